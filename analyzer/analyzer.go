@@ -19,10 +19,12 @@ package analyzer
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -42,6 +44,7 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/stargz-snapshotter/analyzer/fanotify"
 	"github.com/containerd/stargz-snapshotter/analyzer/recorder"
+	"github.com/containerd/stargz-snapshotter/util/tracing"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/identity"
 	runtimespec "github.com/opencontainers/runtime-spec/specs-go"
@@ -50,6 +53,43 @@ import (
 
 var defaultPeriod = 10 * time.Second
 
+// ErrWorkloadTimeout is returned by Analyze when the workload doesn't complete within
+// the duration specified by WithTimeout.
+var ErrWorkloadTimeout = errors.New("workload didn't complete before the timeout")
+
+// Report is the summary of an analysis.
+type Report struct {
+	// AccessedPaths is the number of distinct paths accessed by the workload.
+	AccessedPaths int `json:"accessedPaths"`
+
+	// RecordedPaths is the number of distinct accessed paths recorded as prioritized
+	// files. Paths that don't exist in the image (e.g. files created by the workload)
+	// aren't recorded.
+	RecordedPaths int `json:"recordedPaths"`
+
+	// Killed is true if the workload was killed by the analyzer (e.g. when the waited
+	// line was detected or the period elapsed) instead of exiting by itself.
+	Killed bool `json:"killed"`
+
+	// ExitCode is the exit code of the workload.
+	ExitCode uint32 `json:"exitCode"`
+
+	// Duration is the time the workload ran.
+	Duration time.Duration `json:"duration"`
+
+	// ShutdownPaths is the number of paths recorded in the shutdown phase. This is
+	// counted only with WithShutdownRecording.
+	ShutdownPaths int `json:"shutdownPaths,omitempty"`
+}
+
+// Coverage returns the ratio of the recorded paths to the accessed paths.
+func (r *Report) Coverage() float64 {
+	if r.AccessedPaths == 0 {
+		return 1
+	}
+	return float64(r.RecordedPaths) / float64(r.AccessedPaths)
+}
+
 // Analyze analyzes the passed image then store the record of prioritized files into
 // containerd's content store. This function returns the digest of that record file.
 // This digest can be used to read record from the content store.
@@ -61,6 +101,13 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 	if aOpts.terminal && aOpts.waitOnSignal {
 		return "", fmt.Errorf("wait-on-signal option cannot be used with terminal option")
 	}
+	if aOpts.timeout > 0 && aOpts.waitOnSignal {
+		return "", fmt.Errorf("wait-on-signal option cannot be used with timeout option")
+	}
+	report := aOpts.report
+	if report == nil {
+		report = new(Report)
+	}
 
 	target, err := os.MkdirTemp("", "target")
 	if err != nil {
@@ -86,7 +133,10 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 	if unpacked, err := platformImg.IsUnpacked(ctx, aOpts.snapshotter); err != nil {
 		return "", err
 	} else if !unpacked {
-		if err := platformImg.Unpack(ctx, aOpts.snapshotter); err != nil {
+		_, span := tracing.Start(ctx, "unpack")
+		err := platformImg.Unpack(ctx, aOpts.snapshotter)
+		span.End(err)
+		if err != nil {
 			return "", err
 		}
 	}
@@ -135,6 +185,8 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 	}))
 
 	// Create the container and the task
+	_, runSpan := tracing.Start(ctx, "run workload")
+	defer runSpan.End(nil) // nop if ended after the workload
 	var container containerd.Container
 	for i := 0; i < 3; i++ {
 		id := xid.New().String()
@@ -200,10 +252,15 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 	}
 	var fanotifierClosed bool
 	var fanotifierClosedMu sync.Mutex
+	var shutdown int32 // set to 1 when the shutdown phase starts
+	var shutdownPaths int
+	accessed, recorded := make(map[string]struct{}), make(map[string]struct{})
+	recordDone := make(chan struct{})
 	go func() {
 		var successCount int
 		defer func() {
 			log.G(ctx).Debugf("success record %d path", successCount)
+			close(recordDone)
 		}()
 		for {
 			path, err := fanotifier.GetPath()
@@ -219,9 +276,15 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 				log.G(ctx).WithError(err).Error("failed to get notified path")
 				break
 			}
+			accessed[path] = struct{}{}
 			if err := rc.Record(path); err != nil {
 				log.G(ctx).WithError(err).Debugf("failed to record %q", path)
+				continue
 			}
+			if _, ok := recorded[path]; !ok && atomic.LoadInt32(&shutdown) == 1 {
+				shutdownPaths++
+			}
+			recorded[path] = struct{}{}
 			log.G(ctx).Debugf("[abin] record path %s", path)
 			successCount++
 		}
@@ -234,29 +297,52 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 		sigc := commands.ForwardAllSignals(ctx, task)
 		defer commands.StopCatch(sigc)
 	}
+	stop := func(statusC <-chan containerd.ExitStatus) (containerd.ExitStatus, error) {
+		return killTask(ctx, container, task, statusC)
+	}
+	if aOpts.shutdown > 0 {
+		sig, err := containerd.GetOCIStopSignal(ctx, platformImg, "SIGTERM")
+		if err != nil {
+			return "", err
+		}
+		stopSignal, err := containerd.ParseSignal(sig)
+		if err != nil {
+			return "", err
+		}
+		stop = func(statusC <-chan containerd.ExitStatus) (containerd.ExitStatus, error) {
+			rc.SetPhase(recorder.PhaseShutdown)
+			atomic.StoreInt32(&shutdown, 1)
+			return stopTask(ctx, container, task, statusC, stopSignal, aOpts.shutdown)
+		}
+	}
+	start := time.Now()
 	if err := task.Start(ctx); err != nil {
 		return "", err
 	}
 
 	// Wait until the task exit
 	var status containerd.ExitStatus
-	var killOk bool
+	var killOk, timedOut bool
 	if aOpts.waitOnSignal { // NOTE: not functional with `terminal` option
 		log.G(ctx).Infof("press Ctrl+C to terminate the container")
-		status, killOk, err = waitOnSignal(ctx, container, task)
+		status, report.Killed, killOk, err = waitOnSignal(ctx, task, stop)
 		if err != nil {
 			return "", err
 		}
 	} else {
-		if aOpts.period <= 0 {
-			aOpts.period = defaultPeriod
+		period := aOpts.period
+		if aOpts.timeout > 0 {
+			period = aOpts.timeout
+		} else if period <= 0 {
+			period = defaultPeriod
 		}
-		log.G(ctx).Infof("waiting for %v ...", aOpts.period)
-		status, killOk, err = waitOnTimeout(ctx, container, task, aOpts.period, waitLine)
+		log.G(ctx).Infof("waiting for %v ...", period)
+		status, report.Killed, timedOut, killOk, err = waitOnTimeout(ctx, task, period, waitLine, stop)
 		if err != nil {
 			return "", err
 		}
 	}
+	report.Duration = time.Since(start)
 	if !killOk {
 		log.G(ctx).Warnf("failed to exit task %v; manually kill it", task.ID())
 	} else {
@@ -265,6 +351,7 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 			return "", err
 		}
 		log.G(ctx).Infof("container exit with code %v", code)
+		report.ExitCode = code
 		if _, err := task.Delete(ctx); err != nil {
 			return "", err
 		}
@@ -277,9 +364,24 @@ func Analyze(ctx context.Context, client *containerd.Client, ref string, opts ..
 	if err := fanotifier.Close(); err != nil {
 		log.G(ctx).WithError(err).Warnf("failed to cleanup fanotifier")
 	}
+	select {
+	case <-recordDone:
+		report.AccessedPaths, report.RecordedPaths = len(accessed), len(recorded)
+		report.ShutdownPaths = shutdownPaths
+	case <-time.After(5 * time.Second):
+		log.G(ctx).Warnf("timed out waiting for recording accessed paths")
+	}
+	runSpan.SetAttribute("recorded_paths", strconv.Itoa(report.RecordedPaths))
+	runSpan.End(nil)
+	if timedOut && aOpts.timeout > 0 {
+		return "", ErrWorkloadTimeout
+	}
 
 	// Finish recording
-	return rc.Commit(ctx)
+	_, commitSpan := tracing.Start(ctx, "commit record")
+	dgst, err := rc.Commit(ctx)
+	commitSpan.End(err)
+	return dgst, err
 }
 
 func mountImage(ctx context.Context, ss snapshots.Snapshotter, image containerd.Image, mountpoint string) (func(), error) {
@@ -307,47 +409,52 @@ func mountImage(ctx context.Context, ss snapshots.Snapshotter, image containerd.
 	}, nil
 }
 
-func waitOnSignal(ctx context.Context, container containerd.Container, task containerd.Task) (containerd.ExitStatus, bool, error) {
+// stopFunc stops the task and returns its exit status. statusC is the channel of the exit
+// status of the task.
+type stopFunc func(statusC <-chan containerd.ExitStatus) (containerd.ExitStatus, error)
+
+func waitOnSignal(ctx context.Context, task containerd.Task, stop stopFunc) (_ containerd.ExitStatus, killed, ok bool, _ error) {
 	statusC, err := task.Wait(ctx)
 	if err != nil {
-		return containerd.ExitStatus{}, false, err
+		return containerd.ExitStatus{}, false, false, err
 	}
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT)
 	defer signal.Stop(sc)
 	select {
 	case status := <-statusC:
-		return status, true, nil
+		return status, false, true, nil
 	case <-sc:
 		log.G(ctx).Info("signal detected")
-		status, err := killTask(ctx, container, task, statusC)
+		status, err := stop(statusC)
 		if err != nil {
 			log.G(ctx).WithError(err).Warnf("failed to kill container")
-			return containerd.ExitStatus{}, false, nil
+			return containerd.ExitStatus{}, true, false, nil
 		}
-		return status, true, nil
+		return status, true, true, nil
 	}
 }
 
-func waitOnTimeout(ctx context.Context, container containerd.Container, task containerd.Task, period time.Duration, line *lineWaiter) (containerd.ExitStatus, bool, error) {
+func waitOnTimeout(ctx context.Context, task containerd.Task, period time.Duration, line *lineWaiter, stop stopFunc) (_ containerd.ExitStatus, killed, timedOut, ok bool, _ error) {
 	statusC, err := task.Wait(ctx)
 	if err != nil {
-		return containerd.ExitStatus{}, false, err
+		return containerd.ExitStatus{}, false, false, false, err
 	}
 	select {
 	case status := <-statusC:
-		return status, true, nil
+		return status, false, false, true, nil
 	case l := <-line.waitCh:
 		log.G(ctx).Infof("Waiting line detected %q; killing task", l)
 	case <-time.After(period):
 		log.G(ctx).Warnf("killing task. the time period to monitor access log (%s) has timed out", period.String())
+		timedOut = true
 	}
-	status, err := killTask(ctx, container, task, statusC)
+	status, err := stop(statusC)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("failed to kill container")
-		return containerd.ExitStatus{}, false, nil
+		return containerd.ExitStatus{}, true, timedOut, false, nil
 	}
-	return status, true, nil
+	return status, true, timedOut, true, nil
 }
 
 func killTask(ctx context.Context, container containerd.Container, task containerd.Task, statusC <-chan containerd.ExitStatus) (containerd.ExitStatus, error) {
@@ -366,6 +473,22 @@ func killTask(ctx context.Context, container containerd.Container, task containe
 	}
 }
 
+// stopTask sends the stop signal to the task and waits for the exit until the grace
+// period elapses. Then the task is killed.
+func stopTask(ctx context.Context, container containerd.Container, task containerd.Task, statusC <-chan containerd.ExitStatus, sig syscall.Signal, gracePeriod time.Duration) (containerd.ExitStatus, error) {
+	log.G(ctx).Infof("stopping task with %v; recording shutdown for up to %v", sig, gracePeriod)
+	if err := task.Kill(ctx, sig); err != nil && !errdefs.IsNotFound(err) {
+		return containerd.ExitStatus{}, fmt.Errorf("forward %v: %w", sig, err)
+	}
+	select {
+	case status := <-statusC:
+		return status, nil
+	case <-time.After(gracePeriod):
+		log.G(ctx).Warnf("task didn't exit within the grace period %v; killing task", gracePeriod)
+	}
+	return killTask(ctx, container, task, statusC)
+}
+
 type lazyReadCloser struct {
 	reader      io.Reader
 	closer      func()
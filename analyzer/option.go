@@ -31,6 +31,9 @@ type analyzerOpts struct {
 	terminal     bool
 	stdin        bool
 	waitLineOut  string
+	timeout      time.Duration
+	report       *Report
+	shutdown     time.Duration
 }
 
 // Option is runtime configuration of analyzer container
@@ -88,3 +91,29 @@ func WithWaitLineOut(s string) Option {
 		opts.waitLineOut = s
 	}
 }
+
+// WithTimeout makes the analysis fail with ErrWorkloadTimeout if the workload neither
+// exits nor outputs the line specified by WithWaitLineOut within the duration. This
+// overrides WithPeriod.
+func WithTimeout(timeout time.Duration) Option {
+	return func(opts *analyzerOpts) {
+		opts.timeout = timeout
+	}
+}
+
+// WithReport stores the summary of the analysis to the passed report.
+func WithReport(report *Report) Option {
+	return func(opts *analyzerOpts) {
+		opts.report = report
+	}
+}
+
+// WithShutdownRecording makes the analyzer stop the container gracefully with the stop
+// signal of the image (SIGTERM by default) instead of killing it, and record files
+// accessed until it exits (up to the grace period) as the shutdown phase. After the grace
+// period, the container is killed.
+func WithShutdownRecording(gracePeriod time.Duration) Option {
+	return func(opts *analyzerOpts) {
+		opts.shutdown = gracePeriod
+	}
+}
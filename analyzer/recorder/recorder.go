@@ -46,6 +46,9 @@ const (
 	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
 )
 
+// PhaseShutdown is the phase of the workload after it's requested to stop.
+const PhaseShutdown = recorder.PhaseShutdown
+
 // ImageRecorder is a wrapper of recorder.Recroder. This holds the relationship
 // between files and layer index in the specified image. So the client can record
 // files without knowing about which layer this file belongs to.
@@ -55,6 +58,7 @@ type ImageRecorder struct {
 	manifestDigest digest.Digest
 	recordW        content.Writer
 	recordWMu      sync.Mutex
+	phase          string
 }
 
 func NewImageRecorder(ctx context.Context, cs content.Store, img images.Image, platformMC platforms.MatchComparer) (*ImageRecorder, error) {
@@ -161,9 +165,21 @@ func (r *ImageRecorder) Record(name string) error {
 		Path:           name,
 		ManifestDigest: r.manifestDigest.String(),
 		LayerIndex:     &index,
+		Phase:          r.phase,
 	})
 }
 
+// SetPhase sets the phase of the workload recorded with the following files (e.g.
+// PhaseShutdown). Empty phase means the startup.
+func (r *ImageRecorder) SetPhase(phase string) {
+	r.recordWMu.Lock()
+	defer r.recordWMu.Unlock()
+	if phase == recorder.PhaseStartup {
+		phase = ""
+	}
+	r.phase = phase
+}
+
 func (r *ImageRecorder) Commit(ctx context.Context) (digest.Digest, error) {
 	r.recordWMu.Lock()
 	defer r.recordWMu.Unlock()
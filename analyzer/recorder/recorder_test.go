@@ -311,6 +311,66 @@ func TestNodeIndex(t *testing.T) {
 	}
 }
 
+func TestRecordPhase(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to prepare content store: %v", err)
+	}
+	lw, err := content.OpenWriter(ctx, cs, content.WithRef(fmt.Sprintf("recorder-test-%v", xid.New().String())))
+	if err != nil {
+		t.Fatalf("failed to open writer: %v", err)
+	}
+	if _, err := io.Copy(lw, testutil.BuildTar([]testutil.TarEntry{
+		testutil.File("foo", "foo"),
+		testutil.File("bar", "bar"),
+	})); err != nil {
+		t.Fatalf("failed to copy layer: %v", err)
+	}
+	if err := lw.Commit(ctx, 0, ""); err != nil && !errdefs.IsAlreadyExists(err) {
+		t.Fatalf("failed to commit layer: %v", err)
+	}
+	info, err := cs.Info(ctx, lw.Digest())
+	if err != nil {
+		t.Fatalf("failed to get layer info: %v", err)
+	}
+	ir, err := imageRecorderFromManifest(ctx, cs, ocispec.Descriptor{}, ocispec.Manifest{
+		Layers: []ocispec.Descriptor{{Digest: info.Digest, Size: info.Size, MediaType: ocispec.MediaTypeImageLayer}},
+	})
+	if err != nil {
+		t.Fatalf("failed to get recorder: %v", err)
+	}
+	defer ir.Close()
+	if err := ir.Record("foo"); err != nil {
+		t.Fatalf("failed to record foo: %v", err)
+	}
+	ir.SetPhase(PhaseShutdown)
+	if err := ir.Record("bar"); err != nil {
+		t.Fatalf("failed to record bar: %v", err)
+	}
+	recordOut, err := ir.Commit(ctx)
+	if err != nil {
+		t.Fatalf("failed to commit record: %v", err)
+	}
+	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
+	if err != nil {
+		t.Fatalf("failed to get record out: %v", err)
+	}
+	defer ra.Close()
+	dec := json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size()))
+	var got []recorder.Entry
+	for dec.More() {
+		var e recorder.Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("failed to decode record: %v", err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 2 || got[0].Path != "foo" || got[0].Phase != "" || got[1].Path != "bar" || got[1].Phase != PhaseShutdown {
+		t.Errorf("unexpected record %+v", got)
+	}
+}
+
 func gzipCompress(r io.Reader) io.Reader {
 	pr, pw := io.Pipe()
 	go func() {
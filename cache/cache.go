@@ -18,6 +18,7 @@ package cache
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
@@ -34,6 +35,20 @@ const (
 	defaultMaxCacheFds      = 10
 )
 
+// Counters of cache lookups exposed via expvar for debugging.
+var (
+	hitCount  = expvar.NewInt("stargz_cache_hit_count")
+	missCount = expvar.NewInt("stargz_cache_miss_count")
+)
+
+func countLookup(err error) {
+	if err != nil {
+		missCount.Add(1)
+	} else {
+		hitCount.Add(1)
+	}
+}
+
 type DirectoryCacheConfig struct {
 
 	// Number of entries of LRU cache (default: 10).
@@ -84,6 +99,14 @@ type Reader interface {
 	Close() error
 }
 
+// FileReader is a Reader backed by a file in the cache. The file descriptor returned by
+// Fd is valid until the reader is closed so the caller can pass it to the kernel (e.g. for
+// splicing the data to FUSE) instead of copying the data into its own buffers.
+type FileReader interface {
+	Reader
+	Fd() uintptr
+}
+
 // Writer enables the client to cache byte data. Commit() must be
 // called after data is fully written to Write(). To abort the written
 // data, Abort() must be called.
@@ -94,7 +117,9 @@ type Writer interface {
 }
 
 type cacheOpt struct {
-	direct bool
+	direct         bool
+	preferFile     bool
+	noAccessRecord bool
 }
 
 type Option func(o *cacheOpt) *cacheOpt
@@ -110,6 +135,27 @@ func Direct() Option {
 	}
 }
 
+// PreferFile option lets Get return a FileReader when the contents are stored in a file,
+// instead of a reader of the on-memory copy. The on-memory cache is used only when the
+// contents aren't in a file yet.
+func PreferFile() Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.preferFile = true
+		return o
+	}
+}
+
+// NoAccessRecord option lets Get not record the access to the value. This is used for
+// reads that shouldn't affect the statistics of accesses (e.g. files opened with
+// O_NOATIME by backup tools and scanners), which are used for deciding values kept in
+// caches.
+func NoAccessRecord() Option {
+	return func(o *cacheOpt) *cacheOpt {
+		o.noAccessRecord = true
+		return o
+	}
+}
+
 func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache, error) {
 	if !filepath.IsAbs(directory) {
 		return nil, fmt.Errorf("dir cache path must be an absolute path; got %q", directory)
@@ -183,6 +229,12 @@ type directoryCache struct {
 }
 
 func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
+	r, err := dc.get(key, opts...)
+	countLookup(err)
+	return r, err
+}
+
+func (dc *directoryCache) get(key string, opts ...Option) (Reader, error) {
 	if dc.isClosed() {
 		return nil, fmt.Errorf("cache is already closed")
 	}
@@ -194,20 +246,16 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 
 	if !dc.direct && !opt.direct {
 		// Get data from memory
-		if b, done, ok := dc.cache.Get(key); ok {
-			return &reader{
-				ReaderAt: bytes.NewReader(b.(*bytes.Buffer).Bytes()),
-				closeFunc: func() error {
-					done()
-					return nil
-				},
-			}, nil
+		if !opt.preferFile {
+			if r, ok := dc.getMemory(key); ok {
+				return r, nil
+			}
 		}
 
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
-			return &reader{
-				ReaderAt: f.(*os.File),
+			return &fileReader{
+				file: f.(*os.File),
 				closeFunc: func() error {
 					done() // file will be closed when it's evicted from the cache
 					return nil
@@ -221,6 +269,12 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
+		if !dc.direct && !opt.direct && opt.preferFile {
+			// The file may not be written yet
+			if r, ok := dc.getMemory(key); ok {
+				return r, nil
+			}
+		}
 		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
 	}
 
@@ -228,28 +282,41 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	// This option is useful for preventing memory cache from being polluted by data
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
-		return &reader{
-			ReaderAt:  file,
+		return &fileReader{
+			file:      file,
 			closeFunc: func() error { return file.Close() },
 		}, nil
 	}
 
-	// TODO: should we cache the entire file data on memory?
-	//       but making I/O (possibly huge) on every fetching
-	//       might be costly.
-	return &reader{
-		ReaderAt: file,
+	// Keep the file opened in the fd cache while the reader is used so that the file
+	// descriptor is valid until the reader is closed.
+	f, done, added := dc.fileCache.Add(key, file)
+	if !added {
+		file.Close() // file already exists in the cache. close it.
+	}
+	return &fileReader{
+		file: f.(*os.File),
 		closeFunc: func() error {
-			_, done, added := dc.fileCache.Add(key, file)
-			defer done() // Release it immediately. Cleaned up on eviction.
-			if !added {
-				return file.Close() // file already exists in the cache. close it.
-			}
+			done() // file will be closed when it's evicted from the cache
 			return nil
 		},
 	}, nil
 }
 
+func (dc *directoryCache) getMemory(key string) (Reader, bool) {
+	b, done, ok := dc.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return &reader{
+		ReaderAt: bytes.NewReader(b.(*bytes.Buffer).Bytes()),
+		closeFunc: func() error {
+			done()
+			return nil
+		},
+	}, true
+}
+
 func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if dc.isClosed() {
 		return nil, fmt.Errorf("cache is already closed")
@@ -384,8 +451,10 @@ func (mc *MemoryCache) Get(key string, opts ...Option) (Reader, error) {
 	defer mc.mu.Unlock()
 	b, ok := mc.Membuf[key]
 	if !ok {
+		missCount.Add(1)
 		return nil, fmt.Errorf("Missed cache: %q", key)
 	}
+	hitCount.Add(1)
 	return &reader{bytes.NewReader(b.Bytes()), func() error { return nil }}, nil
 }
 
@@ -414,6 +483,15 @@ type reader struct {
 
 func (r *reader) Close() error { return r.closeFunc() }
 
+type fileReader struct {
+	file      *os.File
+	closeFunc func() error
+}
+
+func (r *fileReader) ReadAt(p []byte, offset int64) (int, error) { return r.file.ReadAt(p, offset) }
+func (r *fileReader) Fd() uintptr                                { return r.file.Fd() }
+func (r *fileReader) Close() error                               { return r.closeFunc() }
+
 type writer struct {
 	io.WriteCloser
 	commitFunc func() error
@@ -23,11 +23,16 @@
 package cache
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -71,6 +76,307 @@ func TestDirectoryCache(t *testing.T) {
 	testCache(t, "dir-with-small-mem", newCache)
 }
 
+func TestTieredDirectoryCache(t *testing.T) {
+	testCache(t, "tiered", func() (BlobCache, cleanFunc) {
+		fast, slow := t.TempDir(), t.TempDir()
+		c, err := NewTieredDirectoryCache([]string{fast, slow}, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 10,
+			SyncAdd:          true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() {}
+	})
+
+	fast, slow := t.TempDir(), t.TempDir()
+	c, err := NewTieredDirectoryCache([]string{fast, slow}, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	key := digestFor(sampleData)
+	w, err := c.Add(key, Direct())
+	if err != nil {
+		t.Fatalf("failed to add %v: %v", key, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write %v: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %v: %v", key, err)
+	}
+	w.Close()
+	inTier := func(dir string) bool {
+		_, err := os.Stat(filepath.Join(dir, key[:2], key))
+		return err == nil
+	}
+	if inTier(fast) || !inTier(slow) {
+		t.Fatalf("contents added with Direct option must be placed on the slowest tier")
+	}
+
+	// Reading contents from the slow tier copies them to the fast tier.
+	testChunk(t, c, key, 0, sampleData)
+	for i := 0; !inTier(fast); i++ {
+		if i > 100 {
+			t.Fatalf("contents aren't copied to the fastest tier")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testChunk(t, c, key, 0, sampleData)
+}
+
+func TestPreferFile(t *testing.T) {
+	c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{
+		MaxLRUCacheEntry: 10,
+		MaxCacheFds:      1,
+		SyncAdd:          true,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	add := func(key, data string) {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %v: %v", key, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("failed to write %v: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %v: %v", key, err)
+		}
+		w.Close()
+	}
+	key := digestFor(sampleData)
+	add(key, sampleData)
+
+	// The contents are served from memory by default.
+	r, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get %v: %v", key, err)
+	}
+	if _, ok := r.(FileReader); ok {
+		t.Errorf("contents on memory must be served without a file")
+	}
+	r.Close()
+
+	r, err = c.Get(key, PreferFile())
+	if err != nil {
+		t.Fatalf("failed to get %v with PreferFile: %v", key, err)
+	}
+	fr, ok := r.(FileReader)
+	if !ok {
+		t.Fatalf("contents must be served from a file with PreferFile")
+	}
+
+	// The file must be kept opened while it's used even if it's evicted from the fd cache.
+	key2 := digestFor("another")
+	add(key2, "another")
+	r2, err := c.Get(key2, PreferFile())
+	if err != nil {
+		t.Fatalf("failed to get %v: %v", key2, err)
+	}
+	r2.Close()
+	p := make([]byte, len(sampleData))
+	if _, err := syscall.Pread(int(fr.Fd()), p, 0); err != nil || string(p) != sampleData {
+		t.Errorf("failed to read from the descriptor: %q (err: %v)", p, err)
+	}
+	fr.Close()
+}
+
+func TestHotCache(t *testing.T) {
+	newHotCache := func(maxSize int64) (BlobCache, string) {
+		dc, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{SyncAdd: true})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		hotDir := t.TempDir()
+		c, err := NewHotCache(dc, hotDir, HotCacheConfig{MaxSize: maxSize, MinHits: 2})
+		if err != nil {
+			t.Fatalf("failed to make hot cache: %v", err)
+		}
+		return c, hotDir
+	}
+	testCache(t, "hot", func() (BlobCache, cleanFunc) {
+		c, _ := newHotCache(1024)
+		return c, func() {}
+	})
+
+	c, hotDir := newHotCache(int64(len(sampleData)))
+	defer c.Close()
+	add := func(sample string) string {
+		key := digestFor(sample)
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %v: %v", key, err)
+		}
+		if _, err := w.Write([]byte(sample)); err != nil {
+			t.Fatalf("failed to write %v: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %v: %v", key, err)
+		}
+		w.Close()
+		return key
+	}
+	isHot := func(key string) bool {
+		_, err := os.Stat(filepath.Join(hotDir, key))
+		return err == nil
+	}
+	waitHot := func(key string) {
+		for i := 0; !isHot(key); i++ {
+			if i > 100 {
+				t.Fatalf("contents of %v aren't kept in the hot directory", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	key := add(sampleData)
+	testChunk(t, c, key, 0, sampleData)
+	time.Sleep(10 * time.Millisecond)
+	if isHot(key) {
+		t.Fatalf("contents must not be hot before reaching the minimum hits")
+	}
+	testChunk(t, c, key, 0, sampleData)
+	waitHot(key)
+	testChunk(t, c, key, 0, sampleData)
+
+	// Another hot contents evict the least recently used ones.
+	sample2 := sampleData[:len(sampleData)-1] + "x"
+	key2 := add(sample2)
+	testChunk(t, c, key2, 0, sample2)
+	testChunk(t, c, key2, 0, sample2)
+	waitHot(key2)
+	if isHot(key) {
+		t.Fatalf("contents exceeding the max size must be evicted")
+	}
+	testChunk(t, c, key, 0, sampleData)
+}
+
+func TestAccessStatsCache(t *testing.T) {
+	statsPath := filepath.Join(t.TempDir(), "stats")
+	newStatsCache := func() BlobCache {
+		dc, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{SyncAdd: true})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		c, err := NewAccessStatsCache(dc, statsPath, 0)
+		if err != nil {
+			t.Fatalf("failed to make access stats cache: %v", err)
+		}
+		return c
+	}
+	testCache(t, "stats", func() (BlobCache, cleanFunc) {
+		return newStatsCache(), func() { os.Remove(statsPath) }
+	})
+
+	c := newStatsCache()
+	key := digestFor(sampleData)
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %v: %v", key, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write %v: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %v: %v", key, err)
+	}
+	w.Close()
+	for i := 0; i < 3; i++ {
+		testChunk(t, c, key, 0, sampleData)
+	}
+	if _, err := c.Get(digestFor("dummy")); err == nil {
+		t.Fatalf("unexpected hit of unknown key")
+	}
+	r, err := c.Get(key, NoAccessRecord()) // must not be counted
+	if err != nil {
+		t.Fatalf("failed to get %v: %v", key, err)
+	}
+	r.Close()
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	// Stats must survive re-creating the cache.
+	s, err := LoadAccessStats(statsPath)
+	if err != nil {
+		t.Fatalf("failed to load stats: %v", err)
+	}
+	ks, ok := s.Get(key)
+	if !ok || ks.Hits != 3 {
+		t.Fatalf("hits of %v = %d (found: %v); want 3", key, ks.Hits, ok)
+	}
+	if time.Since(ks.LastAccess) > time.Minute {
+		t.Errorf("unexpected last access time %v", ks.LastAccess)
+	}
+	if _, ok := s.Get(digestFor("dummy")); ok {
+		t.Errorf("misses must not be recorded")
+	}
+	c = newStatsCache()
+	defer c.Close()
+	if _, err := c.Get(key); err == nil {
+		t.Fatalf("contents must not survive in the new cache")
+	}
+	if got := c.(*statsCache).AccessStats(); got == nil {
+		t.Fatalf("no stats")
+	} else if ks, _ := got.Get(key); ks.Hits != 3 {
+		t.Errorf("hits of %v after reload = %d; want 3", key, ks.Hits)
+	}
+}
+
+func TestSmallObjectCache(t *testing.T) {
+	newSmallObjectCache := func() (BlobCache, string) {
+		dir := t.TempDir()
+		dc, err := NewDirectoryCache(dir, DirectoryCacheConfig{SyncAdd: true})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		c, err := NewSmallObjectCache(dc, t.TempDir(), SmallObjectCacheConfig{MaxObjectSize: 5})
+		if err != nil {
+			t.Fatalf("failed to make small object cache: %v", err)
+		}
+		return c, dir
+	}
+	testCache(t, "small", func() (BlobCache, cleanFunc) {
+		c, _ := newSmallObjectCache()
+		return c, func() { c.Close() }
+	})
+
+	c, dir := newSmallObjectCache()
+	defer c.Close()
+	for _, sample := range []string{"test", sampleData} {
+		key := digestFor(sample)
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %v: %v", key, err)
+		}
+		// Write in pieces so that the writer switches the store in the middle.
+		for i := 0; i < len(sample); i += 3 {
+			end := i + 3
+			if end > len(sample) {
+				end = len(sample)
+			}
+			if _, err := w.Write([]byte(sample[i:end])); err != nil {
+				t.Fatalf("failed to write %v: %v", key, err)
+			}
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %v: %v", key, err)
+		}
+		w.Close()
+		testChunk(t, c, key, 0, sample)
+
+		_, err = os.Stat(filepath.Join(dir, key[:2], key))
+		if inFile, wantFile := err == nil, len(sample) > 5; inFile != wantFile {
+			t.Errorf("contents of %d bytes stored in a file: %v; want %v", len(sample), inFile, wantFile)
+		}
+	}
+}
+
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func() (BlobCache, cleanFunc) { return NewMemoryCache(), func() {} })
 }
@@ -172,6 +478,104 @@ func hit(sample string) check {
 	}
 }
 
+func TestPrefetcher(t *testing.T) {
+	c := NewMemoryCache()
+	p := NewPrefetcher(2)
+	ctx := context.Background()
+
+	// Requests of the same key in flight are deduplicated.
+	release := make(chan struct{})
+	fills := make(chan string, 10)
+	blocking := func(key string) Request {
+		return Request{Key: key, Fill: func(w io.Writer) error {
+			fills <- key
+			<-release
+			_, err := w.Write([]byte(sampleData))
+			return err
+		}}
+	}
+	var committed int
+	req := blocking("a")
+	req.OnCommit = func() { committed++ }
+	t1 := p.Ensure(ctx, c, []Request{req, blocking("b")})
+	t2 := p.Ensure(ctx, c, []Request{blocking("a")})
+	close(release)
+	if err := t1.Wait(ctx); err != nil {
+		t.Fatalf("failed to wait for t1: %v", err)
+	}
+	if err := t2.Wait(ctx); err != nil {
+		t.Fatalf("failed to wait for t2: %v", err)
+	}
+	if n := len(fills); n != 2 {
+		t.Errorf("filled %d times; want 2", n)
+	}
+	if committed != 1 {
+		t.Errorf("committed %d times; want 1", committed)
+	}
+	testChunk(t, c, "a", 0, sampleData)
+	testChunk(t, c, "b", 0, sampleData)
+
+	// Existing keys aren't filled again and failed fills aren't committed.
+	failed := errors.New("failed")
+	t3 := p.Ensure(ctx, c, []Request{blocking("a"), {Key: "c", Fill: func(w io.Writer) error {
+		w.Write([]byte(sampleData))
+		return failed
+	}}})
+	if err := t3.Wait(ctx); !errors.Is(err, failed) {
+		t.Errorf("error = %v; want %v", err, failed)
+	}
+	if _, err := c.Get("c"); err == nil {
+		t.Errorf("failed fill is committed")
+	}
+	want := PrefetcherStats{Requested: 3, Deduplicated: 1, Filled: 2, Failed: 1}
+	if s := p.Stats(); s != want {
+		t.Errorf("stats = %+v; want %+v", s, want)
+	}
+}
+
+func TestPrefetcherLimit(t *testing.T) {
+	c := NewMemoryCache()
+	p := NewPrefetcher(1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	t1 := p.Ensure(context.Background(), c, []Request{{Key: "a", Fill: func(w io.Writer) error {
+		close(started)
+		<-release
+		_, err := w.Write([]byte(sampleData))
+		return err
+	}}})
+	<-started
+
+	// Requests wait for the limit of concurrent fills before starting to fill.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	t2 := p.Ensure(ctx, c, []Request{{Key: "b", Fill: func(w io.Writer) error {
+		t.Errorf("fill must not start beyond the limit")
+		return nil
+	}}})
+	if err := t2.Wait(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	// Requests joining in-flight fills don't wait for the limit.
+	t3 := p.Ensure(context.Background(), c, []Request{{Key: "a"}})
+	if t3.Done() {
+		t.Errorf("joined request must not be done before the fill")
+	}
+	close(release)
+	for _, tk := range []*Ticket{t1, t3} {
+		if err := tk.Wait(context.Background()); err != nil {
+			t.Fatalf("failed to wait: %v", err)
+		}
+	}
+	testChunk(t, c, "a", 0, sampleData)
+	want := PrefetcherStats{Requested: 1, Deduplicated: 1, Filled: 1}
+	if s := p.Stats(); s != want {
+		t.Errorf("stats = %+v; want %+v", s, want)
+	}
+}
+
 func testChunk(t *testing.T, c BlobCache, key string, offset int64, sample string) {
 	p := make([]byte, len(sample))
 	r, err := c.Get(key)
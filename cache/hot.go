@@ -0,0 +1,197 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxHotCandidates is the maximum number of keys whose hits are counted at once.
+const maxHotCandidates = 65536
+
+// HotCacheConfig is config for NewHotCache.
+type HotCacheConfig struct {
+	// MaxSize is the maximum total bytes of contents stored in the directory.
+	MaxSize int64
+
+	// MinHits is the number of hits in the underlying cache after which the contents
+	// are copied to the directory (default: 2).
+	MinHits int
+}
+
+// NewHotCache returns a cache that keeps contents frequently read from the underlying
+// cache as read-only files in the directory. The directory is meant to be on tmpfs so
+// that these contents are served from memory even when the page cache of the
+// underlying cache is dropped (e.g. by random reads over huge files). Contents are
+// evicted in LRU order when the total size exceeds config.MaxSize.
+//
+// Contents added to this cache go to the underlying cache. Contents read with Direct
+// option don't count as hits.
+func NewHotCache(underlying BlobCache, directory string, config HotCacheConfig) (BlobCache, error) {
+	if config.MaxSize <= 0 {
+		return nil, fmt.Errorf("max size of hot cache must be positive")
+	}
+	if config.MinHits <= 0 {
+		config.MinHits = 2
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &hotCache{
+		BlobCache: underlying,
+		directory: directory,
+		config:    config,
+		hits:      make(map[string]int),
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}, nil
+}
+
+type hotCache struct {
+	BlobCache
+	directory string
+	config    HotCacheConfig
+
+	mu      sync.Mutex
+	hits    map[string]int
+	entries map[string]*list.Element // values are *hotEntry
+	lru     *list.List
+	size    int64
+	closed  bool
+
+	// promoting is a set of keys being copied to the directory.
+	promoting sync.Map
+}
+
+type hotEntry struct {
+	key  string
+	size int64
+}
+
+func (hc *hotCache) Get(key string, opts ...Option) (Reader, error) {
+	if r, err := hc.getHot(key); err == nil {
+		countLookup(nil)
+		return r, nil
+	}
+	r, err := hc.BlobCache.Get(key, opts...)
+	if err != nil || isDirect(opts) || isNoAccessRecord(opts) {
+		return r, err
+	}
+	hc.mu.Lock()
+	if len(hc.hits) >= maxHotCandidates {
+		hc.hits = make(map[string]int) // forget stale candidates
+	}
+	hc.hits[key]++
+	promote := hc.hits[key] >= hc.config.MinHits
+	hc.mu.Unlock()
+	if promote {
+		go hc.promote(key)
+	}
+	return r, nil
+}
+
+func (hc *hotCache) getHot(key string) (Reader, error) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	e, ok := hc.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("not hot")
+	}
+	// Evicted files are removed while holding the lock so this never opens a file
+	// being removed.
+	f, err := os.Open(hc.hotPath(key))
+	if err != nil {
+		return nil, err
+	}
+	hc.lru.MoveToFront(e)
+	return f, nil
+}
+
+// promote copies the contents of the key from the underlying cache to the directory.
+func (hc *hotCache) promote(key string) {
+	if _, loaded := hc.promoting.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	defer hc.promoting.Delete(key)
+	r, err := hc.BlobCache.Get(key, Direct())
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(hc.directory, "tmp-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(io.NewSectionReader(r, 0, math.MaxInt64), hc.config.MaxSize+1))
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil || n > hc.config.MaxSize {
+		return
+	}
+	if err := os.Chmod(tmp.Name(), 0400); err != nil {
+		return
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if _, ok := hc.entries[key]; ok || hc.closed {
+		return
+	}
+	for hc.size+n > hc.config.MaxSize {
+		hc.evictLocked()
+	}
+	if err := os.Rename(tmp.Name(), hc.hotPath(key)); err != nil {
+		return
+	}
+	hc.entries[key] = hc.lru.PushFront(&hotEntry{key: key, size: n})
+	hc.size += n
+	delete(hc.hits, key)
+}
+
+func (hc *hotCache) evictLocked() {
+	oldest := hc.lru.Back()
+	if oldest == nil {
+		return
+	}
+	e := hc.lru.Remove(oldest).(*hotEntry)
+	delete(hc.entries, e.key)
+	hc.size -= e.size
+	os.Remove(hc.hotPath(e.key)) // opened readers can still read the contents
+}
+
+func (hc *hotCache) Close() error {
+	hc.mu.Lock()
+	hc.closed = true
+	hc.mu.Unlock()
+	err := hc.BlobCache.Close()
+	if rErr := os.RemoveAll(hc.directory); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+func (hc *hotCache) hotPath(key string) string {
+	return filepath.Join(hc.directory, key)
+}
@@ -0,0 +1,226 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Request is a request to ensure that the contents of the key exist in a cache.
+type Request struct {
+	// Key is the key of the contents.
+	Key string
+
+	// Fill writes the contents of the key (e.g. fetched from the registry). The contents
+	// are committed to the cache only if this succeeds.
+	Fill func(w io.Writer) error
+
+	// OnCommit is called after the contents are committed to the cache. This can be nil.
+	OnCommit func()
+}
+
+// Prefetcher fills caches with contents in background, independently of readers of
+// files. Requests of the same key of the same cache are deduplicated while they are in
+// flight so that the contents are filled once even if prefetch, background fetch and
+// other warmers request them at once. Requests share the limit of concurrent fills.
+type Prefetcher struct {
+	// Counters are placed first to be 64-bit aligned for atomic operations.
+	requested    uint64
+	deduplicated uint64
+	filled       uint64
+	failed       uint64
+
+	sem chan struct{}
+
+	mu       sync.Mutex
+	inflight map[prefetchKey]*prefetchJob
+}
+
+type prefetchKey struct {
+	c   BlobCache
+	key string
+}
+
+type prefetchJob struct {
+	done chan struct{}
+	err  error
+}
+
+// NewPrefetcher returns a Prefetcher filling up to concurrency keys at once.
+func NewPrefetcher(concurrency int) *Prefetcher {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &Prefetcher{
+		sem:      make(chan struct{}, concurrency),
+		inflight: make(map[prefetchKey]*prefetchJob),
+	}
+}
+
+// PrefetcherStats is the statistics of a Prefetcher.
+type PrefetcherStats struct {
+	// Requested is the number of requested keys missing in caches.
+	Requested uint64
+
+	// Deduplicated is the number of requests that joined in-flight fills of the same key.
+	Deduplicated uint64
+
+	// Filled and Failed are the numbers of keys filled and failed to be filled.
+	Filled uint64
+	Failed uint64
+}
+
+// Stats returns the statistics of the prefetcher.
+func (p *Prefetcher) Stats() PrefetcherStats {
+	return PrefetcherStats{
+		Requested:    atomic.LoadUint64(&p.requested),
+		Deduplicated: atomic.LoadUint64(&p.deduplicated),
+		Filled:       atomic.LoadUint64(&p.filled),
+		Failed:       atomic.LoadUint64(&p.failed),
+	}
+}
+
+// Ticket is the handle of requests scheduled by Prefetcher.Ensure.
+type Ticket struct {
+	keys []string
+	jobs []*prefetchJob
+}
+
+// Done reports whether all requests of the ticket are completed.
+func (t *Ticket) Done() bool {
+	for _, j := range t.jobs {
+		select {
+		case <-j.done:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Wait waits for completion of all requests of the ticket and returns their errors.
+func (t *Ticket) Wait(ctx context.Context) error {
+	var allErr error
+	for i, j := range t.jobs {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if j.err != nil {
+			allErr = multierror.Append(allErr, fmt.Errorf("failed to fill %q: %w", t.keys[i], j.err))
+		}
+	}
+	return allErr
+}
+
+// Ensure schedules the requests whose keys don't exist in the cache. If a key is already
+// being filled, the request joins it. Otherwise, Ensure blocks while the limit of
+// concurrent fills is reached so that fills (and their goroutines) never exceed the
+// limit. Requests that can't be scheduled before the context is done fail with its
+// error. opts are passed to the cache.
+func (p *Prefetcher) Ensure(ctx context.Context, c BlobCache, reqs []Request, opts ...Option) *Ticket {
+	t := &Ticket{}
+	for _, req := range reqs {
+		if r, err := c.Get(req.Key, opts...); err == nil {
+			r.Close()
+			continue
+		}
+		k := prefetchKey{c, req.Key}
+		j, created, err := p.acquire(ctx, k)
+		if err != nil {
+			j = &prefetchJob{done: make(chan struct{}), err: err}
+			close(j.done)
+		} else if created {
+			atomic.AddUint64(&p.requested, 1)
+			go p.run(k, req, j, opts...)
+		} else {
+			atomic.AddUint64(&p.deduplicated, 1)
+		}
+		t.keys, t.jobs = append(t.keys, req.Key), append(t.jobs, j)
+	}
+	return t
+}
+
+// acquire returns the in-flight job of the key or, if there is none, a new job holding a
+// slot of concurrent fills (created is true).
+func (p *Prefetcher) acquire(ctx context.Context, k prefetchKey) (j *prefetchJob, created bool, _ error) {
+	p.mu.Lock()
+	j, ok := p.inflight[k]
+	p.mu.Unlock()
+	if ok {
+		return j, false, nil
+	}
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if j, ok := p.inflight[k]; ok {
+		// The key started to be filled while waiting.
+		<-p.sem
+		return j, false, nil
+	}
+	j = &prefetchJob{done: make(chan struct{})}
+	p.inflight[k] = j
+	return j, true, nil
+}
+
+func (p *Prefetcher) run(k prefetchKey, req Request, j *prefetchJob, opts ...Option) {
+	j.err = p.fill(k.c, req, opts...)
+	<-p.sem
+	if j.err != nil {
+		atomic.AddUint64(&p.failed, 1)
+	} else {
+		atomic.AddUint64(&p.filled, 1)
+	}
+	p.mu.Lock()
+	delete(p.inflight, k)
+	p.mu.Unlock()
+	close(j.done)
+}
+
+func (p *Prefetcher) fill(c BlobCache, req Request, opts ...Option) error {
+	// The key can be added by readers of files while waiting.
+	if r, err := c.Get(req.Key, opts...); err == nil {
+		return r.Close()
+	}
+	w, err := c.Add(req.Key, opts...)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := req.Fill(w); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	if req.OnCommit != nil {
+		req.OnCommit()
+	}
+	return nil
+}
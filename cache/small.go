@@ -0,0 +1,196 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultMaxSmallObjectSize = 4096
+
+var smallObjectBucket = []byte("objects")
+
+// SmallObjectCacheConfig is config for NewSmallObjectCache.
+type SmallObjectCacheConfig struct {
+	// MaxObjectSize is the maximum size of contents stored in the database
+	// (default: 4096).
+	MaxObjectSize int64
+}
+
+// NewSmallObjectCache returns a cache that stores contents not larger than
+// config.MaxObjectSize in a key-value database in the directory, instead of storing
+// them as individual files in the underlying cache. This saves space and inodes wasted
+// by tiny chunks. Larger contents are stored in the underlying cache. The store is
+// selected by the size of the contents so callers don't need to care about it.
+//
+// Contents in the database are never returned as FileReader.
+func NewSmallObjectCache(underlying BlobCache, directory string, config SmallObjectCacheConfig) (BlobCache, error) {
+	if config.MaxObjectSize <= 0 {
+		config.MaxObjectSize = defaultMaxSmallObjectSize
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	// The database is discarded on Close so it doesn't need to survive crashes.
+	db, err := bolt.Open(filepath.Join(directory, "objects.db"), 0600, &bolt.Options{
+		NoSync:         true,
+		NoFreelistSync: true,
+		NoGrowSync:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open small object database: %w", err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(smallObjectBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &smallObjectCache{
+		BlobCache: underlying,
+		directory: directory,
+		config:    config,
+		db:        db,
+	}, nil
+}
+
+type smallObjectCache struct {
+	BlobCache
+	directory string
+	config    SmallObjectCacheConfig
+	db        *bolt.DB
+
+	closed   bool
+	closedMu sync.Mutex
+}
+
+func (sc *smallObjectCache) Get(key string, opts ...Option) (Reader, error) {
+	if b := sc.getSmall(key); b != nil {
+		countLookup(nil)
+		return &reader{bytes.NewReader(b), func() error { return nil }}, nil
+	}
+	return sc.BlobCache.Get(key, opts...)
+}
+
+func (sc *smallObjectCache) getSmall(key string) (b []byte) {
+	if sc.isClosed() {
+		return nil
+	}
+	sc.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(smallObjectBucket).Get([]byte(key)); v != nil {
+			b = append([]byte{}, v...) // v is valid only in this transaction
+		}
+		return nil
+	})
+	return b
+}
+
+func (sc *smallObjectCache) Add(key string, opts ...Option) (Writer, error) {
+	if sc.isClosed() {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	return &smallObjectWriter{sc: sc, key: key, opts: opts}, nil
+}
+
+func (sc *smallObjectCache) Close() error {
+	sc.closedMu.Lock()
+	if sc.closed {
+		sc.closedMu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	sc.closedMu.Unlock()
+	err := sc.BlobCache.Close()
+	if dErr := sc.db.Close(); err == nil {
+		err = dErr
+	}
+	if rErr := os.RemoveAll(sc.directory); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+func (sc *smallObjectCache) isClosed() bool {
+	sc.closedMu.Lock()
+	closed := sc.closed
+	sc.closedMu.Unlock()
+	return closed
+}
+
+// smallObjectWriter buffers the contents until they exceed the max size of small
+// objects. After that, the contents are written to the underlying cache.
+type smallObjectWriter struct {
+	sc   *smallObjectCache
+	key  string
+	opts []Option
+	buf  bytes.Buffer
+	w    Writer
+}
+
+func (w *smallObjectWriter) Write(p []byte) (int, error) {
+	if w.w == nil && int64(w.buf.Len()+len(p)) > w.sc.config.MaxObjectSize {
+		uw, err := w.sc.BlobCache.Add(w.key, w.opts...)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := uw.Write(w.buf.Bytes()); err != nil {
+			uw.Abort()
+			uw.Close()
+			return 0, err
+		}
+		w.buf.Reset()
+		w.w = uw
+	}
+	if w.w != nil {
+		return w.w.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *smallObjectWriter) Commit() error {
+	if w.w != nil {
+		return w.w.Commit()
+	}
+	if w.sc.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	return w.sc.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(smallObjectBucket).Put([]byte(w.key), w.buf.Bytes())
+	})
+}
+
+func (w *smallObjectWriter) Abort() error {
+	if w.w != nil {
+		return w.w.Abort()
+	}
+	w.buf.Reset()
+	return nil
+}
+
+func (w *smallObjectWriter) Close() error {
+	if w.w != nil {
+		return w.w.Close()
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// accessStatsMagic is the header of the access stats file.
+var accessStatsMagic = []byte("SGZSTAT1")
+
+// KeyStats is the access statistics of a key.
+type KeyStats struct {
+	// Hits is the number of successful lookups of the key.
+	Hits uint64
+
+	// LastAccess is the time of the last successful lookup of the key.
+	LastAccess time.Time
+}
+
+// AccessStats is per-key access statistics of a cache, which can be used for eviction
+// and visualizing access patterns (e.g. heatmaps). This is safe for concurrent use.
+type AccessStats struct {
+	mu    sync.Mutex
+	m     map[string]*KeyStats
+	dirty bool
+}
+
+// NewAccessStats returns empty statistics.
+func NewAccessStats() *AccessStats {
+	return &AccessStats{m: make(map[string]*KeyStats)}
+}
+
+// LoadAccessStats reads statistics written by Save. Empty statistics are returned if
+// the file doesn't exist.
+//
+// The file consists of accessStatsMagic followed by records of each key. A record is
+// the length of the key (uvarint), the key, the hits (uvarint) and the last access time
+// in Unix seconds (varint).
+func LoadAccessStats(path string) (*AccessStats, error) {
+	s := NewAccessStats()
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(accessStatsMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(accessStatsMagic) {
+		return nil, fmt.Errorf("invalid access stats file %q", path)
+	}
+	for {
+		keyLen, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read key length: %w", err)
+		}
+		if keyLen > 4096 {
+			return nil, fmt.Errorf("too long key (%d bytes) in access stats", keyLen)
+		}
+		key := make([]byte, keyLen)
+		if _, err := io.ReadFull(br, key); err != nil {
+			return nil, fmt.Errorf("failed to read key: %w", err)
+		}
+		hits, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hits of %q: %w", key, err)
+		}
+		last, err := binary.ReadVarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read last access time of %q: %w", key, err)
+		}
+		s.m[string(key)] = &KeyStats{Hits: hits, LastAccess: time.Unix(last, 0)}
+	}
+	return s, nil
+}
+
+// Save atomically writes the statistics to the file.
+func (s *AccessStats) Save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".stats-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	bw.Write(accessStatsMagic)
+	buf := make([]byte, binary.MaxVarintLen64)
+	for key, ks := range s.m {
+		bw.Write(buf[:binary.PutUvarint(buf, uint64(len(key)))])
+		bw.WriteString(key)
+		bw.Write(buf[:binary.PutUvarint(buf, ks.Hits)])
+		bw.Write(buf[:binary.PutVarint(buf, ks.LastAccess.Unix())])
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Record counts a hit of the key.
+func (s *AccessStats) Record(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ks, ok := s.m[key]
+	if !ok {
+		ks = new(KeyStats)
+		s.m[key] = ks
+	}
+	ks.Hits++
+	ks.LastAccess = time.Now()
+	s.dirty = true
+}
+
+// Get returns the statistics of the key.
+func (s *AccessStats) Get(key string) (KeyStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ks, ok := s.m[key]
+	if !ok {
+		return KeyStats{}, false
+	}
+	return *ks, true
+}
+
+// Walk calls f for the statistics of each key until f returns false.
+func (s *AccessStats) Walk(f func(key string, ks KeyStats) bool) {
+	s.mu.Lock()
+	snapshot := make(map[string]KeyStats, len(s.m))
+	for k, ks := range s.m {
+		snapshot[k] = *ks
+	}
+	s.mu.Unlock()
+	for k, ks := range snapshot {
+		if !f(k, ks) {
+			return
+		}
+	}
+}
+
+func (s *AccessStats) isDirty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dirty
+}
+
+// NewAccessStatsCache returns a cache that records hits of the underlying cache to the
+// statistics persisted at path. The statistics are loaded from path if exists and
+// written back every flushInterval (if positive) and on Close.
+func NewAccessStatsCache(underlying BlobCache, path string, flushInterval time.Duration) (BlobCache, error) {
+	s, err := LoadAccessStats(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &statsCache{
+		BlobCache: underlying,
+		stats:     s,
+		path:      path,
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+	go sc.flushLoop(flushInterval)
+	return sc, nil
+}
+
+type statsCache struct {
+	BlobCache
+	stats     *AccessStats
+	path      string
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	closeOnce sync.Once
+}
+
+func (sc *statsCache) Get(key string, opts ...Option) (Reader, error) {
+	r, err := sc.BlobCache.Get(key, opts...)
+	if err == nil && !isNoAccessRecord(opts) {
+		sc.stats.Record(key)
+	}
+	return r, err
+}
+
+// AccessStats returns the statistics of this cache.
+func (sc *statsCache) AccessStats() *AccessStats {
+	return sc.stats
+}
+
+func (sc *statsCache) flushLoop(interval time.Duration) {
+	defer close(sc.stoppedCh)
+	if interval <= 0 {
+		<-sc.stopCh
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if sc.stats.isDirty() {
+				sc.stats.Save(sc.path) // retried on the next tick on failure
+			}
+		case <-sc.stopCh:
+			return
+		}
+	}
+}
+
+func (sc *statsCache) Close() (err error) {
+	sc.closeOnce.Do(func() {
+		close(sc.stopCh)
+		<-sc.stoppedCh
+		err = sc.stats.Save(sc.path)
+	})
+	if cErr := sc.BlobCache.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// NewTieredDirectoryCache returns a cache spanning multiple directories, which are
+// ordered from the one on the fastest storage device to the one on the slowest.
+//
+// Contents added with Direct option (e.g. fetched in background) are placed on the
+// slowest tier and other contents (e.g. prefetched or read on demand) are placed on the
+// fastest tier. When contents are read from a slower tier without Direct option, they
+// are copied to the fastest tier in background so that following reads are served
+// from there.
+func NewTieredDirectoryCache(directories []string, config DirectoryCacheConfig) (BlobCache, error) {
+	if len(directories) == 0 {
+		return nil, fmt.Errorf("no directory is specified for tiered cache")
+	}
+	tc := &tieredCache{}
+	for _, d := range directories {
+		c, err := NewDirectoryCache(d, config)
+		if err != nil {
+			tc.Close()
+			return nil, err
+		}
+		tc.tiers = append(tc.tiers, c.(*directoryCache))
+	}
+	return tc, nil
+}
+
+type tieredCache struct {
+	tiers []*directoryCache
+
+	// promoting is a set of keys being copied to the fastest tier.
+	promoting sync.Map
+}
+
+func (tc *tieredCache) Get(key string, opts ...Option) (Reader, error) {
+	r, err := tc.get(key, opts...)
+	countLookup(err)
+	return r, err
+}
+
+func (tc *tieredCache) get(key string, opts ...Option) (Reader, error) {
+	var allErr error
+	for i, t := range tc.tiers {
+		r, err := t.get(key, opts...)
+		if err != nil {
+			allErr = multierror.Append(allErr, err)
+			continue
+		}
+		if i > 0 && !isDirect(opts) {
+			go tc.promote(key, t)
+		}
+		return r, nil
+	}
+	return nil, allErr
+}
+
+// promote copies the contents of the key from the specified tier to the fastest tier.
+func (tc *tieredCache) promote(key string, from *directoryCache) {
+	if _, loaded := tc.promoting.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	defer tc.promoting.Delete(key)
+	r, err := from.get(key, Direct())
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	w, err := tc.tiers[0].Add(key, Direct())
+	if err != nil {
+		return
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, io.NewSectionReader(r, 0, math.MaxInt64)); err != nil {
+		w.Abort()
+		return
+	}
+	w.Commit()
+}
+
+func (tc *tieredCache) Add(key string, opts ...Option) (Writer, error) {
+	if isDirect(opts) {
+		return tc.tiers[len(tc.tiers)-1].Add(key, opts...)
+	}
+	return tc.tiers[0].Add(key, opts...)
+}
+
+func (tc *tieredCache) Close() error {
+	var allErr error
+	for _, t := range tc.tiers {
+		if err := t.Close(); err != nil {
+			allErr = multierror.Append(allErr, err)
+		}
+	}
+	return allErr
+}
+
+func isDirect(opts []Option) bool {
+	opt := &cacheOpt{}
+	for _, o := range opts {
+		opt = o(opt)
+	}
+	return opt.direct
+}
+
+func isNoAccessRecord(opts []Option) bool {
+	opt := &cacheOpt{}
+	for _, o := range opts {
+		opt = o(opt)
+	}
+	return opt.noAccessRecord
+}
@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/rs/xid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// liveFilesystems is the set of filesystem IDs used by readers that aren't closed yet
+// in this process. Filesystem buckets not listed here are left by readers that weren't
+// closed properly (e.g. the previous run of the snapshotter was killed).
+var liveFilesystems sync.Map
+
+// Prune removes metadata of filesystems that aren't used by any reader in this process
+// and were created before the retention period. It returns the number of bytes of
+// DB pages that became reusable.
+func Prune(db *bolt.DB, retention time.Duration) (reclaimed int64, _ error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		filesystems := tx.Bucket(bucketKeyFilesystems)
+		if filesystems == nil {
+			return nil
+		}
+		var stale [][]byte
+		if err := filesystems.ForEach(func(k, v []byte) error {
+			if v != nil {
+				return nil // not a bucket
+			}
+			if _, ok := liveFilesystems.Load(string(k)); ok {
+				return nil
+			}
+			// IDs are generated by xid so they contain the creation time.
+			if id, err := xid.FromString(string(k)); err == nil && time.Since(id.Time()) < retention {
+				return nil
+			}
+			stats := filesystems.Bucket(k).Stats()
+			reclaimed += int64(stats.BranchAlloc + stats.LeafAlloc)
+			stale = append(stale, append([]byte{}, k...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := filesystems.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reclaimed, nil
+}
+
+// PruneEvery runs Prune with the passed interval until the context is cancelled.
+func PruneEvery(ctx context.Context, db *bolt.DB, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			reclaimed, err := Prune(db, retention)
+			if err != nil {
+				log.G(ctx).WithError(err).Warn("failed to prune metadata DB")
+				continue
+			}
+			if reclaimed > 0 {
+				log.G(ctx).Infof("pruned stale metadata (%d bytes reclaimed)", reclaimed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPrune(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "metadata.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	var (
+		stale  = xid.NewWithTime(time.Now().Add(-time.Hour)).String()
+		recent = xid.New().String()
+		live   = xid.NewWithTime(time.Now().Add(-time.Hour)).String()
+	)
+	liveFilesystems.Store(live, struct{}{})
+	defer liveFilesystems.Delete(live)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		filesystems, err := tx.CreateBucketIfNotExists(bucketKeyFilesystems)
+		if err != nil {
+			return err
+		}
+		for _, id := range []string{stale, recent, live} {
+			b, err := filesystems.CreateBucket([]byte(id))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("key"), make([]byte, os.Getpagesize())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to prepare db: %v", err)
+	}
+
+	reclaimed, err := Prune(db, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	if reclaimed <= 0 {
+		t.Errorf("reclaimed bytes must be positive but got %d", reclaimed)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		filesystems := tx.Bucket(bucketKeyFilesystems)
+		for id, want := range map[string]bool{stale: false, recent: true, live: true} {
+			if got := filesystems.Bucket([]byte(id)) != nil; got != want {
+				t.Errorf("existence of %q = %v; want %v", id, got, want)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to view db: %v", err)
+	}
+}
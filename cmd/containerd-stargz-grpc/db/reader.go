@@ -19,6 +19,7 @@ package db
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -55,6 +56,10 @@ type reader struct {
 	curIDMu sync.Mutex
 	initG   *errgroup.Group
 
+	prefetchBoundary    int64
+	hasPrefetchBoundary bool
+	summary             *estargz.TOCSummary
+
 	decompressor metadata.Decompressor
 }
 
@@ -77,6 +82,10 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 			return nil, fmt.Errorf("failed to apply option: %w", err)
 		}
 	}
+	ctx := rOpts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
 	gzipCompressors := []metadata.Decompressor{new(estargz.GzipDecompressor), new(estargz.LegacyGzipDecompressor)}
 	decompressors := append(gzipCompressors, rOpts.Decompressors...)
@@ -92,6 +101,9 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 
 	start := time.Now() // before getting layer footer
 	footer := make([]byte, fetchSize)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if _, err := sr.ReadAt(footer, sr.Size()-fetchSize); err != nil {
 		return nil, fmt.Errorf("error reading footer: %v", err)
 	}
@@ -114,11 +126,18 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 		if tocSize <= 0 {
 			tocSize = sr.Size() - tocOffset - fSize
 		}
+		if err := estargz.CheckRange(tocOffset, tocSize, sr.Size()); err != nil {
+			allErr = multierror.Append(allErr, fmt.Errorf("invalid TOC location: %w", err))
+			continue
+		}
 		if tocSize < int64(len(maybeTocBytes)) {
 			maybeTocBytes = maybeTocBytes[:tocSize]
 		}
 		tocR, err = decompressTOC(d, sr, tocOffset, tocSize, maybeTocBytes, rOpts)
 		if err != nil {
+			if cErr := ctx.Err(); cErr != nil {
+				return nil, cErr
+			}
 			allErr = multierror.Append(allErr, err)
 			continue
 		}
@@ -133,7 +152,8 @@ func NewReader(db *bolt.DB, sr *io.SectionReader, opts ...metadata.Option) (meta
 	}
 	defer tocR.Close()
 	r := &reader{sr: sr, db: db, initG: new(errgroup.Group), decompressor: decompressor}
-	if err := r.init(tocR, rOpts); err != nil {
+	if err := r.init(&contextReader{ctx, tocR}, rOpts); err != nil {
+		liveFilesystems.Delete(r.fsID) // allow pruning the partially initialized metadata
 		return nil, fmt.Errorf("failed to initialize matadata: %w", err)
 	}
 	return r, nil
@@ -162,6 +182,11 @@ func decompressTOC(d metadata.Decompressor, sr *io.SectionReader, tocOff, tocSiz
 
 	start := time.Now() // before getting TOC
 	tocBytes = make([]byte, tocSize)
+	if opts.Context != nil {
+		if err := opts.Context.Err(); err != nil {
+			return nil, err
+		}
+	}
 	if _, err := sr.ReadAt(tocBytes, tocOff); err != nil {
 		return nil, fmt.Errorf("error reading %d byte TOC targz: %v", len(tocBytes), err)
 	}
@@ -175,6 +200,19 @@ func decompressTOC(d metadata.Decompressor, sr *io.SectionReader, tocOff, tocSiz
 	return r, nil
 }
 
+// contextReader is an io.Reader that fails once the context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
 // RootID returns ID of the root node.
 func (r *reader) RootID() uint32 {
 	return r.rootID
@@ -184,6 +222,20 @@ func (r *reader) TOCDigest() digest.Digest {
 	return r.tocDigest
 }
 
+func (r *reader) PrefetchBoundary() (offset int64, ok bool) {
+	if err := r.waitInit(); err != nil {
+		return 0, false
+	}
+	return r.prefetchBoundary, r.hasPrefetchBoundary
+}
+
+func (r *reader) Summary() (s estargz.TOCSummary, ok bool) {
+	if err := r.waitInit(); err != nil || r.summary == nil {
+		return estargz.TOCSummary{}, false
+	}
+	return *r.summary, true
+}
+
 // Clone returns a new reader identical to the current reader
 // but uses the provided section reader for retrieving file paylaods.
 func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
@@ -197,6 +249,10 @@ func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
 		sr:           sr,
 		initG:        new(errgroup.Group),
 		decompressor: r.decompressor,
+
+		prefetchBoundary:    r.prefetchBoundary,
+		hasPrefetchBoundary: r.hasPrefetchBoundary,
+		summary:             r.summary,
 	}, nil
 }
 
@@ -257,7 +313,7 @@ func (r *reader) init(decompressedR io.Reader, rOpts metadata.Options) (retErr e
 		if _, err := f.Seek(0, io.SeekStart); err != nil {
 			return err
 		}
-		if err := r.initNodes(f); err != nil {
+		if err := r.initNodes(f, rOpts.PathPolicy); err != nil {
 			return err
 		}
 		if rOpts.Telemetry != nil && rOpts.Telemetry.DeserializeTocLatency != nil {
@@ -279,6 +335,7 @@ func (r *reader) initRootNode(fsID string) error {
 			return err
 		}
 		r.fsID = fsID
+		liveFilesystems.Store(fsID, struct{}{})
 		if _, err := lbkt.CreateBucket(bucketKeyMetadata); err != nil {
 			return err
 		}
@@ -305,29 +362,15 @@ func (r *reader) initRootNode(fsID string) error {
 	})
 }
 
-func (r *reader) initNodes(tr io.Reader) error {
-	dec := json.NewDecoder(tr)
-	for {
-		t, err := dec.Token()
-		if err != nil {
-			return fmt.Errorf("failed to get JSON token: %w", err)
-		}
-		if ele, ok := t.(string); ok {
-			if ele == "version" {
-				continue
-			}
-			if ele == "entries" {
-				continue
-			}
-		}
-		if de, ok := t.(json.Delim); ok {
-			if de.String() == "[" {
-				break
-			}
-		}
+func (r *reader) initNodes(tr io.Reader, pathPolicy estargz.PathPolicy) error {
+	nextEntry, readTrailer, err := r.tocEntries(tr)
+	if err != nil {
+		return err
 	}
 	md := make(map[uint32]*metadataEntry)
-	if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
+	// Entries can be read only once so this must not be run by Batch, which calls the function
+	// again when it (or another one in the batch) fails. The retry would see no entries.
+	if err := r.db.Update(func(tx *bolt.Tx) (err error) {
 		nodes, err := getNodes(tx, r.fsID)
 		if err != nil {
 			return err
@@ -338,10 +381,21 @@ func (r *reader) initNodes(tr io.Reader) error {
 		var lastEntSize int64
 		var attr metadata.Attr
 		var ent estargz.TOCEntry
-		for dec.More() {
-			resetEnt(&ent)
-			if err := dec.Decode(&ent); err != nil {
+		for {
+			if ok, err := nextEntry(&ent); err != nil {
 				return err
+			} else if !ok {
+				break
+			}
+			if ent.Type != "chunk" {
+				if ent.Name, err = pathPolicy.Apply(ent.Name); err != nil {
+					return err
+				}
+				if ent.Type == "hardlink" || ent.Type == "symlink" {
+					if ent.LinkName, err = pathPolicy.Apply(ent.LinkName); err != nil {
+						return err
+					}
+				}
 			}
 			ent.Name = cleanEntryName(ent.Name)
 			if ent.Type == "chunk" {
@@ -355,6 +409,13 @@ func (r *reader) initNodes(tr io.Reader) error {
 			if ent.ChunkSize == 0 && ent.Size != 0 {
 				ent.ChunkSize = ent.Size
 			}
+			fileSize := ent.Size
+			if ent.Type == "chunk" {
+				fileSize = lastEntSize
+			}
+			if err := ent.CheckBounds(r.sr.Size(), fileSize); err != nil {
+				return err
+			}
 			if ent.Type != "chunk" {
 				var id uint32
 				var b *bolt.Bucket
@@ -447,6 +508,11 @@ func (r *reader) initNodes(tr io.Reader) error {
 		return err
 	}
 
+	// Read fields following entries, if any.
+	if err := readTrailer(); err != nil {
+		return err
+	}
+
 	addendum := make([]struct {
 		id []byte
 		md *metadataEntry
@@ -482,6 +548,83 @@ func (r *reader) initNodes(tr io.Reader) error {
 	return nil
 }
 
+// tocEntries returns the function to iterate TOC entries and the function to read fields
+// following the entries. The TOC is decoded from JSON or the binary TOC, which is detected
+// from the contents.
+func (r *reader) tocEntries(tr io.Reader) (next func(ent *estargz.TOCEntry) (bool, error), readTrailer func() error, _ error) {
+	br := bufio.NewReader(tr)
+	if magic, _ := br.Peek(3); estargz.IsBinaryTOC(magic) {
+		p, err := io.ReadAll(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read binary TOC: %w", err)
+		}
+		toc, err := estargz.UnmarshalBinaryTOC(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if toc.PrefetchBoundary != nil {
+			r.prefetchBoundary, r.hasPrefetchBoundary = *toc.PrefetchBoundary, true
+		}
+		r.summary = toc.Summary
+		entries := toc.Entries
+		return func(ent *estargz.TOCEntry) (bool, error) {
+			if len(entries) == 0 {
+				return false, nil
+			}
+			*ent = *entries[0]
+			entries[0] = nil // allow GC
+			entries = entries[1:]
+			return true, nil
+		}, func() error { return nil }, nil
+	}
+	dec := json.NewDecoder(br)
+	if found, err := r.readTOCFields(dec); err != nil {
+		return nil, nil, err
+	} else if !found {
+		return nil, nil, fmt.Errorf("entries not found in TOC")
+	}
+	return func(ent *estargz.TOCEntry) (bool, error) {
+			if !dec.More() {
+				return false, nil
+			}
+			resetEnt(ent)
+			return true, dec.Decode(ent)
+		}, func() error {
+			_, err := r.readTOCFields(dec)
+			return err
+		}, nil
+}
+
+// readTOCFields reads top-level fields of TOC JSON until the entries array starts (found
+// is true) or the TOC ends.
+func (r *reader) readTOCFields(dec *json.Decoder) (found bool, _ error) {
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, fmt.Errorf("failed to get JSON token: %w", err)
+		}
+		if ele, ok := t.(string); ok && ele == "prefetchBoundary" {
+			if err := dec.Decode(&r.prefetchBoundary); err != nil {
+				return false, fmt.Errorf("failed to decode prefetch boundary: %w", err)
+			}
+			r.hasPrefetchBoundary = true
+			continue
+		}
+		if ele, ok := t.(string); ok && ele == "summary" {
+			r.summary = new(estargz.TOCSummary)
+			if err := dec.Decode(r.summary); err != nil {
+				return false, fmt.Errorf("failed to decode summary: %w", err)
+			}
+			continue
+		}
+		if de, ok := t.(json.Delim); ok && de.String() == "[" {
+			return true, nil
+		}
+	}
+}
+
 func (r *reader) getOrCreateDir(nodes *bolt.Bucket, md map[uint32]*metadataEntry, d string, rootID uint32) (id uint32, b *bolt.Bucket, err error) {
 	id, err = getIDByName(md, d, rootID)
 	if err != nil {
@@ -546,6 +689,7 @@ func (r *reader) update(fn func(tx *bolt.Tx) error) error {
 
 // Close closes this reader. This removes underlying filesystem metadata as well.
 func (r *reader) Close() error {
+	defer liveFilesystems.Delete(r.fsID)
 	return r.update(func(tx *bolt.Tx) (err error) {
 		filesystems := tx.Bucket(bucketKeyFilesystems)
 		if filesystems == nil {
@@ -654,11 +798,7 @@ func (r *reader) GetChild(pid uint32, base string) (id uint32, attr metadata.Att
 // ForeachChild calls the specified callback function for each child node.
 // When the callback returns non-nil error, this stops the iteration.
 func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error {
-	type childInfo struct {
-		id   uint32
-		mode os.FileMode
-	}
-	children := make(map[string]childInfo)
+	var children map[string]childInfo
 	if err := r.view(func(tx *bolt.Tx) error {
 		metadataEntries, err := getMetadata(tx, r.fsID)
 		if err != nil {
@@ -668,56 +808,222 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 		if err != nil {
 			return nil // no child
 		}
+		nodes, err := getNodes(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
+		}
+		children, err = readChildren(nodes, md)
+		return err
+	}); err != nil {
+		return err
+	}
+	for k, e := range children {
+		if !f(k, e.id, e.mode) {
+			break
+		}
+	}
+	return nil
+}
 
-		var nodes *bolt.Bucket
-		firstName := md.Get(bucketKeyChildName)
-		if len(firstName) != 0 {
-			firstID := decodeID(md.Get(bucketKeyChildID))
-			if nodes == nil {
-				nodes, err = getNodes(tx, r.fsID)
-				if err != nil {
-					return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
-				}
+// PathOf returns the absolute path of the specified node. This scans the children of
+// all directories so Walk should be used for resolving paths of many nodes.
+func (r *reader) PathOf(id uint32) (string, error) {
+	if id == r.rootID {
+		return "/", nil
+	}
+	type parentInfo struct {
+		id   uint32
+		name string
+	}
+	parents := make(map[uint32]parentInfo)
+	if err := r.view(func(tx *bolt.Tx) error {
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for getting path of %d: %w", r.fsID, id, err)
+		}
+		return metadataEntries.ForEach(func(k, v []byte) error {
+			md := metadataEntries.Bucket(k)
+			if md == nil {
+				return nil
+			}
+			pid := decodeID(k)
+			if name := md.Get(bucketKeyChildName); len(name) != 0 {
+				parents[decodeID(md.Get(bucketKeyChildID))] = parentInfo{pid, string(name)}
+			}
+			cbkt := md.Bucket(bucketKeyChildrenExtra)
+			if cbkt == nil {
+				return nil
+			}
+			return cbkt.ForEach(func(k, v []byte) error {
+				parents[decodeID(v)] = parentInfo{pid, string(k)}
+				return nil
+			})
+		})
+	}); err != nil {
+		return "", err
+	}
+	var names []string
+	for cur := id; cur != r.rootID; {
+		p, ok := parents[cur]
+		if !ok || len(names) > len(parents) {
+			return "", fmt.Errorf("path of node %d not found", id)
+		}
+		names = append([]string{p.name}, names...)
+		cur = p.id
+	}
+	return "/" + strings.Join(names, "/"), nil
+}
+
+// Walk calls the specified callback function for each node with its absolute path.
+// All nodes are read in a single transaction before calling the callback.
+func (r *reader) Walk(f func(path string, id uint32, mode os.FileMode) bool) error {
+	type visit struct {
+		path string
+		childInfo
+	}
+	var visits []visit
+	if err := r.view(func(tx *bolt.Tx) error {
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for walking: %w", r.fsID, err)
+		}
+		nodes, err := getNodes(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("nodes bucket of %q not found for walking: %w", r.fsID, err)
+		}
+		root, err := getNodeBucketByID(nodes, r.rootID)
+		if err != nil {
+			return fmt.Errorf("failed to get root bucket %d: %w", r.rootID, err)
+		}
+		var walk func(p string, c childInfo) error
+		walk = func(p string, c childInfo) error {
+			visits = append(visits, visit{p, c})
+			md, err := getMetadataBucketByID(metadataEntries, c.id)
+			if err != nil {
+				return nil // no child
 			}
-			firstChild, err := getNodeBucketByID(nodes, firstID)
+			children, err := readChildren(nodes, md)
 			if err != nil {
-				return fmt.Errorf("failed to get first child bucket %d: %w", firstID, err)
+				return err
 			}
-			mode, _ := binary.Uvarint(firstChild.Get(bucketKeyMode))
-			children[string(firstName)] = childInfo{firstID, os.FileMode(uint32(mode))}
+			for name, child := range children {
+				if err := walk(path.Join(p, name), child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		mode, _ := binary.Uvarint(root.Get(bucketKeyMode))
+		return walk("/", childInfo{r.rootID, os.FileMode(uint32(mode))})
+	}); err != nil {
+		return err
+	}
+	for _, v := range visits {
+		if !f(v.path, v.id, v.mode) {
+			break
 		}
+	}
+	return nil
+}
 
-		cbkt := md.Bucket(bucketKeyChildrenExtra)
-		if cbkt == nil {
-			return nil // no child
+// ForeachChunk calls the specified callback function for each chunk of regular files.
+// All chunks are read in a single transaction before calling the callback.
+func (r *reader) ForeachChunk(f func(c metadata.Chunk) bool) error {
+	var chunks []metadata.Chunk
+	if err := r.view(func(tx *bolt.Tx) error {
+		metadataEntries, err := getMetadata(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("metadata bucket of %q not found for reading chunks: %w", r.fsID, err)
 		}
-		if nodes == nil {
-			nodes, err = getNodes(tx, r.fsID)
+		nodes, err := getNodes(tx, r.fsID)
+		if err != nil {
+			return fmt.Errorf("nodes bucket of %q not found for reading chunks: %w", r.fsID, err)
+		}
+		return metadataEntries.ForEach(func(k, v []byte) error {
+			md := metadataEntries.Bucket(k)
+			if md == nil {
+				return nil
+			}
+			b, err := getNodeBucketByID(nodes, decodeID(k))
 			if err != nil {
-				return fmt.Errorf("nodes bucket of %q not found for getting children of %d: %w", r.fsID, id, err)
+				return err
 			}
-		}
-		return cbkt.ForEach(func(k, v []byte) error {
-			id := decodeID(v)
-			child, err := getNodeBucketByID(nodes, id)
+			m, _ := binary.Uvarint(b.Get(bucketKeyMode))
+			size, _ := binary.Varint(b.Get(bucketKeySize))
+			if !os.FileMode(uint32(m)).IsRegular() || size == 0 {
+				return nil
+			}
+			ents, err := readChunks(md, size)
 			if err != nil {
-				return fmt.Errorf("failed to get child bucket %d: %w", id, err)
+				return fmt.Errorf("failed to get chunks of %d: %w", decodeID(k), err)
+			}
+			nextOffset, _ := binary.Varint(md.Get(bucketKeyNextOffset))
+			for i := len(ents) - 1; i >= 0; i-- {
+				chunks = append(chunks, metadata.Chunk{
+					Offset:    ents[i].offset,
+					Size:      nextOffset - ents[i].offset,
+					ChunkSize: ents[i].chunkSize,
+					Digest:    ents[i].chunkDigest,
+				})
+				nextOffset = ents[i].offset
 			}
-			mode, _ := binary.Uvarint(child.Get(bucketKeyMode))
-			children[string(k)] = childInfo{id, os.FileMode(uint32(mode))}
 			return nil
 		})
 	}); err != nil {
 		return err
 	}
-	for k, e := range children {
-		if !f(k, e.id, e.mode) {
+	for _, c := range chunks {
+		if !f(c) {
 			break
 		}
 	}
 	return nil
 }
 
+// DecompressChunk returns the reader of the chunk decompressed from the passed contents.
+func (r *reader) DecompressChunk(p []byte) (io.ReadCloser, error) {
+	return r.decompressor.Reader(bytes.NewReader(p))
+}
+
+// Decompressor returns the decompressor of the blob.
+func (r *reader) Decompressor() estargz.Decompressor {
+	return r.decompressor
+}
+
+type childInfo struct {
+	id   uint32
+	mode os.FileMode
+}
+
+// readChildren reads the children of the node from its metadata bucket.
+func readChildren(nodes, md *bolt.Bucket) (map[string]childInfo, error) {
+	children := make(map[string]childInfo)
+	add := func(name string, id uint32) error {
+		child, err := getNodeBucketByID(nodes, id)
+		if err != nil {
+			return fmt.Errorf("failed to get child bucket %d: %w", id, err)
+		}
+		mode, _ := binary.Uvarint(child.Get(bucketKeyMode))
+		children[name] = childInfo{id, os.FileMode(uint32(mode))}
+		return nil
+	}
+	if firstName := md.Get(bucketKeyChildName); len(firstName) != 0 {
+		if err := add(string(firstName), decodeID(md.Get(bucketKeyChildID))); err != nil {
+			return nil, err
+		}
+	}
+	cbkt := md.Bucket(bucketKeyChildrenExtra)
+	if cbkt == nil {
+		return children, nil
+	}
+	if err := cbkt.ForEach(func(k, v []byte) error {
+		return add(string(k), decodeID(v))
+	}); err != nil {
+		return nil, err
+	}
+	return children, nil
+}
+
 // OpenFile returns a section reader of the specified node.
 func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 	var chunks []chunkEntry
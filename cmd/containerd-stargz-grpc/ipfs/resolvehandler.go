@@ -17,80 +17,140 @@
 package ipfs
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/containerd/containerd/log"
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/ipfs"
 	httpapi "github.com/ipfs/go-ipfs-http-client"
-	iface "github.com/ipfs/interface-go-ipfs-core"
 	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-type ResolveHandler struct{}
+const (
+	defaultLocalTimeout    = 3 * time.Second
+	defaultFallbackTimeout = 30 * time.Second
+)
+
+// RetrievalConfig configures sources of contents used when the local IPFS daemon doesn't
+// retrieve them in time (e.g. the daemon lacks blocks and can't find providers quickly).
+type RetrievalConfig struct {
+	// Nodes is the HTTP API addresses of other IPFS nodes (e.g. "http://192.0.2.1:5001").
+	Nodes []string `toml:"nodes"`
+
+	// Gateways is the URLs of HTTP gateways (e.g. "https://ipfs.io").
+	Gateways []string `toml:"gateways"`
+
+	// LocalTimeoutMSec is the time to wait for the local daemon before falling back to the
+	// nodes and the gateways. 0 uses 3 seconds.
+	LocalTimeoutMSec int64 `toml:"local_timeout_msec"`
+
+	// TimeoutMSec is the time to wait for the nodes and the gateways, which are requested
+	// in parallel. The first successful one is used. 0 uses 30 seconds.
+	TimeoutMSec int64 `toml:"timeout_msec"`
+}
+
+// ResolveHandler resolves layers stored in IPFS. The zero value retrieves contents only
+// from the local IPFS daemon.
+type ResolveHandler struct {
+	fallbacks    []source
+	localTimeout time.Duration
+	timeout      time.Duration
+}
+
+// NewResolveHandler returns the handler falling back to the nodes and the gateways of the
+// config when the local daemon doesn't retrieve contents in time.
+func NewResolveHandler(config RetrievalConfig) (*ResolveHandler, error) {
+	r := &ResolveHandler{
+		localTimeout: time.Duration(config.LocalTimeoutMSec) * time.Millisecond,
+		timeout:      time.Duration(config.TimeoutMSec) * time.Millisecond,
+	}
+	if r.localTimeout <= 0 {
+		r.localTimeout = defaultLocalTimeout
+	}
+	if r.timeout <= 0 {
+		r.timeout = defaultFallbackTimeout
+	}
+	for _, addr := range config.Nodes {
+		api, err := httpapi.NewURLApiWithClient(addr, &http.Client{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to use IPFS node %q: %w", addr, err)
+		}
+		r.fallbacks = append(r.fallbacks, &apiSource{api: api, addr: addr})
+	}
+	for _, u := range config.Gateways {
+		r.fallbacks = append(r.fallbacks, &gatewaySource{url: u, client: http.DefaultClient})
+	}
+	return r, nil
+}
 
 func (r *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
 	p, err := ipfs.GetPath(desc)
 	if err != nil {
 		return nil, 0, err
 	}
-	client, err := httpapi.NewLocalApi()
-	if err != nil {
-		return nil, 0, err
+	f := &fetcher{
+		path:         p,
+		dgst:         desc.Digest,
+		fallbacks:    r.fallbacks,
+		localTimeout: r.localTimeout,
+		timeout:      r.timeout,
 	}
-	n, err := client.Unixfs().Get(ctx, p)
+	client, err := httpapi.NewLocalApi()
 	if err != nil {
-		return nil, 0, err
-	}
-	if _, ok := n.(interface {
-		io.ReaderAt
-	}); !ok {
-		return nil, 0, fmt.Errorf("ReaderAt is not implemented")
+		if len(r.fallbacks) == 0 {
+			return nil, 0, err
+		}
+		log.G(ctx).WithError(err).Warn("local IPFS daemon isn't available; using other sources")
+	} else {
+		f.local = &apiSource{api: client}
 	}
-	defer n.Close()
-	s, err := n.Size()
+	s, err := f.retrieve(ctx, func(ctx context.Context, s source) (interface{}, error) {
+		return s.size(ctx, p)
+	})
 	if err != nil {
 		return nil, 0, err
 	}
-	return &fetcher{client, p}, s, nil
+	return f, s.(int64), nil
 }
 
+// fetcher retrieves contents from the local daemon. If the local daemon doesn't retrieve
+// them in time, all fallback sources are requested in parallel. Contents are read into
+// memory before Fetch returns so that the timeouts bound the whole retrieval.
 type fetcher struct {
-	api  iface.CoreAPI
-	path ipath.Path
+	path         ipath.Path
+	dgst         digest.Digest
+	local        source // nil if the local daemon isn't available
+	fallbacks    []source
+	localTimeout time.Duration
+	timeout      time.Duration
 }
 
 func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
-	n, err := f.api.Unixfs().Get(ctx, f.path)
+	b, err := f.retrieve(ctx, func(ctx context.Context, s source) (interface{}, error) {
+		return s.read(ctx, f.path, off, size)
+	})
 	if err != nil {
 		return nil, err
 	}
-	ra, ok := n.(interface {
-		io.ReaderAt
-	})
-	if !ok {
-		return nil, fmt.Errorf("ReaderAt is not implemented")
-	}
-	return &readCloser{
-		Reader:    io.NewSectionReader(ra, off, size),
-		closeFunc: n.Close,
-	}, nil
+	return io.NopCloser(bytes.NewReader(b.([]byte))), nil
 }
 
 func (f *fetcher) Check() error {
-	n, err := f.api.Unixfs().Get(context.Background(), f.path)
-	if err != nil {
-		return err
-	}
-	if _, ok := n.(interface {
-		io.ReaderAt
-	}); !ok {
-		return fmt.Errorf("ReaderAt is not implemented")
-	}
-	return n.Close()
+	_, err := f.retrieve(context.Background(), func(ctx context.Context, s source) (interface{}, error) {
+		return s.size(ctx, f.path)
+	})
+	return err
 }
 
 func (f *fetcher) GenID(off int64, size int64) string {
@@ -98,9 +158,59 @@ func (f *fetcher) GenID(off int64, size int64) string {
 	return fmt.Sprintf("%x", sum)
 }
 
-type readCloser struct {
-	io.Reader
-	closeFunc func() error
+// retrieve runs op on the local daemon and falls back to the other sources on failure or
+// timeout.
+func (f *fetcher) retrieve(ctx context.Context, op func(context.Context, source) (interface{}, error)) (interface{}, error) {
+	var errs []string
+	if f.local != nil {
+		lctx, cancel := ctx, context.CancelFunc(func() {})
+		if len(f.fallbacks) > 0 {
+			lctx, cancel = context.WithTimeout(ctx, f.localTimeout)
+		}
+		v, err := f.try(lctx, f.local, op)
+		cancel()
+		if err == nil || len(f.fallbacks) == 0 {
+			return v, err
+		}
+		log.G(ctx).WithError(err).Debugf("falling back to other sources for retrieving %q", f.path)
+		errs = append(errs, fmt.Sprintf("%s: %v", f.local.name(), err))
+	}
+
+	fctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel() // cancels sources other than the first successful one
+	type result struct {
+		v   interface{}
+		err error
+		s   source
+	}
+	resCh := make(chan result, len(f.fallbacks))
+	for _, s := range f.fallbacks {
+		s := s
+		go func() {
+			v, err := f.try(fctx, s, op)
+			resCh <- result{v, err, s}
+		}()
+	}
+	for range f.fallbacks {
+		r := <-resCh
+		if r.err == nil {
+			log.G(ctx).Debugf("retrieved %q from %s", f.path, r.s.name())
+			return r.v, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", r.s.name(), r.err))
+	}
+	return nil, fmt.Errorf("failed to retrieve %q from all sources: %s", f.path, strings.Join(errs, "; "))
 }
 
-func (r *readCloser) Close() error { return r.closeFunc() }
+// try runs op on the source and records the result to the metrics.
+func (f *fetcher) try(ctx context.Context, s source, op func(context.Context, source) (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	v, err := op(ctx, s)
+	succeeded, failed := s.operations()
+	if err == nil {
+		commonmetrics.MeasureLatencyInMilliseconds(succeeded, f.dgst, start)
+	} else if !errors.Is(ctx.Err(), context.Canceled) { // not canceled because another source succeeded
+		commonmetrics.IncOperationCount(failed, f.dgst)
+	}
+	return v, err
+}
@@ -0,0 +1,185 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+const testPath = "/ipfs/QmW8VHwGWCdxXxYoc1m6JYtnSMWKkCK2L96HxA7JXUfKrn"
+
+func TestFetcherFallback(t *testing.T) {
+	contents := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != testPath {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+	}))
+	defer gw.Close()
+
+	tests := []struct {
+		name     string
+		local    *testSource
+		nodes    []*testSource
+		want     string
+		wantErr  bool
+		wantUsed []int // number of reads of the local and the nodes, if checked
+	}{
+		{
+			name:     "local",
+			local:    &testSource{contents: contents},
+			nodes:    []*testSource{{contents: contents}},
+			want:     "abcdef",
+			wantUsed: []int{1, 0},
+		},
+		{
+			name:     "local_stalls",
+			local:    &testSource{stall: true},
+			nodes:    []*testSource{{err: fmt.Errorf("not found")}, {stall: true}},
+			want:     "abcdef",
+			wantUsed: []int{1},
+		},
+		{
+			name:  "no_local",
+			nodes: []*testSource{{contents: contents}},
+			want:  "abcdef",
+		},
+		{
+			name:    "all_fail",
+			local:   &testSource{err: fmt.Errorf("not found")},
+			nodes:   []*testSource{{stall: true}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fetcher{
+				path:         ipath.New(testPath),
+				localTimeout: 100 * time.Millisecond,
+				timeout:      time.Second,
+			}
+			if tt.local != nil {
+				f.local = tt.local
+			}
+			for _, n := range tt.nodes {
+				f.fallbacks = append(f.fallbacks, n)
+			}
+			gwURL := gw.URL
+			if tt.wantErr {
+				gwURL += "/broken"
+			}
+			f.fallbacks = append(f.fallbacks, &gatewaySource{url: gwURL, client: gw.Client()})
+
+			start := time.Now()
+			r, err := f.Fetch(context.Background(), 10, 6)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("fetch must fail")
+				}
+				if d := time.Since(start); d > 2*time.Second {
+					t.Errorf("fetch took %v beyond timeouts", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("fetched %q; want %q", string(b), tt.want)
+			}
+			for i, want := range tt.wantUsed {
+				s := tt.local
+				if i > 0 {
+					s = tt.nodes[i-1]
+				}
+				if s == nil {
+					continue
+				}
+				if got := int(atomic.LoadInt32(&s.reads)); got != want {
+					t.Errorf("source %d is read %d times; want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewaySize(t *testing.T) {
+	gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("contents"))
+	}))
+	defer gw.Close()
+	s := &gatewaySource{url: gw.URL + "/", client: gw.Client()}
+	size, err := s.size(context.Background(), ipath.New(testPath))
+	if err != nil {
+		t.Fatalf("failed to get size: %v", err)
+	}
+	if size != int64(len("contents")) {
+		t.Errorf("size = %d; want %d", size, len("contents"))
+	}
+}
+
+// testSource serves the contents, fails with err or stalls until the context is done.
+type testSource struct {
+	contents []byte
+	err      error
+	stall    bool
+	reads    int32
+}
+
+func (s *testSource) size(ctx context.Context, p ipath.Path) (int64, error) {
+	if err := s.wait(ctx); err != nil {
+		return 0, err
+	}
+	return int64(len(s.contents)), nil
+}
+
+func (s *testSource) read(ctx context.Context, p ipath.Path, off, size int64) ([]byte, error) {
+	atomic.AddInt32(&s.reads, 1)
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return s.contents[off : off+size], nil
+}
+
+func (s *testSource) wait(ctx context.Context) error {
+	if s.stall {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.err
+}
+
+func (s *testSource) name() string { return "test" }
+
+func (s *testSource) operations() (string, string) { return "test", "test_failure" }
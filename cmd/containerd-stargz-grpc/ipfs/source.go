@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
+	iface "github.com/ipfs/interface-go-ipfs-core"
+	ipath "github.com/ipfs/interface-go-ipfs-core/path"
+)
+
+// source is a place to retrieve contents of IPFS paths from.
+type source interface {
+	// size returns the size of the file of the path.
+	size(ctx context.Context, p ipath.Path) (int64, error)
+
+	// read reads the range of the file of the path. ctx bounds the whole read.
+	read(ctx context.Context, p ipath.Path, off, size int64) ([]byte, error)
+
+	// name returns the name of the source in logs.
+	name() string
+
+	// operations returns the names of metrics of successful and failed retrievals.
+	operations() (succeeded, failed string)
+}
+
+// apiSource retrieves contents through the HTTP API of an IPFS node.
+type apiSource struct {
+	api  iface.CoreAPI
+	addr string // empty for the local daemon
+}
+
+func (s *apiSource) size(ctx context.Context, p ipath.Path) (int64, error) {
+	n, err := s.api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	defer n.Close()
+	if _, ok := n.(io.ReaderAt); !ok {
+		return 0, fmt.Errorf("ReaderAt is not implemented")
+	}
+	return n.Size()
+}
+
+func (s *apiSource) read(ctx context.Context, p ipath.Path, off, size int64) ([]byte, error) {
+	n, err := s.api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	defer n.Close()
+	ra, ok := n.(io.ReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("ReaderAt is not implemented")
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(ra, off, size), b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *apiSource) name() string {
+	if s.addr == "" {
+		return "local daemon"
+	}
+	return "node " + s.addr
+}
+
+func (s *apiSource) operations() (string, string) {
+	if s.addr == "" {
+		return commonmetrics.IPFSRetrieveLocal, commonmetrics.IPFSRetrieveLocalFailureCount
+	}
+	return commonmetrics.IPFSRetrieveNode, commonmetrics.IPFSRetrieveNodeFailureCount
+}
+
+// gatewaySource retrieves contents from an HTTP gateway (e.g. "https://ipfs.io").
+type gatewaySource struct {
+	url    string
+	client *http.Client
+}
+
+func (s *gatewaySource) size(ctx context.Context, p ipath.Path) (int64, error) {
+	resp, err := s.do(ctx, http.MethodHead, p, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status code from gateway %q: %v", s.url, resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("gateway %q didn't return the size of %q", s.url, p)
+	}
+	return resp.ContentLength, nil
+}
+
+func (s *gatewaySource) read(ctx context.Context, p ipath.Path, off, size int64) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, p, fmt.Sprintf("bytes=%d-%d", off, off+size-1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK: // the gateway ignored the range
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unexpected status code from gateway %q: %v", s.url, resp.Status)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (s *gatewaySource) do(ctx context.Context, method string, p ipath.Path, rng string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(s.url, "/")+p.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	return s.client.Do(req)
+}
+
+func (s *gatewaySource) name() string { return "gateway " + s.url }
+
+func (s *gatewaySource) operations() (string, string) {
+	return commonmetrics.IPFSRetrieveGateway, commonmetrics.IPFSRetrieveGatewayFailureCount
+}
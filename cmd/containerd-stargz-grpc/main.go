@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
@@ -26,8 +27,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
@@ -39,17 +42,26 @@ import (
 	"github.com/containerd/containerd/sys"
 	dbmetadata "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/db"
 	ipfs "github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/ipfs"
+	"github.com/containerd/stargz-snapshotter/cmd/containerd-stargz-grpc/otelmetrics"
 	"github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/bundle"
+	"github.com/containerd/stargz-snapshotter/fs/progress"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
 	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/dataplane"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
 	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
 	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
+	"github.com/containerd/stargz-snapshotter/service/provision"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/util/sandbox"
 	"github.com/containerd/stargz-snapshotter/version"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
 	metrics "github.com/docker/go-metrics"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pelletier/go-toml"
 	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
@@ -74,6 +86,10 @@ var (
 	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
 	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
 	printVersion = flag.Bool("version", false, "print the version")
+
+	// Flags used by the snapshotter for starting data planes. These aren't for users.
+	dataPlaneSocket      = flag.String("data-plane-socket", "", "(internal) serve as a data plane on the socket")
+	dataPlaneCredentials = flag.String("data-plane-credentials", "", "(internal) socket to get registry credentials from the control plane")
 )
 
 type snapshotterConfig struct {
@@ -85,14 +101,66 @@ type snapshotterConfig struct {
 	// NoPrometheus is a flag to disable the emission of the metrics
 	NoPrometheus bool `toml:"no_prometheus"`
 
+	// OTLPMetricsEndpoint is the address (host:port) of an OTLP gRPC receiver (e.g. the
+	// OpenTelemetry Collector) where the snapshotter exports metrics of snapshot operations.
+	OTLPMetricsEndpoint string `toml:"otlp_metrics_endpoint"`
+
+	// OTLPMetricsInsecure disables TLS for the OTLP receiver.
+	OTLPMetricsInsecure bool `toml:"otlp_metrics_insecure"`
+
+	// OTLPMetricsIntervalSec is the interval (in sec) of exporting metrics to the OTLP
+	// receiver. 0 uses 60 seconds.
+	OTLPMetricsIntervalSec int64 `toml:"otlp_metrics_interval_sec"`
+
 	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
 	DebugAddress string `toml:"debug_address"`
 
+	// WarmnessAddress is a TCP address where the snapshotter exposes a read-only API
+	// reporting how much of each image is fetched to this node (/v1/warmness). This is
+	// meant to be queried by schedulers and must not be exposed outside of the cluster.
+	WarmnessAddress string `toml:"warmness_address"`
+
 	// IPFS is a flag to enbale lazy pulling from IPFS.
 	IPFS bool `toml:"ipfs"`
 
+	// IPFSRetrieval configures the sources used when the local IPFS daemon doesn't
+	// retrieve contents in time.
+	IPFSRetrieval ipfs.RetrievalConfig `toml:"ipfs_retrieval"`
+
+	// BundleDir is the path to a bundle produced by freezing snapshots. Layers contained
+	// in the bundle are served from it instead of registries.
+	BundleDir string `toml:"bundle_dir"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"memory"`
+
+	// MetadataPruneIntervalSec is the interval (in sec) to remove metadata of unmounted
+	// layers left in the metadata DB. 0 disables periodic pruning. Only effective with
+	// the "db" metadata store.
+	MetadataPruneIntervalSec int64 `toml:"metadata_prune_interval_sec"`
+
+	// MetadataPruneRetentionSec is the minimum age (in sec) of unused metadata to be pruned.
+	MetadataPruneRetentionSec int64 `toml:"metadata_prune_retention_sec"`
+
+	// MetadataDir is the directory where the metadata DB is stored. Empty uses the root
+	// directory.
+	MetadataDir string `toml:"metadata_dir"`
+
+	// MetadataMemoryBudgetMB is the limit of the memory (estimated from the number of
+	// files) kept by the "memory" metadata store. Layers mounted after the limit is
+	// exceeded use the DB-backed metadata store stored in metadata_dir. 0 disables the limit.
+	MetadataMemoryBudgetMB int64 `toml:"metadata_memory_budget_mb"`
+
+	// PodMode checks that the snapshotter running in a Kubernetes pod can serve layers
+	// without broad hostPath mounts: /dev/fuse must be provided (e.g. by a device plugin)
+	// and the root directory must be on a volume mounted with Bidirectional propagation.
+	// Caches and metadata can be placed on other volumes with cache_dir and metadata_dir.
+	// FUSE is mounted directly without fusermount in this mode.
+	PodMode bool `toml:"pod_mode"`
+
+	// Seccomp installs a seccomp filter allowing only system calls that the snapshotter
+	// needs to reduce the impact of bugs in parsing untrusted image contents.
+	Seccomp bool `toml:"seccomp"`
 }
 
 func main() {
@@ -133,8 +201,52 @@ func main() {
 		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
 	}
 
+	if config.PodMode {
+		if err := checkPodMode(*rootDir); err != nil {
+			log.G(ctx).WithError(err).Fatalf("snapshotter can't run in pod mode")
+		}
+		config.Config.FuseConfig.DirectMount = true
+	}
+
+	if config.Seccomp {
+		if err := sandbox.ApplySeccomp(); err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to apply seccomp filter")
+		}
+		log.G(ctx).Infof("applied seccomp filter allowing %d system calls", len(sandbox.AllowedSyscalls))
+	}
+
+	if *dataPlaneSocket != "" {
+		if err := serveDataPlane(ctx, *dataPlaneSocket, *dataPlaneCredentials, config); err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to serve data plane")
+		}
+		log.G(ctx).Info("Exiting data plane")
+		return
+	}
+
+	// Configure OpenTelemetry metrics
+	var (
+		rpcOpts      []grpc.ServerOption
+		otelExporter *otelmetrics.Exporter
+	)
+	if config.OTLPMetricsEndpoint != "" {
+		otelExporter, err = otelmetrics.NewExporter(ctx, otelmetrics.Config{
+			Endpoint: config.OTLPMetricsEndpoint,
+			Insecure: config.OTLPMetricsInsecure,
+			Interval: time.Duration(config.OTLPMetricsIntervalSec) * time.Second,
+		})
+		if err != nil {
+			log.G(ctx).WithError(err).Fatalf("failed to configure OTLP metrics exporter")
+		}
+		defer func() {
+			if err := otelExporter.Shutdown(ctx); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to shutdown OTLP metrics exporter")
+			}
+		}()
+		rpcOpts = append(rpcOpts, grpc.UnaryInterceptor(otelmetrics.UnaryServerInterceptor()))
+	}
+
 	// Create a gRPC server
-	rpc := grpc.NewServer()
+	rpc := grpc.NewServer(rpcOpts...)
 
 	// Configure keychain
 	credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
@@ -175,22 +287,47 @@ func main() {
 		runtime.RegisterImageServiceServer(rpc, criServer)
 		credsFuncs = append(credsFuncs, f)
 	}
-	fsOpts := []fs.Option{fs.WithMetricsLogLevel(logrus.InfoLevel)}
-	if config.IPFS {
-		fsOpts = append(fsOpts, fs.WithResolveHandler("ipfs", new(ipfs.ResolveHandler)))
+	if config.DebugAddress != "" {
+		remote.EnableDebugStats()
 	}
-	mt, err := getMetadataStore(*rootDir, config)
+	progressBroker := progress.NewBroker()
+	controller := fs.NewController()
+	fsOpts, prune, err := filesystemOptions(ctx, *rootDir, config)
 	if err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to configure metadata store")
+		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
-	fsOpts = append(fsOpts, fs.WithMetadataStore(mt))
-	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config,
-		service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
+	fsOpts = append(fsOpts,
+		fs.WithProgressBroker(progressBroker),
+		fs.WithController(controller),
+	)
+	sOpts := []service.Option{service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...)}
+	if config.DataPlaneConfig.Enable {
+		sOpts = append(sOpts, service.WithDataPlaneCommand(dataPlaneCommand))
+	}
+	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config, sOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
 
-	cleanup, err := serve(ctx, rpc, *address, rs, config)
+	if config.ProvisionConfig.Enable {
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...)
+		ps := provision.NewServer(provision.Config(config.ProvisionConfig), hosts, func(dgst digest.Digest) bool {
+			layers, err := controller.Layers()
+			if err != nil {
+				return false
+			}
+			for _, l := range layers {
+				if l.Digest == dgst {
+					return true
+				}
+			}
+			return false
+		})
+		defer ps.Close()
+		provision.Register(rpc, ps)
+	}
+
+	cleanup, err := serve(ctx, rpc, *address, rs, config, prune, progressBroker, controller, otelExporter)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 	}
@@ -202,9 +339,79 @@ func main() {
 	log.G(ctx).Info("Exiting")
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig) (bool, error) {
+func filesystemOptions(ctx context.Context, rootDir string, config snapshotterConfig) ([]fs.Option, pruneFunc, error) {
+	fsOpts := []fs.Option{
+		fs.WithMetricsLogLevel(logrus.InfoLevel),
+	}
+	if config.IPFS {
+		h, err := ipfs.NewResolveHandler(config.IPFSRetrieval)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to configure IPFS: %w", err)
+		}
+		fsOpts = append(fsOpts, fs.WithResolveHandler("ipfs", h))
+	}
+	if config.BundleDir != "" {
+		h, err := bundle.NewResolveHandler(config.BundleDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read bundle %q: %w", config.BundleDir, err)
+		}
+		fsOpts = append(fsOpts, fs.WithResolveHandler("bundle", h))
+	}
+	mt, prune, err := getMetadataStore(ctx, rootDir, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure metadata store: %w", err)
+	}
+	return append(fsOpts, fs.WithMetadataStore(mt)), prune, nil
+}
+
+// dataPlaneCommand returns the command to start this binary as a data plane.
+func dataPlaneCommand(root, socket, credsSocket string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0],
+		"--root", root,
+		"--config", *configPath,
+		"--log-level", *logLevel,
+		"--data-plane-socket", socket,
+		"--data-plane-credentials", credsSocket,
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// Data planes must not outlive the snapshotter.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+	return cmd
+}
+
+// serveDataPlane serves layers on behalf of the snapshotter (control plane) until
+// SIGINT or SIGTERM is received.
+func serveDataPlane(ctx context.Context, socket, credsSocket string, config snapshotterConfig) error {
+	fsOpts, _, err := filesystemOptions(ctx, *rootDir, config)
+	if err != nil {
+		return err
+	}
+	lfs, err := service.NewFileSystem(ctx, *rootDir, &config.Config,
+		service.WithCredsFuncs(dataplane.CredentialFromControlPlane(credsSocket)),
+		service.WithFilesystemOptions(fsOpts...))
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen %q: %w", socket, err)
+	}
+	ctx, cancel := signal.NotifyContext(ctx, unix.SIGINT, unix.SIGTERM)
+	defer cancel()
+	return dataplane.Serve(ctx, l, lfs)
+}
+
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, config snapshotterConfig, prune pruneFunc, progressBroker *progress.Broker, controller *fs.Controller, otelExporter *otelmetrics.Exporter) (bool, error) {
 	// Convert the snapshotter to a gRPC service,
-	snsvc := snapshotservice.FromSnapshotter(rs)
+	svcSn := rs
+	if otelExporter != nil {
+		var err error
+		if svcSn, err = otelmetrics.NewSnapshotter(rs, otelExporter.Meter()); err != nil {
+			return false, fmt.Errorf("failed to instrument snapshotter: %w", err)
+		}
+	}
+	snsvc := snapshotservice.FromSnapshotter(svcSn)
 
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
@@ -243,12 +450,28 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 			return false, fmt.Errorf("failed to listen %q: %w", config.DebugAddress, err)
 		}
 		go func() {
-			if err := http.Serve(l, debugServerMux()); err != nil {
+			freezer, _ := rs.(snbase.Freezer)
+			if err := http.Serve(l, debugServerMux(prune, freezer, progressBroker, controller)); err != nil {
 				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", addr, err)
 			}
 		}()
 	}
 
+	if config.WarmnessAddress != "" && controller != nil {
+		log.G(ctx).Infof("listen %q for warmness API", config.WarmnessAddress)
+		l, err := net.Listen("tcp", config.WarmnessAddress)
+		if err != nil {
+			return false, fmt.Errorf("failed to get listener for warmness API: %w", err)
+		}
+		m := http.NewServeMux()
+		m.Handle("/v1/warmness", warmnessHandler(controller))
+		go func() {
+			if err := http.Serve(l, m); err != nil {
+				errCh <- fmt.Errorf("error on serving warmness API via %q: %w", config.WarmnessAddress, err)
+			}
+		}()
+	}
+
 	// Listen and serve
 	l, err := net.Listen("unix", addr)
 	if err != nil {
@@ -289,27 +512,66 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 const (
 	memoryMetadataType = "memory"
 	dbMetadataType     = "db"
+
+	// metadataMemoryExpvarName is the name of the expvar reporting the memory kept by the
+	// "memory" metadata store.
+	metadataMemoryExpvarName = "stargz_metadata_memory"
 )
 
-func getMetadataStore(rootDir string, config snapshotterConfig) (metadata.Store, error) {
+// pruneFunc removes unused metadata and returns the number of reclaimed bytes.
+type pruneFunc func() (int64, error)
+
+func getMetadataStore(ctx context.Context, rootDir string, config snapshotterConfig) (metadata.Store, pruneFunc, error) {
 	switch config.MetadataStore {
 	case "", memoryMetadataType:
-		return memorymetadata.NewReader, nil
-	case dbMetadataType:
-		bOpts := bolt.Options{
-			NoFreelistSync:  true,
-			InitialMmapSize: 64 * 1024 * 1024,
-			FreelistType:    bolt.FreelistMapType,
-		}
-		db, err := bolt.Open(filepath.Join(rootDir, "metadata.db"), 0600, &bOpts)
-		if err != nil {
-			return nil, err
+		var (
+			fallback metadata.Store
+			prune    pruneFunc
+		)
+		if config.MetadataMemoryBudgetMB > 0 {
+			var err error
+			if fallback, prune, err = getDBMetadataStore(ctx, rootDir, config); err != nil {
+				return nil, nil, err
+			}
 		}
-		return func(sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader, error) {
-			return dbmetadata.NewReader(db, sr, opts...)
-		}, nil
+		b := metadata.NewBudget(memorymetadata.NewReader, fallback, config.MetadataMemoryBudgetMB<<20)
+		expvar.Publish(metadataMemoryExpvarName, expvar.Func(func() interface{} { return b.Usage() }))
+		return b.Store, prune, nil
+	case dbMetadataType:
+		return getDBMetadataStore(ctx, rootDir, config)
 	default:
-		return nil, fmt.Errorf("unknown metadata store type: %v; must be %v or %v",
+		return nil, nil, fmt.Errorf("unknown metadata store type: %v; must be %v or %v",
 			config.MetadataStore, memoryMetadataType, dbMetadataType)
 	}
 }
+
+// getDBMetadataStore opens the metadata DB and returns the store backed by it.
+func getDBMetadataStore(ctx context.Context, rootDir string, config snapshotterConfig) (metadata.Store, pruneFunc, error) {
+	bOpts := bolt.Options{
+		NoFreelistSync:  true,
+		InitialMmapSize: 64 * 1024 * 1024,
+		FreelistType:    bolt.FreelistMapType,
+	}
+	dir := rootDir
+	if config.MetadataDir != "" {
+		dir = config.MetadataDir
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, nil, err
+		}
+	}
+	db, err := bolt.Open(filepath.Join(dir, "metadata.db"), 0600, &bOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	retention := time.Duration(config.MetadataPruneRetentionSec) * time.Second
+	if interval := config.MetadataPruneIntervalSec; interval > 0 {
+		go dbmetadata.PruneEvery(ctx, db, time.Duration(interval)*time.Second, retention)
+	}
+	store := func(sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader, error) {
+		return dbmetadata.NewReader(db, sr, opts...)
+	}
+	prune := func() (int64, error) {
+		return dbmetadata.Prune(db, retention)
+	}
+	return store, prune, nil
+}
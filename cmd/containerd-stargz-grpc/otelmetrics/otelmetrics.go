@@ -0,0 +1,234 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package otelmetrics exports metrics of snapshot operations served by the snapshotter
+// gRPC API through OpenTelemetry (OTLP), in addition to the Prometheus metrics.
+package otelmetrics
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/version"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/unit"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"google.golang.org/grpc"
+)
+
+const (
+	// instrumentationName is the name of the meter of the snapshotter.
+	instrumentationName = "github.com/containerd/stargz-snapshotter"
+
+	// operationDurationName is the name of the histogram of the latency of snapshot operations.
+	operationDurationName = "stargz.snapshotter.operation.duration"
+
+	remoteLabel   = "containerd.io/snapshot/remote"
+	targetLabel   = "containerd.io/snapshot.ref"
+	imageRefLabel = "containerd.io/snapshot/cri.image-ref"
+
+	defaultInterval = time.Minute
+)
+
+// Attributes of the measurements.
+const (
+	// OperationKey is the snapshot operation ("prepare", "commit" or "remove").
+	OperationKey = attribute.Key("operation")
+
+	// ErrorClassKey is the class of the error of the operation (e.g. "not_found").
+	// Empty means the operation succeeded.
+	ErrorClassKey = attribute.Key("error.class")
+
+	// RemoteKey is true if the snapshot is a remote snapshot (i.e. lazily pulled).
+	RemoteKey = attribute.Key("remote")
+
+	// ImageKey is the reference of the image of the snapshot passed by CRI.
+	ImageKey = attribute.Key("image")
+)
+
+// Config is the config of the OTLP exporter.
+type Config struct {
+	// Endpoint is the address (host:port) of the OTLP gRPC receiver.
+	Endpoint string
+
+	// Insecure disables TLS for the receiver.
+	Insecure bool
+
+	// Interval is the interval of exporting metrics. Zero uses 1 minute.
+	Interval time.Duration
+}
+
+// Exporter periodically exports metrics recorded by its meter to an OTLP receiver.
+type Exporter struct {
+	provider *sdkmetric.MeterProvider
+}
+
+// NewExporter returns an exporter sending metrics to the OTLP receiver.
+func NewExporter(ctx context.Context, cfg Config) (*Exporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("endpoint of OTLP receiver must be specified")
+	}
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	exp, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("containerd-stargz-grpc"),
+		semconv.ServiceVersionKey.String(version.Version),
+	)
+	return &Exporter{
+		provider: sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(interval))),
+			sdkmetric.WithResource(res),
+		),
+	}, nil
+}
+
+// Meter returns the meter of the snapshotter.
+func (e *Exporter) Meter() metric.Meter {
+	return e.provider.Meter(instrumentationName)
+}
+
+// Shutdown exports the remaining metrics and stops the exporter.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	return e.provider.Shutdown(ctx)
+}
+
+// UnaryServerInterceptor returns the interceptor extracting the trace context (W3C Trace
+// Context) propagated by containerd so that measurements are recorded in the context of
+// the trace of the operation.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return otelgrpc.UnaryServerInterceptor(otelgrpc.WithPropagators(propagation.TraceContext{}))
+}
+
+// NewSnapshotter returns the snapshotter recording the latency of Prepare, Commit and
+// Remove to the meter. Measurements are recorded with the context of the request.
+func NewSnapshotter(sn snapshots.Snapshotter, meter metric.Meter) (snapshots.Snapshotter, error) {
+	duration, err := meter.SyncFloat64().Histogram(operationDurationName,
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("Latency of snapshot operations"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create histogram %q: %w", operationDurationName, err)
+	}
+	return &snapshotter{Snapshotter: sn, duration: duration}, nil
+}
+
+type snapshotter struct {
+	snapshots.Snapshotter
+	duration syncfloat64.Histogram
+}
+
+func (s *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	start := time.Now()
+	mounts, err := s.Snapshotter.Prepare(ctx, key, parent, opts...)
+
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			break
+		}
+	}
+	recErr, remote := err, false
+	if _, ok := base.Labels[targetLabel]; ok && errdefs.IsAlreadyExists(err) {
+		// The remote snapshot is committed with the target name. This is the success of
+		// preparing a remote snapshot, not an error.
+		recErr, remote = nil, true
+	}
+	s.record(ctx, "prepare", start, recErr, remote, base.Labels[imageRefLabel])
+	return mounts, err
+}
+
+func (s *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	remote, image := s.labels(ctx, key)
+	start := time.Now()
+	err := s.Snapshotter.Commit(ctx, name, key, opts...)
+	s.record(ctx, "commit", start, err, remote, image)
+	return err
+}
+
+func (s *snapshotter) Remove(ctx context.Context, key string) error {
+	remote, image := s.labels(ctx, key)
+	start := time.Now()
+	err := s.Snapshotter.Remove(ctx, key)
+	s.record(ctx, "remove", start, err, remote, image)
+	return err
+}
+
+// labels returns the attributes of the snapshot recorded in its labels.
+func (s *snapshotter) labels(ctx context.Context, key string) (remote bool, image string) {
+	info, err := s.Snapshotter.Stat(ctx, key)
+	if err != nil {
+		return false, ""
+	}
+	_, remote = info.Labels[remoteLabel]
+	return remote, info.Labels[imageRefLabel]
+}
+
+func (s *snapshotter) record(ctx context.Context, op string, start time.Time, err error, remote bool, image string) {
+	attrs := []attribute.KeyValue{
+		OperationKey.String(op),
+		ErrorClassKey.String(errorClass(err)),
+		RemoteKey.Bool(remote),
+	}
+	if image != "" {
+		attrs = append(attrs, ImageKey.String(image))
+	}
+	s.duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), attrs...)
+}
+
+// errorClass returns the class of the error following errdefs.
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errdefs.IsNotFound(err):
+		return "not_found"
+	case errdefs.IsAlreadyExists(err):
+		return "already_exists"
+	case errdefs.IsFailedPrecondition(err):
+		return "failed_precondition"
+	case errdefs.IsInvalidArgument(err):
+		return "invalid_argument"
+	case errdefs.IsUnavailable(err):
+		return "unavailable"
+	case errdefs.IsCanceled(err):
+		return "canceled"
+	case errdefs.IsDeadlineExceeded(err):
+		return "deadline_exceeded"
+	}
+	return "unknown"
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package otelmetrics
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestSnapshotter(t *testing.T) {
+	ctx := context.Background()
+	reader := sdkmetric.NewManualReader()
+	sn, err := NewSnapshotter(&testSnapshotter{
+		infos: map[string]snapshots.Info{
+			"remote": {Labels: map[string]string{remoteLabel: "remote snapshot", imageRefLabel: "example.com/foo:1"}},
+			"local":  {Labels: map[string]string{imageRefLabel: "example.com/foo:1"}},
+		},
+	}, sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter(instrumentationName))
+	if err != nil {
+		t.Fatalf("failed to create snapshotter: %v", err)
+	}
+
+	if _, err := sn.Prepare(ctx, "target", "", snapshots.WithLabels(map[string]string{
+		targetLabel:   "remote",
+		imageRefLabel: "example.com/foo:1",
+	})); !errdefs.IsAlreadyExists(err) {
+		t.Errorf("error of the remote snapshot must be kept; got %v", err)
+	}
+	if _, err := sn.Prepare(ctx, "active", ""); err != nil {
+		t.Errorf("failed to prepare: %v", err)
+	}
+	if err := sn.Commit(ctx, "local-committed", "local"); err != nil {
+		t.Errorf("failed to commit: %v", err)
+	}
+	if err := sn.Remove(ctx, "remote"); err != nil {
+		t.Errorf("failed to remove: %v", err)
+	}
+	if err := sn.Remove(ctx, "unknown"); !errdefs.IsNotFound(err) {
+		t.Errorf("error must be kept; got %v", err)
+	}
+
+	rm, err := reader.Collect(ctx)
+	if err != nil {
+		t.Fatalf("failed to collect: %v", err)
+	}
+	got := make(map[string]uint64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != operationDurationName {
+				continue
+			}
+			h, ok := m.Data.(metricdata.Histogram)
+			if !ok {
+				t.Fatalf("unexpected data type %T", m.Data)
+			}
+			for _, dp := range h.DataPoints {
+				got[attrsString(dp.Attributes)] += dp.Count
+			}
+		}
+	}
+	want := map[string]uint64{
+		"operation=prepare,error.class=,remote=true,image=example.com/foo:1": 1,
+		"operation=prepare,error.class=,remote=false":                        1,
+		"operation=commit,error.class=,remote=false,image=example.com/foo:1": 1,
+		"operation=remove,error.class=,remote=true,image=example.com/foo:1":  1,
+		"operation=remove,error.class=not_found,remote=false":                1,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("count of %q = %d; want %d", k, got[k], v)
+		}
+	}
+}
+
+func attrsString(set attribute.Set) string {
+	var s string
+	for _, k := range []attribute.Key{OperationKey, ErrorClassKey, RemoteKey, ImageKey} {
+		if v, ok := set.Value(k); ok {
+			if s != "" {
+				s += ","
+			}
+			s += fmt.Sprintf("%s=%s", k, v.Emit())
+		}
+	}
+	return s
+}
+
+type testSnapshotter struct {
+	snapshots.Snapshotter
+	infos map[string]snapshots.Info
+}
+
+func (s *testSnapshotter) Stat(ctx context.Context, key string) (snapshots.Info, error) {
+	info, ok := s.infos[key]
+	if !ok {
+		return snapshots.Info{}, fmt.Errorf("snapshot %q: %w", key, errdefs.ErrNotFound)
+	}
+	return info, nil
+}
+
+func (s *testSnapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	if target, ok := base.Labels[targetLabel]; ok {
+		return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+	}
+	return []mount.Mount{{Type: "bind", Source: "/"}}, nil
+}
+
+func (s *testSnapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *testSnapshotter) Remove(ctx context.Context, key string) error {
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	return nil
+}
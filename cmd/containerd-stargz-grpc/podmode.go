@@ -0,0 +1,117 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const fuseDevice = "/dev/fuse"
+
+// checkPodMode checks that the snapshotter running in a pod without broad hostPath mounts
+// can serve layers: /dev/fuse (e.g. provided by a device plugin) must be accessible and
+// the root directory must be on a mount propagated to the host (e.g. a CSI volume mounted
+// with Bidirectional propagation) so that containerd can see the mounted layers.
+func checkPodMode(rootDir string) error {
+	f, err := os.OpenFile(fuseDevice, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("%s isn't accessible; provide it with a device plugin: %w", fuseDevice, err)
+	}
+	f.Close()
+	if err := os.MkdirAll(rootDir, 0700); err != nil {
+		return err
+	}
+	shared, mountpoint, err := isSharedMount(rootDir)
+	if err != nil {
+		return fmt.Errorf("failed to check mount propagation of %q: %w", rootDir, err)
+	}
+	if !shared {
+		return fmt.Errorf("root directory %q is on mount %q without shared propagation; mount a volume with Bidirectional propagation", rootDir, mountpoint)
+	}
+	return nil
+}
+
+// isSharedMount returns true if the mount containing the path propagates mount events to
+// its peers. This also returns the mountpoint of the mount.
+func isSharedMount(p string) (bool, string, error) {
+	p, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false, "", err
+	}
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, "", err
+	}
+	defer f.Close()
+	var (
+		mountpoint string
+		shared     bool
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// e.g. "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 shared:2 - ext3 /dev/root rw"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		mp := unescapeMountinfo(fields[4])
+		if !isPathPrefix(mp, p) || len(mp) < len(mountpoint) {
+			continue
+		}
+		mountpoint, shared = mp, false // later mounts on the same mountpoint hide earlier ones
+		for _, opt := range fields[6:] {
+			if opt == "-" {
+				break
+			}
+			if strings.HasPrefix(opt, "shared:") {
+				shared = true
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, "", err
+	}
+	return shared, mountpoint, nil
+}
+
+func isPathPrefix(prefix, p string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// unescapeMountinfo decodes octal escapes (e.g. "\040" for a space) in mountinfo.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			var c int
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -17,13 +17,45 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"expvar"
 	"net/http"
 	"net/http/pprof"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/egress"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/progress"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 )
 
-func debugServerMux() *http.ServeMux {
+func debugServerMux(prune pruneFunc, freezer snbase.Freezer, progressBroker *progress.Broker, controller *fs.Controller) *http.ServeMux {
 	m := http.NewServeMux()
+	if controller != nil {
+		m.Handle("/debug/layers", layersHandler(controller))
+		m.Handle("/debug/layers/prefetch", prefetchHandler(controller))
+		m.Handle("/debug/layers/solidify", solidifyHandler(controller))
+		m.Handle("/debug/layers/priority", readPriorityHandler(controller))
+		m.Handle("/debug/cache/purge", purgeCacheHandler(controller))
+		m.Handle("/debug/fetch", fetchStatusHandler(controller))
+		m.Handle("/debug/fetch/pause", pauseFetchHandler(controller, true))
+		m.Handle("/debug/fetch/resume", pauseFetchHandler(controller, false))
+		m.Handle("/debug/egress", egressHandler(controller))
+		m.Handle("/debug/offline", offlineStatusHandler(controller))
+		m.Handle("/debug/offline/mode", offlineModeHandler(controller))
+	}
+	if progressBroker != nil {
+		m.Handle("/debug/layers/progress", progressHandler(progressBroker))
+	}
+	if prune != nil {
+		m.Handle("/debug/metadata/prune", pruneHandler(prune))
+	}
+	m.Handle("/debug/metadata/memory", metadataMemoryHandler())
+	if freezer != nil {
+		m.Handle("/debug/snapshots/freeze", freezeHandler(freezer))
+	}
 	m.Handle("/debug/vars", expvar.Handler())
 	m.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
 	m.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
@@ -32,3 +64,316 @@ func debugServerMux() *http.ServeMux {
 	m.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 	return m
 }
+
+// pruneHandler removes unused metadata on POST and reports the reclaimed bytes.
+func pruneHandler(prune pruneFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		reclaimed, err := prune()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, struct {
+			ReclaimedBytes int64 `json:"reclaimed_bytes"`
+		}{reclaimed})
+	})
+}
+
+// metadataMemoryHandler reports the memory kept by the "memory" metadata store.
+func metadataMemoryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		v := expvar.Get(metadataMemoryExpvarName)
+		if v == nil {
+			http.Error(w, "memory usage is reported only by the \"memory\" metadata store", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, v.(expvar.Func)())
+	})
+}
+
+// freezeHandler writes a bundle of the snapshot specified by the "key" parameter to the
+// directory specified by the "dir" parameter on POST.
+func freezeHandler(freezer snbase.Freezer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key, dir := r.FormValue("key"), r.FormValue("dir")
+		if key == "" || dir == "" {
+			http.Error(w, "key and dir must be specified", http.StatusBadRequest)
+			return
+		}
+		if err := freezer.Freeze(r.Context(), key, dir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// progressHandler streams the progress of fetching layers in background as
+// newline-delimited JSON until the client disconnects.
+func progressHandler(b *progress.Broker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		enc := json.NewEncoder(w)
+		for e := range b.Subscribe(r.Context()) {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// warmnessHandler reports how much of each image with mounted layers is fetched to this
+// node. The "ref" parameter limits the result to the image of the reference.
+func warmnessHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		images, err := c.Warmness(r.FormValue("ref"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, images)
+	})
+}
+
+// layersHandler reports the status of the mounted layers keyed by the mountpoint.
+func layersHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		layers, err := c.Layers()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, layers)
+	})
+}
+
+// prefetchHandler prefetches the layer mounted on the "mountpoint" parameter on POST.
+func prefetchHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mp := r.FormValue("mountpoint")
+		if mp == "" {
+			http.Error(w, "mountpoint must be specified", http.StatusBadRequest)
+			return
+		}
+		if err := c.Prefetch(mp); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// solidifyHandler solidifies the layer mounted on the "mountpoint" parameter, or all
+// mounted layers of the image of the "ref" parameter, on POST. This responds after all
+// of them are fetched and verified.
+func solidifyHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mp, ref := r.FormValue("mountpoint"), r.FormValue("ref")
+		if (mp == "") == (ref == "") {
+			http.Error(w, "either of mountpoint or ref must be specified", http.StatusBadRequest)
+			return
+		}
+		mps := []string{mp}
+		if ref != "" {
+			var err error
+			if mps, err = c.SolidifyImage(r.Context(), ref); err != nil {
+				writeError(w, err)
+				return
+			}
+		} else if err := c.Solidify(r.Context(), mp); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			Solidified []string `json:"solidified"`
+		}{mps})
+	})
+}
+
+// readPriorityHandler sets the read priority class specified by the "class" parameter
+// ("normal" or "low") to the layer mounted on the "mountpoint" parameter on POST.
+func readPriorityHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mp := r.FormValue("mountpoint")
+		if mp == "" {
+			http.Error(w, "mountpoint must be specified", http.StatusBadRequest)
+			return
+		}
+		p, err := layer.ParseReadPriority(r.FormValue("class"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.SetReadPriority(mp, p); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// purgeCacheHandler drops unused layers and their caches on POST.
+func purgeCacheHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := c.PurgeCache()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			Purged int `json:"purged"`
+		}{n})
+	})
+}
+
+// fetchStatusHandler reports whether fetching layers in background is paused.
+func fetchStatusHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		paused, err := c.BackgroundFetchPaused()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, struct {
+			Paused bool `json:"paused"`
+		}{paused})
+	})
+}
+
+// pauseFetchHandler pauses or resumes fetching layers in background on POST.
+func pauseFetchHandler(c *fs.Controller, pause bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err := c.PauseBackgroundFetch(pause); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// offlineStatusHandler reports the status of the offline mode.
+func offlineStatusHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status, err := c.OfflineStatus()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, status)
+	})
+}
+
+// offlineModeHandler changes the offline mode on POST.
+func offlineModeHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		mode := r.FormValue("mode")
+		if mode == "" {
+			http.Error(w, "mode must be specified", http.StatusBadRequest)
+			return
+		}
+		if err := c.SetOfflineMode(mode); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// egressHandler dumps the bytes fetched from registries for each namespace, image and
+// registry as CSV.
+func egressHandler(c *fs.Controller) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		records, err := c.Egress()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		egress.WriteCSV(w, records)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if errors.Is(err, errdefs.ErrNotFound) {
+		code = http.StatusNotFound
+	} else if errors.Is(err, errdefs.ErrUnavailable) {
+		code = http.StatusServiceUnavailable
+	} else if errors.Is(err, errdefs.ErrInvalidArgument) {
+		code = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), code)
+}
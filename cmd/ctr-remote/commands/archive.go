@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/images/converter"
+	distribution "github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// convertArchive converts the image read from the docker-archive or oci-archive tarball
+// inArchive (or from containerd if empty) and writes the result to the tarball outArchive
+// (or to containerd if empty). client can be nil if both of them are specified.
+func convertArchive(ctx context.Context, client *containerd.Client, cs content.Store, inArchive, outArchive, srcRef, targetRef string, convertFunc converter.ConvertFunc) (ocispec.Descriptor, error) {
+	if client != nil {
+		var done func(context.Context) error
+		var err error
+		ctx, done, err = client.WithLease(ctx)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer done(ctx)
+	}
+
+	var srcDesc ocispec.Descriptor
+	if inArchive != "" {
+		var err error
+		if srcDesc, err = importArchive(ctx, cs, inArchive, srcRef); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	} else {
+		img, err := client.ImageService().Get(ctx, srcRef)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		srcDesc = img.Target
+	}
+
+	newDesc, err := convertFunc(ctx, cs, srcDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if newDesc == nil {
+		newDesc = &srcDesc
+	}
+
+	if outArchive != "" {
+		return *newDesc, exportArchive(ctx, cs, outArchive, *newDesc, targetRef)
+	}
+	is := client.ImageService()
+	_ = is.Delete(ctx, targetRef)
+	if _, err := is.Create(ctx, images.Image{Name: targetRef, Target: *newDesc}); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return *newDesc, nil
+}
+
+// importArchive imports the docker-archive or oci-archive tarball to the content store and
+// returns the descriptor of the image named ref in it. ref isn't checked if the archive
+// contains only one image without a name.
+func importArchive(ctx context.Context, cs content.Store, path, ref string) (ocispec.Descriptor, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer f.Close()
+	idxDesc, err := archive.ImportIndex(ctx, cs, f)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to import %q: %w", path, err)
+	}
+	p, err := content.ReadBlob(ctx, cs, idxDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(p, &idx); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse index of %q: %w", path, err)
+	}
+	names := []string{ref}
+	if named, err := distribution.ParseDockerRef(ref); err == nil {
+		names = append(names, named.String())
+	}
+	for _, m := range idx.Manifests {
+		for _, key := range []string{images.AnnotationImageName, ocispec.AnnotationRefName} {
+			for _, name := range names {
+				if v, ok := m.Annotations[key]; ok && v == name {
+					return withoutNames(m), nil
+				}
+			}
+		}
+	}
+	if len(idx.Manifests) == 1 {
+		m := idx.Manifests[0]
+		_, ok1 := m.Annotations[images.AnnotationImageName]
+		_, ok2 := m.Annotations[ocispec.AnnotationRefName]
+		if !ok1 && !ok2 {
+			return m, nil
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image %q not found in %q: %w", ref, path, errdefs.ErrNotFound)
+}
+
+// withoutNames returns the descriptor without the annotations of the name of the image.
+func withoutNames(desc ocispec.Descriptor) ocispec.Descriptor {
+	annotations := make(map[string]string)
+	for k, v := range desc.Annotations {
+		if k != images.AnnotationImageName && k != ocispec.AnnotationRefName {
+			annotations[k] = v
+		}
+	}
+	desc.Annotations = nil
+	if len(annotations) > 0 {
+		desc.Annotations = annotations
+	}
+	return desc
+}
+
+// exportArchive writes the image to the tarball as an oci-archive, which also contains
+// manifest.json of docker-archive.
+func exportArchive(ctx context.Context, cs content.Provider, path string, desc ocispec.Descriptor, ref string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := archive.Export(ctx, cs, f, archive.WithManifest(desc, ref), archive.WithAllPlatforms()); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to export to %q: %w", path, err)
+	}
+	return f.Close()
+}
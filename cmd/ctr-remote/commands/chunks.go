@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/stats"
+	"github.com/urfave/cli"
+)
+
+// ChunksCommand exports the lists of chunk digests of eStargz layers of an image
+var ChunksCommand = cli.Command{
+	Name:      "chunks",
+	Usage:     "export the lists of chunk digests of eStargz layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Export the ordered list of chunks (digest, offset in the blob and uncompressed
+size) of each eStargz layer of an image in the local content store in JSON.
+
+External tools (e.g. cache preloaders, rsync-like syncers and CDN warmers) can
+compare the lists among versions of images to find chunks they share.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Export the chunks of the image of the platform (default: the platform of the host)",
+		},
+		cli.StringFlag{
+			Name:  "output,o",
+			Usage: "Write the lists to the specified file instead of stdout",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image reference need to be specified")
+		}
+		platformMC := platforms.Default()
+		if ps := context.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platformMC = platforms.Only(p)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		l, err := stats.ComputeChunkList(ctx, client.ContentStore(), img.Target, platformMC)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(l)
+		if err != nil {
+			return fmt.Errorf("failed to marshal chunks: %w", err)
+		}
+		if out := context.String("output"); out != "" {
+			return os.WriteFile(out, b, 0644)
+		}
+		fmt.Fprintln(context.App.Writer, string(b))
+		return nil
+	},
+}
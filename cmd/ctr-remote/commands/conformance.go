@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/conformance"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+// ConformanceCommand checks that eStargz layers conform to the specification
+var ConformanceCommand = cli.Command{
+	Name:      "conformance",
+	Usage:     "check that eStargz layers of an image conform to the eStargz specification",
+	ArgsUsage: "[flags] <ref> | --file <blob>",
+	Description: `Check that eStargz layers built by third-party builders conform to the eStargz
+specification (footer, TOC fields, landmarks and chunk digests) and report each
+violation found in them.
+
+Layers of the image in the local content store are checked against the TOC digests
+in their annotations. '--file' checks a blob file instead. The command fails if any
+layer doesn't conform. '--badge' writes the result as a JSON endpoint of shields.io
+so that builders can show it in their READMEs.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "file",
+			Usage: "Check the blob file specified by the argument instead of an image",
+		},
+		cli.StringFlag{
+			Name:  "toc-digest",
+			Usage: "Expected digest of the TOC of the blob file specified by --file",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Check the image of the platform (default: the platform of the host)",
+		},
+		cli.IntFlag{
+			Name:  "max-details",
+			Usage: "Number of problems reported per check",
+			Value: 20,
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the reports in JSON",
+		},
+		cli.StringFlag{
+			Name:  "badge",
+			Usage: "Write the result as a JSON endpoint of shields.io to the file",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		target := clicontext.Args().First()
+		if target == "" {
+			return errors.New("image reference or blob file need to be specified")
+		}
+		opts := []conformance.Option{
+			conformance.WithDecompressors(new(uncompressed.Decompressor)),
+			conformance.WithMaxDetails(clicontext.Int("max-details")),
+		}
+
+		var layers []conformanceLayer
+		if clicontext.Bool("file") {
+			l, err := checkConformanceFile(target, clicontext.String("toc-digest"), opts)
+			if err != nil {
+				return err
+			}
+			layers = append(layers, l)
+		} else {
+			if clicontext.String("toc-digest") != "" {
+				return errors.New("\"toc-digest\" can be specified only with \"file\"")
+			}
+			platformMC := platforms.Default()
+			if ps := clicontext.String("platform"); ps != "" {
+				p, err := platforms.Parse(ps)
+				if err != nil {
+					return fmt.Errorf("invalid platform %q: %w", ps, err)
+				}
+				platformMC = platforms.Only(p)
+			}
+			client, ctx, cancel, err := commands.NewClient(clicontext)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			img, err := client.ImageService().Get(ctx, target)
+			if err != nil {
+				return err
+			}
+			cs := client.ContentStore()
+			mfst, err := images.Manifest(ctx, cs, img.Target, platformMC)
+			if err != nil {
+				return err
+			}
+			for _, desc := range mfst.Layers {
+				ra, err := cs.ReaderAt(ctx, desc)
+				if err != nil {
+					return err
+				}
+				lOpts := opts[:len(opts):len(opts)]
+				if d, err := digest.Parse(desc.Annotations[estargz.TOCJSONDigestAnnotation]); err == nil {
+					lOpts = append(lOpts, conformance.WithTOCDigest(d))
+				}
+				rep := conformance.Check(io.NewSectionReader(ra, 0, desc.Size), lOpts...)
+				ra.Close()
+				layers = append(layers, conformanceLayer{Layer: desc.Digest.String(), Report: rep})
+			}
+		}
+
+		var failed int
+		for _, l := range layers {
+			if !l.Report.Passed() {
+				failed++
+			}
+		}
+		if p := clicontext.String("badge"); p != "" {
+			if err := writeConformanceBadge(p, failed == 0); err != nil {
+				return err
+			}
+		}
+		if clicontext.Bool("json") {
+			b, err := json.MarshalIndent(layers, "", "\t")
+			if err != nil {
+				return fmt.Errorf("failed to marshal reports: %w", err)
+			}
+			fmt.Fprintln(clicontext.App.Writer, string(b))
+		} else {
+			for _, l := range layers {
+				fmt.Fprintf(clicontext.App.Writer, "%s (%s)\n", l.Layer, l.Report.Compression)
+				if err := l.Report.WriteText(clicontext.App.Writer); err != nil {
+					return err
+				}
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d layers don't conform to eStargz", failed, len(layers))
+		}
+		return nil
+	},
+}
+
+type conformanceLayer struct {
+	Layer  string              `json:"layer"`
+	Report *conformance.Report `json:"report"`
+}
+
+func checkConformanceFile(p, tocDigest string, opts []conformance.Option) (conformanceLayer, error) {
+	if tocDigest != "" {
+		d, err := digest.Parse(tocDigest)
+		if err != nil {
+			return conformanceLayer{}, fmt.Errorf("invalid TOC digest: %w", err)
+		}
+		opts = append(opts, conformance.WithTOCDigest(d))
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return conformanceLayer{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return conformanceLayer{}, err
+	}
+	return conformanceLayer{
+		Layer:  p,
+		Report: conformance.Check(io.NewSectionReader(f, 0, fi.Size()), opts...),
+	}, nil
+}
+
+// writeConformanceBadge writes the result as a JSON endpoint of shields.io
+// (https://shields.io/endpoint).
+func writeConformanceBadge(p string, passed bool) error {
+	badge := struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		Label         string `json:"label"`
+		Message       string `json:"message"`
+		Color         string `json:"color"`
+	}{1, "eStargz", "compatible", "brightgreen"}
+	if !passed {
+		badge.Message, badge.Color = "incompatible", "red"
+	}
+	b, err := json.Marshal(badge)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0644)
+}
@@ -18,20 +18,34 @@ package commands
 
 import (
 	"compress/gzip"
+	gocontext "context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/images/converter/uncompress"
 	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/cache"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/stats"
+	uncompressedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/uncompressed"
 	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/recorder"
+	"github.com/containerd/stargz-snapshotter/version"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -48,8 +62,18 @@ e.g., 'ctr-remote convert --estargz --oci example.com/foo:orig example.com/foo:e
 
 Use '--platform' to define the output platform.
 When '--all-platforms' is given all images in a manifest list must be available.
+
+Use '--push' to push the converted image to <target_ref>. With '--conversion-cache',
+converted layers are pushed as soon as they are converted and layers already pushed by an
+interrupted conversion are reused without being converted and pushed again, so the
+conversion can be restarted.
+
+Use '--input-archive' to read the source image from a docker-archive or oci-archive
+tarball instead of containerd, and '--output-archive' to write the converted image to
+an oci-archive tarball instead of containerd. If both are specified, containerd isn't
+needed.
 `,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// estargz flags
 		cli.BoolFlag{
 			Name:  "estargz",
@@ -69,6 +93,58 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "eStargz chunk size",
 			Value: 0,
 		},
+		cli.IntFlag{
+			Name:  "estargz-chunk-alignment",
+			Usage: "align chunks of files not smaller than this size (bytes) and the end of prioritized files to multiples of it (e.g. 1048576) by padding, so fetches line up with range caches of CDNs",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-no-landmarks",
+			Usage: "record the prefetch boundary in TOC instead of adding landmark files to layers",
+		},
+		cli.StringFlag{
+			Name:  "estargz-mtime",
+			Usage: "set the modification time of all files to this time in Unix seconds (e.g. $SOURCE_DATE_EPOCH) so that layers of the same files built at different times are the same and share caches",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-clamp-mtime",
+			Usage: "with --estargz-mtime, set the time only to files modified after it",
+		},
+		cli.StringFlag{
+			Name:  "estargz-owner",
+			Usage: "set the owner of all files to UID:GID (e.g. 0:0). Note that this changes the ownership of files in containers",
+		},
+		cli.StringFlag{
+			Name:  "estargz-encryption-key",
+			Usage: "encrypt prioritized files (--estargz-record-in) with the 32-byte key in this file while leaving other files plain. The snapshotter needs the key in decryption_keys_dir to read them",
+		},
+		cli.StringFlag{
+			Name:  "estargz-path-policy",
+			Usage: "how to deal with file names that aren't valid UTF-8 or contain control characters (\"allow\", \"reject\" or \"sanitize\")",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-summary",
+			Usage: "record the summary of each layer (number of files, total size and prefetch size) in TOC",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-cdc",
+			Usage: "decide boundaries of chunks by their contents (content-defined chunking) so that chunks are shared among versions of files. --estargz-chunk-size is used as the average chunk size",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-zstd-toc",
+			Usage: "compress TOC JSON with zstd to make it smaller. Layers converted with this option can't be lazily pulled by older snapshotters",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-binary-toc",
+			Usage: "encode TOC in the binary format (CBOR) instead of JSON, which is smaller and faster to parse. Layers converted with this option can't be lazily pulled by older snapshotters",
+		},
+		cli.StringFlag{
+			Name:  "estargz-convert-toc",
+			Usage: "re-encode TOC of eStargz layers into the specified encoding (\"json\" or \"binary\") without rebuilding them. Layers that aren't eStargz are left unchanged",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-uncompressed",
+			Usage: "keep layers as uncompressed tar and append eStargz TOC to them so they can be lazily pulled without decompression. --estargz-chunk-size and --estargz-cdc are applied. Must be used in conjunction with '--oci'",
+		},
 		// zstd:chunked flags
 		cli.BoolFlag{
 			Name:  "zstdchunked",
@@ -93,8 +169,36 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Name:  "all-platforms",
 			Usage: "Convert content for all platforms",
 		},
-	},
-	Action: func(context *cli.Context) error {
+		// cache flags
+		cli.StringFlag{
+			Name:  "conversion-cache",
+			Usage: "directory to record converted layers. Layers converted with the same options before are reused instead of being converted again",
+		},
+		cli.StringFlag{
+			Name:  "conversion-cache-repo",
+			Usage: "repository (e.g. the one where the previous result is pushed) to fetch converted layers recorded in --conversion-cache but missing in the content store",
+		},
+		// archive flags
+		cli.StringFlag{
+			Name:  "input-archive",
+			Usage: "read the source image from a docker-archive or oci-archive tarball. <source_ref> is the name of the image in the archive, which isn't checked if the archive contains only one image without a name",
+		},
+		cli.StringFlag{
+			Name:  "output-archive",
+			Usage: "write the converted image named <target_ref> to an oci-archive tarball (also containing manifest.json of docker-archive) instead of containerd",
+		},
+		// push flags
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "push the converted image to <target_ref>. Blobs already in the registry are skipped. With --conversion-cache, the conversion can be resumed from a partially pushed target",
+		},
+		// other flags
+		cli.BoolFlag{
+			Name:  "stats",
+			Usage: "print statistics of the converted layers to stderr. Use 'ctr-remote image stats --publish' to push them to the registry",
+		},
+	}, append(commands.RegistryFlags, tracingFlags...)...),
+	Action: func(context *cli.Context) (retErr error) {
 		var (
 			convertOpts = []converter.Opt{}
 		)
@@ -154,6 +258,48 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			if context.Bool("uncompress") {
 				return errors.New("option --zstdchunked conflicts with --uncompress")
 			}
+			for _, name := range []string{"estargz-zstd-toc", "estargz-binary-toc"} {
+				if context.Bool(name) {
+					return fmt.Errorf("option --zstdchunked conflicts with --%s", name)
+				}
+			}
+		}
+
+		if context.Bool("estargz-uncompressed") {
+			var uOpts []uncompressedconvert.Option
+			if context.IsSet("estargz-chunk-size") {
+				uOpts = append(uOpts, uncompressedconvert.WithChunkSize(context.Int("estargz-chunk-size")))
+			}
+			if context.Bool("estargz-cdc") {
+				uOpts = append(uOpts, uncompressedconvert.WithContentDefinedChunking())
+			}
+			layerConvertFunc = uncompressedconvert.LayerConvertFunc(uOpts...)
+			if !context.Bool("oci") {
+				return errors.New("option --estargz-uncompressed must be used in conjunction with --oci")
+			}
+			for _, name := range []string{"estargz", "zstdchunked", "uncompress"} {
+				if context.Bool(name) {
+					return fmt.Errorf("option --estargz-uncompressed conflicts with --%s", name)
+				}
+			}
+			if context.String("estargz-record-in") != "" {
+				return errors.New("option --estargz-uncompressed doesn't support --estargz-record-in because layers aren't reordered")
+			}
+		}
+
+		if enc := context.String("estargz-convert-toc"); enc != "" {
+			if enc != "json" && enc != "binary" {
+				return fmt.Errorf("unknown TOC encoding %q; must be \"json\" or \"binary\"", enc)
+			}
+			for _, name := range []string{"estargz", "zstdchunked", "estargz-uncompressed", "uncompress"} {
+				if context.Bool(name) {
+					return fmt.Errorf("option --estargz-convert-toc conflicts with --%s", name)
+				}
+			}
+			if !context.Bool("oci") {
+				logrus.Warn("option --estargz-convert-toc should be used in conjunction with --oci")
+			}
+			layerConvertFunc = estargzconvert.TOCConvertFunc(enc == "binary")
 		}
 
 		if context.Bool("uncompress") {
@@ -163,17 +309,102 @@ When '--all-platforms' is given all images in a manifest list must be available.
 		if layerConvertFunc == nil {
 			return errors.New("specify layer converter")
 		}
-		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
 
 		if context.Bool("oci") {
 			convertOpts = append(convertOpts, converter.WithDockerToOCI(true))
 		}
 
-		client, ctx, cancel, err := commands.NewClient(context)
-		if err != nil {
-			return err
+		inArchive, outArchive := context.String("input-archive"), context.String("output-archive")
+		push := context.Bool("push")
+		if push && outArchive != "" {
+			return errors.New("option --push conflicts with --output-archive")
+		}
+		var (
+			client *containerd.Client
+			ctx    gocontext.Context
+			cancel gocontext.CancelFunc
+			cs     content.Store
+		)
+		if inArchive != "" && outArchive != "" {
+			// Converting from a file to a file doesn't need containerd.
+			ctx, cancel = commands.AppContext(context)
+			defer cancel()
+			tmpDir, err := os.MkdirTemp("", "ctr-remote-convert")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir)
+			if cs, err = local.NewStore(tmpDir); err != nil {
+				return err
+			}
+		} else {
+			var err error
+			client, ctx, cancel, err = commands.NewClient(context)
+			if err != nil {
+				return err
+			}
+			defer cancel()
+			cs = client.ContentStore()
 		}
-		defer cancel()
+
+		var resolver remotes.Resolver
+		if push || context.String("conversion-cache-repo") != "" {
+			var err error
+			if resolver, err = commands.GetResolver(ctx, context); err != nil {
+				return err
+			}
+		}
+
+		// pushCS is the content store where the converted image is pushed from. This
+		// contains converted blobs that are only in the target registry.
+		pushCS := cs
+		if cacheDir := context.String("conversion-cache"); cacheDir != "" {
+			var cacheOpts []cache.Option
+			if repo := context.String("conversion-cache-repo"); repo != "" {
+				fetcher, err := resolver.Fetcher(ctx, repo)
+				if err != nil {
+					return err
+				}
+				cacheOpts = append(cacheOpts, cache.WithFetcher(fetcher))
+			}
+			if push {
+				cacheOpts = append(cacheOpts, cache.WithTarget(resolver, targetRef))
+			}
+			c, err := cache.NewCache(cacheDir, cacheOpts...)
+			if err != nil {
+				return err
+			}
+			if push {
+				pushCS = c.ContentStore(cs)
+			}
+			optsKey, err := conversionOptsKey(context)
+			if err != nil {
+				return err
+			}
+			layerConvertFunc = c.LayerConvertFunc(optsKey, layerConvertFunc)
+		}
+		layerConvertFunc = traceWrapper(layerConvertFunc)
+		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
+		indexConvertFunc := converter.DefaultIndexConvertFunc(layerConvertFunc, context.Bool("oci"), platformMC)
+		if pushCS != cs {
+			// Converted blobs only in the target registry must be visible to the converter.
+			convertIndex := indexConvertFunc
+			indexConvertFunc = func(ctx gocontext.Context, _ content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+				return convertIndex(ctx, pushCS, desc)
+			}
+			convertOpts = append(convertOpts, converter.WithIndexConvertFunc(indexConvertFunc))
+		}
+
+		ctx, endTracing := startTracing(ctx, context, "convert")
+		defer func() {
+			if err := endTracing(retErr); err != nil {
+				if retErr == nil {
+					retErr = fmt.Errorf("failed to output trace: %w", err)
+				} else {
+					logrus.WithError(err).Warn("failed to output trace")
+				}
+			}
+		}()
 
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, os.Interrupt)
@@ -186,11 +417,38 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			case <-ctx.Done():
 			}
 		}()
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
+		var (
+			newDesc ocispec.Descriptor
+			err     error
+		)
+		if inArchive != "" || outArchive != "" {
+			newDesc, err = convertArchive(ctx, client, cs, inArchive, outArchive, srcRef, targetRef, indexConvertFunc)
+		} else {
+			var newImg *images.Image
+			if newImg, err = converter.Convert(ctx, client, targetRef, srcRef, convertOpts...); err == nil {
+				newDesc = newImg.Target
+			}
+		}
 		if err != nil {
 			return err
 		}
-		fmt.Fprintln(context.App.Writer, newImg.Target.Digest.String())
+		fmt.Fprintln(context.App.Writer, newDesc.Digest.String())
+		if push {
+			pusher, err := resolver.Pusher(ctx, targetRef)
+			if err != nil {
+				return err
+			}
+			if err := remotes.PushContent(ctx, pusher, newDesc, pushCS, nil, platformMC, nil); err != nil {
+				return fmt.Errorf("failed to push %q: %w", targetRef, err)
+			}
+		}
+		if context.Bool("stats") {
+			img, _, err := stats.Compute(ctx, cs, newDesc, platformMC)
+			if err != nil {
+				return fmt.Errorf("failed to compute statistics: %w", err)
+			}
+			return renderStats(context.App.ErrWriter, img)
+		}
 		return nil
 	},
 }
@@ -200,6 +458,34 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 		estargz.WithCompressionLevel(context.Int("estargz-compression-level")),
 		estargz.WithChunkSize(context.Int("estargz-chunk-size")),
 	}
+	if a := context.Int("estargz-chunk-alignment"); a > 0 {
+		esgzOpts = append(esgzOpts, estargz.WithChunkAlignment(a))
+	}
+	if context.Bool("estargz-no-landmarks") {
+		esgzOpts = append(esgzOpts, estargz.WithoutLandmarks())
+	}
+	if context.Bool("estargz-summary") {
+		esgzOpts = append(esgzOpts, estargz.WithSummary())
+	}
+	if context.Bool("estargz-cdc") {
+		esgzOpts = append(esgzOpts, estargz.WithContentDefinedChunking())
+	}
+	if context.Bool("estargz-zstd-toc") && !context.Bool("zstdchunked") {
+		esgzOpts = append(esgzOpts, estargz.WithZstdTOC())
+	}
+	if context.Bool("estargz-binary-toc") && !context.Bool("zstdchunked") {
+		esgzOpts = append(esgzOpts, estargz.WithBinaryTOC())
+	}
+	pathPolicy, err := estargz.ParsePathPolicy(context.String("estargz-path-policy"))
+	if err != nil {
+		return nil, err
+	}
+	esgzOpts = append(esgzOpts, estargz.WithPathPolicy(pathPolicy))
+	normalizeOpts, err := getNormalizeOpts(context)
+	if err != nil {
+		return nil, err
+	}
+	esgzOpts = append(esgzOpts, normalizeOpts...)
 	if estargzRecordIn := context.String("estargz-record-in"); estargzRecordIn != "" {
 		paths, err := readPathsFromRecordFile(estargzRecordIn)
 		if err != nil {
@@ -209,9 +495,90 @@ func getESGZConvertOpts(context *cli.Context) ([]estargz.Option, error) {
 		var ignored []string
 		esgzOpts = append(esgzOpts, estargz.WithAllowPrioritizeNotFound(&ignored))
 	}
+	if keyFile := context.String("estargz-encryption-key"); keyFile != "" {
+		if context.String("estargz-record-in") == "" {
+			return nil, errors.New("option --estargz-encryption-key must be used in conjunction with --estargz-record-in")
+		}
+		key, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		esgzOpts = append(esgzOpts, estargz.WithPrioritizedFilesEncryption(key))
+	}
 	return esgzOpts, nil
 }
 
+// getNormalizeOpts returns options to normalize timestamps and owners of files in layers.
+func getNormalizeOpts(context *cli.Context) ([]estargz.Option, error) {
+	var opts []estargz.Option
+	if s := context.String("estargz-mtime"); s != "" {
+		sec, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --estargz-mtime %q: %w", s, err)
+		}
+		if context.Bool("estargz-clamp-mtime") {
+			opts = append(opts, estargz.WithClampedModTime(time.Unix(sec, 0)))
+		} else {
+			opts = append(opts, estargz.WithModTime(time.Unix(sec, 0)))
+		}
+	} else if context.Bool("estargz-clamp-mtime") {
+		return nil, errors.New("option --estargz-clamp-mtime must be used in conjunction with --estargz-mtime")
+	}
+	if s := context.String("estargz-owner"); s != "" {
+		ids := strings.SplitN(s, ":", 2)
+		if len(ids) != 2 {
+			return nil, fmt.Errorf("invalid --estargz-owner %q: must be UID:GID", s)
+		}
+		uid, err := strconv.Atoi(ids[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID of --estargz-owner %q: %w", s, err)
+		}
+		gid, err := strconv.Atoi(ids[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid GID of --estargz-owner %q: %w", s, err)
+		}
+		opts = append(opts, estargz.WithOwner(uid, gid))
+	}
+	return opts, nil
+}
+
+// conversionOptsKey returns the key identifying the options of layer conversion. Layers
+// converted with different keys don't share results in the conversion cache.
+func conversionOptsKey(context *cli.Context) (string, error) {
+	key := []string{version.Version, version.Revision}
+	for _, name := range []string{"estargz", "zstdchunked", "estargz-uncompressed", "uncompress", "estargz-no-landmarks", "estargz-summary", "estargz-cdc", "estargz-zstd-toc", "estargz-binary-toc", "estargz-clamp-mtime"} {
+		key = append(key, fmt.Sprintf("%s=%v", name, context.Bool(name)))
+	}
+	for _, name := range []string{"estargz-compression-level", "estargz-chunk-size", "estargz-chunk-alignment"} {
+		key = append(key, fmt.Sprintf("%s=%d", name, context.Int(name)))
+	}
+	for _, name := range []string{"estargz-path-policy", "estargz-mtime", "estargz-owner"} {
+		key = append(key, fmt.Sprintf("%s=%s", name, context.String(name)))
+	}
+	key = append(key, fmt.Sprintf("estargz-convert-toc=%s", context.String("estargz-convert-toc")))
+	if keyFile := context.String("estargz-encryption-key"); keyFile != "" {
+		k, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		key = append(key, fmt.Sprintf("estargz-encryption-key=%s", estargz.KeyID(k)))
+	}
+	if recordIn := context.String("estargz-record-in"); recordIn != "" {
+		// The record file changes prioritized files even with the same file name.
+		f, err := os.Open(recordIn)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		dgst, err := digest.FromReader(f)
+		if err != nil {
+			return "", err
+		}
+		key = append(key, fmt.Sprintf("estargz-record-in=%s", dgst))
+	}
+	return strings.Join(key, "\n"), nil
+}
+
 func readPathsFromRecordFile(filename string) ([]string, error) {
 	r, err := os.Open(filename)
 	if err != nil {
@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/fs/explain"
+	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli"
+)
+
+const defaultSnapshotterConfigPath = "/etc/containerd-stargz-grpc/config.toml"
+
+// ExplainCommand explains whether an image is lazily pulled by the snapshotter
+var ExplainCommand = cli.Command{
+	Name:      "explain",
+	Usage:     "explain whether an image is lazily pulled and the condition blocking it",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Explain whether the snapshotter lazily pulls layers of an image and, if not, the
+exact condition blocking it.
+
+The manifest annotations, the footer of each layer and the support of range requests
+by the registry are checked in the registry, together with the config of the
+snapshotter ('--config'). The registry is accessed with the mirrors in the config and
+the credentials in the docker config, in the same way as the snapshotter.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "Path to the config file of the snapshotter",
+			Value: defaultSnapshotterConfigPath,
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Explain the image of the platform (default: the platform of the host)",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the report in JSON",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return errors.New("image reference need to be specified")
+		}
+		platformMC := platforms.Default()
+		if ps := clicontext.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platformMC = platforms.Only(p)
+		}
+		var config service.Config
+		if p := clicontext.String("config"); p != "" {
+			tree, err := toml.LoadFile(p)
+			if err == nil {
+				err = tree.Unmarshal(&config)
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(clicontext.App.ErrWriter, "config %q not found; using the default config\n", p)
+			} else if err != nil {
+				return fmt.Errorf("failed to load config %q: %w", p, err)
+			}
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), dockerconfig.NewDockerconfigKeychain(ctx))
+		r, err := explain.New(config.Config, hostname, hosts).Explain(ctx, ref, platformMC)
+		if err != nil {
+			return err
+		}
+		if clicontext.Bool("json") {
+			b, err := json.MarshalIndent(r, "", "\t")
+			if err != nil {
+				return fmt.Errorf("failed to marshal report: %w", err)
+			}
+			fmt.Fprintln(clicontext.App.Writer, string(b))
+			return nil
+		}
+		return r.WriteText(clicontext.App.Writer)
+	},
+}
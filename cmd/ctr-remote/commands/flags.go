@@ -41,6 +41,7 @@ import (
 	"github.com/rs/xid"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
 )
 
 const netnsMountDir = "/var/run/netns"
@@ -127,6 +128,18 @@ var samplerFlags = []cli.Flag{
 }
 
 func getSpecOpts(clicontext *cli.Context) func(image containerd.Image, rootfs string) (opts []oci.SpecOpts, done func() error, rErr error) {
+	return newSpecOpts(clicontext, "", false)
+}
+
+// getServiceSpecOpts returns the runtime configuration of a sandbox that runs in the
+// network namespace shared among images (sharedNetNS). If service is true, flags specific
+// to the workload of the source image (e.g. --entrypoint and --args) aren't applied so
+// the image runs with its default configuration.
+func getServiceSpecOpts(clicontext *cli.Context, sharedNetNS string, service bool) func(image containerd.Image, rootfs string) (opts []oci.SpecOpts, done func() error, rErr error) {
+	return newSpecOpts(clicontext, sharedNetNS, service)
+}
+
+func newSpecOpts(clicontext *cli.Context, sharedNetNS string, service bool) func(image containerd.Image, rootfs string) (opts []oci.SpecOpts, done func() error, rErr error) {
 	return func(image containerd.Image, rootfs string) (opts []oci.SpecOpts, done func() error, rErr error) {
 		var cleanups []func() error
 		done = func() (allErr error) {
@@ -145,11 +158,6 @@ func getSpecOpts(clicontext *cli.Context) func(image containerd.Image, rootfs st
 			}
 		}()
 
-		entrypointOpt, err := withEntrypointArgs(clicontext, image)
-		if err != nil {
-			rErr = fmt.Errorf("failed to parse entrypoint and arg flags: %w", err)
-			return
-		}
 		resolverOpt, cleanup, err := withResolveConfig(clicontext)
 		if err != nil {
 			rErr = fmt.Errorf("failed to parse DNS-related flags: %w", err)
@@ -173,25 +181,37 @@ func getSpecOpts(clicontext *cli.Context) func(image containerd.Image, rootfs st
 			oci.WithEnv(clicontext.StringSlice("env")),
 			oci.WithMounts(mounts),
 			resolverOpt,
-			entrypointOpt,
 		)
 		if envFile := clicontext.String("env-file"); envFile != "" {
 			opts = append(opts, oci.WithEnvFile(envFile))
 		}
-		if username := clicontext.String("user"); username != "" {
-			opts = append(opts, oci.WithUser(username))
-		}
-		if cwd := clicontext.String("cwd"); cwd != "" {
-			opts = append(opts, oci.WithProcessCwd(cwd))
-		}
-		if clicontext.Bool("terminal") {
-			if !clicontext.Bool("i") {
-				rErr = fmt.Errorf("terminal flag must be specified with \"-i\"")
+		if !service {
+			entrypointOpt, err := withEntrypointArgs(clicontext, image)
+			if err != nil {
+				rErr = fmt.Errorf("failed to parse entrypoint and arg flags: %w", err)
 				return
 			}
-			opts = append(opts, oci.WithTTY)
+			opts = append(opts, entrypointOpt)
+			if username := clicontext.String("user"); username != "" {
+				opts = append(opts, oci.WithUser(username))
+			}
+			if cwd := clicontext.String("cwd"); cwd != "" {
+				opts = append(opts, oci.WithProcessCwd(cwd))
+			}
+			if clicontext.Bool("terminal") {
+				if !clicontext.Bool("i") {
+					rErr = fmt.Errorf("terminal flag must be specified with \"-i\"")
+					return
+				}
+				opts = append(opts, oci.WithTTY)
+			}
 		}
-		if clicontext.Bool("cni") {
+		if sharedNetNS != "" {
+			opts = append(opts, oci.WithLinuxNamespace(runtimespec.LinuxNamespace{
+				Type: runtimespec.NetworkNamespace,
+				Path: sharedNetNS,
+			}))
+		} else if clicontext.Bool("cni") {
 			var nOpt oci.SpecOpts
 			nOpt, cleanup, err = withCNI(clicontext)
 			if err != nil {
@@ -264,6 +284,92 @@ func withEntrypointArgs(clicontext *cli.Context, image containerd.Image) (oci.Sp
 }
 
 func withCNI(clicontext *cli.Context) (specOpt oci.SpecOpts, done func() error, rErr error) {
+	nsPath, done, err := newCNINetNS(clicontext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Make the container use this network namespace
+	return oci.WithLinuxNamespace(runtimespec.LinuxNamespace{
+		Type: runtimespec.NetworkNamespace,
+		Path: nsPath,
+	}), done, nil
+}
+
+// withSharedNetwork prepares the network namespace shared among the sandboxes of images
+// optimized together and returns its path. The namespace is configured with CNI plugins if
+// --cni is specified. Otherwise, it has only the loopback interface so the sandboxes can
+// talk with each other via localhost. This returns an empty path with --net-host because
+// the sandboxes already share the host's namespace.
+func withSharedNetwork(clicontext *cli.Context) (nsPath string, done func() error, rErr error) {
+	if clicontext.Bool("net-host") {
+		return "", func() error { return nil }, nil
+	}
+	if clicontext.Bool("cni") {
+		return newCNINetNS(clicontext)
+	}
+	ns, err := netns.NewNetNS(netnsMountDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to prepare netns: %w", err)
+	}
+	if err := setLoopbackUp(ns.GetPath()); err != nil {
+		if err := ns.Remove(); err != nil {
+			logrus.WithError(err).Warn("failed to remove netns")
+		}
+		return "", nil, fmt.Errorf("failed to setup loopback of netns: %w", err)
+	}
+	return ns.GetPath(), ns.Remove, nil
+}
+
+// setLoopbackUp brings up the loopback interface in the network namespace at nsPath.
+// Unlike runc, nothing brings it up for sandboxes joining an existing namespace.
+func setLoopbackUp(nsPath string) error {
+	target, err := os.Open(nsPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	runtime.LockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer orig.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter netns: %w", err)
+	}
+	defer func() {
+		// If the netns of this thread can't be restored, keep it locked so no other
+		// goroutine runs on it.
+		if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+			logrus.WithError(err).Warn("failed to restore netns")
+			return
+		}
+		runtime.UnlockOSThread()
+	}()
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to get flags of lo: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to set lo up: %w", err)
+	}
+	return nil
+}
+
+func newCNINetNS(clicontext *cli.Context) (nsPath string, done func() error, rErr error) {
 	var cleanups []func() error
 	done = func() (allErr error) {
 		for i := len(cleanups) - 1; i >= 0; i-- {
@@ -314,12 +420,7 @@ func withCNI(clicontext *cli.Context) (specOpt oci.SpecOpts, done func() error,
 	cleanups = append(cleanups, func() error {
 		return network.Remove(ctx, id, ns.GetPath())
 	})
-
-	// Make the container use this network namespace
-	return oci.WithLinuxNamespace(runtimespec.LinuxNamespace{
-		Type: runtimespec.NetworkNamespace,
-		Path: ns.GetPath(),
-	}), done, nil
+	return ns.GetPath(), done, nil
 }
 
 func withResolveConfig(clicontext *cli.Context) (specOpt oci.SpecOpts, cleanup func() error, rErr error) {
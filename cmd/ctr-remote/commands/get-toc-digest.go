@@ -24,6 +24,7 @@ import (
 
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -41,11 +42,19 @@ var GetTOCDigestCommand = cli.Command{
 			Name:  "zstdchunked",
 			Usage: "parse layer as zstd:chunked",
 		},
+		cli.BoolFlag{
+			Name:  "uncompressed",
+			Usage: "parse layer as uncompressed eStargz",
+		},
 		// other flags for debugging
 		cli.BoolFlag{
 			Name:  "dump-toc",
 			Usage: "dump TOC instead of digest. Note that the dumped TOC might be formatted with indents so may have different digest against the original in the layer",
 		},
+		cli.BoolFlag{
+			Name:  "summary",
+			Usage: "print the summary of the layer instead of digest. The summary is computed from the entries if the TOC doesn't record it",
+		},
 	},
 	Action: func(clicontext *cli.Context) error {
 		layerDgstStr := clicontext.Args().Get(0)
@@ -69,9 +78,14 @@ var GetTOCDigestCommand = cli.Command{
 		}
 		defer ra.Close()
 
+		if clicontext.Bool("zstdchunked") && clicontext.Bool("uncompressed") {
+			return errors.New("\"zstdchunked\" and \"uncompressed\" cannot be specified at the same time")
+		}
 		footerSize := estargz.FooterSize
 		if clicontext.Bool("zstdchunked") {
 			footerSize = zstdchunked.FooterSize
+		} else if clicontext.Bool("uncompressed") {
+			footerSize = uncompressed.FooterSize
 		}
 		footer := make([]byte, footerSize)
 		if _, err := ra.ReadAt(footer, ra.Size()-int64(footerSize)); err != nil {
@@ -82,6 +96,8 @@ var GetTOCDigestCommand = cli.Command{
 		decompressor = new(estargz.GzipDecompressor)
 		if clicontext.Bool("zstdchunked") {
 			decompressor = new(zstdchunked.Decompressor)
+		} else if clicontext.Bool("uncompressed") {
+			decompressor = new(uncompressed.Decompressor)
 		}
 
 		_, tocOff, tocSize, err := decompressor.ParseFooter(footer)
@@ -96,6 +112,21 @@ var GetTOCDigestCommand = cli.Command{
 			return fmt.Errorf("error parsing TOC: %w", err)
 		}
 
+		if clicontext.Bool("summary") {
+			computed := estargz.ComputeSummary(toc)
+			if toc.Summary != nil && *toc.Summary != computed {
+				return fmt.Errorf("summary %+v recorded in TOC doesn't match the entries (%+v)", *toc.Summary, computed)
+			}
+			summaryJSON, err := json.MarshalIndent(struct {
+				estargz.TOCSummary
+				Recorded bool `json:"recorded"`
+			}{computed, toc.Summary != nil}, "", "\t")
+			if err != nil {
+				return fmt.Errorf("failed to marshal summary: %w", err)
+			}
+			fmt.Println(string(summaryJSON))
+			return nil
+		}
 		if clicontext.Bool("dump-toc") {
 			tocJSON, err := json.MarshalIndent(toc, "", "\t")
 			if err != nil {
@@ -25,25 +25,31 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/stargz-snapshotter/analyzer"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/recorder"
 	"github.com/containerd/stargz-snapshotter/util/containerdutil"
+	"github.com/containerd/stargz-snapshotter/util/tracing"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/sync/errgroup"
 )
 
 const defaultPeriod = 10
@@ -75,6 +81,10 @@ var OptimizeCommand = cli.Command{
 			Name:  "wait-on-line",
 			Usage: "Substring of a stdout line to be waited. When this string is detected, the container will be killed.",
 		},
+		cli.IntFlag{
+			Name:  "record-shutdown",
+			Usage: "stop the container with its stop signal instead of killing it and record files accessed until it exits (up to the specified seconds) as the shutdown phase",
+		},
 		cli.BoolFlag{
 			Name:  "no-optimize",
 			Usage: "convert image without optimization",
@@ -83,6 +93,11 @@ var OptimizeCommand = cli.Command{
 			Name:  "record-out",
 			Usage: "record the monitor log to the specified file",
 		},
+		cli.StringSliceFlag{
+			Name:  "record-in",
+			Usage: "apply the monitor log recorded by --record-out (e.g. on a machine of another platform) to the layers of the recorded manifest",
+			Value: &cli.StringSlice{},
+		},
 		cli.BoolFlag{
 			Name:  "oci",
 			Usage: "convert Docker media types to OCI media types",
@@ -92,18 +107,99 @@ var OptimizeCommand = cli.Command{
 			Usage: "eStargz compression level (only applied to gzip as of now)",
 			Value: gzip.BestCompression,
 		},
+		cli.BoolFlag{
+			Name:  "estargz-no-landmarks",
+			Usage: "record the prefetch boundary in TOC instead of adding landmark files to layers",
+		},
+		cli.StringFlag{
+			Name:  "estargz-mtime",
+			Usage: "set the modification time of all files to this time in Unix seconds (e.g. $SOURCE_DATE_EPOCH) so that layers of the same files built at different times are the same and share caches",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-clamp-mtime",
+			Usage: "with --estargz-mtime, set the time only to files modified after it",
+		},
+		cli.StringFlag{
+			Name:  "estargz-owner",
+			Usage: "set the owner of all files to UID:GID (e.g. 0:0). Note that this changes the ownership of files in containers",
+		},
+		cli.StringFlag{
+			Name:  "estargz-path-policy",
+			Usage: "how to deal with file names that aren't valid UTF-8 or contain control characters (\"allow\", \"reject\" or \"sanitize\")",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-summary",
+			Usage: "record the summary of each layer (number of files, total size and prefetch size) in TOC",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-cdc",
+			Usage: "decide boundaries of chunks by their contents (content-defined chunking) so that chunks are shared among versions of files",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-zstd-toc",
+			Usage: "compress TOC JSON with zstd to make it smaller. Layers converted with this option can't be lazily pulled by older snapshotters",
+		},
+		cli.BoolFlag{
+			Name:  "estargz-binary-toc",
+			Usage: "encode TOC in the binary format (CBOR) instead of JSON, which is smaller and faster to parse. Layers converted with this option can't be lazily pulled by older snapshotters",
+		},
 		cli.BoolFlag{
 			Name:  "zstdchunked",
 			Usage: "use zstd compression instead of gzip (a.k.a zstd:chunked)",
 		},
-	}, samplerFlags...),
-	Action: func(clicontext *cli.Context) error {
+		cli.IntFlag{
+			Name:  "workload-timeout",
+			Usage: "fail if the workload neither exits nor prints the line specified by --wait-on-line within the time seconds (overrides --period)",
+		},
+		cli.Float64Flag{
+			Name:  "min-coverage",
+			Usage: "fail if less than the specified percentage of the paths accessed by the workload is recorded",
+		},
+		cli.StringFlag{
+			Name:  "report-out",
+			Usage: "write the machine-readable report of the optimization to the specified file in JSON",
+		},
+		cli.StringSliceFlag{
+			Name:  "service",
+			Usage: "optimize another image together in the form of <source_ref>=<target_ref>. Workloads of all images run at the same time in one shared network namespace (e.g. microservices)",
+			Value: &cli.StringSlice{},
+		},
+	}, append(samplerFlags, tracingFlags...)...),
+	Action: func(clicontext *cli.Context) (retErr error) {
 		convertOpts := []converter.Opt{}
 		srcRef := clicontext.Args().Get(0)
 		targetRef := clicontext.Args().Get(1)
 		if srcRef == "" || targetRef == "" {
 			return errors.New("src and target image need to be specified")
 		}
+		if clicontext.Int("workload-timeout") > 0 && clicontext.Bool("wait-on-signal") {
+			return errors.New("option --workload-timeout can't be used with --wait-on-signal")
+		}
+		report := &optimizeReport{Source: srcRef, Target: targetRef}
+		for _, svc := range clicontext.StringSlice("service") {
+			parts := strings.SplitN(svc, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return fmt.Errorf("invalid service %q; must be \"<source_ref>=<target_ref>\"", svc)
+			}
+			report.Services = append(report.Services, &optimizeReport{Source: parts[0], Target: parts[1]})
+		}
+		if len(report.Services) > 0 && (clicontext.Bool("terminal") || clicontext.Bool("i")) {
+			return errors.New("option --service can't be used with --terminal or -i")
+		}
+		if reportOutFile := clicontext.String("report-out"); reportOutFile != "" {
+			defer func() {
+				if retErr != nil {
+					report.Error = retErr.Error()
+				}
+				if err := writeReportFile(report, reportOutFile); err != nil {
+					if retErr == nil {
+						retErr = fmt.Errorf("failed to output report file: %w", err)
+					} else {
+						log.L.WithError(err).Warn("failed to output report file")
+					}
+				}
+			}()
+		}
 
 		var platformMC platforms.MatchComparer
 		if clicontext.Bool("all-platforms") {
@@ -130,6 +226,13 @@ var OptimizeCommand = cli.Command{
 		} else if clicontext.Bool("zstdchunked") {
 			return errors.New("option --zstdchunked must be used in conjunction with --oci")
 		}
+		if clicontext.Bool("zstdchunked") {
+			for _, name := range []string{"estargz-zstd-toc", "estargz-binary-toc"} {
+				if clicontext.Bool(name) {
+					return fmt.Errorf("option --zstdchunked conflicts with --%s", name)
+				}
+			}
+		}
 
 		client, ctx, cancel, err := commands.NewClient(clicontext)
 		if err != nil {
@@ -143,27 +246,27 @@ var OptimizeCommand = cli.Command{
 		}
 		defer done(ctx)
 
-		recordOut, esgzOptsPerLayer, wrapper, err := analyze(ctx, clicontext, client, srcRef)
+		ctx, endTracing := startTracing(ctx, clicontext, "optimize")
+		defer func() {
+			if err := endTracing(retErr); err != nil {
+				if retErr == nil {
+					retErr = fmt.Errorf("failed to output trace: %w", err)
+				} else {
+					log.L.WithError(err).Warn("failed to output trace")
+				}
+			}
+		}()
+
+		targets := append([]*optimizeReport{report}, report.Services...)
+		recordOuts, err := analyzeWorkloads(ctx, clicontext, client, targets)
 		if err != nil {
 			return err
 		}
-		if recordOutFile := clicontext.String("record-out"); recordOutFile != "" {
-			if err := writeContentFile(ctx, client, recordOut, recordOutFile); err != nil {
+		if recordOutFile := clicontext.String("record-out"); recordOutFile != "" && recordOuts[0] != "" {
+			if err := writeContentFile(ctx, client, recordOuts[0], recordOutFile); err != nil {
 				return fmt.Errorf("failed output record file: %w", err)
 			}
 		}
-		var f converter.ConvertFunc
-		if clicontext.Bool("zstdchunked") {
-			f = zstdchunkedconvert.LayerConvertWithLayerOptsFunc(esgzOptsPerLayer)
-		} else {
-			f = estargzconvert.LayerConvertWithLayerAndCommonOptsFunc(esgzOptsPerLayer,
-				estargz.WithCompressionLevel(clicontext.Int("estargz-compression-level")))
-		}
-		if wrapper != nil {
-			f = wrapper(f)
-		}
-		layerConvertFunc := logWrapper(f)
-
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, os.Interrupt)
 		go func() {
@@ -175,16 +278,108 @@ var OptimizeCommand = cli.Command{
 			case <-ctx.Done():
 			}
 		}()
-		convertOpts = append(convertOpts, converter.WithLayerConvertFunc(layerConvertFunc))
-		newImg, err := converter.Convert(ctx, client, targetRef, srcRef, convertOpts...)
-		if err != nil {
-			return err
+		for i, t := range targets {
+			if err := optimizeImage(ctx, clicontext, client, t, recordOuts[i], platformMC, convertOpts); err != nil {
+				if len(targets) > 1 {
+					return fmt.Errorf("failed to optimize %q: %w", t.Source, err)
+				}
+				return err
+			}
+			fmt.Fprintln(clicontext.App.Writer, t.Digest.String())
 		}
-		fmt.Fprintln(clicontext.App.Writer, newImg.Target.Digest.String())
 		return nil
 	},
 }
 
+// optimizeImage converts the source image of the report into the target, prioritizing
+// files recorded in recordOut and the files specified by --record-in.
+func optimizeImage(ctx context.Context, clicontext *cli.Context, client *containerd.Client, report *optimizeReport, recordOut digest.Digest, platformMC platforms.MatchComparer, convertOpts []converter.Opt) error {
+	esgzOptsPerLayer, wrapper, err := analyze(ctx, clicontext, client, report.Source, recordOut, platformMC)
+	if err != nil {
+		return err
+	}
+	if a := report.Analysis; a != nil {
+		report.Coverage = a.Coverage() * 100
+		if minCoverage := clicontext.Float64("min-coverage"); report.Coverage < minCoverage {
+			return fmt.Errorf("coverage %.2f%% (%d/%d paths) is lower than the minimum %.2f%%",
+				report.Coverage, a.RecordedPaths, a.AccessedPaths, minCoverage)
+		}
+	}
+	var f converter.ConvertFunc
+	if clicontext.Bool("zstdchunked") {
+		f = zstdchunkedconvert.LayerConvertWithLayerOptsFunc(esgzOptsPerLayer)
+	} else {
+		commonOpts := []estargz.Option{estargz.WithCompressionLevel(clicontext.Int("estargz-compression-level"))}
+		if clicontext.Bool("estargz-no-landmarks") {
+			commonOpts = append(commonOpts, estargz.WithoutLandmarks())
+		}
+		if clicontext.Bool("estargz-summary") {
+			commonOpts = append(commonOpts, estargz.WithSummary())
+		}
+		if clicontext.Bool("estargz-cdc") {
+			commonOpts = append(commonOpts, estargz.WithContentDefinedChunking())
+		}
+		if clicontext.Bool("estargz-zstd-toc") {
+			commonOpts = append(commonOpts, estargz.WithZstdTOC())
+		}
+		if clicontext.Bool("estargz-binary-toc") {
+			commonOpts = append(commonOpts, estargz.WithBinaryTOC())
+		}
+		pathPolicy, err := estargz.ParsePathPolicy(clicontext.String("estargz-path-policy"))
+		if err != nil {
+			return err
+		}
+		commonOpts = append(commonOpts, estargz.WithPathPolicy(pathPolicy))
+		normalizeOpts, err := getNormalizeOpts(clicontext)
+		if err != nil {
+			return err
+		}
+		commonOpts = append(commonOpts, normalizeOpts...)
+		f = estargzconvert.LayerConvertWithLayerAndCommonOptsFunc(esgzOptsPerLayer, commonOpts...)
+	}
+	if wrapper != nil {
+		f = wrapper(f)
+	}
+	layerConvertFunc := traceWrapper(logWrapper(f))
+
+	convertOpts = append(append([]converter.Opt{}, convertOpts...), converter.WithLayerConvertFunc(layerConvertFunc))
+	convertCtx, convertSpan := tracing.Start(ctx, "convert")
+	newImg, err := converter.Convert(convertCtx, client, report.Target, report.Source, convertOpts...)
+	convertSpan.End(err)
+	if err != nil {
+		return err
+	}
+	report.Digest = newImg.Target.Digest
+	return nil
+}
+
+// optimizeReport is the machine-readable result of optimize command.
+type optimizeReport struct {
+	Source string        `json:"source"`
+	Target string        `json:"target"`
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Analysis is the summary of the workload. This is empty if no analysis ran.
+	Analysis *analyzer.Report `json:"analysis,omitempty"`
+
+	// Coverage is the percentage of the paths accessed by the workload that are
+	// recorded as prioritized files.
+	Coverage float64 `json:"coverage,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// Services are the reports of the images specified by --service.
+	Services []*optimizeReport `json:"services,omitempty"`
+}
+
+func writeReportFile(report *optimizeReport, targetFile string) error {
+	p, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(targetFile, p, 0644)
+}
+
 func writeContentFile(ctx context.Context, client *containerd.Client, dgst digest.Digest, targetFile string) error {
 	fw, err := os.Create(targetFile)
 	if err != nil {
@@ -200,11 +395,158 @@ func writeContentFile(ctx context.Context, client *containerd.Client, dgst diges
 	return err
 }
 
-func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Client, srcRef string) (digest.Digest, map[digest.Digest][]estargz.Option, func(converter.ConvertFunc) converter.ConvertFunc, error) {
+func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Client, srcRef string, recordOut digest.Digest, platformMC platforms.MatchComparer) (map[digest.Digest][]estargz.Option, func(converter.ConvertFunc) converter.ConvertFunc, error) {
 	if clicontext.Bool("no-optimize") {
-		return "", nil, nil, nil
+		if len(clicontext.StringSlice("record-in")) > 0 {
+			return nil, nil, fmt.Errorf("record-in can't be used with no-optimize flag")
+		}
+		return nil, nil, nil
+	}
+	ctx, span := tracing.Start(ctx, "analyze")
+	defer span.End(nil)
+
+	cs := client.ContentStore()
+	is := client.ImageService()
+	srcImg, err := is.Get(ctx, srcRef)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	// Records of file accesses. Each entry is applied to the manifest recorded in it
+	// so records of platforms other than the current one can be passed as files
+	// (e.g. recorded on machines of other architectures).
+	var records []io.Reader
+	covered := make(map[digest.Digest]struct{}) // manifests whose layers are analyzed
+	if recordOut != "" {
+		manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, srcImg.Target, platforms.DefaultStrict())
+		if err != nil {
+			return nil, nil, err
+		}
+		covered[manifestDesc.Digest] = struct{}{}
+		ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
+		if err != nil {
+			return nil, nil, err
+		}
+		defer ra.Close()
+		records = append(records, io.NewSectionReader(ra, 0, ra.Size()))
+	}
+	for _, recordIn := range clicontext.StringSlice("record-in") {
+		f, err := os.Open(recordIn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open record file: %w", err)
+		}
+		defer f.Close()
+		records = append(records, f)
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+
+	// Parse record files
+	_, mergeSpan := tracing.Start(ctx, "merge records")
+	defer mergeSpan.End(nil)
+	manifests, err := platformManifests(ctx, cs, srcImg.Target, platformMC)
+	if err != nil {
+		return nil, nil, err
+	}
+	// TODO: this should be indexed by layer "index" (not "digest"). Records of a layer
+	// shared among platforms are merged.
+	layerLogs := make(map[digest.Digest][]string)
+	added := make(map[digest.Digest]map[string]struct{})
+	for _, r := range records {
+		dec := json.NewDecoder(r)
+		for dec.More() {
+			var e recorder.Entry
+			if err := dec.Decode(&e); err != nil {
+				return nil, nil, err
+			}
+			manifestDgst := digest.Digest(e.ManifestDigest)
+			manifest, ok := manifests[manifestDgst]
+			if !ok {
+				continue // not a target of this conversion
+			}
+			covered[manifestDgst] = struct{}{}
+			if e.LayerIndex == nil || *e.LayerIndex >= len(manifest.Layers) {
+				continue
+			}
+			dgst := manifest.Layers[*e.LayerIndex].Digest
+			if added[dgst] == nil {
+				added[dgst] = map[string]struct{}{}
+			}
+			if _, ok := added[dgst][e.Path]; !ok {
+				added[dgst][e.Path] = struct{}{}
+				layerLogs[dgst] = append(layerLogs[dgst], e.Path)
+			}
+		}
+	}
+
+	// Create a converter wrapper for skipping layer conversion. This skip occurs
+	// if "reuse" option is specified, the source layer is already valid estargz
+	// and no access occur to that layer.
+	var excludes []digest.Digest
+	layerOpts := make(map[digest.Digest][]estargz.Option)
+	for manifestDgst := range covered {
+		for _, desc := range manifests[manifestDgst].Layers {
+			if layerLog, ok := layerLogs[desc.Digest]; ok && len(layerLog) > 0 {
+				layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
+			} else if clicontext.Bool("reuse") && isReusableESGZLayer(ctx, desc, cs) {
+				excludes = append(excludes, desc.Digest) // reuse layer without conversion
+			}
+		}
+	}
+	return layerOpts, excludeWrapper(excludes), nil
+}
+
+// analyzeWorkloads runs the workloads of the source images of the reports and returns the
+// digests of their records of file accesses in the same order. When more than one image
+// is passed, their workloads run at the same time in one shared network namespace so that
+// interactions among services (e.g. connecting to a database on startup) are recorded.
+func analyzeWorkloads(ctx context.Context, clicontext *cli.Context, client *containerd.Client, reports []*optimizeReport) ([]digest.Digest, error) {
+	recordOuts := make([]digest.Digest, len(reports))
+	if clicontext.Bool("no-optimize") {
+		return recordOuts, nil
+	}
+	if len(reports) == 1 {
+		recordOut, err := analyzeWorkload(ctx, clicontext, client, reports[0], getSpecOpts(clicontext))
+		if err != nil {
+			return nil, err
+		}
+		recordOuts[0] = recordOut
+		return recordOuts, nil
+	}
+
+	nsPath, done, err := withSharedNetwork(clicontext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare shared network: %w", err)
+	}
+	defer func() {
+		if err := done(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to cleanup shared network")
+		}
+	}()
+	var eg errgroup.Group
+	for i, r := range reports {
+		i, r := i, r
+		specOpts := getServiceSpecOpts(clicontext, nsPath, i > 0)
+		eg.Go(func() error {
+			recordOut, err := analyzeWorkload(ctx, clicontext, client, r, specOpts)
+			if err != nil {
+				return fmt.Errorf("failed to analyze %q: %w", r.Source, err)
+			}
+			recordOuts[i] = recordOut
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return recordOuts, nil
+}
+
+// analyzeWorkload runs the workload against the image and returns the digest of the
+// record of file accesses. This returns an empty digest if the current platform isn't
+// the target of the conversion.
+func analyzeWorkload(ctx context.Context, clicontext *cli.Context, client *containerd.Client, report *optimizeReport, specOpts analyzer.SpecOpts) (digest.Digest, error) {
 	// Do analysis only when the target platforms contain the current platform
 	if !clicontext.Bool("all-platforms") {
 		if pss := clicontext.StringSlice("platform"); len(pss) > 0 {
@@ -212,25 +554,22 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 			for _, ps := range pss {
 				p, err := platforms.Parse(ps)
 				if err != nil {
-					return "", nil, nil, fmt.Errorf("invalid platform %q: %w", ps, err)
+					return "", fmt.Errorf("invalid platform %q: %w", ps, err)
 				}
 				if platforms.DefaultStrict().Match(p) {
 					containsDefault = true
 				}
 			}
 			if !containsDefault {
-				return "", nil, nil, nil // do not run analyzer
+				return "", nil // do not run analyzer
 			}
 		}
 	}
 
-	cs := client.ContentStore()
-	is := client.ImageService()
-
 	// Analyze layers and get prioritized files
-	aOpts := []analyzer.Option{analyzer.WithSpecOpts(getSpecOpts(clicontext))}
+	aOpts := []analyzer.Option{analyzer.WithSpecOpts(specOpts)}
 	if clicontext.Bool("wait-on-signal") && clicontext.Bool("terminal") {
-		return "", nil, nil, fmt.Errorf("wait-on-signal can't be used with terminal flag")
+		return "", fmt.Errorf("wait-on-signal can't be used with terminal flag")
 	}
 
 	if clicontext.Bool("wait-on-signal") {
@@ -239,81 +578,58 @@ func analyze(ctx context.Context, clicontext *cli.Context, client *containerd.Cl
 		aOpts = append(aOpts,
 			analyzer.WithPeriod(time.Duration(clicontext.Int("period"))*time.Second),
 			analyzer.WithWaitLineOut(clicontext.String("wait-on-line")))
+		if timeout := clicontext.Int("workload-timeout"); timeout > 0 {
+			aOpts = append(aOpts, analyzer.WithTimeout(time.Duration(timeout)*time.Second))
+		}
+	}
+	if grace := clicontext.Int("record-shutdown"); grace > 0 {
+		aOpts = append(aOpts, analyzer.WithShutdownRecording(time.Duration(grace)*time.Second))
 	}
 	if clicontext.Bool("terminal") {
 		if !clicontext.Bool("i") {
-			return "", nil, nil, fmt.Errorf("terminal flag must be specified with \"-i\"")
+			return "", fmt.Errorf("terminal flag must be specified with \"-i\"")
 		}
 		aOpts = append(aOpts, analyzer.WithTerminal())
 	}
 	if clicontext.Bool("i") {
 		aOpts = append(aOpts, analyzer.WithStdin())
 	}
-	recordOut, err := analyzer.Analyze(ctx, client, srcRef, aOpts...)
+	report.Analysis = new(analyzer.Report)
+	aOpts = append(aOpts, analyzer.WithReport(report.Analysis))
+	recordOut, err := analyzer.Analyze(ctx, client, report.Source, aOpts...)
 	if err != nil {
-		return "", nil, nil, err
+		return "", err
 	}
 	log.G(ctx).Debugf("[abin] recordOut %v", recordOut)
+	return recordOut, nil
+}
 
-	// Parse record file
-	srcImg, err := is.Get(ctx, srcRef)
-	if err != nil {
-		return "", nil, nil, err
-	}
-	log.G(ctx).Debugf("[abin] srcImg %v", srcImg)
-	manifestDesc, err := containerdutil.ManifestDesc(ctx, cs, srcImg.Target, platforms.DefaultStrict())
-	log.G(ctx).Debugf("[abin] manifestDesc %v", manifestDesc)
-	if err != nil {
-		return "", nil, nil, err
-	}
-	p, err := content.ReadBlob(ctx, cs, manifestDesc)
-	if err != nil {
-		return "", nil, nil, err
-	}
-	var manifest ocispec.Manifest
-	if err := json.Unmarshal(p, &manifest); err != nil {
-		return "", nil, nil, err
-	}
-	// TODO: this should be indexed by layer "index" (not "digest")
-	layerLogs := make(map[digest.Digest][]string, len(manifest.Layers))
-	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: recordOut})
-	if err != nil {
-		return "", nil, nil, err
-	}
-	defer ra.Close()
-	dec := json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size()))
-	added := make(map[digest.Digest]map[string]struct{}, len(manifest.Layers))
-	for dec.More() {
-		var e recorder.Entry
-		if err := dec.Decode(&e); err != nil {
-			return "", nil, nil, err
-		}
-		if *e.LayerIndex < len(manifest.Layers) &&
-			e.ManifestDigest == manifestDesc.Digest.String() {
-			dgst := manifest.Layers[*e.LayerIndex].Digest
-			if added[dgst] == nil {
-				added[dgst] = map[string]struct{}{}
+// platformManifests returns manifests of the image that match the platform.
+func platformManifests(ctx context.Context, cs content.Store, target ocispec.Descriptor, platformMC platforms.MatchComparer) (map[digest.Digest]ocispec.Manifest, error) {
+	manifests := make(map[digest.Digest]ocispec.Manifest)
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			p, err := content.ReadBlob(ctx, cs, desc)
+			if err != nil {
+				if errdefs.IsNotFound(err) {
+					return nil, nil // the manifest of this platform isn't pulled
+				}
+				return nil, err
 			}
-			if _, ok := added[dgst][e.Path]; !ok {
-				added[dgst][e.Path] = struct{}{}
-				layerLogs[dgst] = append(layerLogs[dgst], e.Path)
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(p, &manifest); err != nil {
+				return nil, err
 			}
+			manifests[desc.Digest] = manifest
+			return nil, nil
 		}
+		return images.Children(ctx, cs, desc)
+	})
+	if err := images.Walk(ctx, images.FilterPlatforms(handler, platformMC), target); err != nil {
+		return nil, err
 	}
-
-	// Create a converter wrapper for skipping layer conversion. This skip occurs
-	// if "reuse" option is specified, the source layer is already valid estargz
-	// and no access occur to that layer.
-	var excludes []digest.Digest
-	layerOpts := make(map[digest.Digest][]estargz.Option, len(manifest.Layers))
-	for _, desc := range manifest.Layers {
-		if layerLog, ok := layerLogs[desc.Digest]; ok && len(layerLog) > 0 {
-			layerOpts[desc.Digest] = []estargz.Option{estargz.WithPrioritizedFiles(layerLog)}
-		} else if clicontext.Bool("reuse") && isReusableESGZLayer(ctx, desc, cs) {
-			excludes = append(excludes, desc.Digest) // reuse layer without conversion
-		}
-	}
-	return recordOut, layerOpts, excludeWrapper(excludes), nil
+	return manifests, nil
 }
 
 func isReusableESGZLayer(ctx context.Context, desc ocispec.Descriptor, cs content.Store) bool {
@@ -330,7 +646,7 @@ func isReusableESGZLayer(ctx context.Context, desc ocispec.Descriptor, cs conten
 		return false
 	}
 	defer ra.Close()
-	r, err := estargz.Open(io.NewSectionReader(ra, 0, desc.Size), estargz.WithDecompressors(new(zstdchunked.Decompressor)))
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, desc.Size), estargz.WithDecompressors(new(zstdchunked.Decompressor), new(uncompressed.Decompressor)))
 	if err != nil {
 		return false
 	}
@@ -0,0 +1,141 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+
+	"github.com/containerd/stargz-snapshotter/util/registryreplay"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// RegistryTrafficCommand records and replays registry traffic.
+var RegistryTrafficCommand = cli.Command{
+	Name:  "registry-traffic",
+	Usage: "record and replay registry traffic for reproducible performance tests",
+	Subcommands: []cli.Command{
+		{
+			Name:      "record",
+			Usage:     "run a proxy to a registry recording all responses",
+			ArgsUsage: "[flags] <upstream_url>",
+			Description: `Run a proxy to a registry and record all requests and responses to a fixture.
+
+Pull images with the proxy as a registry mirror, then stop this command with Ctrl-C.
+
+e.g., 'ctr-remote registry-traffic record --out fixture.jsonl https://ghcr.io'
+`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "address the proxy listens on",
+					Value: "127.0.0.1:5001",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "path to the fixture file to write",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				upstream, out := context.Args().First(), context.String("out")
+				if upstream == "" || out == "" {
+					return errors.New("upstream URL and output file need to be specified")
+				}
+				u, err := url.Parse(upstream)
+				if err != nil {
+					return fmt.Errorf("invalid upstream URL %q: %w", upstream, err)
+				}
+				f, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return serveUntilInterrupt(context, registryreplay.NewRecorder(u, f, nil))
+			},
+		},
+		{
+			Name:      "replay",
+			Usage:     "run a registry replaying recorded responses",
+			ArgsUsage: "[flags] <fixture>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "listen",
+					Usage: "address the registry listens on",
+					Value: "127.0.0.1:5001",
+				},
+				cli.BoolFlag{
+					Name:  "no-delay",
+					Usage: "don't reproduce the recorded latency of responses",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				fixture := context.Args().First()
+				if fixture == "" {
+					return errors.New("fixture file needs to be specified")
+				}
+				f, err := os.Open(fixture)
+				if err != nil {
+					return err
+				}
+				entries, err := registryreplay.ReadEntries(f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+				var opts []registryreplay.ReplayOption
+				if context.Bool("no-delay") {
+					opts = append(opts, registryreplay.WithoutDelay())
+				}
+				r, err := registryreplay.NewReplayer(entries, opts...)
+				if err != nil {
+					return err
+				}
+				return serveUntilInterrupt(context, r)
+			},
+		},
+	},
+}
+
+func serveUntilInterrupt(context *cli.Context, h http.Handler) error {
+	l, err := net.Listen("tcp", context.String("listen"))
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: h}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+	fmt.Fprintf(context.App.Writer, "listening on %s\n", l.Addr().String())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	select {
+	case s := <-sigCh:
+		logrus.Infof("Got %v", s)
+	case err := <-errCh:
+		return err
+	}
+	return srv.Shutdown(gocontext.Background())
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/snapshots"
 	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/source"
@@ -37,6 +38,9 @@ import (
 const (
 	remoteSnapshotterName = "stargz"
 	skipContentVerifyOpt  = "skip-content-verify"
+
+	// criPinnedLabel is the image label that CRI uses for pinned images.
+	criPinnedLabel = "io.cri-containerd.pinned"
 )
 
 // RpullCommand is a subcommand to pull an image from a registry levaraging stargz snapshotter
@@ -58,8 +62,32 @@ command.
 			Name:  "ipfs",
 			Usage: "Pull image from IPFS. Specify an IPFS CID as a reference. (experimental)",
 		},
-	), commands.SnapshotterFlags...),
-	Action: func(context *cli.Context) error {
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Pull content from a specific platform (default: the platform of the host)",
+		},
+		cli.BoolFlag{
+			Name:  "pinned",
+			Usage: "Pin the image so that its layers and cached contents aren't evicted",
+		},
+		cli.StringFlag{
+			Name:  "read-priority",
+			Usage: "Priority class (\"normal\" or \"low\") of on-demand reads of the layers of the image",
+		},
+		cli.StringFlag{
+			Name:  "device-policy",
+			Usage: "Policy (\"expose\", \"mask\" or \"empty\") of device nodes and FIFOs in the layers of the image",
+		},
+		cli.StringFlag{
+			Name:  "background-fetch-budget",
+			Usage: "Bytes (e.g. \"1048576\") or percentage (e.g. \"30%\") of each layer fetched in background",
+		},
+		cli.StringFlag{
+			Name:  "image-background-fetch-budget",
+			Usage: "Bytes (e.g. \"1048576\") or percentage (e.g. \"30%\") of the image fetched in background",
+		},
+	), append(commands.SnapshotterFlags, tracingFlags...)...),
+	Action: func(context *cli.Context) (retErr error) {
 		var (
 			ref    = context.Args().First()
 			config = &rPullConfig{}
@@ -89,6 +117,21 @@ command.
 		if context.Bool(skipContentVerifyOpt) {
 			config.skipVerify = true
 		}
+		config.pinned = context.Bool("pinned")
+		config.readPriority = context.String("read-priority")
+		config.devicePolicy = context.String("device-policy")
+		config.backgroundFetchBudget = context.String("background-fetch-budget")
+		config.imageBackgroundFetchBudget = context.String("image-background-fetch-budget")
+
+		platformMC := platforms.Default()
+		if ps := context.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			config.platform = ps
+			platformMC = platforms.Only(p)
+		}
 
 		if context.Bool("ipfs") {
 			ipfsClient, err := httpapi.NewLocalApi()
@@ -96,7 +139,8 @@ command.
 				return err
 			}
 			r, err := ipfs.NewResolver(ipfsClient, ipfs.ResolverOptions{
-				Scheme: "ipfs",
+				Scheme:    "ipfs",
+				Platforms: platformMC,
 			})
 			if err != nil {
 				return err
@@ -108,14 +152,26 @@ command.
 			config.snapshotter = sn
 		}
 
+		ctx, endTracing := startTracing(ctx, context, "rpull")
+		defer func() {
+			if err := endTracing(retErr); err != nil && retErr == nil {
+				retErr = fmt.Errorf("failed to output trace: %w", err)
+			}
+		}()
 		return pull(ctx, client, ref, config)
 	},
 }
 
 type rPullConfig struct {
 	*content.FetchConfig
-	skipVerify  bool
-	snapshotter string
+	skipVerify                 bool
+	pinned                     bool
+	readPriority               string
+	devicePolicy               string
+	backgroundFetchBudget      string
+	imageBackgroundFetchBudget string
+	snapshotter                string
+	platform                   string
 }
 
 func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
@@ -127,17 +183,38 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		return nil, nil
 	})
 
-	var snOpts []snapshots.Opt
+	snLabels := make(map[string]string)
 	if config.skipVerify {
 		log.G(pCtx).WithField("image", ref).Warn("content verification disabled")
-		snOpts = append(snOpts, snapshots.WithLabels(map[string]string{
-			fsconfig.TargetSkipVerifyLabel: "true",
-		}))
+		snLabels[fsconfig.TargetSkipVerifyLabel] = "true"
+	}
+	if config.pinned {
+		snLabels[fsconfig.TargetPinnedLabel] = "true"
+	}
+	if config.readPriority != "" {
+		snLabels[fsconfig.TargetReadPriorityLabel] = config.readPriority
+	}
+	if config.devicePolicy != "" {
+		snLabels[fsconfig.TargetDevicePolicyLabel] = config.devicePolicy
+	}
+	if config.backgroundFetchBudget != "" {
+		snLabels[fsconfig.TargetBackgroundFetchBudgetLabel] = config.backgroundFetchBudget
+	}
+	if config.imageBackgroundFetchBudget != "" {
+		snLabels[fsconfig.TargetImageBackgroundFetchBudgetLabel] = config.imageBackgroundFetchBudget
+	}
+	var snOpts []snapshots.Opt
+	if len(snLabels) > 0 {
+		snOpts = append(snOpts, snapshots.WithLabels(snLabels))
 	}
 
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
 	labels := commands.LabelArgs(config.Labels)
-	if _, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
+	if config.pinned {
+		// Also let CRI treat this image as pinned so that kubelet's image GC skips it.
+		labels[criPinnedLabel] = "pinned"
+	}
+	opts := []containerd.RemoteOpt{
 		containerd.WithPullLabels(labels),
 		containerd.WithResolver(config.Resolver),
 		containerd.WithImageHandler(h),
@@ -145,7 +222,11 @@ func pull(ctx context.Context, client *containerd.Client, ref string, config *rP
 		containerd.WithPullUnpack,
 		containerd.WithPullSnapshotter(config.snapshotter, snOpts...),
 		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(ref, 10*1024*1024)),
-	}...); err != nil {
+	}
+	if config.platform != "" {
+		opts = append(opts, containerd.WithPlatform(config.platform))
+	}
+	if _, err := client.Pull(pCtx, ref, opts...); err != nil {
 		return err
 	}
 
@@ -0,0 +1,296 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	distribution "github.com/containerd/containerd/reference/docker"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// ServeCommand converts an image to eStargz and serves it from an embedded registry.
+var ServeCommand = cli.Command{
+	Name:      "serve",
+	Usage:     "convert an image to eStargz and serve it from an embedded local registry",
+	ArgsUsage: "[flags] <source_ref> <name>[:<tag>]",
+	Description: `Convert an image to eStargz and serve it from an in-memory registry.
+
+This is useful for demonstrating and measuring lazy pulling without setting up an external registry.
+
+e.g., 'ctr-remote image serve --latency 50ms --bandwidth 10485760 ghcr.io/stargz-containers/python:3.9-org python:3.9-esgz'
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "address the embedded registry listens on",
+			Value: "127.0.0.1:5000",
+		},
+		cli.DurationFlag{
+			Name:  "latency",
+			Usage: "artificial latency added to each request",
+		},
+		cli.Int64Flag{
+			Name:  "bandwidth",
+			Usage: "artificial bandwidth limit of each response in bytes per second (0 means unlimited)",
+		},
+		cli.BoolFlag{
+			Name:  "no-convert",
+			Usage: "serve the source image as-is without converting it to eStargz",
+		},
+		cli.StringFlag{
+			Name:  "estargz-record-in",
+			Usage: "Read 'ctr-remote optimize --record-out=<FILE>' record file",
+		},
+		cli.IntFlag{
+			Name:  "estargz-compression-level",
+			Usage: "eStargz compression level",
+			Value: gzip.BestCompression,
+		},
+		cli.IntFlag{
+			Name:  "estargz-chunk-size",
+			Usage: "eStargz chunk size",
+			Value: 0,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		srcRef := context.Args().Get(0)
+		name := context.Args().Get(1)
+		if srcRef == "" || name == "" {
+			return errors.New("source image and name need to be specified")
+		}
+		tag := "latest"
+		if i := strings.LastIndex(name, ":"); i > 0 {
+			name, tag = name[:i], name[i+1:]
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		target := srcRef
+		if !context.Bool("no-convert") {
+			esgzOpts, err := getESGZConvertOpts(context)
+			if err != nil {
+				return err
+			}
+			target, err = serveTarget(srcRef)
+			if err != nil {
+				return err
+			}
+			if _, err := converter.Convert(ctx, client, target, srcRef,
+				converter.WithPlatform(platforms.DefaultStrict()),
+				converter.WithLayerConvertFunc(estargzconvert.LayerConvertFunc(esgzOpts...)),
+				converter.WithDockerToOCI(true),
+			); err != nil {
+				return fmt.Errorf("failed to convert %q: %w", srcRef, err)
+			}
+			defer client.ImageService().Delete(ctx, target)
+		}
+		img, err := client.ImageService().Get(ctx, target)
+		if err != nil {
+			return err
+		}
+
+		reg := newMemRegistry(context.Duration("latency"), context.Int64("bandwidth"))
+		if err := reg.load(ctx, client.ContentStore(), name, tag, img.Target, platforms.DefaultStrict()); err != nil {
+			return err
+		}
+
+		l, err := net.Listen("tcp", context.String("listen"))
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: reg}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- srv.Serve(l)
+		}()
+		fmt.Fprintf(context.App.Writer, "%s/%s:%s\n", l.Addr().String(), name, tag)
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		select {
+		case s := <-sigCh:
+			logrus.Infof("Got %v", s)
+		case err := <-errCh:
+			return err
+		}
+		return srv.Shutdown(gocontext.Background())
+	},
+}
+
+// serveTarget returns the reference of the image converted from srcRef. The tag is derived
+// from the tag or the digest of srcRef because digest-pinned references can't be suffixed.
+func serveTarget(srcRef string) (string, error) {
+	named, err := distribution.ParseDockerRef(srcRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q: %w", srcRef, err)
+	}
+	tag := "latest"
+	if digested, ok := named.(distribution.Digested); ok {
+		tag = digested.Digest().Encoded()
+	} else if tagged, ok := named.(distribution.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	target, err := distribution.WithTag(distribution.TrimNamed(named), tag+"-esgz-serve")
+	if err != nil {
+		return "", err
+	}
+	return target.String(), nil
+}
+
+// memRegistry is a minimal read-only registry serving contents from memory.
+type memRegistry struct {
+	manifests map[string]map[string]ocispec.Descriptor // name -> tag or digest -> manifest
+	blobs     map[digest.Digest][]byte
+	latency   time.Duration
+	bandwidth int64
+}
+
+func newMemRegistry(latency time.Duration, bandwidth int64) *memRegistry {
+	return &memRegistry{
+		manifests: make(map[string]map[string]ocispec.Descriptor),
+		blobs:     make(map[digest.Digest][]byte),
+		latency:   latency,
+		bandwidth: bandwidth,
+	}
+}
+
+// load reads all contents reachable from the passed target into memory and
+// makes them available as the repository "name". Only manifests of the platforms
+// matching to platform are read from indexes.
+func (r *memRegistry) load(ctx gocontext.Context, cs content.Store, name, tag string, target ocispec.Descriptor, platform platforms.Matcher) error {
+	if _, ok := r.manifests[name]; !ok {
+		r.manifests[name] = make(map[string]ocispec.Descriptor)
+	}
+	r.manifests[name][tag] = target
+	return images.Walk(ctx, images.FilterPlatforms(func(ctx gocontext.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		b, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %v: %w", desc.Digest, err)
+		}
+		r.blobs[desc.Digest] = b
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest,
+			images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+			r.manifests[name][desc.Digest.String()] = desc
+		}
+		return images.Children(ctx, cs, desc)
+	}, platform), target)
+}
+
+func (r *memRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.latency > 0 {
+		time.Sleep(r.latency)
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" || path == req.URL.Path {
+		w.WriteHeader(http.StatusOK) // API version check
+		return
+	}
+	var desc ocispec.Descriptor
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		d, ok := r.manifests[path[:i]][path[i+len("/manifests/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		desc = d
+	} else if i := strings.LastIndex(path, "/blobs/"); i >= 0 {
+		if _, ok := r.manifests[path[:i]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dgst, err := digest.Parse(path[i+len("/blobs/"):])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		desc = ocispec.Descriptor{Digest: dgst, MediaType: "application/octet-stream"}
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	b, ok := r.blobs[desc.Digest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", desc.MediaType)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	if r.bandwidth > 0 {
+		w = &throttledResponseWriter{w, r.bandwidth}
+	}
+	// ServeContent supports (multi-)range requests required for lazy pulling.
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(b))
+}
+
+// throttledResponseWriter limits the bandwidth of the response body.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	bytesPerSec int64
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (n int, err error) {
+	chunkSize := int(w.bytesPerSec / 10) // write at most 10 times per second
+	if chunkSize == 0 {
+		chunkSize = 1
+	}
+	for len(p) > 0 {
+		c := chunkSize
+		if c > len(p) {
+			c = len(p)
+		}
+		start := time.Now()
+		wn, err := w.ResponseWriter.Write(p[:c])
+		n += wn
+		if err != nil {
+			return n, err
+		}
+		p = p[c:]
+		if d := time.Duration(int64(wn)*int64(time.Second)/w.bytesPerSec) - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/stats"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// StatsCommand shows statistics of eStargz layers of an image and publishes them
+var StatsCommand = cli.Command{
+	Name:      "stats",
+	Usage:     "show statistics of eStargz layers of an image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Show statistics of eStargz layers of an image (chunk sizes, prefetch coverage
+and deduplication potential) to check how the image is ready for lazy pulling.
+
+The statistics are computed from the image in the local content store.
+'--publish' pushes them to the registry as an artifact referring to the image so
+that registry UIs can display them. '--remote' shows the published statistics
+instead of computing them.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Show statistics of the image of the platform (default: the platform of the host)",
+		},
+		cli.BoolFlag{
+			Name:  "publish",
+			Usage: "Push the statistics to the registry as an artifact referring to the image",
+		},
+		cli.BoolFlag{
+			Name:  "remote",
+			Usage: "Show the statistics published in the registry instead of computing them",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the statistics in JSON",
+		},
+	),
+	Action: func(context *cli.Context) error {
+		ref := context.Args().First()
+		if ref == "" {
+			return errors.New("image reference need to be specified")
+		}
+		if context.Bool("publish") && context.Bool("remote") {
+			return errors.New("\"publish\" and \"remote\" cannot be specified at the same time")
+		}
+		platformMC := platforms.Default()
+		if ps := context.String("platform"); ps != "" {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			platformMC = platforms.Only(p)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		var img *stats.Image
+		if context.Bool("remote") {
+			resolver, err := commands.GetResolver(ctx, context)
+			if err != nil {
+				return err
+			}
+			mfstDesc, err := stats.Resolve(ctx, resolver, ref, platformMC)
+			if err != nil {
+				return err
+			}
+			if img, err = stats.Fetch(ctx, resolver, ref, mfstDesc.Digest); err != nil {
+				return err
+			}
+		} else {
+			i, err := client.ImageService().Get(ctx, ref)
+			if err != nil {
+				return err
+			}
+			var mfstDesc ocispec.Descriptor
+			img, mfstDesc, err = stats.Compute(ctx, client.ContentStore(), i.Target, platformMC)
+			if err != nil {
+				return err
+			}
+			if context.Bool("publish") {
+				resolver, err := commands.GetResolver(ctx, context)
+				if err != nil {
+					return err
+				}
+				desc, err := stats.Push(ctx, resolver, ref, mfstDesc, img)
+				if err != nil {
+					return fmt.Errorf("failed to publish statistics: %w", err)
+				}
+				fmt.Fprintf(context.App.ErrWriter, "published statistics %v\n", desc.Digest)
+			}
+		}
+
+		if context.Bool("json") {
+			b, err := json.MarshalIndent(img, "", "\t")
+			if err != nil {
+				return fmt.Errorf("failed to marshal statistics: %w", err)
+			}
+			fmt.Fprintln(context.App.Writer, string(b))
+			return nil
+		}
+		return renderStats(context.App.Writer, img)
+	},
+}
+
+func renderStats(w io.Writer, img *stats.Image) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tFILES\tCHUNKS\tPREFETCH\tCOVERAGE\tDUPLICATE\tCHUNK SIZES")
+	for _, l := range img.Layers {
+		s := l.Stats
+		if s == nil {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\t(not eStargz)\n", l.Digest.Encoded()[:12])
+			continue
+		}
+		var hist string
+		for i, b := range s.ChunkSizeHistogram {
+			if i > 0 {
+				hist += " "
+			}
+			if b.UpperBound == 0 {
+				hist += fmt.Sprintf(">:%d", b.Count)
+			} else {
+				hist += fmt.Sprintf("%s:%d", humanSize(b.UpperBound), b.Count)
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%.1f%%\t%s\t%s\n",
+			l.Digest.Encoded()[:12], humanSize(s.BlobSize), s.RegularFiles, s.Chunks,
+			humanSize(s.PrefetchSize), s.PrefetchCoverage()*100, humanSize(s.DuplicateSize), hist)
+	}
+	return tw.Flush()
+}
+
+func humanSize(n int64) string {
+	for _, u := range []struct {
+		size int64
+		unit string
+	}{{1 << 30, "GiB"}, {1 << 20, "MiB"}, {1 << 10, "KiB"}} {
+		if n >= u.size {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.size), u.unit)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,87 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/stargz-snapshotter/util/tracing"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// tracingFlags are flags to trace the stages of conversion.
+var tracingFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "timings",
+		Usage: "print the durations of the stages (e.g. running the workload and converting each layer) to stderr",
+	},
+	cli.StringFlag{
+		Name:  "trace-out",
+		Usage: "write the spans of the stages to the file in OTLP/JSON, which can be sent to tracing backends by OpenTelemetry Collector",
+	},
+}
+
+// startTracing starts the root span of the command if tracing is enabled by the flags.
+// The returned function ends the span and outputs the trace.
+func startTracing(ctx gocontext.Context, clicontext *cli.Context, name string) (gocontext.Context, func(error) error) {
+	if !clicontext.Bool("timings") && clicontext.String("trace-out") == "" {
+		return ctx, func(error) error { return nil }
+	}
+	t := tracing.NewTracer()
+	ctx, span := tracing.Start(tracing.WithTracer(ctx, t), name)
+	return ctx, func(err error) error {
+		span.End(err)
+		if clicontext.Bool("timings") {
+			if err := t.WriteSummary(clicontext.App.ErrWriter); err != nil {
+				return err
+			}
+		}
+		if out := clicontext.String("trace-out"); out != "" {
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err := t.WriteOTLP(f, "ctr-remote"); err != nil {
+				return fmt.Errorf("failed to write trace: %w", err)
+			}
+			return f.Close()
+		}
+		return nil
+	}
+}
+
+// traceWrapper records a span of the conversion of each layer.
+func traceWrapper(convertFunc converter.ConvertFunc) converter.ConvertFunc {
+	return func(ctx gocontext.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		ctx, span := tracing.Start(ctx, "convert layer")
+		span.SetAttribute("digest", desc.Digest.String())
+		span.SetAttribute("size", strconv.FormatInt(desc.Size, 10))
+		newDesc, err := convertFunc(ctx, cs, desc)
+		if newDesc != nil {
+			span.SetAttribute("new_size", strconv.FormatInt(newDesc.Size, 10))
+		}
+		span.End(err)
+		return newDesc, err
+	}
+}
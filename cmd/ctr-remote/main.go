@@ -37,6 +37,11 @@ func main() {
 		commands.ConvertCommand,
 		commands.GetTOCDigestCommand,
 		commands.IPFSPushCommand,
+		commands.ServeCommand,
+		commands.StatsCommand,
+		commands.ChunksCommand,
+		commands.ConformanceCommand,
+		commands.ExplainCommand,
 	}
 	app := app.New()
 	for i := range app.Commands {
@@ -63,7 +68,7 @@ func main() {
 			break
 		}
 	}
-	app.Commands = append(app.Commands, commands.FanotifyCommand)
+	app.Commands = append(app.Commands, commands.FanotifyCommand, commands.RegistryTrafficCommand)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "ctr-remote: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	dconfig "github.com/containerd/containerd/remotes/docker/config"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/operator"
+	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultLogLevel     = logrus.InfoLevel
+	defaultRootDir      = "/var/lib/stargz-convert-operator"
+	defaultResyncPeriod = time.Hour
+)
+
+var (
+	kubeconfigPath = flag.String("kubeconfig", "", "path to the kubeconfig file (default: in-cluster config or $KUBECONFIG)")
+	namespace      = flag.String("namespace", "", "namespace to watch ImageConversion (default: all namespaces)")
+	workers        = flag.Int("workers", 1, "number of ImageConversion converted in parallel")
+	resyncPeriod   = flag.Duration("resync-period", defaultResyncPeriod, "interval to check updates of source images")
+	hostsDir       = flag.String("hosts-dir", "", "directory of registry host configurations (hosts.toml) in the same format as containerd")
+	logLevel       = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
+	rootDir        = flag.String("root", defaultRootDir, "path to the directory storing contents during conversion and records of converted layers")
+)
+
+func main() {
+	flag.Parse()
+	lvl, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.L.WithError(err).Fatal("failed to prepare logger")
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetFormatter(&logrus.JSONFormatter{
+		TimestampFormat: log.RFC3339NanoFixed,
+	})
+	ctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.L))
+	defer cancel()
+
+	// default loader for KUBECONFIG or `~/.kube/config`, falling back to the in-cluster
+	// config.
+	loadingRule := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRule.ExplicitPath = *kubeconfigPath
+	clientcfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		loadingRule,
+		&clientcmd.ConfigOverrides{},
+	).ClientConfig()
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to load kubeconfig")
+	}
+	client, err := dynamic.NewForConfig(clientcfg)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to prepare client")
+	}
+
+	// Registries are accessed with the credentials in the docker config (e.g. a
+	// kubernetes.io/dockerconfigjson secret mounted to $DOCKER_CONFIG).
+	creds := dockerconfig.NewDockerconfigKeychain(ctx)
+	hostOptions := dconfig.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			return creds(host, reference.Spec{})
+		},
+	}
+	if *hostsDir != "" {
+		hostOptions.HostDir = dconfig.HostDirFromRoot(*hostsDir)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: dconfig.ConfigureHosts(ctx, hostOptions),
+	})
+	converter, err := operator.NewRegistryConverter(resolver, *rootDir)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to prepare converter")
+	}
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		s := <-sigCh
+		log.G(ctx).Infof("Got %v", s)
+		cancel()
+	}()
+	c := operator.NewController(client, converter,
+		operator.WithNamespace(*namespace),
+		operator.WithResyncPeriod(*resyncPeriod))
+	if err := c.Run(ctx, *workers); err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to run controller")
+	}
+	log.G(ctx).Info("Exiting")
+}
@@ -67,6 +67,10 @@ type Config struct {
 
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store" default:"memory"`
+
+	// MetadataDir is the directory where the metadata DB is stored. Empty uses the root
+	// directory.
+	MetadataDir string `toml:"metadata_dir"`
 }
 
 type KubeconfigKeychainConfig struct {
@@ -188,7 +192,14 @@ func getMetadataStore(rootDir string, config Config) (metadata.Store, error) {
 			InitialMmapSize: 64 * 1024 * 1024,
 			FreelistType:    bolt.FreelistMapType,
 		}
-		db, err := bolt.Open(filepath.Join(rootDir, "metadata.db"), 0600, &bOpts)
+		dir := rootDir
+		if config.MetadataDir != "" {
+			dir = config.MetadataDir
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, err
+			}
+		}
+		db, err := bolt.Open(filepath.Join(dir, "metadata.db"), 0600, &bOpts)
 		if err != nil {
 			return nil, err
 		}
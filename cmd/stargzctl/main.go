@@ -0,0 +1,417 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/provision"
+	"github.com/containerd/stargz-snapshotter/version"
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	defaultAddress     = "/run/containerd-stargz-grpc/debug.sock"
+	defaultGRPCAddress = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+	defaultConfigPath  = "/etc/containerd-stargz-grpc/config.toml"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "stargzctl"
+	app.Usage = "administrate containerd-stargz-grpc through its debug socket"
+	app.Version = version.Version
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "address, a",
+			Usage: "address of the debug socket of the daemon (debug_address in the config)",
+			Value: defaultAddress,
+		},
+	}
+	app.Commands = []cli.Command{
+		layersCommand,
+		prefetchCommand,
+		solidifyCommand,
+		priorityCommand,
+		cacheCommand,
+		fetchCommand,
+		offlineCommand,
+		metadataCommand,
+		freezeCommand,
+		progressCommand,
+		metricsCommand,
+		egressCommand,
+		configCommand,
+		prepareImageCommand,
+	}
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintf(os.Stderr, "stargzctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var layersCommand = cli.Command{
+	Name:  "layers",
+	Usage: "show the status of the mounted layers",
+	Action: func(clicontext *cli.Context) error {
+		return get(clicontext, "/debug/layers")
+	},
+}
+
+var prefetchCommand = cli.Command{
+	Name:      "prefetch",
+	Usage:     "prefetch a mounted layer and fetch the entire layer in background",
+	ArgsUsage: "<mountpoint>",
+	Action: func(clicontext *cli.Context) error {
+		mp := clicontext.Args().First()
+		if mp == "" {
+			return fmt.Errorf("mountpoint must be specified")
+		}
+		return post(clicontext, "/debug/layers/prefetch", url.Values{"mountpoint": {mp}})
+	},
+}
+
+var solidifyCommand = cli.Command{
+	Name:      "solidify",
+	Usage:     "fetch and verify the entire mounted layer and stop depending on the registry for it",
+	ArgsUsage: "<mountpoint>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "ref",
+			Usage: "solidify all mounted layers of the image instead of a layer",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		mp, ref := clicontext.Args().First(), clicontext.String("ref")
+		if (mp == "") == (ref == "") {
+			return fmt.Errorf("either of mountpoint or --ref must be specified")
+		}
+		params := url.Values{"mountpoint": {mp}}
+		if ref != "" {
+			params = url.Values{"ref": {ref}}
+		}
+		return post(clicontext, "/debug/layers/solidify", params)
+	},
+}
+
+var priorityCommand = cli.Command{
+	Name:      "priority",
+	Usage:     "set the priority class (\"normal\" or \"low\") of on-demand reads of a mounted layer",
+	ArgsUsage: "<mountpoint> <class>",
+	Action: func(clicontext *cli.Context) error {
+		mp, class := clicontext.Args().Get(0), clicontext.Args().Get(1)
+		if mp == "" || class == "" {
+			return fmt.Errorf("mountpoint and class must be specified")
+		}
+		return post(clicontext, "/debug/layers/priority", url.Values{"mountpoint": {mp}, "class": {class}})
+	},
+}
+
+var cacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "manage caches of layers",
+	Subcommands: []cli.Command{
+		{
+			Name:  "purge",
+			Usage: "drop unused layers and their caches",
+			Action: func(clicontext *cli.Context) error {
+				return post(clicontext, "/debug/cache/purge", nil)
+			},
+		},
+	},
+}
+
+var fetchCommand = cli.Command{
+	Name:  "fetch",
+	Usage: "manage fetching layers in background",
+	Subcommands: []cli.Command{
+		{
+			Name:  "pause",
+			Usage: "pause fetching layers in background",
+			Action: func(clicontext *cli.Context) error {
+				return post(clicontext, "/debug/fetch/pause", nil)
+			},
+		},
+		{
+			Name:  "resume",
+			Usage: "resume fetching layers in background",
+			Action: func(clicontext *cli.Context) error {
+				return post(clicontext, "/debug/fetch/resume", nil)
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "show whether fetching layers in background is paused",
+			Action: func(clicontext *cli.Context) error {
+				return get(clicontext, "/debug/fetch")
+			},
+		},
+	},
+}
+
+var offlineCommand = cli.Command{
+	Name:  "offline",
+	Usage: "manage the offline mode serving only cached contents while registries are unreachable",
+	Subcommands: []cli.Command{
+		{
+			Name:      "mode",
+			Usage:     "set the offline mode (\"disabled\", \"auto\" or \"on\")",
+			ArgsUsage: "<mode>",
+			Action: func(clicontext *cli.Context) error {
+				mode := clicontext.Args().First()
+				if mode == "" {
+					return fmt.Errorf("mode must be specified")
+				}
+				return post(clicontext, "/debug/offline/mode", url.Values{"mode": {mode}})
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "show whether layers are offline and the size of contents wanted while offline",
+			Action: func(clicontext *cli.Context) error {
+				return get(clicontext, "/debug/offline")
+			},
+		},
+	},
+}
+
+var metadataCommand = cli.Command{
+	Name:  "metadata",
+	Usage: "manage the metadata store",
+	Subcommands: []cli.Command{
+		{
+			Name:  "prune",
+			Usage: "remove metadata of unmounted layers (only with the \"db\" metadata store)",
+			Action: func(clicontext *cli.Context) error {
+				return post(clicontext, "/debug/metadata/prune", nil)
+			},
+		},
+		{
+			Name:  "memory",
+			Usage: "show the estimated memory kept by metadata of each layer (only with the \"memory\" metadata store)",
+			Action: func(clicontext *cli.Context) error {
+				return get(clicontext, "/debug/metadata/memory")
+			},
+		},
+	},
+}
+
+var freezeCommand = cli.Command{
+	Name:      "freeze",
+	Usage:     "write a snapshot and its parents to a bundle",
+	ArgsUsage: "<snapshot key> <directory>",
+	Action: func(clicontext *cli.Context) error {
+		key, dir := clicontext.Args().Get(0), clicontext.Args().Get(1)
+		if key == "" || dir == "" {
+			return fmt.Errorf("snapshot key and directory must be specified")
+		}
+		return post(clicontext, "/debug/snapshots/freeze", url.Values{"key": {key}, "dir": {dir}})
+	},
+}
+
+var progressCommand = cli.Command{
+	Name:  "progress",
+	Usage: "watch the progress of fetching layers in background",
+	Action: func(clicontext *cli.Context) error {
+		return get(clicontext, "/debug/layers/progress")
+	},
+}
+
+var egressCommand = cli.Command{
+	Name:  "egress",
+	Usage: "dump the bytes fetched from registries for each namespace, image and registry as CSV",
+	Action: func(clicontext *cli.Context) error {
+		return get(clicontext, "/debug/egress")
+	},
+}
+
+var metricsCommand = cli.Command{
+	Name:  "metrics",
+	Usage: "dump the variables exposed by the daemon",
+	Action: func(clicontext *cli.Context) error {
+		return get(clicontext, "/debug/vars")
+	},
+}
+
+var configCommand = cli.Command{
+	Name:  "config",
+	Usage: "manage the config of the daemon",
+	Subcommands: []cli.Command{
+		{
+			Name:      "check",
+			Usage:     "check the config file of the daemon without connecting to the daemon",
+			ArgsUsage: "[<config file>]",
+			Action: func(clicontext *cli.Context) error {
+				path := clicontext.Args().First()
+				if path == "" {
+					path = defaultConfigPath
+				}
+				if err := checkConfig(path); err != nil {
+					return fmt.Errorf("invalid config %q: %w", path, err)
+				}
+				fmt.Fprintf(clicontext.App.Writer, "%s: OK\n", path)
+				return nil
+			},
+		},
+	},
+}
+
+var prepareImageCommand = cli.Command{
+	Name:      "prepare-image",
+	Usage:     "pull an image and prepare its snapshots in advance through the provisioning API",
+	ArgsUsage: "<ref>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "grpc-address",
+			Usage: "address of the gRPC socket of the daemon",
+			Value: defaultGRPCAddress,
+		},
+		cli.StringFlag{
+			Name:  "namespace",
+			Usage: "containerd namespace of the image",
+			Value: "k8s.io",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "platform of the image (default: the platform of the node)",
+		},
+		cli.StringSliceFlag{
+			Name:  "label",
+			Usage: "label added to the snapshots (<key>=<value>)",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("image reference must be specified")
+		}
+		req := &provision.PrepareImageRequest{
+			Ref:       ref,
+			Namespace: clicontext.String("namespace"),
+			Platform:  clicontext.String("platform"),
+		}
+		for _, l := range clicontext.StringSlice("label") {
+			kv := strings.SplitN(l, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid label %q", l)
+			}
+			if req.Labels == nil {
+				req.Labels = make(map[string]string)
+			}
+			req.Labels[kv[0]] = kv[1]
+		}
+		addr := clicontext.String("grpc-address")
+		conn, err := grpc.Dial("unix://"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return fmt.Errorf("failed to connect to %q: %w", addr, err)
+		}
+		defer conn.Close()
+		resp, err := provision.NewClient(conn).PrepareImage(context.Background(), req)
+		if err != nil {
+			return fmt.Errorf("failed to prepare %q (is provision enabled?): %w", ref, err)
+		}
+		enc := json.NewEncoder(clicontext.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	},
+}
+
+// checkConfig validates the config file in the same way as the daemon parses it.
+func checkConfig(path string) error {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	var config service.Config
+	if err := tree.Unmarshal(&config); err != nil {
+		return err
+	}
+	if _, err := estargz.ParsePathPolicy(config.PathPolicy); err != nil {
+		return err
+	}
+	if hc := config.HotChunkCache; hc.Dir != "" && hc.MaxSizeMB <= 0 {
+		return fmt.Errorf("max_size_mb of hot_chunk_cache must be positive")
+	}
+	return nil
+}
+
+func get(clicontext *cli.Context, path string) error {
+	return request(clicontext, http.MethodGet, path, nil)
+}
+
+func post(clicontext *cli.Context, path string, params url.Values) error {
+	return request(clicontext, http.MethodPost, path, params)
+}
+
+// request sends a request to the debug socket and copies the response to stdout.
+// JSON responses are indented.
+func request(clicontext *cli.Context, method, path string, params url.Values) error {
+	addr := clicontext.GlobalString("address")
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", addr)
+			},
+		},
+	}
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequest(method, "http://localhost"+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request to %q (is debug_address configured?): %w", addr, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(msg))
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		var v interface{}
+		if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+			return err
+		}
+		enc := json.NewEncoder(clicontext.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	_, err = io.Copy(clicontext.App.Writer, res.Body)
+	return err
+}
@@ -0,0 +1,647 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// The binary TOC is the TOC encoded as CBOR (RFC 8949) instead of JSON. It has the same
+// structure as the TOC JSON and map keys are the JSON field names, so the two encodings
+// can be converted to each other without loss. The encoding starts with the CBOR
+// self-described tag (55799) which is used as the magic number by readers.
+//
+// Only definite-length items are produced and accepted. Unknown map keys are skipped for
+// forward compatibility.
+
+// binaryTOCMagic is the head of the binary TOC (the CBOR self-described tag).
+var binaryTOCMagic = []byte{0xd9, 0xd9, 0xf7}
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+
+	cborNull = 0xf6
+
+	// maxCBORDepth limits the nesting of skipped unknown items.
+	maxCBORDepth = 32
+)
+
+var errMalformedBinaryTOC = errors.New("malformed binary TOC")
+
+// IsBinaryTOC returns true if p is the head of a binary TOC.
+func IsBinaryTOC(p []byte) bool {
+	return bytes.HasPrefix(p, binaryTOCMagic)
+}
+
+// MarshalBinaryTOC encodes the TOC in the binary format.
+func MarshalBinaryTOC(toc *JTOC) ([]byte, error) {
+	e := &cborEncoder{buf: make([]byte, 0, 128*len(toc.Entries)+64)}
+	e.buf = append(e.buf, binaryTOCMagic...)
+	n := 2
+	if toc.PrefetchBoundary != nil {
+		n++
+	}
+	if toc.Summary != nil {
+		n++
+	}
+	e.head(cborMap, uint64(n))
+	e.text("version")
+	e.int(int64(toc.Version))
+	if toc.PrefetchBoundary != nil {
+		e.text("prefetchBoundary")
+		e.int(*toc.PrefetchBoundary)
+	}
+	if s := toc.Summary; s != nil {
+		e.text("summary")
+		e.head(cborMap, 4)
+		e.text("entries")
+		e.int(s.Entries)
+		e.text("regularFiles")
+		e.int(s.RegularFiles)
+		e.text("totalSize")
+		e.int(s.TotalSize)
+		e.text("prefetchSize")
+		e.int(s.PrefetchSize)
+	}
+	e.text("entries")
+	if toc.Entries == nil {
+		e.buf = append(e.buf, cborNull)
+		return e.buf, nil
+	}
+	e.head(cborArray, uint64(len(toc.Entries)))
+	for _, ent := range toc.Entries {
+		if ent == nil {
+			return nil, fmt.Errorf("nil TOC entry")
+		}
+		e.entry(ent)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinaryTOC decodes the TOC encoded in the binary format.
+func UnmarshalBinaryTOC(p []byte) (*JTOC, error) {
+	if !IsBinaryTOC(p) {
+		return nil, fmt.Errorf("binary TOC magic not found")
+	}
+	d := &cborDecoder{p: p, off: len(binaryTOCMagic)}
+	toc, err := d.toc()
+	if err != nil {
+		return nil, fmt.Errorf("%w at byte %d: %v", errMalformedBinaryTOC, d.off, err)
+	}
+	if d.off != len(d.p) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", errMalformedBinaryTOC, len(d.p)-d.off)
+	}
+	return toc, nil
+}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) head(major byte, arg uint64) {
+	m := major << 5
+	switch {
+	case arg < 24:
+		e.buf = append(e.buf, m|byte(arg))
+	case arg <= math.MaxUint8:
+		e.buf = append(e.buf, m|24, byte(arg))
+	case arg <= math.MaxUint16:
+		e.buf = append(e.buf, m|25, 0, 0)
+		binary.BigEndian.PutUint16(e.buf[len(e.buf)-2:], uint16(arg))
+	case arg <= math.MaxUint32:
+		e.buf = append(e.buf, m|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(arg))
+	default:
+		e.buf = append(e.buf, m|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], arg)
+	}
+}
+
+func (e *cborEncoder) int(v int64) {
+	if v < 0 {
+		e.head(cborNegInt, uint64(-1-v))
+		return
+	}
+	e.head(cborUint, uint64(v))
+}
+
+func (e *cborEncoder) text(s string) {
+	e.head(cborText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) bytes(b []byte) {
+	e.head(cborBytes, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// entry encodes the TOCEntry omitting empty fields as the TOC JSON does.
+func (e *cborEncoder) entry(ent *TOCEntry) {
+	type field struct {
+		key   string
+		str   string
+		num   int64
+		isStr bool
+	}
+	fields := []field{
+		{key: "name", str: ent.Name, isStr: true},
+		{key: "type", str: ent.Type, isStr: true},
+	}
+	addStr := func(key, v string) {
+		if v != "" {
+			fields = append(fields, field{key: key, str: v, isStr: true})
+		}
+	}
+	addNum := func(key string, v int64) {
+		if v != 0 {
+			fields = append(fields, field{key: key, num: v})
+		}
+	}
+	addNum("size", ent.Size)
+	addStr("modtime", ent.ModTime3339)
+	addStr("linkName", ent.LinkName)
+	addNum("mode", ent.Mode)
+	addNum("uid", int64(ent.UID))
+	addNum("gid", int64(ent.GID))
+	addStr("userName", ent.Uname)
+	addStr("groupName", ent.Gname)
+	addNum("offset", ent.Offset)
+	addNum("devMajor", int64(ent.DevMajor))
+	addNum("devMinor", int64(ent.DevMinor))
+	addStr("digest", ent.Digest)
+	addNum("chunkOffset", ent.ChunkOffset)
+	addNum("chunkSize", ent.ChunkSize)
+	addStr("chunkDigest", ent.ChunkDigest)
+
+	n := len(fields)
+	if len(ent.Xattrs) > 0 {
+		n++
+	}
+	if ent.Encryption != nil {
+		n++
+	}
+	if len(ent.Hardlinks) > 0 {
+		n++
+	}
+	e.head(cborMap, uint64(n))
+	for _, f := range fields {
+		e.text(f.key)
+		if f.isStr {
+			e.text(f.str)
+		} else {
+			e.int(f.num)
+		}
+	}
+	if len(ent.Xattrs) > 0 {
+		keys := make([]string, 0, len(ent.Xattrs))
+		for k := range ent.Xattrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // make the encoding reproducible
+		e.text("xattrs")
+		e.head(cborMap, uint64(len(keys)))
+		for _, k := range keys {
+			e.text(k)
+			e.bytes(ent.Xattrs[k])
+		}
+	}
+	if enc := ent.Encryption; enc != nil {
+		e.text("encryption")
+		e.head(cborMap, 3)
+		e.text("algorithm")
+		e.text(enc.Algorithm)
+		e.text("keyID")
+		e.text(enc.KeyID)
+		e.text("iv")
+		e.bytes(enc.IV)
+	}
+	if len(ent.Hardlinks) > 0 {
+		e.text("hardlinks")
+		e.head(cborArray, uint64(len(ent.Hardlinks)))
+		for _, l := range ent.Hardlinks {
+			e.text(l)
+		}
+	}
+}
+
+// cborDecoder decodes the binary TOC directly from the byte slice without intermediate
+// representations.
+type cborDecoder struct {
+	p   []byte
+	off int
+}
+
+func (d *cborDecoder) head() (major byte, arg uint64, err error) {
+	if d.off >= len(d.p) {
+		return 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	b := d.p[d.off]
+	d.off++
+	major, info := b>>5, b&0x1f
+	var n int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		n = 1
+	case info == 25:
+		n = 2
+	case info == 26:
+		n = 4
+	case info == 27:
+		n = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported additional information %d", info)
+	}
+	if len(d.p)-d.off < n {
+		return 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	for _, c := range d.p[d.off : d.off+n] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.off += n
+	return major, arg, nil
+}
+
+func (d *cborDecoder) expect(want byte) (uint64, error) {
+	major, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != want {
+		return 0, fmt.Errorf("unexpected major type %d; want %d", major, want)
+	}
+	return arg, nil
+}
+
+// length reads the head of a container or a string and checks the length against the
+// remaining data (each element takes at least 1 byte).
+func (d *cborDecoder) length(want byte) (int, error) {
+	n, err := d.expect(want)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.p)-d.off) {
+		return 0, fmt.Errorf("length %d exceeds the data", n)
+	}
+	return int(n), nil
+}
+
+func (d *cborDecoder) raw(major byte) ([]byte, error) {
+	n, err := d.length(major)
+	if err != nil {
+		return nil, err
+	}
+	b := d.p[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *cborDecoder) text() (string, error) {
+	b, err := d.raw(cborText)
+	return string(b), err
+}
+
+func (d *cborDecoder) int() (int64, error) {
+	major, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if arg > math.MaxInt64 {
+		return 0, fmt.Errorf("integer overflow")
+	}
+	switch major {
+	case cborUint:
+		return int64(arg), nil
+	case cborNegInt:
+		return -1 - int64(arg), nil
+	}
+	return 0, fmt.Errorf("unexpected major type %d; want integer", major)
+}
+
+func (d *cborDecoder) intField() (int, error) {
+	v, err := d.int()
+	if err != nil {
+		return 0, err
+	}
+	if v != int64(int(v)) {
+		return 0, fmt.Errorf("integer overflow")
+	}
+	return int(v), nil
+}
+
+// null consumes the CBOR null if it's the next item.
+func (d *cborDecoder) null() bool {
+	if d.off < len(d.p) && d.p[d.off] == cborNull {
+		d.off++
+		return true
+	}
+	return false
+}
+
+// skip consumes the next item of any type.
+func (d *cborDecoder) skip(depth int) error {
+	if depth > maxCBORDepth {
+		return fmt.Errorf("too deeply nested")
+	}
+	major, arg, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		if arg > uint64(len(d.p)-d.off) {
+			return fmt.Errorf("length %d exceeds the data", arg)
+		}
+		d.off += int(arg)
+	case cborArray, cborMap:
+		if arg > uint64(len(d.p)-d.off) {
+			return fmt.Errorf("length %d exceeds the data", arg)
+		}
+		n := arg
+		if major == cborMap {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return d.skip(depth + 1)
+	}
+	return nil
+}
+
+func (d *cborDecoder) toc() (*JTOC, error) {
+	n, err := d.length(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	toc := new(JTOC)
+	for i := 0; i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "version":
+			toc.Version, err = d.intField()
+		case "prefetchBoundary":
+			if !d.null() {
+				var b int64
+				b, err = d.int()
+				toc.PrefetchBoundary = &b
+			}
+		case "summary":
+			if !d.null() {
+				toc.Summary, err = d.summary()
+			}
+		case "entries":
+			toc.Entries, err = d.entries()
+		default:
+			err = d.skip(0)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", key, err)
+		}
+	}
+	return toc, nil
+}
+
+func (d *cborDecoder) summary() (*TOCSummary, error) {
+	n, err := d.length(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	s := new(TOCSummary)
+	for i := 0; i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "entries":
+			s.Entries, err = d.int()
+		case "regularFiles":
+			s.RegularFiles, err = d.int()
+		case "totalSize":
+			s.TotalSize, err = d.int()
+		case "prefetchSize":
+			s.PrefetchSize, err = d.int()
+		default:
+			err = d.skip(0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (d *cborDecoder) entries() ([]*TOCEntry, error) {
+	if d.null() {
+		return nil, nil
+	}
+	n, err := d.length(cborArray)
+	if err != nil {
+		return nil, err
+	}
+	// Entries are allocated at once to avoid per-entry allocations.
+	ents := make([]TOCEntry, n)
+	res := make([]*TOCEntry, n)
+	for i := range ents {
+		if err := d.entry(&ents[i]); err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		res[i] = &ents[i]
+	}
+	return res, nil
+}
+
+func (d *cborDecoder) entry(ent *TOCEntry) error {
+	n, err := d.length(cborMap)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return err
+		}
+		switch key {
+		case "name":
+			ent.Name, err = d.text()
+		case "type":
+			ent.Type, err = d.text()
+		case "size":
+			ent.Size, err = d.int()
+		case "modtime":
+			ent.ModTime3339, err = d.text()
+		case "linkName":
+			ent.LinkName, err = d.text()
+		case "mode":
+			ent.Mode, err = d.int()
+		case "uid":
+			ent.UID, err = d.intField()
+		case "gid":
+			ent.GID, err = d.intField()
+		case "userName":
+			ent.Uname, err = d.text()
+		case "groupName":
+			ent.Gname, err = d.text()
+		case "offset":
+			ent.Offset, err = d.int()
+		case "devMajor":
+			ent.DevMajor, err = d.intField()
+		case "devMinor":
+			ent.DevMinor, err = d.intField()
+		case "xattrs":
+			ent.Xattrs, err = d.xattrs()
+		case "digest":
+			ent.Digest, err = d.text()
+		case "chunkOffset":
+			ent.ChunkOffset, err = d.int()
+		case "chunkSize":
+			ent.ChunkSize, err = d.int()
+		case "chunkDigest":
+			ent.ChunkDigest, err = d.text()
+		case "encryption":
+			ent.Encryption, err = d.encryption()
+		case "hardlinks":
+			ent.Hardlinks, err = d.texts()
+		default:
+			err = d.skip(0)
+		}
+		if err != nil {
+			return fmt.Errorf("field %q: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func (d *cborDecoder) xattrs() (map[string][]byte, error) {
+	if d.null() {
+		return nil, nil
+	}
+	n, err := d.length(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		k, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.raw(cborBytes)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = append([]byte(nil), v...) // don't retain the whole TOC
+	}
+	return m, nil
+}
+
+func (d *cborDecoder) texts() ([]string, error) {
+	if d.null() {
+		return nil, nil
+	}
+	n, err := d.length(cborArray)
+	if err != nil {
+		return nil, err
+	}
+	s := make([]string, n)
+	for i := range s {
+		if s[i], err = d.text(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (d *cborDecoder) encryption() (*Encryption, error) {
+	if d.null() {
+		return nil, nil
+	}
+	n, err := d.length(cborMap)
+	if err != nil {
+		return nil, err
+	}
+	enc := new(Encryption)
+	for i := 0; i < n; i++ {
+		key, err := d.text()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "algorithm":
+			enc.Algorithm, err = d.text()
+		case "keyID":
+			enc.KeyID, err = d.text()
+		case "iv":
+			var iv []byte
+			if iv, err = d.raw(cborBytes); err == nil {
+				enc.IV = append([]byte(nil), iv...)
+			}
+		default:
+			err = d.skip(0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return enc, nil
+}
+
+// ConvertTOC re-encodes the TOC of the gzip-based eStargz blob using the passed
+// compressor (e.g. from JSON to the binary format or vice versa). The contents of the blob
+// other than the TOC and the footer are kept as-is. This returns the converted blob and
+// the digest of the new TOC. Note that the DiffID of the blob changes as well.
+func ConvertTOC(sr *io.SectionReader, gc *GzipCompressor) (io.Reader, digest.Digest, error) {
+	tocOff, footerSize, err := OpenFooter(sr)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse footer: %w", err)
+	}
+	if tocOff < 0 || tocOff > sr.Size()-footerSize {
+		return nil, "", fmt.Errorf("invalid TOC offset %d", tocOff)
+	}
+	toc, _, err := parseTOCEStargz(io.NewSectionReader(sr, tocOff, sr.Size()-footerSize-tocOff))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse TOC: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	tocDgst, err := gc.WriteTOCAndFooter(buf, tocOff, toc, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to write TOC: %w", err)
+	}
+	return io.MultiReader(io.NewSectionReader(sr, 0, tocOff), buf), tocDgst, nil
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+/*
+   Copyright 2019 The Go Authors. All rights reserved.
+   Use of this source code is governed by a BSD-style
+   license that can be found in the LICENSE file.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// TestBinaryTOCRoundTrip tests that the binary TOC keeps all fields of the TOC JSON.
+func TestBinaryTOCRoundTrip(t *testing.T) {
+	boundary := int64(4096)
+	tocs := map[string]*JTOC{
+		"empty": {Version: 1},
+		"full": {
+			Version:          1,
+			PrefetchBoundary: &boundary,
+			Summary:          &TOCSummary{Entries: 3, RegularFiles: 1, TotalSize: 1 << 40, PrefetchSize: 4096},
+			Entries: []*TOCEntry{
+				{Name: "foo/", Type: "dir", ModTime3339: "2021-01-01T00:00:00Z", Mode: 0755, UID: 1000, GID: 1000, Uname: "user", Gname: "group"},
+				{
+					Name:        "foo/bar.txt",
+					Type:        "reg",
+					Size:        1 << 40,
+					Mode:        0644,
+					Offset:      1 << 33,
+					Xattrs:      map[string][]byte{"user.a": []byte("a"), "security.b": {0, 1, 2}},
+					Digest:      "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+					ChunkSize:   1 << 20,
+					ChunkDigest: "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+					Hardlinks:   []string{"foo/baz.txt"},
+				},
+				{Name: "foo/bar.txt", Type: "chunk", Offset: 1<<33 + 1<<20, ChunkOffset: 1 << 20, ChunkDigest: "sha256:2222222222222222222222222222222222222222222222222222222222222222"},
+				{Name: "dev", Type: "char", DevMajor: 1, DevMinor: 3, UID: -1},
+				{Name: "link", Type: "symlink", LinkName: "foo/bar.txt"},
+				{Name: "foo/baz.txt", Type: "hardlink", LinkName: "foo/bar.txt"},
+			},
+		},
+	}
+	for name, toc := range tocs {
+		t.Run(name, func(t *testing.T) {
+			p, err := MarshalBinaryTOC(toc)
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			if !IsBinaryTOC(p) {
+				t.Fatalf("binary TOC must start with the magic: %x", p)
+			}
+			got, err := UnmarshalBinaryTOC(p)
+			if err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			// Compare with the TOC round-tripped through JSON.
+			tocJSON, err := json.Marshal(toc)
+			if err != nil {
+				t.Fatalf("failed to marshal JSON: %v", err)
+			}
+			var want JTOC
+			if err := json.Unmarshal(tocJSON, &want); err != nil {
+				t.Fatalf("failed to unmarshal JSON: %v", err)
+			}
+			if !reflect.DeepEqual(got, &want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("binary TOC = %s; want %s", gotJSON, tocJSON)
+			}
+			if len(toc.Entries) > 0 && len(p) >= len(tocJSON) {
+				t.Errorf("binary TOC (%d bytes) must be smaller than JSON (%d bytes)", len(p), len(tocJSON))
+			}
+
+			// Malformed TOCs must be rejected without panicking.
+			for i := 0; i < len(p); i++ {
+				if _, err := UnmarshalBinaryTOC(p[:i]); err == nil {
+					t.Errorf("truncated binary TOC (%d/%d bytes) must be rejected", i, len(p))
+				}
+			}
+			if _, err := UnmarshalBinaryTOC(append(p, 0)); err == nil {
+				t.Errorf("binary TOC with trailing bytes must be rejected")
+			}
+		})
+	}
+}
+
+// TestBinaryTOCUnknownFields tests that unknown fields in the binary TOC are skipped.
+func TestBinaryTOCUnknownFields(t *testing.T) {
+	e := &cborEncoder{}
+	e.buf = append(e.buf, binaryTOCMagic...)
+	e.head(cborMap, 3)
+	e.text("future")
+	e.head(cborArray, 2)
+	e.head(cborMap, 1)
+	e.text("x")
+	e.bytes([]byte("y"))
+	e.head(cborTag, 1)
+	e.int(-100)
+	e.text("version")
+	e.int(1)
+	e.text("entries")
+	e.head(cborArray, 1)
+	e.head(cborMap, 2)
+	e.text("name")
+	e.text("foo")
+	e.text("unknown")
+	e.text("bar")
+
+	toc, err := UnmarshalBinaryTOC(e.buf)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if toc.Version != 1 || len(toc.Entries) != 1 || toc.Entries[0].Name != "foo" {
+		t.Errorf("unexpected TOC: %+v", toc)
+	}
+}
+
+// TestGzipBinaryTOC tests gzip-based eStargz with the binary TOC and the conversion of
+// the TOC between encodings.
+func TestGzipBinaryTOC(t *testing.T) {
+	tarBlob := buildTar(t, tarOf(
+		dir("foo/"),
+		file("foo/bar.txt", "bar contents"),
+		file("baz.txt", "baz contents"),
+	), "")
+	for _, zstdTOC := range []bool{false, true} {
+		opts := []Option{WithBinaryTOC()}
+		if zstdTOC {
+			opts = append(opts, WithZstdTOC())
+		}
+		rc, err := Build(tarBlob, opts...)
+		if err != nil {
+			t.Fatalf("failed to build eStargz: %v", err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read eStargz: %v", err)
+		}
+		want := footerSI2BinaryTOC
+		if zstdTOC {
+			want = footerSI2ZstdBinaryTOC
+		}
+		if got := b[len(b)-FooterSize+13]; got != byte(want) {
+			t.Errorf("footer flag = %q; want %q", got, want)
+		}
+		checkBinaryTOCBlob(t, b, rc.TOCDigest())
+
+		// Convert to JSON and back
+		sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+		jr, jDgst, err := ConvertTOC(sr, NewGzipCompressor())
+		if err != nil {
+			t.Fatalf("failed to convert TOC to JSON: %v", err)
+		}
+		jb, err := io.ReadAll(jr)
+		if err != nil {
+			t.Fatalf("failed to read converted blob: %v", err)
+		}
+		if got := jb[len(jb)-FooterSize+13]; got != footerSI2JSON {
+			t.Errorf("footer flag of converted blob = %q; want %q", got, footerSI2JSON)
+		}
+		checkBinaryTOCBlob(t, jb, jDgst)
+		jsr := io.NewSectionReader(bytes.NewReader(jb), 0, int64(len(jb)))
+		br, bDgst, err := ConvertTOC(jsr, NewGzipCompressorWithBinaryTOC(0))
+		if err != nil {
+			t.Fatalf("failed to convert TOC to binary: %v", err)
+		}
+		bb, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatalf("failed to read converted blob: %v", err)
+		}
+		checkBinaryTOCBlob(t, bb, bDgst)
+	}
+	if _, err := Build(tarBlob, WithBinaryTOC(), WithCompression(newGzipCompressionWithLevel(0))); err == nil {
+		t.Errorf("binary TOC must be rejected with custom compression")
+	}
+}
+
+func checkBinaryTOCBlob(t *testing.T, b []byte, tocDgst digest.Digest) {
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("failed to open eStargz: %v", err)
+	}
+	if got := r.TOCDigest(); got != tocDgst {
+		t.Errorf("TOC digest = %v; want %v", got, tocDgst)
+	}
+	for name, want := range map[string]string{"foo/bar.txt": "bar contents", "baz.txt": "baz contents"} {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("contents of %q = %q; want %q", name, got, want)
+		}
+	}
+}
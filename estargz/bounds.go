@@ -0,0 +1,54 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOutOfBounds is returned when an offset or a size recorded in a blob is negative,
+// overflows int64 or points outside of the blob or the file.
+var ErrOutOfBounds = errors.New("offset or size out of bounds")
+
+// CheckRange returns ErrOutOfBounds unless the range [off, off+size) is contained in
+// [0, limit). This never overflows even for ranges near math.MaxInt64.
+func CheckRange(off, size, limit int64) error {
+	if off < 0 || size < 0 || limit < 0 || off > limit || size > limit-off {
+		return fmt.Errorf("range (offset=%d, size=%d) isn't in [0, %d): %w", off, size, limit, ErrOutOfBounds)
+	}
+	return nil
+}
+
+// CheckBounds checks that the offset and the chunk of the entry are contained in the blob
+// of blobSize bytes and the file of fileSize bytes. fileSize is the Size of the entry
+// for "reg" entries and the Size of the file the chunk belongs to for "chunk" entries.
+// ChunkSize must be already initialized (i.e. non-zero for non-empty chunks).
+func (e *TOCEntry) CheckBounds(blobSize, fileSize int64) error {
+	if e.Size < 0 {
+		return fmt.Errorf("negative size %d of %q: %w", e.Size, e.Name, ErrOutOfBounds)
+	}
+	if err := CheckRange(e.Offset, 0, blobSize); err != nil {
+		return fmt.Errorf("invalid offset of %q: %w", e.Name, err)
+	}
+	if e.isDataType() {
+		if err := CheckRange(e.ChunkOffset, e.ChunkSize, fileSize); err != nil {
+			return fmt.Errorf("invalid chunk of %q: %w", e.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestCheckRange(t *testing.T) {
+	for _, tt := range []struct {
+		off, size, limit int64
+		ok               bool
+	}{
+		{0, 0, 0, true},
+		{0, 10, 10, true},
+		{10, 0, 10, true},
+		{1 << 32, 1 << 32, 1 << 34, true},
+		{0, math.MaxInt64, math.MaxInt64, true},
+		{math.MaxInt64 - 1, 1, math.MaxInt64, true},
+		{0, 11, 10, false},
+		{11, 0, 10, false},
+		{-1, 1, 10, false},
+		{0, -1, 10, false},
+		{math.MaxInt64 - 5, 10, math.MaxInt64, false},
+		{math.MaxInt64, math.MaxInt64, math.MaxInt64, false},
+	} {
+		err := CheckRange(tt.off, tt.size, tt.limit)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckRange(%d, %d, %d) = %v; want ok=%v", tt.off, tt.size, tt.limit, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrOutOfBounds) {
+			t.Errorf("CheckRange(%d, %d, %d) = %v; want ErrOutOfBounds", tt.off, tt.size, tt.limit, err)
+		}
+	}
+}
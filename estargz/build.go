@@ -49,6 +49,19 @@ type options struct {
 	missedPrioritizedFiles *[]string
 	compression            Compression
 	ctx                    context.Context
+	noLandmarks            bool
+	pathPolicy             PathPolicy
+	rewrites               []contentRewrite
+	summary                bool
+	cdc                    bool
+	zstdTOC                bool
+	binaryTOC              bool
+	alignment              int
+	normalize              headerNormalization
+	encryptionKey          []byte
+	reusableChunks         bool
+	deltaBase              *DeltaBase
+	deltaReport            *DeltaReport
 }
 
 type Option func(o *options) error
@@ -61,6 +74,18 @@ func WithChunkSize(chunkSize int) Option {
 	}
 }
 
+// WithContentDefinedChunking option makes Build decide the boundaries of chunks of
+// regular files by their contents (FastCDC) instead of splitting them at fixed offsets.
+// The chunk size specified by WithChunkSize is used as the average chunk size. Chunks
+// are likely to stay the same across versions of a file even when bytes are inserted to
+// or removed from it, so their digests (and caches of them) can be shared.
+func WithContentDefinedChunking() Option {
+	return func(o *options) error {
+		o.cdc = true
+		return nil
+	}
+}
+
 // WithCompressionLevel option specifies the gzip compression level.
 // The default is gzip.BestCompression.
 // See also: https://godoc.org/compress/gzip#pkg-constants
@@ -106,6 +131,8 @@ func WithCompression(compression Compression) Option {
 }
 
 // WithContext specifies a context that can be used for clean canceleration.
+// Build stops reading the passed blob and building the sub-blobs once the context
+// is canceled. Reading the returned Blob also fails after that.
 func WithContext(ctx context.Context) Option {
 	return func(o *options) error {
 		o.ctx = ctx
@@ -113,6 +140,68 @@ func WithContext(ctx context.Context) Option {
 	}
 }
 
+// WithoutLandmarks option makes Build record the end of prioritized files in the TOC
+// instead of adding landmark files to the blob. This is useful for readers that don't
+// expect these extra files.
+func WithoutLandmarks() Option {
+	return func(o *options) error {
+		o.noLandmarks = true
+		return nil
+	}
+}
+
+// WithSummary option makes Build record TOCSummary of the blob in the TOC.
+func WithSummary() Option {
+	return func(o *options) error {
+		o.summary = true
+		return nil
+	}
+}
+
+// WithPathPolicy option specifies how to deal with names of tar entries that aren't
+// valid UTF-8 or contain NUL or control characters. Default is PathPolicyAllow.
+func WithPathPolicy(policy PathPolicy) Option {
+	return func(o *options) error {
+		o.pathPolicy = policy
+		return nil
+	}
+}
+
+// WithZstdTOC option makes Build compress the TOC JSON with zstd inside the gzip stream.
+// This cuts the size of the TOC transferred and read on mount but older readers can't
+// read the blob. This can't be used with WithCompression.
+func WithZstdTOC() Option {
+	return func(o *options) error {
+		o.zstdTOC = true
+		return nil
+	}
+}
+
+// WithBinaryTOC option makes Build encode the TOC in the binary format (CBOR) instead of
+// JSON. The binary TOC is smaller and faster to parse but older readers can't read the
+// blob. This can be combined with WithZstdTOC but not with WithCompression.
+func WithBinaryTOC() Option {
+	return func(o *options) error {
+		o.binaryTOC = true
+		return nil
+	}
+}
+
+// WithChunkAlignment option makes Build align the offsets of the chunks of regular files
+// not smaller than the alignment, and of the landmark files (i.e. the end of the prioritized
+// files), to multiples of the alignment (e.g. 1 MiB) by inserting padding. This lets fetch
+// ranges line up with range caches of CDNs and multipart boundaries of object storages.
+// The padding increases the size of the blob.
+func WithChunkAlignment(alignment int) Option {
+	return func(o *options) error {
+		if alignment < 0 {
+			return fmt.Errorf("alignment must not be negative: %d", alignment)
+		}
+		o.alignment = alignment
+		return nil
+	}
+}
+
 // Blob is an eStargz blob.
 type Blob struct {
 	io.ReadCloser
@@ -144,9 +233,32 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			return nil, err
 		}
 	}
+	if opts.zstdTOC || opts.binaryTOC {
+		if opts.compression != nil {
+			return nil, fmt.Errorf("zstd-compressed or binary TOC is supported only by the default gzip compression")
+		}
+		opts.compression = &gzipCompression{
+			&GzipCompressor{
+				compressionLevel: opts.compressionLevel,
+				zstdTOC:          opts.zstdTOC,
+				binaryTOC:        opts.binaryTOC,
+			},
+			&GzipDecompressor{},
+		}
+	}
 	if opts.compression == nil {
 		opts.compression = newGzipCompressionWithLevel(opts.compressionLevel)
 	}
+	if _, ok := opts.compression.(Padder); opts.alignment > 0 && !ok {
+		return nil, fmt.Errorf("compression %T doesn't support chunk alignment", opts.compression)
+	}
+	var delta *deltaConversion
+	if opts.deltaBase != nil {
+		if _, ok := opts.compression.(*gzipCompression); !ok {
+			return nil, fmt.Errorf("delta conversion is supported only by the default gzip compression")
+		}
+		delta = &deltaConversion{base: opts.deltaBase}
+	}
 	layerFiles := newTempFiles()
 	ctx := opts.ctx
 	if ctx == nil {
@@ -172,19 +284,71 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			rErr = fmt.Errorf("error from context %q: %w", cErr, rErr)
 		}
 	}()
+	tarBlob = io.NewSectionReader(&contextReaderAt{ctx, tarBlob}, 0, tarBlob.Size())
 	tarBlob, err := decompressBlob(tarBlob, layerFiles)
 	if err != nil {
 		return nil, err
 	}
-	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.missedPrioritizedFiles)
+	entries, err := sortEntries(tarBlob, opts.prioritizedFiles, opts.missedPrioritizedFiles, opts.pathPolicy)
 	if err != nil {
 		return nil, err
 	}
+	if len(opts.rewrites) > 0 {
+		if err := rewriteEntries(entries, opts.rewrites, layerFiles); err != nil {
+			return nil, err
+		}
+	}
+	if opts.normalize.enabled() {
+		normalizeEntries(entries, opts.normalize)
+	}
+	var encs map[string]*Encryption
+	if opts.encryptionKey != nil {
+		if encs, err = encryptPrioritizedEntries(entries, opts.encryptionKey, layerFiles); err != nil {
+			return nil, err
+		}
+	}
+	var tocHook func(toc *JTOC, dataSize int64)
+	if opts.noLandmarks {
+		entries, tocHook = removeLandmark(entries)
+	}
+	if encs != nil {
+		landmarkHook := tocHook
+		tocHook = func(toc *JTOC, dataSize int64) {
+			if landmarkHook != nil {
+				landmarkHook(toc, dataSize)
+			}
+			for _, e := range toc.Entries {
+				if e.Type == "reg" {
+					e.Encryption = encs[cleanEntryName(e.Name)]
+				}
+			}
+		}
+	}
+	if opts.summary {
+		prevHook := tocHook
+		tocHook = func(toc *JTOC, dataSize int64) {
+			if prevHook != nil {
+				prevHook(toc, dataSize)
+			}
+			s := ComputeSummary(toc)
+			toc.Summary = &s
+		}
+	}
+	var chunker Chunker
+	if opts.cdc {
+		avgSize := opts.chunkSize
+		if avgSize <= 0 {
+			avgSize = (&Writer{}).chunkSize()
+		}
+		if chunker, err = NewFastCDC(avgSize); err != nil {
+			return nil, err
+		}
+	}
 	tarParts := divideEntries(entries, runtime.GOMAXPROCS(0))
 	writers := make([]*Writer, len(tarParts))
 	payloads := make([]*os.File, len(tarParts))
 	var mu sync.Mutex
-	var eg errgroup.Group
+	eg, egCtx := errgroup.WithContext(ctx)
 	for i, parts := range tarParts {
 		i, parts := i, parts
 		// builds verifiable stargz sub-blobs
@@ -195,9 +359,20 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			}
 			sw := NewWriterWithCompressor(esgzFile, opts.compression)
 			sw.ChunkSize = opts.chunkSize
-			if err := sw.AppendTar(readerFromEntries(parts...)); err != nil {
+			sw.Chunker = chunker
+			sw.Alignment = int64(opts.alignment)
+			sw.reusableChunks = opts.reusableChunks
+			sw.delta = delta
+			if err := sw.AppendTar(&contextReader{egCtx, readerFromEntries(parts...)}); err != nil {
 				return err
 			}
+			if sw.Alignment > 0 && i < len(tarParts)-1 {
+				// Parts are concatenated so the following parts stay aligned
+				// only if this part ends at the boundary.
+				if err := sw.align(); err != nil {
+					return err
+				}
+			}
 			mu.Lock()
 			writers[i] = sw
 			payloads[i] = esgzFile
@@ -209,7 +384,10 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 		rErr = err
 		return nil, err
 	}
-	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, writers...)
+	if delta != nil && opts.deltaReport != nil {
+		*opts.deltaReport = delta.result()
+	}
+	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, tocHook, writers...)
 	if err != nil {
 		rErr = err
 		return nil, err
@@ -225,7 +403,7 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	diffID := digest.Canonical.Digester()
 	pr, pw := io.Pipe()
 	go func() {
-		r, err := opts.compression.Reader(io.TeeReader(io.MultiReader(append(rs, tocAndFooter)...), pw))
+		r, err := opts.compression.Reader(io.TeeReader(&contextReader{ctx, io.MultiReader(append(rs, tocAndFooter)...)}, pw))
 		if err != nil {
 			pw.CloseWithError(err)
 			return
@@ -252,7 +430,9 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 // Writers doesn't write TOC and footer to the underlying writers so they can be
 // combined into a single eStargz and tocAndFooter returned by this function can
 // be appended at the tail of that combined blob.
-func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooterR io.Reader, tocDgst digest.Digest, err error) {
+// tocHook is called with the combined TOC and the size of the blob excluding TOC and footer,
+// before the TOC is written. This can be nil.
+func closeWithCombine(compressionLevel int, tocHook func(toc *JTOC, dataSize int64), ws ...*Writer) (tocAndFooterR io.Reader, tocDgst digest.Digest, err error) {
 	if len(ws) == 0 {
 		return nil, "", fmt.Errorf("at least one writer must be passed")
 	}
@@ -286,6 +466,10 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooterR io.Rea
 		}
 		currentOffset += w.cw.n
 	}
+	recordHardlinks(mtoc) // link groups can span writers
+	if tocHook != nil {
+		tocHook(mtoc, currentOffset)
+	}
 
 	return tocAndFooter(ws[0].compressor, mtoc, currentOffset)
 }
@@ -328,10 +512,10 @@ var errNotFound = errors.New("not found")
 // sortEntries reads the specified tar blob and returns a list of tar entries.
 // If some of prioritized files are specified, the list starts from these
 // files with keeping the order specified by the argument.
-func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]string) ([]*entry, error) {
+func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]string, pathPolicy PathPolicy) ([]*entry, error) {
 
 	// Import tar file.
-	intar, err := importTar(in)
+	intar, err := importTar(in, pathPolicy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to sort: %w", err)
 	}
@@ -371,6 +555,43 @@ func sortEntries(in io.ReaderAt, prioritized []string, missedPrioritized *[]stri
 	return append(sorted.dump(), intar.dump()...), nil
 }
 
+// removeLandmark removes the landmark file from the entries sorted by sortEntries. The returned
+// hook records the prefetch boundary indicated by the landmark to the TOC instead.
+func removeLandmark(entries []*entry) ([]*entry, func(toc *JTOC, dataSize int64)) {
+	for i, e := range entries {
+		name := cleanEntryName(e.header.Name)
+		if name != PrefetchLandmark && name != NoPrefetchLandmark {
+			continue
+		}
+		rest := append(entries[:i:i], entries[i+1:]...)
+		if name == NoPrefetchLandmark {
+			return rest, func(toc *JTOC, dataSize int64) {
+				var zero int64
+				toc.PrefetchBoundary = &zero
+			}
+		}
+		// The boundary is the offset of the first payload following the prioritized files.
+		var next string
+		for _, e := range rest[i:] {
+			if e.header.FileInfo().Mode().IsRegular() && e.header.Size > 0 {
+				next = cleanEntryName(e.header.Name)
+				break
+			}
+		}
+		return rest, func(toc *JTOC, dataSize int64) {
+			boundary := dataSize
+			for _, e := range toc.Entries {
+				if next != "" && e.Type == "reg" && cleanEntryName(e.Name) == next {
+					boundary = e.Offset
+					break
+				}
+			}
+			toc.PrefetchBoundary = &boundary
+		}
+	}
+	return entries, nil
+}
+
 // readerFromEntries returns a reader of tar archive that contains entries passed
 // through the arguments.
 func readerFromEntries(entries ...*entry) io.Reader {
@@ -393,7 +614,7 @@ func readerFromEntries(entries ...*entry) io.Reader {
 	return pr
 }
 
-func importTar(in io.ReaderAt) (*tarFile, error) {
+func importTar(in io.ReaderAt, pathPolicy PathPolicy) (*tarFile, error) {
 	tf := &tarFile{}
 	pw, err := newCountReader(in)
 	if err != nil {
@@ -412,6 +633,14 @@ func importTar(in io.ReaderAt) (*tarFile, error) {
 				return nil, fmt.Errorf("failed to parse tar file, %w", err)
 			}
 		}
+		if h.Name, err = pathPolicy.Apply(h.Name); err != nil {
+			return nil, fmt.Errorf("failed to import tar file: %w", err)
+		}
+		if h.Typeflag == tar.TypeLink || h.Typeflag == tar.TypeSymlink {
+			if h.Linkname, err = pathPolicy.Apply(h.Linkname); err != nil {
+				return nil, fmt.Errorf("failed to import tar file: link of %q: %w", h.Name, err)
+			}
+		}
 		switch cleanEntryName(h.Name) {
 		case PrefetchLandmark, NoPrefetchLandmark:
 			// Ignore existing landmark
@@ -461,6 +690,16 @@ func moveRec(name string, in *tarFile, out *tarFile) error {
 	if e, ok := in.get(name); ok {
 		out.add(e)
 		in.remove(name)
+
+		// Move the hardlinks to this entry as well so that the link group isn't split into
+		// the prioritized and non-prioritized spans.
+		for _, l := range in.links[name] {
+			if le, ok := in.get(l); ok && le.header.Typeflag == tar.TypeLink && cleanEntryName(le.header.Linkname) == name {
+				if err := moveRec(l, in, out); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
@@ -473,14 +712,23 @@ type entry struct {
 type tarFile struct {
 	index  map[string]*entry
 	stream []*entry
+	links  map[string][]string // link target -> names of hardlinks to it
 }
 
 func (f *tarFile) add(e *entry) {
 	if f.index == nil {
 		f.index = make(map[string]*entry)
 	}
-	f.index[cleanEntryName(e.header.Name)] = e
+	name := cleanEntryName(e.header.Name)
+	f.index[name] = e
 	f.stream = append(f.stream, e)
+	if e.header.Typeflag == tar.TypeLink {
+		if f.links == nil {
+			f.links = make(map[string][]string)
+		}
+		target := cleanEntryName(e.header.Linkname)
+		f.links[target] = append(f.links[target], name)
+	}
 }
 
 func (f *tarFile) remove(name string) {
@@ -519,6 +767,32 @@ func (rc readCloser) Close() error {
 	return rc.closeFunc()
 }
 
+// contextReader is an io.Reader that fails once the context is canceled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// contextReaderAt is an io.ReaderAt that fails once the context is canceled.
+type contextReaderAt struct {
+	ctx context.Context
+	r   io.ReaderAt
+}
+
+func (cr *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.ReadAt(p, off)
+}
+
 func fileSectionReader(file *os.File) (*io.SectionReader, error) {
 	info, err := file.Stat()
 	if err != nil {
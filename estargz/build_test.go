@@ -26,6 +26,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"reflect"
@@ -136,9 +138,9 @@ func TestSort(t *testing.T) {
 			log: []string{"baz.txt"},
 			want: tarOf(
 				file("baz.txt", "baz"),
+				link("bar.txt", "baz.txt"),
 				prefetchLandmark(),
 				file("foo.txt", "foo"),
-				link("bar.txt", "baz.txt"),
 				file("baa.txt", "baa"),
 			),
 		},
@@ -312,6 +314,44 @@ func TestSort(t *testing.T) {
 				prefetchLandmark(),
 			),
 		},
+		{
+			name: "hardlink_group",
+			in: tarOf(
+				file("baz.txt", "aaaaa"),
+				file("foo.txt", "foo"),
+				link("bazlink", "baz.txt"),
+				dir("bar/"),
+				link("bar/bazlink", "baz.txt"),
+			),
+			log: []string{"baz.txt"},
+			want: tarOf(
+				file("baz.txt", "aaaaa"),
+				link("bazlink", "baz.txt"),
+				dir("bar/"),
+				link("bar/bazlink", "baz.txt"),
+				prefetchLandmark(),
+				file("foo.txt", "foo"),
+			),
+		},
+		{
+			name: "hardlink_group_from_link",
+			in: tarOf(
+				file("baz.txt", "aaaaa"),
+				file("foo.txt", "foo"),
+				link("bazlink", "baz.txt"),
+				dir("bar/"),
+				link("bar/bazlink", "baz.txt"),
+			),
+			log: []string{"bar/bazlink"},
+			want: tarOf(
+				dir("bar/"),
+				file("baz.txt", "aaaaa"),
+				link("bazlink", "baz.txt"),
+				link("bar/bazlink", "baz.txt"),
+				prefetchLandmark(),
+				file("foo.txt", "foo"),
+			),
+		},
 		{
 			name: "root_relative_file",
 			in: tarOf(
@@ -444,6 +484,72 @@ func TestSort(t *testing.T) {
 	}
 }
 
+// TestHardlinkGroups tests that link groups spanning the prioritized and non-prioritized
+// files are placed in the prioritized span with the payload stored once, and that the
+// groups are recorded in the TOC.
+func TestHardlinkGroups(t *testing.T) {
+	in := tarOf(
+		file("baz.txt", "aaaaa"),
+		file("foo.txt", "foo"),
+		link("bazlink", "baz.txt"),
+		dir("bar/"),
+		link("bar/bazlink", "bazlink"),
+	)
+	compressors := map[string]Compression{
+		"json":   newGzipCompressionWithLevel(gzip.BestCompression),
+		"binary": &gzipCompression{NewGzipCompressorWithBinaryTOC(gzip.BestCompression), &GzipDecompressor{}},
+	}
+	for name, c := range compressors {
+		c := c
+		for _, prioritized := range []string{"baz.txt", "bazlink", "bar/bazlink"} {
+			prioritized := prioritized
+			t.Run(fmt.Sprintf("%s-prioritized=%s", name, prioritized), func(t *testing.T) {
+				rc, err := Build(buildTar(t, in, ""), WithPrioritizedFiles([]string{prioritized}), WithoutLandmarks(), WithCompression(c))
+				if err != nil {
+					t.Fatalf("failed to build stargz: %v", err)
+				}
+				defer rc.Close()
+				b, err := io.ReadAll(rc)
+				if err != nil {
+					t.Fatalf("failed to read stargz: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), WithDecompressors(c))
+				if err != nil {
+					t.Fatalf("failed to open stargz: %v", err)
+				}
+				var payloads int
+				for _, e := range r.toc.Entries {
+					if e.Type == "reg" && e.Size > 0 && cleanEntryName(e.Name) != "foo.txt" {
+						payloads++
+					}
+				}
+				if payloads != 1 {
+					t.Errorf("payload of the link group must be stored once; got %d", payloads)
+				}
+				boundary, ok := r.PrefetchBoundary()
+				if !ok {
+					t.Fatalf("prefetch boundary must be recorded")
+				}
+				for _, l := range []string{"baz.txt", "bazlink", "bar/bazlink"} {
+					e, ok := r.Lookup(l)
+					if !ok {
+						t.Fatalf("%q not found", l)
+					}
+					if e.Name != "baz.txt" || e.Offset >= boundary {
+						t.Errorf("%q must be resolved to the prioritized file; got %q at %d (boundary %d)", l, e.Name, e.Offset, boundary)
+					}
+					if want := []string{"bazlink", "bar/bazlink"}; !reflect.DeepEqual(e.Hardlinks, want) {
+						t.Errorf("hardlinks of %q = %v; want %v", l, e.Hardlinks, want)
+					}
+				}
+				if e, ok := r.Lookup("foo.txt"); !ok || e.Offset < boundary || len(e.Hardlinks) != 0 {
+					t.Errorf("foo.txt must be placed after the boundary without hardlinks")
+				}
+			})
+		}
+	}
+}
+
 func next(t *testing.T, a *tar.Reader, b *tar.Reader) (ah *tar.Header, bh *tar.Header, err error) {
 	eofA, eofB := false, false
 
@@ -676,3 +782,34 @@ func TestCountReader(t *testing.T) {
 	}
 
 }
+
+func TestContextCancel(t *testing.T) {
+	newTar := func() *io.SectionReader {
+		return buildTar(t, tarOf(
+			dir("foo/"),
+			file("foo/bar.txt", "bar"),
+		), "")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Build(newTar(), WithContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("build must be canceled: %v", err)
+	}
+
+	rc, err := Build(newTar())
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read built blob: %v", err)
+	}
+	blob := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	if _, err := Open(blob, WithOpenContext(ctx)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("open must be canceled: %v", err)
+	}
+	if _, err := Open(blob, WithOpenContext(context.Background())); err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bufio"
+	"fmt"
+	"math/bits"
+)
+
+// Chunker decides boundaries of chunks of regular files written by Writer.
+type Chunker interface {
+	// MaxChunkSize returns the maximum size of a chunk.
+	MaxChunkSize() int
+
+	// NextChunkSize returns the size of the chunk at the head of data, which is in the
+	// range of (0, len(data)]. data contains MaxChunkSize bytes of the file or all the
+	// remaining bytes of the file if they are fewer.
+	NextChunkSize(data []byte) int
+}
+
+// FastCDC is a Chunker of content-defined chunking based on FastCDC. Boundaries of chunks
+// are decided by the contents around them, not by the offsets, so inserting or removing
+// bytes in a file changes only the chunks around the modified bytes. This maximizes the
+// chunks (and their digests) shared among versions of a file.
+type FastCDC struct {
+	minSize, avgSize, maxSize int
+	maskS, maskL              uint64
+}
+
+// NewFastCDC returns a FastCDC chunker producing chunks of avgSize bytes on average.
+// Chunk sizes are limited to [avgSize/4, avgSize*2] except the last chunk of a file.
+// avgSize is rounded down to a power of two.
+func NewFastCDC(avgSize int) (*FastCDC, error) {
+	if avgSize < 64 {
+		return nil, fmt.Errorf("average chunk size must be at least 64 bytes; got %d", avgSize)
+	}
+	b := bits.Len(uint(avgSize)) - 1
+	avgSize = 1 << b
+	// Normalized chunking: cutting before avgSize is harder and after avgSize is easier,
+	// which concentrates chunk sizes around avgSize. Masks use the upper bits of the gear
+	// hash, which depend on the last 64 bytes.
+	return &FastCDC{
+		minSize: avgSize / 4,
+		avgSize: avgSize,
+		maxSize: avgSize * 2,
+		maskS:   ^uint64(0) << (64 - (b + 2)),
+		maskL:   ^uint64(0) << (64 - (b - 2)),
+	}, nil
+}
+
+// MaxChunkSize implements Chunker.
+func (c *FastCDC) MaxChunkSize() int {
+	return c.maxSize
+}
+
+// NextChunkSize implements Chunker.
+func (c *FastCDC) NextChunkSize(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+	var h uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gearTable[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// nextChunkSize returns the size of the next chunk of the file read from br with remain
+// bytes left.
+func nextChunkSize(c Chunker, br *bufio.Reader, remain int64) (int64, error) {
+	n := c.MaxChunkSize()
+	if remain < int64(n) {
+		n = int(remain)
+	}
+	data, err := br.Peek(n)
+	if err != nil {
+		return 0, err
+	}
+	size := c.NextChunkSize(data)
+	if size <= 0 || size > n {
+		return 0, fmt.Errorf("invalid chunk size %d decided by the chunker (max: %d)", size, n)
+	}
+	return int64(size), nil
+}
+
+// gearTable is the table of random values for the gear hash. This must not be changed
+// because chunk boundaries of blobs depend on it.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64 with a fixed seed
+	x := uint64(0x6573746172677a00) // "estargz"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
@@ -0,0 +1,61 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+// Chunk is a chunk of regular files in a layer.
+type Chunk struct {
+	// Digest is the digest of the uncompressed contents of the chunk (i.e. ChunkDigest of
+	// the TOC entry).
+	Digest string `json:"digest"`
+
+	// Offset is the offset of the compressed chunk in the blob.
+	Offset int64 `json:"offset"`
+
+	// Size is the uncompressed size of the chunk.
+	Size int64 `json:"size"`
+}
+
+// ComputeChunks walks the entries of the TOC and returns non-empty chunks of regular files
+// in the order of their offsets in the blob. Chunks without digests are skipped. Tools
+// outside of the snapshotter (e.g. cache preloaders and syncers) can compare the lists
+// among layers to find chunks they share.
+func ComputeChunks(toc *JTOC) []Chunk {
+	var chunks []Chunk
+	var lastReg *TOCEntry
+	for _, e := range toc.Entries {
+		if e.Type == "reg" {
+			lastReg = e
+		}
+		if !e.isDataType() || e.ChunkDigest == "" || lastReg == nil {
+			continue
+		}
+		size := e.ChunkSize
+		if size == 0 {
+			size = lastReg.Size - e.ChunkOffset // the chunk goes to the end of the file
+		}
+		if size <= 0 {
+			continue
+		}
+		chunks = append(chunks, Chunk{Digest: e.ChunkDigest, Offset: e.Offset, Size: size})
+	}
+	return chunks
+}
+
+// Chunks returns non-empty chunks of regular files in the blob.
+func (r *Reader) Chunks() []Chunk {
+	return ComputeChunks(r.toc)
+}
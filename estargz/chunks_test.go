@@ -0,0 +1,43 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComputeChunks(t *testing.T) {
+	toc := &JTOC{
+		Entries: []*TOCEntry{
+			{Name: "a", Type: "reg", Size: 10 << 10, Offset: 0, ChunkSize: 8 << 10, ChunkDigest: "sha256:1"},
+			{Name: "a", Type: "chunk", Offset: 100, ChunkOffset: 8 << 10, ChunkDigest: "sha256:2"},
+			{Name: "b", Type: "reg", Size: 2 << 10, Offset: 300, ChunkDigest: "sha256:2"},
+			{Name: "c", Type: "reg", Offset: 400},
+			{Name: "d", Type: "dir"},
+			{Name: "e", Type: "reg", Size: 1, Offset: 500},
+		},
+	}
+	want := []Chunk{
+		{Digest: "sha256:1", Offset: 0, Size: 8 << 10},
+		{Digest: "sha256:2", Offset: 100, Size: 2 << 10},
+		{Digest: "sha256:2", Offset: 300, Size: 2 << 10},
+	}
+	if got := ComputeChunks(toc); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected chunks %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,496 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package conformance checks that eStargz blobs produced by third-party builders
+// conform to the eStargz specification (docs/estargz.md) implemented by this module,
+// and reports each violation found in them.
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Names of the checks in the order they are run.
+const (
+	// CheckFooter checks the footer at the end of the blob.
+	CheckFooter = "footer"
+
+	// CheckTOC checks that the TOC can be read and its version is 1.
+	CheckTOC = "toc"
+
+	// CheckTOCDigest checks that the digest of the TOC matches the one given with
+	// WithTOCDigest (i.e. the layer annotation).
+	CheckTOCDigest = "toc-digest"
+
+	// CheckEntries checks the required fields and the layout of TOC entries.
+	CheckEntries = "entries"
+
+	// CheckLandmark checks the prefetch landmark or the no-prefetch landmark.
+	CheckLandmark = "landmark"
+
+	// CheckTarStructure checks that the tar archive in the blob matches the TOC.
+	CheckTarStructure = "tar-structure"
+
+	// CheckChunkDigests checks that the contents of all chunks match their digests.
+	CheckChunkDigests = "chunk-digests"
+
+	// CheckSummary checks the optional summary recorded in the TOC.
+	CheckSummary = "summary"
+)
+
+var allChecks = []string{CheckFooter, CheckTOC, CheckTOCDigest, CheckEntries, CheckLandmark,
+	CheckTarStructure, CheckChunkDigests, CheckSummary}
+
+const defaultMaxDetails = 20
+
+// Result is the result of a check.
+type Result struct {
+	Name string `json:"name"`
+
+	// Passed is true if the blob conforms to the checked part of the specification.
+	Passed bool `json:"passed"`
+
+	// Skipped is true if the check wasn't run because checks it depends on failed or
+	// the blob doesn't contain the checked optional property. Skipped checks don't fail
+	// the report.
+	Skipped bool `json:"skipped,omitempty"`
+
+	// Message describes the result.
+	Message string `json:"message,omitempty"`
+
+	// Details lists the problems found by the check, up to the number specified by
+	// WithMaxDetails.
+	Details []string `json:"details,omitempty"`
+}
+
+// Report is the results of all checks against a blob.
+type Report struct {
+	// Compression is the compression of the blob detected from the footer.
+	Compression string `json:"compression,omitempty"`
+
+	// TOCDigest is the digest of the TOC in the blob.
+	TOCDigest digest.Digest `json:"tocDigest,omitempty"`
+
+	Results []Result `json:"results"`
+}
+
+// Passed reports whether the blob passed all checks that were run.
+func (r *Report) Passed() bool {
+	for _, res := range r.Results {
+		if !res.Passed && !res.Skipped {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteText writes the report in a human-readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, res := range r.Results {
+		status := "PASS"
+		if res.Skipped {
+			status = "SKIP"
+		} else if !res.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s\t%s", status, res.Name)
+		if res.Message != "" {
+			fmt.Fprintf(&b, ": %s", res.Message)
+		}
+		b.WriteString("\n")
+		for _, d := range res.Details {
+			fmt.Fprintf(&b, "\t- %s\n", d)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (r *Report) add(res Result) {
+	r.Results = append(r.Results, res)
+}
+
+func (r *Report) skipRest(reason string) {
+	for _, name := range allChecks[len(r.Results):] {
+		r.add(Result{Name: name, Skipped: true, Message: reason})
+	}
+}
+
+// Option is an option of Check.
+type Option func(o *options)
+
+type options struct {
+	decompressors []namedDecompressor
+	tocDigest     digest.Digest
+	maxDetails    int
+}
+
+type namedDecompressor struct {
+	name string
+	estargz.Decompressor
+}
+
+// WithDecompressors adds decompressors of blobs in compressions other than gzip and
+// zstd:chunked.
+func WithDecompressors(decompressors ...estargz.Decompressor) Option {
+	return func(o *options) {
+		for _, d := range decompressors {
+			o.decompressors = append(o.decompressors, namedDecompressor{fmt.Sprintf("%T", d), d})
+		}
+	}
+}
+
+// WithTOCDigest specifies the expected digest of the TOC, which is recorded in the
+// annotation of the layer. CheckTOCDigest is skipped without this option.
+func WithTOCDigest(tocDigest digest.Digest) Option {
+	return func(o *options) {
+		o.tocDigest = tocDigest
+	}
+}
+
+// WithMaxDetails specifies the number of problems reported per check (default: 20).
+// The number of all problems is reported in the message of the result.
+func WithMaxDetails(n int) Option {
+	return func(o *options) {
+		o.maxDetails = n
+	}
+}
+
+// Check runs all checks against the blob and returns the report. Problems in the blob
+// (including errors of reading it) are reported as failed checks.
+func Check(sr *io.SectionReader, opts ...Option) *Report {
+	o := options{
+		decompressors: []namedDecompressor{
+			{"gzip", new(estargz.GzipDecompressor)},
+			{"zstd", new(zstdchunked.Decompressor)},
+		},
+		maxDetails: defaultMaxDetails,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	rep := &Report{}
+	d, tocOffset, tocSize, err := parseFooter(sr, o.decompressors)
+	if err != nil {
+		rep.add(fail(CheckFooter, err))
+		rep.skipRest("footer isn't valid")
+		return rep
+	}
+	rep.Compression = d.name
+	rep.add(pass(CheckFooter, fmt.Sprintf("%s footer; TOC at offset %d", d.name, tocOffset)))
+
+	toc, tocDgst, err := d.ParseTOC(io.NewSectionReader(sr, tocOffset, tocSize))
+	if err != nil {
+		rep.add(fail(CheckTOC, fmt.Errorf("failed to parse TOC: %w", err)))
+		rep.skipRest("TOC isn't valid")
+		return rep
+	}
+	rep.TOCDigest = tocDgst
+	if toc.Version != 1 {
+		rep.add(fail(CheckTOC, fmt.Errorf("version of TOC is %d; must be 1", toc.Version)))
+		rep.skipRest("TOC isn't valid")
+		return rep
+	}
+	r, err := estargz.Open(sr, estargz.WithDecompressors(d.Decompressor))
+	if err != nil {
+		rep.add(fail(CheckTOC, fmt.Errorf("failed to open blob: %w", err)))
+		rep.skipRest("TOC isn't valid")
+		return rep
+	}
+	rep.add(pass(CheckTOC, fmt.Sprintf("%d entries", len(toc.Entries))))
+
+	switch {
+	case o.tocDigest == "":
+		rep.add(Result{Name: CheckTOCDigest, Skipped: true, Message: "expected TOC digest isn't specified"})
+	case o.tocDigest != tocDgst:
+		rep.add(fail(CheckTOCDigest, fmt.Errorf("TOC digest is %s; want %s", tocDgst, o.tocDigest)))
+	default:
+		rep.add(pass(CheckTOCDigest, tocDgst.String()))
+	}
+
+	rep.add(checkEntries(toc, tocOffset, o.maxDetails))
+	rep.add(checkLandmark(r, toc))
+	if err := r.VerifyTarStructure(sr); err != nil {
+		rep.add(fail(CheckTarStructure, err))
+	} else {
+		rep.add(pass(CheckTarStructure, ""))
+	}
+	rep.add(checkChunkDigests(r, toc, o.maxDetails))
+	if _, ok := r.Summary(); !ok {
+		rep.add(Result{Name: CheckSummary, Skipped: true, Message: "summary isn't recorded"})
+	} else if err := r.VerifySummary(); err != nil {
+		rep.add(fail(CheckSummary, err))
+	} else {
+		rep.add(pass(CheckSummary, ""))
+	}
+	return rep
+}
+
+func parseFooter(sr *io.SectionReader, decompressors []namedDecompressor) (d namedDecompressor, tocOffset, tocSize int64, err error) {
+	var errs []string
+	for _, d := range decompressors {
+		tocOffset, tocSize, err := parseFooterWith(sr, d)
+		if err == nil {
+			return d, tocOffset, tocSize, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", d.name, err))
+	}
+	if _, _, err := parseFooterWith(sr, namedDecompressor{"legacy", new(estargz.LegacyGzipDecompressor)}); err == nil {
+		return d, 0, 0, fmt.Errorf("blob has the footer of legacy stargz, not eStargz")
+	}
+	return d, 0, 0, fmt.Errorf("no valid footer found (%s)", strings.Join(errs, "; "))
+}
+
+func parseFooterWith(sr *io.SectionReader, d namedDecompressor) (tocOffset, tocSize int64, err error) {
+	fSize := d.FooterSize()
+	if sr.Size() < fSize {
+		return 0, 0, fmt.Errorf("blob size %d is smaller than the footer", sr.Size())
+	}
+	footer := make([]byte, fSize)
+	if _, err := sr.ReadAt(footer, sr.Size()-fSize); err != nil {
+		return 0, 0, fmt.Errorf("failed to read footer: %w", err)
+	}
+	_, tocOffset, tocSize, err = d.ParseFooter(footer)
+	if err != nil {
+		return 0, 0, err
+	}
+	if tocSize <= 0 {
+		tocSize = sr.Size() - tocOffset - fSize
+	}
+	if err := estargz.CheckRange(tocOffset, tocSize, sr.Size()-fSize); err != nil {
+		return 0, 0, fmt.Errorf("invalid TOC location: %w", err)
+	}
+	return tocOffset, tocSize, nil
+}
+
+// problems collects problems found by a check.
+type problems struct {
+	details []string
+	n       int
+	max     int
+}
+
+func (p *problems) addf(format string, a ...interface{}) {
+	p.n++
+	if len(p.details) < p.max {
+		p.details = append(p.details, fmt.Sprintf(format, a...))
+	}
+}
+
+func (p *problems) result(name, message string) Result {
+	if p.n == 0 {
+		return pass(name, message)
+	}
+	msg := fmt.Sprintf("%d problems found", p.n)
+	if p.n > len(p.details) {
+		msg += fmt.Sprintf(" (showing first %d)", len(p.details))
+	}
+	return Result{Name: name, Message: msg, Details: p.details}
+}
+
+// checkEntries checks the TOC entries against the requirements of the specification.
+// payloadEnd is the offset of the TOC.
+func checkEntries(toc *estargz.JTOC, payloadEnd int64, maxDetails int) Result {
+	var (
+		p          = &problems{max: maxDetails}
+		seen       = make(map[string]bool)
+		lastOffset int64
+		file       *estargz.TOCEntry // the regular file whose chunks are being checked
+		nextChunk  int64             // the chunkOffset of the next chunk of file
+	)
+	endFile := func() {
+		if file != nil && nextChunk != file.Size {
+			p.addf("%q: chunks cover %d bytes of %d bytes", file.Name, nextChunk, file.Size)
+		}
+		file = nil
+	}
+	for i, e := range toc.Entries {
+		if e.Type != "chunk" {
+			endFile()
+		}
+		if e.Name == "" {
+			p.addf("entry %d: name isn't set", i)
+			continue
+		}
+		if strings.TrimPrefix(e.Name, "./") == estargz.TOCTarName {
+			p.addf("%q: TOC must not contain itself", e.Name)
+			continue
+		}
+		switch e.Type {
+		case "dir", "char", "block", "fifo":
+		case "symlink", "hardlink":
+			if e.LinkName == "" {
+				p.addf("%q: linkName of %s isn't set", e.Name, e.Type)
+			} else if e.Type == "hardlink" && !seen[e.LinkName] {
+				p.addf("%q: target %q of hardlink doesn't precede it", e.Name, e.LinkName)
+			}
+		case "reg":
+			if e.ChunkOffset != 0 {
+				p.addf("%q: chunkOffset of reg is %d; must be 0", e.Name, e.ChunkOffset)
+			}
+			if e.Size < 0 {
+				p.addf("%q: negative size %d", e.Name, e.Size)
+				continue
+			}
+			if e.Digest != "" {
+				if _, err := digest.Parse(e.Digest); err != nil {
+					p.addf("%q: invalid digest: %v", e.Name, err)
+				}
+			}
+			file, nextChunk = e, 0
+		case "chunk":
+			if file == nil || file.Name != e.Name {
+				p.addf("%q: chunk doesn't follow reg or chunk of the same file", e.Name)
+				continue
+			}
+			if e.ChunkOffset != nextChunk {
+				p.addf("%q: chunkOffset is %d; want %d", e.Name, e.ChunkOffset, nextChunk)
+			}
+		default:
+			p.addf("%q: unknown type %q", e.Name, e.Type)
+			continue
+		}
+		if e.Type != "chunk" {
+			seen[strings.TrimPrefix(e.Name, "./")] = true
+			seen[e.Name] = true
+		}
+		if file == nil || file.Size == 0 {
+			continue
+		}
+
+		// Non-empty reg or chunk
+		if e.Offset <= lastOffset {
+			p.addf("%q: offset %d isn't after the previous chunk (%d)", e.Name, e.Offset, lastOffset)
+		} else if e.Offset >= payloadEnd {
+			p.addf("%q: offset %d isn't before TOC (%d)", e.Name, e.Offset, payloadEnd)
+		}
+		lastOffset = e.Offset
+		if e.ChunkDigest == "" {
+			p.addf("%q: chunkDigest of the chunk at %d isn't set", e.Name, e.ChunkOffset)
+		} else if _, err := digest.Parse(e.ChunkDigest); err != nil {
+			p.addf("%q: invalid chunkDigest: %v", e.Name, err)
+		}
+		if e.ChunkSize < 0 {
+			p.addf("%q: negative chunkSize %d", e.Name, e.ChunkSize)
+			endFile()
+		} else if e.ChunkSize == 0 {
+			nextChunk = file.Size // the last chunk
+		} else {
+			nextChunk = e.ChunkOffset + e.ChunkSize
+			if nextChunk > file.Size {
+				p.addf("%q: chunk at %d exceeds the file size %d", e.Name, e.ChunkOffset, file.Size)
+				endFile()
+			}
+		}
+	}
+	endFile()
+	return p.result(CheckEntries, fmt.Sprintf("%d entries", len(toc.Entries)))
+}
+
+func checkLandmark(r *estargz.Reader, toc *estargz.JTOC) Result {
+	pl, hasPrefetch := r.Lookup(estargz.PrefetchLandmark)
+	nl, hasNoPrefetch := r.Lookup(estargz.NoPrefetchLandmark)
+	var e *estargz.TOCEntry
+	switch {
+	case hasPrefetch && hasNoPrefetch:
+		return fail(CheckLandmark, fmt.Errorf("both prefetch and no-prefetch landmarks exist"))
+	case hasPrefetch:
+		e = pl
+	case hasNoPrefetch:
+		e = nl
+	case toc.PrefetchBoundary != nil:
+		return pass(CheckLandmark, fmt.Sprintf("no landmark; prefetchBoundary is %d", *toc.PrefetchBoundary))
+	default:
+		return fail(CheckLandmark, fmt.Errorf("neither prefetch nor no-prefetch landmark exists"))
+	}
+	if e.Type != "reg" || e.Size != 1 {
+		return fail(CheckLandmark, fmt.Errorf("landmark %q must be a reg of 1 byte (got %s of %d bytes)", e.Name, e.Type, e.Size))
+	}
+	fr, err := r.OpenFile(e.Name)
+	if err != nil {
+		return fail(CheckLandmark, fmt.Errorf("failed to open landmark %q: %w", e.Name, err))
+	}
+	b := make([]byte, 1)
+	if _, err := fr.ReadAt(b, 0); err != nil && err != io.EOF {
+		return fail(CheckLandmark, fmt.Errorf("failed to read landmark %q: %w", e.Name, err))
+	}
+	if b[0] != 0xf {
+		return fail(CheckLandmark, fmt.Errorf("contents of landmark %q are %#x; must be 0xf", e.Name, b[0]))
+	}
+	return pass(CheckLandmark, e.Name)
+}
+
+func checkChunkDigests(r *estargz.Reader, toc *estargz.JTOC, maxDetails int) Result {
+	v, err := r.Verifiers()
+	if err != nil {
+		return fail(CheckChunkDigests, err)
+	}
+	var (
+		p       = &problems{max: maxDetails}
+		checked = make(map[string]bool)
+		chunks  int
+	)
+	for _, e := range toc.Entries {
+		if e.Type != "reg" || e.Size == 0 || checked[e.Name] {
+			continue
+		}
+		checked[e.Name] = true
+		fr, err := r.OpenFile(e.Name)
+		if err != nil {
+			p.addf("%q: failed to open: %v", e.Name, err)
+			continue
+		}
+		for off := int64(0); off < fr.Size(); {
+			ce, ok := r.ChunkEntryForOffset(e.Name, off)
+			if !ok || ce.ChunkSize <= 0 {
+				p.addf("%q: chunk at %d isn't found", e.Name, off)
+				break
+			}
+			b := make([]byte, ce.ChunkSize)
+			if n, err := fr.ReadAt(b, ce.ChunkOffset); n != len(b) {
+				p.addf("%q: failed to read chunk at %d: %v", e.Name, ce.ChunkOffset, err)
+				break
+			}
+			cv, err := v.Verifier(ce)
+			if err != nil {
+				p.addf("%q: %v", e.Name, err)
+				break
+			}
+			if _, err := cv.Write(b); err != nil || !cv.Verified() {
+				p.addf("%q: contents of chunk at %d don't match %s", e.Name, ce.ChunkOffset, ce.ChunkDigest)
+			}
+			chunks++
+			off = ce.ChunkOffset + ce.ChunkSize
+		}
+	}
+	return p.result(CheckChunkDigests, fmt.Sprintf("%d chunks", chunks))
+}
+
+func pass(name, message string) Result {
+	return Result{Name: name, Passed: true, Message: message}
+}
+
+func fail(name string, err error) Result {
+	return Result{Name: name, Message: err.Error()}
+}
@@ -0,0 +1,212 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package conformance
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type zstdCompression struct {
+	*zstdchunked.Compressor
+	*zstdchunked.Decompressor
+}
+
+func buildBlob(t *testing.T, opts ...estargz.Option) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct{ name, contents string }{
+		{"a.txt", "hello"},
+		{"dir/", ""},
+		{"dir/b.txt", strings.Repeat("0123456789", 10)},
+	} {
+		h := &tar.Header{Name: f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.contents))}
+		if strings.HasSuffix(f.name, "/") {
+			h.Typeflag, h.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if _, err := io.WriteString(tw, f.contents); err != nil {
+			t.Fatalf("failed to write tar contents: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	opts = append([]estargz.Option{
+		estargz.WithCompression(&zstdCompression{&zstdchunked.Compressor{CompressionLevel: zstd.SpeedDefault}, &zstdchunked.Decompressor{}}),
+		estargz.WithChunkSize(16),
+	}, opts...)
+	blob, err := estargz.Build(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), opts...)
+	if err != nil {
+		t.Fatalf("failed to build blob: %v", err)
+	}
+	defer blob.Close()
+	b, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	return b
+}
+
+func resultOf(t *testing.T, rep *Report, name string) Result {
+	for _, res := range rep.Results {
+		if res.Name == name {
+			return res
+		}
+	}
+	t.Fatalf("result of %q not found", name)
+	return Result{}
+}
+
+func TestCheck(t *testing.T) {
+	b := buildBlob(t, estargz.WithSummary())
+	sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	rep := Check(sr)
+	if !rep.Passed() {
+		var out strings.Builder
+		rep.WriteText(&out)
+		t.Fatalf("valid blob must pass:\n%s", out.String())
+	}
+	if rep.Compression != "zstd" {
+		t.Errorf("compression = %q; want zstd", rep.Compression)
+	}
+	if len(rep.Results) != len(allChecks) {
+		t.Errorf("got %d results; want %d", len(rep.Results), len(allChecks))
+	}
+	if res := resultOf(t, rep, CheckTOCDigest); !res.Skipped {
+		t.Errorf("TOC digest check must be skipped without expected digest")
+	}
+
+	rep = Check(sr, WithTOCDigest(rep.TOCDigest))
+	if res := resultOf(t, rep, CheckTOCDigest); !res.Passed {
+		t.Errorf("TOC digest check must pass: %+v", res)
+	}
+	rep = Check(sr, WithTOCDigest(digest.FromString("dummy")))
+	if res := resultOf(t, rep, CheckTOCDigest); res.Passed || rep.Passed() {
+		t.Errorf("TOC digest check must fail: %+v", res)
+	}
+
+	// Blobs without landmarks record the prefetch boundary instead.
+	b = buildBlob(t, estargz.WithoutLandmarks())
+	rep = Check(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if res := resultOf(t, rep, CheckLandmark); !res.Passed {
+		t.Errorf("landmark check must pass with prefetch boundary: %+v", res)
+	}
+
+	rep = Check(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))-1))
+	if res := resultOf(t, rep, CheckFooter); res.Passed {
+		t.Errorf("truncated blob must fail footer check")
+	}
+	if res := resultOf(t, rep, CheckChunkDigests); !res.Skipped {
+		t.Errorf("checks after footer must be skipped: %+v", res)
+	}
+}
+
+func TestCheckEntries(t *testing.T) {
+	d := digest.FromString("dummy").String()
+	tests := []struct {
+		name    string
+		entries []*estargz.TOCEntry
+		want    []string
+	}{
+		{
+			name: "valid",
+			entries: []*estargz.TOCEntry{
+				{Name: "dir", Type: "dir"},
+				{Name: "dir/a", Type: "reg", Size: 10, Offset: 10, ChunkSize: 4, ChunkDigest: d},
+				{Name: "dir/a", Type: "chunk", Offset: 20, ChunkOffset: 4, ChunkDigest: d},
+				{Name: "dir/b", Type: "hardlink", LinkName: "dir/a"},
+				{Name: "empty", Type: "reg"},
+			},
+		},
+		{
+			name: "unknown_type",
+			entries: []*estargz.TOCEntry{
+				{Name: "a", Type: "socket"},
+			},
+			want: []string{"unknown type"},
+		},
+		{
+			name: "missing_fields",
+			entries: []*estargz.TOCEntry{
+				{Name: "a", Type: "reg", Size: 10},
+				{Name: "b", Type: "symlink"},
+			},
+			want: []string{"offset 0", "chunkDigest", "linkName"},
+		},
+		{
+			name: "broken_chunks",
+			entries: []*estargz.TOCEntry{
+				{Name: "a", Type: "reg", Size: 10, Offset: 10, ChunkSize: 4, ChunkDigest: d},
+				{Name: "b", Type: "chunk", Offset: 20, ChunkOffset: 4, ChunkDigest: d},
+				{Name: "c", Type: "reg", Size: 10, Offset: 30, ChunkSize: 4, ChunkDigest: d},
+				{Name: "c", Type: "chunk", Offset: 40, ChunkOffset: 5, ChunkDigest: d},
+			},
+			want: []string{"cover 4 bytes", "doesn't follow", "chunkOffset is 5"},
+		},
+		{
+			name: "offsets",
+			entries: []*estargz.TOCEntry{
+				{Name: "a", Type: "reg", Size: 10, Offset: 30, ChunkDigest: d},
+				{Name: "b", Type: "reg", Size: 10, Offset: 20, ChunkDigest: d},
+				{Name: "c", Type: "reg", Size: 10, Offset: 1000, ChunkDigest: d},
+			},
+			want: []string{"isn't after", "isn't before TOC"},
+		},
+		{
+			name: "hardlink_order",
+			entries: []*estargz.TOCEntry{
+				{Name: "b", Type: "hardlink", LinkName: "a"},
+				{Name: "a", Type: "reg"},
+			},
+			want: []string{"doesn't precede"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := checkEntries(&estargz.JTOC{Version: 1, Entries: tt.entries}, 100, defaultMaxDetails)
+			if len(tt.want) == 0 {
+				if !res.Passed {
+					t.Fatalf("must pass: %+v", res)
+				}
+				return
+			}
+			if res.Passed {
+				t.Fatalf("must fail")
+			}
+			all := strings.Join(res.Details, "\n")
+			for _, w := range tt.want {
+				if !strings.Contains(all, w) {
+					t.Errorf("problem %q isn't reported in:\n%s", w, all)
+				}
+			}
+			if len(res.Details) != len(tt.want) {
+				t.Errorf("got %d problems; want %d:\n%s", len(res.Details), len(tt.want), all)
+			}
+		})
+	}
+}
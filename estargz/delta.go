@@ -0,0 +1,206 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DeltaBase is the set of eStargz blobs of an older converted image whose compressed
+// chunks can be reused by Build of the layers of a newer version of the image. See
+// WithDeltaBase.
+type DeltaBase struct {
+	chunks map[string][]baseChunk // chunk digest -> chunks with the digest
+	files  map[string]string      // name -> digest of regular files
+}
+
+type baseChunk struct {
+	sr         *io.SectionReader
+	offset     int64
+	nextOffset int64
+	size       int64
+}
+
+// NewDeltaBase returns the base of delta conversion consisting of the blobs (e.g. all
+// layers of the older converted image). Only gzip-compressed blobs are supported.
+func NewDeltaBase(blobs ...*Reader) (*DeltaBase, error) {
+	b := &DeltaBase{
+		chunks: make(map[string][]baseChunk),
+		files:  make(map[string]string),
+	}
+	for i, r := range blobs {
+		switch r.Decompressor().(type) {
+		case *GzipDecompressor, *LegacyGzipDecompressor:
+		default:
+			return nil, fmt.Errorf("blob %d of the delta base isn't gzip-compressed: %T", i, r.Decompressor())
+		}
+		var encrypted bool
+		for _, e := range r.toc.Entries {
+			if e.Type == "reg" {
+				encrypted = e.Encryption != nil
+				if !encrypted {
+					b.files[e.Name] = e.Digest
+				}
+			}
+			if !e.isDataType() || e.ChunkSize <= 0 || e.ChunkDigest == "" || encrypted {
+				continue
+			}
+			b.chunks[e.ChunkDigest] = append(b.chunks[e.ChunkDigest], baseChunk{
+				sr:         r.sr,
+				offset:     e.Offset,
+				nextOffset: e.nextOffset,
+				size:       e.ChunkSize,
+			})
+		}
+	}
+	return b, nil
+}
+
+// compressedChunk returns the compressed bytes of the chunk of the digest and the size in
+// the base. The chunk can be reused only if a gzip member in the base contains exactly the
+// chunk. Chunks written by Writers with reusable chunks always meet this. Otherwise, only
+// chunks other than the last chunk of each file meet this because the last gzip member
+// of a file also contains the following tar headers.
+func (b *DeltaBase) compressedChunk(dgst string, size int64) ([]byte, bool) {
+	for _, c := range b.chunks[dgst] {
+		if c.size != size {
+			continue
+		}
+		if p, ok := c.member(dgst); ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// member returns the gzip member of the chunk if it contains exactly the chunk.
+func (c baseChunk) member(dgst string) ([]byte, bool) {
+	p := make([]byte, c.nextOffset-c.offset)
+	if _, err := c.sr.ReadAt(p, c.offset); err != nil && err != io.EOF {
+		return nil, false
+	}
+	br := bytes.NewReader(p)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	zr.Multistream(false) // br is left just after the member
+	d := digest.Canonical.Digester()
+	if n, err := io.Copy(d.Hash(), io.LimitReader(zr, c.size+1)); err != nil || n != c.size {
+		return nil, false
+	}
+	if d.Digest().String() != dgst {
+		return nil, false
+	}
+	return p[:len(p)-br.Len()], true
+}
+
+// DeltaReport is the result of delta conversion. See WithDeltaBase.
+type DeltaReport struct {
+	// Changed is the names of regular files in the blob whose contents differ from the
+	// files of the same names in the base, including files not in the base. This is
+	// sorted by name.
+	Changed []string
+
+	// ReusedChunks is the number of chunks copied from the base without compression.
+	ReusedChunks int
+
+	// ReusedSize is the total compressed size of the chunks copied from the base.
+	ReusedSize int64
+
+	// CompressedChunks is the number of chunks compressed by the conversion.
+	CompressedChunks int
+}
+
+// deltaConversion is the state of the delta conversion shared by Writers of a blob.
+type deltaConversion struct {
+	base *DeltaBase
+
+	mu     sync.Mutex
+	report DeltaReport
+}
+
+func (dc *deltaConversion) recordFile(name, dgst string) {
+	if name == PrefetchLandmark || name == NoPrefetchLandmark {
+		return
+	}
+	if org, ok := dc.base.files[name]; ok && org == dgst {
+		return
+	}
+	dc.mu.Lock()
+	dc.report.Changed = append(dc.report.Changed, name)
+	dc.mu.Unlock()
+}
+
+func (dc *deltaConversion) recordChunk(reusedSize int64, reused bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if reused {
+		dc.report.ReusedChunks++
+		dc.report.ReusedSize += reusedSize
+	} else {
+		dc.report.CompressedChunks++
+	}
+}
+
+func (dc *deltaConversion) result() DeltaReport {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	r := dc.report
+	r.Changed = append([]string(nil), r.Changed...)
+	sort.Strings(r.Changed)
+	return r
+}
+
+// WithDeltaBase option makes Build reuse compressed chunks of the base (the blobs of an
+// older converted image) whose contents are identical to chunks of the blob, instead of
+// compressing them again. This cuts the time of converting a new version of the image.
+// Chunks reused from a base written with reusable chunks are copied as-is, so a layer that
+// didn't change can result in the same blob as the base, which doesn't need to be uploaded
+// again. If report is non-nil, it is filled with the changed files and the reused chunks.
+//
+// The blob is written with reusable chunks (see WithReusableChunks) so that it can be the
+// base of later conversions. Only the default gzip compression is supported.
+func WithDeltaBase(base *DeltaBase, report *DeltaReport) Option {
+	return func(o *options) error {
+		if base == nil {
+			return fmt.Errorf("WithDeltaBase: base must be passed")
+		}
+		o.deltaBase = base
+		o.deltaReport = report
+		o.reusableChunks = true
+		return nil
+	}
+}
+
+// WithReusableChunks option makes Build end the gzip member of each chunk at the end of
+// the chunk so that all chunks of the blob can be reused by later delta conversions using
+// this blob as a base (see WithDeltaBase). This slightly increases the size of the blob.
+func WithReusableChunks() Option {
+	return func(o *options) error {
+		o.reusableChunks = true
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeltaConversion(t *testing.T) {
+	const chunkSize = 1000
+	var (
+		small   = strings.Repeat("a", 500)
+		oldBig  = strings.Repeat("x", chunkSize) + strings.Repeat("y", chunkSize) + strings.Repeat("z", chunkSize)
+		newBig  = strings.Repeat("x", chunkSize) + strings.Repeat("Y", chunkSize) + strings.Repeat("z", chunkSize)
+		oldTar  = tarOf(dir("d/"), file("d/small.txt", small), file("big.bin", oldBig), file("c.txt", "ccc"))
+		newTar  = tarOf(dir("d/"), file("d/small.txt", small), file("big.bin", newBig), file("c.txt", "CCC"), file("new.txt", "new"))
+		newFile = map[string]string{"d/small.txt": small, "big.bin": newBig, "c.txt": "CCC", "new.txt": "new"}
+	)
+	tests := []struct {
+		name     string
+		baseOpts []Option
+		want     DeltaReport
+	}{
+		{
+			name:     "reusable",
+			baseOpts: []Option{WithReusableChunks()},
+			want: DeltaReport{
+				Changed:          []string{"big.bin", "c.txt", "new.txt"},
+				ReusedChunks:     3, // "d/small.txt" and the first and the last chunks of "big.bin"
+				CompressedChunks: 3,
+			},
+		},
+		{
+			// The last chunk of each file shares the gzip member with the following headers.
+			name: "not_reusable",
+			want: DeltaReport{
+				Changed:          []string{"big.bin", "c.txt", "new.txt"},
+				ReusedChunks:     1, // the first chunk of "big.bin"
+				CompressedChunks: 5,
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			base := buildBlob(t, oldTar, append(tt.baseOpts, WithChunkSize(chunkSize), WithoutLandmarks())...)
+			baseR, err := Open(io.NewSectionReader(bytes.NewReader(base), 0, int64(len(base))))
+			if err != nil {
+				t.Fatalf("failed to open base: %v", err)
+			}
+			db, err := NewDeltaBase(baseR)
+			if err != nil {
+				t.Fatalf("failed to create delta base: %v", err)
+			}
+			var report DeltaReport
+			rc, err := Build(buildTar(t, newTar, ""), WithChunkSize(chunkSize), WithoutLandmarks(), WithDeltaBase(db, &report))
+			if err != nil {
+				t.Fatalf("failed to build with delta base: %v", err)
+			}
+			defer rc.Close()
+			blob, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+			if report.ReusedSize <= 0 {
+				t.Errorf("reused size must be recorded: %+v", report)
+			}
+			report.ReusedSize = 0
+			if !reflect.DeepEqual(report, tt.want) {
+				t.Errorf("report = %+v; want %+v", report, tt.want)
+			}
+
+			sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+			r, err := Open(sr)
+			if err != nil {
+				t.Fatalf("failed to open blob: %v", err)
+			}
+			for name, want := range newFile {
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got, err := io.ReadAll(io.NewSectionReader(fr, 0, fr.Size()))
+				if err != nil {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("unexpected contents of %q", name)
+				}
+			}
+			if _, err := r.VerifyTOC(rc.TOCDigest()); err != nil {
+				t.Errorf("failed to verify TOC: %v", err)
+			}
+			verifyTarHeaders(t, r)
+			plain, err := Build(buildTar(t, newTar, ""), WithChunkSize(chunkSize), WithoutLandmarks(), WithReusableChunks())
+			if err != nil {
+				t.Fatalf("failed to build stargz: %v", err)
+			}
+			defer plain.Close()
+			if _, err := io.Copy(io.Discard, plain); err != nil {
+				t.Fatalf("failed to read stargz: %v", err)
+			}
+			if rc.DiffID() != plain.DiffID() {
+				t.Errorf("DiffID = %v; want %v", rc.DiffID(), plain.DiffID())
+			}
+
+			// The blob of an unchanged layer is identical to the base.
+			db, err = NewDeltaBase(r)
+			if err != nil {
+				t.Fatalf("failed to create delta base: %v", err)
+			}
+			report = DeltaReport{}
+			again := buildBlob(t, newTar, WithChunkSize(chunkSize), WithoutLandmarks(), WithDeltaBase(db, &report))
+			if !bytes.Equal(again, blob) {
+				t.Errorf("blob of the unchanged layer must be identical to the base")
+			}
+			if len(report.Changed) != 0 || report.CompressedChunks != 0 {
+				t.Errorf("nothing must be changed or compressed: %+v", report)
+			}
+		})
+	}
+}
+
+func buildBlob(t *testing.T, ents []tarEntry, opts ...Option) []byte {
+	rc, err := Build(buildTar(t, ents, ""), opts...)
+	if err != nil {
+		t.Fatalf("failed to build stargz: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read stargz: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// EncryptionAlgorithmAES256CTR is the algorithm of files encrypted by Build.
+const EncryptionAlgorithmAES256CTR = "AES-256-CTR"
+
+// EncryptionKeySize is the size of keys passed to WithPrioritizedFilesEncryption.
+const EncryptionKeySize = 32
+
+// KeyID returns the ID of the key recorded in the TOC. This is the digest of the key.
+func KeyID(key []byte) string {
+	return digest.FromBytes(key).String()
+}
+
+// WithPrioritizedFilesEncryption option makes Build encrypt the payloads of the
+// prioritized files specified by WithPrioritizedFiles with the key (AES-256-CTR) while
+// leaving other files plain. Sensitive files needed on startup (e.g. configs and models)
+// can be protected while the rest of the layer is lazily pulled without decryption
+// overhead. Headers of files, the TOC and the digests of chunks (that are calculated
+// over the encrypted payloads) aren't encrypted. Readers need the key (see
+// WithDecryptionKeys) to read the encrypted files.
+//
+// Note that the DiffID of the layer is calculated over the encrypted payloads so
+// unpacking the layer without this package results in encrypted files.
+func WithPrioritizedFilesEncryption(key []byte) Option {
+	return func(o *options) error {
+		if len(key) != EncryptionKeySize {
+			return fmt.Errorf("encryption key must be %d bytes but %d", EncryptionKeySize, len(key))
+		}
+		o.encryptionKey = key
+		return nil
+	}
+}
+
+// WithDecryptionKeys option specifies the keys used for decrypting files encrypted by
+// WithPrioritizedFilesEncryption. Encrypted files can't be opened without their keys.
+func WithDecryptionKeys(keys ...[]byte) OpenOption {
+	return func(o *openOpts) error {
+		if o.decryptionKeys == nil {
+			o.decryptionKeys = make(map[string][]byte)
+		}
+		for _, k := range keys {
+			o.decryptionKeys[KeyID(k)] = k
+		}
+		return nil
+	}
+}
+
+// DecryptAt decrypts p in place, which is the contents of the file encrypted as
+// described by enc, at offset off of the file.
+func DecryptAt(enc *Encryption, key []byte, p []byte, off int64) error {
+	if enc.Algorithm != EncryptionAlgorithmAES256CTR {
+		return fmt.Errorf("unsupported encryption algorithm %q", enc.Algorithm)
+	}
+	if id := KeyID(key); id != enc.KeyID {
+		return fmt.Errorf("key %q doesn't match %q", id, enc.KeyID)
+	}
+	s, err := newCTRStream(key, enc.IV, off)
+	if err != nil {
+		return err
+	}
+	s.XORKeyStream(p, p)
+	return nil
+}
+
+// newCTRStream returns the key stream starting from offset off of the file.
+func newCTRStream(key, iv []byte, off int64) (cipher.Stream, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("invalid offset %d", off)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid IV size %d", len(iv))
+	}
+	// Advance the counter (big endian) by the number of blocks preceding off.
+	ctr := append([]byte(nil), iv...)
+	carry := uint64(off) / uint64(block.BlockSize())
+	for i := len(ctr) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(ctr[i]) + carry&0xff
+		ctr[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	s := cipher.NewCTR(block, ctr)
+	if skip := int(off % int64(block.BlockSize())); skip > 0 {
+		var discard [aes.BlockSize]byte
+		s.XORKeyStream(discard[:skip], discard[:skip])
+	}
+	return s, nil
+}
+
+// encryptPrioritizedEntries encrypts payloads of the regular files preceding the prefetch
+// landmark. This returns the encryption of each file keyed by the name.
+func encryptPrioritizedEntries(entries []*entry, key []byte, tf *tempFiles) (map[string]*Encryption, error) {
+	encs := make(map[string]*Encryption)
+	landmark := false
+	for _, e := range entries {
+		name := cleanEntryName(e.header.Name)
+		if name == PrefetchLandmark {
+			landmark = true
+			break
+		} else if name == NoPrefetchLandmark {
+			break
+		}
+		if (e.header.Typeflag != tar.TypeReg && e.header.Typeflag != tar.TypeRegA) || e.header.Size == 0 {
+			continue
+		}
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return nil, err
+		}
+		s, err := newCTRStream(key, iv, 0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := e.payload.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		f, err := tf.TempFile("", "encrypted")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(&cipher.StreamWriter{S: s, W: f}, e.payload); err != nil {
+			return nil, fmt.Errorf("failed to encrypt %q: %w", name, err)
+		}
+		sr, err := fileSectionReader(f)
+		if err != nil {
+			return nil, err
+		}
+		e.payload = sr
+		encs[name] = &Encryption{
+			Algorithm: EncryptionAlgorithmAES256CTR,
+			KeyID:     KeyID(key),
+			IV:        iv,
+		}
+	}
+	if !landmark || len(encs) == 0 {
+		return nil, fmt.Errorf("no prioritized files to encrypt")
+	}
+	return encs, nil
+}
+
+// decryptingReaderAt decrypts the contents of the encrypted file read from r.
+type decryptingReaderAt struct {
+	r   io.ReaderAt
+	enc *Encryption
+	key []byte
+}
+
+func (d *decryptingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.r.ReadAt(p, off)
+	if dErr := DecryptAt(d.enc, d.key, p[:n], off); dErr != nil {
+		return 0, dErr
+	}
+	return n, err
+}
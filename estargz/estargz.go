@@ -26,6 +26,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -58,12 +59,18 @@ type Reader struct {
 	chunks map[string][]*TOCEntry
 
 	decompressor Decompressor
+
+	// decryptionKeys are the keys of encrypted files, keyed by the ID.
+	decryptionKeys map[string][]byte
 }
 
 type openOpts struct {
-	tocOffset     int64
-	decompressors []Decompressor
-	telemetry     *Telemetry
+	tocOffset      int64
+	decompressors  []Decompressor
+	telemetry      *Telemetry
+	pathPolicy     PathPolicy
+	ctx            context.Context
+	decryptionKeys map[string][]byte
 }
 
 // OpenOption is an option used during opening the layer
@@ -94,6 +101,25 @@ func WithTelemetry(telemetry *Telemetry) OpenOption {
 	}
 }
 
+// WithOpenPathPolicy option specifies how to deal with entry names in the TOC that
+// aren't valid UTF-8 or contain NUL or control characters. Default is PathPolicyAllow.
+func WithOpenPathPolicy(policy PathPolicy) OpenOption {
+	return func(o *openOpts) error {
+		o.pathPolicy = policy
+		return nil
+	}
+}
+
+// WithOpenContext option specifies a context that can be used for canceling Open.
+// The context is used only while reading and parsing the TOC; the returned Reader
+// doesn't depend on it.
+func WithOpenContext(ctx context.Context) OpenOption {
+	return func(o *openOpts) error {
+		o.ctx = ctx
+		return nil
+	}
+}
+
 // MeasureLatencyHook is a func which takes start time and records the diff
 type MeasureLatencyHook func(time.Time)
 
@@ -116,6 +142,9 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 			return nil, err
 		}
 	}
+	if opts.ctx == nil {
+		opts.ctx = context.Background()
+	}
 
 	gzipCompressors := []Decompressor{new(GzipDecompressor), new(LegacyGzipDecompressor)}
 	decompressors := append(gzipCompressors, opts.decompressors...)
@@ -131,8 +160,8 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 
 	start := time.Now() // before getting layer footer
 	footer := make([]byte, fetchSize)
-	if _, err := sr.ReadAt(footer, sr.Size()-fetchSize); err != nil {
-		return nil, fmt.Errorf("error reading footer: %v", err)
+	if _, err := (&contextReaderAt{opts.ctx, sr}).ReadAt(footer, sr.Size()-fetchSize); err != nil {
+		return nil, fmt.Errorf("error reading footer: %w", err)
 	}
 	if opts.telemetry != nil && opts.telemetry.GetFooterLatency != nil {
 		opts.telemetry.GetFooterLatency(start)
@@ -153,6 +182,10 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 		if tocSize <= 0 {
 			tocSize = sr.Size() - tocOffset - fSize
 		}
+		if err := CheckRange(tocOffset, tocSize, sr.Size()); err != nil {
+			allErr = append(allErr, fmt.Errorf("invalid TOC location: %w", err))
+			continue
+		}
 		if tocSize < int64(len(maybeTocBytes)) {
 			maybeTocBytes = maybeTocBytes[:tocSize]
 		}
@@ -161,14 +194,24 @@ func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
 			found = true
 			break
 		}
+		if cErr := opts.ctx.Err(); cErr != nil {
+			return nil, cErr
+		}
 		allErr = append(allErr, err)
 	}
 	if !found {
 		return nil, errorutil.Aggregate(allErr)
 	}
+	if err := applyPathPolicy(r.toc, opts.pathPolicy); err != nil {
+		return nil, err
+	}
+	if err := opts.ctx.Err(); err != nil {
+		return nil, err
+	}
 	if err := r.initFields(); err != nil {
-		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
+		return nil, fmt.Errorf("failed to initialize fields of entries: %w", err)
 	}
+	r.decryptionKeys = opts.decryptionKeys
 	return r, nil
 }
 
@@ -240,12 +283,27 @@ func (r *Reader) initFields() error {
 			r.m[ent.Name] = ent
 		}
 		if ent.Type == "reg" && ent.ChunkSize > 0 && ent.ChunkSize < ent.Size {
-			r.chunks[ent.Name] = make([]*TOCEntry, 0, ent.Size/ent.ChunkSize+1)
+			// The number of chunks is bounded by the number of entries. Don't trust
+			// the sizes in the TOC for allocation.
+			n := ent.Size/ent.ChunkSize + 1
+			if max := int64(len(r.toc.Entries)); n > max {
+				n = max
+			}
+			r.chunks[ent.Name] = make([]*TOCEntry, 0, n)
 			r.chunks[ent.Name] = append(r.chunks[ent.Name], ent)
 		}
 		if ent.ChunkSize == 0 && ent.Size != 0 {
 			ent.ChunkSize = ent.Size
 		}
+		var fileSize int64
+		if ent.Type == "reg" {
+			fileSize = ent.Size
+		} else if ent.Type == "chunk" && lastRegEnt != nil {
+			fileSize = lastRegEnt.Size
+		}
+		if err := ent.CheckBounds(r.sr.Size(), fileSize); err != nil {
+			return err
+		}
 	}
 
 	// Populate children, add implicit directories:
@@ -343,6 +401,48 @@ func (r *Reader) TOCDigest() digest.Digest {
 	return r.tocDigest
 }
 
+// Clone returns a reader sharing the parsed TOC with r but reading file contents from sr.
+// sr must have the same contents as the blob of r. This doesn't parse the TOC again.
+func (r *Reader) Clone(sr *io.SectionReader) *Reader {
+	nr := *r
+	nr.sr = sr
+	return &nr
+}
+
+// Decompressor returns the decompressor used for reading the blob.
+func (r *Reader) Decompressor() Decompressor {
+	return r.decompressor
+}
+
+// PrefetchBoundary returns the offset where the prioritized files end, which is recorded
+// in the TOC of blobs built without landmark files. ok is false if the TOC doesn't record it.
+func (r *Reader) PrefetchBoundary() (offset int64, ok bool) {
+	if r.toc.PrefetchBoundary == nil {
+		return 0, false
+	}
+	return *r.toc.PrefetchBoundary, true
+}
+
+// Summary returns the statistics recorded in the TOC. ok is false if the TOC doesn't
+// record it. Use VerifySummary for checking it against the entries.
+func (r *Reader) Summary() (s TOCSummary, ok bool) {
+	if r.toc.Summary == nil {
+		return TOCSummary{}, false
+	}
+	return *r.toc.Summary, true
+}
+
+// VerifySummary checks that the statistics recorded in the TOC match the entries.
+func (r *Reader) VerifySummary() error {
+	if r.toc.Summary == nil {
+		return fmt.Errorf("summary isn't recorded in the TOC")
+	}
+	if got := ComputeSummary(r.toc); got != *r.toc.Summary {
+		return fmt.Errorf("summary %+v doesn't match the entries (%+v)", *r.toc.Summary, got)
+	}
+	return nil
+}
+
 // VerifyTOC checks that the TOC JSON in the passed blob matches the
 // passed digests and that the TOC JSON contains digests for all chunks
 // contained in the blob. If the verification succceeds, this function
@@ -485,9 +585,21 @@ func (r *Reader) Lookup(path string) (e *TOCEntry, ok bool) {
 }
 
 // OpenFile returns the reader of the specified file payload.
+// Encrypted files are decrypted with the keys passed by WithDecryptionKeys.
 //
 // Name must be absolute path or one that is relative to root.
 func (r *Reader) OpenFile(name string) (*io.SectionReader, error) {
+	return r.openFile(name, true)
+}
+
+// OpenRawFile is the same as OpenFile but returns the payload as stored in the blob,
+// without decrypting encrypted files. Contents read from this reader can be verified
+// against digests of chunks.
+func (r *Reader) OpenRawFile(name string) (*io.SectionReader, error) {
+	return r.openFile(name, false)
+}
+
+func (r *Reader) openFile(name string, decrypt bool) (*io.SectionReader, error) {
 	name = cleanEntryName(name)
 	ent, ok := r.Lookup(name)
 	if !ok {
@@ -510,6 +622,17 @@ func (r *Reader) OpenFile(name string) (*io.SectionReader, error) {
 		size: ent.Size,
 		ents: r.getChunks(ent),
 	}
+	if enc := ent.Encryption; enc != nil && decrypt {
+		key, ok := r.decryptionKeys[enc.KeyID]
+		if !ok {
+			return nil, &os.PathError{
+				Path: name,
+				Op:   "OpenFile",
+				Err:  fmt.Errorf("no key to decrypt the file (%q)", enc.KeyID),
+			}
+		}
+		return io.NewSectionReader(&decryptingReaderAt{fr, enc, key}, 0, fr.size), nil
+	}
 	return io.NewSectionReader(fr, 0, fr.size), nil
 }
 
@@ -570,12 +693,12 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 
 	br := bufio.NewReaderSize(sr, bufSize)
 	if _, err := br.Peek(bufSize); err != nil {
-		return 0, fmt.Errorf("fileReader.ReadAt.peek: %v", err)
+		return 0, fmt.Errorf("fileReader.ReadAt.peek: %w", err)
 	}
 
 	dr, err := fr.r.decompressor.Reader(br)
 	if err != nil {
-		return 0, fmt.Errorf("fileReader.ReadAt.decompressor.Reader: %v", err)
+		return 0, fmt.Errorf("fileReader.ReadAt.decompressor.Reader: %w", err)
 	}
 	defer dr.Close()
 	if n, err := io.CopyN(io.Discard, dr, off); n != off || err != nil {
@@ -604,6 +727,22 @@ type Writer struct {
 	// stream before a new gzip stream is started.
 	// Zero means to use a default, currently 4 MiB.
 	ChunkSize int
+
+	// Chunker optionally decides the boundaries of chunks of regular files instead of
+	// splitting them every ChunkSize bytes.
+	Chunker Chunker
+
+	// Alignment optionally aligns the offsets of the chunks of regular files that are
+	// not smaller than Alignment, and of the landmark files, to multiples of Alignment
+	// by inserting padding before them. This lets range requests of the chunks and the
+	// prioritized files line up with boundaries of caches on the delivery infrastructure
+	// (e.g. CDN). The compressor must implement Padder. Zero disables alignment.
+	Alignment int64
+
+	reusableChunks bool             // end the compression stream at the end of each chunk
+	delta          *deltaConversion // reuse compressed chunks of the base if non-nil
+	rawChunk       bool             // the compressed chunk is being copied from the base
+	chunkBuf       []byte
 }
 
 // currentCompressionWriter writes to the current w.gz field, which can
@@ -615,6 +754,9 @@ type currentCompressionWriter struct{ w *Writer }
 
 func (ccw currentCompressionWriter) Write(p []byte) (int, error) {
 	ccw.w.diffHash.Write(p)
+	if ccw.w.rawChunk {
+		return len(p), nil // the compressed bytes are written by the caller
+	}
 	if ccw.w.gz == nil {
 		if err := ccw.w.condOpenGz(); err != nil {
 			return 0, err
@@ -649,6 +791,184 @@ func Unpack(sr *io.SectionReader, c Decompressor) (io.ReadCloser, error) {
 	return c.Reader(io.LimitReader(sr, blobPayloadSize))
 }
 
+// VerifyTarStructure reads the passed blob from the head as a stream and checks that
+// the structure of the tar archive (names, types and sizes of entries) matches to
+// the TOC of this reader. This returns an error on the first divergence so corrupted
+// blobs can be detected without waiting for reading all of it.
+func (r *Reader) VerifyTarStructure(sr *io.SectionReader) error {
+	rc, err := Unpack(sr, r.decompressor)
+	if errors.Is(err, io.EOF) {
+		// The blob has no payload other than TOC (e.g. an empty layer).
+		rc, err = io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decompress blob: %w", err)
+	}
+	defer rc.Close()
+
+	var (
+		tr         = tar.NewReader(rc)
+		idx        int
+		lastOffset int64
+	)
+	for _, ent := range r.toc.Entries {
+		if ent.Offset != 0 {
+			if ent.Offset < lastOffset {
+				return fmt.Errorf("offset of entry %q (%d) is smaller than the previous entry (%d)",
+					ent.Name, ent.Offset, lastOffset)
+			}
+			lastOffset = ent.Offset
+		}
+	}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read tar header after %d entries: %w", idx, err)
+		}
+		name := cleanEntryName(h.Name)
+		if name == TOCTarName {
+			continue
+		}
+		// Chunk entries don't appear in the tar archive.
+		for idx < len(r.toc.Entries) && r.toc.Entries[idx].Type == "chunk" {
+			idx++
+		}
+		if idx >= len(r.toc.Entries) {
+			return fmt.Errorf("tar entry %q doesn't exist in TOC", name)
+		}
+		ent := r.toc.Entries[idx]
+		idx++
+		if err := checkTarHeader(h, ent); err != nil {
+			return err
+		}
+	}
+	for ; idx < len(r.toc.Entries); idx++ {
+		if ent := r.toc.Entries[idx]; ent.Type != "chunk" {
+			return fmt.Errorf("TOC entry %q doesn't exist in tar", ent.Name)
+		}
+	}
+	return nil
+}
+
+func tocEntryTypeOf(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeReg, tar.TypeRegA:
+		return "reg"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	}
+	return fmt.Sprintf("unknown(%q)", typeflag)
+}
+
+// TarHeaderVerifier checks the tar headers of a blob against the TOC one regular file
+// at a time so that the check can be done along with fetching the payloads. Unlike
+// VerifyTarStructure, this doesn't need to read the blob from the head.
+type TarHeaderVerifier struct {
+	r     *Reader
+	spans map[int64]*tarHeaderSpan
+}
+
+// tarHeaderSpan is the range of the blob preceding the payload of a regular file.
+type tarHeaderSpan struct {
+	// start is the offset of the stream holding the last chunk of the previous payload.
+	start int64
+
+	// skip is the size of the rest of the previous payload and its padding in the
+	// decompressed stream.
+	skip int64
+
+	// entries are the TOC entries whose tar headers are in this span. The last one is
+	// the regular file owning the payload.
+	entries []*TOCEntry
+}
+
+// NewTarHeaderVerifier returns a TarHeaderVerifier of the blob of this reader.
+func (r *Reader) NewTarHeaderVerifier() *TarHeaderVerifier {
+	v := &TarHeaderVerifier{r: r, spans: make(map[int64]*tarHeaderSpan)}
+	var (
+		cur  = &tarHeaderSpan{}
+		size int64
+	)
+	for _, ent := range r.toc.Entries {
+		switch {
+		case ent.Type == "reg" && ent.Size > 0:
+			cur.entries = append(cur.entries, ent)
+			v.spans[ent.Offset] = cur
+			cur, size = &tarHeaderSpan{}, ent.Size
+		case ent.Type != "chunk":
+			cur.entries = append(cur.entries, ent)
+			continue
+		}
+		// The headers following a payload are written after its last chunk and padding.
+		cur.start = ent.Offset
+		cur.skip = size - ent.ChunkOffset + (tarBlockSize-size%tarBlockSize)%tarBlockSize
+	}
+	return v
+}
+
+// Verify checks the tar headers preceding the payload of the regular file starting at
+// the offset of the blob. Names, types and sizes of the headers must match to the TOC
+// entries and the last header must end right at the offset. Headers of entries following
+// the last payload of the blob aren't checked by this.
+func (v *TarHeaderVerifier) Verify(offset int64) error {
+	span, ok := v.spans[offset]
+	if !ok {
+		return fmt.Errorf("no regular file starts at offset %d", offset)
+	}
+	dr, err := v.r.decompressor.Reader(io.NewSectionReader(v.r.sr, span.start, offset-span.start))
+	if err != nil {
+		return fmt.Errorf("failed to decompress tar headers at %d: %w", span.start, err)
+	}
+	defer dr.Close()
+	if _, err := io.CopyN(io.Discard, dr, span.skip); err != nil {
+		return fmt.Errorf("failed to skip %d bytes preceding tar headers at %d: %w", span.skip, span.start, err)
+	}
+	tr := tar.NewReader(dr)
+	for _, ent := range span.entries {
+		h, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("failed to read tar header of TOC entry %q: %w", ent.Name, err)
+		}
+		if err := checkTarHeader(h, ent); err != nil {
+			return err
+		}
+	}
+	if n, err := io.Copy(io.Discard, dr); err != nil || n > 0 {
+		last := span.entries[len(span.entries)-1]
+		return fmt.Errorf("tar header of %q doesn't end at its offset %d", last.Name, offset)
+	}
+	return nil
+}
+
+// tarBlockSize is the size of blocks of tar archives, to which payloads are padded.
+const tarBlockSize = 512
+
+func checkTarHeader(h *tar.Header, ent *TOCEntry) error {
+	name := cleanEntryName(h.Name)
+	if ent.Name != name {
+		return fmt.Errorf("tar entry %q doesn't match to TOC entry %q", name, ent.Name)
+	}
+	if typ := tocEntryTypeOf(h.Typeflag); typ != ent.Type {
+		return fmt.Errorf("type of tar entry %q is %q but TOC records %q", name, typ, ent.Type)
+	}
+	if ent.Type == "reg" && ent.Size != h.Size {
+		return fmt.Errorf("size of tar entry %q is %d but TOC records %d", name, h.Size, ent.Size)
+	}
+	return nil
+}
+
 // NewWriter returns a new stargz writer (gzip-based) writing to w.
 //
 // The writer must be closed to write its trailing table of contents.
@@ -692,6 +1012,8 @@ func (w *Writer) Close() (digest.Digest, error) {
 		return "", err
 	}
 
+	recordHardlinks(w.toc)
+
 	// Write the TOC index and footer.
 	tocDigest, err := w.compressor.WriteTOCAndFooter(w.cw, w.cw.n, w.toc, w.diffHash)
 	if err != nil {
@@ -704,6 +1026,32 @@ func (w *Writer) Close() (digest.Digest, error) {
 	return tocDigest, nil
 }
 
+// recordHardlinks records the names of the hardlinks to each regular file in the TOC to
+// the Hardlinks field of the file.
+func recordHardlinks(toc *JTOC) {
+	files := make(map[string]*TOCEntry) // name -> regular file referred by the name
+	for _, e := range toc.Entries {
+		name := cleanEntryName(e.Name)
+		switch e.Type {
+		case "reg":
+			e.Hardlinks = nil
+			files[name] = e
+		case "hardlink":
+			org, ok := files[cleanEntryName(e.LinkName)]
+			if !ok {
+				delete(files, name)
+				continue
+			}
+			org.Hardlinks = append(org.Hardlinks, e.Name)
+			files[name] = org // hardlinks to this hardlink refer to the same file
+		case "chunk":
+			// chunks of the regular file
+		default:
+			delete(files, name)
+		}
+	}
+}
+
 func (w *Writer) closeGz() error {
 	if w.closed {
 		return errors.New("write on closed Writer")
@@ -733,6 +1081,26 @@ func (w *Writer) nameIfChanged(mp *map[int]string, id int, name string) string {
 	return name
 }
 
+// align closes the current compression stream and writes padding so that the next
+// stream starts at a multiple of w.Alignment.
+func (w *Writer) align() error {
+	if err := w.closeGz(); err != nil {
+		return err
+	}
+	p, ok := w.compressor.(Padder)
+	if !ok {
+		return fmt.Errorf("compressor %T doesn't support alignment", w.compressor)
+	}
+	size := (w.Alignment - w.cw.n%w.Alignment) % w.Alignment
+	if size == 0 {
+		return nil
+	}
+	for size < p.MinPaddingSize() {
+		size += w.Alignment
+	}
+	return p.WritePadding(w.cw, size)
+}
+
 func (w *Writer) condOpenGz() (err error) {
 	if w.gz == nil {
 		w.gz, err = w.compressor.Writer(w.cw)
@@ -881,15 +1249,35 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		if h.Typeflag == tar.TypeReg && ent.Size > 0 {
 			var written int64
 			totalSize := ent.Size // save it before we destroy ent
-			tee := io.TeeReader(tr, payloadDigest.Hash())
+			var tee io.Reader = io.TeeReader(tr, payloadDigest.Hash())
+			var br *bufio.Reader
+			if w.Chunker != nil {
+				br = bufio.NewReaderSize(tee, w.Chunker.MaxChunkSize())
+				tee = br
+			}
+			name := cleanEntryName(h.Name)
+			aligned := w.Alignment > 0 && (totalSize >= w.Alignment || name == PrefetchLandmark || name == NoPrefetchLandmark)
 			for written < totalSize {
 				if err := w.closeGz(); err != nil {
 					return err
 				}
+				if aligned {
+					if err := w.align(); err != nil {
+						return err
+					}
+				}
 
 				chunkSize := int64(w.chunkSize())
 				remain := totalSize - written
-				if remain < chunkSize {
+				if br != nil {
+					chunkSize, err = nextChunkSize(w.Chunker, br, remain)
+					if err != nil {
+						return fmt.Errorf("error chunking %q: %w", h.Name, err)
+					}
+					if chunkSize < remain {
+						ent.ChunkSize = chunkSize
+					}
+				} else if remain < chunkSize {
 					chunkSize = remain
 				} else {
 					ent.ChunkSize = chunkSize
@@ -898,10 +1286,6 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 				ent.ChunkOffset = written
 				chunkDigest := digest.Canonical.Digester()
 
-				if err := w.condOpenGz(); err != nil {
-					return err
-				}
-
 				teeChunk := io.TeeReader(tee, chunkDigest.Hash())
 				var out io.Writer
 				if tw != nil {
@@ -909,8 +1293,23 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 				} else {
 					out = dst
 				}
-				if _, err := io.CopyN(out, teeChunk, chunkSize); err != nil {
-					return fmt.Errorf("error copying %q: %v", h.Name, err)
+				if w.delta != nil {
+					if err := w.appendDeltaChunk(out, teeChunk, chunkSize, chunkDigest); err != nil {
+						return fmt.Errorf("error copying %q: %v", h.Name, err)
+					}
+				} else {
+					if err := w.condOpenGz(); err != nil {
+						return err
+					}
+					if _, err := io.CopyN(out, teeChunk, chunkSize); err != nil {
+						return fmt.Errorf("error copying %q: %v", h.Name, err)
+					}
+				}
+				if w.reusableChunks {
+					// The following tar headers go to the next stream.
+					if err := w.closeGz(); err != nil {
+						return err
+					}
 				}
 				ent.ChunkDigest = chunkDigest.Digest().String()
 				w.toc.Entries = append(w.toc.Entries, ent)
@@ -925,6 +1324,9 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 		}
 		if payloadDigest != nil {
 			regFileEntry.Digest = payloadDigest.Digest().String()
+			if w.delta != nil {
+				w.delta.recordFile(cleanEntryName(h.Name), regFileEntry.Digest)
+			}
 		}
 		if tw != nil {
 			if err := tw.Flush(); err != nil {
@@ -940,6 +1342,37 @@ func (w *Writer) appendTar(r io.Reader, lossless bool) error {
 	return err
 }
 
+// appendDeltaChunk writes the chunk of size bytes read from r to out. If the base of the
+// delta conversion has the same chunk, its compressed bytes are copied to the blob instead
+// of compressing the chunk.
+func (w *Writer) appendDeltaChunk(out io.Writer, r io.Reader, size int64, chunkDigest digest.Digester) error {
+	if int64(cap(w.chunkBuf)) < size {
+		w.chunkBuf = make([]byte, size)
+	}
+	p := w.chunkBuf[:size]
+	if _, err := io.ReadFull(r, p); err != nil {
+		return err
+	}
+	compressed, ok := w.delta.base.compressedChunk(chunkDigest.Digest().String(), size)
+	w.delta.recordChunk(int64(len(compressed)), ok)
+	if !ok {
+		if err := w.condOpenGz(); err != nil {
+			return err
+		}
+		_, err := out.Write(p)
+		return err
+	}
+	// The stream was closed by the caller so the chunk starts a new stream.
+	w.rawChunk = true
+	_, err := out.Write(p) // updates DiffID and the state of the tar writer
+	w.rawChunk = false
+	if err != nil {
+		return err
+	}
+	_, err = w.cw.Write(compressed)
+	return err
+}
+
 // DiffID returns the SHA-256 of the uncompressed tar bytes.
 // It is only valid to call DiffID after Close.
 func (w *Writer) DiffID() string {
@@ -958,7 +1391,7 @@ func maxFooterSize(blobSize int64, decompressors ...Decompressor) (res int64) {
 func parseTOC(d Decompressor, sr *io.SectionReader, tocOff, tocSize int64, tocBytes []byte, opts openOpts) (*Reader, error) {
 	if len(tocBytes) > 0 {
 		start := time.Now()
-		toc, tocDgst, err := d.ParseTOC(bytes.NewReader(tocBytes))
+		toc, tocDgst, err := d.ParseTOC(&contextReader{opts.ctx, bytes.NewReader(tocBytes)})
 		if err == nil {
 			if opts.telemetry != nil && opts.telemetry.DeserializeTocLatency != nil {
 				opts.telemetry.DeserializeTocLatency(start)
@@ -974,14 +1407,14 @@ func parseTOC(d Decompressor, sr *io.SectionReader, tocOff, tocSize int64, tocBy
 
 	start := time.Now()
 	tocBytes = make([]byte, tocSize)
-	if _, err := sr.ReadAt(tocBytes, tocOff); err != nil {
-		return nil, fmt.Errorf("error reading %d byte TOC targz: %v", len(tocBytes), err)
+	if _, err := (&contextReaderAt{opts.ctx, sr}).ReadAt(tocBytes, tocOff); err != nil {
+		return nil, fmt.Errorf("error reading %d byte TOC targz: %w", len(tocBytes), err)
 	}
 	if opts.telemetry != nil && opts.telemetry.GetTocLatency != nil {
 		opts.telemetry.GetTocLatency(start)
 	}
 	start = time.Now()
-	toc, tocDgst, err := d.ParseTOC(bytes.NewReader(tocBytes))
+	toc, tocDgst, err := d.ParseTOC(&contextReader{opts.ctx, bytes.NewReader(tocBytes)})
 	if err != nil {
 		return nil, err
 	}
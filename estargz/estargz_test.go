@@ -22,7 +22,12 @@
 
 package estargz
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
 
 // Tests *Reader.ChunkEntryForOffset about offset and size calculation.
 func TestChunkEntryForOffset(t *testing.T) {
@@ -123,3 +128,70 @@ func regularFileReader(name string, size int64, chunkSize int64) (*TOCEntry, *Re
 		chunks: map[string][]*TOCEntry{name: chunks},
 	}
 }
+
+func TestTarHeaderVerifier(t *testing.T) {
+	const chunkSize = 1000
+	ents := tarOf(
+		dir("d/"),
+		file("d/small.txt", "small"),
+		file("d/empty.txt", ""),
+		symlink("d/link", "small.txt"),
+		file("big.bin", strings.Repeat("x", chunkSize*3+10)),
+		dir("e/"),
+		file("e/tail.txt", "tail"),
+	)
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "default"},
+		{name: "chunked", opts: []Option{WithChunkSize(chunkSize)}},
+		{name: "reusable", opts: []Option{WithChunkSize(chunkSize), WithReusableChunks()}},
+		{name: "aligned", opts: []Option{WithChunkSize(chunkSize), WithChunkAlignment(4096)}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			blob := buildBlob(t, ents, tt.opts...)
+			r, err := Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+			if err != nil {
+				t.Fatalf("failed to open blob: %v", err)
+			}
+			verifyTarHeaders(t, r)
+
+			big, ok := r.Lookup("big.bin")
+			if !ok {
+				t.Fatalf("big.bin not found")
+			}
+			if err := r.NewTarHeaderVerifier().Verify(big.Offset + 1); err == nil {
+				t.Errorf("verifying an offset of no file must fail")
+			}
+
+			// Divergences of the TOC from the tar headers are detected.
+			small, ok := r.Lookup("d/small.txt")
+			if !ok {
+				t.Fatalf("d/small.txt not found")
+			}
+			small.Size++
+			if err := r.NewTarHeaderVerifier().Verify(small.Offset); err == nil {
+				t.Errorf("size divergence of d/small.txt must be detected")
+			}
+			small.Size--
+			link, ok := r.Lookup("d/link")
+			if !ok {
+				t.Fatalf("d/link not found")
+			}
+			link.Type = "reg"
+			if err := r.NewTarHeaderVerifier().Verify(big.Offset); err == nil {
+				t.Errorf("type divergence of d/link must be detected")
+			}
+			link.Type = "symlink"
+			offset := big.Offset
+			big.Offset = small.Offset + 1
+			if err := r.NewTarHeaderVerifier().Verify(big.Offset); err == nil {
+				t.Errorf("offset divergence of big.bin must be detected")
+			}
+			big.Offset = offset
+		})
+	}
+}
@@ -0,0 +1,122 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// FuzzOpen fuzzes parsing of the footer and the TOC and reconciliation of the TOC and the
+// tar stream (VerifyTarStructure).
+func FuzzOpen(f *testing.F) {
+	for _, opts := range [][]Option{
+		nil,
+		{WithChunkSize(4), WithPrioritizedFiles([]string{"foo"})},
+		{WithoutLandmarks(), WithSummary()},
+	} {
+		b, err := fuzzBlob(opts...)
+		if err != nil {
+			f.Fatalf("failed to build blob: %v", err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) > 1<<20 {
+			return
+		}
+		sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+		r, err := Open(sr)
+		if err != nil {
+			return
+		}
+		r.VerifyTarStructure(sr)
+		root, ok := r.Lookup("")
+		if !ok {
+			return
+		}
+		walked := 0
+		var walk func(e *TOCEntry)
+		walk = func(e *TOCEntry) {
+			e.ForeachChild(func(_ string, ent *TOCEntry) bool {
+				if walked++; walked > 10000 {
+					return false
+				}
+				if ent.Type == "reg" {
+					if fr, err := r.OpenFile(ent.Name); err == nil {
+						io.Copy(io.Discard, io.LimitReader(fr, 1<<16))
+					}
+				} else if ent.Type == "dir" {
+					walk(ent)
+				}
+				return true
+			})
+		}
+		walk(root)
+	})
+}
+
+// FuzzParseFooter fuzzes parsing of footers.
+func FuzzParseFooter(f *testing.F) {
+	f.Add(gzipFooterBytes(0, footerSI2JSON))
+	f.Add(gzipFooterBytes(123456, footerSI2JSON))
+	f.Add(gzipFooterBytes(123456, footerSI2ZstdJSON))
+	f.Add(gzipFooterBytes(123456, footerSI2BinaryTOC))
+	f.Add(legacyFooterBytes(123456))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		(&GzipDecompressor{}).ParseFooter(b)
+		(&LegacyGzipDecompressor{}).ParseFooter(b)
+	})
+}
+
+func fuzzBlob(opts ...Option) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []struct {
+		hdr      *tar.Header
+		contents string
+	}{
+		{&tar.Header{Typeflag: tar.TypeReg, Name: "foo", Mode: 0644}, "foofoofoo"},
+		{&tar.Header{Typeflag: tar.TypeDir, Name: "bar/", Mode: 0755, PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}}, ""},
+		{&tar.Header{Typeflag: tar.TypeReg, Name: "bar/baz", Mode: 0644}, "bazbazbazbazbaz"},
+		{&tar.Header{Typeflag: tar.TypeSymlink, Name: "bar/sym", Linkname: "../foo"}, ""},
+		{&tar.Header{Typeflag: tar.TypeLink, Name: "bar/link", Linkname: "foo"}, ""},
+		{&tar.Header{Typeflag: tar.TypeFifo, Name: "fifo"}, ""},
+	} {
+		h.hdr.Size = int64(len(h.contents))
+		if err := tw.WriteHeader(h.hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(tw, h.contents); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	blob, err := Build(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(blob)
+}
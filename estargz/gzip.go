@@ -24,6 +24,7 @@ package estargz
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/binary"
@@ -33,9 +34,13 @@ import (
 	"io"
 	"strconv"
 
+	"github.com/klauspost/compress/zstd"
 	digest "github.com/opencontainers/go-digest"
 )
 
+// zstdMagic is the magic number at the head of zstd frames.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 type gzipCompression struct {
 	*GzipCompressor
 	*GzipDecompressor
@@ -43,33 +48,106 @@ type gzipCompression struct {
 
 func newGzipCompressionWithLevel(level int) Compression {
 	return &gzipCompression{
-		&GzipCompressor{level},
+		&GzipCompressor{compressionLevel: level},
 		&GzipDecompressor{},
 	}
 }
 
 func NewGzipCompressor() *GzipCompressor {
-	return &GzipCompressor{gzip.BestCompression}
+	return &GzipCompressor{compressionLevel: gzip.BestCompression}
 }
 
 func NewGzipCompressorWithLevel(level int) *GzipCompressor {
-	return &GzipCompressor{level}
+	return &GzipCompressor{compressionLevel: level}
+}
+
+// NewGzipCompressorWithZstdTOC returns a gzip compressor that compresses the TOC JSON with
+// zstd inside the gzip stream, which is flagged in the footer. This makes the TOC of huge
+// layers much smaller than gzip does but the blob can't be read by older readers.
+func NewGzipCompressorWithZstdTOC(level int) *GzipCompressor {
+	return &GzipCompressor{compressionLevel: level, zstdTOC: true}
+}
+
+// NewGzipCompressorWithBinaryTOC returns a gzip compressor that encodes the TOC in the
+// binary format (CBOR) instead of JSON, which is flagged in the footer. The binary TOC is
+// smaller and faster to parse than the TOC JSON but the blob can't be read by older readers.
+func NewGzipCompressorWithBinaryTOC(level int) *GzipCompressor {
+	return &GzipCompressor{compressionLevel: level, binaryTOC: true}
 }
 
 type GzipCompressor struct {
 	compressionLevel int
+	zstdTOC          bool
+	binaryTOC        bool
 }
 
 func (gc *GzipCompressor) Writer(w io.Writer) (io.WriteCloser, error) {
 	return gzip.NewWriterLevel(w, gc.compressionLevel)
 }
 
+const (
+	// gzipPaddingHeaderSize is the size of an empty gzip member carrying padding in an
+	// extra subfield: header (10) + XLEN (2) + subfield header (4) + empty deflate
+	// block (2) + CRC32 (4) + ISIZE (4).
+	gzipPaddingHeaderSize = 26
+
+	// gzipMaxPaddingMemberSize is the maximum size of a gzip member carrying padding.
+	gzipMaxPaddingMemberSize = gzipPaddingHeaderSize + 0xffff - 4
+)
+
+func (gc *GzipCompressor) MinPaddingSize() int64 {
+	return gzipPaddingHeaderSize
+}
+
+// WritePadding writes empty gzip members whose extra fields are filled with zeros.
+func (gc *GzipCompressor) WritePadding(w io.Writer, size int64) error {
+	for size > 0 {
+		n := size
+		if n > gzipMaxPaddingMemberSize {
+			n = gzipMaxPaddingMemberSize
+			if size-n < gzipPaddingHeaderSize {
+				n = size - gzipPaddingHeaderSize // leave enough for the last member
+			}
+		}
+		if n < gzipPaddingHeaderSize {
+			return fmt.Errorf("padding size %d is smaller than %d", n, gzipPaddingHeaderSize)
+		}
+		member := make([]byte, n)
+		copy(member, []byte{0x1f, 0x8b, 8, 4 /* FEXTRA */, 0, 0, 0, 0, 0, 255})
+		binary.LittleEndian.PutUint16(member[10:12], uint16(n-gzipPaddingHeaderSize+4))
+		member[12], member[13] = 'P', 'D' // subfield ID
+		binary.LittleEndian.PutUint16(member[14:16], uint16(n-gzipPaddingHeaderSize))
+		copy(member[n-10:], []byte{0x03, 0x00}) // empty final block; CRC32 and ISIZE are 0
+		if _, err := w.Write(member); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
 func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (digest.Digest, error) {
-	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	var tocBytes []byte
+	var err error
+	if gc.binaryTOC {
+		tocBytes, err = MarshalBinaryTOC(toc)
+	} else {
+		tocBytes, err = json.MarshalIndent(toc, "", "\t")
+	}
 	if err != nil {
 		return "", err
 	}
-	gz, _ := gzip.NewWriterLevel(w, gc.compressionLevel)
+	payload, level := tocBytes, gc.compressionLevel
+	if gc.zstdTOC {
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return "", err
+		}
+		payload = enc.EncodeAll(tocBytes, nil)
+		enc.Close()
+		level = gzip.NoCompression // the payload is already compressed
+	}
+	gz, _ := gzip.NewWriterLevel(w, level)
 	gw := io.Writer(gz)
 	if diffHash != nil {
 		gw = io.MultiWriter(gz, diffHash)
@@ -78,11 +156,11 @@ func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, d
 	if err := tw.WriteHeader(&tar.Header{
 		Typeflag: tar.TypeReg,
 		Name:     TOCTarName,
-		Size:     int64(len(tocJSON)),
+		Size:     int64(len(payload)),
 	}); err != nil {
 		return "", err
 	}
-	if _, err := tw.Write(tocJSON); err != nil {
+	if _, err := tw.Write(payload); err != nil {
 		return "", err
 	}
 
@@ -92,21 +170,43 @@ func (gc *GzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, d
 	if err := gz.Close(); err != nil {
 		return "", err
 	}
-	if _, err := w.Write(gzipFooterBytes(off)); err != nil {
+	if _, err := w.Write(gzipFooterBytes(off, gc.footerSI2())); err != nil {
 		return "", err
 	}
-	return digest.FromBytes(tocJSON), nil
+	return digest.FromBytes(tocBytes), nil
 }
 
-// gzipFooterBytes returns the 51 bytes footer.
-func gzipFooterBytes(tocOff int64) []byte {
+// The second subfield ID in the footer flags the encoding of the TOC so that older readers
+// reject blobs that they can't read. Readers detect the encoding from the TOC contents.
+const (
+	footerSI2JSON          = 'G' // TOC JSON
+	footerSI2ZstdJSON      = 'Z' // TOC JSON compressed with zstd
+	footerSI2BinaryTOC     = 'B' // binary TOC
+	footerSI2ZstdBinaryTOC = 'Y' // binary TOC compressed with zstd
+)
+
+func (gc *GzipCompressor) footerSI2() byte {
+	switch {
+	case gc.binaryTOC && gc.zstdTOC:
+		return footerSI2ZstdBinaryTOC
+	case gc.binaryTOC:
+		return footerSI2BinaryTOC
+	case gc.zstdTOC:
+		return footerSI2ZstdJSON
+	}
+	return footerSI2JSON
+}
+
+// gzipFooterBytes returns the 51 bytes footer. si2 is the second subfield ID which flags
+// the encoding of the TOC.
+func gzipFooterBytes(tocOff int64, si2 byte) []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, FooterSize))
 	gz, _ := gzip.NewWriterLevel(buf, gzip.NoCompression) // MUST be NoCompression to keep 51 bytes
 
 	// Extra header indicating the offset of TOCJSON
 	// https://tools.ietf.org/html/rfc1952#section-2.3.1.1
 	header := make([]byte, 4)
-	header[0], header[1] = 'S', 'G'
+	header[0], header[1] = 'S', si2
 	subfield := fmt.Sprintf("%016xSTARGZ", tocOff)
 	binary.LittleEndian.PutUint16(header[2:4], uint16(len(subfield))) // little-endian per RFC1952
 	gz.Header.Extra = append(header, []byte(subfield)...)
@@ -138,8 +238,8 @@ func (gz *GzipDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, t
 	defer zr.Close()
 	extra := zr.Header.Extra
 	si1, si2, subfieldlen, subfield := extra[0], extra[1], extra[2:4], extra[4:]
-	if si1 != 'S' || si2 != 'G' {
-		return 0, 0, 0, fmt.Errorf("invalid subfield IDs: %q, %q; want E, S", si1, si2)
+	if si1 != 'S' || !validFooterSI2(si2) {
+		return 0, 0, 0, fmt.Errorf("invalid subfield IDs: %q, %q; want S, G (or Z, B, Y)", si1, si2)
 	}
 	if slen := binary.LittleEndian.Uint16(subfieldlen); slen != uint16(16+len("STARGZ")) {
 		return 0, 0, 0, fmt.Errorf("invalid length of subfield %d; want %d", slen, 16+len("STARGZ"))
@@ -154,6 +254,14 @@ func (gz *GzipDecompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, t
 	return tocOffset, tocOffset, 0, nil
 }
 
+func validFooterSI2(si2 byte) bool {
+	switch si2 {
+	case footerSI2JSON, footerSI2ZstdJSON, footerSI2BinaryTOC, footerSI2ZstdBinaryTOC:
+		return true
+	}
+	return false
+}
+
 func (gz *GzipDecompressor) FooterSize() int64 {
 	return FooterSize
 }
@@ -208,9 +316,25 @@ func parseTOCEStargz(r io.Reader) (toc *JTOC, tocDgst digest.Digest, err error)
 	if err != nil {
 		return nil, "", err
 	}
+	br := bufio.NewReader(tr)
+	if magic, _ := br.Peek(len(binaryTOCMagic)); IsBinaryTOC(magic) {
+		p, err := io.ReadAll(br)
+		if err != nil {
+			tr.Close()
+			return nil, "", fmt.Errorf("error reading binary TOC: %v", err)
+		}
+		if err := tr.Close(); err != nil {
+			return nil, "", err
+		}
+		toc, err := UnmarshalBinaryTOC(p)
+		if err != nil {
+			return nil, "", err
+		}
+		return toc, digest.FromBytes(p), nil
+	}
 	dgstr := digest.Canonical.Digester()
 	toc = new(JTOC)
-	if err := json.NewDecoder(io.TeeReader(tr, dgstr.Hash())).Decode(&toc); err != nil {
+	if err := json.NewDecoder(io.TeeReader(br, dgstr.Hash())).Decode(&toc); err != nil {
 		return nil, "", fmt.Errorf("error decoding TOC JSON: %v", err)
 	}
 	if err := tr.Close(); err != nil {
@@ -233,5 +357,16 @@ func decompressTOCEStargz(r io.Reader) (tocJSON io.ReadCloser, err error) {
 	if h.Name != TOCTarName {
 		return nil, fmt.Errorf("TOC tar entry had name %q; expected %q", h.Name, TOCTarName)
 	}
-	return readCloser{tr, zr.Close}, nil
+	br := bufio.NewReader(tr)
+	if magic, _ := br.Peek(len(zstdMagic)); !bytes.Equal(magic, zstdMagic) {
+		return readCloser{br, zr.Close}, nil // uncompressed TOC JSON
+	}
+	dec, err := zstd.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("malformed zstd-compressed TOC: %v", err)
+	}
+	return readCloser{dec, func() error {
+		dec.Close()
+		return zr.Close()
+	}}, nil
 }
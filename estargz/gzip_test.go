@@ -23,6 +23,7 @@
 package estargz
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
@@ -43,7 +44,7 @@ func TestGzipEStargz(t *testing.T) {
 }
 
 func gzipControllerWithLevel(compressionLevel int) TestingController {
-	return &gzipController{&GzipCompressor{compressionLevel}, &GzipDecompressor{}}
+	return &gzipController{&GzipCompressor{compressionLevel: compressionLevel}, &GzipDecompressor{}}
 }
 
 type gzipController struct {
@@ -105,17 +106,19 @@ func TestGzipFooter(t *testing.T) {
 
 // TODO: check fallback
 func checkFooter(t *testing.T, off int64) {
-	footer := gzipFooterBytes(off)
-	if len(footer) != FooterSize {
-		t.Fatalf("for offset %v, footer length was %d, not expected %d. got bytes: %q", off, len(footer), FooterSize, footer)
-	}
-	_, got, _, err := (&GzipDecompressor{}).ParseFooter(footer)
-	if err != nil {
-		t.Fatalf("failed to parse footer for offset %d, footer: %x: err: %v",
-			off, footer, err)
-	}
-	if got != off {
-		t.Fatalf("ParseFooter(footerBytes(offset %d)) = %d; want %d", off, got, off)
+	for _, si2 := range []byte{footerSI2JSON, footerSI2ZstdJSON, footerSI2BinaryTOC, footerSI2ZstdBinaryTOC} {
+		footer := gzipFooterBytes(off, si2)
+		if len(footer) != FooterSize {
+			t.Fatalf("for offset %v, footer length was %d, not expected %d. got bytes: %q", off, len(footer), FooterSize, footer)
+		}
+		_, got, _, err := (&GzipDecompressor{}).ParseFooter(footer)
+		if err != nil {
+			t.Fatalf("failed to parse footer for offset %d, footer: %x: err: %v",
+				off, footer, err)
+		}
+		if got != off {
+			t.Fatalf("ParseFooter(footerBytes(offset %d)) = %d; want %d", off, got, off)
+		}
 	}
 }
 
@@ -144,3 +147,80 @@ func legacyFooterBytes(tocOff int64) []byte {
 	}
 	return buf.Bytes()
 }
+
+// TestGzipZstdTOC tests gzip-based eStargz whose TOC JSON is compressed with zstd.
+func TestGzipZstdTOC(t *testing.T) {
+	tarBlob := buildTar(t, tarOf(
+		dir("foo/"),
+		file("foo/bar.txt", "bar contents"),
+		file("baz.txt", "baz contents"),
+	), "")
+	rc, err := Build(tarBlob, WithZstdTOC())
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read eStargz: %v", err)
+	}
+
+	// The blob must be a valid gzip-compressed tar whose TOC entry is zstd-compressed.
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed to decompress the blob: %v", err)
+	}
+	diffID := sha256.New()
+	tr := tar.NewReader(io.TeeReader(zr, diffID))
+	var tocFound bool
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		if h.Name == TOCTarName {
+			tocFound = true
+			magic := make([]byte, len(zstdMagic))
+			if _, err := io.ReadFull(tr, magic); err != nil || !bytes.Equal(magic, zstdMagic) {
+				t.Errorf("TOC must be compressed with zstd: %x (err: %v)", magic, err)
+			}
+		}
+	}
+	if !tocFound {
+		t.Fatalf("TOC entry not found")
+	}
+	io.Copy(io.Discard, zr)
+	if got := fmt.Sprintf("sha256:%x", diffID.Sum(nil)); got != rc.DiffID().String() {
+		t.Errorf("DiffID = %v; want %v", rc.DiffID(), got)
+	}
+	if b[len(b)-FooterSize+13] != 'Z' {
+		t.Errorf("footer must flag zstd-compressed TOC: %q", b[len(b)-FooterSize:])
+	}
+
+	r, err := Open(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	if err != nil {
+		t.Fatalf("failed to open eStargz: %v", err)
+	}
+	if _, err := r.VerifyTOC(rc.TOCDigest()); err != nil {
+		t.Errorf("failed to verify TOC: %v", err)
+	}
+	for name, want := range map[string]string{"foo/bar.txt": "bar contents", "baz.txt": "baz contents"} {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := fr.ReadAt(got, 0); err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("contents of %q = %q; want %q", name, got, want)
+		}
+	}
+
+	if _, err := Build(tarBlob, WithZstdTOC(), WithCompression(newGzipCompressionWithLevel(gzip.BestSpeed))); err == nil {
+		t.Errorf("zstd-compressed TOC must be rejected with custom compression")
+	}
+}
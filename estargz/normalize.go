@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"time"
+)
+
+// headerNormalization is the normalization of tar headers applied by Build.
+type headerNormalization struct {
+	modTime      *time.Time
+	clampModTime bool
+	owner        *[2]int
+}
+
+// WithModTime option makes Build set the modification time of all entries to t (in
+// seconds) and drop their access and change times. Layers built from the same files at
+// different times then have the same headers, TOC and DiffID, so their contents (and
+// caches of them) can be shared across builds. The Unix epoch can be passed to strip
+// timestamps.
+func WithModTime(t time.Time) Option {
+	return func(o *options) error {
+		t := t.Truncate(time.Second)
+		o.normalize.modTime = &t
+		o.normalize.clampModTime = false
+		return nil
+	}
+}
+
+// WithClampedModTime option is the same as WithModTime but sets t only to entries
+// modified after t, following the convention of SOURCE_DATE_EPOCH of reproducible builds.
+func WithClampedModTime(t time.Time) Option {
+	return func(o *options) error {
+		t := t.Truncate(time.Second)
+		o.normalize.modTime = &t
+		o.normalize.clampModTime = true
+		return nil
+	}
+}
+
+// WithOwner option makes Build set the owner of all entries to uid and gid and drop the
+// names of the user and the group. Note that this changes the ownership of files seen
+// in containers.
+func WithOwner(uid, gid int) Option {
+	return func(o *options) error {
+		if uid < 0 || gid < 0 {
+			return fmt.Errorf("invalid owner %d:%d", uid, gid)
+		}
+		o.normalize.owner = &[2]int{uid, gid}
+		return nil
+	}
+}
+
+func (n headerNormalization) enabled() bool {
+	return n.modTime != nil || n.owner != nil
+}
+
+// normalizeEntries applies the normalization to headers of the entries.
+func normalizeEntries(entries []*entry, n headerNormalization) {
+	for _, e := range entries {
+		h := *e.header
+		if n.modTime != nil {
+			if !n.clampModTime || h.ModTime.After(*n.modTime) {
+				h.ModTime = *n.modTime
+			}
+			h.ModTime = h.ModTime.Truncate(time.Second)
+			h.AccessTime, h.ChangeTime = time.Time{}, time.Time{}
+			deletePAXRecords(&h, "mtime", "atime", "ctime")
+		}
+		if n.owner != nil {
+			h.Uid, h.Gid = n.owner[0], n.owner[1]
+			h.Uname, h.Gname = "", ""
+			deletePAXRecords(&h, "uid", "gid", "uname", "gname")
+		}
+		e.header = &h
+	}
+}
+
+func deletePAXRecords(h *tar.Header, keys ...string) {
+	if len(h.PAXRecords) == 0 {
+		return
+	}
+	records := make(map[string]string, len(h.PAXRecords))
+	for k, v := range h.PAXRecords {
+		records[k] = v
+	}
+	for _, k := range keys {
+		delete(records, k)
+	}
+	h.PAXRecords = records
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidPath is returned when a path is rejected by PathPolicyReject.
+var ErrInvalidPath = errors.New("invalid path")
+
+// PathPolicy specifies how to deal with entry names and link names that aren't valid
+// UTF-8 or contain NUL or control characters. Such names can come from untrusted blobs
+// and can't be represented (or looked up) consistently by filesystems.
+type PathPolicy int
+
+const (
+	// PathPolicyAllow uses names as-is. This is the default.
+	PathPolicyAllow PathPolicy = iota
+
+	// PathPolicyReject fails on invalid names with ErrInvalidPath.
+	PathPolicyReject
+
+	// PathPolicySanitize replaces each invalid byte in names with "%XX" where XX is
+	// the hexadecimal value of the byte.
+	PathPolicySanitize
+)
+
+// ParsePathPolicy parses the name of a policy ("allow", "reject" or "sanitize").
+// Empty string means PathPolicyAllow.
+func ParsePathPolicy(s string) (PathPolicy, error) {
+	switch s {
+	case "", "allow":
+		return PathPolicyAllow, nil
+	case "reject":
+		return PathPolicyReject, nil
+	case "sanitize":
+		return PathPolicySanitize, nil
+	}
+	return 0, fmt.Errorf("unknown path policy %q", s)
+}
+
+// Apply returns the name to use according to the policy.
+func (p PathPolicy) Apply(name string) (string, error) {
+	switch p {
+	case PathPolicyReject:
+		if err := ValidatePath(name); err != nil {
+			return "", err
+		}
+	case PathPolicySanitize:
+		return SanitizePath(name), nil
+	}
+	return name, nil
+}
+
+// ValidatePath returns ErrInvalidPath if the name isn't valid UTF-8 or contains NUL or
+// control characters.
+func ValidatePath(name string) error {
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("%q isn't valid UTF-8: %w", name, ErrInvalidPath)
+	}
+	for _, c := range name {
+		if isControl(c) {
+			return fmt.Errorf("%q contains control character %U: %w", name, c, ErrInvalidPath)
+		}
+	}
+	return nil
+}
+
+// SanitizePath replaces bytes that aren't valid UTF-8 and bytes of NUL and control
+// characters with "%XX". Valid names are returned as-is.
+func SanitizePath(name string) string {
+	if ValidatePath(name) == nil {
+		return name
+	}
+	var b strings.Builder
+	for len(name) > 0 {
+		c, size := utf8.DecodeRuneInString(name)
+		if (c == utf8.RuneError && size <= 1) || isControl(c) {
+			for i := 0; i < size; i++ {
+				fmt.Fprintf(&b, "%%%02X", name[i])
+			}
+		} else {
+			b.WriteString(name[:size])
+		}
+		name = name[size:]
+	}
+	return b.String()
+}
+
+func isControl(c rune) bool {
+	return c < 0x20 || (0x7f <= c && c < 0xa0)
+}
+
+// applyPathPolicy applies the policy to the names of the TOC entries.
+func applyPathPolicy(toc *JTOC, policy PathPolicy) (err error) {
+	if policy == PathPolicyAllow {
+		return nil
+	}
+	for _, ent := range toc.Entries {
+		if ent.Name, err = policy.Apply(ent.Name); err != nil {
+			return err
+		}
+		if ent.Type == "hardlink" || ent.Type == "symlink" {
+			if ent.LinkName, err = policy.Apply(ent.LinkName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+		want  string
+	}{
+		{in: "foo/bar.txt", valid: true, want: "foo/bar.txt"},
+		{in: "日本語/�", valid: true, want: "日本語/�"},
+		{in: "foo\x00bar", want: "foo%00bar"},
+		{in: "foo\nbar\x7f", want: "foo%0Abar%7F"},
+		{in: "foo\u0085", want: "foo%C2%85"},
+		{in: "foo\xffbar\xe6\x97", want: "foo%FFbar%E6%97"},
+	}
+	for _, tt := range tests {
+		err := ValidatePath(tt.in)
+		if tt.valid != (err == nil) {
+			t.Errorf("ValidatePath(%q) = %v; want valid = %v", tt.in, err, tt.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPath) {
+			t.Errorf("ValidatePath(%q) must return ErrInvalidPath: %v", tt.in, err)
+		}
+		if got := SanitizePath(tt.in); got != tt.want {
+			t.Errorf("SanitizePath(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPathPolicy(t *testing.T) {
+	newTar := func() *io.SectionReader {
+		return buildTar(t, tarOf(
+			dir("foo\x01/"),
+			file("foo\x01/bar\xff", "bar"),
+			symlink("baz", "foo\x01/bar\xff"),
+		), "")
+	}
+	build := func(policy PathPolicy) (*io.SectionReader, error) {
+		rc, err := Build(newTar(), WithPathPolicy(policy))
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read built blob: %v", err)
+		}
+		return io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), nil
+	}
+
+	if _, err := build(PathPolicyReject); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("build must reject invalid names: %v", err)
+	}
+
+	blob, err := build(PathPolicySanitize)
+	if err != nil {
+		t.Fatalf("failed to build with sanitizing names: %v", err)
+	}
+	r, err := Open(blob)
+	if err != nil {
+		t.Fatalf("failed to open sanitized blob: %v", err)
+	}
+	if _, ok := r.Lookup("foo%01/bar%FF"); !ok {
+		t.Errorf("sanitized file not found")
+	}
+	if e, ok := r.Lookup("baz"); !ok || e.LinkName != "foo%01/bar%FF" {
+		t.Errorf("symlink target isn't sanitized: %+v", e)
+	}
+
+	blob, err = build(PathPolicyAllow)
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	if _, err := Open(blob, WithOpenPathPolicy(PathPolicyReject)); !errors.Is(err, ErrInvalidPath) {
+		t.Fatalf("open must reject invalid names: %v", err)
+	}
+	r, err = Open(blob, WithOpenPathPolicy(PathPolicySanitize))
+	if err != nil {
+		t.Fatalf("failed to open with sanitizing names: %v", err)
+	}
+	// Invalid UTF-8 in names is replaced with U+FFFD when the TOC JSON is encoded so only
+	// control characters are left to be sanitized on open.
+	if _, ok := r.Lookup("foo%01/bar\uFFFD"); !ok {
+		t.Errorf("file isn't sanitized on open")
+	}
+}
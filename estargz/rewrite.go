@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+)
+
+// RewriteFunc writes the new contents of a regular file to w, reading the original
+// contents from r. The header is a copy of the original one and fields other than
+// Name, Typeflag and Size (e.g. ModTime and PAXRecords) can be modified. Size is set to
+// the number of bytes written to w.
+type RewriteFunc func(h *tar.Header, r io.Reader, w io.Writer) error
+
+// MatchFunc reports whether contents of the file should be rewritten. The name is
+// cleaned and doesn't have the leading "/" (e.g. "etc/passwd").
+type MatchFunc func(name string) bool
+
+type contentRewrite struct {
+	match   MatchFunc
+	rewrite RewriteFunc
+}
+
+// WithContentRewrite option makes Build pass contents of regular files matching the
+// MatchFunc through the RewriteFunc. This can be used for stripping secrets, normalizing
+// timestamps recorded in files or injecting build metadata during conversion. TOC,
+// digests and DiffID are computed over the rewritten contents. When this option is
+// specified multiple times, rewrites are applied in that order.
+func WithContentRewrite(match MatchFunc, rewrite RewriteFunc) Option {
+	return func(o *options) error {
+		if match == nil || rewrite == nil {
+			return fmt.Errorf("WithContentRewrite: match and rewrite must be passed")
+		}
+		o.rewrites = append(o.rewrites, contentRewrite{match, rewrite})
+		return nil
+	}
+}
+
+// MatchPatterns returns a MatchFunc matching names with any of the patterns following
+// the syntax of path.Match (e.g. "etc/*.conf"). Patterns can be absolute.
+func MatchPatterns(patterns ...string) (MatchFunc, error) {
+	cleaned := make([]string, len(patterns))
+	for i, p := range patterns {
+		p = cleanEntryName(p)
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", patterns[i], err)
+		}
+		cleaned[i] = p
+	}
+	return func(name string) bool {
+		for _, p := range cleaned {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// rewriteEntries applies the rewrites to the entries. Rewritten contents are stored in
+// temporary files so that the sizes can be written to the tar headers in advance.
+func rewriteEntries(entries []*entry, rewrites []contentRewrite, tf *tempFiles) error {
+	for _, e := range entries {
+		if e.header.Typeflag != tar.TypeReg && e.header.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := cleanEntryName(e.header.Name)
+		if name == PrefetchLandmark || name == NoPrefetchLandmark {
+			continue
+		}
+		for _, rw := range rewrites {
+			if !rw.match(name) {
+				continue
+			}
+			if _, err := e.payload.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			f, err := tf.TempFile("", "rewritten")
+			if err != nil {
+				return err
+			}
+			h := *e.header
+			if err := rw.rewrite(&h, e.payload, f); err != nil {
+				return fmt.Errorf("failed to rewrite %q: %w", name, err)
+			}
+			sr, err := fileSectionReader(f)
+			if err != nil {
+				return err
+			}
+			h.Name, h.Typeflag, h.Size = e.header.Name, e.header.Typeflag, sr.Size()
+			e.header, e.payload = &h, sr
+		}
+	}
+	return nil
+}
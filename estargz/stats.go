@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+// chunkSizeBuckets are the upper bounds of the buckets of chunk sizes in LayerStats. The
+// last bucket has no upper bound.
+var chunkSizeBuckets = []int64{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// LayerStats is statistics of a layer showing how the layer is ready for lazy pulling.
+type LayerStats struct {
+	TOCSummary
+
+	// BlobSize is the size of the blob.
+	BlobSize int64 `json:"blobSize"`
+
+	// Chunks is the number of non-empty chunks of regular files.
+	Chunks int64 `json:"chunks"`
+
+	// ChunkSizeHistogram is the number of chunks per range of their uncompressed sizes.
+	ChunkSizeHistogram []ChunkSizeBucket `json:"chunkSizeHistogram"`
+
+	// PrefetchFileSize is the uncompressed size of chunks in the prefetched range.
+	PrefetchFileSize int64 `json:"prefetchFileSize"`
+
+	// DuplicateChunks is the number of chunks whose contents are the same as another
+	// chunk in the layer. DuplicateSize is their uncompressed size, which could be saved
+	// by deduplication.
+	DuplicateChunks int64 `json:"duplicateChunks"`
+	DuplicateSize   int64 `json:"duplicateSize"`
+}
+
+// ChunkSizeBucket is a bucket of the histogram of chunk sizes. It counts chunks larger than
+// the upper bound of the previous bucket. UpperBound is 0 for the last bucket.
+type ChunkSizeBucket struct {
+	UpperBound int64 `json:"upperBound,omitempty"`
+	Count      int64 `json:"count"`
+}
+
+// PrefetchCoverage returns the ratio of the prefetched data to the data of all regular files.
+func (s LayerStats) PrefetchCoverage() float64 {
+	if s.TotalSize == 0 {
+		return 0
+	}
+	return float64(s.PrefetchFileSize) / float64(s.TotalSize)
+}
+
+// ComputeStats walks the entries of the TOC and returns the statistics of the blob.
+func ComputeStats(toc *JTOC, blobSize int64) LayerStats {
+	s := LayerStats{
+		TOCSummary: ComputeSummary(toc),
+		BlobSize:   blobSize,
+	}
+	for _, b := range chunkSizeBuckets {
+		s.ChunkSizeHistogram = append(s.ChunkSizeHistogram, ChunkSizeBucket{UpperBound: b})
+	}
+	s.ChunkSizeHistogram = append(s.ChunkSizeHistogram, ChunkSizeBucket{})
+	seen := make(map[string]struct{})
+	for _, e := range toc.Entries {
+		if !e.isDataType() {
+			continue
+		}
+		size := e.ChunkSize
+		if size == 0 && e.Type == "reg" {
+			size = e.Size - e.ChunkOffset // the chunk goes to the end of the file
+		}
+		if size <= 0 {
+			continue
+		}
+		s.Chunks++
+		i := 0
+		for i < len(chunkSizeBuckets) && size > chunkSizeBuckets[i] {
+			i++
+		}
+		s.ChunkSizeHistogram[i].Count++
+		if e.Offset < s.PrefetchSize {
+			s.PrefetchFileSize += size
+		}
+		if e.ChunkDigest == "" {
+			continue
+		}
+		if _, ok := seen[e.ChunkDigest]; ok {
+			s.DuplicateChunks++
+			s.DuplicateSize += size
+		}
+		seen[e.ChunkDigest] = struct{}{}
+	}
+	return s
+}
+
+// Stats returns the statistics of the blob.
+func (r *Reader) Stats() LayerStats {
+	return ComputeStats(r.toc, r.sr.Size())
+}
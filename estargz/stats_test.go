@@ -0,0 +1,48 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import "testing"
+
+func TestComputeStats(t *testing.T) {
+	toc := &JTOC{
+		Entries: []*TOCEntry{
+			{Name: "a", Type: "reg", Size: 10 << 10, Offset: 0, ChunkSize: 8 << 10, ChunkDigest: "sha256:1"},
+			{Name: "a", Type: "chunk", Offset: 100, ChunkOffset: 8 << 10, ChunkSize: 2 << 10, ChunkDigest: "sha256:2"},
+			{Name: PrefetchLandmark, Type: "reg", Offset: 200},
+			{Name: "b", Type: "reg", Size: 2 << 10, Offset: 300, ChunkDigest: "sha256:2"},
+			{Name: "c", Type: "reg", Size: 8 << 20, Offset: 400, ChunkDigest: "sha256:3"},
+			{Name: "d", Type: "dir"},
+		},
+	}
+	s := ComputeStats(toc, 1000)
+	if s.BlobSize != 1000 || s.Chunks != 4 || s.RegularFiles != 4 || s.PrefetchSize != 200 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if s.PrefetchFileSize != 10<<10 || s.DuplicateChunks != 1 || s.DuplicateSize != 2<<10 {
+		t.Errorf("unexpected prefetch or duplicate stats %+v", s)
+	}
+	want := []int64{2, 1, 0, 0, 0, 0, 1}
+	for i, b := range s.ChunkSizeHistogram {
+		if b.Count != want[i] {
+			t.Errorf("bucket %d (<= %d) has %d chunks; want %d", i, b.UpperBound, b.Count, want[i])
+		}
+	}
+	if got, want := s.PrefetchCoverage(), float64(10<<10)/float64(s.TotalSize); got != want {
+		t.Errorf("prefetch coverage %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+// ComputeSummary walks the entries of the TOC and returns their statistics. The Summary
+// field of the TOC is ignored.
+func ComputeSummary(toc *JTOC) TOCSummary {
+	var s TOCSummary
+	var landmark *int64
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" {
+			continue
+		}
+		s.Entries++
+		if e.Type == "reg" {
+			s.RegularFiles++
+			s.TotalSize += e.Size
+		}
+		switch cleanEntryName(e.Name) {
+		case PrefetchLandmark:
+			off := e.Offset
+			landmark = &off
+		case NoPrefetchLandmark:
+			var zero int64
+			landmark = &zero
+		}
+	}
+	// Landmark files take precedence over PrefetchBoundary as readers respect them.
+	if landmark != nil {
+		s.PrefetchSize = *landmark
+	} else if toc.PrefetchBoundary != nil {
+		s.PrefetchSize = *toc.PrefetchBoundary
+	}
+	return s
+}
@@ -31,6 +31,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -57,6 +58,14 @@ func CompressionTestSuite(t *testing.T, controllers ...TestingController) {
 	t.Run("testBuild", func(t *testing.T) { t.Parallel(); testBuild(t, controllers...) })
 	t.Run("testDigestAndVerify", func(t *testing.T) { t.Parallel(); testDigestAndVerify(t, controllers...) })
 	t.Run("testWriteAndOpen", func(t *testing.T) { t.Parallel(); testWriteAndOpen(t, controllers...) })
+	t.Run("testBuildWithoutLandmarks", func(t *testing.T) { t.Parallel(); testBuildWithoutLandmarks(t, controllers...) })
+	t.Run("testBuildWithContentRewrite", func(t *testing.T) { t.Parallel(); testBuildWithContentRewrite(t, controllers...) })
+	t.Run("testBuildWithSummary", func(t *testing.T) { t.Parallel(); testBuildWithSummary(t, controllers...) })
+	t.Run("testBuildWithContentDefinedChunking", func(t *testing.T) { t.Parallel(); testBuildWithContentDefinedChunking(t, controllers...) })
+	t.Run("testBuildWithChunkAlignment", func(t *testing.T) { t.Parallel(); testBuildWithChunkAlignment(t, controllers...) })
+	t.Run("testBuildWithHeaderNormalization", func(t *testing.T) { t.Parallel(); testBuildWithHeaderNormalization(t, controllers...) })
+	t.Run("testBuildWithPrioritizedFilesEncryption", func(t *testing.T) { t.Parallel(); testBuildWithPrioritizedFilesEncryption(t, controllers...) })
+	t.Run("testRandomTreeRoundTrip", func(t *testing.T) { t.Parallel(); testRandomTreeRoundTrip(t, controllers...) })
 }
 
 const (
@@ -155,7 +164,7 @@ func testBuild(t *testing.T, controllers ...TestingController) {
 						t.Run(tt.name+"-"+fmt.Sprintf("compression=%v,prefix=%q,src=%d,format=%s", cl, prefix, srcCompression, srcTarFormat), func(t *testing.T) {
 							tarBlob := buildTar(t, tt.in, prefix, srcTarFormat)
 							// Test divideEntries()
-							entries, err := sortEntries(tarBlob, nil, nil) // identical order
+							entries, err := sortEntries(tarBlob, nil, nil, PathPolicyAllow) // identical order
 							if err != nil {
 								t.Fatalf("failed to parse tar: %v", err)
 							}
@@ -244,6 +253,486 @@ func testBuild(t *testing.T, controllers ...TestingController) {
 	}
 }
 
+// testBuildWithoutLandmarks tests that the prefetch boundary is recorded in the TOC instead of
+// landmark files.
+func testBuildWithoutLandmarks(t *testing.T, controllers ...TestingController) {
+	tests := []struct {
+		name        string
+		prioritized []string
+		wantNoFetch bool
+	}{
+		{name: "prioritized", prioritized: []string{"foo"}},
+		{name: "prioritized all", prioritized: []string{"foo", "bar", "baz"}},
+		{name: "no prioritized", wantNoFetch: true},
+	}
+	for _, tt := range tests {
+		for _, cl := range controllers {
+			cl := cl
+			t.Run(tt.name+"-"+fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+				tarBlob := buildTar(t, tarOf(
+					file("foo", "test1"),
+					file("bar", "test2"),
+					file("baz", "test3"),
+				), "")
+				rc, err := Build(tarBlob, WithCompression(cl), WithPrioritizedFiles(tt.prioritized), WithoutLandmarks())
+				if err != nil {
+					t.Fatalf("failed to build stargz: %v", err)
+				}
+				defer rc.Close()
+				buf := new(bytes.Buffer)
+				if _, err := io.Copy(buf, rc); err != nil {
+					t.Fatalf("failed to copy built stargz blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to parse the stargz: %v", err)
+				}
+				for _, landmark := range []string{PrefetchLandmark, NoPrefetchLandmark} {
+					if _, ok := r.Lookup(landmark); ok {
+						t.Errorf("landmark %q must not be contained", landmark)
+					}
+				}
+				boundary, ok := r.PrefetchBoundary()
+				if !ok {
+					t.Fatalf("prefetch boundary must be recorded")
+				}
+				if tt.wantNoFetch {
+					if boundary != 0 {
+						t.Errorf("boundary = %d; want 0", boundary)
+					}
+					return
+				}
+				for _, name := range []string{"foo", "bar", "baz"} {
+					e, ok := r.Lookup(name)
+					if !ok {
+						t.Fatalf("%q not found", name)
+					}
+					isPrioritized := false
+					for _, p := range tt.prioritized {
+						isPrioritized = isPrioritized || p == name
+					}
+					if inRange := e.Offset < boundary; inRange != isPrioritized {
+						t.Errorf("%q (offset %d): in prefetch range = %v; want %v (boundary %d)",
+							name, e.Offset, inRange, isPrioritized, boundary)
+					}
+				}
+			})
+		}
+	}
+}
+
+func testBuildWithContentRewrite(t *testing.T, controllers ...TestingController) {
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			tarBlob := buildTar(t, tarOf(
+				dir("etc/"),
+				file("etc/app.conf", "user=foo\npassword=secret\n"),
+				file("etc/other.conf", "password=keep\n"),
+				file("bin/app", "binary"),
+			), "")
+			match, err := MatchPatterns("/etc/app.conf", "bin/*")
+			if err != nil {
+				t.Fatalf("failed to parse patterns: %v", err)
+			}
+			stripSecret := func(h *tar.Header, r io.Reader, w io.Writer) error {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(bytes.ReplaceAll(b, []byte("password=secret\n"), nil))
+				return err
+			}
+			appendMeta := func(h *tar.Header, r io.Reader, w io.Writer) error {
+				if _, err := io.Copy(w, r); err != nil {
+					return err
+				}
+				_, err := w.Write([]byte("#built"))
+				return err
+			}
+			rc, err := Build(tarBlob, WithCompression(cl),
+				WithContentRewrite(match, stripSecret), WithContentRewrite(match, appendMeta))
+			if err != nil {
+				t.Fatalf("failed to build stargz: %v", err)
+			}
+			defer rc.Close()
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, rc); err != nil {
+				t.Fatalf("failed to copy built stargz blob: %v", err)
+			}
+			r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), WithDecompressors(cl))
+			if err != nil {
+				t.Fatalf("failed to parse the stargz: %v", err)
+			}
+			if _, err := r.VerifyTOC(rc.TOCDigest()); err != nil {
+				t.Fatalf("failed to verify TOC: %v", err)
+			}
+			for name, want := range map[string]string{
+				"etc/app.conf":   "user=foo\n#built",
+				"etc/other.conf": "password=keep\n",
+				"bin/app":        "binary#built",
+			} {
+				e, ok := r.Lookup(name)
+				if !ok {
+					t.Fatalf("%q not found", name)
+				}
+				if e.Size != int64(len(want)) {
+					t.Errorf("size of %q = %d; want %d", name, e.Size, len(want))
+				}
+				if e.Digest != digestFor(want) {
+					t.Errorf("digest of %q = %q; want %q", name, e.Digest, digestFor(want))
+				}
+				sr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got, err := io.ReadAll(sr)
+				if err != nil {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				if string(got) != want {
+					t.Errorf("contents of %q = %q; want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// testBuildWithHeaderNormalization tests that layers of the same files built at different
+// times by different users are the same after normalizing their headers.
+func testBuildWithHeaderNormalization(t *testing.T, controllers ...TestingController) {
+	epoch := time.Unix(1600000000, 0)
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			build := func(mtime time.Time, o owner, opts ...Option) (*Reader, digest.Digest, digest.Digest) {
+				tarBlob := buildTar(t, tarOf(
+					file("old", "old", epoch.Add(-time.Hour), o),
+					file("new", "new", mtime, o),
+				), "", tar.FormatPAX)
+				rc, err := Build(tarBlob, append(opts, WithCompression(cl))...)
+				if err != nil {
+					t.Fatalf("failed to build stargz: %v", err)
+				}
+				defer rc.Close()
+				buf := new(bytes.Buffer)
+				if _, err := io.Copy(buf, rc); err != nil {
+					t.Fatalf("failed to copy built stargz blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to parse the stargz: %v", err)
+				}
+				return r, rc.TOCDigest(), rc.DiffID()
+			}
+			opts := []Option{WithClampedModTime(epoch), WithOwner(0, 0)}
+			r, tocDgst, diffID := build(epoch.Add(time.Minute+time.Millisecond), owner{1000, 1000}, opts...)
+			_, tocDgst2, diffID2 := build(epoch.Add(2*time.Minute), owner{1001, 1001}, opts...)
+			if tocDgst != tocDgst2 || diffID != diffID2 {
+				t.Errorf("normalized layers differ: TOC %v != %v or DiffID %v != %v", tocDgst, tocDgst2, diffID, diffID2)
+			}
+			for name, want := range map[string]time.Time{
+				"old": epoch.Add(-time.Hour), // not clamped
+				"new": epoch,
+			} {
+				e, ok := r.Lookup(name)
+				if !ok {
+					t.Fatalf("%q not found", name)
+				}
+				if !e.ModTime().Equal(want) {
+					t.Errorf("mtime of %q = %v; want %v", name, e.ModTime(), want)
+				}
+				if e.UID != 0 || e.GID != 0 || e.Uname != "" || e.Gname != "" {
+					t.Errorf("owner of %q = %d(%q):%d(%q); want 0:0", name, e.UID, e.Uname, e.GID, e.Gname)
+				}
+			}
+
+			// Without clamping, mtime of all entries (including older ones) is set to the given
+			// time. The Unix epoch is omitted from the TOC, so mtime must be stripped.
+			r, _, _ = build(epoch, owner{}, WithModTime(time.Unix(0, 0)))
+			if e, ok := r.Lookup("old"); !ok || e.ModTime3339 != "" {
+				t.Errorf("mtime of old isn't stripped")
+			}
+		})
+	}
+}
+
+// testBuildWithPrioritizedFilesEncryption tests that only prioritized files are encrypted
+// and they can be read only with the key.
+func testBuildWithPrioritizedFilesEncryption(t *testing.T, controllers ...TestingController) {
+	key := bytes.Repeat([]byte{0x42}, EncryptionKeySize)
+	secret := strings.Repeat("secret!", 10)
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			tarBlob := buildTar(t, tarOf(
+				file("secret", secret),
+				file("plain", "plain"),
+			), "")
+			rc, err := Build(tarBlob, WithCompression(cl), WithChunkSize(13),
+				WithPrioritizedFiles([]string{"secret"}), WithPrioritizedFilesEncryption(key))
+			if err != nil {
+				t.Fatalf("failed to build stargz: %v", err)
+			}
+			defer rc.Close()
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, rc); err != nil {
+				t.Fatalf("failed to copy built stargz blob: %v", err)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+			readAll := func(r *Reader, name string, off int64, open func(string) (*io.SectionReader, error)) string {
+				f, err := open(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				b := make([]byte, f.Size()-off)
+				if _, err := f.ReadAt(b, off); err != nil {
+					t.Fatalf("failed to read %q: %v", name, err)
+				}
+				return string(b)
+			}
+
+			// Without the key, only plain files can be read.
+			r, err := Open(sr, WithDecompressors(cl))
+			if err != nil {
+				t.Fatalf("failed to parse the stargz: %v", err)
+			}
+			if e, ok := r.Lookup("secret"); !ok || e.Encryption == nil || e.Encryption.KeyID != KeyID(key) {
+				t.Fatalf("encryption of secret isn't recorded")
+			}
+			if e, ok := r.Lookup("plain"); !ok || e.Encryption != nil {
+				t.Fatalf("plain file must not be encrypted")
+			}
+			if _, err := r.OpenFile("secret"); err == nil {
+				t.Errorf("encrypted file must not be opened without the key")
+			}
+			if got := readAll(r, "secret", 0, r.OpenRawFile); got == secret {
+				t.Errorf("secret is stored in plain")
+			}
+			if got := readAll(r, "plain", 0, r.OpenFile); got != "plain" {
+				t.Errorf("plain = %q; want %q", got, "plain")
+			}
+
+			// With the key, encrypted files are decrypted from any offset.
+			r, err = Open(sr, WithDecompressors(cl), WithDecryptionKeys(key))
+			if err != nil {
+				t.Fatalf("failed to parse the stargz: %v", err)
+			}
+			for _, off := range []int64{0, 5, 16, 21} {
+				if got := readAll(r, "secret", off, r.OpenFile); got != secret[off:] {
+					t.Errorf("secret at %d = %q; want %q", off, got, secret[off:])
+				}
+			}
+
+			// Building fails if there is nothing to encrypt.
+			if _, err := Build(buildTar(t, tarOf(file("plain", "plain")), ""), WithCompression(cl),
+				WithPrioritizedFilesEncryption(key)); err == nil {
+				t.Errorf("encryption without prioritized files must fail")
+			}
+		})
+	}
+}
+
+func testBuildWithSummary(t *testing.T, controllers ...TestingController) {
+	for _, noLandmarks := range []bool{false, true} {
+		for _, cl := range controllers {
+			noLandmarks, cl := noLandmarks, cl
+			t.Run(fmt.Sprintf("nolandmarks=%v,compression=%v", noLandmarks, cl), func(t *testing.T) {
+				tarBlob := buildTar(t, tarOf(
+					dir("foo/"),
+					file("foo/a", "test1"),
+					file("b", "test22"),
+					symlink("c", "b"),
+				), "")
+				opts := []Option{WithCompression(cl), WithPrioritizedFiles([]string{"foo/a"}), WithSummary()}
+				if noLandmarks {
+					opts = append(opts, WithoutLandmarks())
+				}
+				rc, err := Build(tarBlob, opts...)
+				if err != nil {
+					t.Fatalf("failed to build stargz: %v", err)
+				}
+				defer rc.Close()
+				buf := new(bytes.Buffer)
+				if _, err := io.Copy(buf, rc); err != nil {
+					t.Fatalf("failed to copy built stargz blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to parse the stargz: %v", err)
+				}
+				s, ok := r.Summary()
+				if !ok {
+					t.Fatalf("summary must be recorded")
+				}
+				want := TOCSummary{Entries: 4, RegularFiles: 2, TotalSize: 11}
+				if !noLandmarks { // landmark file is contained
+					want.Entries++
+					want.RegularFiles++
+					want.TotalSize++
+				}
+				if s.Entries != want.Entries || s.RegularFiles != want.RegularFiles || s.TotalSize != want.TotalSize {
+					t.Errorf("summary = %+v; want %+v", s, want)
+				}
+				e, ok := r.Lookup("b")
+				if !ok {
+					t.Fatalf("\"b\" not found")
+				}
+				if s.PrefetchSize <= 0 || s.PrefetchSize > e.Offset {
+					t.Errorf("prefetch size = %d; want (0, %d]", s.PrefetchSize, e.Offset)
+				}
+				if err := r.VerifySummary(); err != nil {
+					t.Errorf("failed to verify summary: %v", err)
+				}
+				r.toc.Summary.TotalSize++
+				if err := r.VerifySummary(); err == nil {
+					t.Errorf("verification of broken summary must fail")
+				}
+			})
+		}
+	}
+}
+
+// testBuildWithContentDefinedChunking tests that chunks of a file built with content-defined
+// chunking are mostly shared with a modified version of the file.
+func testBuildWithContentDefinedChunking(t *testing.T, controllers ...TestingController) {
+	const chunkSize = 1024
+	orig := make([]byte, 64*chunkSize)
+	rand.New(rand.NewSource(1)).Read(orig)
+	modified := append(append(append([]byte{}, orig[:3000]...), []byte("inserted bytes")...), orig[3000:]...)
+
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			chunkDigests := func(contents []byte) map[string]bool {
+				tarBlob := buildTar(t, tarOf(file("a", string(contents))), "")
+				rc, err := Build(tarBlob, WithCompression(cl), WithChunkSize(chunkSize), WithContentDefinedChunking())
+				if err != nil {
+					t.Fatalf("failed to build stargz: %v", err)
+				}
+				defer rc.Close()
+				buf := new(bytes.Buffer)
+				if _, err := io.Copy(buf, rc); err != nil {
+					t.Fatalf("failed to copy built stargz blob: %v", err)
+				}
+				r, err := Open(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len())), WithDecompressors(cl))
+				if err != nil {
+					t.Fatalf("failed to parse the stargz: %v", err)
+				}
+				sr, err := r.OpenFile("a")
+				if err != nil {
+					t.Fatalf("failed to open file: %v", err)
+				}
+				got, err := io.ReadAll(sr)
+				if err != nil || !bytes.Equal(got, contents) {
+					t.Fatalf("unexpected contents (err: %v)", err)
+				}
+				e, ok := r.Lookup("a")
+				if !ok {
+					t.Fatalf("\"a\" not found")
+				}
+				digests := make(map[string]bool)
+				sizes := make(map[int64]bool)
+				for _, ce := range r.getChunks(e) {
+					if ce.ChunkSize > 2*chunkSize {
+						t.Errorf("too large chunk %d", ce.ChunkSize)
+					}
+					if want := digest.FromBytes(contents[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]).String(); ce.ChunkDigest != want {
+						t.Errorf("chunk digest at %d = %q; want %q", ce.ChunkOffset, ce.ChunkDigest, want)
+					}
+					digests[ce.ChunkDigest] = true
+					sizes[ce.ChunkSize] = true
+				}
+				if len(sizes) < 2 {
+					t.Errorf("chunk sizes must vary: %v", sizes)
+				}
+				return digests
+			}
+			a, b := chunkDigests(orig), chunkDigests(modified)
+			var shared int
+			for d := range b {
+				if a[d] {
+					shared++
+				}
+			}
+			if shared < len(b)*3/4 {
+				t.Errorf("only %d of %d chunks are shared", shared, len(b))
+			}
+		})
+	}
+}
+
+// testBuildWithChunkAlignment tests that chunks of large files and the landmark file are
+// aligned and the padding is skipped on decompression.
+func testBuildWithChunkAlignment(t *testing.T, controllers ...TestingController) {
+	const alignment = 512
+	contents := map[string]string{
+		"small.txt":       "small",
+		"big.txt":         strings.Repeat("0123456789", 100),
+		"prioritized.txt": "prioritized",
+	}
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			tarBlob := buildTar(t, tarOf(
+				file("small.txt", contents["small.txt"]),
+				file("big.txt", contents["big.txt"]),
+				file("prioritized.txt", contents["prioritized.txt"]),
+			), "")
+			rc, err := Build(tarBlob, WithCompression(cl), WithChunkSize(100), WithChunkAlignment(alignment),
+				WithPrioritizedFiles([]string{"prioritized.txt"}))
+			if err != nil {
+				t.Fatalf("failed to build stargz: %v", err)
+			}
+			defer rc.Close()
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, rc); err != nil {
+				t.Fatalf("failed to copy built stargz blob: %v", err)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+			r, err := Open(sr, WithDecompressors(cl))
+			if err != nil {
+				t.Fatalf("failed to parse the stargz: %v", err)
+			}
+			var bigChunks int
+			for _, e := range r.toc.Entries {
+				if e.Name == "big.txt" {
+					bigChunks++
+				} else if e.Name != PrefetchLandmark {
+					continue
+				}
+				if e.Offset%alignment != 0 {
+					t.Errorf("chunk of %q at %d (offset %d) isn't aligned", e.Name, e.ChunkOffset, e.Offset)
+				}
+			}
+			if bigChunks != 10 {
+				t.Errorf("number of chunks of big.txt = %d; want 10", bigChunks)
+			}
+			for name, want := range contents {
+				fr, err := r.OpenFile(name)
+				if err != nil {
+					t.Fatalf("failed to open %q: %v", name, err)
+				}
+				got, err := io.ReadAll(io.NewSectionReader(fr, 0, int64(len(want))))
+				if err != nil || string(got) != want {
+					t.Errorf("unexpected contents of %q (err: %v)", name, err)
+				}
+			}
+			ur, err := Unpack(sr, cl)
+			if err != nil {
+				t.Fatalf("failed to unpack: %v", err)
+			}
+			defer ur.Close()
+			if got := cl.DiffIDOf(t, buf.Bytes()); got != rc.DiffID().String() {
+				t.Errorf("DiffID = %q; want %q", got, rc.DiffID())
+			}
+			if _, err := io.Copy(io.Discard, ur); err != nil {
+				t.Fatalf("failed to decompress the padded blob: %v", err)
+			}
+		})
+	}
+}
+
 func isSameTarGz(t *testing.T, controller TestingController, a, b []byte) bool {
 	aGz, err := controller.Reader(bytes.NewReader(a))
 	if err != nil {
@@ -1414,6 +1903,10 @@ func testWriteAndOpen(t *testing.T, controllers ...TestingController) {
 							for _, want := range tt.want {
 								want.check(t, r)
 							}
+							if err := r.VerifyTarStructure(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))); err != nil {
+								t.Errorf("failed to verify tar structure: %v", err)
+							}
+							verifyTarHeaders(t, r)
 						})
 					}
 				}
@@ -1422,6 +1915,18 @@ func testWriteAndOpen(t *testing.T, controllers ...TestingController) {
 	}
 }
 
+// verifyTarHeaders checks the tar header of each regular file with payload in r.
+func verifyTarHeaders(t *testing.T, r *Reader) {
+	v := r.NewTarHeaderVerifier()
+	for _, ent := range r.toc.Entries {
+		if ent.Type == "reg" && ent.Size > 0 {
+			if err := v.Verify(ent.Offset); err != nil {
+				t.Errorf("failed to verify tar header of %q: %v", ent.Name, err)
+			}
+		}
+	}
+}
+
 func newCalledTelemetry() (telemetry *Telemetry, check func() error) {
 	var getFooterLatencyCalled bool
 	var getTocLatencyCalled bool
@@ -1878,6 +2383,7 @@ func file(name, contents string, opts ...interface{}) tarEntry {
 	return tarEntryFunc(func(tw *tar.Writer, prefix string, format tar.Format) error {
 		var xattrs xAttr
 		var o owner
+		var mtime time.Time
 		mode := os.FileMode(0644)
 		for _, opt := range opts {
 			switch v := opt.(type) {
@@ -1887,6 +2393,8 @@ func file(name, contents string, opts ...interface{}) tarEntry {
 				o = v
 			case os.FileMode:
 				mode = v
+			case time.Time:
+				mtime = v
 			default:
 				return errors.New("unsupported opt")
 			}
@@ -1909,6 +2417,7 @@ func file(name, contents string, opts ...interface{}) tarEntry {
 			Size:     int64(len(contents)),
 			Uid:      o.uid,
 			Gid:      o.gid,
+			ModTime:  mtime,
 			Format:   format,
 		}); err != nil {
 			return err
@@ -0,0 +1,401 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// randomTreeCount is the number of random trees tested by testRandomTreeRoundTrip.
+	randomTreeCount = 16
+
+	// randomTreeMaxEntries is the maximum number of steps generating entries of a tree.
+	randomTreeMaxEntries = 40
+
+	// randomTreeMaxDepth is the maximum depth of deep paths.
+	randomTreeMaxDepth = 32
+
+	// randomTreeMaxLinks is the maximum number of hardlinks of a link group.
+	randomTreeMaxLinks = 64
+
+	// randomTreeSparseSize is the maximum size of sparse files.
+	randomTreeSparseSize = 512 << 10
+)
+
+// randomNameParts are components of names in random trees, including non-ASCII names,
+// combining characters and long names.
+var randomNameParts = []string{
+	"a", "foo", "bar.txt", ".hidden", "with space", "x.y.z", "dots..", "_-+=@,",
+	"日本語", "файл", "αβγ", "🐳whale", "é", "é", "中文 目录",
+	strings.Repeat("long", 50),
+}
+
+// randomTree is a random filesystem tree for property-based tests. This implements
+// quick.Generator.
+type randomTree struct {
+	entries     []randomEntry
+	chunkSize   int
+	prioritized []string
+}
+
+// randomEntry is an entry of randomTree. Entries are ordered so that parent directories
+// and targets of hardlinks come first.
+type randomEntry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	contents []byte // regular files
+	linkname string // symlinks and hardlinks
+}
+
+// Generate implements quick.Generator.
+func (randomTree) Generate(rnd *rand.Rand, size int) reflect.Value {
+	g := &randomTreeGenerator{rnd: rnd, used: make(map[string]bool), dirs: []string{""}}
+	n := 1 + rnd.Intn(randomTreeMaxEntries)
+	for i := 0; i < n; i++ {
+		switch k := rnd.Intn(10); {
+		case k < 2:
+			g.addDir(g.randomDir())
+		case k < 6:
+			g.addFile(g.randomDir())
+		case k < 7:
+			g.addSymlink()
+		case k < 9:
+			g.addLinkGroup()
+		default:
+			g.addDeepPath()
+		}
+	}
+	tree := randomTree{entries: g.entries}
+	tree.chunkSize = []int{0, 1 << 10, 4 << 10, 64 << 10}[rnd.Intn(4)]
+	for _, e := range tree.entries {
+		if (e.typeflag == tar.TypeReg || e.typeflag == tar.TypeLink) && rnd.Intn(4) == 0 {
+			tree.prioritized = append(tree.prioritized, e.name)
+		}
+	}
+	return reflect.ValueOf(tree)
+}
+
+// GoString summarizes the tree in failure reports of quick.Check without contents.
+func (tree randomTree) GoString() string {
+	var ents []string
+	for _, e := range tree.entries {
+		s := fmt.Sprintf("%q(%c", e.name, e.typeflag)
+		if e.typeflag == tar.TypeReg {
+			s += fmt.Sprintf(",%d bytes", len(e.contents))
+		} else if e.linkname != "" {
+			s += fmt.Sprintf(",-> %q", e.linkname)
+		}
+		ents = append(ents, s+")")
+	}
+	return fmt.Sprintf("randomTree{chunkSize: %d, prioritized: %q, entries: [%s]}",
+		tree.chunkSize, tree.prioritized, strings.Join(ents, ", "))
+}
+
+func (tree randomTree) tar(t *testing.T) *io.SectionReader {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range tree.entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     e.mode,
+			Linkname: e.linkname,
+			ModTime:  time.Unix(1600000000, 0),
+			Size:     int64(len(e.contents)),
+		}
+		if e.typeflag == tar.TypeDir {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("failed to write tar header of %q: %v", e.name, err)
+		}
+		if _, err := tw.Write(e.contents); err != nil {
+			t.Fatalf("failed to write contents of %q: %v", e.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	return io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))
+}
+
+type randomTreeGenerator struct {
+	rnd     *rand.Rand
+	entries []randomEntry
+	used    map[string]bool
+	dirs    []string
+	files   []string
+}
+
+func (g *randomTreeGenerator) randomDir() string {
+	return g.dirs[g.rnd.Intn(len(g.dirs))]
+}
+
+// newName returns an unused name under the directory.
+func (g *randomTreeGenerator) newName(dir string) string {
+	base := randomNameParts[g.rnd.Intn(len(randomNameParts))]
+	name := path.Join(dir, base)
+	for i := 1; g.used[name]; i++ {
+		name = path.Join(dir, fmt.Sprintf("%s.%d", base, i))
+	}
+	g.used[name] = true
+	return name
+}
+
+func (g *randomTreeGenerator) addDir(parent string) string {
+	name := g.newName(parent)
+	g.entries = append(g.entries, randomEntry{name: name, typeflag: tar.TypeDir, mode: 0755})
+	g.dirs = append(g.dirs, name)
+	return name
+}
+
+func (g *randomTreeGenerator) addDeepPath() {
+	dir := g.randomDir()
+	for i := g.rnd.Intn(randomTreeMaxDepth); i >= 0; i-- {
+		dir = g.addDir(dir)
+	}
+	g.addFile(dir)
+}
+
+func (g *randomTreeGenerator) addFile(dir string) string {
+	var contents []byte
+	switch g.rnd.Intn(4) {
+	case 0: // empty
+	case 1:
+		contents = g.randomBytes(g.rnd.Intn(100))
+	case 2:
+		contents = g.randomBytes(g.rnd.Intn(64 << 10))
+	default: // sparse; mostly zero with some islands of data
+		contents = make([]byte, g.rnd.Intn(randomTreeSparseSize))
+		for i := g.rnd.Intn(4); i > 0 && len(contents) > 0; i-- {
+			off := g.rnd.Intn(len(contents))
+			copy(contents[off:], g.randomBytes(g.rnd.Intn(4<<10)))
+		}
+	}
+	name := g.newName(dir)
+	mode := int64(0644)
+	if g.rnd.Intn(2) == 0 {
+		mode = 0755
+	}
+	g.entries = append(g.entries, randomEntry{name: name, typeflag: tar.TypeReg, mode: mode, contents: contents})
+	g.files = append(g.files, name)
+	return name
+}
+
+func (g *randomTreeGenerator) addSymlink() {
+	target := randomNameParts[g.rnd.Intn(len(randomNameParts))] // can be dangling
+	if len(g.files) > 0 && g.rnd.Intn(2) == 0 {
+		target = "/" + g.files[g.rnd.Intn(len(g.files))]
+	}
+	g.entries = append(g.entries, randomEntry{name: g.newName(g.randomDir()), typeflag: tar.TypeSymlink, mode: 0777, linkname: target})
+}
+
+func (g *randomTreeGenerator) addLinkGroup() {
+	var target string
+	if len(g.files) > 0 && g.rnd.Intn(2) == 0 {
+		target = g.files[g.rnd.Intn(len(g.files))]
+	} else {
+		target = g.addFile(g.randomDir())
+	}
+	n := 1 + g.rnd.Intn(4)
+	if g.rnd.Intn(4) == 0 {
+		n = randomTreeMaxLinks
+	}
+	for i := 0; i < n; i++ {
+		g.entries = append(g.entries, randomEntry{name: g.newName(g.randomDir()), typeflag: tar.TypeLink, mode: 0644, linkname: target})
+	}
+}
+
+func (g *randomTreeGenerator) randomBytes(n int) []byte {
+	b := make([]byte, n)
+	g.rnd.Read(b)
+	return b
+}
+
+// testRandomTreeRoundTrip tests that random filesystem trees survive the round trip of
+// building eStargz blobs, reading them and extracting them as tar.
+func testRandomTreeRoundTrip(t *testing.T, controllers ...TestingController) {
+	for _, cl := range controllers {
+		cl := cl
+		t.Run(fmt.Sprintf("compression=%v", cl), func(t *testing.T) {
+			t.Parallel()
+			seed := time.Now().UnixNano()
+			t.Logf("seed: %d", seed)
+			property := func(tree randomTree) bool {
+				return checkRandomTreeRoundTrip(t, cl, tree)
+			}
+			cfg := &quick.Config{MaxCount: randomTreeCount, Rand: rand.New(rand.NewSource(seed))}
+			if err := quick.Check(property, cfg); err != nil {
+				t.Errorf("round trip failed: %v", err)
+			}
+		})
+	}
+}
+
+func checkRandomTreeRoundTrip(t *testing.T, cl TestingController, tree randomTree) bool {
+	// Build
+	rc, err := Build(tree.tar(t), WithChunkSize(tree.chunkSize), WithCompression(cl), WithPrioritizedFiles(tree.prioritized))
+	if err != nil {
+		t.Logf("failed to build: %v", err)
+		return false
+	}
+	defer rc.Close()
+	buf := new(bytes.Buffer)
+	if _, err := io.Copy(buf, rc); err != nil {
+		t.Logf("failed to read the built blob: %v", err)
+		return false
+	}
+	rc.Close()
+	blob := buf.Bytes()
+	if diffID, want := rc.DiffID().String(), cl.DiffIDOf(t, blob); diffID != want {
+		t.Logf("DiffID = %q; want %q", diffID, want)
+		return false
+	}
+
+	// Read
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	r, err := Open(sr, WithDecompressors(cl))
+	if err != nil {
+		t.Logf("failed to open the blob: %v", err)
+		return false
+	}
+	if _, err := r.VerifyTOC(rc.TOCDigest()); err != nil {
+		t.Logf("failed to verify TOC: %v", err)
+		return false
+	}
+	contents := make(map[string][]byte)
+	for _, e := range tree.entries {
+		if e.typeflag == tar.TypeReg {
+			contents[e.name] = e.contents
+		}
+	}
+	for _, e := range tree.entries {
+		if !checkRandomTreeEntry(t, r, e, contents) {
+			return false
+		}
+	}
+
+	// Extract
+	urc, err := Unpack(sr, cl)
+	if err != nil {
+		t.Logf("failed to unpack: %v", err)
+		return false
+	}
+	defer urc.Close()
+	extracted := make(map[string]randomEntry)
+	tr := tar.NewReader(urc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Logf("failed to read the extracted tar: %v", err)
+			return false
+		}
+		name := cleanEntryName(h.Name)
+		if name == PrefetchLandmark || name == NoPrefetchLandmark {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Logf("failed to read %q from the extracted tar: %v", name, err)
+			return false
+		}
+		extracted[name] = randomEntry{name: name, typeflag: h.Typeflag, mode: h.Mode, contents: b, linkname: h.Linkname}
+	}
+	if len(extracted) != len(tree.entries) {
+		t.Logf("extracted %d entries; want %d", len(extracted), len(tree.entries))
+		return false
+	}
+	for _, want := range tree.entries {
+		got, ok := extracted[want.name]
+		if !ok {
+			t.Logf("%q isn't extracted", want.name)
+			return false
+		}
+		if got.typeflag != want.typeflag || got.mode != want.mode || got.linkname != want.linkname || !bytes.Equal(got.contents, want.contents) {
+			t.Logf("extracted %q (type %c, mode %o, link %q, %d bytes); want (type %c, mode %o, link %q, %d bytes)",
+				want.name, got.typeflag, got.mode, got.linkname, len(got.contents),
+				want.typeflag, want.mode, want.linkname, len(want.contents))
+			return false
+		}
+	}
+	return true
+}
+
+// checkRandomTreeEntry checks that the entry is read from the blob as generated.
+func checkRandomTreeEntry(t *testing.T, r *Reader, want randomEntry, contents map[string][]byte) bool {
+	e, ok := r.Lookup(want.name)
+	if !ok {
+		t.Logf("%q not found in the blob", want.name)
+		return false
+	}
+	switch want.typeflag {
+	case tar.TypeDir:
+		if e.Type != "dir" {
+			t.Logf("type of %q = %q; want dir", want.name, e.Type)
+			return false
+		}
+	case tar.TypeSymlink:
+		if e.Type != "symlink" || e.LinkName != want.linkname {
+			t.Logf("%q = %q -> %q; want symlink -> %q", want.name, e.Type, e.LinkName, want.linkname)
+			return false
+		}
+	case tar.TypeReg, tar.TypeLink:
+		wantContents := want.contents
+		if want.typeflag == tar.TypeLink {
+			wantContents = contents[want.linkname]
+		}
+		if e.Type != "reg" || e.Size != int64(len(wantContents)) {
+			t.Logf("%q = %q of %d bytes; want reg of %d bytes", want.name, e.Type, e.Size, len(wantContents))
+			return false
+		}
+		if e.Digest != digest.FromBytes(wantContents).String() {
+			t.Logf("digest of %q = %q; want %q", want.name, e.Digest, digest.FromBytes(wantContents))
+			return false
+		}
+		fr, err := r.OpenFile(want.name)
+		if err != nil {
+			t.Logf("failed to open %q: %v", want.name, err)
+			return false
+		}
+		got, err := io.ReadAll(fr)
+		if err != nil {
+			t.Logf("failed to read %q: %v", want.name, err)
+			return false
+		}
+		if !bytes.Equal(got, wantContents) {
+			t.Logf("contents of %q differ", want.name)
+			return false
+		}
+	}
+	return true
+}
@@ -81,6 +81,13 @@ const (
 	// to the special annotation.
 	StoreUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
 
+	// DiffIDAnnotation is an optional annotation for an image layer. This stores the
+	// digest of the uncompressed blob (i.e. DiffID) so that snapshotters can check that
+	// the layer matches the DiffID in the image config before mounting it.
+	// This annotation is valid only when it is specified in `.[]layers.annotations`
+	// of an image manifest.
+	DiffIDAnnotation = "containerd.io/snapshot/stargz/diff-id"
+
 	// PrefetchLandmark is a file entry which indicates the end position of
 	// prefetch in the stargz file.
 	PrefetchLandmark = ".prefetch.landmark"
@@ -94,10 +101,39 @@ const (
 
 // JTOC is the JSON-serialized table of contents index of the files in the stargz file.
 type JTOC struct {
-	Version int         `json:"version"`
+	Version int `json:"version"`
+
+	// PrefetchBoundary is the offset in the blob where the prioritized files end. This is
+	// used instead of landmark files when the blob is built without them. 0 means that no
+	// prefetch should occur. Readers must respect landmark files if they exist.
+	// This field is placed before Entries for allowing readers to know it before
+	// the entries are streamed.
+	PrefetchBoundary *int64 `json:"prefetchBoundary,omitempty"`
+
+	// Summary is the optional statistics of the entries. This is placed before Entries
+	// for the same reason as PrefetchBoundary.
+	Summary *TOCSummary `json:"summary,omitempty"`
+
 	Entries []*TOCEntry `json:"entries"`
 }
 
+// TOCSummary is statistics of a layer recorded in the TOC so that readers can get them
+// without walking all entries (e.g. for admission estimates).
+type TOCSummary struct {
+	// Entries is the number of entries excluding "chunk" entries.
+	Entries int64 `json:"entries"`
+
+	// RegularFiles is the number of "reg" entries.
+	RegularFiles int64 `json:"regularFiles"`
+
+	// TotalSize is the sum of the sizes of regular files.
+	TotalSize int64 `json:"totalSize"`
+
+	// PrefetchSize is the size of the prefix of the blob containing prioritized files,
+	// which is indicated by the landmark files or PrefetchBoundary.
+	PrefetchSize int64 `json:"prefetchSize"`
+}
+
 // TOCEntry is an entry in the stargz file's TOC (Table of Contents).
 type TOCEntry struct {
 	// Name is the tar entry's name. It is the complete path
@@ -169,6 +205,11 @@ type TOCEntry struct {
 	// It has the form "sha256:abcdef01234....".
 	Digest string `json:"digest,omitempty"`
 
+	// Hardlinks, for regular files, are the names of the hardlinks to this file in
+	// the order of the TOC. The file and its hardlinks share the payload so readers
+	// can use this to fetch the payload once for the whole link group.
+	Hardlinks []string `json:"hardlinks,omitempty"`
+
 	// ChunkOffset is non-zero if this is a chunk of a large,
 	// regular file. If so, the Offset is where the gzip header of
 	// ChunkSize bytes at ChunkOffset in Name begin.
@@ -185,9 +226,27 @@ type TOCEntry struct {
 	// as "sha256:0123abcd...".
 	ChunkDigest string `json:"chunkDigest,omitempty"`
 
+	// Encryption, for regular files, is non-nil if the payload is encrypted.
+	// See WithPrioritizedFilesEncryption.
+	Encryption *Encryption `json:"encryption,omitempty"`
+
 	children map[string]*TOCEntry
 }
 
+// Encryption describes how the payload of a regular file is encrypted.
+type Encryption struct {
+	// Algorithm is the cipher of the payload. Only "AES-256-CTR" is supported.
+	Algorithm string `json:"algorithm"`
+
+	// KeyID identifies the key of the payload. See KeyID.
+	KeyID string `json:"keyID"`
+
+	// IV is the initial counter block of the file. Chunks are encrypted with
+	// the key stream starting from the offset of the chunk in the file so they
+	// can be decrypted independently of each other.
+	IV []byte `json:"iv"`
+}
+
 // ModTime returns the entry's modification time.
 func (e *TOCEntry) ModTime() time.Time { return e.modTime }
 
@@ -291,6 +350,17 @@ type Compressor interface {
 	WriteTOCAndFooter(w io.Writer, off int64, toc *JTOC, diffHash hash.Hash) (tocDgst digest.Digest, err error)
 }
 
+// Padder is optionally implemented by Compressor for writing padding that is skipped on
+// decompression. This is used for aligning chunks (see Writer.Alignment).
+type Padder interface {
+	// MinPaddingSize returns the minimum size of padding that can be written.
+	MinPaddingSize() int64
+
+	// WritePadding writes exactly size bytes of padding to w. size is never smaller
+	// than MinPaddingSize.
+	WritePadding(w io.Writer, size int64) error
+}
+
 // Decompressor represents the helper mothods to be used for parsing eStargz.
 type Decompressor interface {
 	// Reader returns ReadCloser to be used for decompressing file payload.
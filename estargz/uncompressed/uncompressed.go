@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package uncompressed provides eStargz without compression. Chunks of files are plain
+// ranges of the blob so files can be lazily read without decompression.
+//
+// Combined with estargz.Writer.AppendTarLossLess, the blob is the input tar archive as-is
+// followed by the TOC JSON and the footer. Because they are placed after the end of the
+// archive, tar readers extract the same files as the original tar.
+package uncompressed
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	// FooterSize is the size of the footer
+	FooterSize = 32
+)
+
+// footerMagic identifies the footer. This must be 16 bytes.
+var footerMagic = []byte("estargz.raw.v1\x00\x00")
+
+// Compressor writes eStargz without compression.
+type Compressor struct{}
+
+// Writer returns a writer that writes chunks as-is.
+func (c *Compressor) Writer(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+// WriteTOCAndFooter writes the TOC JSON and the footer without compression. They are also
+// written to diffHash because they are part of the uncompressed blob. This makes DiffID
+// match the digest of the blob.
+func (c *Compressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if diffHash != nil {
+		w = io.MultiWriter(w, diffHash)
+	}
+	if _, err := w.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if _, err := w.Write(footerBytes(off, int64(len(tocJSON)))); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// Decompressor parses eStargz without compression.
+type Decompressor struct{}
+
+// Reader returns the passed reader as-is.
+func (d *Decompressor) Reader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+// FooterSize returns the size of the footer.
+func (d *Decompressor) FooterSize() int64 {
+	return FooterSize
+}
+
+// ParseFooter parses the footer.
+func (d *Decompressor) ParseFooter(p []byte) (blobPayloadSize, tocOffset, tocSize int64, err error) {
+	if len(p) != FooterSize {
+		return 0, 0, 0, fmt.Errorf("invalid length %d cannot be parsed", len(p))
+	}
+	if !bytes.Equal(p[16:], footerMagic) {
+		return 0, 0, 0, fmt.Errorf("invalid magic number")
+	}
+	tocOffset = int64(binary.LittleEndian.Uint64(p[0:8]))
+	tocSize = int64(binary.LittleEndian.Uint64(p[8:16]))
+	if tocOffset < 0 || tocSize < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid TOC location (offset: %d, size: %d)", tocOffset, tocSize)
+	}
+	return tocOffset, tocOffset, tocSize, nil
+}
+
+// ParseTOC parses the TOC JSON.
+func (d *Decompressor) ParseTOC(r io.Reader) (toc *estargz.JTOC, tocDgst digest.Digest, err error) {
+	dgstr := digest.Canonical.Digester()
+	toc = new(estargz.JTOC)
+	if err := json.NewDecoder(io.TeeReader(r, dgstr.Hash())).Decode(&toc); err != nil {
+		return nil, "", fmt.Errorf("error decoding TOC JSON: %w", err)
+	}
+	return toc, dgstr.Digest(), nil
+}
+
+// DecompressTOC returns the reader of the TOC JSON as-is.
+func (d *Decompressor) DecompressTOC(r io.Reader) (tocJSON io.ReadCloser, err error) {
+	return io.NopCloser(r), nil
+}
+
+// footerBytes returns the 32 bytes footer.
+func footerBytes(tocOff, tocSize int64) []byte {
+	footer := make([]byte, FooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(tocOff))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(tocSize))
+	copy(footer[16:], footerMagic)
+	return footer
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
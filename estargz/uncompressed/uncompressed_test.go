@@ -0,0 +1,137 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package uncompressed
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// TestUncompressed tests that the blob starts with the original tar archive and
+// files can be read from it.
+func TestUncompressed(t *testing.T) {
+	files := map[string]string{
+		"foo":     "foofoofoofoo",
+		"bar/baz": "bazbazbazbazbazbazbaz",
+		"empty":   "",
+	}
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "bar/", Mode: 0755}); err != nil {
+		t.Fatalf("failed to write dir: %v", err)
+	}
+	for _, name := range []string{"foo", "bar/baz", "empty"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatalf("failed to write header of %q: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(files[name])); err != nil {
+			t.Fatalf("failed to write %q: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar: %v", err)
+	}
+	tarBytes := tarBuf.Bytes()
+
+	var blobBuf bytes.Buffer
+	w := estargz.NewWriterWithCompressor(&blobBuf, new(Compressor))
+	w.ChunkSize = 4
+	if err := w.AppendTarLossLess(bytes.NewReader(tarBytes)); err != nil {
+		t.Fatalf("failed to append tar: %v", err)
+	}
+	tocDgst, err := w.Close()
+	if err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	blob := blobBuf.Bytes()
+	if !bytes.HasPrefix(blob, tarBytes) {
+		t.Fatalf("blob must start with the original tar")
+	}
+	if want := fmt.Sprintf("sha256:%x", sha256.Sum256(blob)); w.DiffID() != want {
+		t.Errorf("DiffID must be the digest of the blob %q; got %q", want, w.DiffID())
+	}
+
+	// Tar readers must see the same files as the original tar.
+	tr := tar.NewReader(bytes.NewReader(blob))
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read blob as tar: %v", err)
+		}
+		names = append(names, h.Name)
+	}
+	if len(names) != 4 {
+		t.Errorf("unexpected entries in the blob: %v", names)
+	}
+
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	r, err := estargz.Open(sr, estargz.WithDecompressors(new(Decompressor)))
+	if err != nil {
+		t.Fatalf("failed to open blob: %v", err)
+	}
+	if _, err := r.VerifyTOC(tocDgst); err != nil {
+		t.Fatalf("failed to verify TOC: %v", err)
+	}
+	if err := r.VerifyTarStructure(sr); err != nil {
+		t.Errorf("tar structure diverges from TOC: %v", err)
+	}
+	for name, want := range files {
+		fr, err := r.OpenFile(name)
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", name, err)
+		}
+		got, err := io.ReadAll(io.NewSectionReader(fr, 0, int64(len(want))+1))
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("contents of %q = %q; want %q", name, got, want)
+		}
+		// Chunks must be plain ranges of the blob.
+		if ent, ok := r.Lookup(name); ok && ent.ChunkSize > 0 {
+			if got := string(blob[ent.Offset : ent.Offset+ent.ChunkSize]); got != want[:ent.ChunkSize] {
+				t.Errorf("first chunk of %q isn't a plain range: %q", name, got)
+			}
+		}
+	}
+}
+
+func TestParseFooter(t *testing.T) {
+	d := new(Decompressor)
+	payloadSize, tocOff, tocSize, err := d.ParseFooter(footerBytes(100, 20))
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	if payloadSize != 100 || tocOff != 100 || tocSize != 20 {
+		t.Errorf("unexpected footer (%d, %d, %d)", payloadSize, tocOff, tocSize)
+	}
+	if _, _, _, err := d.ParseFooter(make([]byte, FooterSize)); err == nil {
+		t.Errorf("footer without magic must be rejected")
+	}
+	if _, _, _, err := d.ParseFooter(footerBytes(100, 20)[1:]); err == nil {
+		t.Errorf("footer with invalid length must be rejected")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"math"
 	"sync"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -147,6 +148,47 @@ func (w *poolEncoder) Close() error {
 	return nil
 }
 
+func (zc *Compressor) MinPaddingSize() int64 {
+	return 8 // the size of the zstd skippable frame header + the frame size
+}
+
+// WritePadding writes zstd skippable frames filled with zeros.
+func (zc *Compressor) WritePadding(w io.Writer, size int64) error {
+	const maxFrameSize = 8 + math.MaxUint32
+	for size > 0 {
+		n := size
+		if n > maxFrameSize {
+			n = maxFrameSize
+			if size-n < 8 {
+				n = size - 8 // leave enough for the last frame
+			}
+		}
+		if n < 8 {
+			return fmt.Errorf("padding size %d is smaller than 8", n)
+		}
+		header := make([]byte, 8)
+		copy(header, skippableFrameMagic)
+		binary.LittleEndian.PutUint32(header[4:], uint32(n-8))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, zeroReader{}, n-8); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 func (zc *Compressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
 	tocJSON, err := json.MarshalIndent(toc, "", "\t")
 	if err != nil {
@@ -0,0 +1,180 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package bundle provides a portable format of the on-node state of remote snapshots.
+//
+// A bundle is a directory containing a manifest and the contents of layer blobs that
+// have been fetched to the node. Contents that haven't been fetched are left as holes in
+// the blob files. The bundle can be copied to another node and served by the
+// ResolveHandler so that the snapshots can be mounted there without accessing registries.
+// Metadata of the layers isn't contained; it's rebuilt from the TOC in the blobs on
+// mounting each layer.
+//
+//	<dir>/manifest.json
+//	<dir>/blobs/<algorithm>/<encoded digest>
+package bundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ManifestName is the name of the manifest file in a bundle.
+const ManifestName = "manifest.json"
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	// Snapshots is the chain of the frozen snapshots ordered from the top to the bottom.
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Snapshot is a snapshot contained in a bundle.
+type Snapshot struct {
+	Key    string            `json:"key"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Layer is the layer mounted as this snapshot. This is nil if the snapshot isn't
+	// a remote snapshot. The contents of such snapshots aren't contained in the bundle.
+	Layer *Layer `json:"layer,omitempty"`
+}
+
+// Layer is a layer blob contained in a bundle.
+type Layer struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+
+	// Regions are the sorted ranges of the blob contained in the bundle.
+	Regions []remote.Region `json:"regions"`
+}
+
+// BlobPath returns the path to the blob of the specified digest in the bundle.
+func BlobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// ReadManifest reads the manifest of the bundle at dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m Manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode bundle manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteManifest writes the manifest to the bundle at dir.
+func WriteManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestName), b, 0600)
+}
+
+// ResolveHandler is a remote.Handler that serves layer blobs from a bundle. Reading
+// contents that aren't contained in the bundle fails.
+type ResolveHandler struct {
+	dir    string
+	layers map[digest.Digest]*Layer
+}
+
+// NewResolveHandler returns a handler serving layers contained in the bundle at dir.
+func NewResolveHandler(dir string) (*ResolveHandler, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	layers := make(map[digest.Digest]*Layer)
+	for _, s := range m.Snapshots {
+		if s.Layer != nil {
+			layers[s.Layer.Digest] = s.Layer
+		}
+	}
+	return &ResolveHandler{dir, layers}, nil
+}
+
+func (h *ResolveHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	l, ok := h.layers[desc.Digest]
+	if !ok {
+		return nil, 0, fmt.Errorf("layer %v isn't contained in bundle %q", desc.Digest, h.dir)
+	}
+	f := &fetcher{path: BlobPath(h.dir, l.Digest), layer: l}
+	if err := f.Check(); err != nil {
+		return nil, 0, err
+	}
+	return f, l.Size, nil
+}
+
+type fetcher struct {
+	path  string
+	layer *Layer
+}
+
+func (f *fetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	if !f.contains(off, size) {
+		return nil, fmt.Errorf("range [%d, %d) of layer %v isn't contained in the bundle",
+			off, off+size, f.layer.Digest)
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		Reader:    io.NewSectionReader(file, off, size),
+		closeFunc: file.Close,
+	}, nil
+}
+
+// contains reports whether the range is fully contained in the bundle. Regions are
+// sorted and merged so the range needs to be contained in a single region.
+func (f *fetcher) contains(off int64, size int64) bool {
+	for _, reg := range f.layer.Regions {
+		if reg.Offset <= off && off+size <= reg.Offset+reg.Size {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fetcher) Check() error {
+	_, err := os.Stat(f.path)
+	return err
+}
+
+func (f *fetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("bundle-%s-%d-%d", f.layer.Digest, off, size)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (r *readCloser) Close() error { return r.closeFunc() }
@@ -0,0 +1,208 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	"github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestResolveHandler(t *testing.T) {
+	contents := []byte("0123456789abcdefghij")
+	dgst := digest.FromBytes(contents)
+	dir := t.TempDir()
+
+	// Only [0, 5) and [10, 15) are contained in the bundle.
+	blob := make([]byte, len(contents))
+	copy(blob[0:5], contents[0:5])
+	copy(blob[10:15], contents[10:15])
+	p := BlobPath(dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Snapshots: []Snapshot{
+		{Key: "upper"},
+		{Key: "lower", Layer: &Layer{
+			Digest:  dgst,
+			Size:    int64(len(contents)),
+			Regions: []remote.Region{{Offset: 0, Size: 5}, {Offset: 10, Size: 5}},
+		}},
+	}}
+	if err := WriteManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewResolveHandler(dir)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	if _, _, err := h.Handle(context.Background(), ocispec.Descriptor{Digest: digest.FromString("dummy")}); err == nil {
+		t.Fatalf("layer not contained in the bundle must not be handled")
+	}
+	f, size, err := h.Handle(context.Background(), ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		t.Fatalf("failed to handle layer: %v", err)
+	}
+	if size != int64(len(contents)) {
+		t.Fatalf("size = %d; want %d", size, len(contents))
+	}
+	tests := []struct {
+		off, size int64
+		ok        bool
+	}{
+		{off: 0, size: 5, ok: true},
+		{off: 11, size: 3, ok: true},
+		{off: 3, size: 5, ok: false},
+		{off: 0, size: 15, ok: false},
+		{off: 15, size: 5, ok: false},
+	}
+	for _, tt := range tests {
+		rc, err := f.Fetch(context.Background(), tt.off, tt.size)
+		if !tt.ok {
+			if err == nil {
+				rc.Close()
+				t.Errorf("range [%d, %d) must not be served", tt.off, tt.off+tt.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to fetch [%d, %d): %v", tt.off, tt.off+tt.size, err)
+			continue
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := contents[tt.off : tt.off+tt.size]; !bytes.Equal(got, want) {
+			t.Errorf("fetched %q; want %q", got, want)
+		}
+	}
+}
+
+// TestRebuildMetadata checks that metadata of a layer is rebuilt from a bundle that
+// contains only the TOC of the layer, which is fetched on mounting the layer.
+func TestRebuildMetadata(t *testing.T) {
+	h, dgst, size := makeTOCOnlyBundle(t, 10)
+	mr, err := openMetadata(h, dgst, size)
+	if err != nil {
+		t.Fatalf("failed to rebuild metadata from the bundle: %v", err)
+	}
+	defer mr.Close()
+	if _, _, err := mr.GetChild(mr.RootID(), "file9"); err != nil {
+		t.Errorf("file isn't found in the rebuilt metadata: %v", err)
+	}
+}
+
+// BenchmarkRebuildMetadata measures the cost of rebuilding metadata of a layer from a
+// bundle, which is paid on mounting each layer on the node where the bundle is served.
+func BenchmarkRebuildMetadata(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("%d-files", n), func(b *testing.B) {
+			h, dgst, size := makeTOCOnlyBundle(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mr, err := openMetadata(h, dgst, size)
+				if err != nil {
+					b.Fatalf("failed to rebuild metadata from the bundle: %v", err)
+				}
+				mr.Close()
+			}
+		})
+	}
+}
+
+// makeTOCOnlyBundle makes a bundle containing only the TOC and the footer of an eStargz
+// layer with n files.
+func makeTOCOnlyBundle(t testing.TB, n int) (*ResolveHandler, digest.Digest, int64) {
+	ents := make([]testutil.TarEntry, n)
+	for i := range ents {
+		ents[i] = testutil.File(fmt.Sprintf("file%d", i), fmt.Sprintf("contents of file %d", i))
+	}
+	sr, _, err := testutil.BuildEStargz(ents)
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	tocOffset, _, err := estargz.OpenFooter(sr)
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	blob, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(blob)
+	dir := t.TempDir()
+	p := BlobPath(dir, dgst)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	frozen := make([]byte, len(blob))
+	copy(frozen[tocOffset:], blob[tocOffset:])
+	if err := os.WriteFile(p, frozen, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Snapshots: []Snapshot{{Key: "layer", Layer: &Layer{
+		Digest:  dgst,
+		Size:    sr.Size(),
+		Regions: []remote.Region{{Offset: tocOffset, Size: sr.Size() - tocOffset}},
+	}}}}
+	if err := WriteManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewResolveHandler(dir)
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+	return h, dgst, sr.Size()
+}
+
+func openMetadata(h *ResolveHandler, dgst digest.Digest, size int64) (metadata.Reader, error) {
+	f, _, err := h.Handle(context.Background(), ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	ra := readerAtFunc(func(p []byte, off int64) (int, error) {
+		rc, err := f.Fetch(context.Background(), off, int64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.ReadFull(rc, p)
+	})
+	return memory.NewReader(io.NewSectionReader(ra, 0, size))
+}
+
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) { return f(p, off) }
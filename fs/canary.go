@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+const (
+	canaryModeFallback = "fallback"
+	canaryModeFail     = "fail"
+)
+
+// canary forces layers of images matching pattern to fall back or fail on this node.
+type canary struct {
+	pattern string
+	fail    bool
+}
+
+// newCanaries returns the canaries selecting the node of the hostname.
+func newCanaries(cfgs []config.CanaryConfig, hostname string) ([]canary, error) {
+	var res []canary
+	for _, c := range cfgs {
+		if _, err := matchImage(c.ImagePattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid image pattern %q of canary: %w", c.ImagePattern, err)
+		}
+		if c.Mode != canaryModeFallback && c.Mode != canaryModeFail {
+			return nil, fmt.Errorf("unknown canary mode %q; must be %q or %q", c.Mode, canaryModeFallback, canaryModeFail)
+		}
+		if c.NodePercent < 0 || c.NodePercent > 100 {
+			return nil, fmt.Errorf("node percent of canary must be 0 to 100; got %d", c.NodePercent)
+		}
+		if selectsNode(c, hostname) {
+			res = append(res, canary{pattern: c.ImagePattern, fail: c.Mode == canaryModeFail})
+		}
+	}
+	return res, nil
+}
+
+func selectsNode(c config.CanaryConfig, hostname string) bool {
+	for _, n := range c.Nodes {
+		if n == hostname {
+			return true
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return int(h.Sum32()%100) < c.NodePercent
+}
+
+// matchImage reports whether the image reference matches the pattern in the syntax of
+// path.Match except that "*" also matches "/" so that "ghcr.io/*" matches all images of
+// the registry.
+func matchImage(pattern, ref string) (bool, error) {
+	// path.Match doesn't match "/" with "*" so separators are replaced with a byte that
+	// never appears in references.
+	return path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(ref, "/", "\x00"))
+}
+
+// checkCanary returns an error if the image is forced to take the fallback or the failure
+// path on this node. Errors of the failure path prevent the snapshotter from falling back.
+func checkCanary(canaries []canary, ref string) error {
+	for _, c := range canaries {
+		if ok, _ := matchImage(c.pattern, ref); c.pattern != "" && !ok {
+			continue
+		}
+		if c.fail {
+			return fmt.Errorf("canary: image %q is forced to fail: %w", ref, snapshot.ErrNoFallback)
+		}
+		return fmt.Errorf("canary: image %q is forced to fall back", ref)
+	}
+	return nil
+}
+
+// CheckCanary returns an error if layers of the image are forced to take the fallback or
+// the failure path on the node of the hostname by the canaries in the config.
+func CheckCanary(cfgs []config.CanaryConfig, hostname, ref string) error {
+	canaries, err := newCanaries(cfgs, hostname)
+	if err != nil {
+		return err
+	}
+	return checkCanary(canaries, ref)
+}
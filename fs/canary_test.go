@@ -0,0 +1,76 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+func TestCanary(t *testing.T) {
+	cfgs := []config.CanaryConfig{
+		{ImagePattern: "ghcr.io/canary/*", Mode: "fail", Nodes: []string{"node-a"}},
+		{ImagePattern: "ghcr.io/*", Mode: "fallback", Nodes: []string{"node-a", "node-b"}},
+		{Mode: "fail", NodePercent: 100},
+	}
+	tests := []struct {
+		hostname     string
+		ref          string
+		wantFallback bool
+		wantFail     bool
+	}{
+		{hostname: "node-a", ref: "ghcr.io/canary/app:1", wantFail: true},
+		{hostname: "node-a", ref: "ghcr.io/other/app:1", wantFallback: true},
+		{hostname: "node-b", ref: "ghcr.io/canary/app:1", wantFallback: true},
+		{hostname: "node-c", ref: "ghcr.io/canary/app:1", wantFail: true},
+	}
+	for _, tt := range tests {
+		canaries, err := newCanaries(cfgs, tt.hostname)
+		if err != nil {
+			t.Fatalf("failed to create canaries: %v", err)
+		}
+		err = checkCanary(canaries, tt.ref)
+		if gotFail := errors.Is(err, snapshot.ErrNoFallback); gotFail != tt.wantFail {
+			t.Errorf("%s on %s: fail = %v; want %v (err: %v)", tt.ref, tt.hostname, gotFail, tt.wantFail, err)
+		}
+		if gotFallback := err != nil && !errors.Is(err, snapshot.ErrNoFallback); gotFallback != tt.wantFallback {
+			t.Errorf("%s on %s: fallback = %v; want %v (err: %v)", tt.ref, tt.hostname, gotFallback, tt.wantFallback, err)
+		}
+	}
+
+	// No node is selected with 0%.
+	canaries, err := newCanaries([]config.CanaryConfig{{Mode: "fallback"}}, "node-a")
+	if err != nil {
+		t.Fatalf("failed to create canaries: %v", err)
+	}
+	if err := checkCanary(canaries, "ghcr.io/app:1"); err != nil {
+		t.Errorf("canary must not be applied to unselected nodes: %v", err)
+	}
+
+	for _, c := range []config.CanaryConfig{
+		{Mode: "unknown"},
+		{Mode: "fail", NodePercent: 101},
+		{ImagePattern: "[", Mode: "fail"},
+	} {
+		if _, err := newCanaries([]config.CanaryConfig{c}, "node-a"); err == nil {
+			t.Errorf("invalid canary %+v must be rejected", c)
+		}
+	}
+}
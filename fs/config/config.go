@@ -31,6 +31,31 @@ const (
 	// the layer. If the layer is eStargz and contains prefetch landmarks, these config
 	// will be respeced.
 	TargetPrefetchSizeLabel = "containerd.io/snapshot/remote/stargz.prefetch"
+
+	// TargetPinnedLabel is a snapshot label key that indicates to keep the layer and its
+	// cached contents from being evicted.
+	TargetPinnedLabel = "containerd.io/snapshot/remote/stargz.pinned"
+
+	// TargetReadPriorityLabel is a snapshot label key that specifies the priority class
+	// ("normal" or "low") of on-demand reads of the layer.
+	TargetReadPriorityLabel = "containerd.io/snapshot/remote/stargz.read-priority"
+
+	// TargetDevicePolicyLabel is a snapshot label key that specifies the policy of device
+	// nodes and FIFOs in the layer ("expose", "mask" or "empty").
+	TargetDevicePolicyLabel = "containerd.io/snapshot/remote/stargz.device-policy"
+
+	// TargetBackgroundFetchBudgetLabel is a snapshot label key that overrides
+	// BackgroundFetchBudget for the layer.
+	TargetBackgroundFetchBudgetLabel = "containerd.io/snapshot/remote/stargz.background-fetch-budget"
+
+	// TargetImageBackgroundFetchBudgetLabel is a snapshot label key that overrides
+	// ImageBackgroundFetchBudget for the image of the layer.
+	TargetImageBackgroundFetchBudgetLabel = "containerd.io/snapshot/remote/stargz.image-background-fetch-budget"
+
+	// TargetSignatureLabel is a snapshot label key that passes the status of the signature
+	// of the image (e.g. "verified") checked by the client pulling the image to the mount
+	// policy.
+	TargetSignatureLabel = "containerd.io/snapshot/remote/stargz.signature"
 )
 
 type Config struct {
@@ -50,15 +75,188 @@ type Config struct {
 	MaxConcurrency           int64 `toml:"max_concurrency"`
 	NoPrometheus             bool  `toml:"no_prometheus"`
 
+	// BackgroundFetchBudget limits the bytes fetched from the registry in background per
+	// layer, either in bytes (e.g. "1048576") or in the percentage of the layer size
+	// (e.g. "30%"). The rest of the layer is fetched only on demand. Empty means no limit.
+	BackgroundFetchBudget string `toml:"background_fetch_budget"`
+
+	// ImageBackgroundFetchBudget is the same as BackgroundFetchBudget but is shared
+	// among the layers of an image. The percentage is of the total size of the layers.
+	ImageBackgroundFetchBudget string `toml:"image_background_fetch_budget"`
+
+	// VerifyTarStructure enables to check the tar headers of each layer against its TOC
+	// when background fetch fetches the first chunk of each regular file. Headers following
+	// the last regular file with payload aren't checked.
+	VerifyTarStructure bool `toml:"verify_tar_structure"`
+
+	// VerifyDiffID enables to check that each layer matches the DiffID annotated to it
+	// (estargz.DiffIDAnnotation). The annotated DiffID is checked against the chain ID of
+	// the snapshot before mounting and the uncompressed contents are checked against it
+	// after the entire layer is fetched in background.
+	VerifyDiffID bool `toml:"verify_diff_id"`
+
+	// LazyLayerSizeThreshold is the size (in bytes) under which layers aren't mounted
+	// lazily but pulled and extracted normally. 0 means all layers are mounted lazily.
+	LazyLayerSizeThreshold int64 `toml:"lazy_layer_size_threshold"`
+
+	// RegistryProbeIntervalSec is the interval (in sec) to periodically validate that
+	// registries serving the mounted layers still support lazy pulling (connectivity,
+	// authorization, range requests and TOC availability). 0 disables probing.
+	RegistryProbeIntervalSec int64 `toml:"registry_probe_interval_sec"`
+
+	// DecompressionChain is a list of outer compression codecs ("gzip" or "zstd") that
+	// can wrap an eStargz blob. When a blob can't be parsed as-is, the filesystem detects
+	// one of these envelopes and streams the blob through it to get the inner blob.
+	// Empty list disables this feature.
+	DecompressionChain []string `toml:"decompression_chain"`
+
+	// PathPolicy specifies how to deal with entry names in TOCs that aren't valid UTF-8
+	// or contain NUL or control characters: "allow" (default) uses them as-is, "reject"
+	// fails to mount such layers and "sanitize" replaces invalid bytes with "%XX".
+	PathPolicy string `toml:"path_policy"`
+
+	// ShareChunksAcrossLayers makes layers take chunks from caches of other layers having
+	// chunks of the same digest instead of fetching them. This is effective for images
+	// built with content-defined chunking, whose chunks are mostly shared among versions.
+	ShareChunksAcrossLayers bool `toml:"share_chunks_across_layers"`
+
+	// StrictVerify verifies chunks every time they are served from the cache, instead of
+	// trusting chunks verified when they were fetched (e.g. by prefetch). Unverified layers
+	// aren't mounted in this mode.
+	StrictVerify bool `toml:"strict_verify"`
+
+	// ZeroCopyRead serves reads of data stored in cache files by passing the descriptors of
+	// the files to FUSE, which splices the data without copying it through the snapshotter.
+	// This has no effect with StrictVerify.
+	ZeroCopyRead bool `toml:"zero_copy_read"`
+
+	// CacheDir is the directory where caches and per-layer states (e.g. access stats) are
+	// stored. This allows placing them on a volume (e.g. provided by CSI) other than the root
+	// directory, which needs to be shared with the host only for mountpoints. Empty uses the
+	// root directory.
+	CacheDir string `toml:"cache_dir"`
+
+	// SpanChunks is the number of consecutive chunks of a file decompressed and cached
+	// together when one of them is read on demand. 0 or 1 caches only the requested chunk.
+	SpanChunks int `toml:"span_chunks"`
+
+	// MetadataCacheSizeMB is the memory budget (estimated from the number of files) of
+	// parsed metadata of layers shared among mounts. Mounts of a cached layer reuse the
+	// parsed metadata instead of parsing the TOC again. 0 disables this.
+	MetadataCacheSizeMB int64 `toml:"metadata_cache_size_mb"`
+
+	// ReadAttribution logs each on-demand read at debug level with the PID and the command
+	// name of the process that requested it, and the number of bytes fetched from the registry
+	// while serving it.
+	ReadAttribution bool `toml:"read_attribution"`
+
+	// SBOMPrefetch prefetches files listed in the SBOM (SPDX or CycloneDX) attached to the
+	// image as a referrer, for layers that don't indicate prioritized files (i.e. layers of
+	// images that aren't optimized).
+	SBOMPrefetch bool `toml:"sbom_prefetch"`
+
+	// XattrPolicies restrict extended attributes exposed to containers. The first policy
+	// whose ImagePattern matches the image is applied to its layers.
+	XattrPolicies []XattrPolicy `toml:"xattr_policy"`
+
+	// Canaries force layers of specific images to take the fallback or the failure path on
+	// a subset of nodes, for canary testing of behavior changes. The first canary whose
+	// ImagePattern matches the image and that selects this node is applied.
+	Canaries []CanaryConfig `toml:"canary"`
+
+	// PinnedImages are patterns (in the syntax of path.Match) of image references whose
+	// layers are exempted from eviction, e.g. images pinned in containerd or by CRI.
+	PinnedImages []string `toml:"pinned_images"`
+
+	// LowPriorityReadConcurrency is the number of on-demand reads of layers in the "low"
+	// read priority class that can fetch contents from the registry at once. (default 1)
+	LowPriorityReadConcurrency int64 `toml:"low_priority_read_concurrency"`
+
+	// CacheFillConcurrency is the number of chunks that can be fetched to the cache at
+	// once by prefetch and background fetch of all layers. Requests of the same chunk
+	// are deduplicated. (default: the number of CPUs)
+	CacheFillConcurrency int `toml:"cache_fill_concurrency"`
+
+	// BlocksPolicy is the policy of st_blocks (i.e. the allocated size shown by du)
+	// reported for files in layers. "apparent" (default) reports the size of files,
+	// "fetched" reports the size of the contents of regular files already fetched to the
+	// cache and "zero" reports zero for all files.
+	BlocksPolicy string `toml:"blocks_policy"`
+
+	// DevicePolicy is the policy of device nodes and FIFOs in layers. "expose" (default)
+	// exposes them as they are, "mask" hides them and "empty" replaces them with empty
+	// regular files. This can be overridden for each mount by TargetDevicePolicyLabel.
+	DevicePolicy string `toml:"device_policy"`
+
+	// EgressAccounting records the bytes fetched from registries for each containerd
+	// namespace, image and registry to a file under the root directory, for charging the
+	// egress from registries back to workloads. The records are kept across restarts and
+	// exported as Prometheus metrics and through the debug socket as CSV.
+	EgressAccounting bool `toml:"egress_accounting"`
+
+	// DecryptionKeysDir is the directory containing keys (32 bytes each, one per file)
+	// of layers whose prioritized files are encrypted by ctr-remote. Encrypted files
+	// of layers whose keys aren't in this directory can't be read.
+	DecryptionKeysDir string `toml:"decryption_keys_dir"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
 	// DirectoryCacheConfig is config for directory-based cache.
 	DirectoryCacheConfig `toml:"directory_cache"`
 
+	// HotChunkCache is config for keeping frequently read file contents on tmpfs.
+	HotChunkCache HotChunkCacheConfig `toml:"hot_chunk_cache"`
+
+	// EagerBoot is config for fetching layers eagerly on freshly provisioned nodes.
+	EagerBoot EagerBootConfig `toml:"eager_boot"`
+
+	// Decompression is config for the pool of workers decompressing contents of layers.
+	Decompression DecompressionConfig `toml:"decompression"`
+
+	// MountPolicy is config for consulting a policy engine before mounting layers lazily.
+	MountPolicy MountPolicyConfig `toml:"mount_policy"`
+
+	// MountBackend is the kernel interface through which layers are mounted. "fuse"
+	// (default) mounts layers with FUSE. "fscache" mounts layers as erofs through fscache
+	// in on-demand mode if the kernel supports it (Linux 5.19+), falling back to FUSE
+	// otherwise. Contents are fetched and cached in the same way with both backends.
+	MountBackend string `toml:"mount_backend"`
+
+	// FscacheConfig is config for the fscache mount backend.
+	FscacheConfig `toml:"fscache"`
+
 	FuseConfig `toml:"fuse"`
 }
 
+// XattrPolicy is an allow/deny policy of extended attribute names. Patterns follow the
+// syntax of path.Match. A name matching Allow is always exposed. Otherwise, a name matching
+// Deny is hidden. If Allow is not empty, names matching none of the patterns are hidden too.
+type XattrPolicy struct {
+	// ImagePattern is matched against the image reference (e.g. "docker.io/library/ubuntu:20.04").
+	// Empty pattern matches all images.
+	ImagePattern string   `toml:"image_pattern"`
+	Allow        []string `toml:"allow"`
+	Deny         []string `toml:"deny"`
+}
+
+// CanaryConfig forces layers of images matching ImagePattern to take the path specified
+// by Mode on the selected nodes. A node is selected if its hostname is listed in Nodes or if
+// it's in NodePercent percent of nodes chosen by the hash of the hostname.
+type CanaryConfig struct {
+	// ImagePattern is matched against the image reference with the syntax of path.Match
+	// except that "*" also matches "/" (e.g. "ghcr.io/*" matches "ghcr.io/org/app:1").
+	// Empty pattern matches all images.
+	ImagePattern string `toml:"image_pattern"`
+
+	// Mode is "fallback" to pull layers normally instead of lazily, or "fail" to fail
+	// preparing snapshots without falling back.
+	Mode string `toml:"mode"`
+
+	Nodes       []string `toml:"nodes"`
+	NodePercent int      `toml:"node_percent"`
+}
+
 type BlobConfig struct {
 	ValidInterval int64 `toml:"valid_interval"`
 	CheckAlways   bool  `toml:"check_always"`
@@ -76,6 +274,97 @@ type BlobConfig struct {
 	MaxRetries  int `toml:"max_retries"`
 	MinWaitMSec int `toml:"min_wait_msec"`
 	MaxWaitMSec int `toml:"max_wait_msec"`
+
+	// MaxFetchResumes is the number of times an interrupted fetch is resumed from
+	// the remaining chunks instead of being restarted from scratch. 0 disables resuming.
+	// (default 3)
+	MaxFetchResumes *int `toml:"max_fetch_resumes"`
+
+	// VerifyChunksOnFetch verifies each chunk against the TOC while it's downloaded,
+	// before it's stored in the cache. A corrupted transfer is aborted and retried as soon
+	// as a mismatching chunk is found and the error tells the byte range of the chunk.
+	// This is enabled only for layers whose TOC is verified.
+	VerifyChunksOnFetch bool `toml:"verify_chunks_on_fetch"`
+
+	// UseContainerdFetcher makes the snapshotter fetch blobs from registries through
+	// containerd's remotes.Fetcher (the one used by containerd for pulling images)
+	// instead of its own HTTP fetcher. This requires the layer size in the snapshot
+	// labels and ForceSingleRangeMode is implied.
+	UseContainerdFetcher bool `toml:"use_containerd_fetcher"`
+
+	// DigestAddressedHosts are the registry hosts (e.g. "registry-1.docker.io" or a
+	// mirror) serving blobs with the digest as the strong ETag. Chunk requests to these
+	// hosts carry the digest as the validator and a hint that the contents are immutable
+	// so that HTTP caches and proxies in between can serve the cached ranges without
+	// revalidating them with the host.
+	DigestAddressedHosts []string `toml:"digest_addressed_hosts"`
+
+	// SourceChain is the ordered list of sources that contents of blobs are fetched from
+	// on cache misses. Each fetch falls back to the next source when a source fails or
+	// is disabled at that time. Empty uses resolve handlers, then the registry hosts
+	// (mirrors followed by the origin) as before.
+	SourceChain []SourceConfig `toml:"source_chain"`
+
+	// FaultInjection injects faults into fetching blobs. This is meant for testing the
+	// behavior under registry degradation and must not be enabled in production.
+	FaultInjection FaultInjectionConfig `toml:"fault_injection"`
+
+	// Offline configures the offline mode where mounted layers keep serving the cached
+	// contents while registries are unreachable.
+	Offline OfflineConfig `toml:"offline"`
+}
+
+// SourceConfig is a source of blob contents in BlobConfig.SourceChain.
+type SourceConfig struct {
+	// Type is the type of the source. "handler" is resolve handlers (e.g. peer caches or
+	// IPFS), "mirror" is the registry hosts other than the origin and "origin" is the
+	// registry of the image reference.
+	Type string `toml:"type"`
+
+	// Name limits the "handler" source to the handler of the name.
+	Name string `toml:"name"`
+
+	// TimeoutMSec is the time to wait for the source to start responding to a fetch
+	// before falling back to the next source. 0 means no timeout.
+	TimeoutMSec int64 `toml:"timeout_msec"`
+
+	// DisabledHours is the range of hours in the local time when the source isn't used,
+	// in the format of "<start>-<end>" (e.g. "9-17" disables the source from 9:00 to
+	// 16:59). The range can wrap around midnight (e.g. "22-6").
+	DisabledHours string `toml:"disabled_hours"`
+}
+
+// FaultInjectionConfig configures faults injected into each fetch of blob contents.
+// Probabilities are in the range of 0.0 (never) to 1.0 (always) and applied independently.
+type FaultInjectionConfig struct {
+	// DelayProbability is the probability to delay a fetch by DelayMSec.
+	DelayProbability float64 `toml:"delay_probability"`
+	DelayMSec        int64   `toml:"delay_msec"`
+
+	// ErrorProbability is the probability to fail a fetch.
+	ErrorProbability float64 `toml:"error_probability"`
+
+	// TruncateProbability is the probability to cut a fetched response off in the middle.
+	TruncateProbability float64 `toml:"truncate_probability"`
+}
+
+// OfflineConfig configures the offline mode. While offline, reads of contents that aren't
+// cached fail immediately with ENETUNREACH instead of waiting for the registry, and the
+// wanted chunks are fetched once the registry becomes reachable again.
+type OfflineConfig struct {
+	// Mode is "disabled" (default), "auto" or "on". "auto" goes offline when fetches
+	// fail FailureThreshold times in a row because the registry is unreachable, and
+	// goes back online once the registry responds again. "on" stays offline until the
+	// operator changes the mode.
+	Mode string `toml:"mode"`
+
+	// FailureThreshold is the number of consecutive failures of fetches in "auto" mode
+	// to go offline. (default 3)
+	FailureThreshold int `toml:"failure_threshold"`
+
+	// ProbeIntervalSec is the interval to check whether the registry is reachable again
+	// while offline in "auto" mode. (default 10)
+	ProbeIntervalSec int64 `toml:"probe_interval_sec"`
 }
 
 type DirectoryCacheConfig struct {
@@ -83,6 +372,94 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct" default:"true"`
+
+	// TierDirs are directories to store the cache, ordered from the one on the fastest
+	// storage device to the one on the slowest. Prefetched contents and contents read on
+	// demand are stored on the first one and contents fetched in background are stored
+	// on the last one. Empty list uses the root directory of the filesystem.
+	TierDirs []string `toml:"tier_dirs"`
+
+	// SmallObjectMaxSize is the size in bytes up to which chunks in the fs cache are
+	// stored in a key-value database per layer, instead of being stored as individual
+	// files. This saves space and inodes taken by tiny chunks. 0 disables this.
+	SmallObjectMaxSize int64 `toml:"small_object_max_size"`
+
+	// PersistAccessStats records hit counts and last access times of each chunk in the
+	// fs cache to a sidecar file per layer under the root directory. The file is kept
+	// across restarts so eviction policies and access heatmaps can use the history.
+	PersistAccessStats bool `toml:"persist_access_stats"`
+}
+
+// HotChunkCacheConfig is config for keeping decompressed chunks read repeatedly from the
+// fs cache in a bounded region on tmpfs. This helps workloads whose reads defeat the
+// page cache (e.g. random reads over huge files).
+type HotChunkCacheConfig struct {
+	// Dir is the directory on tmpfs where the chunks are stored. Empty disables this.
+	Dir string `toml:"dir"`
+
+	// MaxSizeMB is the maximum size of the chunks stored per layer.
+	MaxSizeMB int64 `toml:"max_size_mb"`
+
+	// MinHits is the number of reads of a chunk from the fs cache after which the
+	// chunk is stored on tmpfs (default: 2).
+	MinHits int `toml:"min_hits"`
+}
+
+// EagerBootConfig configures the first-boot eager mode. While the mode is active, every
+// mounted layer is entirely fetched in background without budgets and without yielding to
+// on-demand reads, even if background fetch is disabled. The mode ends automatically after
+// the period since the snapshotter first started on the node or once the cache reaches
+// the size, whichever comes first. If neither is specified, the period is 1 hour.
+type EagerBootConfig struct {
+	Enable bool `toml:"enable"`
+
+	// PeriodSec is the period (in sec) since the first start of the snapshotter on the
+	// node during which the mode is active. 0 means no limit of time.
+	PeriodSec int64 `toml:"period_sec"`
+
+	// CacheSizeMB ends the mode once the size of the cache directory reaches this size.
+	// 0 means no limit of size.
+	CacheSizeMB int64 `toml:"cache_size_mb"`
+}
+
+// DecompressionConfig configures the pool of workers decompressing contents of layers.
+// When enabled, on-demand reads and background fetches of all layers share the bounded
+// number of workers of each codec, instead of decompressing contents in the goroutines
+// serving them. On-demand reads are given priority over background fetches.
+type DecompressionConfig struct {
+	// Workers is the number of workers of each codec. 0 decompresses contents in the
+	// serving goroutines without the pool.
+	Workers int `toml:"workers"`
+
+	// CodecWorkers overrides the number of workers of the codecs ("gzip", "zstd" or
+	// "uncompressed").
+	CodecWorkers map[string]int `toml:"codec_workers"`
+
+	// CgroupCPUMax limits the CPU time of the workers with the cgroup v2 "cpu.max" value
+	// (e.g. "200000 100000" for 2 CPUs). The workers are moved to a threaded child of the
+	// cgroup of the snapshotter. Empty means no limit.
+	CgroupCPUMax string `toml:"cgroup_cpu_max"`
+}
+
+// MountPolicyConfig is config for consulting a policy engine before mounting each layer
+// lazily. Layers denied by the policy aren't mounted and are pulled without lazy pulling.
+type MountPolicyConfig struct {
+	// OPAURL is the URL of the decision of Open Policy Agent queried through its Data API
+	// (e.g. "http://127.0.0.1:8181/v1/data/stargz/mount/allow"). Empty disables the policy.
+	OPAURL string `toml:"opa_url"`
+
+	// TimeoutMSec is the time to wait for the decision. 0 uses 5 seconds.
+	TimeoutMSec int64 `toml:"timeout_msec"`
+
+	// FailOpen allows mounting layers lazily when the policy can't be evaluated. By default,
+	// such layers are pulled without lazy pulling.
+	FailOpen bool `toml:"fail_open"`
+}
+
+type FscacheConfig struct {
+	// Dir is the directory where the kernel caches the contents of layers mounted through
+	// fscache. Default is "fscache-ondemand" under the cache directory (the fs cache uses "fscache").
+	Dir string `toml:"dir"`
 }
 
 type FuseConfig struct {
@@ -91,4 +468,9 @@ type FuseConfig struct {
 
 	// EntryTimeout defines TTL for directory, name lookup in seconds.
 	EntryTimeout int64 `toml:"entry_timeout"`
+
+	// DirectMount mounts FUSE by opening /dev/fuse directly instead of using fusermount.
+	// This is needed where setuid binaries don't work (e.g. in pods disallowing privilege
+	// escalation), with /dev/fuse provided by a device plugin.
+	DirectMount bool `toml:"direct_mount"`
 }
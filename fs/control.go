@@ -0,0 +1,324 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/fs/egress"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Controller provides administrative operations on a filesystem, which are exposed by
+// the daemon on its debug socket. Operations fail with errdefs.ErrUnavailable until the
+// controller is attached to a filesystem using WithController.
+type Controller struct {
+	mu sync.Mutex
+	fs *filesystem
+}
+
+// NewController returns a controller not attached to any filesystem yet.
+func NewController() *Controller {
+	return &Controller{}
+}
+
+func (c *Controller) attach(fs *filesystem) {
+	c.mu.Lock()
+	c.fs = fs
+	c.mu.Unlock()
+}
+
+func (c *Controller) filesystem() (*filesystem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fs == nil {
+		return nil, fmt.Errorf("no filesystem is attached: %w", errdefs.ErrUnavailable)
+	}
+	return c.fs, nil
+}
+
+// Layers returns the current status of the mounted layers keyed by the mountpoint.
+func (c *Controller) Layers() (map[string]layer.Info, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	return fs.layerInfo().(map[string]layer.Info), nil
+}
+
+// Prefetch prefetches the layer mounted on the mountpoint and starts fetching the entire
+// layer in background. This is useful when prefetch or background fetch is disabled by
+// the config. Nop for the layer that has already been (pre)fetched.
+func (c *Controller) Prefetch(mountpoint string) error {
+	fs, err := c.filesystem()
+	if err != nil {
+		return err
+	}
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no layer is mounted on %q: %w", mountpoint, errdefs.ErrNotFound)
+	}
+	if err := l.Prefetch(fs.prefetchSize); err != nil {
+		return fmt.Errorf("failed to prefetch %q: %w", mountpoint, err)
+	}
+	if fs.noBackgroundFetch {
+		// Otherwise, the background fetch has been started on mount.
+		go fs.backgroundFetch(l)
+	}
+	return nil
+}
+
+// Solidify fetches and verifies all contents of the layer mounted on the mountpoint and
+// makes the layer served only from the cache, so it doesn't depend on the registry anymore.
+// This blocks until the entire layer is fetched. The layer must be verified.
+func (c *Controller) Solidify(ctx context.Context, mountpoint string) error {
+	fs, err := c.filesystem()
+	if err != nil {
+		return err
+	}
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no layer is mounted on %q: %w", mountpoint, errdefs.ErrNotFound)
+	}
+	if err := l.Solidify(ctx); err != nil {
+		return fmt.Errorf("failed to solidify %q: %w", mountpoint, err)
+	}
+	return nil
+}
+
+// SolidifyImage solidifies all mounted layers of the image of the reference (see Solidify)
+// and returns their mountpoints. errdefs.ErrNotFound is returned if no layer of the image
+// is mounted.
+func (c *Controller) SolidifyImage(ctx context.Context, ref string) ([]string, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	var mps []string
+	fs.layerMu.Lock()
+	for mp := range fs.layer {
+		if img, ok := fs.layerImage[mp]; ok && img.ref == ref {
+			mps = append(mps, mp)
+		}
+	}
+	fs.layerMu.Unlock()
+	if len(mps) == 0 {
+		return nil, fmt.Errorf("no layer of %q is mounted: %w", ref, errdefs.ErrNotFound)
+	}
+	sort.Strings(mps)
+	for _, mp := range mps {
+		if err := c.Solidify(ctx, mp); err != nil {
+			return nil, err
+		}
+	}
+	return mps, nil
+}
+
+// SetReadPriority changes the priority class of on-demand reads of the layer mounted on
+// the mountpoint. Reads in the "low" class don't stop fetching layers in background and
+// only a limited number of them fetch contents at once, so that noisy readers (e.g. log
+// scanners) don't degrade reads of other containers on the node.
+func (c *Controller) SetReadPriority(mountpoint string, p layer.ReadPriority) error {
+	fs, err := c.filesystem()
+	if err != nil {
+		return err
+	}
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no layer is mounted on %q: %w", mountpoint, errdefs.ErrNotFound)
+	}
+	return setReadPriority(l, p)
+}
+
+type readPrioritizer interface {
+	SetReadPriority(layer.ReadPriority)
+}
+
+func setReadPriority(l layer.Layer, p layer.ReadPriority) error {
+	rp, ok := l.(readPrioritizer)
+	if !ok {
+		return fmt.Errorf("layer doesn't support read priority: %w", errdefs.ErrNotImplemented)
+	}
+	rp.SetReadPriority(p)
+	return nil
+}
+
+// PurgeCache drops layers and blobs that are kept for reuse after being resolved,
+// along with their caches. Caches of the mounted layers are kept until they are
+// unmounted. This returns the number of the dropped layers and blobs.
+func (c *Controller) PurgeCache() (int, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return 0, err
+	}
+	return fs.resolver.Purge(), nil
+}
+
+// PauseBackgroundFetch pauses (or resumes if pause is false) fetching layers in
+// background. Reads by containers aren't affected.
+func (c *Controller) PauseBackgroundFetch(pause bool) error {
+	fs, err := c.filesystem()
+	if err != nil {
+		return err
+	}
+	if pause {
+		fs.backgroundTaskManager.Pause()
+	} else {
+		fs.backgroundTaskManager.Resume()
+	}
+	return nil
+}
+
+// BackgroundFetchPaused returns true if fetching layers in background is paused.
+func (c *Controller) BackgroundFetchPaused() (bool, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return false, err
+	}
+	return fs.backgroundTaskManager.Paused(), nil
+}
+
+// SetOfflineMode changes the offline mode ("disabled", "auto" or "on") where layers serve
+// only the cached contents while registries are unreachable. Going back online fetches
+// the chunks read while offline.
+func (c *Controller) SetOfflineMode(mode string) error {
+	fs, err := c.filesystem()
+	if err != nil {
+		return err
+	}
+	if err := fs.resolver.Offline().SetMode(mode); err != nil {
+		return fmt.Errorf("%v: %w", err, errdefs.ErrInvalidArgument)
+	}
+	return nil
+}
+
+// OfflineStatus returns the status of the offline mode.
+func (c *Controller) OfflineStatus() (remote.OfflineStatus, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return remote.OfflineStatus{}, err
+	}
+	return fs.resolver.Offline().Status(), nil
+}
+
+// Egress returns the bytes fetched from registries for each namespace, image and registry.
+// errdefs.ErrNotFound is returned if the egress accounting is disabled by the config.
+func (c *Controller) Egress() ([]egress.Record, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	a := fs.resolver.Egress()
+	if a == nil {
+		return nil, fmt.Errorf("egress accounting is disabled: %w", errdefs.ErrNotFound)
+	}
+	return a.Records(), nil
+}
+
+// ImageWarmness is how much of the layers of an image has been fetched to this node.
+type ImageWarmness struct {
+	Ref string `json:"ref"`
+
+	// Layers is the number of layers of the image and MountedLayers is the number of
+	// them mounted on this node. Layers not mounted are counted as not fetched at all.
+	Layers        int `json:"layers"`
+	MountedLayers int `json:"mountedLayers"`
+
+	// PrioritizedPercent is the percentage of the fetched bytes in the prioritized
+	// ranges of the mounted layers. This is 100 if there is no prioritized range.
+	PrioritizedPercent float64 `json:"prioritizedPercent"`
+
+	// TotalPercent is the percentage of the fetched bytes in all layers of the image.
+	TotalPercent float64 `json:"totalPercent"`
+
+	LayerWarmness map[digest.Digest]layer.Warmness `json:"layerWarmness"`
+}
+
+// Warmness returns how much of each image whose layers are mounted has been fetched.
+// Layers shared among images are counted in all of them. If ref isn't empty, only the
+// image of the reference is returned and errdefs.ErrNotFound is returned if no layer of
+// the image is mounted.
+func (c *Controller) Warmness(ref string) ([]ImageWarmness, error) {
+	fs, err := c.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	type warmer interface {
+		Warmness() layer.Warmness
+	}
+	images := make(map[string][]ocispec.Descriptor)
+	mounted := make(map[digest.Digest]layer.Layer)
+	fs.layerMu.Lock()
+	for mp, l := range fs.layer {
+		mounted[l.Info().Digest] = l
+		if img, ok := fs.layerImage[mp]; ok && (ref == "" || img.ref == ref) {
+			images[img.ref] = img.layers
+		}
+	}
+	fs.layerMu.Unlock()
+	if ref != "" && len(images) == 0 {
+		return nil, fmt.Errorf("no layer of %q is mounted: %w", ref, errdefs.ErrNotFound)
+	}
+
+	var res []ImageWarmness
+	for r, layers := range images {
+		iw := ImageWarmness{Ref: r, Layers: len(layers), LayerWarmness: make(map[digest.Digest]layer.Warmness)}
+		var total layer.Warmness
+		for _, desc := range layers {
+			w := layer.Warmness{Size: desc.Size}
+			if l, ok := mounted[desc.Digest]; ok {
+				iw.MountedLayers++
+				if wl, ok := l.(warmer); ok {
+					w = wl.Warmness()
+				} else {
+					info := l.Info()
+					w.Size, w.FetchedSize = info.Size, info.FetchedSize
+				}
+			}
+			iw.LayerWarmness[desc.Digest] = w
+			total.Size += w.Size
+			total.FetchedSize += w.FetchedSize
+			total.PrioritizedSize += w.PrioritizedSize
+			total.PrioritizedFetchedSize += w.PrioritizedFetchedSize
+		}
+		iw.PrioritizedPercent = percent(total.PrioritizedFetchedSize, total.PrioritizedSize)
+		iw.TotalPercent = percent(total.FetchedSize, total.Size)
+		res = append(res, iw)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ref < res[j].Ref })
+	return res, nil
+}
+
+func percent(n, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(n) * 100 / float64(total)
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+const (
+	// firstStartFileName is the name of the file under the root directory recording when
+	// the snapshotter first started on the node.
+	firstStartFileName = "first-start"
+
+	defaultEagerBootPeriod = time.Hour
+
+	// eagerBootCheckInterval is the minimum interval to measure the size of the cache.
+	eagerBootCheckInterval = 30 * time.Second
+)
+
+// eagerBoot decides whether the first-boot eager mode is active. See config.EagerBootConfig.
+type eagerBoot struct {
+	firstStart time.Time
+	period     time.Duration
+	cacheDir   string
+	cacheLimit int64
+
+	mu        sync.Mutex
+	ended     bool
+	lastCheck time.Time
+	now       func() time.Time
+}
+
+// newEagerBoot returns the first-boot eager mode. The time of the first start is kept in
+// the root directory so that the period isn't restarted by restarts of the snapshotter.
+func newEagerBoot(root, cacheDir string, cfg config.EagerBootConfig) (*eagerBoot, error) {
+	e := &eagerBoot{
+		period:     time.Duration(cfg.PeriodSec) * time.Second,
+		cacheDir:   cacheDir,
+		cacheLimit: cfg.CacheSizeMB << 20,
+		now:        time.Now,
+	}
+	if e.period <= 0 && e.cacheLimit <= 0 {
+		e.period = defaultEagerBootPeriod
+	}
+	p := filepath.Join(root, firstStartFileName)
+	if b, err := os.ReadFile(p); err == nil {
+		if e.firstStart, err = time.Parse(time.RFC3339Nano, string(bytes.TrimSpace(b))); err == nil {
+			return e, nil
+		}
+		log.L.WithError(err).Warnf("invalid time of the first start in %q; resetting", p)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	e.firstStart = e.now().UTC()
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(p, []byte(e.firstStart.Format(time.RFC3339Nano)), 0600); err != nil {
+		return nil, fmt.Errorf("failed to record the first start: %w", err)
+	}
+	return e, nil
+}
+
+// active reports whether layers mounted now are fetched eagerly. Once the mode ends, it
+// never becomes active again.
+func (e *eagerBoot) active() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ended {
+		return false
+	}
+	now := e.now()
+	if e.period > 0 && now.Sub(e.firstStart) >= e.period {
+		e.end("period %v since the first start at %v elapsed", e.period, e.firstStart)
+		return false
+	}
+	if e.cacheLimit > 0 && now.Sub(e.lastCheck) >= eagerBootCheckInterval {
+		e.lastCheck = now
+		size, err := dirSize(e.cacheDir)
+		if err != nil {
+			log.L.WithError(err).Warnf("failed to get the size of the cache %q", e.cacheDir)
+		} else if size >= e.cacheLimit {
+			e.end("cache reached %d bytes", size)
+			return false
+		}
+	}
+	return true
+}
+
+func (e *eagerBoot) end(format string, args ...interface{}) {
+	e.ended = true
+	log.L.Infof("first-boot eager mode ended: "+format, args...)
+}
+
+// dirSize returns the total size of regular files under the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
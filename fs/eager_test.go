@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestEagerBootPeriod(t *testing.T) {
+	root := t.TempDir()
+	e, err := newEagerBoot(root, root, config.EagerBootConfig{Enable: true, PeriodSec: 60})
+	if err != nil {
+		t.Fatalf("failed to setup eager mode: %v", err)
+	}
+	if !e.active() {
+		t.Fatalf("eager mode must be active after the first start")
+	}
+
+	// The period continues from the first start across restarts.
+	restarted, err := newEagerBoot(root, root, config.EagerBootConfig{Enable: true, PeriodSec: 60})
+	if err != nil {
+		t.Fatalf("failed to setup eager mode: %v", err)
+	}
+	if !restarted.firstStart.Equal(e.firstStart) {
+		t.Errorf("first start = %v; want %v", restarted.firstStart, e.firstStart)
+	}
+	restarted.now = func() time.Time { return e.firstStart.Add(61 * time.Second) }
+	if restarted.active() {
+		t.Errorf("eager mode must end after the period")
+	}
+	restarted.now = func() time.Time { return e.firstStart }
+	if restarted.active() {
+		t.Errorf("eager mode must not be active again once it ended")
+	}
+}
+
+func TestEagerBootCacheSize(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	e, err := newEagerBoot(root, cacheDir, config.EagerBootConfig{Enable: true, CacheSizeMB: 1})
+	if err != nil {
+		t.Fatalf("failed to setup eager mode: %v", err)
+	}
+	if e.period != 0 {
+		t.Errorf("period must be unlimited if only the cache size is specified; got %v", e.period)
+	}
+	if !e.active() {
+		t.Fatalf("eager mode must be active with the empty cache")
+	}
+	if err := os.MkdirAll(filepath.Join(cacheDir, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheDir, "a", "chunk"), make([]byte, 1<<20), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !e.active() {
+		t.Errorf("the size of the cache must not be checked within the interval")
+	}
+	e.lastCheck = time.Time{}
+	if e.active() {
+		t.Errorf("eager mode must end once the cache reaches the size")
+	}
+}
@@ -0,0 +1,256 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package egress accounts bytes fetched from registries to the workloads that caused the
+// fetches, so that the cost of the egress from registries can be charged back to them.
+package egress
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+)
+
+// csvHeader is the header of the CSV written by WriteCSV.
+var csvHeader = []string{"namespace", "image", "registry", "bytes"}
+
+// Key identifies the workload that bytes are fetched for.
+type Key struct {
+	// Namespace is the containerd namespace. This is empty if unknown.
+	Namespace string
+
+	// Image is the repository of the image without tag and digest
+	// (e.g. "docker.io/library/ubuntu").
+	Image string
+
+	// Registry is the host of the registry of the image. Bytes fetched from mirrors are
+	// accounted to the registry they mirror.
+	Registry string
+}
+
+// KeyOf returns the key of the image of refspec fetched by the context.
+func KeyOf(ctx context.Context, refspec reference.Spec) Key {
+	ns, _ := namespaces.Namespace(ctx)
+	return Key{
+		Namespace: ns,
+		Image:     refspec.Locator,
+		Registry:  refspec.Hostname(),
+	}
+}
+
+// Record is the total bytes fetched for a key.
+type Record struct {
+	Key
+	Bytes uint64
+}
+
+// Accounting is the total bytes fetched for each key, persisted to a file. This is safe
+// for concurrent use.
+type Accounting struct {
+	mu    sync.Mutex
+	bytes map[Key]uint64
+	dirty bool
+
+	path      string
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns the accounting persisted at path. Records are loaded from path if exists
+// and written back every flushInterval (if positive) and on Close.
+func New(path string, flushInterval time.Duration) (*Accounting, error) {
+	a := &Accounting{
+		bytes:     make(map[Key]uint64),
+		path:      path,
+		stopCh:    make(chan struct{}),
+		stoppedCh: make(chan struct{}),
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		records, err := ReadCSV(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load egress records from %q: %w", path, err)
+		}
+		for _, r := range records {
+			a.bytes[r.Key] += r.Bytes
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	go a.flushLoop(flushInterval)
+	return a, nil
+}
+
+// Add accounts n bytes fetched for the key.
+func (a *Accounting) Add(k Key, n int64) {
+	if n <= 0 {
+		return
+	}
+	a.mu.Lock()
+	a.bytes[k] += uint64(n)
+	a.dirty = true
+	a.mu.Unlock()
+}
+
+// Records returns the records sorted by the namespace, the image and the registry.
+func (a *Accounting) Records() []Record {
+	a.mu.Lock()
+	records := make([]Record, 0, len(a.bytes))
+	for k, n := range a.bytes {
+		records = append(records, Record{k, n})
+	}
+	a.mu.Unlock()
+	sort.Slice(records, func(i, j int) bool {
+		ki, kj := records[i].Key, records[j].Key
+		if ki.Namespace != kj.Namespace {
+			return ki.Namespace < kj.Namespace
+		}
+		if ki.Image != kj.Image {
+			return ki.Image < kj.Image
+		}
+		return ki.Registry < kj.Registry
+	})
+	return records
+}
+
+// Save atomically writes the records to the file.
+func (a *Accounting) Save() error {
+	records := a.Records()
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(a.path), ".egress-tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if err := WriteCSV(bw, records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), a.path); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.dirty = false // records added while saving are written on the next save
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *Accounting) isDirty() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.dirty
+}
+
+func (a *Accounting) flushLoop(interval time.Duration) {
+	defer close(a.stoppedCh)
+	if interval <= 0 {
+		<-a.stopCh
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if a.isDirty() {
+				a.Save() // retried on the next tick on failure
+			}
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// Close stops flushing the records and writes them to the file.
+func (a *Accounting) Close() (err error) {
+	a.closeOnce.Do(func() {
+		close(a.stopCh)
+		<-a.stoppedCh
+		err = a.Save()
+	})
+	return err
+}
+
+// WriteCSV writes the records as CSV with the header "namespace,image,registry,bytes".
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if err := cw.Write([]string{r.Namespace, r.Image, r.Registry, strconv.FormatUint(r.Bytes, 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReadCSV reads records written by WriteCSV.
+func ReadCSV(r io.Reader) ([]Record, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for i, h := range csvHeader {
+		if header[i] != h {
+			return nil, fmt.Errorf("unexpected header %q", header)
+		}
+	}
+	var records []Record
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseUint(row[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytes of %q: %w", row[:3], err)
+		}
+		records = append(records, Record{Key{row[0], row[1], row[2]}, n})
+	}
+	return records, nil
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package egress
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestAccounting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "egress.csv")
+	a, err := New(path, 0)
+	if err != nil {
+		t.Fatalf("failed to create accounting: %v", err)
+	}
+	refspec, err := reference.Parse("registry.example.com/foo/bar:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	k1 := KeyOf(namespaces.WithNamespace(context.Background(), "k8s.io"), refspec)
+	if want := (Key{"k8s.io", "registry.example.com/foo/bar", "registry.example.com"}); k1 != want {
+		t.Fatalf("key = %+v; want %+v", k1, want)
+	}
+	k2 := KeyOf(context.Background(), refspec)
+	a.Add(k1, 100)
+	a.Add(k2, 10)
+	a.Add(k1, 20)
+	a.Add(k2, -1) // ignored
+	want := []Record{{k2, 10}, {k1, 120}}
+	if got := a.Records(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records = %+v; want %+v", got, want)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatalf("failed to close accounting: %v", err)
+	}
+
+	// Records must survive re-creating the accounting.
+	a, err = New(path, 0)
+	if err != nil {
+		t.Fatalf("failed to reload accounting: %v", err)
+	}
+	defer a.Close()
+	a.Add(k2, 5)
+	want[0].Bytes += 5
+	if got := a.Records(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("records after reload = %+v; want %+v", got, want)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, want); err != nil {
+		t.Fatalf("failed to write CSV: %v", err)
+	}
+	wantCSV := "namespace,image,registry,bytes\n" +
+		",registry.example.com/foo/bar,registry.example.com,15\n" +
+		"k8s.io,registry.example.com/foo/bar,registry.example.com,120\n"
+	if buf.String() != wantCSV {
+		t.Errorf("CSV = %q; want %q", buf.String(), wantCSV)
+	}
+	got, err := ReadCSV(&buf)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadCSV = %+v, %v; want %+v", got, err, want)
+	}
+}
@@ -0,0 +1,601 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package erofs builds erofs images of layers, which can be mounted by the kernel through
+// fscache in on-demand mode (see fs/fscache). The image is never materialized: the metadata
+// (inodes, directories and symlinks) is kept in memory and the contents of regular files are
+// read from the layer when the kernel requests them.
+package erofs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// On-disk format of erofs. See fs/erofs/erofs_fs.h of Linux.
+const (
+	blockBits = 12
+	blockSize = 1 << blockBits
+
+	superblockOffset = 1024
+	superblockSize   = 128
+	superblockMagic  = 0xE0F5E1E2
+
+	// inodes are placed in 32-byte slots and addressed by the slot number (nid) from
+	// the meta block. Inodes follow the superblock so that no inode has nid 0, which
+	// is treated as a deleted entry by readdir of userspace.
+	inodeSlotBits = 5
+	metaBlockAddr = 0
+
+	extendedInodeSize = 64
+	direntSize        = 12
+	xattrHeaderSize   = 12
+	xattrEntrySize    = 4
+
+	// i_format of extended inodes whose data is stored in contiguous blocks.
+	formatExtendedFlatPlain = 1
+)
+
+const (
+	ftUnknown = iota
+	ftRegFile
+	ftDir
+	ftChrdev
+	ftBlkdev
+	ftFifo
+	ftSock
+	ftSymlink
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	opaqueXattrValue  = "y"
+)
+
+// xattrPrefixes are the name prefixes of extended attributes that can be stored in erofs.
+// Extended attributes with other prefixes are dropped.
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{1, "user."},
+	{2, "system.posix_acl_access"},
+	{3, "system.posix_acl_default"},
+	{4, "trusted."},
+	{6, "security."},
+}
+
+type options struct {
+	opaqueXattrs []string
+	xattrFilter  func(string) bool
+}
+
+// Option is an option to configure the image.
+type Option func(*options)
+
+// WithOpaqueXattrs specifies the names of extended attributes that indicate opaque
+// directories to overlayfs. Default is "trusted.overlay.opaque".
+func WithOpaqueXattrs(names ...string) Option {
+	return func(o *options) {
+		o.opaqueXattrs = names
+	}
+}
+
+// WithXattrFilter specifies the filter of extended attributes exposed in the image.
+func WithXattrFilter(f func(string) bool) Option {
+	return func(o *options) {
+		o.xattrFilter = f
+	}
+}
+
+// Image is an erofs image of a layer. Whiteouts in the layer are converted to the ones
+// of overlayfs as done by the FUSE filesystem.
+type Image struct {
+	meta     []byte
+	files    []*inode // regular files in the order of blocks
+	size     int64
+	openFile func(id uint32) (io.ReaderAt, error)
+}
+
+type inode struct {
+	id       uint32 // ID in the metadata reader
+	attr     metadata.Attr
+	whiteout bool
+	xattrs   []xattr
+	children []dirent
+
+	nid     uint64
+	ino     uint32
+	nlink   uint32
+	size    int64
+	blkaddr uint32
+}
+
+type xattr struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+type dirent struct {
+	name string
+	in   *inode
+}
+
+// Build builds the image of the layer. openFile is used to read the contents of regular
+// files when they're requested.
+func Build(md metadata.Reader, openFile func(id uint32) (io.ReaderAt, error), opts ...Option) (*Image, error) {
+	o := options{opaqueXattrs: []string{"trusted.overlay.opaque"}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	b := &builder{md: md, opts: o, inodes: make(map[uint32]*inode)}
+	root, err := b.walk(md.RootID(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return b.build(root, openFile)
+}
+
+type builder struct {
+	md     metadata.Reader
+	opts   options
+	inodes map[uint32]*inode
+	order  []*inode // inodes in the order of nids
+}
+
+func (b *builder) walk(id uint32, parent *inode) (*inode, error) {
+	attr, err := b.md.GetAttr(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attribute of %d: %w", id, err)
+	}
+	if attr.Mode.IsDir() {
+		// Directories aren't shared so we don't look up b.inodes.
+		in := &inode{id: id, attr: attr}
+		b.order = append(b.order, in)
+		if err := b.walkDir(in, parent); err != nil {
+			return nil, err
+		}
+		return in, nil
+	}
+	if in, ok := b.inodes[id]; ok {
+		return in, nil // hardlink
+	}
+	in := &inode{id: id, attr: attr}
+	b.inodes[id] = in
+	b.order = append(b.order, in)
+	return in, nil
+}
+
+func (b *builder) walkDir(dir *inode, parent *inode) error {
+	var (
+		names     []string
+		ids       = make(map[string]uint32)
+		whiteouts []string
+		opaque    bool
+	)
+	if err := b.md.ForeachChild(dir.id, func(name string, id uint32, mode os.FileMode) bool {
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			if name == whiteoutOpaqueDir {
+				opaque = true
+			} else {
+				whiteouts = append(whiteouts, name)
+				ids[name] = id
+			}
+			return true
+		}
+		names = append(names, name)
+		ids[name] = id
+		return true
+	}); err != nil {
+		return fmt.Errorf("failed to read directory %d: %w", dir.id, err)
+	}
+	sort.Strings(names)
+	sort.Strings(whiteouts)
+
+	if parent == nil {
+		parent = dir // root
+	}
+	dir.children = []dirent{{".", dir}, {"..", parent}}
+	exists := make(map[string]bool, len(names))
+	for _, name := range names {
+		exists[name] = true
+	}
+	// Append whiteouts if no entry replaces the target entry in the lower layer.
+	for _, w := range whiteouts {
+		name := w[len(whiteoutPrefix):]
+		if exists[name] {
+			continue
+		}
+		attr, err := b.md.GetAttr(ids[w])
+		if err != nil {
+			return fmt.Errorf("failed to get attribute of whiteout %q: %w", w, err)
+		}
+		in := &inode{id: ids[w], attr: attr, whiteout: true}
+		b.order = append(b.order, in)
+		dir.children = append(dir.children, dirent{name, in})
+	}
+	for _, name := range names {
+		in, err := b.walk(ids[name], dir)
+		if err != nil {
+			return err
+		}
+		dir.children = append(dir.children, dirent{name, in})
+	}
+	sort.Slice(dir.children, func(i, j int) bool {
+		return dir.children[i].name < dir.children[j].name
+	})
+
+	xattrs := make(map[string][]byte)
+	for k, v := range dir.attr.Xattrs {
+		xattrs[k] = v
+	}
+	if opaque {
+		for _, name := range b.opts.opaqueXattrs {
+			xattrs[name] = []byte(opaqueXattrValue)
+		}
+	}
+	dir.attr.Xattrs = xattrs
+	return nil
+}
+
+func (b *builder) build(root *inode, openFile func(id uint32) (io.ReaderAt, error)) (*Image, error) {
+	// Place inodes in the meta area following the superblock.
+	pos := int64(superblockOffset + superblockSize)
+	for i, in := range b.order {
+		in.ino = uint32(i + 1)
+		in.nlink = 1
+		if !in.whiteout {
+			in.xattrs = b.xattrs(in.attr.Xattrs)
+		}
+		n := roundUp(int64(extendedInodeSize+xattrSize(in.xattrs)), 1<<inodeSlotBits)
+		if rem := blockSize - pos%blockSize; n > rem && rem < blockSize {
+			pos += rem // don't let inodes cross block boundaries
+		}
+		in.nid = uint64(pos-(int64(metaBlockAddr)<<blockBits)) >> inodeSlotBits
+		pos += n
+	}
+	if root.nid > 0xffff {
+		return nil, fmt.Errorf("nid of the root is too large: %d", root.nid)
+	}
+	for _, in := range b.order {
+		if in.attr.Mode.IsDir() {
+			in.nlink = 2
+		} else if !in.whiteout {
+			in.nlink = 0 // counted below
+		}
+	}
+	for _, in := range b.order {
+		if !in.attr.Mode.IsDir() {
+			continue
+		}
+		for _, d := range in.children[2:] {
+			if d.in.attr.Mode.IsDir() {
+				in.nlink++
+			} else if !d.in.whiteout {
+				d.in.nlink++
+			}
+		}
+	}
+
+	// Directories and symlinks follow inodes. Their data is also kept in memory.
+	meta := make([]byte, roundUp(pos, blockSize))
+	var data [][]byte
+	addr := uint32(len(meta) >> blockBits)
+	for _, in := range b.order {
+		var d []byte
+		switch {
+		case in.whiteout:
+		case in.attr.Mode.IsDir():
+			d = dirBlocks(in.children)
+		case in.attr.Mode&os.ModeSymlink != 0:
+			d = []byte(in.attr.LinkName)
+		default:
+			continue
+		}
+		in.size = int64(len(d))
+		if len(d) > 0 {
+			in.blkaddr = addr
+			addr += uint32(roundUp(int64(len(d)), blockSize) >> blockBits)
+			data = append(data, d)
+		}
+	}
+	for _, d := range data {
+		meta = append(meta, d...)
+		meta = append(meta, make([]byte, roundUp(int64(len(d)), blockSize)-int64(len(d)))...)
+	}
+
+	// Contents of regular files follow the meta area.
+	var files []*inode
+	for _, in := range b.order {
+		if in.whiteout || !in.attr.Mode.IsRegular() {
+			continue
+		}
+		in.size = in.attr.Size
+		if in.size > 0 {
+			in.blkaddr = addr
+			blocks := roundUp(in.size, blockSize) >> blockBits
+			if int64(addr)+blocks > int64(^uint32(0)) {
+				return nil, fmt.Errorf("layer is too large")
+			}
+			addr += uint32(blocks)
+			files = append(files, in)
+		}
+	}
+
+	for _, in := range b.order {
+		off := (int64(metaBlockAddr) << blockBits) + int64(in.nid<<inodeSlotBits)
+		putInode(meta[off:], in)
+	}
+	putSuperblock(meta[superblockOffset:], root, uint64(len(b.order)), addr)
+
+	return &Image{
+		meta:     meta,
+		files:    files,
+		size:     int64(addr) << blockBits,
+		openFile: openFile,
+	}, nil
+}
+
+func (b *builder) xattrs(m map[string][]byte) (xattrs []xattr) {
+	for k, v := range m {
+		if b.opts.xattrFilter != nil && !b.opts.xattrFilter(k) {
+			continue
+		}
+		for _, p := range xattrPrefixes {
+			if !strings.HasPrefix(k, p.prefix) {
+				continue
+			}
+			name := k[len(p.prefix):]
+			if len(name) <= 0xff && len(v) <= 0xffff {
+				xattrs = append(xattrs, xattr{p.index, name, v})
+			}
+			break
+		}
+	}
+	sort.Slice(xattrs, func(i, j int) bool {
+		if xattrs[i].index != xattrs[j].index {
+			return xattrs[i].index < xattrs[j].index
+		}
+		return xattrs[i].name < xattrs[j].name
+	})
+	return xattrs
+}
+
+// Size returns the size of the image.
+func (img *Image) Size() int64 {
+	return img.size
+}
+
+// MetadataDigest returns the digest of the metadata of the image. Images of the same layer
+// having the same metadata digest have the same contents.
+func (img *Image) MetadataDigest() digest.Digest {
+	return digest.FromBytes(img.meta)
+}
+
+// ReadAt reads the image. Contents of regular files are read from the layer.
+func (img *Image) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %d", off)
+	}
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= img.size {
+			return n, io.EOF
+		}
+		if cur < int64(len(img.meta)) {
+			n += copy(p[n:], img.meta[cur:])
+			continue
+		}
+		// Find the file whose blocks contain the offset.
+		i := sort.Search(len(img.files), func(i int) bool {
+			return int64(img.files[i].blkaddr)<<blockBits > cur
+		}) - 1
+		in := img.files[i]
+		start := int64(in.blkaddr) << blockBits
+		end := start + roundUp(in.size, blockSize)
+		buf := p[n:]
+		if rem := end - cur; int64(len(buf)) > rem {
+			buf = buf[:rem]
+		}
+		if fileOff := cur - start; fileOff < in.size {
+			fbuf := buf
+			if rem := in.size - fileOff; int64(len(fbuf)) > rem {
+				fbuf = fbuf[:rem]
+			}
+			ra, err := img.openFile(in.id)
+			if err != nil {
+				return n, fmt.Errorf("failed to open file %d: %w", in.id, err)
+			}
+			if m, err := ra.ReadAt(fbuf, fileOff); m < len(fbuf) {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n + m, fmt.Errorf("failed to read file %d: %w", in.id, err)
+			}
+			n += len(fbuf)
+			buf = buf[len(fbuf):]
+		}
+		for i := range buf {
+			buf[i] = 0 // padding of the last block
+		}
+		n += len(buf)
+	}
+	return n, nil
+}
+
+func dirBlocks(ents []dirent) (d []byte) {
+	for len(ents) > 0 {
+		// Fill a block with as many entries as possible.
+		n, used := 0, 0
+		for n < len(ents) && used+direntSize+len(ents[n].name) <= blockSize {
+			used += direntSize + len(ents[n].name)
+			n++
+		}
+		blk := make([]byte, blockSize)
+		nameOff := direntSize * n
+		for i, e := range ents[:n] {
+			de := blk[i*direntSize:]
+			binary.LittleEndian.PutUint64(de[0:], e.in.nid)
+			binary.LittleEndian.PutUint16(de[8:], uint16(nameOff))
+			de[10] = fileType(e.in)
+			nameOff += copy(blk[nameOff:], e.name)
+		}
+		ents = ents[n:]
+		if len(ents) == 0 {
+			blk = blk[:used] // the last block ends with the last name
+		}
+		d = append(d, blk...)
+	}
+	return d
+}
+
+func xattrSize(xattrs []xattr) int {
+	if len(xattrs) == 0 {
+		return 0
+	}
+	n := xattrHeaderSize
+	for _, x := range xattrs {
+		n += int(roundUp(int64(xattrEntrySize+len(x.name)+len(x.value)), xattrEntrySize))
+	}
+	return n
+}
+
+func putInode(b []byte, in *inode) {
+	le := binary.LittleEndian
+	mode := systemMode(in)
+	le.PutUint16(b[0:], formatExtendedFlatPlain)
+	if xsize := xattrSize(in.xattrs); xsize > 0 {
+		le.PutUint16(b[2:], uint16((xsize-xattrHeaderSize)/xattrEntrySize+1))
+	}
+	le.PutUint16(b[4:], uint16(mode))
+	le.PutUint64(b[8:], uint64(in.size))
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		if !in.whiteout {
+			le.PutUint32(b[16:], encodeDev(uint32(in.attr.DevMajor), uint32(in.attr.DevMinor)))
+		}
+	default:
+		le.PutUint32(b[16:], in.blkaddr)
+	}
+	le.PutUint32(b[20:], in.ino)
+	if !in.whiteout {
+		le.PutUint32(b[24:], uint32(in.attr.UID))
+		le.PutUint32(b[28:], uint32(in.attr.GID))
+	}
+	if mtime := in.attr.ModTime; !mtime.IsZero() {
+		le.PutUint64(b[32:], uint64(mtime.Unix()))
+		le.PutUint32(b[40:], uint32(mtime.Nanosecond()))
+	}
+	le.PutUint32(b[44:], in.nlink)
+
+	// Extended attributes follow the inode.
+	if len(in.xattrs) == 0 {
+		return
+	}
+	off := extendedInodeSize + xattrHeaderSize
+	for _, x := range in.xattrs {
+		e := b[off:]
+		e[0] = uint8(len(x.name))
+		e[1] = x.index
+		le.PutUint16(e[2:], uint16(len(x.value)))
+		copy(e[xattrEntrySize:], x.name)
+		copy(e[xattrEntrySize+len(x.name):], x.value)
+		off += int(roundUp(int64(xattrEntrySize+len(x.name)+len(x.value)), xattrEntrySize))
+	}
+}
+
+func putSuperblock(b []byte, root *inode, inos uint64, blocks uint32) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], superblockMagic)
+	b[12] = blockBits
+	le.PutUint16(b[14:], uint16(root.nid))
+	le.PutUint64(b[16:], inos)
+	le.PutUint32(b[36:], blocks)
+	le.PutUint32(b[40:], metaBlockAddr)
+}
+
+func systemMode(in *inode) uint32 {
+	if in.whiteout {
+		return syscall.S_IFCHR // overlayfs-compliant whiteout (0:0)
+	}
+	m := in.attr.Mode
+	sm := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		sm |= syscall.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		sm |= syscall.S_IFLNK
+	case m&os.ModeDevice != 0 && m&os.ModeCharDevice != 0:
+		sm |= syscall.S_IFCHR
+	case m&os.ModeDevice != 0:
+		sm |= syscall.S_IFBLK
+	case m&os.ModeNamedPipe != 0:
+		sm |= syscall.S_IFIFO
+	case m&os.ModeSocket != 0:
+		sm |= syscall.S_IFSOCK
+	default:
+		sm |= syscall.S_IFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		sm |= syscall.S_ISUID
+	}
+	if m&os.ModeSetgid != 0 {
+		sm |= syscall.S_ISGID
+	}
+	if m&os.ModeSticky != 0 {
+		sm |= syscall.S_ISVTX
+	}
+	return sm
+}
+
+func fileType(in *inode) uint8 {
+	switch systemMode(in) & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		return ftRegFile
+	case syscall.S_IFDIR:
+		return ftDir
+	case syscall.S_IFCHR:
+		return ftChrdev
+	case syscall.S_IFBLK:
+		return ftBlkdev
+	case syscall.S_IFIFO:
+		return ftFifo
+	case syscall.S_IFSOCK:
+		return ftSock
+	case syscall.S_IFLNK:
+		return ftSymlink
+	}
+	return ftUnknown
+}
+
+// encodeDev encodes the device number in the same way as new_encode_dev of Linux.
+func encodeDev(major, minor uint32) uint32 {
+	return (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12)
+}
+
+func roundUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package erofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+
+	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+)
+
+func TestBuild(t *testing.T) {
+	sr, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("foo/", testutil.WithDirXattrs(map[string]string{"user.dir": "a"})),
+		testutil.File("foo/bar", strings.Repeat("x", 5000), testutil.WithFileXattrs(map[string]string{
+			"user.foo":      "1",
+			"security.deny": "2",
+		})),
+		testutil.Link("foo/baz", "foo/bar"),
+		testutil.File("foo/.wh.bar", ""), // hidden by foo/bar
+		testutil.Symlink("foo/link", "bar"),
+		testutil.Chardev("foo/dev", 1, 3),
+		testutil.File(".wh.deleted", ""),
+		testutil.Dir("opq/"),
+		testutil.File("opq/.wh..wh..opq", ""),
+		testutil.File("empty", ""),
+	})
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	md, err := memorymetadata.NewReader(sr)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	defer md.Close()
+	openFile := func(id uint32) (io.ReaderAt, error) {
+		f, err := md.OpenFile(id)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	img, err := Build(md, openFile, WithXattrFilter(func(name string) bool { return name != "security.deny" }))
+	if err != nil {
+		t.Fatalf("failed to build image: %v", err)
+	}
+	if img.Size()%blockSize != 0 {
+		t.Fatalf("size %d isn't aligned to blocks", img.Size())
+	}
+	data := make([]byte, img.Size())
+	if _, err := img.ReadAt(data, 0); err != nil {
+		t.Fatalf("failed to read image: %v", err)
+	}
+	if magic := binary.LittleEndian.Uint32(data[superblockOffset:]); magic != superblockMagic {
+		t.Fatalf("invalid magic %x", magic)
+	}
+	root := uint64(binary.LittleEndian.Uint16(data[superblockOffset+14:]))
+
+	// Check files by looking up them from the root.
+	lookup := func(p string) testInode {
+		in := readTestInode(t, data, root)
+		for _, name := range strings.Split(p, "/") {
+			nid, ok := in.lookup(t, data, name)
+			if !ok {
+				t.Fatalf("%q not found", p)
+			}
+			in = readTestInode(t, data, nid)
+		}
+		return in
+	}
+	bar := lookup("foo/bar")
+	if got := string(bar.contents(data)); got != strings.Repeat("x", 5000) {
+		t.Errorf("unexpected contents of foo/bar: %q", got)
+	}
+	if bar.nlink != 2 {
+		t.Errorf("nlink of foo/bar = %d; want 2", bar.nlink)
+	}
+	if baz := lookup("foo/baz"); baz.nid != bar.nid {
+		t.Errorf("foo/baz (%d) isn't a hardlink of foo/bar (%d)", baz.nid, bar.nid)
+	}
+	if v := bar.xattrs["user.foo"]; v != "1" {
+		t.Errorf("user.foo of foo/bar = %q; want 1", v)
+	}
+	if _, ok := bar.xattrs["security.deny"]; ok {
+		t.Errorf("filtered xattr is exposed")
+	}
+	if v := lookup("foo").xattrs["user.dir"]; v != "a" {
+		t.Errorf("user.dir of foo = %q; want a", v)
+	}
+	if got := string(lookup("foo/link").contents(data)); got != "bar" {
+		t.Errorf("link target = %q; want bar", got)
+	}
+	if dev := lookup("foo/dev"); dev.mode&syscall.S_IFMT != syscall.S_IFCHR || dev.u != encodeDev(1, 3) {
+		t.Errorf("unexpected device: mode=%o rdev=%x", dev.mode, dev.u)
+	}
+	if wh := lookup("deleted"); wh.mode&syscall.S_IFMT != syscall.S_IFCHR || wh.u != 0 {
+		t.Errorf("unexpected whiteout: mode=%o rdev=%x", wh.mode, wh.u)
+	}
+	if v := lookup("opq").xattrs["trusted.overlay.opaque"]; v != opaqueXattrValue {
+		t.Errorf("opaque xattr = %q; want %q", v, opaqueXattrValue)
+	}
+	if size := lookup("empty").size; size != 0 {
+		t.Errorf("size of empty file = %d", size)
+	}
+	for _, name := range []string{".wh.deleted", "foo/.wh.bar", "opq/.wh..wh..opq"} {
+		dir, base := "", name
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			dir, base = name[:i], name[i+1:]
+		}
+		d := readTestInode(t, data, root)
+		if dir != "" {
+			d = lookup(dir)
+		}
+		if _, ok := d.lookup(t, data, base); ok {
+			t.Errorf("%q must be hidden", name)
+		}
+	}
+}
+
+type testInode struct {
+	nid     uint64
+	mode    uint16
+	size    uint64
+	u       uint32
+	nlink   uint32
+	xattrs  map[string]string
+	blkaddr uint32
+}
+
+func readTestInode(t *testing.T, data []byte, nid uint64) testInode {
+	le := binary.LittleEndian
+	b := data[(metaBlockAddr<<blockBits)+(nid<<inodeSlotBits):]
+	in := testInode{
+		nid:    nid,
+		mode:   le.Uint16(b[4:]),
+		size:   le.Uint64(b[8:]),
+		u:      le.Uint32(b[16:]),
+		nlink:  le.Uint32(b[44:]),
+		xattrs: make(map[string]string),
+	}
+	in.blkaddr = in.u
+	if icount := int(le.Uint16(b[2:])); icount > 0 {
+		x := b[extendedInodeSize+xattrHeaderSize : extendedInodeSize+xattrHeaderSize+(icount-1)*xattrEntrySize]
+		for len(x) > 0 {
+			nameLen, index, valueLen := int(x[0]), x[1], int(le.Uint16(x[2:]))
+			prefix := ""
+			for _, p := range xattrPrefixes {
+				if p.index == index {
+					prefix = p.prefix
+				}
+			}
+			name := string(x[xattrEntrySize : xattrEntrySize+nameLen])
+			in.xattrs[prefix+name] = string(x[xattrEntrySize+nameLen : xattrEntrySize+nameLen+valueLen])
+			x = x[roundUp(int64(xattrEntrySize+nameLen+valueLen), xattrEntrySize):]
+		}
+	}
+	return in
+}
+
+func (in testInode) contents(data []byte) []byte {
+	off := uint64(in.blkaddr) << blockBits
+	return data[off : off+in.size]
+}
+
+func (in testInode) lookup(t *testing.T, data []byte, name string) (uint64, bool) {
+	if in.mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Fatalf("looking up %q in non-directory", name)
+	}
+	d := in.contents(data)
+	for len(d) > 0 {
+		blk := d
+		if len(blk) > blockSize {
+			blk = blk[:blockSize]
+		}
+		n := int(binary.LittleEndian.Uint16(blk[8:])) / direntSize
+		for i := 0; i < n; i++ {
+			de := blk[i*direntSize:]
+			start, end := int(binary.LittleEndian.Uint16(de[8:])), len(blk)
+			if i < n-1 {
+				end = int(binary.LittleEndian.Uint16(blk[(i+1)*direntSize+8:]))
+			}
+			if string(bytes.TrimRight(blk[start:end], "\x00")) == name {
+				return binary.LittleEndian.Uint64(de), true
+			}
+		}
+		d = d[len(blk):]
+	}
+	return 0, false
+}
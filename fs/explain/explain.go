@@ -0,0 +1,375 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package explain explains whether the snapshotter lazily pulls layers of an image and, if
+// not, the condition blocking it. Layers are checked in the registry in the same way as
+// the snapshotter checks them on mounting, following the config of the snapshotter.
+package explain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/stats"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxManifestSize is the maximum size of manifests fetched from the registry.
+const maxManifestSize = 4 * 1024 * 1024
+
+// Names of the checks.
+const (
+	CheckCanary       = "canary"
+	CheckMediaType    = "media type"
+	CheckTOCDigest    = "TOC digest"
+	CheckSize         = "size"
+	CheckRangeSupport = "range requests"
+	CheckFooter       = "footer"
+)
+
+// Check is the result of a condition checked for lazily pulling an image.
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// Layer is the result of checks of a layer.
+type Layer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+
+	// Lazy is true if the layer is lazily pulled.
+	Lazy bool `json:"lazy"`
+
+	// Checks are the checked conditions. Any failed one blocks lazily pulling the layer.
+	Checks []Check `json:"checks"`
+}
+
+// Blocker returns the first failed check of the layer. ok is false if the layer is lazily
+// pulled.
+func (l *Layer) Blocker() (_ Check, ok bool) {
+	for _, c := range l.Checks {
+		if !c.OK {
+			return c, true
+		}
+	}
+	return Check{}, false
+}
+
+// Report is the explanation of an image.
+type Report struct {
+	Ref      string        `json:"ref"`
+	Manifest digest.Digest `json:"manifest"`
+
+	// Checks are the conditions checked for the entire image.
+	Checks []Check  `json:"checks"`
+	Layers []*Layer `json:"layers"`
+}
+
+// Blocker returns the first failed check of the image or of its layers. ok is false if
+// all layers are lazily pulled.
+func (r *Report) Blocker() (_ Check, layer digest.Digest, ok bool) {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return c, "", true
+		}
+	}
+	for _, l := range r.Layers {
+		if c, ok := l.Blocker(); ok {
+			return c, l.Digest, true
+		}
+	}
+	return Check{}, "", false
+}
+
+// Verdict returns the human-readable summary of the report.
+func (r *Report) Verdict() string {
+	var lazy int
+	for _, l := range r.Layers {
+		if l.Lazy {
+			lazy++
+		}
+	}
+	switch {
+	case lazy == len(r.Layers):
+		return "lazily pulled"
+	case lazy == 0:
+		return "not lazily pulled"
+	}
+	return fmt.Sprintf("partially lazily pulled (%d of %d layers)", lazy, len(r.Layers))
+}
+
+// WriteText writes the report in a human-readable form.
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "image:    %s\n", r.Ref)
+	fmt.Fprintf(w, "manifest: %s\n", r.Manifest)
+	fmt.Fprintf(w, "verdict:  %s\n", r.Verdict())
+	if c, l, ok := r.Blocker(); ok {
+		if l != "" {
+			fmt.Fprintf(w, "blocking: %s of layer %s: %s\n", c.Name, l, c.Detail)
+		} else {
+			fmt.Fprintf(w, "blocking: %s: %s\n", c.Name, c.Detail)
+		}
+	}
+	writeChecks(w, r.Checks)
+	for _, l := range r.Layers {
+		state := "pulled lazily"
+		if !l.Lazy {
+			state = "pulled normally"
+		}
+		fmt.Fprintf(w, "\n%s (%s, %d bytes): %s\n", l.Digest, l.MediaType, l.Size, state)
+		writeChecks(w, l.Checks)
+	}
+	return nil
+}
+
+func writeChecks(w io.Writer, checks []Check) {
+	for _, c := range checks {
+		mark := "ok"
+		if !c.OK {
+			mark = "NG"
+		}
+		fmt.Fprintf(w, "  [%s] %s: %s\n", mark, c.Name, c.Detail)
+	}
+}
+
+// Explainer explains images following the config of the snapshotter.
+type Explainer struct {
+	config   config.Config
+	hostname string
+	hosts    source.RegistryHosts
+	registry registry
+}
+
+// New returns an explainer of images for the snapshotter running on the node of the
+// hostname with the config. hosts should be the same as the ones of the snapshotter so
+// that registries are accessed with its mirrors and credentials.
+func New(cfg config.Config, hostname string, hosts source.RegistryHosts) *Explainer {
+	return &Explainer{
+		config:   cfg,
+		hostname: hostname,
+		hosts:    hosts,
+		registry: &remoteRegistry{remote.NewResolver(cfg.BlobConfig, nil), hosts},
+	}
+}
+
+// Explain checks the image of the platform in the registry.
+func (e *Explainer) Explain(ctx context.Context, ref string, platform platforms.MatchComparer) (*Report, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) { return e.hosts(refspec) },
+	})
+	desc, err := stats.Resolve(ctx, resolver, ref, platform)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %q: %w", ref, err)
+	}
+	manifest, err := fetchManifest(ctx, resolver, refspec, desc)
+	if err != nil {
+		return nil, err
+	}
+	return e.explain(ctx, refspec, desc.Digest, manifest), nil
+}
+
+func (e *Explainer) explain(ctx context.Context, refspec reference.Spec, manifestDigest digest.Digest, manifest ocispec.Manifest) *Report {
+	r := &Report{Ref: refspec.String(), Manifest: manifestDigest}
+	c := Check{Name: CheckCanary, OK: true, Detail: "no canary applies to the image on this node"}
+	if err := fs.CheckCanary(e.config.Canaries, e.hostname, refspec.String()); err != nil {
+		c.OK, c.Detail = false, err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	for _, desc := range manifest.Layers {
+		r.Layers = append(r.Layers, e.explainLayer(ctx, refspec, desc))
+	}
+	if !c.OK {
+		for _, l := range r.Layers {
+			l.Lazy = false
+		}
+	}
+	return r
+}
+
+func (e *Explainer) explainLayer(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) *Layer {
+	l := &Layer{Digest: desc.Digest, MediaType: desc.MediaType, Size: desc.Size}
+	check := func(name string, ok bool, format string, a ...interface{}) {
+		l.Checks = append(l.Checks, Check{Name: name, OK: ok, Detail: fmt.Sprintf(format, a...)})
+	}
+
+	if !images.IsLayerType(desc.MediaType) {
+		check(CheckMediaType, false, "not a layer")
+		return l
+	}
+	check(CheckMediaType, true, "layer")
+
+	switch tocDigest, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; {
+	case ok:
+		if _, err := digest.Parse(tocDigest); err != nil {
+			check(CheckTOCDigest, false, "invalid annotation %q: %v", tocDigest, err)
+		} else {
+			check(CheckTOCDigest, true, "%s", tocDigest)
+		}
+	case e.config.DisableVerification:
+		check(CheckTOCDigest, true, "no annotation %q but verification is disabled by disable_verification", estargz.TOCJSONDigestAnnotation)
+	case e.config.StrictVerify:
+		check(CheckTOCDigest, false, "no annotation %q, which is required by strict_verify", estargz.TOCJSONDigestAnnotation)
+	case e.config.AllowNoVerification:
+		check(CheckTOCDigest, true, "no annotation %q; allowed by allow_no_verification only if pulled with --skip-content-verify", estargz.TOCJSONDigestAnnotation)
+	default:
+		check(CheckTOCDigest, false, "no annotation %q; the image isn't eStargz or the annotation was dropped (e.g. by a registry or a tool copying the image)", estargz.TOCJSONDigestAnnotation)
+	}
+
+	if threshold := e.config.LazyLayerSizeThreshold; desc.Size < threshold {
+		check(CheckSize, false, "%d bytes is under lazy_layer_size_threshold (%d bytes)", desc.Size, threshold)
+	} else {
+		check(CheckSize, true, "%d bytes", desc.Size)
+	}
+
+	// Registry checks are done even after failures above so that all problems of the
+	// layer are reported at once.
+	if ok, err := e.registry.supportsRange(ctx, refspec, desc); err != nil {
+		check(CheckRangeSupport, false, "failed to access the blob in the registry: %v", err)
+		return l
+	} else if !ok {
+		check(CheckRangeSupport, false, "the registry returns the entire blob for range requests")
+		return l
+	}
+	check(CheckRangeSupport, true, "supported")
+
+	if err := e.checkFooter(ctx, refspec, desc); err != nil {
+		check(CheckFooter, false, "%v", err)
+	} else {
+		check(CheckFooter, true, "valid")
+	}
+
+	_, blocked := l.Blocker()
+	l.Lazy = !blocked
+	return l
+}
+
+// decompressors are the formats of layers supported by the snapshotter.
+var decompressors = []estargz.Decompressor{
+	new(estargz.GzipDecompressor),
+	new(estargz.LegacyGzipDecompressor),
+	new(zstdchunked.Decompressor),
+	new(uncompressed.Decompressor),
+}
+
+// checkFooter checks that the blob has a footer pointing to the TOC.
+func (e *Explainer) checkFooter(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) error {
+	var n int64
+	for _, d := range decompressors {
+		if s := d.FooterSize(); s > n {
+			n = s
+		}
+	}
+	if desc.Size < n {
+		n = desc.Size
+	}
+	footer := make([]byte, n)
+	if err := e.registry.readAt(ctx, refspec, desc, footer, desc.Size-n); err != nil {
+		return fmt.Errorf("failed to read the footer: %w", err)
+	}
+	var errs []string
+	for _, d := range decompressors {
+		fSize := d.FooterSize()
+		if fSize > n {
+			continue
+		}
+		_, tocOffset, _, err := d.ParseFooter(footer[n-fSize:])
+		if err == nil && (tocOffset < 0 || tocOffset >= desc.Size) {
+			err = fmt.Errorf("TOC offset %d is out of the blob", tocOffset)
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return fmt.Errorf("no valid eStargz or zstd:chunked footer: %s", strings.Join(errs, "; "))
+}
+
+func fetchManifest(ctx context.Context, resolver remotes.Resolver, refspec reference.Spec, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	if desc.Size > maxManifestSize {
+		return ocispec.Manifest{}, fmt.Errorf("manifest %v is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("failed to fetch manifest %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, desc.Size))
+	if err != nil {
+		return ocispec.Manifest{}, err
+	}
+	if dgst := digest.FromBytes(b); dgst != desc.Digest {
+		return ocispec.Manifest{}, fmt.Errorf("unexpected digest %v of manifest; want %v", dgst, desc.Digest)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ocispec.Manifest{}, fmt.Errorf("failed to parse manifest %v: %w", desc.Digest, err)
+	}
+	return manifest, nil
+}
+
+// registry accesses blobs in the registry.
+type registry interface {
+	supportsRange(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (bool, error)
+	readAt(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, p []byte, offset int64) error
+}
+
+// remoteRegistry accesses blobs in the same way as the snapshotter.
+type remoteRegistry struct {
+	r     *remote.Resolver
+	hosts source.RegistryHosts
+}
+
+func (r *remoteRegistry) supportsRange(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (bool, error) {
+	return r.r.SupportsRange(ctx, r.hosts, refspec, desc)
+}
+
+func (r *remoteRegistry) readAt(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, p []byte, offset int64) error {
+	b, err := r.r.Resolve(ctx, r.hosts, refspec, desc, cache.NewMemoryCache())
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	_, err = b.ReadAt(p, offset)
+	return err
+}
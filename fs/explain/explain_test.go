@@ -0,0 +1,147 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package explain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type testBlob struct {
+	data    []byte
+	noRange bool
+}
+
+type testRegistry map[digest.Digest]testBlob
+
+func (r testRegistry) supportsRange(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (bool, error) {
+	b, ok := r[desc.Digest]
+	if !ok {
+		return false, fmt.Errorf("blob %v not found", desc.Digest)
+	}
+	return !b.noRange, nil
+}
+
+func (r testRegistry) readAt(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor, p []byte, offset int64) error {
+	_, err := bytes.NewReader(r[desc.Digest].data).ReadAt(p, offset)
+	return err
+}
+
+func TestExplain(t *testing.T) {
+	sr, tocDigest, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("foo", "foofoofoofoofoofoo"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	esgz, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, testutil.BuildTar([]testutil.TarEntry{testutil.File("foo", "foo")})); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz := buf.Bytes()
+
+	// Layers sharing contents are given distinct digests for testing.
+	reg := testRegistry{}
+	layer := func(data []byte, annotations map[string]string, noRange bool) ocispec.Descriptor {
+		dgst := digest.FromString(fmt.Sprintf("layer-%d", len(reg)))
+		reg[dgst] = testBlob{data: data, noRange: noRange}
+		return ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageLayerGzip,
+			Digest:      dgst,
+			Size:        int64(len(data)),
+			Annotations: annotations,
+		}
+	}
+	withTOC := map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest.String()}
+	manifest := ocispec.Manifest{
+		Layers: []ocispec.Descriptor{
+			layer(esgz, withTOC, false),
+			layer(esgz, nil, false),
+			layer(esgz, withTOC, true),
+			layer(gz, withTOC, false),
+			layer(esgz[:100], withTOC, false),
+		},
+	}
+	tests := []struct {
+		name    string
+		config  config.Config
+		blocker []string // name of the check blocking each layer
+		verdict string
+	}{
+		{
+			name:    "default",
+			blocker: []string{"", CheckTOCDigest, CheckRangeSupport, CheckFooter, CheckFooter},
+			verdict: "partially lazily pulled (1 of 5 layers)",
+		},
+		{
+			name:    "threshold",
+			config:  config.Config{LazyLayerSizeThreshold: int64(len(esgz)) + 1, AllowNoVerification: true},
+			blocker: []string{CheckSize, CheckSize, CheckSize, CheckSize, CheckSize},
+			verdict: "not lazily pulled",
+		},
+		{
+			name:    "canary",
+			config:  config.Config{Canaries: []config.CanaryConfig{{ImagePattern: "docker.io/library/*", Mode: "fallback", NodePercent: 100}}},
+			blocker: []string{"", CheckTOCDigest, CheckRangeSupport, CheckFooter, CheckFooter},
+			verdict: "not lazily pulled",
+		},
+	}
+	refspec, err := reference.Parse("docker.io/library/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Explainer{config: tt.config, hostname: "node", registry: reg}
+			r := e.explain(context.Background(), refspec, digest.FromString("manifest"), manifest)
+			for i, l := range r.Layers {
+				c, blocked := l.Blocker()
+				if got := c.Name; got != tt.blocker[i] {
+					t.Errorf("layer %d is blocked by %q; want %q: %+v", i, got, tt.blocker[i], l.Checks)
+				}
+				if l.Lazy && (blocked || !r.Checks[0].OK) {
+					t.Errorf("blocked layer %d is lazy", i)
+				}
+			}
+			if got := r.Verdict(); got != tt.verdict {
+				t.Errorf("verdict = %q; want %q", got, tt.verdict)
+			}
+			if err := r.WriteText(io.Discard); err != nil {
+				t.Errorf("failed to write report: %v", err)
+			}
+		})
+	}
+}
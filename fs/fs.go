@@ -38,27 +38,39 @@ package fs
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/bundle"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/erofs"
+	"github.com/containerd/stargz-snapshotter/fs/fscache"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/fs/policy"
+	"github.com/containerd/stargz-snapshotter/fs/progress"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/sbom"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
 	"github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/cacheutil"
 	metrics "github.com/docker/go-metrics"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -71,6 +83,21 @@ const (
 	defaultFuseTimeout    = time.Second
 	defaultMaxConcurrency = 2
 	fusermountBin         = "fusermount"
+	layersExpvarName      = "stargz_layers"
+	progressInterval      = time.Second
+
+	// sbomCacheSize is the number of images whose files listed in SBOM are kept.
+	sbomCacheSize = 64
+
+	// imageFetchBudgetCacheSize is the number of images whose background fetch budgets
+	// are kept.
+	imageFetchBudgetCacheSize = 256
+
+	// sbomFetchTimeout limits the time to get SBOM of an image.
+	sbomFetchTimeout = 30 * time.Second
+
+	mountBackendFUSE    = "fuse"
+	mountBackendFscache = "fscache"
 )
 
 type Option func(*options)
@@ -81,6 +108,9 @@ type options struct {
 	metadataStore     metadata.Store
 	metricsLogLevel   *logrus.Level
 	overlayOpaqueType layer.OverlayOpaqueType
+	progress          *progress.Broker
+	controller        *Controller
+	mountPolicy       policy.Evaluator
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -116,11 +146,46 @@ func WithOverlayOpaqueType(overlayOpaqueType layer.OverlayOpaqueType) Option {
 	}
 }
 
+// WithProgressBroker publishes the progress of fetching layers in background to the broker.
+func WithProgressBroker(b *progress.Broker) Option {
+	return func(opts *options) {
+		opts.progress = b
+	}
+}
+
+// WithController attaches the controller to the filesystem so that the filesystem can
+// be administrated through it.
+func WithController(c *Controller) Option {
+	return func(opts *options) {
+		opts.controller = c
+	}
+}
+
+// WithMountPolicy consults the evaluator before mounting each layer lazily, instead of the
+// policy engine configured by config.MountPolicyConfig. The timeout and the behavior on
+// failures of the config are still applied.
+func WithMountPolicy(e policy.Evaluator) Option {
+	return func(opts *options) {
+		opts.mountPolicy = e
+	}
+}
+
 func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
 		o(&fsOpts)
 	}
+	if cfg.StrictVerify && cfg.DisableVerification {
+		return nil, fmt.Errorf("strict_verify conflicts with disable_verification")
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+	canaries, err := newCanaries(cfg.Canaries, hostname)
+	if err != nil {
+		return nil, err
+	}
 	maxConcurrency := cfg.MaxConcurrency
 	if maxConcurrency == 0 {
 		maxConcurrency = defaultMaxConcurrency
@@ -163,11 +228,14 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		commonmetrics.Register(logLevel) // Register common metrics. This will happen only once.
 	}
 	c := layermetrics.NewLayerMetrics(ns)
+	layermetrics.AddLockMetrics(ns, "resolve", r.ResolveLockStats)
+	layermetrics.AddEgressMetrics(ns, r.Egress())
+	layermetrics.AddDecompressionMetrics(ns, r.DecompressionStats)
 	if ns != nil {
 		metrics.Register(ns) // Register layer metrics.
 	}
 
-	return &filesystem{
+	fs := &filesystem{
 		resolver:              r,
 		getSources:            getSources,
 		prefetchSize:          cfg.PrefetchSize,
@@ -175,13 +243,64 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
 		debug:                 cfg.Debug,
 		layer:                 make(map[string]layer.Layer),
+		layerImage:            make(map[string]mountedImage),
 		backgroundTaskManager: tm,
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
+		strictVerify:          cfg.StrictVerify,
 		metricsController:     c,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
-	}, nil
+		lazySizeThreshold:     cfg.LazyLayerSizeThreshold,
+		progress:              fsOpts.progress,
+		canaries:              canaries,
+		mountPolicy:           newMountPolicy(cfg.MountPolicy, fsOpts.mountPolicy),
+		pinnedImages:          cfg.PinnedImages,
+		directMount:           cfg.FuseConfig.DirectMount,
+		fetchBudget: fetchBudgetSpec{
+			layer: cfg.BackgroundFetchBudget,
+			image: cfg.ImageBackgroundFetchBudget,
+		},
+		imageFetchBudgets: cacheutil.NewLRUCache(imageFetchBudgetCacheSize),
+		fscacheMounts:     make(map[string]string),
+	}
+	if cfg.SBOMPrefetch {
+		fs.sbomCache = cacheutil.NewLRUCache(sbomCacheSize)
+	}
+	if cfg.EagerBoot.Enable {
+		cacheDir := root
+		if cfg.CacheDir != "" {
+			cacheDir = cfg.CacheDir
+		}
+		if fs.eagerBoot, err = newEagerBoot(root, cacheDir, cfg.EagerBoot); err != nil {
+			return nil, fmt.Errorf("failed to setup first-boot eager mode: %w", err)
+		}
+	}
+	switch cfg.MountBackend {
+	case "", mountBackendFUSE:
+	case mountBackendFscache:
+		fs.fscache = newFscacheDaemon(root, cfg)
+	default:
+		return nil, fmt.Errorf("unknown mount backend %q", cfg.MountBackend)
+	}
+	if fsOpts.controller != nil {
+		fsOpts.controller.attach(fs)
+	}
+	if expvar.Get(layersExpvarName) == nil {
+		expvar.Publish(layersExpvarName, expvar.Func(fs.layerInfo))
+	}
+	if cfg.RegistryProbeIntervalSec > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		fs.stopProbe = cancel
+		go fs.probeRegistries(ctx, time.Duration(cfg.RegistryProbeIntervalSec)*time.Second)
+	}
+	return fs, nil
+}
+
+// mountedImage is the image that a mounted layer belongs to.
+type mountedImage struct {
+	ref    string
+	layers []ocispec.Descriptor
 }
 
 type filesystem struct {
@@ -191,14 +310,38 @@ type filesystem struct {
 	noBackgroundFetch     bool
 	debug                 bool
 	layer                 map[string]layer.Layer
+	layerImage            map[string]mountedImage // image of the layer on each mountpoint
 	layerMu               sync.Mutex
 	backgroundTaskManager *task.BackgroundTaskManager
 	allowNoVerification   bool
 	disableVerification   bool
+	strictVerify          bool
 	getSources            source.GetSources
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
+	lazySizeThreshold     int64
+	progress              *progress.Broker
+	sbomCache             *cacheutil.LRUCache // files listed in SBOM of each image; nil if disabled
+	canaries              []canary
+	pinnedImages          []string
+	directMount           bool
+	fetchBudget           fetchBudgetSpec
+	imageFetchBudgets     *cacheutil.LRUCache // background fetch budgets shared in each image
+	fscache               *fscache.Daemon     // nil if layers are mounted only with FUSE
+	fscacheMounts         map[string]string   // fsid of each mountpoint mounted through fscache
+	eagerBoot             *eagerBoot          // nil if the first-boot eager mode is disabled
+	layerStates           layerStates
+	mountPolicy           *mountPolicy       // nil if no policy is configured
+	stopProbe             context.CancelFunc // nil if registries aren't probed
+}
+
+// Close stops the background goroutines of the filesystem. Mounted layers are kept.
+func (fs *filesystem) Close() error {
+	if fs.stopProbe != nil {
+		fs.stopProbe()
+	}
+	return nil
 }
 
 func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
@@ -219,6 +362,22 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	} else if len(src) == 0 {
 		return fmt.Errorf("source must be passed")
 	}
+	if err := checkCanary(fs.canaries, src[0].Name.String()); err != nil {
+		log.G(ctx).WithError(err).Info("layer isn't mounted for canary")
+		return err
+	}
+	if err := fs.mountPolicy.check(ctx, src[0], labels); err != nil {
+		log.G(ctx).WithError(err).Info("layer isn't mounted by the mount policy")
+		return err
+	}
+
+	// Small layers aren't worth mounting lazily because the overhead of FUSE exceeds
+	// the cost of downloading them. Fail before resolving (i.e. fetching the TOC) so the
+	// layer is pulled normally.
+	if size := src[0].Target.Size; size < fs.lazySizeThreshold {
+		log.G(ctx).Debugf("layer size %d is under the lazy threshold %d", size, fs.lazySizeThreshold)
+		return fmt.Errorf("layer size %d is under the lazy threshold %d", size, fs.lazySizeThreshold)
+	}
 
 	defaultPrefetchSize := fs.prefetchSize
 	if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
@@ -227,6 +386,14 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	}
 
+	fetchBudget := fs.fetchBudget
+	if v, ok := labels[config.TargetBackgroundFetchBudgetLabel]; ok {
+		fetchBudget.layer = v
+	}
+	if v, ok := labels[config.TargetImageBackgroundFetchBudgetLabel]; ok {
+		fetchBudget.image = v
+	}
+
 	// Resolve the target layer
 	var (
 		resultChan = make(chan layer.Layer)
@@ -238,7 +405,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target)
 			if err == nil {
 				resultChan <- l
-				fs.prefetch(ctx, l, defaultPrefetchSize, start)
+				fs.prefetch(ctx, l, s, defaultPrefetchSize, fetchBudget, start)
 				return
 			}
 			rErr = fmt.Errorf("failed to resolve layer %q from %q: %v: %w", s.Target.Digest, s.Name, err, rErr)
@@ -249,16 +416,23 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Also resolve and cache other layers in parallel
 	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
 	for _, desc := range neighboringLayers(preResolve.Manifest, preResolve.Target) {
+		if desc.Size < fs.lazySizeThreshold {
+			continue // this will be pulled normally
+		}
 		desc := desc
 		go func() {
-			// Avoids to get canceled by client.
+			// Avoids to get canceled by client. The namespace is kept for accounting the egress.
+			ns, hasNS := namespaces.Namespace(ctx)
 			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
+			if hasNS {
+				ctx = namespaces.WithNamespace(ctx, ns)
+			}
 			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc)
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
 				return
 			}
-			fs.prefetch(ctx, l, defaultPrefetchSize, start)
+			fs.prefetch(ctx, l, preResolve, defaultPrefetchSize, fetchBudget, start)
 
 			// Release this layer because this isn't target and we don't use it anymore here.
 			// However, this will remain on the resolver cache until eviction.
@@ -300,6 +474,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			return fmt.Errorf("invalid stargz layer: %w", err)
 		}
 		log.G(ctx).Debugf("verified")
+	} else if fs.strictVerify {
+		// Unverified layer can't be served in strict verification mode.
+		return fmt.Errorf("digest of TOC JSON must be passed in strict verification mode")
 	} else if _, ok := labels[config.TargetSkipVerifyLabel]; ok && fs.allowNoVerification {
 		// If unverified layer is allowed, use it with warning.
 		// This mode is for legacy stargz archives which don't contain digests
@@ -310,7 +487,16 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		// Verification must be done. Don't mount this layer.
 		return fmt.Errorf("digest of TOC JSON must be passed")
 	}
-	node, err := l.RootNode(0)
+	var devicePolicy layer.DevicePolicy
+	if v, ok := labels[config.TargetDevicePolicyLabel]; ok {
+		p, err := layer.ParseDevicePolicy(v)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("invalid device policy label")
+			return fmt.Errorf("invalid device policy: %w", err)
+		}
+		devicePolicy = p
+	}
+	node, err := l.RootNode(0, devicePolicy)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
 		return fmt.Errorf("failed to get root node: %w", err)
@@ -323,8 +509,49 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	fs.layerImage[mountpoint] = mountedImage{ref: src[0].Name.String(), layers: src[0].Manifest.Layers}
 	fs.layerMu.Unlock()
 	fs.metricsController.Add(mountpoint, l)
+	defer func() {
+		if retErr != nil {
+			return
+		}
+		fs.layerStates.mounted(mountpoint)
+		if !fs.noprefetch {
+			go func() {
+				if err := l.WaitForPrefetchCompletion(); err == nil {
+					fs.layerStates.prefetched(mountpoint)
+				}
+			}()
+		}
+	}()
+	if fs.pinned(src[0].Name.String(), labels) {
+		for _, s := range src {
+			if fs.resolver.Pin(s.Name, s.Target) {
+				log.G(ctx).Debugf("pinned layer %q of %q", s.Target.Digest, s.Name)
+			}
+		}
+	}
+
+	if v, ok := labels[config.TargetReadPriorityLabel]; ok {
+		if p, err := layer.ParseReadPriority(v); err != nil {
+			log.G(ctx).WithError(err).Warnf("ignoring read priority label")
+		} else if err := setReadPriority(l, p); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to set read priority")
+		}
+	}
+
+	// Prefer the in-kernel erofs if available. Layers that can't be mounted in this way
+	// are mounted with FUSE.
+	// Device policies are applied only by FUSE.
+	if fs.fscache != nil && (devicePolicy == "" || devicePolicy == layer.DevicesExpose) {
+		err := fs.mountFscache(mountpoint, l)
+		if err == nil {
+			log.G(ctx).Debugf("mounted layer through fscache")
+			return nil
+		}
+		log.G(ctx).WithError(err).Warnf("failed to mount layer through fscache; falling back to FUSE")
+	}
 
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
@@ -338,7 +565,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		FsName:     "stargz", // name this filesystem as "stargz"
 		Debug:      fs.debug,
 	}
-	if _, err := exec.LookPath(fusermountBin); err == nil {
+	if fs.directMount {
+		mountOpts.DirectMount = true
+	} else if _, err := exec.LookPath(fusermountBin); err == nil {
 		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
 	} else {
 		log.G(ctx).WithError(err).Infof("%s not installed; trying direct mount", fusermountBin)
@@ -376,8 +605,10 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	// Check the blob connectivity and try to refresh the connection on failure
 	if err := fs.check(ctx, l, labels); err != nil {
 		log.G(ctx).WithError(err).Warn("check failed")
+		fs.layerStates.setDegraded(mountpoint, true)
 		return err
 	}
+	fs.layerStates.setDegraded(mountpoint, false)
 
 	// Wait for prefetch compeletion
 	if !fs.noprefetch {
@@ -421,6 +652,105 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	return rErr
 }
 
+// layerInfo returns the current status of the mounted layers keyed by the mountpoint.
+func (fs *filesystem) layerInfo() interface{} {
+	fs.layerMu.Lock()
+	defer fs.layerMu.Unlock()
+	res := make(map[string]layer.Info, len(fs.layer))
+	for mp, l := range fs.layer {
+		res[mp] = l.Info()
+	}
+	return res
+}
+
+// probeRegistries periodically validates that registries serving the mounted layers
+// are still capable of lazy pulling so that failures can be noticed through metrics
+// and logs before users hit read failures. This returns when ctx is done.
+func (fs *filesystem) probeRegistries(ctx context.Context, interval time.Duration) {
+	type prober interface {
+		Probe(ctx context.Context) error
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fs.layerMu.Lock()
+		layers := make(map[string]layer.Layer, len(fs.layer))
+		for mp, l := range fs.layer {
+			layers[mp] = l
+		}
+		fs.layerMu.Unlock()
+		for mp, l := range layers {
+			p, ok := l.(prober)
+			if !ok {
+				continue
+			}
+			mp, dgst := mp, l.Info().Digest
+			fs.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+				ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mp))
+				start := time.Now()
+				err := p.Probe(ctx)
+				commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.RegistryProbe, dgst, start)
+				if err != nil {
+					commonmetrics.IncOperationCount(commonmetrics.RegistryProbeFailureCount, dgst)
+					log.G(ctx).WithError(err).Warnf("registry probe failed for layer %q", dgst)
+					fs.layerStates.setDegraded(mp, true)
+					return
+				}
+				fs.layerStates.setDegraded(mp, false)
+				log.G(ctx).Debugf("registry probe succeeded for layer %q", dgst)
+			}, interval)
+		}
+	}
+}
+
+// Freeze writes the contents of the layer mounted at the mountpoint that have been
+// fetched so far to the bundle at dir.
+func (fs *filesystem) Freeze(ctx context.Context, mountpoint string, dir string) (*bundle.Layer, error) {
+	type freezer interface {
+		Freeze(w io.WriterAt) ([]remote.Region, error)
+	}
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	f, ok := l.(freezer)
+	if !ok {
+		return nil, fmt.Errorf("layer at %q can't be frozen", mountpoint)
+	}
+	info := l.Info()
+	p := bundle.BlobPath(dir, info.Digest)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+	w, err := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(w.Name()) // nop if renamed
+	regions, err := f.Freeze(w)
+	if err == nil {
+		err = w.Truncate(info.Size) // keep unfetched tail as a hole
+	}
+	if cErr := w.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to freeze layer %v: %w", info.Digest, err)
+	}
+	if err := os.Rename(w.Name(), p); err != nil {
+		return nil, err
+	}
+	log.G(ctx).WithField("mountpoint", mountpoint).Debugf("froze %d regions of layer %v", len(regions), info.Digest)
+	return &bundle.Layer{Digest: info.Digest, Size: info.Size, Regions: regions}, nil
+}
+
 func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	fs.layerMu.Lock()
 	l, ok := fs.layer[mountpoint]
@@ -429,6 +759,10 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
 	delete(fs.layer, mountpoint) // unregisters the corresponding layer
+	delete(fs.layerImage, mountpoint)
+	fs.layerStates.remove(mountpoint)
+	fsid, isFscache := fs.fscacheMounts[mountpoint]
+	delete(fs.fscacheMounts, mountpoint)
 	l.Done()
 	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
@@ -437,19 +771,89 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	// In the future, we might be able to consider to kill that specific hanging
 	// goroutine using channel, etc.
 	// See also: https://www.kernel.org/doc/html/latest/filesystems/fuse.html#aborting-a-filesystem-connection
-	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
+	err := syscall.Unmount(mountpoint, syscall.MNT_FORCE)
+	if isFscache {
+		fs.fscache.Unregister(fsid)
+	}
+	return err
 }
 
-func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, defaultPrefetchSize int64, start time.Time) {
+// newFscacheDaemon starts the daemon serving layers to the kernel through fscache. This
+// returns nil if the kernel doesn't support it, so layers are mounted with FUSE.
+func newFscacheDaemon(root string, cfg config.Config) *fscache.Daemon {
+	if err := fscache.Supported(); err != nil {
+		log.L.WithError(err).Warn("fscache isn't supported; layers are mounted with FUSE")
+		return nil
+	}
+	dir := cfg.FscacheConfig.Dir
+	if dir == "" {
+		if cfg.CacheDir != "" {
+			root = cfg.CacheDir
+		}
+		dir = filepath.Join(root, "fscache-ondemand")
+	}
+	d, err := fscache.NewDaemon(dir)
+	if err != nil {
+		log.L.WithError(err).Warn("failed to start fscache daemon; layers are mounted with FUSE")
+		return nil
+	}
+	log.L.Infof("layers are mounted through fscache (cache directory: %q)", dir)
+	return d
+}
+
+type erofsImager interface {
+	EROFSImage() (*erofs.Image, error)
+}
+
+// mountFscache mounts the layer as erofs through fscache.
+func (fs *filesystem) mountFscache(mountpoint string, l layer.Layer) error {
+	ei, ok := l.(erofsImager)
+	if !ok {
+		return fmt.Errorf("layer doesn't support erofs")
+	}
+	img, err := ei.EROFSImage()
+	if err != nil {
+		return fmt.Errorf("failed to build erofs image: %w", err)
+	}
+	// The kernel keeps caches of images across mounts by fsid. Images having the same
+	// fsid must have the same contents.
+	fsid := digest.FromString(l.Info().Digest.String() + img.MetadataDigest().String()).Encoded()
+	if err := fs.fscache.Mount(mountpoint, fsid, img); err != nil {
+		return err
+	}
+	fs.layerMu.Lock()
+	fs.fscacheMounts[mountpoint] = fsid
+	fs.layerMu.Unlock()
+	return nil
+}
+
+func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, src source.Source, defaultPrefetchSize int64, fetchBudget fetchBudgetSpec, start time.Time) {
 	// Prefetch a layer. The first Check() for this layer waits for the prefetch completion.
 	if !fs.noprefetch {
-		go l.Prefetch(defaultPrefetchSize)
+		var opts []layer.PrefetchOption
+		if fs.sbomCache != nil && src.ManifestDigest != "" {
+			opts = append(opts, layer.WithPrioritizedFiles(func() []string {
+				return fs.sbomFiles(ctx, src)
+			}))
+		}
+		go l.Prefetch(defaultPrefetchSize, opts...)
 	}
 
-	// Fetch whole layer aggressively in background.
-	if !fs.noBackgroundFetch {
+	// Fetch whole layer aggressively in background. In the first-boot eager mode, the
+	// layer is fetched without budgets and without yielding to on-demand reads.
+	eager := fs.eagerBoot != nil && fs.eagerBoot.active()
+	if !fs.noBackgroundFetch || eager {
+		if eager {
+			if ef, ok := l.(eagerFetcher); ok {
+				ef.SetEagerFetch()
+			}
+		} else if budgets := fs.fetchBudgets(ctx, l, src, fetchBudget); len(budgets) > 0 {
+			if fb, ok := l.(fetchBudgeter); ok {
+				fb.SetFetchBudgets(budgets...)
+			}
+		}
 		go func() {
-			if err := l.BackgroundFetch(); err == nil {
+			if err := fs.backgroundFetch(l); err == nil {
 				// write log record for the latency between mount start and last on demand fetch
 				commonmetrics.LogLatencyForLastOnDemandFetch(ctx, l.Info().Digest, start, l.Info().ReadTime)
 			}
@@ -457,6 +861,119 @@ func (fs *filesystem) prefetch(ctx context.Context, l layer.Layer, defaultPrefet
 	}
 }
 
+type sbomEntry struct {
+	once  sync.Once
+	files []string
+}
+
+// sbomFiles returns files listed in the SBOM attached to the image of the source. SBOM is
+// fetched once per image and shared among its layers.
+func (fs *filesystem) sbomFiles(ctx context.Context, src source.Source) []string {
+	v, done, _ := fs.sbomCache.Add(src.ManifestDigest.String(), &sbomEntry{})
+	defer done()
+	e := v.(*sbomEntry)
+	e.once.Do(func() {
+		// Avoids to get canceled by client.
+		ctx, cancel := context.WithTimeout(log.WithLogger(context.Background(), log.G(ctx)), sbomFetchTimeout)
+		defer cancel()
+		files, err := sbom.Files(ctx, src.Hosts, src.Name, src.ManifestDigest)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("failed to get SBOM of %v", src.ManifestDigest)
+			return
+		}
+		log.G(ctx).Debugf("got %d files from SBOM of %v", len(files), src.ManifestDigest)
+		e.files = files
+	})
+	return e.files
+}
+
+// fetchBudgetSpec is the budgets of background fetch in the syntax of
+// layer.ParseFetchBudget. Empty means no limit.
+type fetchBudgetSpec struct {
+	layer string
+	image string
+}
+
+type fetchBudgeter interface {
+	SetFetchBudgets(...*layer.FetchBudget)
+}
+
+type eagerFetcher interface {
+	SetEagerFetch()
+}
+
+// fetchBudgets returns the budgets of background fetch of the layer. The budget of the
+// image is shared among its layers.
+func (fs *filesystem) fetchBudgets(ctx context.Context, l layer.Layer, src source.Source, spec fetchBudgetSpec) (budgets []*layer.FetchBudget) {
+	if spec.layer != "" {
+		if n, err := layer.ParseFetchBudget(spec.layer, l.Info().Size); err != nil {
+			log.G(ctx).WithError(err).Warnf("ignoring background fetch budget of layer")
+		} else {
+			budgets = append(budgets, layer.NewFetchBudget(n))
+		}
+	}
+	if spec.image != "" {
+		var size int64
+		for _, desc := range src.Manifest.Layers {
+			size += desc.Size
+		}
+		key := src.ManifestDigest.String()
+		if src.ManifestDigest == "" {
+			key = src.Name.String()
+		}
+		if n, err := layer.ParseFetchBudget(spec.image, size); err != nil {
+			log.G(ctx).WithError(err).Warnf("ignoring background fetch budget of image")
+		} else {
+			v, done, _ := fs.imageFetchBudgets.Add(key, layer.NewFetchBudget(n))
+			done() // the budget is kept by the layer while it's used
+			budgets = append(budgets, v.(*layer.FetchBudget))
+		}
+	}
+	return budgets
+}
+
+// backgroundFetch fetches the entire layer in background with tracking the progress.
+func (fs *filesystem) backgroundFetch(l layer.Layer) error {
+	var stopTracking func(error)
+	if fs.progress != nil {
+		stopTracking = fs.trackBackgroundFetch(l)
+	}
+	err := l.BackgroundFetch()
+	if stopTracking != nil {
+		stopTracking(err)
+	}
+	return err
+}
+
+// trackBackgroundFetch periodically publishes the progress of the layer until the
+// returned function is called with the result of the background fetch.
+func (fs *filesystem) trackBackgroundFetch(l layer.Layer) func(error) {
+	info := l.Info()
+	t := fs.progress.NewTracker(info.Digest, info.FetchedSize)
+	doneCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				info := l.Info()
+				t.Update(info.FetchedSize, info.Size)
+			case <-doneCh:
+				return
+			}
+		}
+	}()
+	return func(err error) {
+		close(doneCh)
+		<-stopped
+		info := l.Info()
+		t.Complete(info.FetchedSize, info.Size, err)
+	}
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
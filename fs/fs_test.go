@@ -28,6 +28,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
@@ -65,14 +66,17 @@ type breakableLayer struct {
 	success bool
 }
 
-func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
-func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       { return nil, nil }
+func (l *breakableLayer) Info() layer.Info { return layer.Info{} }
+func (l *breakableLayer) RootNode(uint32, layer.DevicePolicy) (fusefs.InodeEmbedder, error) {
+	return nil, nil
+}
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
-func (l *breakableLayer) Prefetch(prefetchSize int64) error                   { return fmt.Errorf("fail") }
+func (l *breakableLayer) Prefetch(int64, ...layer.PrefetchOption) error       { return fmt.Errorf("fail") }
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
 func (l *breakableLayer) WaitForPrefetchCompletion() error                    { return fmt.Errorf("fail") }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) Solidify(context.Context) error                      { return fmt.Errorf("fail") }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -86,3 +90,97 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	return nil
 }
 func (l *breakableLayer) Done() {}
+
+func TestMountUnderLazyThreshold(t *testing.T) {
+	small := ocispec.Descriptor{Digest: digest.FromString("small"), Size: 10}
+	// The resolver is nil so the layer must be rejected before being resolved.
+	fs := &filesystem{
+		backgroundTaskManager: task.NewBackgroundTaskManager(1, time.Millisecond),
+		getSources: func(map[string]string) ([]source.Source, error) {
+			return []source.Source{{
+				Name:     reference.Spec{Locator: "example.com/test", Object: "latest"},
+				Target:   small,
+				Manifest: ocispec.Manifest{Layers: []ocispec.Descriptor{small, small}},
+			}}, nil
+		},
+		lazySizeThreshold: 100,
+	}
+	if err := fs.Mount(context.TODO(), "test", nil); err == nil {
+		t.Errorf("layer under the lazy threshold must not be mounted")
+	}
+}
+
+func TestControllerWarmness(t *testing.T) {
+	dgstA, dgstB, dgstC := digest.FromString("a"), digest.FromString("b"), digest.FromString("c")
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"a": &warmLayer{digest: dgstA, w: layer.Warmness{Size: 100, FetchedSize: 50, PrioritizedSize: 20, PrioritizedFetchedSize: 20}},
+			"b": &warmLayer{digest: dgstB, w: layer.Warmness{Size: 100, FetchedSize: 0, PrioritizedSize: 20, PrioritizedFetchedSize: 0}},
+		},
+		layerImage: map[string]mountedImage{
+			"a": {ref: "example.com/img:1", layers: []ocispec.Descriptor{{Digest: dgstA, Size: 100}, {Digest: dgstC, Size: 200}}},
+			"b": {ref: "example.com/img:2", layers: []ocispec.Descriptor{{Digest: dgstB, Size: 100}}},
+		},
+	}
+	c := new(Controller)
+	c.attach(fs)
+
+	images, err := c.Warmness("")
+	if err != nil {
+		t.Fatalf("failed to get warmness: %v", err)
+	}
+	if len(images) != 2 || images[0].Ref != "example.com/img:1" || images[1].Ref != "example.com/img:2" {
+		t.Fatalf("unexpected images: %+v", images)
+	}
+	img1 := images[0]
+	if img1.Layers != 2 || img1.MountedLayers != 1 {
+		t.Errorf("layers = %d/%d; want 1/2", img1.MountedLayers, img1.Layers)
+	}
+	if img1.PrioritizedPercent != 100 {
+		t.Errorf("prioritized percent = %v; want 100", img1.PrioritizedPercent)
+	}
+	if want := float64(50) * 100 / 300; img1.TotalPercent != want {
+		t.Errorf("total percent = %v; want %v", img1.TotalPercent, want)
+	}
+	if w := img1.LayerWarmness[dgstC]; w.Size != 200 || w.FetchedSize != 0 {
+		t.Errorf("unmounted layer must be reported as not fetched: %+v", w)
+	}
+
+	images, err = c.Warmness("example.com/img:2")
+	if err != nil {
+		t.Fatalf("failed to get warmness of a ref: %v", err)
+	}
+	if len(images) != 1 || images[0].PrioritizedPercent != 0 || images[0].TotalPercent != 0 {
+		t.Errorf("unexpected warmness of a cold image: %+v", images)
+	}
+
+	if _, err := c.Warmness("example.com/unknown:1"); !errdefs.IsNotFound(err) {
+		t.Errorf("unknown ref must be not found: %v", err)
+	}
+}
+
+type warmLayer struct {
+	breakableLayer
+	digest digest.Digest
+	w      layer.Warmness
+}
+
+func (l *warmLayer) Info() layer.Info         { return layer.Info{Digest: l.digest} }
+func (l *warmLayer) Warmness() layer.Warmness { return l.w }
+
+func TestProbeRegistriesStops(t *testing.T) {
+	fs := &filesystem{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fs.probeRegistries(ctx, time.Millisecond)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("probing registries must stop when the context is done")
+	}
+}
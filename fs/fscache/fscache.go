@@ -0,0 +1,277 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fscache serves erofs images to the kernel through cachefiles in on-demand mode
+// (Linux 5.19+). The kernel mounts the images and caches their contents in the cache
+// directory, requesting the contents that aren't cached yet to this daemon.
+// See also: https://docs.kernel.org/filesystems/caching/cachefiles.html
+package fscache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	devicePath = "/dev/cachefiles"
+
+	opOpen  = 0
+	opClose = 1
+	opRead  = 2
+
+	msgHeaderSize  = 16 // struct cachefiles_msg
+	openHeaderSize = 16 // struct cachefiles_open
+	readSize       = 16 // struct cachefiles_read
+
+	// iocReadComplete is CACHEFILES_IOC_READ_COMPLETE (_IOW(0x98, 1, int)).
+	iocReadComplete = 0x40049801
+
+	maxMsgSize = 1 << 14
+)
+
+// Blob is the contents served to the kernel.
+type Blob interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// Supported checks if the kernel supports erofs over fscache.
+func Supported() error {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	erofs := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 && fields[len(fields)-1] == "erofs" {
+			erofs = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !erofs {
+		return fmt.Errorf("erofs isn't supported by the kernel")
+	}
+	if _, err := os.Stat(devicePath); err != nil {
+		return fmt.Errorf("cachefiles isn't supported by the kernel: %w", err)
+	}
+	return nil
+}
+
+// Daemon serves blobs to the kernel. Blobs are identified by fsid passed to erofs.
+type Daemon struct {
+	fd int
+
+	mu      sync.Mutex
+	blobs   map[string]Blob
+	objects map[uint32]*object
+}
+
+type object struct {
+	fd   int
+	blob Blob
+	wg   sync.WaitGroup // in-flight reads
+}
+
+// NewDaemon binds the cache in on-demand mode to the directory and starts serving
+// requests from the kernel. This fails on kernels without on-demand mode.
+func NewDaemon(dir string) (*Daemon, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fd, err := unix.Open(devicePath, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", devicePath, err)
+	}
+	for _, cmd := range []string{"dir " + dir, "bind ondemand"} {
+		if _, err := unix.Write(fd, []byte(cmd)); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to configure cachefiles (%q): %w", cmd, err)
+		}
+	}
+	d := &Daemon{
+		fd:      fd,
+		blobs:   make(map[string]Blob),
+		objects: make(map[uint32]*object),
+	}
+	go d.serve()
+	return d, nil
+}
+
+// Mount registers the blob as fsid and mounts it as erofs on the mountpoint.
+func (d *Daemon) Mount(mountpoint, fsid string, blob Blob) error {
+	d.mu.Lock()
+	if _, ok := d.blobs[fsid]; ok {
+		d.mu.Unlock()
+		return fmt.Errorf("fsid %q is already mounted", fsid)
+	}
+	d.blobs[fsid] = blob
+	d.mu.Unlock()
+	if err := unix.Mount("stargz", mountpoint, "erofs", unix.MS_RDONLY, "fsid="+fsid); err != nil {
+		d.Unregister(fsid)
+		return fmt.Errorf("failed to mount erofs: %w", err)
+	}
+	return nil
+}
+
+// Unregister unregisters the blob of fsid. This should be called after the blob is
+// unmounted.
+func (d *Daemon) Unregister(fsid string) {
+	d.mu.Lock()
+	delete(d.blobs, fsid)
+	d.mu.Unlock()
+}
+
+func (d *Daemon) serve() {
+	buf := make([]byte, maxMsgSize)
+	for {
+		if _, err := unix.Poll([]unix.PollFd{{Fd: int32(d.fd), Events: unix.POLLIN}}, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.L.WithError(err).Error("fscache: failed to poll requests")
+			return
+		}
+		n, err := unix.Read(d.fd, buf)
+		if err != nil {
+			if err == unix.EINTR || err == unix.EAGAIN {
+				continue
+			}
+			log.L.WithError(err).Error("fscache: failed to read requests")
+			return
+		}
+		if n < msgHeaderSize {
+			continue // no request
+		}
+		d.handle(buf[:n])
+	}
+}
+
+func (d *Daemon) handle(msg []byte) {
+	le := binary.LittleEndian
+	msgID, opcode, objectID := le.Uint32(msg[0:]), le.Uint32(msg[4:]), le.Uint32(msg[12:])
+	if l := int(le.Uint32(msg[8:])); l <= len(msg) {
+		msg = msg[:l]
+	}
+	data := msg[msgHeaderSize:]
+	switch opcode {
+	case opOpen:
+		if len(data) < openHeaderSize {
+			log.L.Errorf("fscache: too short open request %d", msgID)
+			return
+		}
+		volumeKeySize, cookieKeySize := int(le.Uint32(data[0:])), int(le.Uint32(data[4:]))
+		fd := int(le.Uint32(data[8:]))
+		keys := data[openHeaderSize:]
+		if len(keys) < volumeKeySize+cookieKeySize {
+			unix.Close(fd)
+			d.reply(msgID, -int64(unix.EINVAL))
+			return
+		}
+		// erofs uses fsid as the cookie key of the blob.
+		fsid := string(keys[volumeKeySize : volumeKeySize+cookieKeySize])
+		d.mu.Lock()
+		blob, ok := d.blobs[fsid]
+		if ok {
+			d.objects[objectID] = &object{fd: fd, blob: blob}
+		}
+		d.mu.Unlock()
+		if !ok {
+			log.L.Warnf("fscache: unknown fsid %q is requested", fsid)
+			unix.Close(fd)
+			d.reply(msgID, -int64(unix.ENOENT))
+			return
+		}
+		d.reply(msgID, blob.Size())
+	case opClose:
+		d.mu.Lock()
+		obj, ok := d.objects[objectID]
+		delete(d.objects, objectID)
+		d.mu.Unlock()
+		if ok {
+			go func() {
+				obj.wg.Wait()
+				unix.Close(obj.fd)
+			}()
+		}
+	case opRead:
+		if len(data) < readSize {
+			log.L.Errorf("fscache: too short read request %d", msgID)
+			return
+		}
+		d.mu.Lock()
+		obj, ok := d.objects[objectID]
+		if ok {
+			obj.wg.Add(1)
+		}
+		d.mu.Unlock()
+		if !ok {
+			log.L.Warnf("fscache: read request %d to unknown object %d", msgID, objectID)
+			return
+		}
+		// Reads can take long to fetch contents from the registry so serve them in parallel.
+		go func() {
+			defer obj.wg.Done()
+			obj.read(msgID, int64(le.Uint64(data[0:])), int64(le.Uint64(data[8:])))
+		}()
+	}
+}
+
+func (d *Daemon) reply(msgID uint32, size int64) {
+	if _, err := unix.Write(d.fd, []byte(fmt.Sprintf("copen %d,%d", msgID, size))); err != nil {
+		log.L.WithError(err).Errorf("fscache: failed to reply to open request %d", msgID)
+	}
+}
+
+// read writes the requested range of the blob to the cache. The kernel retries reading
+// the cache on completion and fails the read if the range still isn't cached.
+func (obj *object) read(msgID uint32, off, size int64) {
+	defer func() {
+		if err := unix.IoctlSetInt(obj.fd, iocReadComplete, int(msgID)); err != nil {
+			log.L.WithError(err).Errorf("fscache: failed to complete read request %d", msgID)
+		}
+	}()
+	if rem := obj.blob.Size() - off; size > rem {
+		size = rem
+	}
+	if size <= 0 {
+		return
+	}
+	buf := make([]byte, size)
+	if n, err := obj.blob.ReadAt(buf, off); n < len(buf) {
+		log.L.WithError(err).Errorf("fscache: failed to read %d bytes at %d", size, off)
+		return
+	}
+	for len(buf) > 0 {
+		n, err := unix.Pwrite(obj.fd, buf, off)
+		if err != nil {
+			log.L.WithError(err).Errorf("fscache: failed to write %d bytes at %d", len(buf), off)
+			return
+		}
+		buf, off = buf[n:], off+int64(n)
+	}
+}
@@ -0,0 +1,142 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// statBlockSize is the unit of st_blocks.
+	statBlockSize = 512
+
+	// attrInvalidationInterval is the interval of batched invalidations of attributes.
+	attrInvalidationInterval = time.Second
+)
+
+// BlocksPolicy is the policy of st_blocks (i.e. the allocated size) reported for files
+// in layers.
+type BlocksPolicy string
+
+const (
+	// BlocksApparent reports st_blocks based on the size of files as if they were
+	// stored on the disk. This is the default.
+	BlocksApparent BlocksPolicy = "apparent"
+
+	// BlocksFetched reports st_blocks of regular files based on the size of their
+	// contents already fetched to the cache, so that du reports the usage of the cache.
+	BlocksFetched BlocksPolicy = "fetched"
+
+	// BlocksZero reports zero st_blocks for all files.
+	BlocksZero BlocksPolicy = "zero"
+)
+
+// ParseBlocksPolicy parses the name of a policy of st_blocks. Empty string is
+// BlocksApparent.
+func ParseBlocksPolicy(s string) (BlocksPolicy, error) {
+	switch p := BlocksPolicy(s); p {
+	case "":
+		return BlocksApparent, nil
+	case BlocksApparent, BlocksFetched, BlocksZero:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown blocks policy %q", s)
+}
+
+// setBlocks sets st_blocks of the file following the policy of the filesystem.
+func (fs *fs) setBlocks(id uint32, out *fuse.Attr) {
+	switch fs.blocksPolicy {
+	case BlocksZero:
+		out.Blocks = 0
+		return
+	case BlocksFetched:
+		if out.Mode&syscall.S_IFMT != syscall.S_IFREG {
+			break
+		}
+		fr, ok := fs.r.(reader.FetchedSizer)
+		if !ok {
+			break
+		}
+		size, err := fr.FetchedSize(id)
+		if err != nil {
+			fs.s.report(fmt.Errorf("failed to get fetched size of %d: %w", id, err))
+			break
+		}
+		out.Blocks = sizeToBlocks(uint64(size))
+		return
+	}
+	out.Blocks = sizeToBlocks(out.Size)
+}
+
+func sizeToBlocks(size uint64) uint64 {
+	return (size + statBlockSize - 1) / statBlockSize
+}
+
+// attrInvalidator invalidates attributes of inodes cached by the kernel so that changes of
+// st_blocks are visible without shortening the attribute timeout. Invalidations requested
+// during an interval are batched into one notification per inode, not to cross the
+// kernel on every read.
+type attrInvalidator struct {
+	interval time.Duration
+	notify   func(in *fusefs.Inode)
+
+	mu        sync.Mutex
+	pending   map[*fusefs.Inode]struct{}
+	scheduled bool
+}
+
+func newAttrInvalidator(interval time.Duration) *attrInvalidator {
+	return &attrInvalidator{
+		interval: interval,
+		notify: func(in *fusefs.Inode) {
+			// Negative offset invalidates only attributes, keeping the page cache.
+			// Errors are ignored because they only mean the inode isn't cached.
+			in.NotifyContent(-1, 0)
+		},
+	}
+}
+
+// add schedules the invalidation of attributes of the inode.
+func (ai *attrInvalidator) add(in *fusefs.Inode) {
+	ai.mu.Lock()
+	defer ai.mu.Unlock()
+	if ai.pending == nil {
+		ai.pending = make(map[*fusefs.Inode]struct{})
+	}
+	ai.pending[in] = struct{}{}
+	if !ai.scheduled {
+		ai.scheduled = true
+		time.AfterFunc(ai.interval, ai.flush)
+	}
+}
+
+func (ai *attrInvalidator) flush() {
+	ai.mu.Lock()
+	pending := ai.pending
+	ai.pending, ai.scheduled = nil, false
+	ai.mu.Unlock()
+	for in := range pending {
+		ai.notify(in)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestParseBlocksPolicy(t *testing.T) {
+	for in, want := range map[string]BlocksPolicy{
+		"":         BlocksApparent,
+		"apparent": BlocksApparent,
+		"fetched":  BlocksFetched,
+		"zero":     BlocksZero,
+	} {
+		got, err := ParseBlocksPolicy(in)
+		if err != nil || got != want {
+			t.Errorf("ParseBlocksPolicy(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseBlocksPolicy("allocated"); err == nil {
+		t.Errorf("unknown policy must be rejected")
+	}
+}
+
+type testFetchedSizer struct {
+	testReader
+	fetched int64
+}
+
+func (tr *testFetchedSizer) FetchedSize(id uint32) (int64, error) { return tr.fetched, nil }
+
+func TestSetBlocks(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy BlocksPolicy
+		mode   uint32
+		want   uint64
+	}{
+		{name: "apparent", policy: BlocksApparent, mode: syscall.S_IFREG, want: 20},
+		{name: "fetched", policy: BlocksFetched, mode: syscall.S_IFREG, want: 2},
+		{name: "fetched_dir", policy: BlocksFetched, mode: syscall.S_IFDIR, want: 20},
+		{name: "zero", policy: BlocksZero, mode: syscall.S_IFREG, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fs{r: &testFetchedSizer{fetched: 1000}, blocksPolicy: tt.policy}
+			out := &fuse.Attr{Size: 10000, Mode: tt.mode | 0644}
+			fs.setBlocks(1, out)
+			if out.Blocks != tt.want {
+				t.Errorf("Blocks = %d; want %d", out.Blocks, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttrInvalidator(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		notified = make(map[*fusefs.Inode]int)
+	)
+	ai := newAttrInvalidator(100 * time.Millisecond)
+	ai.notify = func(in *fusefs.Inode) {
+		mu.Lock()
+		notified[in]++
+		mu.Unlock()
+	}
+	a, b := new(fusefs.Inode), new(fusefs.Inode)
+	for i := 0; i < 10; i++ {
+		ai.add(a)
+	}
+	ai.add(b)
+	time.Sleep(500 * time.Millisecond)
+	ai.add(a)
+	time.Sleep(500 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if notified[a] != 2 || notified[b] != 1 {
+		t.Errorf("notified a %d times and b %d times; want 2 and 1", notified[a], notified[b])
+	}
+}
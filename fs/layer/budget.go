@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrFetchBudgetExhausted is returned by BackgroundFetch when it stops because a
+// budget of the layer is exhausted. The rest of the layer is fetched on demand.
+var ErrFetchBudgetExhausted = errors.New("background fetch budget is exhausted")
+
+// FetchBudget is the number of bytes that can be fetched from the registry in
+// background. A budget can be shared among layers (e.g. of an image) so that they don't
+// fetch more than it in total. The budget can be exceeded by the size of a read in
+// flight when it's exhausted.
+type FetchBudget struct {
+	limit int64
+	used  int64
+}
+
+// NewFetchBudget returns a budget of limit bytes.
+func NewFetchBudget(limit int64) *FetchBudget {
+	return &FetchBudget{limit: limit}
+}
+
+// Exhausted reports whether the budget is used up.
+func (b *FetchBudget) Exhausted() bool {
+	return atomic.LoadInt64(&b.used) >= b.limit
+}
+
+// Used returns the number of bytes fetched with the budget.
+func (b *FetchBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+func (b *FetchBudget) consume(n int64) {
+	atomic.AddInt64(&b.used, n)
+}
+
+// ParseFetchBudget parses a budget of fetching contents of the total size, which is
+// either a number of bytes (e.g. "1048576") or a percentage of size (e.g. "30%").
+func ParseFetchBudget(s string, size int64) (int64, error) {
+	if p := strings.TrimSuffix(s, "%"); p != s {
+		percent, err := strconv.ParseFloat(p, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid percentage of budget %q", s)
+		}
+		return int64(float64(size) * percent / 100), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid budget %q", s)
+	}
+	return n, nil
+}
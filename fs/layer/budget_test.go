@@ -0,0 +1,54 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import "testing"
+
+func TestParseFetchBudget(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":       0,
+		"1048576": 1048576,
+		"30%":     300,
+		"12.5%":   125,
+		"100%":    1000,
+	} {
+		got, err := ParseFetchBudget(in, 1000)
+		if err != nil || got != want {
+			t.Errorf("ParseFetchBudget(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "-1", "101%", "x%", "1MiB"} {
+		if _, err := ParseFetchBudget(in, 1000); err == nil {
+			t.Errorf("invalid budget %q must be rejected", in)
+		}
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	b := NewFetchBudget(10)
+	b.consume(6)
+	if b.Exhausted() {
+		t.Fatalf("budget must not be exhausted after using 6 of 10 bytes")
+	}
+	b.consume(6)
+	if !b.Exhausted() || b.Used() != 12 {
+		t.Fatalf("budget must be exhausted after using %d of 10 bytes", b.Used())
+	}
+	if !NewFetchBudget(0).Exhausted() {
+		t.Fatalf("zero budget must be exhausted")
+	}
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+// DevicePolicy is the policy of device nodes (character and block devices) and FIFOs
+// contained in layers. Some hardened runtimes reject layers exposing them through FUSE.
+type DevicePolicy string
+
+const (
+	// DevicesExpose exposes device nodes and FIFOs as they are. This is the default.
+	DevicesExpose DevicePolicy = "expose"
+
+	// DevicesMask hides device nodes and FIFOs as if they don't exist in the layer.
+	DevicesMask DevicePolicy = "mask"
+
+	// DevicesEmpty replaces device nodes and FIFOs with empty regular files, keeping their
+	// permission bits, owners and timestamps.
+	DevicesEmpty DevicePolicy = "empty"
+)
+
+// ParseDevicePolicy parses the name of a policy of device nodes and FIFOs. Empty string
+// is DevicesExpose.
+func ParseDevicePolicy(s string) (DevicePolicy, error) {
+	switch p := DevicePolicy(s); p {
+	case "":
+		return DevicesExpose, nil
+	case DevicesExpose, DevicesMask, DevicesEmpty:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown device policy %q", s)
+}
+
+// isDeviceMode reports whether the mode is of a device node or a FIFO.
+func isDeviceMode(m os.FileMode) bool {
+	return m&(os.ModeDevice|os.ModeNamedPipe) != 0
+}
+
+// deviceMode returns the mode of the entry exposed following the policy of the filesystem.
+// ok is false if the entry is hidden.
+func (fs *fs) deviceMode(m os.FileMode) (_ os.FileMode, ok bool) {
+	if !isDeviceMode(m) {
+		return m, true
+	}
+	switch fs.devicePolicy {
+	case DevicesMask:
+		return 0, false
+	case DevicesEmpty:
+		return m &^ os.ModeType, true
+	}
+	return m, true
+}
+
+// applyDevicePolicy modifies the attributes of the entry following the policy of the
+// filesystem. emptied is true if the entry is replaced with an empty regular file and
+// ok is false if the entry is hidden.
+func (fs *fs) applyDevicePolicy(attr *metadata.Attr) (emptied, ok bool) {
+	m, ok := fs.deviceMode(attr.Mode)
+	if !ok {
+		return false, false
+	}
+	if m == attr.Mode {
+		return false, true
+	}
+	attr.Mode = m
+	attr.Size = 0
+	attr.DevMajor, attr.DevMinor = 0, 0
+	return true, true
+}
@@ -25,19 +25,26 @@ package layer
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
 	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/egress"
+	"github.com/containerd/stargz-snapshotter/fs/erofs"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
@@ -58,6 +65,17 @@ const (
 	defaultMaxCacheFds              = 10
 	defaultPrefetchTimeoutSec       = 10
 	memoryCacheType                 = "memory"
+
+	// resolveLockHoldThreshold is the duration after which a layer kept locked for
+	// resolution is reported as a possible leak of the lock.
+	resolveLockHoldThreshold = 5 * time.Minute
+
+	// accessStatsFlushInterval is the interval to write access stats of the fs cache
+	// so that they mostly survive crashes.
+	accessStatsFlushInterval = time.Minute
+
+	// egressFlushInterval is the interval to write the egress records.
+	egressFlushInterval = time.Minute
 )
 
 // Layer represents a layer.
@@ -65,8 +83,9 @@ type Layer interface {
 	// Info returns the information of this layer.
 	Info() Info
 
-	// RootNode returns the root node of this layer.
-	RootNode(baseInode uint32) (fusefs.InodeEmbedder, error)
+	// RootNode returns the root node of this layer. devicePolicy overrides the policy of
+	// device nodes and FIFOs configured for the resolver unless it's empty.
+	RootNode(baseInode uint32, devicePolicy DevicePolicy) (fusefs.InodeEmbedder, error)
 
 	// Check checks if the layer is still connectable.
 	Check() error
@@ -84,7 +103,7 @@ type Layer interface {
 
 	// Prefetch prefetches the specified size. If the layer is eStargz and contains landmark files,
 	// the range indicated by these files is respected.
-	Prefetch(prefetchSize int64) error
+	Prefetch(prefetchSize int64, opts ...PrefetchOption) error
 
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
@@ -96,6 +115,11 @@ type Layer interface {
 	// Fetching contents is done as a background task.
 	BackgroundFetch() error
 
+	// Solidify fetches all contents of this layer to the cache, verifying them, and makes
+	// this layer independent of the registry: Check and Refresh don't access the registry
+	// anymore. This layer needs to be verified in advance.
+	Solidify(ctx context.Context) error
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -108,6 +132,36 @@ type Info struct {
 	FetchedSize  int64     // layer fetched size in bytes
 	PrefetchSize int64     // layer prefetch size in bytes
 	ReadTime     time.Time // last time the layer was read
+	Solid        bool      // whether the layer is served only from the cache
+	ReadPriority ReadPriority
+}
+
+// Warmness is the amount of contents of a layer that have been fetched to the node.
+type Warmness struct {
+	Size        int64 `json:"size"`
+	FetchedSize int64 `json:"fetchedSize"`
+
+	// PrioritizedSize is the size of the prefix of the blob containing prioritized files.
+	// This is 0 if the layer has no prioritized files or doesn't indicate them.
+	PrioritizedSize        int64 `json:"prioritizedSize"`
+	PrioritizedFetchedSize int64 `json:"prioritizedFetchedSize"`
+}
+
+// PrefetchOption is an option of Prefetch.
+type PrefetchOption func(*prefetchOptions)
+
+type prefetchOptions struct {
+	prioritizedFiles func() []string
+}
+
+// WithPrioritizedFiles specifies files to prefetch when the layer doesn't indicate
+// prioritized files. f is called only in that case so it can lazily get the files (e.g.
+// from SBOM). Files are prefetched in the order until their total size exceeds the
+// prefetch size, if the prefetch size is positive.
+func WithPrioritizedFiles(f func() []string) PrefetchOption {
+	return func(o *prefetchOptions) {
+		o.prioritizedFiles = f
+	}
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -117,6 +171,7 @@ type Resolver struct {
 	prefetchTimeout       time.Duration
 	layerCache            *cacheutil.TTLCache
 	layerCacheMu          sync.Mutex
+	sharedLayers          *sharedLayers
 	blobCache             *cacheutil.TTLCache
 	blobCacheMu           sync.Mutex
 	backgroundTaskManager *task.BackgroundTaskManager
@@ -124,6 +179,16 @@ type Resolver struct {
 	config                config.Config
 	metadataStore         metadata.Store
 	overlayOpaqueType     OverlayOpaqueType
+	pathPolicy            estargz.PathPolicy
+	chunkIndex            *reader.ChunkIndex
+	metadataCache         *metadataCache
+	readScheduler         *readScheduler
+	blocksPolicy          BlocksPolicy
+	devicePolicy          DevicePolicy
+	egress                *egress.Accounting
+	decryptionKeys        map[string][]byte
+	prefetcher            *cache.Prefetcher
+	decompressionPool     *reader.DecompressionPool
 }
 
 // NewResolver returns a new layer resolver.
@@ -141,7 +206,9 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 	// the filesystem resolves and caches all layers in an image (not only queried one) in parallel,
 	// before they are actually queried.
 	layerCache := cacheutil.NewTTLCache(resolveResultEntryTTL)
+	shared := newSharedLayers()
 	layerCache.OnEvicted = func(key string, value interface{}) {
+		shared.remove(key)
 		if err := value.(*layer).close(); err != nil {
 			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up layer")
 			return
@@ -160,24 +227,133 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		logrus.WithField("key", key).Debugf("cleaned up blob")
 	}
 
+	if err := validateXattrPolicies(cfg.XattrPolicies); err != nil {
+		return nil, err
+	}
+	pathPolicy, err := estargz.ParsePathPolicy(cfg.PathPolicy)
+	if err != nil {
+		return nil, err
+	}
+	blocksPolicy, err := ParseBlocksPolicy(cfg.BlocksPolicy)
+	if err != nil {
+		return nil, err
+	}
+	devicePolicy, err := ParseDevicePolicy(cfg.DevicePolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CacheDir != "" {
+		root = cfg.CacheDir
+	}
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
 	}
 
+	var chunkIndex *reader.ChunkIndex
+	if cfg.ShareChunksAcrossLayers {
+		chunkIndex = reader.NewChunkIndex()
+	}
+
+	var mc *metadataCache
+	if cfg.MetadataCacheSizeMB > 0 {
+		mc = newMetadataCache(cfg.MetadataCacheSizeMB << 20)
+	}
+
+	var egressAccounting *egress.Accounting
+	if cfg.EgressAccounting {
+		egressAccounting, err = egress.New(filepath.Join(root, "egress.csv"), egressFlushInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var decryptionKeys map[string][]byte
+	if cfg.DecryptionKeysDir != "" {
+		decryptionKeys, err = loadDecryptionKeys(cfg.DecryptionKeysDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load decryption keys: %w", err)
+		}
+	}
+
+	cacheFillConcurrency := cfg.CacheFillConcurrency
+	if cacheFillConcurrency <= 0 {
+		cacheFillConcurrency = runtime.GOMAXPROCS(0)
+	}
+
+	var decompressionPool *reader.DecompressionPool
+	if dc := cfg.Decompression; dc.Workers > 0 || len(dc.CodecWorkers) > 0 {
+		decompressionPool = reader.NewDecompressionPool(dc.Workers, dc.CodecWorkers, dc.CgroupCPUMax)
+	}
+
+	resolveLock := namedmutex.New(namedmutex.WithHoldThreshold(resolveLockHoldThreshold, func(name string, held time.Duration) {
+		log.L.Warnf("layer %q has been locked for resolution over %v", name, held)
+	}))
+
 	return &Resolver{
 		rootDir:               root,
 		resolver:              remote.NewResolver(cfg.BlobConfig, resolveHandlers),
 		layerCache:            layerCache,
+		sharedLayers:          shared,
 		blobCache:             blobCache,
 		prefetchTimeout:       prefetchTimeout,
 		backgroundTaskManager: backgroundTaskManager,
 		config:                cfg,
-		resolveLock:           new(namedmutex.NamedMutex),
+		resolveLock:           resolveLock,
 		metadataStore:         metadataStore,
 		overlayOpaqueType:     overlayOpaqueType,
+		pathPolicy:            pathPolicy,
+		chunkIndex:            chunkIndex,
+		metadataCache:         mc,
+		readScheduler:         newReadScheduler(backgroundTaskManager, cfg.LowPriorityReadConcurrency),
+		blocksPolicy:          blocksPolicy,
+		devicePolicy:          devicePolicy,
+		egress:                egressAccounting,
+		decryptionKeys:        decryptionKeys,
+		prefetcher:            cache.NewPrefetcher(cacheFillConcurrency),
+		decompressionPool:     decompressionPool,
 	}, nil
 }
 
+// layerCodec returns the codec of the layer, detected from the decompressor of the metadata
+// if available.
+func layerCodec(meta metadata.Reader, mediaType string) string {
+	d, ok := meta.(interface{ Decompressor() estargz.Decompressor })
+	if !ok {
+		return reader.CodecOfMediaType(mediaType)
+	}
+	switch d.Decompressor().(type) {
+	case *zstdchunked.Decompressor:
+		return reader.CodecZstd
+	case *uncompressed.Decompressor:
+		return reader.CodecUncompressed
+	}
+	return reader.CodecGzip
+}
+
+// loadDecryptionKeys reads keys of encrypted files from the directory, one key per file.
+func loadDecryptionKeys(dir string) (map[string][]byte, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, e := range ents {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		key, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != estargz.EncryptionKeySize {
+			return nil, fmt.Errorf("key %q must be %d bytes but %d", e.Name(), estargz.EncryptionKeySize, len(key))
+		}
+		keys[estargz.KeyID(key)] = key
+	}
+	return keys, nil
+}
+
 func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
@@ -206,51 +382,187 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value interface{}) {
 		value.(*os.File).Close()
 	}
+	dirs := []string{root}
+	if len(dcc.TierDirs) > 0 {
+		dirs = make([]string, len(dcc.TierDirs))
+		for i, d := range dcc.TierDirs {
+			dirs[i] = filepath.Join(d, filepath.Base(root))
+		}
+	}
 	// create a cache on an unique directory
+	var cachePaths []string
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, err
+		}
+		cachePath, err := os.MkdirTemp(d, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
+		}
+		cachePaths = append(cachePaths, cachePath)
+	}
+	dcConfig := cache.DirectoryCacheConfig{
+		SyncAdd:   dcc.SyncAdd,
+		DataCache: dCache,
+		FdCache:   fCache,
+		BufPool:   bufPool,
+		Direct:    dcc.Direct,
+	}
+	if len(cachePaths) > 1 {
+		return cache.NewTieredDirectoryCache(cachePaths, dcConfig)
+	}
+	return cache.NewDirectoryCache(cachePaths[0], dcConfig)
+}
+
+// newHotCache wraps the fs cache of a layer with a hot cache on an unique directory.
+func newHotCache(fsCache cache.BlobCache, cfg config.HotChunkCacheConfig) (cache.BlobCache, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		fsCache.Close()
+		return nil, err
+	}
+	hotPath, err := os.MkdirTemp(cfg.Dir, "")
+	if err != nil {
+		fsCache.Close()
+		return nil, err
+	}
+	hc, err := cache.NewHotCache(fsCache, hotPath, cache.HotCacheConfig{
+		MaxSize: cfg.MaxSizeMB * 1024 * 1024,
+		MinHits: cfg.MinHits,
+	})
+	if err != nil {
+		fsCache.Close()
+		os.RemoveAll(hotPath)
+		return nil, err
+	}
+	return hc, nil
+}
+
+// newSmallObjectCache wraps the fs cache of a layer with a small object cache on an
+// unique directory.
+func newSmallObjectCache(fsCache cache.BlobCache, root string, maxSize int64) (cache.BlobCache, error) {
 	if err := os.MkdirAll(root, 0700); err != nil {
+		fsCache.Close()
 		return nil, err
 	}
-	cachePath, err := os.MkdirTemp(root, "")
+	dir, err := os.MkdirTemp(root, "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to initialize directory cache: %w", err)
-	}
-	return cache.NewDirectoryCache(
-		cachePath,
-		cache.DirectoryCacheConfig{
-			SyncAdd:   dcc.SyncAdd,
-			DataCache: dCache,
-			FdCache:   fCache,
-			BufPool:   bufPool,
-			Direct:    dcc.Direct,
-		},
-	)
+		fsCache.Close()
+		return nil, err
+	}
+	sc, err := cache.NewSmallObjectCache(fsCache, dir, cache.SmallObjectCacheConfig{
+		MaxObjectSize: maxSize,
+	})
+	if err != nil {
+		fsCache.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Purge drops resolved layers and blobs kept for reuse and returns the number of the
+// dropped ones. Resources of layers still in use are released after they are done.
+func (r *Resolver) Purge() int {
+	r.layerCacheMu.Lock()
+	n := r.layerCache.Purge()
+	r.layerCacheMu.Unlock()
+	r.blobCacheMu.Lock()
+	n += r.blobCache.Purge()
+	r.blobCacheMu.Unlock()
+	return n
+}
+
+// Pin exempts the resolved layer and its blob from eviction and Purge so that they are kept
+// until the process exits. This returns false if the layer isn't cached by this resolver.
+func (r *Resolver) Pin(refspec reference.Spec, desc ocispec.Descriptor) bool {
+	name := refspec.String() + "/" + desc.Digest.String()
+	// The layer can be shared with another image.
+	layerName := name
+	if sharedName, ok := r.sharedLayers.get(shareKey(desc.Digest, xattrPolicyIndex(r.config.XattrPolicies, refspec.String()))); ok {
+		layerName = sharedName
+	}
+	r.layerCacheMu.Lock()
+	ok := r.layerCache.Pin(name) || r.layerCache.Pin(layerName)
+	r.layerCacheMu.Unlock()
+	r.blobCacheMu.Lock()
+	r.blobCache.Pin(name)
+	r.blobCacheMu.Unlock()
+	return ok
+}
+
+// Egress returns the accounting of bytes fetched from registries. This is nil unless
+// enabled by the config.
+func (r *Resolver) Egress() *egress.Accounting {
+	return r.egress
+}
+
+// Offline returns the offline mode of blobs resolved by this resolver.
+func (r *Resolver) Offline() *remote.Offline {
+	return r.resolver.Offline()
+}
+
+// ResolveLockStats returns the statistics of the lock serializing resolutions of each layer.
+func (r *Resolver) ResolveLockStats() namedmutex.Stats {
+	return r.resolveLock.Stats()
+}
+
+// DecompressionStats returns the statistics of the decompression pool for each codec. This
+// returns nil if the pool isn't enabled.
+func (r *Resolver) DecompressionStats() map[string]reader.DecompressionStats {
+	return r.decompressionPool.Stats()
+}
+
+// getCachedLayer retrieves the layer from the underlying cache.
+func (r *Resolver) getCachedLayer(ctx context.Context, name string) (Layer, bool) {
+	r.layerCacheMu.Lock()
+	c, done, ok := r.layerCache.Get(name)
+	r.layerCacheMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if l := c.(*layer); l.Check() == nil {
+		log.G(ctx).Debugf("hit layer cache %q", name)
+		return &layerRef{l, done}, true
+	}
+	// Cached layer is invalid
+	done()
+	r.layerCacheMu.Lock()
+	r.layerCache.Remove(name)
+	r.layerCacheMu.Unlock()
+	return nil, false
 }
 
 // Resolve resolves a layer based on the passed layer blob information.
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, esgzOpts ...metadata.Option) (_ Layer, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
 
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("src", name))
+
 	// Wait if resolving this layer is already running. The result
-	// can hopefully get from the cache.
+	// can hopefully get from the cache. Lookups of the cache don't block
+	// each other so mounts of a hot layer aren't serialized.
+	r.resolveLock.RLock(name)
+	cached, ok := r.getCachedLayer(ctx, name)
+	r.resolveLock.RUnlock(name)
+	if ok {
+		return cached, nil
+	}
 	r.resolveLock.Lock(name)
 	defer r.resolveLock.Unlock(name)
 
-	ctx = log.WithLogger(ctx, log.G(ctx).WithField("src", name))
+	// The layer might have been resolved while waiting for the lock.
+	if l, ok := r.getCachedLayer(ctx, name); ok {
+		return l, nil
+	}
 
-	// First, try to retrieve this layer from the underlying cache.
-	r.layerCacheMu.Lock()
-	c, done, ok := r.layerCache.Get(name)
-	r.layerCacheMu.Unlock()
-	if ok {
-		if l := c.(*layer); l.Check() == nil {
-			log.G(ctx).Debugf("hit layer cache %q", name)
-			return &layerRef{l, done}, nil
+	// The same blob might have been resolved for another image (e.g. a base layer pushed
+	// to many repositories). Share it instead of resolving it again.
+	sharedKey := shareKey(desc.Digest, xattrPolicyIndex(r.config.XattrPolicies, refspec.String()))
+	if sharedName, ok := r.sharedLayers.get(sharedKey); ok && sharedName != name {
+		if l, ok := r.getCachedLayer(ctx, sharedName); ok {
+			log.G(ctx).Debugf("sharing layer resolved as %q", sharedName)
+			return l, nil
 		}
-		// Cached layer is invalid
-		done()
-		r.layerCacheMu.Lock()
-		r.layerCache.Remove(name)
-		r.layerCacheMu.Unlock()
 	}
 
 	log.G(ctx).Debugf("resolving")
@@ -270,6 +582,27 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	if err != nil {
 		return nil, fmt.Errorf("failed to create fs cache: %w", err)
 	}
+	if maxSize := r.config.SmallObjectMaxSize; maxSize > 0 && r.config.FSCacheType != memoryCacheType {
+		fsCache, err = newSmallObjectCache(fsCache, filepath.Join(r.rootDir, "smallobjects"), maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create small object cache: %w", err)
+		}
+	}
+	if hcc := r.config.HotChunkCache; hcc.Dir != "" && hcc.MaxSizeMB > 0 {
+		fsCache, err = newHotCache(fsCache, hcc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create hot chunk cache: %w", err)
+		}
+	}
+	if r.config.PersistAccessStats {
+		statsPath := filepath.Join(r.rootDir, "stats", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+		sc, err := cache.NewAccessStatsCache(fsCache, statsPath, accessStatsFlushInterval)
+		if err != nil {
+			fsCache.Close()
+			return nil, fmt.Errorf("failed to load access stats: %w", err)
+		}
+		fsCache = sc
+	}
 	defer func() {
 		if retErr != nil {
 			fsCache.Close()
@@ -277,14 +610,16 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}()
 
 	// Get a reader for stargz archive.
-	// Each file's read operation is a prioritized task and all background tasks
-	// will be stopped during the execution so this can avoid being disturbed for
-	// NW traffic by background tasks.
-	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
-		r.backgroundTaskManager.DoPrioritizedTask()
-		defer r.backgroundTaskManager.DonePrioritizedTask()
-		return blobR.ReadAt(p, offset)
-	}), 0, blobR.Size())
+	// Each file's read operation is scheduled following the read priority class of
+	// the layer, which can be changed after the layer is mounted.
+	priority := new(priorityClass)
+	newSectionReader := func(b remote.Blob) *io.SectionReader {
+		return io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
+			return r.readScheduler.do(priority, func() (int, error) {
+				return b.ReadAt(p, offset)
+			})
+		}), 0, b.Size())
+	}
 	// define telemetry hooks to measure latency metrics inside estargz package
 	telemetry := metadata.Telemetry{
 		GetFooterLatency: func(start time.Time) {
@@ -297,30 +632,84 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 			commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.DeserializeTocJSON, desc.Digest, start)
 		},
 	}
-	meta, err := r.metadataStore(sr,
-		append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(new(zstdchunked.Decompressor)))...)
+	metaOpts := append(esgzOpts, metadata.WithTelemetry(&telemetry), metadata.WithDecompressors(new(zstdchunked.Decompressor), new(uncompressed.Decompressor)),
+		metadata.WithPathPolicy(r.pathPolicy), metadata.WithContext(ctx))
+	meta, err := r.newMetadata(desc.Digest, newSectionReader(blobR), metaOpts...)
+	// The blob can be wrapped by outer compression envelopes. Try to unwrap them
+	// following the decompression chain.
+	for i := 0; err != nil && ctx.Err() == nil && i < len(r.config.DecompressionChain); i++ {
+		ub, uErr := unwrapBlob(filepath.Join(r.rootDir, "unwrapped"), blobR.Blob, r.config.DecompressionChain)
+		if uErr != nil {
+			log.G(ctx).WithError(uErr).Debugf("failed to unwrap blob")
+			break
+		}
+		log.G(ctx).Debugf("unwrapped outer compression envelope of the blob")
+		wrapped := blobR
+		blobR = &blobRef{ub, func() {
+			ub.Close()
+			wrapped.done()
+		}}
+		meta, err = r.metadataStore(newSectionReader(blobR), metaOpts...)
+	}
 	if err != nil {
 		return nil, err
 	}
-	vr, err := reader.NewReader(meta, fsCache, desc.Digest)
+	readerOpts := []reader.Option{reader.WithChunkIndex(r.chunkIndex), reader.WithPrefetcher(r.prefetcher)}
+	if r.config.StrictVerify {
+		readerOpts = append(readerOpts, reader.WithStrictVerify())
+	}
+	if r.config.ZeroCopyRead {
+		readerOpts = append(readerOpts, reader.WithZeroCopy())
+	}
+	if r.config.SpanChunks > 1 {
+		readerOpts = append(readerOpts, reader.WithSpanChunks(r.config.SpanChunks))
+	}
+	if len(r.decryptionKeys) > 0 {
+		readerOpts = append(readerOpts, reader.WithDecryptionKeys(r.decryptionKeys))
+	}
+	if r.decompressionPool != nil {
+		readerOpts = append(readerOpts, reader.WithDecompressionPool(r.decompressionPool, layerCodec(meta, desc.MediaType)))
+	}
+	vr, err := reader.NewReader(meta, fsCache, desc.Digest, readerOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
 
 	// Combine layer information together and cache it.
 	l := newLayer(r, desc, blobR, vr)
+	l.priority = priority
+	l.xattrFilter = newXattrFilter(r.config.XattrPolicies, refspec.String())
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
 	r.layerCacheMu.Unlock()
 	if !added {
 		l.close() // layer already exists in the cache. discrad this.
 	}
+	r.sharedLayers.add(sharedKey, name)
 
 	log.G(ctx).Debugf("resolved")
 	return &layerRef{cachedL.(*layer), done2}, nil
 }
 
 // resolveBlob resolves a blob based on the passed layer blob information.
+// newMetadata parses the metadata of the blob. If the metadata cache is enabled, the parsed
+// metadata is shared among mounts of the layer.
+func (r *Resolver) newMetadata(dgst digest.Digest, sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader, error) {
+	if r.metadataCache == nil {
+		return r.metadataStore(sr, opts...)
+	}
+	if meta, ok, err := r.metadataCache.get(dgst.String(), sr); ok {
+		return meta, nil
+	} else if err != nil {
+		return nil, err
+	}
+	meta, err := r.metadataStore(sr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.metadataCache.add(dgst.String(), meta, sr)
+}
+
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
 	name := refspec.String() + "/" + desc.Digest.String()
 
@@ -350,7 +739,14 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 	}()
 
 	// Resolve the blob and cache the result.
-	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, httpCache)
+	var resolveOpts []remote.ResolveOption
+	if r.egress != nil {
+		// Blobs are shared by the reference so the bytes are accounted to the namespace
+		// that resolved the blob first.
+		key := egress.KeyOf(ctx, refspec)
+		resolveOpts = append(resolveOpts, remote.WithFetchRecorder(func(n int64) { r.egress.Add(key, n) }))
+	}
+	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, httpCache, resolveOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve the source: %w", err)
 	}
@@ -393,8 +789,24 @@ type layer struct {
 	closed   bool
 	closedMu sync.Mutex
 
+	solid   bool
+	solidMu sync.Mutex
+
 	prefetchOnce        sync.Once
 	backgroundFetchOnce sync.Once
+
+	// xattrFilter reports whether an xattr is exposed to containers. nil exposes all.
+	xattrFilter func(name string) bool
+
+	priority *priorityClass
+
+	// fetchBudgets limit the bytes fetched in background.
+	fetchBudgets   []*FetchBudget
+	fetchBudgetsMu sync.Mutex
+
+	// eagerFetch is non-zero if the layer is fetched in background without yielding to
+	// prioritized tasks.
+	eagerFetch int32
 }
 
 func (l *layer) Info() Info {
@@ -408,9 +820,46 @@ func (l *layer) Info() Info {
 		FetchedSize:  l.blob.FetchedSize(),
 		PrefetchSize: l.prefetchedSize(),
 		ReadTime:     readTime,
+		Solid:        l.isSolid(),
+		ReadPriority: l.ReadPriority(),
 	}
 }
 
+// SetReadPriority changes the priority class of on-demand reads of this layer.
+func (l *layer) SetReadPriority(p ReadPriority) {
+	if l.priority != nil {
+		l.priority.set(p)
+	}
+}
+
+// SetFetchBudgets sets budgets of the bytes fetched in background. BackgroundFetch stops
+// when any of them is exhausted. This must be called before BackgroundFetch.
+func (l *layer) SetFetchBudgets(budgets ...*FetchBudget) {
+	l.fetchBudgetsMu.Lock()
+	l.fetchBudgets = budgets
+	l.fetchBudgetsMu.Unlock()
+}
+
+// SetEagerFetch makes BackgroundFetch fetch the layer without yielding to prioritized
+// tasks (e.g. on-demand reads and prefetch). This must be called before BackgroundFetch.
+func (l *layer) SetEagerFetch() {
+	atomic.StoreInt32(&l.eagerFetch, 1)
+}
+
+func (l *layer) getFetchBudgets() []*FetchBudget {
+	l.fetchBudgetsMu.Lock()
+	defer l.fetchBudgetsMu.Unlock()
+	return l.fetchBudgets
+}
+
+// ReadPriority returns the priority class of on-demand reads of this layer.
+func (l *layer) ReadPriority() ReadPriority {
+	if l.priority == nil {
+		return ReadPriorityNormal
+	}
+	return l.priority.get()
+}
+
 func (l *layer) prefetchedSize() int64 {
 	l.prefetchSizeMu.Lock()
 	sz := l.prefetchSize
@@ -422,13 +871,74 @@ func (l *layer) Check() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	if l.isSolid() {
+		return nil
+	}
 	return l.blob.Check()
 }
 
+// Probe checks that the registry still serves this layer in the way lazy pulling
+// requires. The tail of the blob, which contains the TOC and the footer, is fetched
+// from the registry. Only the footer is fetched if the TOC can't be located. Nop if
+// the blob isn't served by a registry.
+func (l *layer) Probe(ctx context.Context) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	p, ok := l.blob.Blob.(interface {
+		Probe(ctx context.Context, offset int64, size int64) error
+	})
+	if !ok {
+		return nil
+	}
+	offset := l.tocOffset()
+	return p.Probe(ctx, offset, l.blob.Size()-offset)
+}
+
+// tocOffset returns the offset of the TOC parsed from the footer of the blob. The offset of
+// the footer is returned instead if the footer can't be parsed.
+func (l *layer) tocOffset() int64 {
+	decompressors := []estargz.Decompressor{
+		new(estargz.GzipDecompressor),
+		new(estargz.LegacyGzipDecompressor),
+		new(zstdchunked.Decompressor),
+		new(uncompressed.Decompressor),
+	}
+	size := l.blob.Size()
+	footerOffset := size - estargz.FooterSize
+	var tailSize int64
+	for _, d := range decompressors {
+		if fSize := d.FooterSize(); fSize > tailSize {
+			tailSize = fSize
+		}
+	}
+	if tailSize > size {
+		tailSize, footerOffset = size, 0
+	}
+	footer := make([]byte, tailSize)
+	if _, err := l.blob.ReadAt(footer, size-tailSize); err != nil {
+		return footerOffset
+	}
+	for _, d := range decompressors {
+		fSize := d.FooterSize()
+		if fSize > tailSize {
+			continue
+		}
+		_, tocOffset, _, err := d.ParseFooter(footer[tailSize-fSize:])
+		if err == nil && tocOffset >= 0 && tocOffset < size-fSize {
+			return tocOffset
+		}
+	}
+	return footerOffset
+}
+
 func (l *layer) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	if l.isSolid() {
+		return nil
+	}
 	return l.blob.Refresh(ctx, hosts, refspec, desc)
 }
 
@@ -440,6 +950,12 @@ func (l *layer) Verify(tocDigest digest.Digest) (err error) {
 		return nil
 	}
 	l.r, err = l.verifiableReader.VerifyTOC(tocDigest)
+	if err == nil && l.resolver.config.VerifyChunksOnFetch {
+		// Chunk digests can be trusted now because the TOC is verified.
+		if cv, ok := l.blob.Blob.(interface{ SetChunkVerifier(remote.ChunkVerifier) }); ok {
+			cv.SetChunkVerifier(&chunkVerifier{r: l.verifiableReader.Metadata()})
+		}
+	}
 	return
 }
 
@@ -450,12 +966,16 @@ func (l *layer) SkipVerify() {
 	l.r = l.verifiableReader.SkipVerify()
 }
 
-func (l *layer) Prefetch(prefetchSize int64) (err error) {
+func (l *layer) Prefetch(prefetchSize int64, opts ...PrefetchOption) (err error) {
+	var pOpts prefetchOptions
+	for _, o := range opts {
+		o(&pOpts)
+	}
 	l.prefetchOnce.Do(func() {
 		ctx := context.Background()
 		l.resolver.backgroundTaskManager.DoPrioritizedTask()
 		defer l.resolver.backgroundTaskManager.DonePrioritizedTask()
-		err = l.prefetch(ctx, prefetchSize)
+		err = l.prefetch(ctx, prefetchSize, pOpts)
 		if err != nil {
 			log.G(ctx).WithError(err).Warnf("failed to prefetch layer=%v", l.desc.Digest)
 			return
@@ -465,7 +985,7 @@ func (l *layer) Prefetch(prefetchSize int64) (err error) {
 	return
 }
 
-func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
+func (l *layer) prefetch(ctx context.Context, prefetchSize int64, opts prefetchOptions) error {
 	defer l.prefetchWaiter.done() // Notify the completion
 	// Measuring the total time to complete prefetch (use defer func() because l.Info().PrefetchSize is set later)
 	start := time.Now()
@@ -476,17 +996,22 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
-	rootID := l.verifiableReader.Metadata().RootID()
-	if _, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.NoPrefetchLandmark); err == nil {
-		// do not prefetch this layer
-		return nil
-	} else if id, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.PrefetchLandmark); err == nil {
-		offset, err := l.verifiableReader.Metadata().GetOffset(id)
-		if err != nil {
-			return fmt.Errorf("failed to get offset of prefetch landmark: %w", err)
+	size, ok, err := l.prioritizedSize()
+	if err != nil {
+		return err
+	}
+	if (!ok || size == 0) && opts.prioritizedFiles != nil {
+		// The layer isn't optimized. Prefetch the specified files if available.
+		if files := opts.prioritizedFiles(); len(files) > 0 {
+			return l.prefetchFiles(ctx, files, prefetchSize)
+		}
+	}
+	if ok {
+		if size == 0 {
+			return nil // do not prefetch this layer
 		}
 		// override the prefetch size with optimized value
-		prefetchSize = offset
+		prefetchSize = size
 	} else if prefetchSize > l.blob.Size() {
 		// adjust prefetch size not to exceed the whole layer size
 		prefetchSize = l.blob.Size()
@@ -494,7 +1019,7 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 
 	// Fetch the target range
 	downloadStart := time.Now()
-	err := l.blob.Cache(0, prefetchSize)
+	err = l.blob.Cache(0, prefetchSize)
 	commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.PrefetchDownload, downloadStart) // time to download prefetch data
 
 	if err != nil {
@@ -519,6 +1044,109 @@ func (l *layer) prefetch(ctx context.Context, prefetchSize int64) error {
 	return nil
 }
 
+// prefetchFiles caches the contents of the files in this layer. Files not in this layer
+// are ignored because they are usually in other layers of the image.
+func (l *layer) prefetchFiles(ctx context.Context, files []string, prefetchSize int64) error {
+	r := l.verifiableReader.Metadata()
+	offsets := make(map[int64]struct{})
+	var size int64
+	for _, f := range files {
+		if prefetchSize > 0 && size >= prefetchSize {
+			break
+		}
+		id, attr, err := resolvePath(r, f)
+		if err != nil || !attr.Mode.IsRegular() || attr.Size == 0 {
+			continue
+		}
+		offset, err := r.GetOffset(id)
+		if err != nil {
+			return fmt.Errorf("failed to get offset of %q: %w", f, err)
+		}
+		if _, ok := offsets[offset]; ok {
+			continue // hardlink to a file already counted
+		}
+		offsets[offset] = struct{}{}
+		size += attr.Size
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	// Set prefetch size for metrics
+	l.prefetchSizeMu.Lock()
+	l.prefetchSize = size
+	l.prefetchSizeMu.Unlock()
+
+	log.G(ctx).Debugf("prefetching %d files (%d bytes) listed as prioritized", len(offsets), size)
+	if err := l.verifiableReader.Cache(reader.WithFilter(func(offset int64) bool {
+		_, ok := offsets[offset]
+		return ok
+	})); err != nil {
+		return fmt.Errorf("failed to cache prioritized files: %w", err)
+	}
+	return nil
+}
+
+// resolvePath returns the node of the path relative to the root of the layer.
+func resolvePath(r metadata.Reader, p string) (id uint32, attr metadata.Attr, err error) {
+	id = r.RootID()
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		if id, attr, err = r.GetChild(id, name); err != nil {
+			return 0, metadata.Attr{}, err
+		}
+	}
+	return id, attr, nil
+}
+
+// prioritizedSize returns the size of the prefix of the blob containing prioritized files.
+// This is indicated by the landmark files or the prefetch boundary recorded in the TOC.
+// ok is false if the layer indicates neither of them.
+func (l *layer) prioritizedSize() (size int64, ok bool, err error) {
+	rootID := l.verifiableReader.Metadata().RootID()
+	if _, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.NoPrefetchLandmark); err == nil {
+		return 0, true, nil
+	} else if id, _, err := l.verifiableReader.Metadata().GetChild(rootID, estargz.PrefetchLandmark); err == nil {
+		offset, err := l.verifiableReader.Metadata().GetOffset(id)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to get offset of prefetch landmark: %w", err)
+		}
+		return offset, true, nil
+	} else if offset, ok := l.verifiableReader.Metadata().PrefetchBoundary(); ok {
+		// the blob is built without landmarks but records the boundary in TOC
+		return offset, true, nil
+	}
+	return 0, false, nil
+}
+
+// Warmness returns how much of this layer has been fetched.
+func (l *layer) Warmness() Warmness {
+	w := Warmness{Size: l.blob.Size(), FetchedSize: l.blob.FetchedSize()}
+	if l.isClosed() {
+		return w
+	}
+	if size, ok, err := l.prioritizedSize(); err == nil && ok {
+		w.PrioritizedSize = size
+	}
+	if rl, ok := l.blob.Blob.(interface{ FetchedRegions() []remote.Region }); ok {
+		for _, reg := range rl.FetchedRegions() {
+			if reg.Offset >= w.PrioritizedSize {
+				break // regions are sorted
+			}
+			end := reg.Offset + reg.Size
+			if end > w.PrioritizedSize {
+				end = w.PrioritizedSize
+			}
+			w.PrioritizedFetchedSize += end - reg.Offset
+		}
+	} else if w.FetchedSize == w.Size {
+		w.PrioritizedFetchedSize = w.PrioritizedSize
+	}
+	return w
+}
+
 func (l *layer) WaitForPrefetchCompletion() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -529,8 +1157,11 @@ func (l *layer) WaitForPrefetchCompletion() error {
 func (l *layer) BackgroundFetch() (err error) {
 	l.backgroundFetchOnce.Do(func() {
 		ctx := context.Background()
-		err = l.backgroundFetch(ctx)
-		if err != nil {
+		err = l.backgroundFetch(ctx, l.getFetchBudgets())
+		if errors.Is(err, ErrFetchBudgetExhausted) {
+			log.G(ctx).Infof("stopped fetching layer=%v in background: %v", l.desc.Digest, err)
+			return
+		} else if err != nil {
 			log.G(ctx).WithError(err).Warnf("failed to fetch whole layer=%v", l.desc.Digest)
 			return
 		}
@@ -539,13 +1170,28 @@ func (l *layer) BackgroundFetch() (err error) {
 	return
 }
 
-func (l *layer) backgroundFetch(ctx context.Context) error {
+// backgroundFetch fetches the entire layer to the cache. This stops with
+// ErrFetchBudgetExhausted when any of the budgets is exhausted.
+func (l *layer) backgroundFetch(ctx context.Context, budgets []*FetchBudget) error {
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchTotal, time.Now())
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
+	var exhausted int32
 	br := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (retN int, retErr error) {
-		l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+		for _, b := range budgets {
+			if b.Exhausted() {
+				atomic.StoreInt32(&exhausted, 1)
+				return 0, ErrFetchBudgetExhausted
+			}
+		}
+		var fetched int64
+		defer func() {
+			for _, b := range budgets {
+				b.consume(fetched)
+			}
+		}()
+		fetch := func(ctx context.Context) {
 			// Measuring the time to download background fetch data (in milliseconds)
 			defer commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.BackgroundFetchDownload, l.Info().Digest, time.Now()) // time to download background fetch data
 			retN, retErr = l.blob.ReadAt(
@@ -553,35 +1199,195 @@ func (l *layer) backgroundFetch(ctx context.Context) error {
 				offset,
 				remote.WithContext(ctx),              // Make cancellable
 				remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
+				remote.WithFetchedBytes(&fetched),
 			)
-		}, 120*time.Second)
+		}
+		if atomic.LoadInt32(&l.eagerFetch) != 0 {
+			fetch(ctx)
+			return
+		}
+		l.resolver.backgroundTaskManager.InvokeBackgroundTask(fetch, 120*time.Second)
 		return
 	}), 0, l.blob.Size())
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchDecompress, time.Now()) // time to decompress background fetch data (in milliseconds)
-	return l.verifiableReader.Cache(
+	cacheOpts := []reader.CacheOption{
 		reader.WithReader(br),                // Read contents in background
 		reader.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
-	)
+	}
+	var err error
+	if l.resolver.config.VerifyTarStructure {
+		var check func(int64) error
+		check, err = l.tarHeaderCheck(ctx, br)
+		cacheOpts = append(cacheOpts, reader.WithTarHeaderCheck(check))
+	}
+	if err == nil {
+		err = l.verifiableReader.Cache(cacheOpts...)
+	}
+	if err != nil {
+		if atomic.LoadInt32(&exhausted) != 0 {
+			return ErrFetchBudgetExhausted
+		}
+		return err
+	}
+	if l.resolver.config.VerifyDiffID {
+		return l.verifyDiffID(ctx, br)
+	}
+	return nil
+}
+
+func (l *layer) Solidify(ctx context.Context) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	if l.r == nil {
+		return fmt.Errorf("layer hasn't been verified yet")
+	}
+	if l.isSolid() {
+		return nil
+	}
+	// Fetch contents not cached yet (including ones failed in background). Chunks are
+	// verified when they are fetched.
+	if err := l.backgroundFetch(ctx, nil); err != nil {
+		return fmt.Errorf("failed to fetch the entire layer: %w", err)
+	}
+	l.solidMu.Lock()
+	l.solid = true
+	l.solidMu.Unlock()
+	log.G(ctx).WithField("digest", l.desc.Digest).Info("layer is solidified")
+	return nil
+}
+
+func (l *layer) isSolid() bool {
+	l.solidMu.Lock()
+	defer l.solidMu.Unlock()
+	return l.solid
+}
+
+// tarHeaderCheck returns the function to check the tar header of the regular file at the
+// offset of the blob read through br against the TOC. This is passed to the cache so that
+// corrupted conversions are detected by the chunk fetching the file, before reads hit them.
+func (l *layer) tarHeaderCheck(ctx context.Context, br *io.SectionReader) (func(int64) error, error) {
+	r, err := estargz.Open(br, estargz.WithDecompressors(new(zstdchunked.Decompressor), new(uncompressed.Decompressor)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TOC for verifying tar structure: %w", err)
+	}
+	v := r.NewTarHeaderVerifier()
+	return func(offset int64) error {
+		if err := v.Verify(offset); err != nil {
+			log.G(ctx).WithError(err).Errorf("tar structure of layer %v diverges from TOC", l.desc.Digest)
+			return fmt.Errorf("tar structure diverges from TOC: %w", err)
+		}
+		return nil
+	}, nil
+}
+
+// verifyDiffID checks the digest of the uncompressed contents of the blob read through br
+// against the DiffID annotated to the layer. Nop if the layer isn't annotated.
+func (l *layer) verifyDiffID(ctx context.Context, br *io.SectionReader) error {
+	v, ok := l.desc.Annotations[estargz.DiffIDAnnotation]
+	if !ok {
+		return nil
+	}
+	diffID, err := digest.Parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid DiffID %q: %w", v, err)
+	}
+	r, err := estargz.Open(br, estargz.WithDecompressors(new(zstdchunked.Decompressor), new(uncompressed.Decompressor)))
+	if err != nil {
+		return fmt.Errorf("failed to parse TOC for verifying DiffID: %w", err)
+	}
+	dr, err := r.Decompressor().Reader(io.NewSectionReader(br, 0, br.Size()))
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	dgstr := diffID.Algorithm().Digester()
+	if _, err := io.Copy(dgstr.Hash(), dr); err != nil {
+		return fmt.Errorf("failed to decompress layer for verifying DiffID: %w", err)
+	}
+	if got := dgstr.Digest(); got != diffID {
+		log.G(ctx).Errorf("DiffID of layer %v is %v but annotated %v", l.desc.Digest, got, diffID)
+		return fmt.Errorf("DiffID must be %v but got %v", diffID, got)
+	}
+	return nil
 }
 
 func (l *layerRef) Done() {
 	l.done()
 }
 
-func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
+func (l *layer) RootNode(baseInode uint32, devicePolicy DevicePolicy) (fusefs.InodeEmbedder, error) {
 	if l.isClosed() {
 		return nil, fmt.Errorf("layer is already closed")
 	}
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType)
+	if devicePolicy == "" {
+		devicePolicy = l.resolver.devicePolicy
+	}
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, l.resolver.overlayOpaqueType, l.xattrFilter, l.resolver.config.ReadAttribution, l.resolver.blocksPolicy, devicePolicy)
+}
+
+// EROFSImage returns the erofs image of this layer, to be mounted through fscache instead
+// of FUSE. Contents of the image are read through the same reader as the FUSE filesystem.
+func (l *layer) EROFSImage() (*erofs.Image, error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	if l.r == nil {
+		return nil, fmt.Errorf("layer hasn't been verified yet")
+	}
+	opq, ok := opaqueXattrs[l.resolver.overlayOpaqueType]
+	if !ok {
+		return nil, fmt.Errorf("unknown overlay opaque type")
+	}
+	return erofs.Build(l.r.Metadata(), l.r.OpenFile, erofs.WithOpaqueXattrs(opq...), erofs.WithXattrFilter(l.xattrFilter))
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return l.blob.ReadAt(p, offset, opts...)
 }
 
+// Freeze writes the contents of this layer fetched so far to w, at the same offsets as
+// in the blob, and returns the written regions. Contents that haven't been fetched are
+// left unwritten.
+func (l *layer) Freeze(w io.WriterAt) ([]remote.Region, error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	var regions []remote.Region
+	if rl, ok := l.blob.Blob.(interface{ FetchedRegions() []remote.Region }); ok {
+		regions = rl.FetchedRegions()
+	} else if size := l.blob.Size(); l.blob.FetchedSize() == size {
+		regions = []remote.Region{{Offset: 0, Size: size}} // e.g. blob unwrapped to a local file
+	} else {
+		return nil, fmt.Errorf("fetched regions of layer %v are unknown", l.desc.Digest)
+	}
+	buf := make([]byte, 1<<20)
+	for _, reg := range regions {
+		for off := reg.Offset; off < reg.Offset+reg.Size; {
+			p := buf
+			if remain := reg.Offset + reg.Size - off; remain < int64(len(p)) {
+				p = p[:remain]
+			}
+			n, err := l.blob.ReadAt(p, off, remote.WithCacheOpts(cache.Direct()))
+			if err == nil && n == 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil && !(err == io.EOF && n == len(p)) {
+				return nil, fmt.Errorf("failed to read region [%d, %d) of layer %v: %w",
+					reg.Offset, reg.Offset+reg.Size, l.desc.Digest, err)
+			}
+			if _, err := w.WriteAt(p[:n], off); err != nil {
+				return nil, err
+			}
+			off += int64(n)
+		}
+	}
+	return regions, nil
+}
+
 func (l *layer) close() error {
 	l.closedMu.Lock()
 	defer l.closedMu.Unlock()
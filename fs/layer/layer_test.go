@@ -23,10 +23,17 @@
 package layer
 
 import (
+	"bytes"
+	"context"
+	"io"
 	"testing"
 	"time"
 
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	memorymetadata "github.com/containerd/stargz-snapshotter/metadata/memory"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
 )
 
 func TestLayer(t *testing.T) {
@@ -59,3 +66,67 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestProbe(t *testing.T) {
+	sr, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("a", "aaa"),
+	}, testutil.WithEStargzOptions(estargz.WithCompression(struct {
+		*zstdchunked.Compressor
+		*zstdchunked.Decompressor
+	}{&zstdchunked.Compressor{CompressionLevel: zstd.SpeedDefault}, new(zstdchunked.Decompressor)})))
+	if err != nil {
+		t.Fatalf("failed to build sample estargz: %v", err)
+	}
+	garbage := io.NewSectionReader(bytes.NewReader([]byte("not a footer of estargz")), 0, 23)
+	tests := []struct {
+		name       string
+		sr         *io.SectionReader
+		wantOffset int64
+	}{
+		{
+			name:       "toc",
+			sr:         sr,
+			wantOffset: tocOffsetOf(t, sr),
+		},
+		{
+			name:       "no_footer",
+			sr:         garbage,
+			wantOffset: 0,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			pb := &probeBlob{sampleBlob: newBlob(tt.sr)}
+			l := &layer{blob: &blobRef{pb, func() {}}}
+			if err := l.Probe(context.Background()); err != nil {
+				t.Fatalf("failed to probe: %v", err)
+			}
+			if pb.offset != tt.wantOffset || pb.size != tt.sr.Size()-tt.wantOffset {
+				t.Errorf("probed %d-%d; want %d-%d", pb.offset, pb.offset+pb.size, tt.wantOffset, tt.sr.Size())
+			}
+		})
+	}
+}
+
+func tocOffsetOf(t *testing.T, sr *io.SectionReader) int64 {
+	footer := make([]byte, zstdchunked.FooterSize)
+	if _, err := sr.ReadAt(footer, sr.Size()-zstdchunked.FooterSize); err != nil {
+		t.Fatalf("failed to read footer: %v", err)
+	}
+	_, tocOffset, _, err := new(zstdchunked.Decompressor).ParseFooter(footer)
+	if err != nil {
+		t.Fatalf("failed to parse footer: %v", err)
+	}
+	return tocOffset
+}
+
+type probeBlob struct {
+	*sampleBlob
+	offset, size int64
+}
+
+func (pb *probeBlob) Probe(ctx context.Context, offset int64, size int64) error {
+	pb.offset, pb.size = offset, size
+	return nil
+}
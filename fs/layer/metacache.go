@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+// metadataNodeSize is the estimated memory usage of metadata of a node, used for
+// accounting the memory budget of the metadata cache.
+const metadataNodeSize = 512
+
+// metadataCache is a daemon-wide LRU cache of parsed metadata readers keyed by the layer
+// digest. New mounts of a cached layer clone the reader instead of parsing the TOC again.
+// Readers are closed after they are evicted and all of their clones are closed.
+type metadataCache struct {
+	budget  int64
+	size    int64
+	ll      *list.List
+	entries map[string]*list.Element
+	mu      sync.Mutex
+}
+
+type metadataEntry struct {
+	key  string
+	r    metadata.Reader
+	cost int64
+	refs int // clones in use and the cache itself
+}
+
+func newMetadataCache(budget int64) *metadataCache {
+	return &metadataCache{
+		budget:  budget,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a clone of the cached reader of the layer which reads the blob from sr.
+func (c *metadataCache) get(key string, sr *io.SectionReader) (metadata.Reader, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	c.ll.MoveToFront(el)
+	r, err := c.cloneLocked(el.Value.(*metadataEntry), sr)
+	return r, err == nil, err
+}
+
+// add caches the reader parsed from sr and returns its clone. The cache takes the ownership
+// of r. If the reader doesn't fit in the budget, r is returned as-is without being cached.
+func (c *metadataCache) add(key string, r metadata.Reader, sr *io.SectionReader) (metadata.Reader, error) {
+	n, err := numOfNodes(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	cost := int64(n) * metadataNodeSize
+	if cost > c.budget {
+		return r, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		// Another mount of the same layer parsed it concurrently.
+		r.Close()
+		c.ll.MoveToFront(el)
+		return c.cloneLocked(el.Value.(*metadataEntry), sr)
+	}
+	e := &metadataEntry{key: key, r: r, cost: cost, refs: 1}
+	c.entries[key] = c.ll.PushFront(e)
+	c.size += cost
+	for c.size > c.budget {
+		c.evictLocked(c.ll.Back())
+	}
+	return c.cloneLocked(e, sr)
+}
+
+// numOfNodes returns the number of nodes in the metadata, which is counted by walking
+// the tree if the reader doesn't provide it.
+func numOfNodes(r metadata.Reader) (int, error) {
+	if nr, ok := r.(interface{ NumOfNodes() (int, error) }); ok {
+		return nr.NumOfNodes()
+	}
+	var n int
+	err := r.Walk(func(string, uint32, os.FileMode) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+func (c *metadataCache) cloneLocked(e *metadataEntry, sr *io.SectionReader) (metadata.Reader, error) {
+	r, err := e.r.Clone(sr)
+	if err != nil {
+		return nil, err
+	}
+	e.refs++
+	var once sync.Once
+	return &sharedMetadataReader{r, func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.releaseLocked(e)
+		})
+	}}, nil
+}
+
+func (c *metadataCache) evictLocked(el *list.Element) {
+	e := c.ll.Remove(el).(*metadataEntry)
+	delete(c.entries, e.key)
+	c.size -= e.cost
+	c.releaseLocked(e)
+}
+
+func (c *metadataCache) releaseLocked(e *metadataEntry) {
+	e.refs--
+	if e.refs == 0 {
+		e.r.Close()
+	}
+}
+
+// sharedMetadataReader is a clone of a cached reader. Closing it doesn't close the cached
+// reader, which can share resources (e.g. the metadata DB) with its clones.
+type sharedMetadataReader struct {
+	metadata.Reader
+	release func()
+}
+
+func (r *sharedMetadataReader) Close() error {
+	r.release()
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/metadata"
+)
+
+type testMetadataReader struct {
+	metadata.Reader
+	nodes  int
+	closed bool
+}
+
+func (r *testMetadataReader) NumOfNodes() (int, error) { return r.nodes, nil }
+
+func (r *testMetadataReader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
+	return &testMetadataReader{nodes: r.nodes}, nil
+}
+
+func (r *testMetadataReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestMetadataCache(t *testing.T) {
+	c := newMetadataCache(10 * metadataNodeSize)
+
+	r1 := &testMetadataReader{nodes: 6}
+	c1, err := c.add("a", r1, nil)
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if c1 == metadata.Reader(r1) {
+		t.Fatalf("cached reader must be cloned")
+	}
+	c2, ok, err := c.get("a", nil)
+	if !ok || err != nil {
+		t.Fatalf("cached reader must be returned (err: %v)", err)
+	}
+
+	// Readers larger than the budget aren't cached.
+	big := &testMetadataReader{nodes: 11}
+	if got, err := c.add("big", big, nil); err != nil || got != metadata.Reader(big) {
+		t.Fatalf("reader larger than the budget must be returned as-is (err: %v)", err)
+	}
+
+	// Adding another reader evicts "a" but it's kept opened until its clones are closed.
+	if _, err := c.add("b", &testMetadataReader{nodes: 6}, nil); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, ok, _ := c.get("a", nil); ok {
+		t.Fatalf("evicted reader must not be returned")
+	}
+	c1.Close()
+	c1.Close() // ignored
+	if r1.closed {
+		t.Fatalf("reader must not be closed while it's used")
+	}
+	c2.Close()
+	if !r1.closed {
+		t.Fatalf("evicted reader must be closed after all clones are closed")
+	}
+}
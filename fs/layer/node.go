@@ -37,6 +37,7 @@ import (
 	"time"
 
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
@@ -59,6 +60,17 @@ const (
 	stateDirMode      = syscall.S_IFDIR | 0500 // dr-x------
 )
 
+const (
+	// maxHeldCacheFiles is the max number of cache files whose descriptors are passed to
+	// the kernel, held by a file handle.
+	maxHeldCacheFiles = 64
+
+	// heldCacheFileTimeout is how long a cache file is held after its descriptor is passed
+	// to the kernel. go-fuse splices the data right after Read returns but doesn't notify
+	// the completion, so this is far longer than the splice takes.
+	heldCacheFileTimeout = time.Second
+)
+
 type OverlayOpaqueType int
 
 const (
@@ -73,7 +85,7 @@ var opaqueXattrs = map[OverlayOpaqueType][]string{
 	OverlayOpaqueUser:    {"user.overlay.opaque"},
 }
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType) (fusefs.InodeEmbedder, error) {
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, opaque OverlayOpaqueType, xattrFilter func(string) bool, attributeReads bool, blocksPolicy BlocksPolicy, devicePolicy DevicePolicy) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -84,11 +96,18 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		return nil, fmt.Errorf("Unknown overlay opaque type")
 	}
 	ffs := &fs{
-		r:            r,
-		layerDigest:  layerDgst,
-		baseInode:    baseInode,
-		rootID:       rootID,
-		opaqueXattrs: opq,
+		r:              r,
+		layerDigest:    layerDgst,
+		baseInode:      baseInode,
+		rootID:         rootID,
+		opaqueXattrs:   opq,
+		xattrFilter:    xattrFilter,
+		attributeReads: attributeReads,
+		blocksPolicy:   blocksPolicy,
+		devicePolicy:   devicePolicy,
+	}
+	if blocksPolicy == BlocksFetched {
+		ffs.attrInvalidator = newAttrInvalidator(attrInvalidationInterval)
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -106,6 +125,24 @@ type fs struct {
 	baseInode    uint32
 	rootID       uint32
 	opaqueXattrs []string
+	xattrFilter  func(name string) bool
+
+	// attributeReads logs each read with the process that requested it.
+	attributeReads bool
+
+	// blocksPolicy is the policy of st_blocks reported for files.
+	blocksPolicy BlocksPolicy
+
+	// devicePolicy is the policy of device nodes and FIFOs in the layer.
+	devicePolicy DevicePolicy
+
+	// attrInvalidator invalidates attributes cached by the kernel. This is nil unless
+	// attributes change on reads.
+	attrInvalidator *attrInvalidator
+}
+
+func (fs *fs) exposesXattr(name string) bool {
+	return fs.xattrFilter == nil || fs.xattrFilter(name)
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -132,6 +169,9 @@ type node struct {
 	attr       metadata.Attr
 	ents       []fuse.DirEntry
 	entsCached bool
+
+	// emptied is true if this is a device node or a FIFO replaced with an empty regular file.
+	emptied bool
 }
 
 func (n *node) isRootNode() bool {
@@ -191,6 +231,10 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 
 		// This is a normal entry.
 		normalEnts[name] = true
+		mode, ok := n.fs.deviceMode(mode)
+		if !ok {
+			return true
+		}
 		ino, err := n.fs.inodeOfID(id)
 		if err != nil {
 			lastErr = err
@@ -264,6 +308,7 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 				return nil, syscall.EIO
 			}
 			entryToAttr(ino, tn.attr, &out.Attr)
+			n.fs.setBlocks(tn.id, &out.Attr)
 		case *whiteout:
 			ino, err := n.fs.inodeOfID(tn.id)
 			if err != nil {
@@ -310,32 +355,62 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 		return nil, syscall.ENOENT
 	}
 
+	emptied, ok := n.fs.applyDevicePolicy(&ce)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
 	ino, err := n.fs.inodeOfID(id)
 	if err != nil {
 		n.fs.s.report(fmt.Errorf("node.Lookup: %v", err))
 		return nil, syscall.EIO
 	}
+	stable := entryToAttr(ino, ce, &out.Attr)
+	n.fs.setBlocks(id, &out.Attr)
 	return n.NewInode(ctx, &node{
-		id:   id,
-		fs:   n.fs,
-		attr: ce,
-	}, entryToAttr(ino, ce, &out.Attr)), 0
+		id:      id,
+		fs:      n.fs,
+		attr:    ce,
+		emptied: emptied,
+	}, stable), 0
 }
 
 var _ = (fusefs.NodeOpener)((*node)(nil))
 
 func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	if n.emptied {
+		return &file{n: n, ra: bytes.NewReader(nil)}, fuse.FOPEN_KEEP_CACHE, 0
+	}
 	ra, err := n.fs.r.OpenFile(n.id)
 	if err != nil {
 		n.fs.s.report(fmt.Errorf("node.Open: %v", err))
 		return nil, 0, syscall.EIO
 	}
+	if flags&syscall.O_NOATIME != 0 {
+		if nf, ok := ra.(reader.NoAtimeFile); ok {
+			ra = nf.NoAtime()
+		}
+	}
 	return &file{
 		n:  n,
 		ra: ra,
 	}, fuse.FOPEN_KEEP_CACHE, 0
 }
 
+var _ = (fusefs.NodeFlusher)((*node)(nil))
+
+// Flush returns ENOSYS so that the kernel stops sending flush requests on close of
+// files of this filesystem. Files are read-only so there is nothing to flush.
+func (n *node) Flush(ctx context.Context, f fusefs.FileHandle) syscall.Errno {
+	return syscall.ENOSYS
+}
+
+var _ = (fusefs.NodeFsyncer)((*node)(nil))
+
+// Fsync returns ENOSYS so that the kernel stops sending fsync requests.
+func (n *node) Fsync(ctx context.Context, f fusefs.FileHandle, flags uint32) syscall.Errno {
+	return syscall.ENOSYS
+}
+
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
 
 func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
@@ -345,6 +420,7 @@ func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrO
 		return syscall.EIO
 	}
 	entryToAttr(ino, n.attr, &out.Attr)
+	n.fs.setBlocks(n.id, &out.Attr)
 	return 0
 }
 
@@ -362,7 +438,7 @@ func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 			return uint32(copy(dest, opaqueXattrValue)), 0
 		}
 	}
-	if v, ok := ent.Xattrs[attr]; ok {
+	if v, ok := ent.Xattrs[attr]; ok && n.fs.exposesXattr(attr) {
 		if len(dest) < len(v) {
 			return uint32(len(v)), syscall.ERANGE
 		}
@@ -384,6 +460,9 @@ func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 		}
 	}
 	for k := range ent.Xattrs {
+		if !n.fs.exposesXattr(k) {
+			continue
+		}
 		attrs = append(attrs, []byte(k+"\x00")...)
 	}
 	if len(dest) < len(attrs) {
@@ -410,6 +489,18 @@ func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 type file struct {
 	n  *node
 	ra io.ReaderAt
+
+	// held are cache files whose descriptors are passed to the kernel, keyed by the
+	// descriptors. They are kept opened for heldCacheFileTimeout after they are passed
+	// last time because go-fuse splices the data after Read returns.
+	held      map[uintptr]*heldCacheFile
+	heldSweep *time.Timer
+	heldMu    sync.Mutex
+}
+
+type heldCacheFile struct {
+	r    cache.FileReader
+	last time.Time
 }
 
 var _ = (fusefs.FileReader)((*file)(nil))
@@ -417,14 +508,94 @@ var _ = (fusefs.FileReader)((*file)(nil))
 func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.ReadOnDemand, f.n.fs.layerDigest, time.Now()) // measure time for on-demand file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.OnDemandReadAccessCount, f.n.fs.layerDigest)             // increment the counter for on-demand file accesses
+	if f.n.fs.attributeReads {
+		defer f.n.fs.logRead(ctx, f.n.id, off, len(dest), f.n.fs.s.statFile.blob.FetchedSize())
+	}
+	if fr, ok := f.ra.(reader.FileRangeReader); ok {
+		if res, ok := f.readCachedFile(fr, off, len(dest)); ok {
+			return res, 0
+		}
+	}
 	n, err := f.ra.ReadAt(dest, off)
 	if err != nil && err != io.EOF {
 		f.n.fs.s.report(fmt.Errorf("file.Read: %v", err))
+		if errors.Is(err, remote.ErrOffline) {
+			// Distinguish contents not cached while offline from broken layers.
+			return nil, syscall.ENETUNREACH
+		}
 		return nil, syscall.EIO
 	}
+	if f.n.fs.attrInvalidator != nil {
+		// The read may have fetched contents so st_blocks can change.
+		f.n.fs.attrInvalidator.add(&f.n.Inode)
+	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+// readCachedFile returns the range of the file as the descriptor of the cache file,
+// which lets go-fuse splice the data without copying it to the user space.
+func (f *file) readCachedFile(fr reader.FileRangeReader, off int64, size int) (fuse.ReadResult, bool) {
+	cr, fileOff, n, ok := fr.ReadCachedFile(off, size)
+	if !ok {
+		return nil, false
+	}
+	fd := cr.Fd()
+	f.heldMu.Lock()
+	defer f.heldMu.Unlock()
+	if h, ok := f.held[fd]; ok {
+		cr.Close() // already held
+		h.last = time.Now()
+	} else if len(f.held) >= maxHeldCacheFiles {
+		cr.Close()
+		return nil, false
+	} else {
+		if f.held == nil {
+			f.held = make(map[uintptr]*heldCacheFile)
+		}
+		f.held[fd] = &heldCacheFile{r: cr, last: time.Now()}
+	}
+	if f.heldSweep == nil {
+		f.heldSweep = time.AfterFunc(heldCacheFileTimeout, f.releaseHeld)
+	}
+	return fuse.ReadResultFd(fd, fileOff, n), true
+}
+
+// releaseHeld closes the held cache files whose data have been spliced.
+func (f *file) releaseHeld() {
+	f.heldMu.Lock()
+	defer f.heldMu.Unlock()
+	if f.heldSweep == nil {
+		return // released
+	}
+	for fd, h := range f.held {
+		if time.Since(h.last) >= heldCacheFileTimeout {
+			h.r.Close()
+			delete(f.held, fd)
+		}
+	}
+	if len(f.held) > 0 {
+		f.heldSweep.Reset(heldCacheFileTimeout)
+	} else {
+		f.heldSweep = nil
+	}
+}
+
+var _ = (fusefs.FileReleaser)((*file)(nil))
+
+func (f *file) Release(ctx context.Context) syscall.Errno {
+	f.heldMu.Lock()
+	defer f.heldMu.Unlock()
+	if f.heldSweep != nil {
+		f.heldSweep.Stop()
+		f.heldSweep = nil
+	}
+	for fd, h := range f.held {
+		h.r.Close()
+		delete(f.held, fd)
+	}
+	return 0
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
@@ -434,6 +605,7 @@ func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
 		return syscall.EIO
 	}
 	entryToAttr(ino, f.n.attr, &out.Attr)
+	f.n.fs.setBlocks(f.n.id, &out.Attr)
 	return 0
 }
 
@@ -562,6 +734,12 @@ func (sf *statFile) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandl
 	return nil, 0, 0
 }
 
+var _ = (fusefs.NodeFlusher)((*statFile)(nil))
+
+func (sf *statFile) Flush(ctx context.Context, f fusefs.FileHandle) syscall.Errno {
+	return syscall.ENOSYS
+}
+
 var _ = (fusefs.NodeReader)((*statFile)(nil))
 
 func (sf *statFile) Read(ctx context.Context, f fusefs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
@@ -641,10 +819,7 @@ func entryToAttr(ino uint64, e metadata.Attr, out *fuse.Attr) fusefs.StableAttr
 		out.Size = uint64(len(e.LinkName))
 	}
 	out.Blksize = blockSize
-	out.Blocks = out.Size / uint64(out.Blksize)
-	if out.Size%uint64(out.Blksize) > 0 {
-		out.Blocks++
-	}
+	out.Blocks = sizeToBlocks(out.Size) // st_blocks is in 512-byte units regardless of st_blksize
 	mtime := e.ModTime
 	out.SetTimes(nil, &mtime, nil)
 	out.Mode = fileModeToSystemMode(e.Mode)
@@ -0,0 +1,93 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+)
+
+func TestHeldCacheFiles(t *testing.T) {
+	fr := &testFileRangeReader{closed: make(map[uintptr]bool)}
+	f := &file{}
+	for fd := uintptr(1); fd <= maxHeldCacheFiles+1; fd++ {
+		fr.fd = fd
+		_, ok := f.readCachedFile(fr, 0, 10)
+		if want := fd <= maxHeldCacheFiles; ok != want {
+			t.Fatalf("served cache file %d = %v; want %v", fd, ok, want)
+		}
+	}
+	if !fr.isClosed(maxHeldCacheFiles + 1) {
+		t.Errorf("cache file over the limit isn't closed")
+	}
+	if fr.isClosed(1) {
+		t.Fatalf("cache file is closed before splicing")
+	}
+
+	// Cache files are released after they are spliced.
+	deadline := time.Now().Add(3 * heldCacheFileTimeout)
+	for !fr.isClosed(1) || !fr.isClosed(maxHeldCacheFiles) {
+		if time.Now().After(deadline) {
+			t.Fatalf("held cache files aren't released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Release closes cache files not released yet.
+	fr.fd = maxHeldCacheFiles + 2
+	if _, ok := f.readCachedFile(fr, 0, 10); !ok {
+		t.Fatalf("failed to serve cache file")
+	}
+	f.Release(context.Background())
+	if !fr.isClosed(maxHeldCacheFiles + 2) {
+		t.Errorf("cache file isn't closed on release")
+	}
+}
+
+type testFileRangeReader struct {
+	fd     uintptr
+	closed map[uintptr]bool
+	mu     sync.Mutex
+}
+
+func (fr *testFileRangeReader) ReadCachedFile(offset int64, size int) (cache.FileReader, int64, int, bool) {
+	return &testCacheFile{fr: fr, fd: fr.fd}, offset, size, true
+}
+
+func (fr *testFileRangeReader) isClosed(fd uintptr) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.closed[fd]
+}
+
+type testCacheFile struct {
+	fr *testFileRangeReader
+	fd uintptr
+}
+
+func (c *testCacheFile) ReadAt(p []byte, offset int64) (int, error) { return len(p), nil }
+func (c *testCacheFile) Fd() uintptr                                { return c.fd }
+func (c *testCacheFile) Close() error {
+	c.fr.mu.Lock()
+	c.fr.closed[c.fd] = true
+	c.fr.mu.Unlock()
+	return nil
+}
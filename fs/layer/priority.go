@@ -0,0 +1,105 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/containerd/stargz-snapshotter/task"
+	"golang.org/x/sync/semaphore"
+)
+
+const defaultLowPriorityReadConcurrency = 1
+
+// ReadPriority is the priority class of on-demand reads of a layer.
+type ReadPriority string
+
+const (
+	// ReadPriorityNormal makes on-demand reads of the layer stop fetching layers in
+	// background while they fetch contents from the registry. This is the default.
+	ReadPriorityNormal ReadPriority = "normal"
+
+	// ReadPriorityLow makes on-demand reads of the layer not stop fetching layers in
+	// background and limits the number of them fetching contents from the registry at
+	// once, so that they don't degrade reads of other layers (e.g. for log scanners).
+	ReadPriorityLow ReadPriority = "low"
+)
+
+// ParseReadPriority parses the name of a read priority class. Empty string is
+// ReadPriorityNormal.
+func ParseReadPriority(s string) (ReadPriority, error) {
+	switch p := ReadPriority(s); p {
+	case "":
+		return ReadPriorityNormal, nil
+	case ReadPriorityNormal, ReadPriorityLow:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown read priority %q", s)
+}
+
+// readScheduler schedules on-demand reads of layers from the registry following their
+// priority classes.
+type readScheduler struct {
+	backgroundTaskManager *task.BackgroundTaskManager
+	lowSem                *semaphore.Weighted
+}
+
+func newReadScheduler(backgroundTaskManager *task.BackgroundTaskManager, lowConcurrency int64) *readScheduler {
+	if lowConcurrency <= 0 {
+		lowConcurrency = defaultLowPriorityReadConcurrency
+	}
+	return &readScheduler{
+		backgroundTaskManager: backgroundTaskManager,
+		lowSem:                semaphore.NewWeighted(lowConcurrency),
+	}
+}
+
+// do runs the read following the priority class.
+func (s *readScheduler) do(p *priorityClass, read func() (int, error)) (int, error) {
+	if p.get() == ReadPriorityLow {
+		if err := s.lowSem.Acquire(context.Background(), 1); err != nil {
+			return 0, err
+		}
+		defer s.lowSem.Release(1)
+		return read()
+	}
+	// Each file's read operation is a prioritized task and all background tasks
+	// will be stopped during the execution so this can avoid being disturbed for
+	// NW traffic by background tasks.
+	s.backgroundTaskManager.DoPrioritizedTask()
+	defer s.backgroundTaskManager.DonePrioritizedTask()
+	return read()
+}
+
+// priorityClass holds the read priority class of a layer, which can be changed while
+// the layer is mounted.
+type priorityClass struct {
+	v atomic.Value
+}
+
+func (p *priorityClass) get() ReadPriority {
+	if v, ok := p.v.Load().(ReadPriority); ok {
+		return v
+	}
+	return ReadPriorityNormal
+}
+
+func (p *priorityClass) set(v ReadPriority) {
+	p.v.Store(v)
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/task"
+)
+
+func TestParseReadPriority(t *testing.T) {
+	for in, want := range map[string]ReadPriority{
+		"":       ReadPriorityNormal,
+		"normal": ReadPriorityNormal,
+		"low":    ReadPriorityLow,
+	} {
+		got, err := ParseReadPriority(in)
+		if err != nil || got != want {
+			t.Errorf("ParseReadPriority(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseReadPriority("high"); err == nil {
+		t.Errorf("unknown class must be rejected")
+	}
+}
+
+func TestReadScheduler(t *testing.T) {
+	tm := task.NewBackgroundTaskManager(1, time.Millisecond)
+	s := newReadScheduler(tm, 1)
+	p := new(priorityClass)
+	if p.get() != ReadPriorityNormal {
+		t.Fatalf("default class = %q; want normal", p.get())
+	}
+
+	// Low priority reads don't stop background tasks.
+	p.set(ReadPriorityLow)
+	bgDone := make(chan struct{})
+	if _, err := s.do(p, func() (int, error) {
+		go tm.InvokeBackgroundTask(func(ctx context.Context) { close(bgDone) }, time.Second)
+		select {
+		case <-bgDone:
+		case <-time.After(time.Second):
+			t.Errorf("background task is blocked by a low priority read")
+		}
+		return 0, nil
+	}); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	// Only a limited number of low priority reads run at once.
+	var (
+		mu              sync.Mutex
+		running, maxRun int
+		wg              sync.WaitGroup
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.do(p, func() (int, error) {
+				mu.Lock()
+				running++
+				if running > maxRun {
+					maxRun = running
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return 0, nil
+			})
+		}()
+	}
+	wg.Wait()
+	if maxRun != 1 {
+		t.Errorf("%d low priority reads ran at once; want 1", maxRun)
+	}
+}
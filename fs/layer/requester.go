@@ -0,0 +1,73 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sirupsen/logrus"
+)
+
+// requester is the process that issued a FUSE request.
+type requester struct {
+	pid  uint32
+	comm string
+}
+
+// requesterOf returns the process that issued the FUSE request of ctx. go-fuse passes
+// the request header as *fuse.Context. The PID is in the PID namespace of the snapshotter.
+// The command name is empty if the process has already exited.
+func requesterOf(ctx context.Context) (requester, bool) {
+	fc, ok := ctx.(*fuse.Context)
+	if !ok || fc.Caller.Pid == 0 {
+		return requester{}, false
+	}
+	rq := requester{pid: fc.Caller.Pid}
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", rq.pid)); err == nil {
+		rq.comm = strings.TrimSpace(string(comm))
+	}
+	return rq, true
+}
+
+// logRead logs an on-demand read of the node with the process that requested it.
+// fetchedBefore is the fetched size of the layer when the read started. Concurrent
+// reads of the layer can also contribute to the fetched bytes logged here.
+func (fs *fs) logRead(ctx context.Context, id uint32, off int64, size int, fetchedBefore int64) {
+	lg := log.G(ctx)
+	if !lg.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	fields := logrus.Fields{
+		"digest":  fs.layerDigest,
+		"offset":  off,
+		"size":    size,
+		"fetched": fs.s.statFile.blob.FetchedSize() - fetchedBefore,
+	}
+	if p, err := fs.r.Metadata().PathOf(id); err == nil {
+		fields["path"] = p
+	}
+	if rq, ok := requesterOf(ctx); ok {
+		fields["pid"] = rq.pid
+		fields["comm"] = rq.comm
+	}
+	lg.WithFields(fields).Debug("on-demand read")
+}
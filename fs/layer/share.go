@@ -0,0 +1,71 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// sharedLayers indexes resolved layers by their contents so that images referring to the
+// same layer blob under different references (e.g. a common base layer pushed to many
+// repositories) share the resolved layer instead of parsing its metadata and caching its
+// contents in parallel.
+type sharedLayers struct {
+	mu    sync.Mutex
+	names map[string]string // share key -> name of the layer in the layer cache
+}
+
+func newSharedLayers() *sharedLayers {
+	return &sharedLayers{names: make(map[string]string)}
+}
+
+// shareKey returns the key of the layer shared among images. Layers are shared only among
+// images applying the same xattr policy because the policy is bound to the layer.
+func shareKey(dgst digest.Digest, xattrPolicy int) string {
+	return fmt.Sprintf("%s/%d", dgst, xattrPolicy)
+}
+
+// get returns the name of the layer sharable by the key.
+func (s *sharedLayers) get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.names[key]
+	return name, ok
+}
+
+// add registers the layer as sharable by the key. The layer registered first is kept.
+func (s *sharedLayers) add(key, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.names[key]; !ok {
+		s.names[key] = name
+	}
+}
+
+// remove unregisters the layer evicted from the layer cache.
+func (s *sharedLayers) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, n := range s.names {
+		if n == name {
+			delete(s.names, key)
+		}
+	}
+}
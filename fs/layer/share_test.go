@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestSharedLayers(t *testing.T) {
+	policies := []config.XattrPolicy{{ImagePattern: "docker.io/untrusted/*", Deny: []string{"security.*"}}}
+	dgst := digest.FromString("base layer")
+	keyOf := func(ref string) string { return shareKey(dgst, xattrPolicyIndex(policies, ref)) }
+
+	s := newSharedLayers()
+	s.add(keyOf("docker.io/library/app1:latest"), "docker.io/library/app1:latest/"+dgst.String())
+	s.add(keyOf("docker.io/library/app2:latest"), "docker.io/library/app2:latest/"+dgst.String())
+
+	// The layer resolved first is shared among images applying the same xattr policy.
+	if name, ok := s.get(keyOf("ghcr.io/foo/app3:latest")); !ok || name != "docker.io/library/app1:latest/"+dgst.String() {
+		t.Errorf("shared layer = %q, %v; want the layer of app1", name, ok)
+	}
+	if name, ok := s.get(keyOf("docker.io/untrusted/app:latest")); ok {
+		t.Errorf("layer %q is shared with an image applying another xattr policy", name)
+	}
+	if name, ok := s.get(shareKey(digest.FromString("other layer"), -1)); ok {
+		t.Errorf("layer %q is shared with another blob", name)
+	}
+
+	s.remove("docker.io/library/app1:latest/" + dgst.String())
+	if name, ok := s.get(keyOf("docker.io/library/app2:latest")); ok {
+		t.Errorf("evicted layer %q is still shared", name)
+	}
+}
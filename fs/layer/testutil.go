@@ -65,6 +65,7 @@ func TestSuiteLayer(t *testing.T, store metadata.Store) {
 	testPrefetch(t, store)
 	testNodeRead(t, store)
 	testExistence(t, store)
+	testDevicePolicy(t, store)
 }
 
 var testStateLayerDigest = digest.FromString("dummy")
@@ -91,6 +92,7 @@ func testPrefetch(t *testing.T, factory metadata.Store) {
 		wants            []string // filenames to compare
 		prefetchSize     func(*testing.T, *layer) int64
 		prioritizedFiles []string
+		sbomFiles        []string // files passed by WithPrioritizedFiles
 	}{
 		{
 			name: "no_prefetch",
@@ -124,6 +126,29 @@ func testPrefetch(t *testing.T, factory metadata.Store) {
 			prefetchSize:     landmarkPosition,
 			prioritizedFiles: []string{"foo/", "foo/bar.txt"},
 		},
+		{
+			name: "prioritized_files_of_unoptimized_layer",
+			in: []testutil.TarEntry{
+				testutil.Dir("foo/"),
+				testutil.File("foo/bar.txt", sampleData1),
+				testutil.File("buz.txt", sampleData2),
+			},
+			wantNum:   chunkNum(sampleData2),
+			wants:     []string{"buz.txt"},
+			sbomFiles: []string{"buz.txt", "notexist/file", "foo/"},
+		},
+		{
+			name: "prioritized_files_of_optimized_layer",
+			in: []testutil.TarEntry{
+				testutil.File("foo.txt", sampleData1),
+				testutil.File("bar.txt", sampleData2),
+			},
+			wantNum:          chunkNum(sampleData1),
+			wants:            []string{"foo.txt"},
+			prefetchSize:     landmarkPosition,
+			prioritizedFiles: []string{"foo.txt"},
+			sbomFiles:        []string{"bar.txt"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -164,7 +189,11 @@ func testPrefetch(t *testing.T, factory metadata.Store) {
 			if tt.prefetchSize != nil {
 				prefetchSize = tt.prefetchSize(t, l)
 			}
-			if err := l.Prefetch(defaultPrefetchSize); err != nil {
+			var opts []PrefetchOption
+			if tt.sbomFiles != nil {
+				opts = append(opts, WithPrioritizedFiles(func() []string { return tt.sbomFiles }))
+			}
+			if err := l.Prefetch(defaultPrefetchSize, opts...); err != nil {
 				t.Errorf("failed to prefetch: %v", err)
 				return
 			}
@@ -541,8 +570,72 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 	}
 }
 
+func testDevicePolicy(t *testing.T, factory metadata.Store) {
+	in := []testutil.TarEntry{
+		testutil.File("file", sampleData1),
+		testutil.Chardev("chardev", 1, 3),
+		testutil.Blockdev("blockdev", 8, 0),
+		testutil.Fifo("fifo"),
+	}
+	tests := []struct {
+		policy DevicePolicy
+		want   []check
+	}{
+		{
+			policy: DevicesExpose,
+			want: []check{
+				hasFileDigest("file", digestFor(sampleData1)),
+				hasType("chardev", syscall.S_IFCHR),
+				hasType("blockdev", syscall.S_IFBLK),
+				hasType("fifo", syscall.S_IFIFO),
+			},
+		},
+		{
+			policy: DevicesMask,
+			want: []check{
+				hasFileDigest("file", digestFor(sampleData1)),
+				fileNotExist("chardev"),
+				fileNotExist("blockdev"),
+				fileNotExist("fifo"),
+			},
+		},
+		{
+			policy: DevicesEmpty,
+			want: []check{
+				hasFileDigest("file", digestFor(sampleData1)),
+				hasType("chardev", syscall.S_IFREG),
+				hasType("blockdev", syscall.S_IFREG),
+				hasType("fifo", syscall.S_IFREG),
+				hasSize("chardev", 0),
+				hasFileDigest("chardev", digestFor("")),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run("device_policy_"+string(tt.policy), func(t *testing.T) {
+			sgz, _, err := testutil.BuildEStargz(in)
+			if err != nil {
+				t.Fatalf("failed to build sample eStargz: %v", err)
+			}
+			r, err := factory(sgz)
+			if err != nil {
+				t.Fatalf("failed to create reader: %v", err)
+			}
+			defer r.Close()
+			rootNode := getRootNodeWithDevicePolicy(t, r, OverlayOpaqueAll, tt.policy)
+			for _, want := range tt.want {
+				want(t, rootNode)
+			}
+		})
+	}
+}
+
 func getRootNode(t *testing.T, r metadata.Reader, opaque OverlayOpaqueType) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque)
+	return getRootNodeWithDevicePolicy(t, r, opaque, DevicesExpose)
+}
+
+func getRootNodeWithDevicePolicy(t *testing.T, r metadata.Reader, opaque OverlayOpaqueType, devicePolicy DevicePolicy) *node {
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, opaque, nil, false, BlocksApparent, devicePolicy)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -651,6 +744,28 @@ func hasExtraMode(name string, mode os.FileMode) check {
 	}
 }
 
+func hasType(name string, typ uint32) check {
+	return func(t *testing.T, root *node) {
+		ent, n, err := getDirentAndNode(t, root, name)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", name, err)
+		}
+		var ao fuse.AttrOut
+		if errno := n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao); errno != 0 {
+			t.Fatalf("failed to get attributes of node %q: %v", name, errno)
+		}
+		if got := ent.Mode & syscall.S_IFMT; got != typ {
+			t.Errorf("direntry %q has type %o; want %o", name, got, typ)
+		}
+		if got := ao.Attr.Mode & syscall.S_IFMT; got != typ {
+			t.Errorf("node %q has type %o; want %o", name, got, typ)
+		}
+		if typ == syscall.S_IFREG && ao.Attr.Rdev != 0 {
+			t.Errorf("regular file %q has device numbers", name)
+		}
+	}
+}
+
 func hasValidWhiteout(name string) check {
 	return func(t *testing.T, root *node) {
 		ent, n, err := getDirentAndNode(t, root, name)
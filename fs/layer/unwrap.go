@@ -0,0 +1,149 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/klauspost/compress/zstd"
+)
+
+// outerCodec is a compression envelope that can wrap a layer blob.
+type outerCodec struct {
+	magic  []byte
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+var outerCodecs = map[string]outerCodec{
+	"gzip": {
+		magic: []byte{0x1F, 0x8B, 0x08},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			dec, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return dec.IOReadCloser(), nil
+		},
+	},
+}
+
+// detectOuterCodec returns the codec listed in chain whose magic number matches the
+// head of the passed reader.
+func detectOuterCodec(sr *io.SectionReader, chain []string) (string, outerCodec, error) {
+	head := make([]byte, 4)
+	n, err := sr.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", outerCodec{}, err
+	}
+	head = head[:n]
+	for _, name := range chain {
+		c, ok := outerCodecs[name]
+		if !ok {
+			return "", outerCodec{}, fmt.Errorf("unknown codec %q in decompression chain", name)
+		}
+		if bytes.HasPrefix(head, c.magic) {
+			return name, c, nil
+		}
+	}
+	return "", outerCodec{}, fmt.Errorf("no codec in decompression chain %v matches the blob", chain)
+}
+
+// unwrapBlob streams the whole contents of the passed blob through the outer codec
+// detected from chain and stores the decoded contents in a file under dir. The returned
+// blob serves the decoded contents and is fully available locally.
+func unwrapBlob(dir string, b remote.Blob, chain []string) (*unwrappedBlob, error) {
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return b.ReadAt(p, offset, remote.WithCacheOpts(cache.Direct()))
+	}), 0, b.Size())
+	name, codec, err := detectOuterCodec(sr, chain)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := codec.reader(sr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize %s decoder: %w", name, err)
+	}
+	defer dr.Close()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(f, dr)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to decode %s envelope: %w", name, err)
+	}
+	return &unwrappedBlob{Blob: b, f: f, size: size}, nil
+}
+
+// unwrappedBlob is a blob with contents decoded from the outer compression envelope
+// of the underlying blob. Check and Refresh are delegated to the underlying blob.
+// Closing this doesn't close the underlying blob.
+type unwrappedBlob struct {
+	remote.Blob
+	f    *os.File
+	size int64
+
+	closed   bool
+	closedMu sync.Mutex
+}
+
+func (b *unwrappedBlob) Size() int64 {
+	return b.size
+}
+
+func (b *unwrappedBlob) FetchedSize() int64 {
+	return b.size
+}
+
+func (b *unwrappedBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	return b.f.ReadAt(p, offset)
+}
+
+func (b *unwrappedBlob) Cache(offset int64, size int64, opts ...remote.Option) error {
+	return nil // all contents are already available
+}
+
+func (b *unwrappedBlob) Close() error {
+	b.closedMu.Lock()
+	defer b.closedMu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	if err := b.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(b.f.Name())
+}
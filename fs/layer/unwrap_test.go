@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestUnwrapBlob(t *testing.T) {
+	contents := []byte("inner eStargz blob contents")
+	tests := []struct {
+		name    string
+		chain   []string
+		wrap    func(t *testing.T, p []byte) []byte
+		wantErr bool
+	}{
+		{
+			name:  "zstd",
+			chain: []string{"zstd"},
+			wrap:  zstdWrap,
+		},
+		{
+			name:  "gzip",
+			chain: []string{"zstd", "gzip"},
+			wrap:  gzipWrap,
+		},
+		{
+			name:    "not-in-chain",
+			chain:   []string{"gzip"},
+			wrap:    zstdWrap,
+			wantErr: true,
+		},
+		{
+			name:    "unknown-codec",
+			chain:   []string{"lz4"},
+			wrap:    zstdWrap,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := tt.wrap(t, contents)
+			b := newBlob(io.NewSectionReader(bytes.NewReader(wrapped), 0, int64(len(wrapped))))
+			ub, err := unwrapBlob(t.TempDir(), b, tt.chain)
+			if tt.wantErr {
+				if err == nil {
+					ub.Close()
+					t.Fatalf("unwrapping must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to unwrap blob: %v", err)
+			}
+			defer ub.Close()
+			if ub.Size() != int64(len(contents)) {
+				t.Fatalf("unexpected size %d; want %d", ub.Size(), len(contents))
+			}
+			got := make([]byte, ub.Size())
+			if _, err := ub.ReadAt(got, 0); err != nil && err != io.EOF {
+				t.Fatalf("failed to read unwrapped blob: %v", err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Fatalf("unexpected contents %q; want %q", string(got), string(contents))
+			}
+		})
+	}
+}
+
+func zstdWrap(t *testing.T, p []byte) []byte {
+	buf := new(bytes.Buffer)
+	zw, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("failed to create zstd writer: %v", err)
+	}
+	if _, err := zw.Write(p); err != nil {
+		t.Fatalf("failed to write zstd: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zstd writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func gzipWrap(t *testing.T, p []byte) []byte {
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(p); err != nil {
+		t.Fatalf("failed to write gzip: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
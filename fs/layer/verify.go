@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// chunkVerifier verifies chunks of the blob against the TOC while they are downloaded.
+// This must be used only for layers whose TOC is verified.
+type chunkVerifier struct {
+	r metadata.Reader
+
+	initOnce sync.Once
+	chunks   []verifiableChunk // sorted by offset
+	initErr  error
+}
+
+type verifiableChunk struct {
+	offset    int64
+	size      int64
+	chunkSize int64
+	digest    digest.Digest
+}
+
+func (v *chunkVerifier) init() error {
+	v.initOnce.Do(func() {
+		var chunks []verifiableChunk
+		v.initErr = v.r.ForeachChunk(func(c metadata.Chunk) bool {
+			dgst, err := digest.Parse(c.Digest)
+			if err != nil || c.Size <= 0 {
+				return true // unverifiable chunk
+			}
+			chunks = append(chunks, verifiableChunk{c.Offset, c.Size, c.ChunkSize, dgst})
+			return true
+		})
+		sort.Slice(chunks, func(i, j int) bool {
+			return chunks[i].offset < chunks[j].offset
+		})
+		v.chunks = chunks[:0]
+		for _, c := range chunks {
+			if n := len(v.chunks); n > 0 && v.chunks[n-1].offset+v.chunks[n-1].size > c.offset {
+				continue // overlapping chunk (e.g. shared by multiple files)
+			}
+			v.chunks = append(v.chunks, c)
+		}
+	})
+	return v.initErr
+}
+
+// Spans returns the chunks contained in the range of the blob.
+func (v *chunkVerifier) Spans(offset int64, size int64) (spans []remote.Region) {
+	if err := v.init(); err != nil {
+		return nil
+	}
+	i := sort.Search(len(v.chunks), func(i int) bool {
+		return v.chunks[i].offset >= offset
+	})
+	for ; i < len(v.chunks) && v.chunks[i].offset+v.chunks[i].size <= offset+size; i++ {
+		spans = append(spans, remote.Region{Offset: v.chunks[i].offset, Size: v.chunks[i].size})
+	}
+	return spans
+}
+
+// Verify decompresses the chunk and checks its digest recorded in the TOC.
+func (v *chunkVerifier) Verify(s remote.Region, p []byte) error {
+	if err := v.init(); err != nil {
+		return err
+	}
+	i := sort.Search(len(v.chunks), func(i int) bool {
+		return v.chunks[i].offset >= s.Offset
+	})
+	if i == len(v.chunks) || v.chunks[i].offset != s.Offset || v.chunks[i].size != s.Size {
+		return fmt.Errorf("no chunk is recorded at %d (size %d)", s.Offset, s.Size)
+	}
+	c := v.chunks[i]
+	dr, err := v.r.DecompressChunk(p)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decompress: %v", remote.ErrChunkDigestMismatch, err)
+	}
+	defer dr.Close()
+	dgstr := c.digest.Algorithm().Digester()
+	if _, err := io.CopyN(dgstr.Hash(), dr, c.chunkSize); err != nil {
+		return fmt.Errorf("%w: failed to decompress: %v", remote.ErrChunkDigestMismatch, err)
+	}
+	if got := dgstr.Digest(); got != c.digest {
+		return fmt.Errorf("%w: digest must be %v but got %v", remote.ErrChunkDigestMismatch, c.digest, got)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// validateXattrPolicies checks that all patterns in the policies are well-formed.
+func validateXattrPolicies(policies []config.XattrPolicy) error {
+	for _, p := range policies {
+		patterns := []string{p.ImagePattern}
+		patterns = append(patterns, p.Allow...)
+		patterns = append(patterns, p.Deny...)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q in xattr policy: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// newXattrFilter returns a function reporting whether an xattr name is exposed to
+// containers of the specified image. nil is returned if no policy applies to the image.
+func newXattrFilter(policies []config.XattrPolicy, ref string) func(name string) bool {
+	i := xattrPolicyIndex(policies, ref)
+	if i < 0 {
+		return nil
+	}
+	allow, deny := policies[i].Allow, policies[i].Deny
+	return func(name string) bool {
+		if matchAny(allow, name) {
+			return true
+		}
+		if matchAny(deny, name) {
+			return false
+		}
+		return len(allow) == 0
+	}
+}
+
+// xattrPolicyIndex returns the index of the policy applied to the image. -1 is returned if
+// no policy applies to the image.
+func xattrPolicyIndex(policies []config.XattrPolicy, ref string) int {
+	for i, p := range policies {
+		if p.ImagePattern != "" && !matchAny([]string{p.ImagePattern}, ref) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestXattrFilter(t *testing.T) {
+	policies := []config.XattrPolicy{
+		{
+			ImagePattern: "docker.io/untrusted/*",
+			Allow:        []string{"security.capability"},
+			Deny:         []string{"user.*", "security.*"},
+		},
+		{
+			ImagePattern: "docker.io/minimal/*",
+			Allow:        []string{"security.capability"},
+		},
+	}
+	if err := validateXattrPolicies(policies); err != nil {
+		t.Fatalf("failed to validate policies: %v", err)
+	}
+	tests := []struct {
+		ref     string
+		exposed map[string]bool // nil means no filter is applied
+	}{
+		{
+			ref: "docker.io/untrusted/app:latest",
+			exposed: map[string]bool{
+				"user.foo":            false,
+				"security.selinux":    false,
+				"security.capability": true,
+				"trusted.foo":         false,
+			},
+		},
+		{
+			ref: "docker.io/minimal/app:latest",
+			exposed: map[string]bool{
+				"user.foo":            false,
+				"security.capability": true,
+			},
+		},
+		{
+			ref: "docker.io/library/ubuntu:20.04",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			f := newXattrFilter(policies, tt.ref)
+			if (f == nil) != (tt.exposed == nil) {
+				t.Fatalf("unexpected filter existence: %v", f != nil)
+			}
+			for name, want := range tt.exposed {
+				if got := f(name); got != want {
+					t.Errorf("%q exposed = %v; want %v", name, got, want)
+				}
+			}
+		})
+	}
+
+	if err := validateXattrPolicies([]config.XattrPolicy{{Deny: []string{"user.["}}}); err == nil {
+		t.Errorf("invalid pattern must be rejected")
+	}
+}
@@ -58,11 +58,23 @@ const (
 	PrefetchesCompleted           = "all_prefetches_completed"
 	ReadOnDemand                  = "read_on_demand"
 	MountLayerToLastOnDemandFetch = "mount_layer_to_last_on_demand_fetch"
+	RegistryProbe                 = "registry_probe"
+	IPFSRetrieveLocal             = "ipfs_retrieve_local"
+	IPFSRetrieveNode              = "ipfs_retrieve_node"
+	IPFSRetrieveGateway           = "ipfs_retrieve_gateway"
 
 	OnDemandReadAccessCount          = "on_demand_read_access_count"
 	OnDemandRemoteRegistryFetchCount = "on_demand_remote_registry_fetch_count"
 	OnDemandBytesServed              = "on_demand_bytes_served"
 	OnDemandBytesFetched             = "on_demand_bytes_fetched"
+	SharedChunkBytesServed           = "shared_chunk_bytes_served"
+	ServeTimeVerify                  = "serve_time_verify"
+	ServeTimeVerifiedBytes           = "serve_time_verified_bytes"
+	ServeTimeVerifyFailureCount      = "serve_time_verify_failure_count"
+	RegistryProbeFailureCount        = "registry_probe_failure_count"
+	IPFSRetrieveLocalFailureCount    = "ipfs_retrieve_local_failure_count"
+	IPFSRetrieveNodeFailureCount     = "ipfs_retrieve_node_failure_count"
+	IPFSRetrieveGatewayFailureCount  = "ipfs_retrieve_gateway_failure_count"
 
 	// logs metrics
 	PrefetchTotal             = "prefetch_total"
@@ -0,0 +1,92 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	metrics "github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var decompressionMetrics = []struct {
+	name      string
+	help      string
+	unit      metrics.Unit
+	valueType prometheus.ValueType
+	getValue  func(s reader.DecompressionStats) float64
+}{
+	{
+		name:      "decompression_waiting",
+		help:      "Number of decompressions waiting for workers",
+		unit:      "",
+		valueType: prometheus.GaugeValue,
+		getValue:  func(s reader.DecompressionStats) float64 { return float64(s.Waiting) },
+	},
+	{
+		name:      "decompression_running",
+		help:      "Number of decompressions running on workers",
+		unit:      "",
+		valueType: prometheus.GaugeValue,
+		getValue:  func(s reader.DecompressionStats) float64 { return float64(s.Running) },
+	},
+	{
+		name:      "decompression_jobs",
+		help:      "Number of decompressions run on workers",
+		unit:      metrics.Total,
+		valueType: prometheus.CounterValue,
+		getValue:  func(s reader.DecompressionStats) float64 { return float64(s.Jobs) },
+	},
+	{
+		name:      "decompression_wait",
+		help:      "Total time decompressions waited for workers",
+		unit:      metrics.Seconds,
+		valueType: prometheus.CounterValue,
+		getValue:  func(s reader.DecompressionStats) float64 { return s.WaitTime.Seconds() },
+	},
+}
+
+// AddDecompressionMetrics adds metrics of the queues of the decompression pool to the
+// namespace for each codec. This must be called before the namespace is registered.
+func AddDecompressionMetrics(ns *metrics.Namespace, stats func() map[string]reader.DecompressionStats) {
+	if ns == nil {
+		return
+	}
+	ns.Add(&decompressionCollector{ns: ns, stats: stats})
+}
+
+type decompressionCollector struct {
+	ns    *metrics.Namespace
+	stats func() map[string]reader.DecompressionStats
+}
+
+func (c *decompressionCollector) desc(name, help string, unit metrics.Unit) *prometheus.Desc {
+	return c.ns.NewDesc(name, help, unit, "codec")
+}
+
+func (c *decompressionCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range decompressionMetrics {
+		ch <- c.desc(m.name, m.help, m.unit)
+	}
+}
+
+func (c *decompressionCollector) Collect(ch chan<- prometheus.Metric) {
+	for codec, s := range c.stats() {
+		for _, m := range decompressionMetrics {
+			ch <- prometheus.MustNewConstMetric(c.desc(m.name, m.help, m.unit), m.valueType, m.getValue(s), codec)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"github.com/containerd/stargz-snapshotter/fs/egress"
+	metrics "github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AddEgressMetrics adds the bytes fetched from registries for each namespace, image and
+// registry to the namespace. This must be called before the namespace is registered.
+func AddEgressMetrics(ns *metrics.Namespace, a *egress.Accounting) {
+	if ns == nil || a == nil {
+		return
+	}
+	ns.Add(&egressCollector{
+		desc: ns.NewDesc("egress", "Total bytes fetched from the registry for the image", metrics.Bytes, "namespace", "image", "registry"),
+		a:    a,
+	})
+}
+
+type egressCollector struct {
+	desc *prometheus.Desc
+	a    *egress.Accounting
+}
+
+func (c *egressCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *egressCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.a.Records() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(r.Bytes), r.Namespace, r.Image, r.Registry)
+	}
+}
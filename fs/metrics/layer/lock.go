@@ -0,0 +1,87 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"github.com/containerd/stargz-snapshotter/util/namedmutex"
+	metrics "github.com/docker/go-metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lockMetrics = []struct {
+	name     string
+	help     string
+	unit     metrics.Unit
+	getValue func(s namedmutex.Stats) float64
+}{
+	{
+		name:     "lock_acquisitions",
+		help:     "Number of acquisitions of the lock",
+		unit:     metrics.Total,
+		getValue: func(s namedmutex.Stats) float64 { return float64(s.Acquisitions) },
+	},
+	{
+		name:     "lock_contentions",
+		help:     "Number of acquisitions of the lock that waited for other holders",
+		unit:     metrics.Total,
+		getValue: func(s namedmutex.Stats) float64 { return float64(s.Contentions) },
+	},
+	{
+		name:     "lock_wait",
+		help:     "Total time spent for waiting for the lock",
+		unit:     metrics.Seconds,
+		getValue: func(s namedmutex.Stats) float64 { return s.WaitTime.Seconds() },
+	},
+	{
+		name:     "lock_long_holds",
+		help:     "Number of times the lock was held longer than the threshold, which likely indicates leaks",
+		unit:     metrics.Total,
+		getValue: func(s namedmutex.Stats) float64 { return float64(s.LongHolds) },
+	},
+}
+
+// AddLockMetrics adds metrics of contention of the named lock to the namespace. This must
+// be called before the namespace is registered.
+func AddLockMetrics(ns *metrics.Namespace, lock string, stats func() namedmutex.Stats) {
+	if ns == nil {
+		return
+	}
+	ns.Add(&lockCollector{ns: ns, lock: lock, stats: stats})
+}
+
+type lockCollector struct {
+	ns    *metrics.Namespace
+	lock  string
+	stats func() namedmutex.Stats
+}
+
+func (c *lockCollector) desc(name, help string, unit metrics.Unit) *prometheus.Desc {
+	return c.ns.NewDesc(name, help, unit, "lock")
+}
+
+func (c *lockCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range lockMetrics {
+		ch <- c.desc(m.name, m.help, m.unit)
+	}
+}
+
+func (c *lockCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	for _, m := range lockMetrics {
+		ch <- prometheus.MustNewConstMetric(c.desc(m.name, m.help, m.unit), prometheus.CounterValue, m.getValue(s), c.lock)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/policy"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+const defaultMountPolicyTimeout = 5 * time.Second
+
+// mountPolicy consults the policy before mounting layers lazily. See config.MountPolicyConfig.
+type mountPolicy struct {
+	evaluator policy.Evaluator
+	timeout   time.Duration
+	failOpen  bool
+}
+
+// newMountPolicy returns the policy evaluated by e, or by OPA of the config if e is nil.
+// This returns nil if no policy is configured.
+func newMountPolicy(cfg config.MountPolicyConfig, e policy.Evaluator) *mountPolicy {
+	if e == nil {
+		if cfg.OPAURL == "" {
+			return nil
+		}
+		e = policy.NewOPA(cfg.OPAURL, nil)
+	}
+	timeout := time.Duration(cfg.TimeoutMSec) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultMountPolicyTimeout
+	}
+	return &mountPolicy{evaluator: e, timeout: timeout, failOpen: cfg.FailOpen}
+}
+
+// check returns an error if the layer of the source isn't allowed to be mounted lazily.
+func (p *mountPolicy) check(ctx context.Context, src source.Source, labels map[string]string) error {
+	if p == nil {
+		return nil
+	}
+	in := policy.Input{
+		Ref:       src.Name.String(),
+		Registry:  src.Name.Hostname(),
+		Layer:     src.Target.Digest,
+		MediaType: src.Target.MediaType,
+		TOCDigest: labels[estargz.TOCJSONDigestAnnotation],
+		Signature: labels[config.TargetSignatureLabel],
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	d, err := p.evaluator.Evaluate(ctx, in)
+	if err != nil {
+		if p.failOpen {
+			log.G(ctx).WithError(err).Warn("failed to evaluate mount policy; mounting the layer")
+			return nil
+		}
+		return fmt.Errorf("failed to evaluate mount policy: %w", err)
+	}
+	if !d.Allow {
+		if d.Reason != "" {
+			return fmt.Errorf("layer isn't allowed to be mounted lazily by the policy: %s", d.Reason)
+		}
+		return fmt.Errorf("layer isn't allowed to be mounted lazily by the policy")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/policy"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMountPolicy(t *testing.T) {
+	if p := newMountPolicy(config.MountPolicyConfig{}, nil); p != nil {
+		t.Errorf("policy must be disabled by default")
+	}
+
+	// Allows only signed images from ghcr.io.
+	signedFromGHCR := policy.EvaluatorFunc(func(ctx context.Context, in policy.Input) (policy.Decision, error) {
+		if in.Registry != "ghcr.io" {
+			return policy.Decision{Reason: "unapproved registry"}, nil
+		}
+		return policy.Decision{Allow: in.Signature == "verified"}, nil
+	})
+	failing := policy.EvaluatorFunc(func(ctx context.Context, in policy.Input) (policy.Decision, error) {
+		return policy.Decision{}, fmt.Errorf("unavailable")
+	})
+	tests := []struct {
+		name      string
+		evaluator policy.Evaluator
+		failOpen  bool
+		ref       string
+		signature string
+		wantErr   bool
+	}{
+		{name: "allowed", evaluator: signedFromGHCR, ref: "ghcr.io/app:1", signature: "verified"},
+		{name: "unsigned", evaluator: signedFromGHCR, ref: "ghcr.io/app:1", wantErr: true},
+		{name: "unapproved_registry", evaluator: signedFromGHCR, ref: "docker.io/library/app:1", signature: "verified", wantErr: true},
+		{name: "fail_closed", evaluator: failing, ref: "ghcr.io/app:1", wantErr: true},
+		{name: "fail_open", evaluator: failing, failOpen: true, ref: "ghcr.io/app:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newMountPolicy(config.MountPolicyConfig{FailOpen: tt.failOpen}, tt.evaluator)
+			spec, err := reference.Parse(tt.ref)
+			if err != nil {
+				t.Fatalf("failed to parse ref: %v", err)
+			}
+			labels := map[string]string{}
+			if tt.signature != "" {
+				labels[config.TargetSignatureLabel] = tt.signature
+			}
+			src := source.Source{Name: spec, Target: ocispec.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}}
+			if err := p.check(context.Background(), src, labels); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v; want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"path"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// pinned returns true if layers of the image must be kept from eviction. This is the case
+// if the snapshot is labeled as pinned or if the image matches one of the pinned patterns.
+func (fs *filesystem) pinned(ref string, labels map[string]string) bool {
+	if _, ok := labels[config.TargetPinnedLabel]; ok {
+		return true
+	}
+	for _, p := range fs.pinnedImages {
+		if ok, _ := path.Match(p, ref); ok {
+			return true
+		}
+	}
+	return false
+}
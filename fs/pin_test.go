@@ -0,0 +1,42 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+func TestPinned(t *testing.T) {
+	fs := &filesystem{pinnedImages: []string{"registry.k8s.io/pause:*", "ghcr.io/system/*"}}
+	tests := []struct {
+		ref    string
+		labels map[string]string
+		want   bool
+	}{
+		{ref: "registry.k8s.io/pause:3.9", want: true},
+		{ref: "ghcr.io/system/agent:1", want: true},
+		{ref: "ghcr.io/app/web:1", want: false},
+		{ref: "ghcr.io/app/web:1", labels: map[string]string{config.TargetPinnedLabel: "true"}, want: true},
+	}
+	for _, tt := range tests {
+		if got := fs.pinned(tt.ref, tt.labels); got != tt.want {
+			t.Errorf("pinned(%q, %v) = %v; want %v", tt.ref, tt.labels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy provides the evaluation point consulted before mounting layers lazily so
+// that users can restrict lazy pulling (e.g. only signed images from approved registries).
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Input is the information of the layer to be mounted.
+type Input struct {
+	// Ref is the reference of the image (e.g. "ghcr.io/stargz-containers/python:3.9-esgz").
+	Ref string `json:"ref"`
+
+	// Registry is the host of the registry of the image (e.g. "ghcr.io").
+	Registry string `json:"registry"`
+
+	// Layer is the digest of the layer blob.
+	Layer digest.Digest `json:"layer"`
+
+	// MediaType is the media type of the layer blob.
+	MediaType string `json:"mediaType"`
+
+	// TOCDigest is the digest of the TOC JSON of the layer passed through labels. Empty if
+	// not passed, in which case the layer can only be mounted without verification.
+	TOCDigest string `json:"tocDigest,omitempty"`
+
+	// Signature is the status of the signature of the image passed by the client pulling
+	// the image (see config.TargetSignatureLabel). Empty if not passed.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Decision is the result of the evaluation of the policy.
+type Decision struct {
+	// Allow is true if the layer can be mounted lazily.
+	Allow bool
+
+	// Reason is the optional explanation of the decision.
+	Reason string
+}
+
+// Evaluator decides whether a layer can be mounted lazily. Embedders of the filesystem can
+// provide their own evaluators (e.g. evaluating CEL expressions).
+type Evaluator interface {
+	Evaluate(ctx context.Context, in Input) (Decision, error)
+}
+
+// EvaluatorFunc is a function implementing Evaluator.
+type EvaluatorFunc func(ctx context.Context, in Input) (Decision, error)
+
+func (f EvaluatorFunc) Evaluate(ctx context.Context, in Input) (Decision, error) {
+	return f(ctx, in)
+}
+
+// NewOPA returns the Evaluator querying the decision of the URL through the Data API of
+// Open Policy Agent with the Input as "input". The decision must be a boolean or an object
+// with a boolean "allow" field and an optional "reason" field. An undefined decision denies
+// the layer.
+func NewOPA(url string, client *http.Client) Evaluator {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &opa{url: url, client: client}
+}
+
+type opa struct {
+	url    string
+	client *http.Client
+}
+
+func (o *opa) Evaluate(ctx context.Context, in Input) (Decision, error) {
+	body, err := json.Marshal(struct {
+		Input Input `json:"input"`
+	}{in})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Decision{}, fmt.Errorf("unexpected status code from policy %q: %v: %s", o.url, resp.Status, msg)
+	}
+	var res struct {
+		Result *json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return Decision{}, fmt.Errorf("failed to decode the decision of policy %q: %w", o.url, err)
+	}
+	if res.Result == nil {
+		return Decision{Reason: "decision is undefined"}, nil
+	}
+	var allow bool
+	if err := json.Unmarshal(*res.Result, &allow); err == nil {
+		return Decision{Allow: allow}, nil
+	}
+	var obj struct {
+		Allow  *bool  `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(*res.Result, &obj); err != nil {
+		return Decision{}, fmt.Errorf("decision of policy %q must be a boolean or an object: %w", o.url, err)
+	}
+	if obj.Allow == nil {
+		return Decision{Reason: "allow is undefined"}, nil
+	}
+	return Decision{Allow: *obj.Allow, Reason: obj.Reason}, nil
+}
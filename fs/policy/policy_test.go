@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOPA(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     string
+		status     int
+		wantAllow  bool
+		wantReason string
+		wantErr    bool
+	}{
+		{name: "allow", result: `{"result": true}`, wantAllow: true},
+		{name: "deny", result: `{"result": false}`},
+		{name: "object", result: `{"result": {"allow": false, "reason": "unsigned"}}`, wantReason: "unsigned"},
+		{name: "undefined", result: `{}`, wantReason: "decision is undefined"},
+		{name: "invalid", result: `{"result": "yes"}`, wantErr: true},
+		{name: "error", result: `{}`, status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Input
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var req struct {
+					Input Input `json:"input"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					t.Errorf("failed to decode input: %v", err)
+				}
+				got = req.Input
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(tt.result))
+			}))
+			defer srv.Close()
+
+			in := Input{
+				Ref:       "ghcr.io/stargz-containers/python:3.9-esgz",
+				Registry:  "ghcr.io",
+				Layer:     "sha256:3fff52a3d8cfc3c0d2e1e2d9a9f3a0c7c5c2a6b8e0e8b3e0a6c1f1a4f3b2c1d0",
+				TOCDigest: "sha256:7e1b8d1b5cb0b3e6e1a0a2c5f1c1e8b4e3a2c9d8f7e6d5c4b3a2918070605040",
+				Signature: "verified",
+			}
+			d, err := NewOPA(srv.URL, srv.Client()).Evaluate(context.Background(), in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("evaluation must fail; got %+v", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to evaluate: %v", err)
+			}
+			if got != in {
+				t.Errorf("input = %+v; want %+v", got, in)
+			}
+			if d.Allow != tt.wantAllow || d.Reason != tt.wantReason {
+				t.Errorf("decision = %+v; want allow=%v reason=%q", d, tt.wantAllow, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package progress provides subscriptions to the progress of fetching layers in
+// background.
+package progress
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// subscriberBuffer is the number of events buffered per subscriber.
+const subscriberBuffer = 64
+
+// Event is the progress of fetching a layer in background.
+type Event struct {
+	Digest digest.Digest `json:"digest"`
+
+	// Done is the number of bytes of the layer fetched so far.
+	Done int64 `json:"done"`
+
+	// Total is the size of the layer in bytes.
+	Total int64 `json:"total"`
+
+	// ETA is the estimated time to fetch the remaining bytes based on the rate since
+	// the start of the background fetch. Zero if unknown.
+	ETA time.Duration `json:"eta"`
+
+	// Completed is true on the last event of the layer.
+	Completed bool `json:"completed,omitempty"`
+
+	// Error is the reason of the failure if the background fetch failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Broker delivers events to subscribers. Events are dropped for subscribers that
+// don't receive them fast enough so publishers are never blocked.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewBroker returns a new broker.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe returns a channel receiving events published after this call. The channel
+// is closed when ctx is done.
+func (b *Broker) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		close(ch)
+		b.mu.Unlock()
+	}()
+	return ch
+}
+
+// Publish sends the event to all subscribers.
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Tracker publishes the progress of fetching a layer.
+type Tracker struct {
+	b      *Broker
+	digest digest.Digest
+	start  time.Time
+	base   int64 // bytes fetched before starting the tracker
+}
+
+// NewTracker starts tracking the layer. done is the number of bytes already fetched
+// (e.g. by prefetch), which is excluded from the rate for estimating ETA.
+func (b *Broker) NewTracker(dgst digest.Digest, done int64) *Tracker {
+	return &Tracker{b: b, digest: dgst, start: time.Now(), base: done}
+}
+
+// Update publishes the current progress.
+func (t *Tracker) Update(done, total int64) {
+	t.b.Publish(Event{Digest: t.digest, Done: done, Total: total, ETA: t.eta(done, total)})
+}
+
+// Complete publishes the last progress of the layer with the result of the fetch.
+func (t *Tracker) Complete(done, total int64, err error) {
+	e := Event{Digest: t.digest, Done: done, Total: total, Completed: true}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.b.Publish(e)
+}
+
+func (t *Tracker) eta(done, total int64) time.Duration {
+	fetched, elapsed := done-t.base, time.Since(t.start)
+	if fetched <= 0 || elapsed <= 0 || done >= total {
+		return 0
+	}
+	return time.Duration(float64(total-done) / float64(fetched) * float64(elapsed))
+}
@@ -0,0 +1,62 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package progress
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := b.Subscribe(ctx)
+	dgst := digest.FromString("dummy")
+
+	tr := b.NewTracker(dgst, 10)
+	time.Sleep(10 * time.Millisecond)
+	tr.Update(60, 110)
+	e := <-ch
+	if e.Digest != dgst || e.Done != 60 || e.Total != 110 || e.Completed {
+		t.Fatalf("unexpected event %+v", e)
+	}
+	// 50 bytes are fetched since the start so the remaining 50 bytes take about
+	// the same time.
+	if e.ETA <= 0 || e.ETA > time.Second {
+		t.Fatalf("unexpected ETA %v", e.ETA)
+	}
+
+	tr.Complete(100, 110, errors.New("dummy error"))
+	e = <-ch
+	if !e.Completed || e.Error != "dummy error" || e.ETA != 0 {
+		t.Fatalf("unexpected last event %+v", e)
+	}
+
+	// Slow subscribers don't block publishers.
+	for i := 0; i < subscriberBuffer*2; i++ {
+		tr.Update(int64(i), 110)
+	}
+
+	cancel()
+	for range ch {
+	}
+	b.Publish(Event{Digest: dgst}) // no subscriber
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// Codecs of layers decompressed by the pool.
+const (
+	CodecGzip         = "gzip"
+	CodecZstd         = "zstd"
+	CodecUncompressed = "uncompressed"
+)
+
+// CodecOfMediaType returns the codec of the layer of the media type.
+func CodecOfMediaType(mediaType string) string {
+	switch {
+	case strings.HasSuffix(mediaType, "+zstd"):
+		return CodecZstd
+	case strings.HasSuffix(mediaType, ".tar"):
+		return CodecUncompressed
+	}
+	return CodecGzip
+}
+
+// DecompressionStats is the statistics of the decompression of a codec.
+type DecompressionStats struct {
+	// Waiting is the number of decompressions waiting for workers.
+	Waiting int64
+
+	// Running is the number of decompressions running on workers.
+	Running int64
+
+	// Jobs is the total number of decompressions run on workers.
+	Jobs uint64
+
+	// WaitTime is the total time decompressions waited for workers.
+	WaitTime time.Duration
+}
+
+// DecompressionPool runs decompression of contents of layers on a bounded number of
+// workers for each codec so that decompression of a layer doesn't starve reads of other
+// layers. On-demand reads are given priority over background fetches. As the decompressors
+// read compressed contents from the blob, a worker also waits for fetching the contents
+// that aren't fetched yet.
+//
+// Workers are locked to OS threads. If a cgroup is set up, the threads are moved to the
+// cgroup so that the CPU time of decompression is limited.
+type DecompressionPool struct {
+	workers   int
+	perCodec  map[string]int
+	cgroupDir string
+
+	mu     sync.Mutex
+	codecs map[string]*codecWorkers
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewDecompressionPool returns the pool running workers workers for each codec, which can
+// be overridden for each codec by perCodec. If cgroupCPUMax is non-empty, the workers are limited by
+// the cgroup v2 "cpu.max" value. Failures of setting up the cgroup are logged and the pool
+// runs without the limit.
+func NewDecompressionPool(workers int, perCodec map[string]int, cgroupCPUMax string) *DecompressionPool {
+	p := &DecompressionPool{
+		workers:  workers,
+		perCodec: perCodec,
+		codecs:   make(map[string]*codecWorkers),
+		closed:   make(chan struct{}),
+	}
+	if cgroupCPUMax != "" {
+		dir, err := setupDecompressionCgroup(cgroupCPUMax)
+		if err != nil {
+			log.L.WithError(err).Warnf("failed to set up cgroup for decompression; running without CPU limit")
+		} else {
+			p.cgroupDir = dir
+		}
+	}
+	return p
+}
+
+// Do runs f on a worker of the codec and waits for its completion. background is true
+// for decompression of background fetches. If the pool is nil or the codec has no
+// worker, f runs on the caller goroutine.
+func (p *DecompressionPool) Do(codec string, background bool, f func()) {
+	c := p.workersOf(codec)
+	if c == nil {
+		f()
+		return
+	}
+	j := &decompressJob{f: f, queued: time.Now(), done: make(chan struct{})}
+	c.mu.Lock()
+	c.stats.Waiting++
+	c.mu.Unlock()
+	if background {
+		c.low <- j
+	} else {
+		c.high <- j
+	}
+	<-j.done
+}
+
+// Stats returns the statistics of the codecs used so far.
+func (p *DecompressionPool) Stats() map[string]DecompressionStats {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	codecs := make(map[string]*codecWorkers, len(p.codecs))
+	for codec, c := range p.codecs {
+		if c != nil {
+			codecs[codec] = c
+		}
+	}
+	p.mu.Unlock()
+	stats := make(map[string]DecompressionStats, len(codecs))
+	for codec, c := range codecs {
+		c.mu.Lock()
+		stats[codec] = c.stats
+		c.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops the workers. Decompressions must not be requested after Close.
+func (p *DecompressionPool) Close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.closed) })
+}
+
+// workersOf returns the workers of the codec, starting them at the first use. This
+// returns nil if the codec has no worker.
+func (p *DecompressionPool) workersOf(codec string) *codecWorkers {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.codecs[codec]; ok {
+		return c
+	}
+	n := p.workers
+	if cn, ok := p.perCodec[codec]; ok {
+		n = cn
+	}
+	if n <= 0 {
+		p.codecs[codec] = nil
+		return nil
+	}
+	c := &codecWorkers{
+		high: make(chan *decompressJob),
+		low:  make(chan *decompressJob),
+	}
+	for i := 0; i < n; i++ {
+		go p.work(codec, c)
+	}
+	p.codecs[codec] = c
+	return c
+}
+
+func (p *DecompressionPool) work(codec string, c *codecWorkers) {
+	// The thread is discarded when the worker exits without unlocking, so that other
+	// goroutines don't run in the cgroup of decompression.
+	runtime.LockOSThread()
+	if p.cgroupDir != "" {
+		if err := joinDecompressionCgroup(p.cgroupDir); err != nil {
+			log.L.WithError(err).Warnf("failed to move %s decompression worker to the cgroup", codec)
+		}
+	}
+	for {
+		var j *decompressJob
+		select {
+		case j = <-c.high:
+		default:
+			select {
+			case j = <-c.high:
+			case j = <-c.low:
+			case <-p.closed:
+				return
+			}
+		}
+		c.run(j)
+	}
+}
+
+type codecWorkers struct {
+	high chan *decompressJob // on-demand reads
+	low  chan *decompressJob // background fetches
+
+	mu    sync.Mutex
+	stats DecompressionStats
+}
+
+func (c *codecWorkers) run(j *decompressJob) {
+	c.mu.Lock()
+	c.stats.Waiting--
+	c.stats.Running++
+	c.stats.Jobs++
+	c.stats.WaitTime += time.Since(j.queued)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.stats.Running--
+		c.mu.Unlock()
+		close(j.done)
+	}()
+	j.f()
+}
+
+type decompressJob struct {
+	f      func()
+	queued time.Time
+	done   chan struct{}
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// cgroupRoot is the mountpoint of cgroup v2.
+	cgroupRoot = "/sys/fs/cgroup"
+
+	// decompressionCgroupName is the name of the threaded cgroup of decompression workers
+	// created under the cgroup of the snapshotter.
+	decompressionCgroupName = "stargz-decompression"
+)
+
+// setupDecompressionCgroup creates the threaded child cgroup of the cgroup of this process
+// limited by the "cpu.max" value and returns its path.
+func setupDecompressionCgroup(cpuMax string) (string, error) {
+	self, err := selfCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(cgroupRoot, self)
+	dir := filepath.Join(parent, decompressionCgroupName)
+	if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := writeCgroupFile(dir, "cgroup.type", "threaded"); err != nil {
+		return "", err
+	}
+	if err := writeCgroupFile(parent, "cgroup.subtree_control", "+cpu"); err != nil {
+		return "", err
+	}
+	if err := writeCgroupFile(dir, "cpu.max", cpuMax); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// joinDecompressionCgroup moves the calling thread to the cgroup. The caller must be locked
+// to the thread.
+func joinDecompressionCgroup(dir string) error {
+	return writeCgroupFile(dir, "cgroup.threads", strconv.Itoa(unix.Gettid()))
+}
+
+// selfCgroup returns the path of the cgroup v2 of this process relative to the root.
+func selfCgroup() (string, error) {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if p := strings.TrimPrefix(s.Text(), "0::"); p != s.Text() {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 isn't used")
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to write %q to %q of cgroup %q: %w", value, name, dir, err)
+	}
+	return nil
+}
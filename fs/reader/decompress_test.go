@@ -0,0 +1,126 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecompressionPool(t *testing.T) {
+	p := NewDecompressionPool(2, map[string]int{CodecUncompressed: 0}, "")
+	defer p.Close()
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(CodecGzip, false, func() { <-release })
+		}()
+	}
+	waitDecompressionStats(t, p, CodecGzip, func(s DecompressionStats) bool {
+		return s.Running == 2 && s.Waiting == 3
+	})
+	close(release)
+	wg.Wait()
+	if s := p.Stats()[CodecGzip]; s.Jobs != 5 || s.Running != 0 || s.Waiting != 0 {
+		t.Errorf("unexpected stats after decompressions: %+v", s)
+	}
+
+	// Codecs without workers are decompressed by the caller.
+	var ran bool
+	p.Do(CodecUncompressed, false, func() { ran = true })
+	if !ran {
+		t.Errorf("decompression of the codec without workers must run inline")
+	}
+	if _, ok := p.Stats()[CodecUncompressed]; ok {
+		t.Errorf("codec without workers must not have stats")
+	}
+
+	// A nil pool decompresses on the caller.
+	ran = false
+	(*DecompressionPool)(nil).Do(CodecGzip, false, func() { ran = true })
+	if !ran {
+		t.Errorf("decompression without the pool must run inline")
+	}
+}
+
+func TestDecompressionPoolPriority(t *testing.T) {
+	p := NewDecompressionPool(1, nil, "")
+	defer p.Close()
+
+	release := make(chan struct{})
+	go p.Do(CodecZstd, false, func() { <-release })
+	waitDecompressionStats(t, p, CodecZstd, func(s DecompressionStats) bool { return s.Running == 1 })
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	do := func(name string, background bool) {
+		defer wg.Done()
+		p.Do(CodecZstd, background, func() {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		})
+	}
+	wg.Add(1)
+	go do("background", true)
+	waitDecompressionStats(t, p, CodecZstd, func(s DecompressionStats) bool { return s.Waiting == 1 })
+	wg.Add(1)
+	go do("on-demand", false)
+	waitDecompressionStats(t, p, CodecZstd, func(s DecompressionStats) bool { return s.Waiting == 2 })
+	close(release)
+	wg.Wait()
+	if len(order) != 2 || order[0] != "on-demand" {
+		t.Errorf("on-demand decompression must run before background one; got %v", order)
+	}
+	if s := p.Stats()[CodecZstd]; s.WaitTime <= 0 {
+		t.Errorf("wait time must be recorded: %+v", s)
+	}
+}
+
+func TestCodecOfMediaType(t *testing.T) {
+	for mediaType, want := range map[string]string{
+		"application/vnd.oci.image.layer.v1.tar+gzip":       CodecGzip,
+		"application/vnd.docker.image.rootfs.diff.tar.gzip": CodecGzip,
+		"application/vnd.oci.image.layer.v1.tar+zstd":       CodecZstd,
+		"application/vnd.oci.image.layer.v1.tar":            CodecUncompressed,
+		"application/vnd.docker.image.rootfs.diff.tar":      CodecUncompressed,
+		"": CodecGzip,
+	} {
+		if got := CodecOfMediaType(mediaType); got != want {
+			t.Errorf("codec of %q = %q; want %q", mediaType, got, want)
+		}
+	}
+}
+
+func waitDecompressionStats(t *testing.T, p *DecompressionPool, codec string, f func(DecompressionStats) bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !f(p.Stats()[codec]) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for stats of %q: %+v", codec, p.Stats()[codec])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
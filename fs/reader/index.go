@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// ChunkIndex indexes chunks in caches of readers by their digests so that a reader can
+// take a chunk from the cache of another layer containing the same chunk, instead of
+// fetching it from the registry. This is effective for layers built with content-defined
+// chunking, whose chunks are mostly shared among versions of the image.
+type ChunkIndex struct {
+	mu     sync.Mutex
+	chunks map[digest.Digest]map[*reader]string // cache key of the chunk in each reader
+	owners map[*reader][]digest.Digest
+}
+
+// NewChunkIndex returns an empty index.
+func NewChunkIndex() *ChunkIndex {
+	return &ChunkIndex{
+		chunks: make(map[digest.Digest]map[*reader]string),
+		owners: make(map[*reader][]digest.Digest),
+	}
+}
+
+// Option is an option of NewReader.
+type Option func(*reader)
+
+// WithChunkIndex makes the reader share its cached chunks with other readers through the
+// index. Nil index disables sharing.
+func WithChunkIndex(idx *ChunkIndex) Option {
+	return func(gr *reader) {
+		gr.index = idx
+	}
+}
+
+type chunkLocation struct {
+	gr  *reader
+	key string
+}
+
+func (idx *ChunkIndex) add(dgst digest.Digest, gr *reader, key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	m, ok := idx.chunks[dgst]
+	if !ok {
+		m = make(map[*reader]string)
+		idx.chunks[dgst] = m
+	}
+	if _, ok := m[gr]; !ok {
+		m[gr] = key
+		idx.owners[gr] = append(idx.owners[gr], dgst)
+	}
+}
+
+// lookup returns the locations of the chunk in readers other than the one specified.
+func (idx *ChunkIndex) lookup(dgst digest.Digest, exclude *reader) (locs []chunkLocation) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for gr, key := range idx.chunks[dgst] {
+		if gr != exclude {
+			locs = append(locs, chunkLocation{gr, key})
+		}
+	}
+	return
+}
+
+// remove removes all chunks of the reader from the index.
+func (idx *ChunkIndex) remove(gr *reader) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, dgst := range idx.owners[gr] {
+		delete(idx.chunks[dgst], gr)
+		if len(idx.chunks[dgst]) == 0 {
+			delete(idx.chunks, dgst)
+		}
+	}
+	delete(idx.owners, gr)
+}
@@ -34,17 +34,21 @@ import (
 	"sync"
 	"time"
 
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/metadata"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
-	"golang.org/x/sync/errgroup"
-	"golang.org/x/sync/semaphore"
 )
 
-const maxWalkDepth = 10000
+const (
+	maxWalkDepth = 10000
+
+	// maxSpanSize is the max size of chunks read together by WithSpanChunks.
+	maxSpanSize = 16 << 20
+)
 
 type Reader interface {
 	OpenFile(id uint32) (io.ReaderAt, error)
@@ -135,20 +139,61 @@ func (vr *VerifiableReader) Cache(opts ...CacheOption) (err error) {
 		filter = cacheOpts.filter
 	}
 
-	eg, egCtx := errgroup.WithContext(context.Background())
-	eg.Go(func() error {
-		return vr.cacheWithReader(egCtx,
-			0, eg, semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
-			rootID, r, filter, cacheOpts.cacheOpts...)
-	})
-	return eg.Wait()
+	// Chunks of each file are scheduled as soon as the walk finds the file so that chunks
+	// found before VerifyTOC are fetched and verified before it. Scheduling blocks while the
+	// limit of concurrent fills is reached and the walk stops on the first failure.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		pending []*cache.Ticket
+		allErr  error
+	)
+	collect := func(wait bool) {
+		n := 0
+		for _, t := range pending {
+			if !wait && !t.Done() {
+				pending[n] = t
+				n++
+				continue
+			}
+			if err := t.Wait(context.Background()); err != nil {
+				allErr = multierror.Append(allErr, err)
+			}
+		}
+		pending = pending[:n]
+	}
+	ensure := func(offset int64, reqs []cache.Request) error {
+		if check := cacheOpts.tarHeaderCheck; check != nil && len(reqs) > 0 {
+			// Check the tar header of the file along with fetching its first chunk.
+			fill := reqs[0].Fill
+			reqs[0].Fill = func(w io.Writer) error {
+				if err := check(offset); err != nil {
+					return err
+				}
+				return fill(w)
+			}
+		}
+		pending = append(pending, gr.prefetcher.Ensure(ctx, gr.cache, reqs, cacheOpts.cacheOpts...))
+		collect(false)
+		if allErr != nil {
+			cancel()
+		}
+		return allErr
+	}
+	walkErr := vr.cacheWithReader(0, rootID, r, filter, ensure)
+	collect(true)
+	if allErr != nil {
+		return allErr
+	}
+	return walkErr
 }
 
-func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dirID uint32, r metadata.Reader, filter func(int64) bool, opts ...cache.Option) (rErr error) {
+// cacheWithReader walks the directory and passes the offset and requests to cache chunks of
+// each regular file to ensure. The walk stops if ensure returns an error.
+func (vr *VerifiableReader) cacheWithReader(currentDepth int, dirID uint32, r metadata.Reader, filter func(int64) bool, ensure func(int64, []cache.Request) error) (rErr error) {
 	if currentDepth > maxWalkDepth {
 		return fmt.Errorf("tree is too deep (depth:%d)", currentDepth)
 	}
-	gr := vr.r
 	rootID := r.RootID()
 	r.ForeachChild(dirID, func(name string, id uint32, mode os.FileMode) bool {
 		e, err := r.GetAttr(id)
@@ -165,7 +210,7 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 				return true
 			}
 
-			if err := vr.cacheWithReader(ctx, currentDepth+1, eg, sem, id, r, filter, opts...); err != nil {
+			if err := vr.cacheWithReader(currentDepth+1, id, r, filter, ensure); err != nil {
 				rErr = err
 				return false
 			}
@@ -194,81 +239,101 @@ func (vr *VerifiableReader) cacheWithReader(ctx context.Context, currentDepth in
 			return false
 		}
 
-		var nr int64
+		var (
+			nr   int64
+			reqs []cache.Request
+		)
 		for nr < e.Size {
 			chunkOffset, chunkSize, chunkDigestStr, ok := fr.ChunkEntryForOffset(nr)
 			if !ok {
 				break
 			}
-			nr += chunkSize
-
-			if err := sem.Acquire(ctx, 1); err != nil {
-				rErr = err
+			if err := checkChunkSize(chunkSize); err != nil {
+				rErr = fmt.Errorf("failed to cache %q: %w", name, err)
 				return false
 			}
+			nr += chunkSize
+			reqs = append(reqs, vr.chunkRequest(name, id, fr, chunkOffset, chunkSize, chunkDigestStr))
+		}
+		if err := ensure(offset, reqs); err != nil {
+			rErr = err
+			return false
+		}
 
-			eg.Go(func() (retErr error) {
-				defer sem.Release(1)
-				defer func() {
-					if retErr != nil {
-						vr.storeLastVerifyErr(retErr)
-					}
-				}()
-
-				// Check if the target chunks exists in the cache
-				cacheID := genID(id, chunkOffset, chunkSize)
-				if r, err := gr.cache.Get(cacheID, opts...); err == nil {
-					return r.Close()
-				}
+		return true
+	})
 
-				// missed cache, needs to fetch and add it to the cache
-				br := bufio.NewReaderSize(io.NewSectionReader(fr, chunkOffset, chunkSize), int(chunkSize))
-				if _, err := br.Peek(int(chunkSize)); err != nil {
-					return fmt.Errorf("cacheWithReader.peek: %v", err)
+	return
+}
+
+// chunkRequest returns the request to cache the chunk, taking it from caches of other
+// layers if available or fetching it otherwise.
+func (vr *VerifiableReader) chunkRequest(name string, id uint32, fr metadata.File, chunkOffset, chunkSize int64, chunkDigestStr string) cache.Request {
+	gr := vr.r
+	cacheID := genID(id, chunkOffset, chunkSize)
+	var indexed bool
+	return cache.Request{
+		Key: cacheID,
+		Fill: func(w io.Writer) (retErr error) {
+			defer func() {
+				if retErr != nil {
+					vr.storeLastVerifyErr(retErr)
 				}
-				w, err := gr.cache.Add(cacheID, opts...)
-				if err != nil {
+			}()
+
+			// take it from caches of other layers if available
+			if gr.index != nil {
+				p := make([]byte, chunkSize)
+				if gr.readFromIndex(p, chunkDigestStr) {
+					indexed = true
+					_, err := w.Write(p)
 					return err
 				}
-				defer w.Close()
-				v, err := vr.verifier(id, chunkDigestStr)
-				if err != nil {
-					vr.prohibitVerifyFailureMu.RLock()
-					if vr.prohibitVerifyFailure {
-						vr.prohibitVerifyFailureMu.RUnlock()
-						return fmt.Errorf("verifier not found %q(off:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
-					}
-					vr.storeLastVerifyErr(err)
+			}
+
+			// needs to fetch and add it to the cache
+			br := bufio.NewReaderSize(io.NewSectionReader(fr, chunkOffset, chunkSize), int(chunkSize))
+			var err error
+			gr.decompress(true, func() { _, err = br.Peek(int(chunkSize)) })
+			if err != nil {
+				return fmt.Errorf("cacheWithReader.peek: %v", err)
+			}
+			v, err := vr.verifier(id, chunkDigestStr)
+			if err != nil {
+				vr.prohibitVerifyFailureMu.RLock()
+				if vr.prohibitVerifyFailure {
 					vr.prohibitVerifyFailureMu.RUnlock()
+					return fmt.Errorf("verifier not found %q(off:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
 				}
-				tee := io.Discard
-				if v != nil {
-					tee = io.Writer(v) // verification is required
-				}
-				if _, err := io.CopyN(w, io.TeeReader(br, tee), chunkSize); err != nil {
-					w.Abort()
-					return fmt.Errorf("failed to cache file payload of %q (offset:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
-				}
-				if v != nil && !v.Verified() {
-					err := fmt.Errorf("invalid chunk %q (offset:%d,size:%d)", name, chunkOffset, chunkSize)
-					vr.prohibitVerifyFailureMu.RLock()
-					if vr.prohibitVerifyFailure {
-						vr.prohibitVerifyFailureMu.RUnlock()
-						w.Abort()
-						return err
-					}
-					vr.storeLastVerifyErr(err)
+				vr.storeLastVerifyErr(err)
+				vr.prohibitVerifyFailureMu.RUnlock()
+			}
+			tee := io.Discard
+			if v != nil {
+				tee = io.Writer(v) // verification is required
+			}
+			if _, err := io.CopyN(w, io.TeeReader(br, tee), chunkSize); err != nil {
+				return fmt.Errorf("failed to cache file payload of %q (offset:%d,size:%d): %w", name, chunkOffset, chunkSize, err)
+			}
+			if v != nil && !v.Verified() {
+				err := fmt.Errorf("invalid chunk %q (offset:%d,size:%d)", name, chunkOffset, chunkSize)
+				vr.prohibitVerifyFailureMu.RLock()
+				if vr.prohibitVerifyFailure {
 					vr.prohibitVerifyFailureMu.RUnlock()
+					return err
 				}
-
-				return w.Commit()
-			})
-		}
-
-		return true
-	})
-
-	return
+				vr.storeLastVerifyErr(err)
+				vr.prohibitVerifyFailureMu.RUnlock()
+			}
+			indexed = v != nil && v.Verified()
+			return nil
+		},
+		OnCommit: func() {
+			if indexed {
+				gr.addToIndex(chunkDigestStr, cacheID)
+			}
+		},
+	}
 }
 
 func (vr *VerifiableReader) Close() error {
@@ -288,13 +353,92 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// WithStrictVerify makes the reader verify chunks read from the cache every time they are
+// served, not only when they are fetched. This has no effect on unverified layers.
+func WithStrictVerify() Option {
+	return func(gr *reader) {
+		gr.strictVerify = true
+	}
+}
+
+// WithZeroCopy makes files opened by the reader implement FileRangeReader so that ranges
+// cached in files can be served without being copied to the caller's buffer. This has no
+// effect in strict verification mode because chunks need to be read for verification, and
+// on encrypted files because their contents need to be decrypted.
+func WithZeroCopy() Option {
+	return func(gr *reader) {
+		gr.zeroCopy = true
+	}
+}
+
+// WithSpanChunks makes the reader decompress and cache up to n consecutive chunks of a file
+// together when one of them misses the cache. This exploits the locality of compressed
+// streams for sequential reads while bounding the overfetch to n chunks.
+func WithSpanChunks(n int) Option {
+	return func(gr *reader) {
+		gr.spanChunks = n
+	}
+}
+
+// WithDecryptionKeys specifies the keys of encrypted files keyed by the IDs (see
+// estargz.KeyID). Contents of encrypted files are cached as stored in the blob and
+// decrypted every time they are read. Encrypted files can't be opened without their keys.
+func WithDecryptionKeys(keys map[string][]byte) Option {
+	return func(gr *reader) {
+		gr.decryptionKeys = keys
+	}
+}
+
+// WithPrefetcher makes the reader fill the cache through the prefetcher on Cache so that
+// fills are deduplicated with and share the concurrency with other users of the prefetcher.
+// By default, each reader uses its own prefetcher.
+func WithPrefetcher(p *cache.Prefetcher) Option {
+	return func(gr *reader) {
+		gr.prefetcher = p
+	}
+}
+
+// WithDecompressionPool makes the reader decompress contents of the layer of the codec (see
+// CodecOfMediaType) on the workers of the pool.
+func WithDecompressionPool(p *DecompressionPool, codec string) Option {
+	return func(gr *reader) {
+		gr.decompressPool = p
+		gr.codec = codec
+	}
+}
+
+// FetchedSizer is implemented by readers that know how much of the contents of files
+// are already fetched.
+type FetchedSizer interface {
+	// FetchedSize returns the total size of the chunks of the file stored in the cache.
+	FetchedSize(id uint32) (int64, error)
+}
+
+// FileRangeReader is implemented by files opened by readers with WithZeroCopy.
+type FileRangeReader interface {
+	// ReadCachedFile returns the cache file containing the range of the file starting at
+	// offset, if the range of size bytes (or the range until the end of the file) is
+	// entirely in a chunk stored in a file. fileOffset and n are the offset and the size
+	// of the range in the cache file. The caller must close r after it finishes using the
+	// file descriptor.
+	ReadCachedFile(offset int64, size int) (r cache.FileReader, fileOffset int64, n int, ok bool)
+}
+
+// NoAtimeFile is implemented by files that can be read without recording accesses to
+// the cache.
+type NoAtimeFile interface {
+	// NoAtime returns the file whose reads don't affect the access statistics of the
+	// cache.
+	NoAtime() io.ReaderAt
+}
+
 // NewReader creates a Reader based on the given stargz blob and cache implementation.
 // It returns VerifiableReader so the caller must provide a metadata.ChunkVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, blobCache cache.BlobCache, layerSha digest.Digest, opts ...Option) (*VerifiableReader, error) {
 	vr := &reader{
 		r:     r,
-		cache: cache,
+		cache: blobCache,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
@@ -303,6 +447,12 @@ func NewReader(r metadata.Reader, cache cache.BlobCache, layerSha digest.Digest)
 		layerSha: layerSha,
 		verifier: digestVerifier,
 	}
+	for _, o := range opts {
+		o(vr)
+	}
+	if vr.prefetcher == nil {
+		vr.prefetcher = cache.NewPrefetcher(runtime.GOMAXPROCS(0))
+	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
 
@@ -319,8 +469,20 @@ type reader struct {
 	closed   bool
 	closedMu sync.Mutex
 
-	verify   bool
-	verifier func(uint32, string) (digest.Verifier, error)
+	verify       bool
+	strictVerify bool
+	zeroCopy     bool
+	spanChunks   int
+	verifier     func(uint32, string) (digest.Verifier, error)
+
+	decryptionKeys map[string][]byte
+
+	decompressPool *DecompressionPool
+	codec          string
+
+	prefetcher *cache.Prefetcher
+
+	index *ChunkIndex
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -349,11 +511,46 @@ func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file %d: %w", id, err)
 	}
-	return &file{
+	f := &file{
 		id: id,
 		fr: fr,
 		gr: gr,
-	}, nil
+	}
+	attr, err := gr.r.GetAttr(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attributes of file %d: %w", id, err)
+	}
+	if enc := attr.Encryption; enc != nil {
+		key, ok := gr.decryptionKeys[enc.KeyID]
+		if !ok {
+			return nil, fmt.Errorf("no key to decrypt file %d (%q)", id, enc.KeyID)
+		}
+		f.enc, f.key = enc, key
+	}
+	return f, nil
+}
+
+func (gr *reader) FetchedSize(id uint32) (int64, error) {
+	if gr.isClosed() {
+		return 0, fmt.Errorf("reader is already closed")
+	}
+	fr, err := gr.r.OpenFile(id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %d: %w", id, err)
+	}
+	var fetched, offset int64
+	for {
+		chunkOffset, chunkSize, _, ok := fr.ChunkEntryForOffset(offset)
+		if !ok || chunkSize <= 0 {
+			break
+		}
+		if r, err := gr.cache.Get(genID(id, chunkOffset, chunkSize)); err == nil {
+			r.Close()
+			fetched += chunkSize
+		}
+		offset = chunkOffset + chunkSize
+	}
+	return fetched, nil
 }
 
 func (gr *reader) Close() (retErr error) {
@@ -363,6 +560,9 @@ func (gr *reader) Close() (retErr error) {
 		return nil
 	}
 	gr.closed = true
+	if gr.index != nil {
+		gr.index.remove(gr)
+	}
 	if err := gr.cache.Close(); err != nil {
 		retErr = multierror.Append(retErr, err)
 	}
@@ -379,6 +579,12 @@ func (gr *reader) isClosed() bool {
 	return closed
 }
 
+// decompress runs f reading (and decompressing) contents of the blob on the decompression
+// pool, if any. background is true for background fetches.
+func (gr *reader) decompress(background bool, f func()) {
+	gr.decompressPool.Do(gr.codec, background, f)
+}
+
 func (gr *reader) putBuffer(b *bytes.Buffer) {
 	b.Reset()
 	gr.bufPool.Put(b)
@@ -388,6 +594,28 @@ type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+
+	// noAtime makes reads not record accesses to the cache.
+	noAtime bool
+
+	// enc and key decrypt the contents if the file is encrypted.
+	enc *estargz.Encryption
+	key []byte
+}
+
+// NoAtime returns the file that doesn't record accesses to the cache, for handles opened
+// with O_NOATIME.
+func (sf *file) NoAtime() io.ReaderAt {
+	f := *sf
+	f.noAtime = true
+	return &f
+}
+
+func (sf *file) cacheOpts(opts ...cache.Option) []cache.Option {
+	if sf.noAtime {
+		opts = append(opts, cache.NoAccessRecord())
+	}
+	return opts
 }
 
 // ReadAt reads chunks from the stargz file with trying to fetch as many chunks
@@ -399,6 +627,9 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		if !ok {
 			break
 		}
+		if err := checkChunkSize(chunkSize); err != nil {
+			return 0, err
+		}
 		var (
 			id           = genID(sf.id, chunkOffset, chunkSize)
 			lowerDiscard = positive(offset - chunkOffset)
@@ -407,45 +638,38 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		)
 
 		// Check if the content exists in the cache
-		if r, err := sf.gr.cache.Get(id); err == nil {
-			n, err := r.ReadAt(p[nr:int64(nr)+expectedSize], lowerDiscard)
-			if (err == nil || err == io.EOF) && int64(n) == expectedSize {
-				nr += n
-				r.Close()
+		if r, err := sf.gr.cache.Get(id, sf.cacheOpts()...); err == nil {
+			ok := sf.readCached(r, p[nr:int64(nr)+expectedSize], lowerDiscard, chunkSize, chunkDigestStr)
+			r.Close()
+			if ok {
+				nr += int(expectedSize)
 				continue
 			}
-			r.Close()
 		}
 
 		// We missed cache. Take it from underlying reader.
 		// We read the whole chunk here and add it to the cache so that following
 		// reads against neighboring chunks can take the data without decmpression.
+		if sf.gr.spanChunks > 1 {
+			ok, err := sf.readSpan(p[nr:int64(nr)+expectedSize], lowerDiscard, chunkOffset, chunkSize, chunkDigestStr)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				nr += int(expectedSize)
+				continue
+			}
+		}
 		if lowerDiscard == 0 && upperDiscard == 0 {
 			// We can directly store the result to the given buffer
 			ip := p[nr : int64(nr)+chunkSize]
-			n, err := sf.fr.ReadAt(ip, chunkOffset)
-			if err != nil && err != io.EOF {
-				return 0, fmt.Errorf("failed to read data: %w", err)
-			}
-
-			commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
-			commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(n))       // record total bytes fetched
-			sf.gr.setLastReadTime(time.Now())
-
-			// Verify this chunk
-			if err := sf.verify(sf.id, ip, chunkDigestStr); err != nil {
-				return 0, fmt.Errorf("invalid chunk: %w", err)
+			n, err := sf.readChunk(ip, chunkOffset, chunkDigestStr)
+			if err != nil {
+				return 0, err
 			}
 
 			// Cache this chunk
-			if w, err := sf.gr.cache.Add(id); err == nil {
-				if cn, err := w.Write(ip); err != nil || cn != len(ip) {
-					w.Abort()
-				} else {
-					w.Commit()
-				}
-				w.Close()
-			}
+			sf.gr.cacheChunk(id, chunkDigestStr, ip)
 			nr += n
 			continue
 		}
@@ -455,31 +679,13 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		b.Reset()
 		b.Grow(int(chunkSize))
 		ip := b.Bytes()[:chunkSize]
-		if _, err := sf.fr.ReadAt(ip, chunkOffset); err != nil && err != io.EOF {
-			sf.gr.putBuffer(b)
-			return 0, fmt.Errorf("failed to read data: %w", err)
-		}
-
-		// We can end up doing on demand registry fetch when aligning the chunk
-		commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
-		commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(len(ip))) // record total bytes fetched
-		sf.gr.setLastReadTime(time.Now())
-
-		// Verify this chunk
-		if err := sf.verify(sf.id, ip, chunkDigestStr); err != nil {
+		if _, err := sf.readChunk(ip, chunkOffset, chunkDigestStr); err != nil {
 			sf.gr.putBuffer(b)
-			return 0, fmt.Errorf("invalid chunk: %w", err)
+			return 0, err
 		}
 
 		// Cache this chunk
-		if w, err := sf.gr.cache.Add(id); err == nil {
-			if cn, err := w.Write(ip); err != nil || cn != len(ip) {
-				w.Abort()
-			} else {
-				w.Commit()
-			}
-			w.Close()
-		}
+		sf.gr.cacheChunk(id, chunkDigestStr, ip)
 		n := copy(p[nr:], ip[lowerDiscard:chunkSize-upperDiscard])
 		sf.gr.putBuffer(b)
 		if int64(n) != expectedSize {
@@ -488,11 +694,217 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		nr += n
 	}
 
+	if sf.enc != nil {
+		if err := estargz.DecryptAt(sf.enc, sf.key, p[:nr], offset); err != nil {
+			return 0, err
+		}
+	}
+
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(nr)) // measure the number of on demand bytes served
 
 	return nr, nil
 }
 
+func (sf *file) ReadCachedFile(offset int64, size int) (cache.FileReader, int64, int, bool) {
+	if !sf.gr.zeroCopy || (sf.gr.strictVerify && sf.gr.verify) || sf.enc != nil || size <= 0 {
+		return nil, 0, 0, false
+	}
+	chunkOffset, chunkSize, _, ok := sf.fr.ChunkEntryForOffset(offset)
+	if !ok || checkChunkSize(chunkSize) != nil {
+		return nil, 0, 0, false
+	}
+	chunkEnd := chunkOffset + chunkSize
+	n := int64(size)
+	if offset+n > chunkEnd {
+		if _, _, _, ok := sf.fr.ChunkEntryForOffset(chunkEnd); ok {
+			return nil, 0, 0, false // the range spans multiple chunks
+		}
+		n = chunkEnd - offset // the end of the file
+	}
+	r, err := sf.gr.cache.Get(genID(sf.id, chunkOffset, chunkSize), sf.cacheOpts(cache.PreferFile())...)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	fr, ok := r.(cache.FileReader)
+	if !ok {
+		r.Close() // not stored in a file yet
+		return nil, 0, 0, false
+	}
+	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, n)
+	return fr, offset - chunkOffset, int(n), true
+}
+
+// readCached reads the range of the chunk from the cache to p. In strict verification mode,
+// the whole chunk is read and verified every time it's served so that data in the cache
+// (e.g. fetched by prefetch) is never served without verification.
+func (sf *file) readCached(r cache.Reader, p []byte, lowerDiscard, chunkSize int64, chunkDigestStr string) bool {
+	if !sf.gr.strictVerify || !sf.gr.verify {
+		n, err := r.ReadAt(p, lowerDiscard)
+		return (err == nil || err == io.EOF) && n == len(p)
+	}
+	start := time.Now()
+	b := sf.gr.bufPool.Get().(*bytes.Buffer)
+	defer sf.gr.putBuffer(b)
+	b.Reset()
+	b.Grow(int(chunkSize))
+	ip := b.Bytes()[:chunkSize]
+	if n, err := r.ReadAt(ip, 0); (err != nil && err != io.EOF) || int64(n) != chunkSize {
+		return false
+	}
+	if err := sf.verify(sf.id, ip, chunkDigestStr); err != nil {
+		commonmetrics.IncOperationCount(commonmetrics.ServeTimeVerifyFailureCount, sf.gr.layerSha)
+		log.L.WithError(err).Warnf("cached chunk of file %d in layer %v isn't verified; fetching again", sf.id, sf.gr.layerSha)
+		return false
+	}
+	copy(p, ip[lowerDiscard:])
+	commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.ServeTimeVerify, sf.gr.layerSha, start)
+	commonmetrics.AddBytesCount(commonmetrics.ServeTimeVerifiedBytes, sf.gr.layerSha, chunkSize)
+	return true
+}
+
+// readChunk reads the whole chunk to p. The chunk is taken from caches of other layers
+// containing the same chunk if available. Otherwise, this can end up doing on demand
+// registry fetch.
+func (sf *file) readChunk(p []byte, chunkOffset int64, chunkDigestStr string) (int, error) {
+	if sf.gr.readFromIndex(p, chunkDigestStr) {
+		return len(p), nil
+	}
+	var n int
+	var err error
+	sf.gr.decompress(false, func() { n, err = sf.fr.ReadAt(p, chunkOffset) })
+	if err != nil && err != io.EOF {
+		return 0, fmt.Errorf("failed to read data: %w", err)
+	}
+
+	commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
+	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(n))       // record total bytes fetched
+	sf.gr.setLastReadTime(time.Now())
+
+	// Verify this chunk
+	if err := sf.verify(sf.id, p, chunkDigestStr); err != nil {
+		return 0, fmt.Errorf("invalid chunk: %w", err)
+	}
+	return n, nil
+}
+
+type spanChunk struct {
+	offset int64
+	size   int64
+	digest string
+}
+
+// readSpan reads the chunk together with the following chunks of the file that miss the
+// cache, up to spanChunks chunks in total, and caches all of them. The range of the first
+// chunk starting from lowerDiscard is copied to p. This returns false without reading
+// anything if no following chunk needs to be read.
+func (sf *file) readSpan(p []byte, lowerDiscard, chunkOffset, chunkSize int64, chunkDigestStr string) (bool, error) {
+	span := []spanChunk{{chunkOffset, chunkSize, chunkDigestStr}}
+	end := chunkOffset + chunkSize
+	for len(span) < sf.gr.spanChunks {
+		off, size, dgst, ok := sf.fr.ChunkEntryForOffset(end)
+		if !ok || off != end || checkChunkSize(size) != nil || end-chunkOffset+size > maxSpanSize {
+			break
+		}
+		if r, err := sf.gr.cache.Get(genID(sf.id, off, size)); err == nil {
+			r.Close()
+			break // the rest of the span is already cached
+		}
+		span = append(span, spanChunk{off, size, dgst})
+		end += size
+	}
+	if len(span) == 1 {
+		return false, nil
+	}
+
+	b := sf.gr.bufPool.Get().(*bytes.Buffer)
+	defer sf.gr.putBuffer(b)
+	b.Reset()
+	b.Grow(int(end - chunkOffset))
+	ip := b.Bytes()[:end-chunkOffset]
+	var n int
+	var err error
+	sf.gr.decompress(false, func() { n, err = sf.fr.ReadAt(ip, chunkOffset) })
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read data: %w", err)
+	} else if n != len(ip) {
+		return false, fmt.Errorf("unexpected span size %d; want %d", n, len(ip))
+	}
+
+	commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
+	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesFetched, sf.gr.layerSha, int64(n))       // record total bytes fetched
+	sf.gr.setLastReadTime(time.Now())
+
+	for i, c := range span {
+		cp := ip[c.offset-chunkOffset : c.offset-chunkOffset+c.size]
+		if err := sf.verify(sf.id, cp, c.digest); err != nil {
+			if i == 0 {
+				return false, fmt.Errorf("invalid chunk: %w", err)
+			}
+			// Following chunks aren't requested. Leave them to be fetched on demand.
+			log.L.WithError(err).Debugf("chunk at %d of file %d in the span isn't verified", c.offset, sf.id)
+			break
+		}
+		sf.gr.cacheChunk(genID(sf.id, c.offset, c.size), c.digest, cp)
+	}
+	copy(p, ip[lowerDiscard:chunkSize])
+	return true, nil
+}
+
+// cacheChunk adds the verified chunk to the cache.
+func (gr *reader) cacheChunk(key, chunkDigestStr string, p []byte, opts ...cache.Option) error {
+	w, err := gr.cache.Add(key, opts...)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if cn, err := w.Write(p); err != nil || cn != len(p) {
+		w.Abort()
+		return fmt.Errorf("failed to write chunk to the cache (%d/%d bytes): %v", cn, len(p), err)
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+	if gr.verify {
+		gr.addToIndex(chunkDigestStr, key)
+	}
+	return nil
+}
+
+// readFromIndex reads the chunk to p from caches of other layers containing the same
+// chunk. Contents are checked against the digest. This is done only for verified layers
+// because the digest must be trustworthy.
+func (gr *reader) readFromIndex(p []byte, chunkDigestStr string) bool {
+	if gr.index == nil || !gr.verify {
+		return false
+	}
+	dgst, err := digest.Parse(chunkDigestStr)
+	if err != nil {
+		return false
+	}
+	for _, loc := range gr.index.lookup(dgst, gr) {
+		r, err := loc.gr.cache.Get(loc.key)
+		if err != nil {
+			continue
+		}
+		n, err := r.ReadAt(p, 0)
+		r.Close()
+		if (err == nil || err == io.EOF) && n == len(p) && dgst.Algorithm().FromBytes(p) == dgst {
+			commonmetrics.AddBytesCount(commonmetrics.SharedChunkBytesServed, gr.layerSha, int64(n))
+			return true
+		}
+	}
+	return false
+}
+
+func (gr *reader) addToIndex(chunkDigestStr, key string) {
+	if gr.index == nil {
+		return
+	}
+	if dgst, err := digest.Parse(chunkDigestStr); err == nil {
+		gr.index.add(dgst, gr, key)
+	}
+}
+
 func (sf *file) verify(id uint32, p []byte, chunkDigestStr string) error {
 	if !sf.gr.verify {
 		return nil // verification is not required
@@ -516,6 +928,15 @@ func genID(id uint32, offset, size int64) string {
 	return fmt.Sprintf("%x", sum)
 }
 
+// checkChunkSize fails on chunks that make no progress or that can't be buffered on
+// this platform (i.e. larger than the max int).
+func checkChunkSize(chunkSize int64) error {
+	if chunkSize <= 0 || int64(int(chunkSize)) != chunkSize {
+		return fmt.Errorf("invalid chunk size %d: %w", chunkSize, estargz.ErrOutOfBounds)
+	}
+	return nil
+}
+
 func positive(n int64) int64 {
 	if n < 0 {
 		return 0
@@ -526,9 +947,10 @@ func positive(n int64) int64 {
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
-	cacheOpts []cache.Option
-	filter    func(int64) bool
-	reader    *io.SectionReader
+	cacheOpts      []cache.Option
+	filter         func(int64) bool
+	reader         *io.SectionReader
+	tarHeaderCheck func(int64) error
 }
 
 func WithCacheOpts(cacheOpts ...cache.Option) CacheOption {
@@ -549,6 +971,14 @@ func WithReader(sr *io.SectionReader) CacheOption {
 	}
 }
 
+// WithTarHeaderCheck makes Cache call check with the offset of each regular file when its
+// first chunk is filled. The chunk fails if check returns an error.
+func WithTarHeaderCheck(check func(offset int64) error) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.tarHeaderCheck = check
+	}
+}
+
 func digestVerifier(id uint32, chunkDigestStr string) (digest.Verifier, error) {
 	chunkDigest, err := digest.Parse(chunkDigestStr)
 	if err != nil {
@@ -26,8 +26,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -54,6 +57,10 @@ func TestSuiteReader(t *testing.T, store metadata.Store) {
 	testFileReadAt(t, store)
 	testCacheVerify(t, store)
 	testFailReader(t, store)
+	testSharedChunks(t, store)
+	testStrictVerify(t, store)
+	testSpanChunks(t, store)
+	testTarHeaderCheck(t, store)
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -207,10 +214,14 @@ func (er *exceptFile) ChunkEntryForOffset(offset int64) (off int64, size int64,
 }
 
 func makeFile(t *testing.T, contents []byte, chunkSize int, factory metadata.Store) (*file, func() error) {
+	return makeFileWithOptions(t, contents, factory, []estargz.Option{estargz.WithChunkSize(chunkSize)})
+}
+
+func makeFileWithOptions(t *testing.T, contents []byte, factory metadata.Store, esgzOpts []estargz.Option, opts ...Option) (*file, func() error) {
 	testName := "test"
 	sr, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
 		testutil.File(testName, string(contents)),
-	}, testutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+	}, testutil.WithEStargzOptions(esgzOpts...))
 	if err != nil {
 		t.Fatalf("failed to build sample estargz")
 	}
@@ -218,7 +229,7 @@ func makeFile(t *testing.T, contents []byte, chunkSize int, factory metadata.Sto
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+	vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""), opts...)
 	if err != nil {
 		mr.Close()
 		t.Fatalf("failed to make new reader: %v", err)
@@ -553,3 +564,197 @@ type testChunkVerifier struct {
 func (bev *testChunkVerifier) verifier(id uint32, chunkDigest string) (digest.Verifier, error) {
 	return &testVerifier{bev.success}, nil
 }
+
+// testSharedChunks tests that a layer takes chunks from the cache of another layer built
+// with content-defined chunking.
+func testSharedChunks(t *testing.T, factory metadata.Store) {
+	const chunkSize = 256
+	orig := make([]byte, 64*chunkSize)
+	rand.New(rand.NewSource(1)).Read(orig)
+	modified := append(append(append([]byte{}, orig[:1000]...), []byte("inserted bytes")...), orig[1000:]...)
+	esgzOpts := []estargz.Option{estargz.WithChunkSize(chunkSize), estargz.WithContentDefinedChunking()}
+
+	idx := NewChunkIndex()
+	f1, closeFn1 := makeFileWithOptions(t, orig, factory, esgzOpts, WithChunkIndex(idx))
+	defer closeFn1()
+	if got, err := io.ReadAll(io.NewSectionReader(f1, 0, int64(len(orig)))); err != nil || !bytes.Equal(got, orig) {
+		t.Fatalf("failed to read the original file (err: %v)", err)
+	}
+
+	f2, closeFn2 := makeFileWithOptions(t, modified, factory, esgzOpts, WithChunkIndex(idx))
+	defer closeFn2()
+	cf := &countFile{File: f2.fr}
+	f2.fr = cf
+	if got, err := io.ReadAll(io.NewSectionReader(f2, 0, int64(len(modified)))); err != nil || !bytes.Equal(got, modified) {
+		t.Fatalf("failed to read the modified file (err: %v)", err)
+	}
+	if cf.n == 0 || cf.n > int64(len(modified))/4 {
+		t.Errorf("read %d bytes from the blob; want (0, %d]", cf.n, len(modified)/4)
+	}
+
+	// chunks of closed layers must not be used
+	closeFn1()
+	closeFn2()
+	f3, closeFn3 := makeFileWithOptions(t, orig, factory, esgzOpts, WithChunkIndex(idx))
+	defer closeFn3()
+	cf = &countFile{File: f3.fr}
+	f3.fr = cf
+	if got, err := io.ReadAll(io.NewSectionReader(f3, 0, int64(len(orig)))); err != nil || !bytes.Equal(got, orig) {
+		t.Fatalf("failed to read the file (err: %v)", err)
+	}
+	if cf.n <= int64(len(orig))/4 {
+		t.Errorf("read only %d bytes from the blob", cf.n)
+	}
+}
+
+func testStrictVerify(t *testing.T, factory metadata.Store) {
+	data := make([]byte, 8*sampleChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	esgzOpts := []estargz.Option{estargz.WithChunkSize(sampleChunkSize)}
+	for _, strict := range []bool{true, false} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			var opts []Option
+			if strict {
+				opts = append(opts, WithStrictVerify())
+			}
+			f, closeFn := makeFileWithOptions(t, data, factory, esgzOpts, opts...)
+			defer closeFn()
+			if got, err := io.ReadAll(io.NewSectionReader(f, 0, int64(len(data)))); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("failed to read the file (err: %v)", err)
+			}
+
+			// Corrupt all chunks in the cache
+			mc, ok := f.gr.cache.(*cache.MemoryCache)
+			if !ok {
+				t.Fatalf("unexpected cache type %T", f.gr.cache)
+			}
+			mc.Membuf = func() map[string]*bytes.Buffer {
+				m := make(map[string]*bytes.Buffer)
+				for k, b := range mc.Membuf {
+					c := append([]byte{}, b.Bytes()...)
+					c[0] ^= 0xff
+					m[k] = bytes.NewBuffer(c)
+				}
+				return m
+			}()
+
+			cf := &countFile{File: f.fr}
+			f.fr = cf
+			got, err := io.ReadAll(io.NewSectionReader(f, 0, int64(len(data))))
+			if err != nil {
+				t.Fatalf("failed to read the file: %v", err)
+			}
+			if strict {
+				if !bytes.Equal(got, data) {
+					t.Errorf("corrupted cache must not be served in strict mode")
+				}
+				if cf.n != int64(len(data)) {
+					t.Errorf("read %d bytes from the blob; want %d", cf.n, len(data))
+				}
+			} else if cf.n != 0 {
+				t.Errorf("cache must be used without strict mode; read %d bytes from the blob", cf.n)
+			}
+		})
+	}
+}
+
+func testSpanChunks(t *testing.T, factory metadata.Store) {
+	data := make([]byte, 8*sampleChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	esgzOpts := []estargz.Option{estargz.WithChunkSize(sampleChunkSize)}
+	f, closeFn := makeFileWithOptions(t, data, factory, esgzOpts, WithSpanChunks(3))
+	defer closeFn()
+	cf := &countFile{File: f.fr}
+	f.fr = cf
+
+	// Reading a part of the first chunk fetches the span of 3 chunks.
+	p := make([]byte, 2)
+	if _, err := f.ReadAt(p, 1); err != nil || !bytes.Equal(p, data[1:3]) {
+		t.Fatalf("failed to read the first chunk (err: %v)", err)
+	}
+	if want := int64(3 * sampleChunkSize); cf.n != want {
+		t.Fatalf("read %d bytes from the blob; want %d", cf.n, want)
+	}
+
+	// Following chunks in the span are served from the cache.
+	p = make([]byte, 2*sampleChunkSize)
+	if _, err := f.ReadAt(p, sampleChunkSize); err != nil || !bytes.Equal(p, data[sampleChunkSize:3*sampleChunkSize]) {
+		t.Fatalf("failed to read chunks in the span (err: %v)", err)
+	}
+	if want := int64(3 * sampleChunkSize); cf.n != want {
+		t.Fatalf("chunks in the span must be cached; read %d bytes from the blob", cf.n)
+	}
+
+	if got, err := io.ReadAll(io.NewSectionReader(f, 0, int64(len(data)))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("failed to read the file (err: %v)", err)
+	}
+	if want := int64(len(data)); cf.n != want {
+		t.Errorf("read %d bytes from the blob; want %d", cf.n, want)
+	}
+}
+
+func testTarHeaderCheck(t *testing.T, factory metadata.Store) {
+	sr, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("a", sampleData1+"a"),
+		testutil.File("b", sampleData1+"b"),
+	}, testutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize)))
+	if err != nil {
+		t.Fatalf("failed to build sample estargz")
+	}
+	mr, err := factory(sr)
+	if err != nil {
+		t.Fatalf("failed to prepare reader %v", err)
+	}
+	defer mr.Close()
+	vr, err := NewReader(mr, cache.NewMemoryCache(), digest.FromString(""))
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	vr.SkipVerify()
+	off2id, id2path, err := prepareMap(vr.Metadata(), vr.Metadata().RootID(), "")
+	if err != nil {
+		t.Fatalf("failed to prepare offset map %v", err)
+	}
+
+	// The header of each file is checked and the failure of "b" fails the chunk.
+	var (
+		checked   []string
+		checkedMu sync.Mutex
+	)
+	err = vr.Cache(WithTarHeaderCheck(func(offset int64) error {
+		name := id2path[off2id[offset]]
+		checkedMu.Lock()
+		checked = append(checked, name)
+		checkedMu.Unlock()
+		if name == "b" {
+			return fmt.Errorf("header of %q diverges", name)
+		}
+		return nil
+	}))
+	if err == nil || !strings.Contains(err.Error(), "diverges") {
+		t.Fatalf("the divergence must fail Cache(): %v", err)
+	}
+	sort.Strings(checked)
+	if want := []string{estargz.NoPrefetchLandmark, "a", "b"}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checked headers = %v; want %v", checked, want)
+	}
+	for id, name := range id2path {
+		if name != "b" {
+			continue
+		}
+		if _, err := vr.r.cache.Get(genID(id, 0, sampleChunkSize)); err == nil {
+			t.Errorf("the chunk failed the check must not be cached")
+		}
+	}
+}
+
+type countFile struct {
+	metadata.File
+	n int64
+}
+
+func (cf *countFile) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := cf.File.ReadAt(p, offset)
+	cf.n += int64(n)
+	return n, err
+}
@@ -24,6 +24,7 @@ package remote
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
@@ -32,9 +33,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/singleflight"
@@ -72,6 +75,27 @@ type blob struct {
 
 	resolver *Resolver
 
+	// maxResumes is the number of times an interrupted fetch is resumed from the
+	// chunks that haven't been fetched yet.
+	maxResumes int
+
+	// digest is used for verifying the fetched contents in a rolling manner.
+	// Empty digest disables the verification.
+	digest         digest.Digest
+	verifier       digest.Verifier
+	verifiedOffset int64
+	verifyErr      error
+	refetched      regionSet // chunks fetched again after verifyErr
+	verifyMu       sync.Mutex
+
+	// chunkVerifier verifies chunks while they are downloaded. nil disables this.
+	chunkVerifier   ChunkVerifier
+	chunkVerifierMu sync.Mutex
+
+	// onFetched is called with the size of each chunk fetched from the source and stored
+	// in the cache. nil disables this.
+	onFetched func(n int64)
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -94,11 +118,16 @@ func makeBlob(fetcher fetcher, size int64, chunkSize int64, prefetchChunkSize in
 
 func (b *blob) Close() error {
 	b.closedMu.Lock()
-	defer b.closedMu.Unlock()
 	if b.closed {
+		b.closedMu.Unlock()
 		return nil
 	}
 	b.closed = true
+	b.closedMu.Unlock()
+
+	// Chunks of this blob can't be fetched anymore. Offline.want doesn't record them once
+	// closed is set.
+	b.offline().forget(b)
 	return b.cache.Close()
 }
 
@@ -151,6 +180,7 @@ func (b *blob) Check() error {
 	fr := b.fetcher
 	b.fetcherMu.Unlock()
 	err := fr.check()
+	b.offline().observe(b, err)
 	if err == nil {
 		// update lastCheck only if check succeeded.
 		// on failure, we should check this layer next time again.
@@ -162,6 +192,44 @@ func (b *blob) Check() error {
 	return err
 }
 
+// Probe validates that the registry still serves this blob in the way lazy pulling
+// requires. This checks the connectivity (including the authorization) and fetches
+// the specified range bypassing the cache to make sure range requests are served.
+func (b *blob) Probe(ctx context.Context, offset int64, size int64) error {
+	if b.isClosed() {
+		return fmt.Errorf("blob is already closed")
+	}
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+	if err := fr.check(); err != nil {
+		return fmt.Errorf("connectivity check failed: %w", err)
+	}
+	if size <= 0 {
+		return nil
+	}
+	req := region{offset, offset + size - 1}
+	mr, err := fr.fetch(ctx, []region{req}, true)
+	if err != nil {
+		return fmt.Errorf("failed to fetch range %d-%d: %w", req.b, req.e, err)
+	}
+	defer mr.Close()
+	reg, p, err := mr.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read range %d-%d: %w", req.b, req.e, err)
+	}
+	if reg != req && reg.b == 0 && reg.e == b.size-1 {
+		return fmt.Errorf("range request isn't supported: got whole blob for range %d-%d", req.b, req.e)
+	}
+	if reg.b > req.b || reg.e < req.e {
+		return fmt.Errorf("unexpected range %d-%d; want %d-%d", reg.b, reg.e, req.b, req.e)
+	}
+	if _, err := io.Copy(io.Discard, p); err != nil {
+		return fmt.Errorf("failed to read range %d-%d: %w", req.b, req.e, err)
+	}
+	return nil
+}
+
 func (b *blob) Size() int64 {
 	return b.size
 }
@@ -173,6 +241,33 @@ func (b *blob) FetchedSize() int64 {
 	return sz
 }
 
+// Region is a range of a blob.
+type Region struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// FetchedRegions returns the sorted list of non-overlapping regions of the blob that
+// have been fetched so far.
+func (b *blob) FetchedRegions() []Region {
+	b.fetchedRegionSetMu.Lock()
+	defer b.fetchedRegionSetMu.Unlock()
+	res := make([]Region, len(b.fetchedRegionSet.rs))
+	for i, reg := range b.fetchedRegionSet.rs {
+		res[i] = Region{reg.b, reg.size()}
+	}
+	return res
+}
+
+// SetChunkVerifier makes the blob verify contents of chunks while they are downloaded,
+// before they are stored in the cache. A fetch is aborted as soon as a mismatching
+// chunk is found.
+func (b *blob) SetChunkVerifier(v ChunkVerifier) {
+	b.chunkVerifierMu.Lock()
+	b.chunkVerifier = v
+	b.chunkVerifierMu.Unlock()
+}
+
 func makeSyncKey(allData map[region]io.Writer) string {
 	keys := make([]string, len(allData))
 	keysIndex := 0
@@ -294,6 +389,11 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 	if err := b.fetchRange(allData, &readAtOpts); err != nil {
 		return 0, err
 	}
+	if readAtOpts.fetched != nil {
+		for reg := range allData {
+			*readAtOpts.fetched += reg.size()
+		}
+	}
 
 	// Adjust the buffer size according to the blob size
 	if remain := b.size - offset; int64(len(p)) >= remain {
@@ -331,10 +431,63 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 	if opts.ctx != nil {
 		fetchCtx = opts.ctx
 	}
+
+	var mismatches int
+	for i := 0; ; i++ {
+		progressed, err := b.fetchRegionsOnce(fetchCtx, fr, req, allData, fetched, opts)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrChunkDigestMismatch) {
+			// The transfer was corrupted. Retry it even if nothing has been fetched
+			// because it can be a transient failure of the network path.
+			if debugStatsEnabled() {
+				chunkMismatchCount.Add(1)
+			}
+			log.G(fetchCtx).WithError(err).Warnf("fetched chunk of %v is corrupted", b.digest)
+			if mismatches >= maxChunkMismatchRetries || fetchCtx.Err() != nil {
+				return err
+			}
+			mismatches++
+		} else if !progressed || i >= b.maxResumes || fetchCtx.Err() != nil {
+			// The fetch was interrupted. Resume it only for the remaining chunks
+			// instead of restarting from scratch.
+			return err
+		}
+		req = req[:0]
+		for reg := range allData {
+			if !fetched[reg] {
+				if rw, ok := allData[reg].(interface{ reset() }); ok {
+					rw.reset()
+				}
+				req = append(req, reg)
+			}
+		}
+		if len(req) == 0 {
+			break
+		}
+		log.G(fetchCtx).WithError(err).Infof("resuming interrupted fetch of %d chunks (%d/%d)", len(req), i+1, b.maxResumes)
+	}
+
+	fetchedRegions := make([]region, 0, len(fetched))
+	for reg := range fetched {
+		fetchedRegions = append(fetchedRegions, reg)
+	}
+	return b.verifyFetched(fr, fetchedRegions, opts)
+}
+
+// fetchRegionsOnce requests the specified regions and puts the responded chunks in the
+// local cache. progressed reports whether at least one chunk is fetched.
+func (b *blob) fetchRegionsOnce(fetchCtx context.Context, fr fetcher, req []region, allData map[region]io.Writer, fetched map[region]bool, opts *options) (progressed bool, _ error) {
+	if debugStatsEnabled() {
+		done := activeFetches.add(b.digest.String(), req)
+		defer done()
+		fetchCount.Add(1)
+	}
 	mr, err := fr.fetch(fetchCtx, req, true)
 
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer mr.Close()
 
@@ -343,6 +496,10 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 	b.lastCheck = time.Now()
 	b.lastCheckMu.Unlock()
 
+	b.chunkVerifierMu.Lock()
+	cv := b.chunkVerifier
+	b.chunkVerifierMu.Unlock()
+
 	// chunk and cache responsed data. Regions must be aligned by chunk size.
 	// TODO: Reorganize remoteData to make it be aligned by chunk size
 	for {
@@ -350,15 +507,18 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return fmt.Errorf("failed to read multipart resp: %w", err)
+			return progressed, fmt.Errorf("failed to read multipart resp: %w", err)
 		}
-		if err := b.walkChunks(reg, func(chunk region) (retErr error) {
+		// Chunks overlapping with spans being verified are held until the spans are
+		// verified so that corrupted contents never reach the cache.
+		sv := newSpanVerifier(cv, reg)
+		var pending []pendingChunk
+		err = b.walkChunks(reg, func(chunk region) error {
 			id := fr.genID(chunk)
 			cw, err := b.cache.Add(id, opts.cacheOpts...)
 			if err != nil {
 				return err
 			}
-			defer cw.Close()
 			w := io.Writer(cw)
 
 			// If this chunk is one of the targets, write the content to the
@@ -366,25 +526,46 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 			if _, ok := fetched[chunk]; ok {
 				w = io.MultiWriter(w, allData[chunk])
 			}
+			if sv != nil {
+				w = io.MultiWriter(w, sv)
+			}
 
 			// Copy the target chunk
 			if _, err := io.CopyN(w, p, chunk.size()); err != nil {
 				cw.Abort()
+				cw.Close()
 				return err
 			}
+			pending = append(pending, pendingChunk{chunk, cw})
 
-			// Add the target chunk to the cache
-			if err := cw.Commit(); err != nil {
-				return err
+			// Add the verified chunks to the cache
+			n := 0
+			for ; n < len(pending) && pending[n].e < sv.pendingOffset(); n++ {
+				if err := pending[n].commit(); err != nil {
+					pending = pending[n+1:]
+					return err
+				}
+				b.fetchedRegionSetMu.Lock()
+				b.fetchedRegionSet.add(pending[n].region)
+				b.fetchedRegionSetMu.Unlock()
+				if debugStatsEnabled() {
+					fetchedBytes.Add(pending[n].size())
+				}
+				if b.onFetched != nil {
+					b.onFetched(pending[n].size())
+				}
+				fetched[pending[n].region] = true
+				progressed = true
 			}
-
-			b.fetchedRegionSetMu.Lock()
-			b.fetchedRegionSet.add(chunk)
-			b.fetchedRegionSetMu.Unlock()
-			fetched[chunk] = true
+			pending = pending[n:]
 			return nil
-		}); err != nil {
-			return fmt.Errorf("failed to get chunks: %w", err)
+		})
+		for _, c := range pending {
+			c.cw.Abort()
+			c.cw.Close()
+		}
+		if err != nil {
+			return progressed, fmt.Errorf("failed to get chunks: %w", err)
 		}
 	}
 
@@ -396,9 +577,73 @@ func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]boo
 		}
 	}
 	if unfetched != nil {
-		return fmt.Errorf("failed to fetch region %v", unfetched)
+		return progressed, fmt.Errorf("failed to fetch region %v", unfetched)
 	}
 
+	return progressed, nil
+}
+
+// pendingChunk is a fetched chunk waiting for being added to the cache.
+type pendingChunk struct {
+	region
+	cw cache.Writer
+}
+
+func (c pendingChunk) commit() error {
+	defer c.cw.Close()
+	return c.cw.Commit()
+}
+
+// verifyFetched feeds the chunks contiguously fetched from the head of the blob to the
+// rolling verifier. Once the whole blob is fed, the digest of the blob is checked so
+// corrupted contents are detected without re-reading the whole blob at once. fetched
+// are the chunks just fetched from the registry. After a mismatch, the blob is verified
+// again from the head once all chunks have been fetched again.
+func (b *blob) verifyFetched(fr fetcher, fetched []region, opts *options) error {
+	if b.digest == "" || !b.digest.Algorithm().Available() {
+		return nil
+	}
+	b.verifyMu.Lock()
+	defer b.verifyMu.Unlock()
+	if b.verifyErr != nil {
+		for _, reg := range fetched {
+			b.refetched.add(reg)
+		}
+		if b.refetched.totalSize() < b.size {
+			return b.verifyErr
+		}
+		b.verifier, b.verifiedOffset, b.verifyErr, b.refetched = nil, 0, nil, regionSet{}
+	}
+	if b.verifier == nil {
+		b.verifier = b.digest.Verifier()
+	}
+	if b.verifiedOffset >= b.size {
+		return nil
+	}
+	buf := make([]byte, b.chunkSize)
+	for b.verifiedOffset < b.size {
+		chunk := region{b.verifiedOffset, b.verifiedOffset + b.chunkSize - 1}
+		if chunk.e >= b.size {
+			chunk.e = b.size - 1
+		}
+		r, err := b.cache.Get(fr.genID(chunk), opts.cacheOpts...)
+		if err != nil {
+			return nil // not fetched yet. try it next time.
+		}
+		n, err := io.ReadFull(io.NewSectionReader(r, 0, chunk.size()), buf[:chunk.size()])
+		r.Close()
+		if err != nil || int64(n) != chunk.size() {
+			return nil // try it next time.
+		}
+		if _, err := b.verifier.Write(buf[:n]); err != nil {
+			return err
+		}
+		b.verifiedOffset = chunk.e + 1
+	}
+	if !b.verifier.Verified() {
+		b.verifyErr = fmt.Errorf("fetched contents of the blob don't match to the digest %v", b.digest)
+		return b.verifyErr
+	}
 	return nil
 }
 
@@ -408,14 +653,28 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 		return nil
 	}
 
+	// Chunks that aren't cached can't be fetched while offline. They are fetched once
+	// going back online.
+	o := b.offline()
+	if o.isOffline() {
+		o.want(b, allData)
+		return fmt.Errorf("%d chunks of %v: %w", len(allData), b.digest, ErrOffline)
+	}
+
 	// We build a key based on regions we need to fetch and pass it to singleflightGroup.Do(...)
 	// to block simultaneous same requests. Once the request is finished and the data is ready,
 	// all blocked callers will be unblocked and that same data will be returned by all blocked callers.
 	key := makeSyncKey(allData)
 	fetched := make(map[region]bool)
 	_, err, shared := b.fetchedRegionGroup.Do(key, func() (interface{}, error) {
-		return nil, b.fetchRegions(allData, fetched, opts)
+		err := b.fetchRegions(allData, fetched, opts)
+		o.observe(b, err)
+		return nil, err
 	})
+	if err != nil && o.isOffline() {
+		o.want(b, allData)
+		return fmt.Errorf("%w: %v", ErrOffline, err)
+	}
 
 	// When unblocked try to read from cache in case if there were no errors
 	// If we fail reading from cache, fetch from remote registry again
@@ -460,6 +719,14 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 	return err
 }
 
+// offline returns the offline mode of the resolver of this blob, which can be nil.
+func (b *blob) offline() *Offline {
+	if b.resolver == nil {
+		return nil
+	}
+	return b.resolver.offline
+}
+
 type walkFunc func(reg region) error
 
 // walkChunks walks chunks from begin to end in order in the specified region.
@@ -519,6 +786,10 @@ func (bw *bytesWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+func (bw *bytesWriter) reset() {
+	bw.current = 0
+}
+
 func floor(n int64, unit int64) int64 {
 	return (n / unit) * unit
 }
@@ -24,6 +24,7 @@ package remote
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -39,6 +40,7 @@ import (
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/cache"
+	digest "github.com/opencontainers/go-digest"
 )
 
 const (
@@ -579,6 +581,188 @@ func makeTestBlob(t *testing.T, size int64, chunkSize int64, prefetchChunkSize i
 		time.Duration(defaultFetchTimeoutSec)*time.Second)
 }
 
+func TestResumeFetch(t *testing.T) {
+	contents := []byte(sampleData1)
+	tests := []struct {
+		name    string
+		digest  digest.Digest
+		wantErr bool
+	}{
+		{
+			name:   "valid-digest",
+			digest: digest.FromBytes(contents),
+		},
+		{
+			name:    "invalid-digest",
+			digest:  digest.FromString("dummy"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int64
+			broken := brokenBodyRoundTripper(t, contents, true)
+			normal := multiRoundTripper(t, contents)
+			b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					// The first response is interrupted in the middle of the body
+					if atomic.AddInt64(&calls, 1) == 1 {
+						return broken(req)
+					}
+					return normal(req)
+				})
+			b.maxResumes = 1
+			b.digest = tt.digest
+			p := make([]byte, len(contents))
+			_, err := b.ReadAt(p, 0)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("reading contents with invalid digest must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if !bytes.Equal(p, contents) {
+				t.Errorf("unexpected contents %q; want %q", string(p), sampleData1)
+			}
+			if calls != 2 {
+				t.Errorf("unexpected number of requests %d; want 2", calls)
+			}
+			if b.verifiedOffset != int64(len(contents)) {
+				t.Errorf("unexpected verified offset %d; want %d", b.verifiedOffset, len(contents))
+			}
+		})
+	}
+}
+
+func TestVerifyFetchedRecovers(t *testing.T) {
+	contents := []byte(sampleData1)
+	corrupted := append([]byte{}, contents...)
+	corrupted[5] = 'x'
+	var calls int64
+	broken, normal := multiRoundTripper(t, corrupted), multiRoundTripper(t, contents)
+	b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize,
+		func(req *http.Request) *http.Response {
+			if atomic.AddInt64(&calls, 1) == 1 {
+				return broken(req)
+			}
+			return normal(req)
+		})
+	b.digest = digest.FromBytes(contents)
+	p := make([]byte, len(contents))
+	if _, err := b.ReadAt(p, 0); err == nil {
+		t.Fatalf("reading corrupted contents must fail")
+	}
+
+	// The mismatch is reported until all chunks are fetched again.
+	b.cache = cache.NewMemoryCache()
+	if _, err := b.ReadAt(p[:sampleChunkSize], 0); err == nil {
+		t.Fatalf("mismatch must be reported until the whole blob is fetched again")
+	}
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("mismatch must be cleared after the whole blob is fetched again: %v", err)
+	}
+	if !bytes.Equal(p, contents) {
+		t.Errorf("unexpected contents %q; want %q", string(p), string(contents))
+	}
+}
+
+func TestChunkVerifier(t *testing.T) {
+	contents := []byte(sampleData1)
+	corrupted := append([]byte{}, contents...)
+	corrupted[5] = 'x'
+	tests := []struct {
+		name       string
+		corruptFor int64
+		wantErr    bool
+		wantCalls  int64
+	}{
+		{
+			name:      "valid",
+			wantCalls: 1,
+		},
+		{
+			name:       "corrupted-once",
+			corruptFor: 1,
+			wantCalls:  2,
+		},
+		{
+			name:       "always-corrupted",
+			corruptFor: maxChunkMismatchRetries + 1,
+			wantErr:    true,
+			wantCalls:  maxChunkMismatchRetries + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int64
+			broken := multiRoundTripper(t, corrupted)
+			normal := multiRoundTripper(t, contents)
+			b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize,
+				func(req *http.Request) *http.Response {
+					if atomic.AddInt64(&calls, 1) <= tt.corruptFor {
+						return broken(req)
+					}
+					return normal(req)
+				})
+			// Spans aren't aligned to the chunks of the blob.
+			b.SetChunkVerifier(&testChunkVerifier{contents, []Region{{0, 4}, {4, 4}, {8, 2}}})
+			p := make([]byte, len(contents))
+			_, err := b.ReadAt(p, 0)
+			if calls != tt.wantCalls {
+				t.Errorf("unexpected number of requests %d; want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrChunkDigestMismatch) {
+					t.Fatalf("reading corrupted contents must fail with mismatch but got %v", err)
+				}
+				if !strings.Contains(err.Error(), "bytes 4-7 ") {
+					t.Errorf("error must tell the mismatched range: %v", err)
+				}
+				// Chunks preceding the corrupted span are stored but others must not.
+				if _, err := b.cache.Get(b.fetcher.genID(region{0, 2})); err != nil {
+					t.Errorf("verified chunk must be cached: %v", err)
+				}
+				for _, reg := range []region{{3, 5}, {6, 8}, {9, 9}} {
+					if _, err := b.cache.Get(b.fetcher.genID(reg)); err == nil {
+						t.Errorf("chunk %v must not be cached", reg)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if !bytes.Equal(p, contents) {
+				t.Errorf("unexpected contents %q; want %q", string(p), sampleData1)
+			}
+		})
+	}
+}
+
+type testChunkVerifier struct {
+	contents []byte
+	spans    []Region
+}
+
+func (v *testChunkVerifier) Spans(offset int64, size int64) (res []Region) {
+	for _, s := range v.spans {
+		if offset <= s.Offset && s.Offset+s.Size <= offset+size {
+			res = append(res, s)
+		}
+	}
+	return
+}
+
+func (v *testChunkVerifier) Verify(s Region, p []byte) error {
+	if !bytes.Equal(p, v.contents[s.Offset:s.Offset+s.Size]) {
+		return fmt.Errorf("%w: %q", ErrChunkDigestMismatch, string(p))
+	}
+	return nil
+}
+
 func TestCheckInterval(t *testing.T) {
 	var (
 		tr        = &calledRoundTripper{}
@@ -862,3 +1046,28 @@ func parseRangeString(t *testing.T, rangeString string) (int64, int64) {
 	}
 	return begin, end
 }
+
+func TestDebugStats(t *testing.T) {
+	contents := []byte(sampleData1)
+	read := func() {
+		b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize, multiRoundTripper(t, contents))
+		p := make([]byte, sampleChunkSize)
+		if _, err := b.ReadAt(p, 0); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	}
+
+	// Statistics aren't collected unless the debug endpoint is served.
+	count, fetched := fetchCount.Value(), fetchedBytes.Value()
+	read()
+	if fetchCount.Value() != count || fetchedBytes.Value() != fetched {
+		t.Errorf("statistics are collected while disabled")
+	}
+
+	EnableDebugStats()
+	read()
+	if fetchCount.Value() != count+1 || fetchedBytes.Value() != fetched+sampleChunkSize {
+		t.Errorf("fetched %d times, %d bytes; want 1 time, %d bytes",
+			fetchCount.Value()-count, fetchedBytes.Value()-fetched, sampleChunkSize)
+	}
+}
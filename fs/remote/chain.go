@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+)
+
+const (
+	sourceTypeHandler = "handler"
+	sourceTypeMirror  = "mirror"
+	sourceTypeOrigin  = "origin"
+
+	// sourceRetryInterval is the interval to retry resolving a source that failed.
+	sourceRetryInterval = 30 * time.Second
+)
+
+// Statistics of fetches from each source of the source chain exposed via expvar.
+var (
+	sourceFetchCount = expvar.NewMap("stargz_remote_source_fetch_count")
+	sourceErrorCount = expvar.NewMap("stargz_remote_source_error_count")
+	sourceSkipCount  = expvar.NewMap("stargz_remote_source_skip_count")
+)
+
+// errSourceDisabled is returned when all sources are disabled at that time.
+var errSourceDisabled = errors.New("source is disabled at this time")
+
+// chainFetcher fetches contents from the first available source in the chain.
+type chainFetcher struct {
+	sources []*chainSource
+	digest  digest.Digest
+	size    int64
+	now     func() time.Time
+}
+
+type chainSource struct {
+	name     string
+	timeout  time.Duration
+	disabled hourRange
+	resolve  func(ctx context.Context) (fetcher, int64, error)
+
+	mu         sync.Mutex
+	f          fetcher
+	err        error
+	resolvedAt time.Time
+}
+
+// newChainFetcher returns a fetcher trying the sources configured by SourceChain in
+// order. The first available source is resolved here to know the blob size and others
+// are resolved when they are needed.
+func (r *Resolver) newChainFetcher(ctx context.Context, fc *fetcherConfig) (fetcher, int64, error) {
+	cf := &chainFetcher{digest: fc.desc.Digest, now: time.Now}
+	for i, sc := range r.blobConfig.SourceChain {
+		s, err := r.newChainSource(fc, sc)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid source #%d in source chain: %w", i, err)
+		}
+		cf.sources = append(cf.sources, s)
+	}
+	var allErr error = errSourceDisabled
+	for _, s := range cf.sources {
+		if !s.enabled(cf.now()) {
+			continue
+		}
+		_, size, err := s.get(ctx)
+		if err != nil {
+			allErr = fmt.Errorf("source %q: %v: %w", s.name, err, allErr)
+			continue
+		}
+		cf.size = size
+		return cf, size, nil
+	}
+	return nil, 0, fmt.Errorf("cannot resolve layer from any source: %w", allErr)
+}
+
+func (r *Resolver) newChainSource(fc *fetcherConfig, sc config.SourceConfig) (*chainSource, error) {
+	disabled, err := parseHourRange(sc.DisabledHours)
+	if err != nil {
+		return nil, err
+	}
+	s := &chainSource{
+		name:     sc.Type,
+		timeout:  time.Duration(sc.TimeoutMSec) * time.Millisecond,
+		disabled: disabled,
+	}
+	switch sc.Type {
+	case sourceTypeHandler:
+		if sc.Name != "" {
+			s.name += ":" + sc.Name
+		}
+		s.resolve = func(ctx context.Context) (fetcher, int64, error) {
+			return r.resolveByHandlers(ctx, fc, sc.Name)
+		}
+	case sourceTypeMirror, sourceTypeOrigin:
+		origin := sc.Type == sourceTypeOrigin
+		hfc := *fc
+		hfc.hosts = func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+			hosts, err := fc.hosts(refspec)
+			if err != nil {
+				return nil, err
+			}
+			var res []docker.RegistryHost
+			for _, h := range hosts {
+				if isOriginHost(h, refspec) == origin {
+					res = append(res, h)
+				}
+			}
+			if len(res) == 0 {
+				return nil, fmt.Errorf("no %s host is configured for %q", sc.Type, refspec.Hostname())
+			}
+			return res, nil
+		}
+		s.resolve = func(ctx context.Context) (fetcher, int64, error) {
+			return r.resolveByRegistries(ctx, &hfc)
+		}
+	default:
+		return nil, fmt.Errorf("unknown source type %q", sc.Type)
+	}
+	return s, nil
+}
+
+// isOriginHost returns true if the host is the registry of the reference, not a mirror.
+func isOriginHost(host docker.RegistryHost, refspec reference.Spec) bool {
+	if refspec.Hostname() == "docker.io" && host.Host == "registry-1.docker.io" {
+		return true
+	}
+	return host.Host == refspec.Hostname()
+}
+
+func (s *chainSource) enabled(now time.Time) bool {
+	return !s.disabled.contains(now.Hour())
+}
+
+// get returns the fetcher of this source. A failure of resolving is remembered for
+// sourceRetryInterval so that a broken source doesn't slow down every fetch.
+func (s *chainSource) get(ctx context.Context) (fetcher, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f != nil {
+		return s.f, 0, nil
+	}
+	if s.err != nil && time.Since(s.resolvedAt) < sourceRetryInterval {
+		return nil, 0, s.err
+	}
+	f, size, err := s.resolve(ctx)
+	s.resolvedAt = time.Now()
+	if err != nil {
+		s.err = err
+		return nil, 0, err
+	}
+	s.f, s.err = f, nil
+	return f, size, nil
+}
+
+func (cf *chainFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	var allErr error = errSourceDisabled
+	for _, s := range cf.sources {
+		if !s.enabled(cf.now()) {
+			sourceSkipCount.Add(s.name, 1)
+			continue
+		}
+		mr, err := cf.fetchFrom(ctx, s, rs, retry)
+		if err != nil {
+			sourceErrorCount.Add(s.name, 1)
+			log.G(ctx).WithError(err).WithField("source", s.name).WithField("digest", cf.digest).
+				Debug("falling back to the next source")
+			allErr = fmt.Errorf("source %q: %v: %w", s.name, err, allErr)
+			continue
+		}
+		sourceFetchCount.Add(s.name, 1)
+		return mr, nil
+	}
+	return nil, fmt.Errorf("failed to fetch from any source: %w", allErr)
+}
+
+func (cf *chainFetcher) fetchFrom(ctx context.Context, s *chainSource, rs []region, retry bool) (multipartReadCloser, error) {
+	f, size, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if size != 0 && size != cf.size {
+		s.mu.Lock()
+		s.f, s.err, s.resolvedAt = nil, fmt.Errorf("blob size %d differs from %d", size, cf.size), time.Now()
+		s.mu.Unlock()
+		return nil, fmt.Errorf("blob size %d differs from %d: %w", size, cf.size, ErrBlobSizeMismatch)
+	}
+	if s.timeout <= 0 {
+		return f.fetch(ctx, rs, retry)
+	}
+	// The timeout limits the time until the source starts responding. Reading the
+	// response isn't limited because it can take long for large regions.
+	fCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(s.timeout, cancel)
+	mr, err := f.fetch(fCtx, rs, retry)
+	if !timer.Stop() && err != nil {
+		err = fmt.Errorf("no response in %v: %w", s.timeout, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &cancelOnClose{mr, cancel}, nil
+}
+
+func (cf *chainFetcher) check() error {
+	var allErr error = errSourceDisabled
+	for _, s := range cf.sources {
+		if !s.enabled(cf.now()) {
+			continue
+		}
+		f, _, err := s.get(context.Background())
+		if err == nil {
+			if err = f.check(); err == nil {
+				return nil
+			}
+		}
+		allErr = fmt.Errorf("source %q: %v: %w", s.name, err, allErr)
+	}
+	return allErr
+}
+
+// genID doesn't depend on the source so that contents cached from a source can be used
+// regardless of the source serving following fetches.
+func (cf *chainFetcher) genID(reg region) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", cf.digest, reg.b, reg.e)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type cancelOnClose struct {
+	multipartReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.multipartReadCloser.Close()
+}
+
+// hourRange is a range of hours [start, end) that can wrap around midnight. The zero
+// value contains no hour.
+type hourRange struct {
+	start, end int
+}
+
+// parseHourRange parses "<start>-<end>". Empty string means the empty range.
+func parseHourRange(s string) (hourRange, error) {
+	if s == "" {
+		return hourRange{}, nil
+	}
+	startS, endS := s, ""
+	if i := strings.Index(s, "-"); i >= 0 {
+		startS, endS = s[:i], s[i+1:]
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(startS))
+	if err != nil || start < 0 || start > 23 {
+		return hourRange{}, fmt.Errorf("invalid start hour in %q", s)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(endS))
+	if err != nil || end < 0 || end > 24 {
+		return hourRange{}, fmt.Errorf("invalid end hour in %q", s)
+	}
+	return hourRange{start, end}, nil
+}
+
+func (r hourRange) contains(hour int) bool {
+	if r.start <= r.end {
+		return r.start <= hour && hour < r.end
+	}
+	return hour >= r.start || hour < r.end
+}
@@ -0,0 +1,207 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type errFetcher struct{ err error }
+
+func (f errFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	return nil, f.err
+}
+func (f errFetcher) check() error            { return f.err }
+func (f errFetcher) genID(reg region) string { return "" }
+
+// hangFetcher doesn't respond until the context is cancelled.
+type hangFetcher struct{}
+
+func (hangFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+func (hangFetcher) check() error            { return nil }
+func (hangFetcher) genID(reg region) string { return "" }
+
+func TestChainFetcher(t *testing.T) {
+	contents := []byte("0123456789")
+	errBroken := errors.New("broken")
+	source := func(name string, f fetcher) *chainSource {
+		return &chainSource{
+			name: name,
+			resolve: func(context.Context) (fetcher, int64, error) {
+				return f, int64(len(contents)), nil
+			},
+		}
+	}
+	at := func(hour int) func() time.Time {
+		return func() time.Time { return time.Date(2022, 1, 1, hour, 30, 0, 0, time.Local) }
+	}
+	tests := []struct {
+		name     string
+		sources  []*chainSource
+		now      func() time.Time
+		wantErr  bool
+		wantFrom string
+	}{
+		{
+			name:     "first",
+			sources:  []*chainSource{source("a", bytesFetcher(contents)), source("b", errFetcher{errBroken})},
+			wantFrom: "a",
+		},
+		{
+			name:     "fallback_on_error",
+			sources:  []*chainSource{source("a", errFetcher{errBroken}), source("b", bytesFetcher(contents))},
+			wantFrom: "b",
+		},
+		{
+			name: "fallback_on_timeout",
+			sources: []*chainSource{
+				func() *chainSource {
+					s := source("a", hangFetcher{})
+					s.timeout = 10 * time.Millisecond
+					return s
+				}(),
+				source("b", bytesFetcher(contents)),
+			},
+			wantFrom: "b",
+		},
+		{
+			name: "skip_disabled",
+			sources: []*chainSource{
+				func() *chainSource {
+					s := source("a", errFetcher{errBroken})
+					s.disabled = hourRange{9, 17}
+					return s
+				}(),
+				source("b", bytesFetcher(contents)),
+			},
+			now:      at(10),
+			wantFrom: "b",
+		},
+		{
+			name: "all_disabled",
+			sources: []*chainSource{
+				func() *chainSource {
+					s := source("a", bytesFetcher(contents))
+					s.disabled = hourRange{22, 6}
+					return s
+				}(),
+			},
+			now:     at(23),
+			wantErr: true,
+		},
+		{
+			name: "out_of_disabled_hours",
+			sources: []*chainSource{
+				func() *chainSource {
+					s := source("a", bytesFetcher(contents))
+					s.disabled = hourRange{22, 6}
+					return s
+				}(),
+			},
+			now:      at(12),
+			wantFrom: "a",
+		},
+		{
+			name:    "all_failed",
+			sources: []*chainSource{source("a", errFetcher{errBroken}), source("b", errFetcher{errBroken})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf := &chainFetcher{sources: tt.sources, size: int64(len(contents)), now: time.Now}
+			if tt.now != nil {
+				cf.now = tt.now
+			}
+			before := make(map[string]int64)
+			for _, s := range tt.sources {
+				before[s.name] = fetchCountOf(s.name)
+			}
+			mr, err := cf.fetch(context.Background(), []region{{0, int64(len(contents)) - 1}}, false)
+			if tt.wantErr {
+				if err == nil {
+					mr.Close()
+					t.Fatalf("fetch must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			defer mr.Close()
+			_, r, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to get part: %v", err)
+			}
+			if got, err := io.ReadAll(r); err != nil || string(got) != string(contents) {
+				t.Fatalf("read %q (err: %v); want %q", got, err, contents)
+			}
+			for _, s := range tt.sources {
+				want := before[s.name]
+				if s.name == tt.wantFrom {
+					want++
+				}
+				if got := fetchCountOf(s.name); got != want {
+					t.Errorf("fetch count of %q = %d; want %d", s.name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func fetchCountOf(name string) int64 {
+	v := sourceFetchCount.Get(name)
+	if v == nil {
+		return 0
+	}
+	return v.(interface{ Value() int64 }).Value()
+}
+
+func TestParseHourRange(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    hourRange
+		wantErr bool
+	}{
+		{in: "", want: hourRange{}},
+		{in: "9-17", want: hourRange{9, 17}},
+		{in: "22-6", want: hourRange{22, 6}},
+		{in: "0-24", want: hourRange{0, 24}},
+		{in: "9", wantErr: true},
+		{in: "24-1", wantErr: true},
+		{in: "a-b", wantErr: true},
+	} {
+		got, err := parseHourRange(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseHourRange(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseHourRange(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+	if (hourRange{}).contains(0) {
+		t.Errorf("empty range must contain no hour")
+	}
+}
@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// containerdFetcher fetches blob contents through containerd's remotes.Fetcher. This
+// shares the behaviour of pulling with containerd (e.g. mirrors, redirection, auth and
+// the handling of registry quirks) instead of using the fetcher implemented in this
+// package.
+//
+// Each fetch is served by seeking the reader returned by remotes.Fetcher so only
+// contiguous ranges are fetched per request and multi-range requests aren't used.
+type containerdFetcher struct {
+	f    remotes.Fetcher
+	desc ocispec.Descriptor
+}
+
+func newContainerdFetcher(ctx context.Context, fc *fetcherConfig) (*containerdFetcher, int64, error) {
+	desc := fc.desc
+	if desc.Digest.String() == "" {
+		return nil, 0, fmt.Errorf("Digest is mandatory in layer descriptor")
+	}
+	if desc.Size <= 0 {
+		// remotes.Fetcher relies on the size in the descriptor for seeking.
+		return nil, 0, fmt.Errorf("size of layer %q is unknown", desc.Digest)
+	}
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return fc.hosts(fc.refspec)
+		},
+	})
+	f, err := resolver.Fetcher(ctx, fc.refspec.String())
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get fetcher of %q: %w", fc.refspec, err)
+	}
+	return &containerdFetcher{f: f, desc: desc}, desc.Size, nil
+}
+
+func (f *containerdFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	var s regionSet
+	for _, reg := range rs {
+		s.add(reg)
+	}
+	reg := superRegion(s.rs)
+	rc, err := f.open(ctx, reg)
+	if err != nil {
+		return nil, err
+	}
+	return newSinglePartReader(reg, rc), nil
+}
+
+func (f *containerdFetcher) open(ctx context.Context, reg region) (io.ReadCloser, error) {
+	rc, err := f.f.Fetch(ctx, f.desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %w", f.desc.Digest, err)
+	}
+	if reg.b > 0 {
+		s, ok := rc.(io.Seeker)
+		if !ok {
+			rc.Close()
+			return nil, fmt.Errorf("fetcher of %q doesn't support seeking", f.desc.Digest)
+		}
+		if _, err := s.Seek(reg.b, io.SeekStart); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("failed to seek %q to %d: %w", f.desc.Digest, reg.b, err)
+		}
+	}
+	return &readCloser{Reader: io.LimitReader(rc, reg.size()), closeFunc: rc.Close}, nil
+}
+
+func (f *containerdFetcher) check() error {
+	rc, err := f.open(context.Background(), region{0, 0})
+	if err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return fmt.Errorf("check failed: %w", err)
+	}
+	return nil
+}
+
+func (f *containerdFetcher) genID(reg region) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.desc.Digest, reg.b, reg.e)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error {
+	return rc.closeFunc()
+}
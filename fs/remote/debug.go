@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statistics of fetches exposed via expvar for debugging. These are collected only after
+// EnableDebugStats is called.
+var (
+	fetchCount         = expvar.NewInt("stargz_remote_fetch_count")
+	fetchedBytes       = expvar.NewInt("stargz_remote_fetched_bytes")
+	chunkMismatchCount = expvar.NewInt("stargz_remote_chunk_mismatch_count")
+	activeFetches      = &fetchList{m: make(map[uint64]activeFetch)}
+)
+
+// debugStats is non-zero when statistics of fetches are collected.
+var debugStats int32
+
+func init() {
+	expvar.Publish("stargz_remote_active_fetches", expvar.Func(activeFetches.list))
+}
+
+// EnableDebugStats starts collecting statistics of fetches exposed via expvar. This
+// should be called when the debug endpoint is served.
+func EnableDebugStats() {
+	atomic.StoreInt32(&debugStats, 1)
+}
+
+func debugStatsEnabled() bool {
+	return atomic.LoadInt32(&debugStats) != 0
+}
+
+type activeFetch struct {
+	Blob    string    `json:"blob"`
+	Regions []string  `json:"regions"`
+	Started time.Time `json:"started"`
+}
+
+// fetchList tracks fetches that are in progress.
+type fetchList struct {
+	m    map[uint64]activeFetch
+	next uint64
+	mu   sync.Mutex
+}
+
+// add registers a fetch and returns a function to unregister it.
+func (l *fetchList) add(blob string, rs []region) (done func()) {
+	f := activeFetch{Blob: blob, Started: time.Now()}
+	for _, reg := range rs {
+		f.Regions = append(f.Regions, fmt.Sprintf("%d-%d", reg.b, reg.e))
+	}
+	l.mu.Lock()
+	id := l.next
+	l.next++
+	l.m[id] = f
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		delete(l.m, id)
+		l.mu.Unlock()
+	}
+}
+
+func (l *fetchList) list() interface{} {
+	l.mu.Lock()
+	res := make([]activeFetch, 0, len(l.m))
+	for _, f := range l.m {
+		res = append(res, f)
+	}
+	l.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Started.Before(res[j].Started)
+	})
+	return res
+}
@@ -0,0 +1,90 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// errInjectedFault is returned by fetches failed by fault injection.
+var errInjectedFault = errors.New("injected fault")
+
+func faultInjectionEnabled(cfg config.FaultInjectionConfig) bool {
+	return (cfg.DelayProbability > 0 && cfg.DelayMSec > 0) ||
+		cfg.ErrorProbability > 0 || cfg.TruncateProbability > 0
+}
+
+// faultInjectingFetcher wraps a fetcher and injects faults into fetches according to
+// the config.
+type faultInjectingFetcher struct {
+	fetcher
+	cfg  config.FaultInjectionConfig
+	rand func() float64
+}
+
+func newFaultInjectingFetcher(f fetcher, cfg config.FaultInjectionConfig) fetcher {
+	return &faultInjectingFetcher{fetcher: f, cfg: cfg, rand: rand.Float64}
+}
+
+func (f *faultInjectingFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	if f.rand() < f.cfg.DelayProbability {
+		d := time.Duration(f.cfg.DelayMSec) * time.Millisecond
+		log.G(ctx).Debugf("fault injection: delaying fetch by %v", d)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.rand() < f.cfg.ErrorProbability {
+		log.G(ctx).Debug("fault injection: failing fetch")
+		return nil, errInjectedFault
+	}
+	mr, err := f.fetcher.fetch(ctx, rs, retry)
+	if err != nil {
+		return nil, err
+	}
+	if f.rand() < f.cfg.TruncateProbability {
+		log.G(ctx).Debug("fault injection: truncating fetched response")
+		return &truncatedReader{mr}, nil
+	}
+	return mr, nil
+}
+
+// truncatedReader cuts each part of the underlying response off at its half.
+type truncatedReader struct {
+	multipartReadCloser
+}
+
+func (tr *truncatedReader) Next() (region, io.Reader, error) {
+	reg, r, err := tr.multipartReadCloser.Next()
+	if err != nil {
+		return reg, r, err
+	}
+	return reg, io.MultiReader(io.LimitReader(r, reg.size()/2), errReader{io.ErrUnexpectedEOF}), nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+type bytesFetcher []byte
+
+func (f bytesFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
+	reg := superRegion(rs)
+	return newSinglePartReader(reg, io.NopCloser(bytes.NewReader(f[reg.b:reg.e+1]))), nil
+}
+func (f bytesFetcher) check() error            { return nil }
+func (f bytesFetcher) genID(reg region) string { return "" }
+
+func TestFaultInjection(t *testing.T) {
+	contents := []byte("0123456789")
+	reg := region{0, int64(len(contents)) - 1}
+	tests := []struct {
+		name      string
+		cfg       config.FaultInjectionConfig
+		minDelay  time.Duration
+		wantErr   error
+		wantBytes []byte
+	}{
+		{
+			name:      "no_fault",
+			cfg:       config.FaultInjectionConfig{},
+			wantBytes: contents,
+		},
+		{
+			name:      "delay",
+			cfg:       config.FaultInjectionConfig{DelayProbability: 1, DelayMSec: 50},
+			minDelay:  50 * time.Millisecond,
+			wantBytes: contents,
+		},
+		{
+			name:    "error",
+			cfg:     config.FaultInjectionConfig{ErrorProbability: 1},
+			wantErr: errInjectedFault,
+		},
+		{
+			name:      "truncate",
+			cfg:       config.FaultInjectionConfig{TruncateProbability: 1},
+			wantErr:   io.ErrUnexpectedEOF,
+			wantBytes: contents[:5],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFaultInjectingFetcher(bytesFetcher(contents), tt.cfg)
+			start := time.Now()
+			mr, err := f.fetch(context.Background(), []region{reg}, false)
+			if d := time.Since(start); d < tt.minDelay {
+				t.Errorf("fetch took %v; want >= %v", d, tt.minDelay)
+			}
+			if err != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			defer mr.Close()
+			_, r, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to get part: %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != tt.wantErr {
+				t.Errorf("read error = %v; want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.wantBytes) {
+				t.Errorf("read %q; want %q", got, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestFaultInjectionDelayCancel(t *testing.T) {
+	f := newFaultInjectingFetcher(bytesFetcher("0123"), config.FaultInjectionConfig{
+		DelayProbability: 1,
+		DelayMSec:        int64(time.Hour / time.Millisecond),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := f.fetch(ctx, []region{{0, 3}}, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("delayed fetch must be cancellable: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// ErrOffline is returned by reads of contents that aren't cached while registries are
+// unreachable (offline mode). The wanted chunks are fetched once the registries become
+// reachable again.
+var ErrOffline = errors.New("contents aren't cached and registry is unreachable (offline)")
+
+// Modes of the offline mode. See config.OfflineConfig.
+const (
+	OfflineModeDisabled = "disabled"
+	OfflineModeAuto     = "auto"
+	OfflineModeOn       = "on"
+)
+
+const (
+	defaultOfflineFailureThreshold = 3
+	defaultOfflineProbeIntervalSec = 10
+)
+
+// OfflineStatus is the status of the offline mode.
+type OfflineStatus struct {
+	Mode    string    `json:"mode"`
+	Offline bool      `json:"offline"`
+	Since   time.Time `json:"since,omitempty"`
+
+	// WantedBlobs and WantedBytes are the blobs and the bytes of the chunks read while
+	// offline, which will be fetched once going back online.
+	WantedBlobs int   `json:"wantedBlobs"`
+	WantedBytes int64 `json:"wantedBytes"`
+}
+
+// Offline tracks the reachability of registries and switches blobs of the resolver to
+// serve only the cached contents while registries are unreachable. Methods are safe to
+// be called on nil, which is never offline.
+type Offline struct {
+	threshold     int
+	probeInterval time.Duration
+
+	mu         sync.Mutex
+	mode       string
+	offline    bool
+	since      time.Time
+	failures   int
+	lastFailed *blob
+	probing    bool
+	wanted     map[*blob]*regionSet
+}
+
+// newOffline returns the offline mode configured by cfg. Unknown modes are logged and
+// treated as "disabled".
+func newOffline(cfg config.OfflineConfig) *Offline {
+	o := &Offline{
+		threshold:     cfg.FailureThreshold,
+		probeInterval: time.Duration(cfg.ProbeIntervalSec) * time.Second,
+		mode:          OfflineModeDisabled,
+		wanted:        make(map[*blob]*regionSet),
+	}
+	if o.threshold <= 0 {
+		o.threshold = defaultOfflineFailureThreshold
+	}
+	if o.probeInterval <= 0 {
+		o.probeInterval = defaultOfflineProbeIntervalSec * time.Second
+	}
+	if cfg.Mode != "" {
+		if err := o.SetMode(cfg.Mode); err != nil {
+			log.L.WithError(err).Warnf("offline mode is disabled")
+		}
+	}
+	return o
+}
+
+// SetMode changes the mode of the offline mode. Going back online starts fetching the
+// chunks wanted while offline.
+func (o *Offline) SetMode(mode string) error {
+	if o == nil {
+		return fmt.Errorf("offline mode isn't available")
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch mode {
+	case OfflineModeDisabled:
+		o.mode = mode
+		o.goOnlineLocked("offline mode disabled")
+	case OfflineModeAuto:
+		o.mode = mode
+		if o.offline {
+			o.startProbeLocked()
+		}
+	case OfflineModeOn:
+		o.mode = mode
+		o.goOfflineLocked("offline mode turned on")
+	default:
+		return fmt.Errorf("unknown offline mode %q; must be %q, %q or %q",
+			mode, OfflineModeDisabled, OfflineModeAuto, OfflineModeOn)
+	}
+	return nil
+}
+
+// Status returns the status of the offline mode.
+func (o *Offline) Status() OfflineStatus {
+	if o == nil {
+		return OfflineStatus{Mode: OfflineModeDisabled}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	s := OfflineStatus{
+		Mode:        o.mode,
+		Offline:     o.offline,
+		WantedBlobs: len(o.wanted),
+	}
+	if o.offline {
+		s.Since = o.since
+	}
+	for _, rs := range o.wanted {
+		s.WantedBytes += rs.totalSize()
+	}
+	return s
+}
+
+func (o *Offline) isOffline() bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.offline
+}
+
+// want records the chunks of the blob read while offline. Chunks of closed blobs aren't
+// recorded.
+func (o *Offline) want(b *blob, regs map[region]io.Writer) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if b.isClosed() {
+		return
+	}
+	rs, ok := o.wanted[b]
+	if !ok {
+		rs = &regionSet{}
+		o.wanted[b] = rs
+	}
+	for reg := range regs {
+		rs.add(reg)
+	}
+}
+
+// forget drops the chunks of the blob wanted while offline. This is called when the blob
+// is closed.
+func (o *Offline) forget(b *blob) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.wanted, b)
+	if o.lastFailed == b {
+		o.lastFailed = nil
+	}
+}
+
+// observe records the result of an access to the registry serving the blob. In "auto"
+// mode, consecutive failures due to the unreachable registry make it go offline and a
+// success makes it go back online.
+func (o *Offline) observe(b *blob, err error) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mode != OfflineModeAuto {
+		return
+	}
+	if err == nil {
+		o.failures = 0
+		o.goOnlineLocked("registry is reachable again")
+		return
+	}
+	if !isUnreachable(err) {
+		return
+	}
+	o.failures++
+	o.lastFailed = b
+	if o.failures >= o.threshold && !o.offline {
+		o.goOfflineLocked(fmt.Sprintf("%d consecutive fetches failed: %v", o.failures, err))
+		o.startProbeLocked()
+	}
+}
+
+func (o *Offline) goOfflineLocked(reason string) {
+	if o.offline {
+		return
+	}
+	o.offline = true
+	o.since = time.Now()
+	log.L.Warnf("going offline; serving only cached contents: %s", reason)
+}
+
+func (o *Offline) goOnlineLocked(reason string) {
+	o.failures = 0
+	o.lastFailed = nil
+	if !o.offline {
+		return
+	}
+	o.offline = false
+	wanted := o.wanted
+	o.wanted = make(map[*blob]*regionSet)
+	log.L.Infof("going back online after %v; fetching chunks of %d blobs wanted while offline: %s",
+		time.Since(o.since), len(wanted), reason)
+	go catchUp(wanted)
+}
+
+func (o *Offline) startProbeLocked() {
+	if o.probing {
+		return
+	}
+	o.probing = true
+	go o.probe()
+}
+
+// probe checks periodically whether the registries are reachable again while offline in
+// "auto" mode.
+func (o *Offline) probe() {
+	t := time.NewTicker(o.probeInterval)
+	defer t.Stop()
+	for range t.C {
+		o.mu.Lock()
+		if !o.offline || o.mode != OfflineModeAuto {
+			o.probing = false
+			o.mu.Unlock()
+			return
+		}
+		var targets []*blob
+		if o.lastFailed != nil {
+			targets = append(targets, o.lastFailed)
+		}
+		for b := range o.wanted {
+			targets = append(targets, b)
+		}
+		o.mu.Unlock()
+		for _, b := range targets {
+			if b.isClosed() {
+				continue
+			}
+			b.fetcherMu.Lock()
+			fr := b.fetcher
+			b.fetcherMu.Unlock()
+			err := fr.check()
+			if err == nil {
+				o.observe(b, nil)
+				break
+			}
+			log.L.WithError(err).Debugf("registry of %v is still unreachable", b.digest)
+		}
+	}
+}
+
+// catchUp fetches the chunks wanted while offline. If it goes offline again in the
+// meantime, the remaining chunks are wanted again by the failing fetches.
+func catchUp(wanted map[*blob]*regionSet) {
+	for b, rs := range wanted {
+		for _, reg := range rs.rs {
+			if b.isClosed() {
+				break
+			}
+			if err := b.Cache(reg.b, reg.size()); err != nil && !errors.Is(err, ErrOffline) {
+				log.L.WithError(err).Warnf("failed to fetch chunks of %v wanted while offline", b.digest)
+			}
+		}
+	}
+}
+
+// isUnreachable reports whether the error is caused by registries that don't respond.
+func isUnreachable(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// unreachableRoundTripper fails requests with a network error while down.
+type unreachableRoundTripper struct {
+	down  int32
+	calls int64
+	tr    http.RoundTripper
+}
+
+func (u *unreachableRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt64(&u.calls, 1)
+	if atomic.LoadInt32(&u.down) == 1 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return u.tr.RoundTrip(req)
+}
+
+func makeOfflineTestBlob(t *testing.T, contents []byte, cfg config.OfflineConfig) (*blob, *unreachableRoundTripper, *Offline) {
+	tr := &unreachableRoundTripper{tr: multiRoundTripper(t, contents)}
+	b := makeTestBlob(t, int64(len(contents)), sampleChunkSize, defaultPrefetchChunkSize, nil)
+	b.fetcher = &httpFetcher{url: testURL, tr: tr}
+	o := newOffline(cfg)
+	o.probeInterval = 10 * time.Millisecond
+	b.resolver = &Resolver{offline: o}
+	return b, tr, o
+}
+
+func TestOfflineAuto(t *testing.T) {
+	contents := []byte(sampleData1)
+	b, tr, o := makeOfflineTestBlob(t, contents, config.OfflineConfig{Mode: OfflineModeAuto, FailureThreshold: 2})
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read the first chunk: %v", err)
+	}
+
+	// Consecutive failures due to the unreachable registry make it go offline.
+	atomic.StoreInt32(&tr.down, 1)
+	for i := 0; i < 2; i++ {
+		if _, err := b.ReadAt(p, sampleChunkSize); err == nil {
+			t.Fatalf("read of the uncached chunk must fail while the registry is unreachable")
+		}
+	}
+	if !o.Status().Offline {
+		t.Fatalf("must be offline after consecutive failures")
+	}
+
+	// Cached contents are served and uncached ones fail immediately.
+	calls := atomic.LoadInt64(&tr.calls)
+	if _, err := b.ReadAt(p, 0); err != nil || !bytes.Equal(p, contents[:sampleChunkSize]) {
+		t.Errorf("cached chunk must be served while offline: %q, %v", p, err)
+	}
+	if _, err := b.ReadAt(p, 2*sampleChunkSize); !errors.Is(err, ErrOffline) {
+		t.Errorf("read of the uncached chunk must fail with ErrOffline; got %v", err)
+	}
+	if c := atomic.LoadInt64(&tr.calls); c != calls {
+		t.Errorf("registry must not be accessed by reads while offline; got %d requests", c-calls)
+	}
+	if s := o.Status(); s.WantedBlobs != 1 || s.WantedBytes != 2*sampleChunkSize {
+		t.Errorf("unexpected wanted contents %d blobs, %d bytes; want 1 blob, %d bytes",
+			s.WantedBlobs, s.WantedBytes, 2*sampleChunkSize)
+	}
+
+	// It goes back online and fetches the wanted chunks once the registry is reachable.
+	atomic.StoreInt32(&tr.down, 0)
+	waitOffline(t, func() bool {
+		return !o.Status().Offline && b.FetchedSize() == 3*sampleChunkSize
+	})
+	if _, err := b.ReadAt(p, 2*sampleChunkSize); err != nil || !bytes.Equal(p, contents[2*sampleChunkSize:3*sampleChunkSize]) {
+		t.Errorf("failed to read the chunk after going back online: %q, %v", p, err)
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	contents := []byte(sampleData1)
+	b, tr, o := makeOfflineTestBlob(t, contents, config.OfflineConfig{})
+
+	// Failures don't make it go offline unless "auto" mode is enabled.
+	atomic.StoreInt32(&tr.down, 1)
+	p := make([]byte, sampleChunkSize)
+	for i := 0; i < defaultOfflineFailureThreshold; i++ {
+		if _, err := b.ReadAt(p, 0); err == nil || errors.Is(err, ErrOffline) {
+			t.Fatalf("read must fail with the network error; got %v", err)
+		}
+	}
+	if s := o.Status(); s.Mode != OfflineModeDisabled || s.Offline {
+		t.Fatalf("must not be offline in %q mode", s.Mode)
+	}
+
+	// The operator can turn it on regardless of the registry.
+	atomic.StoreInt32(&tr.down, 0)
+	if err := o.SetMode(OfflineModeOn); err != nil {
+		t.Fatalf("failed to turn on offline mode: %v", err)
+	}
+	if _, err := b.ReadAt(p, 0); !errors.Is(err, ErrOffline) {
+		t.Errorf("read of the uncached chunk must fail with ErrOffline; got %v", err)
+	}
+	time.Sleep(5 * o.probeInterval)
+	if !o.Status().Offline {
+		t.Fatalf("offline mode turned on by the operator must not be turned off automatically")
+	}
+	if err := o.SetMode("unknown"); err == nil {
+		t.Errorf("unknown mode must be rejected")
+	}
+	if err := o.SetMode(OfflineModeDisabled); err != nil {
+		t.Fatalf("failed to disable offline mode: %v", err)
+	}
+	waitOffline(t, func() bool { return b.FetchedSize() == sampleChunkSize })
+}
+
+func TestOfflineClosedBlob(t *testing.T) {
+	contents := []byte(sampleData1)
+	b, _, o := makeOfflineTestBlob(t, contents, config.OfflineConfig{Mode: OfflineModeOn})
+
+	p := make([]byte, sampleChunkSize)
+	if _, err := b.ReadAt(p, 0); !errors.Is(err, ErrOffline) {
+		t.Fatalf("read of the uncached chunk must fail with ErrOffline; got %v", err)
+	}
+	if s := o.Status(); s.WantedBlobs != 1 {
+		t.Fatalf("wanted %d blobs; want 1", s.WantedBlobs)
+	}
+
+	// Chunks of closed blobs are never fetched so they aren't wanted anymore.
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close blob: %v", err)
+	}
+	if s := o.Status(); s.WantedBlobs != 0 || s.WantedBytes != 0 {
+		t.Errorf("closed blob is still wanted: %d blobs, %d bytes", s.WantedBlobs, s.WantedBytes)
+	}
+	o.want(b, map[region]io.Writer{{0, sampleChunkSize - 1}: io.Discard})
+	if s := o.Status(); s.WantedBlobs != 0 {
+		t.Errorf("chunks of closed blob are wanted")
+	}
+}
+
+func waitOffline(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the offline mode")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
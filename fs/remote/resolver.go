@@ -25,12 +25,14 @@ package remote
 import (
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -45,7 +47,6 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/source"
-	"github.com/hashicorp/go-multierror"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -59,6 +60,8 @@ const (
 	defaultMaxRetries  = 5
 	defaultMinWaitMSec = 30
 	defaultMaxWaitMSec = 300000
+
+	defaultMaxFetchResumes = 3
 )
 
 func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
@@ -83,31 +86,74 @@ func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
 	if cfg.MaxWaitMSec == 0 {
 		cfg.MaxWaitMSec = defaultMaxWaitMSec
 	}
+	if cfg.MaxFetchResumes == nil {
+		n := defaultMaxFetchResumes
+		cfg.MaxFetchResumes = &n
+	}
 
 	return &Resolver{
 		blobConfig: cfg,
 		handlers:   handlers,
+		offline:    newOffline(cfg.Offline),
 	}
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
 	handlers   map[string]Handler
+	offline    *Offline
+}
+
+// Offline returns the offline mode of blobs resolved by this resolver.
+func (r *Resolver) Offline() *Offline {
+	return r.offline
 }
 
+var (
+	// ErrBlobSizeMismatch is returned when the size of the blob provided by the registry
+	// differs from the size recorded in the manifest. This typically means that the image
+	// is stale or broken (e.g. the manifest was edited without updating the descriptors).
+	ErrBlobSizeMismatch = errors.New("blob size doesn't match the manifest")
+
+	// ErrBlobDigestMismatch is returned when the registry reports that the blob it serves
+	// has a digest different from the requested one. This means that the registry (or a
+	// mirror) is broken.
+	ErrBlobDigestMismatch = errors.New("registry serves a blob of an unexpected digest")
+)
+
 type fetcher interface {
 	fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error)
 	check() error
 	genID(reg region) string
 }
 
-func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (Blob, error) {
+// ResolveOption is an option of resolving blobs.
+type ResolveOption func(*resolveOptions)
+
+type resolveOptions struct {
+	onFetched func(n int64)
+}
+
+// WithFetchRecorder makes the blob call f with the number of bytes each time it stores
+// contents fetched from the source to the cache. This can be used for accounting the
+// egress from registries.
+func WithFetchRecorder(f func(n int64)) ResolveOption {
+	return func(o *resolveOptions) {
+		o.onFetched = f
+	}
+}
+
+func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache, opts ...ResolveOption) (Blob, error) {
+	var rOpts resolveOptions
+	for _, o := range opts {
+		o(&rOpts)
+	}
 	f, size, err := r.resolveFetcher(ctx, hosts, refspec, desc)
 	if err != nil {
 		return nil, err
 	}
 	blobConfig := &r.blobConfig
-	return makeBlob(f,
+	b := makeBlob(f,
 		size,
 		blobConfig.ChunkSize,
 		blobConfig.PrefetchChunkSize,
@@ -115,11 +161,38 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		time.Now(),
 		time.Duration(blobConfig.ValidInterval)*time.Second,
 		r,
-		time.Duration(blobConfig.FetchTimeoutSec)*time.Second), nil
+		time.Duration(blobConfig.FetchTimeoutSec)*time.Second)
+	b.maxResumes = *blobConfig.MaxFetchResumes
+	b.digest = desc.Digest
+	b.onFetched = rOpts.onFetched
+	return b, nil
+}
+
+// SupportsRange reports whether the registry serving the blob returns partial contents for
+// range requests. Without the support, every fetch downloads the entire blob so layers
+// aren't pulled lazily in effect. Blobs served by resolve handlers are assumed to support it.
+func (r *Resolver) SupportsRange(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (bool, error) {
+	f, _, err := r.resolveFetcher(ctx, hosts, refspec, desc)
+	if err != nil {
+		return false, err
+	}
+	hf, ok := f.(*httpFetcher)
+	if !ok {
+		return true, nil
+	}
+	return hf.supportsRange(ctx)
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (f fetcher, size int64, err error) {
 	blobConfig := &r.blobConfig
+	if faultInjectionEnabled(blobConfig.FaultInjection) {
+		defer func() {
+			if err == nil {
+				log.G(ctx).WithField("digest", desc.Digest).Warn("fault injection is enabled for fetching this blob")
+				f = newFaultInjectingFetcher(f, blobConfig.FaultInjection)
+			}
+		}()
+	}
 	fc := &fetcherConfig{
 		hosts:       hosts,
 		refspec:     refspec,
@@ -127,21 +200,59 @@ func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHost
 		maxRetries:  blobConfig.MaxRetries,
 		minWaitMSec: time.Duration(blobConfig.MinWaitMSec) * time.Millisecond,
 		maxWaitMSec: time.Duration(blobConfig.MaxWaitMSec) * time.Millisecond,
+
+		digestAddressedHosts: blobConfig.DigestAddressedHosts,
+	}
+	if len(blobConfig.SourceChain) > 0 {
+		return r.newChainFetcher(ctx, fc)
+	}
+	if f, size, err := r.resolveByHandlers(ctx, fc, ""); err == nil {
+		return f, size, nil
+	} else if !errors.Is(err, errNoHandler) {
+		return nil, 0, err
 	}
-	var handlersErr error
-	for name, p := range r.handlers {
+	return r.resolveByRegistries(ctx, fc)
+}
+
+// errNoHandler is returned when no handler provides the blob.
+var errNoHandler = errors.New("no handler provides the blob")
+
+// resolveByHandlers returns the fetcher of the first handler providing the blob. If name
+// isn't empty, only the handler of that name is used.
+func (r *Resolver) resolveByHandlers(ctx context.Context, fc *fetcherConfig, name string) (fetcher, int64, error) {
+	refspec, desc := fc.refspec, fc.desc
+	handlersErr := errNoHandler
+	for hName, p := range r.handlers {
+		if name != "" && hName != name {
+			continue
+		}
 		// TODO: allow to configure the selection of readers based on the hostname in refspec
 		r, size, err := p.Handle(ctx, desc)
 		if err != nil {
-			handlersErr = multierror.Append(handlersErr, err)
+			handlersErr = fmt.Errorf("handler %q: %v: %w", hName, err, handlersErr)
 			continue
 		}
-		log.G(ctx).WithField("handler name", name).WithField("ref", refspec.String()).WithField("digest", desc.Digest).
+		if err := checkBlobSize(desc, size); err != nil {
+			return nil, 0, fmt.Errorf("handler %q provides inconsistent blob %q: %w", hName, desc.Digest, err)
+		}
+		log.G(ctx).WithField("handler name", hName).WithField("ref", refspec.String()).WithField("digest", desc.Digest).
 			Debugf("contents is provided by a handler")
 		return &remoteFetcher{r}, size, nil
 	}
-
 	log.G(ctx).WithError(handlersErr).WithField("ref", refspec.String()).WithField("digest", desc.Digest).Debugf("using default handler")
+	return nil, 0, handlersErr
+}
+
+// resolveByRegistries returns the fetcher of the first registry host serving the blob.
+func (r *Resolver) resolveByRegistries(ctx context.Context, fc *fetcherConfig) (fetcher, int64, error) {
+	blobConfig := &r.blobConfig
+	if blobConfig.UseContainerdFetcher {
+		cf, size, err := newContainerdFetcher(ctx, fc)
+		if err != nil {
+			return nil, 0, err
+		}
+		return cf, size, nil
+	}
 	hf, size, err := newHTTPFetcher(ctx, fc)
 	if err != nil {
 		return nil, 0, err
@@ -159,6 +270,9 @@ type fetcherConfig struct {
 	maxRetries  int
 	minWaitMSec time.Duration
 	maxWaitMSec time.Duration
+
+	// digestAddressedHosts are the hosts serving blobs with the digest as the ETag.
+	digestAddressedHosts []string
 }
 
 func jitter(duration time.Duration) time.Duration {
@@ -247,13 +361,25 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 		// Get size information
 		// TODO: we should try to use the Size field in the descriptor here.
 		start := time.Now() // start time before getting layer header
-		size, err := getSize(ctx, url, tr, timeout)
+		size, respDigest, err := getSize(ctx, url, tr, timeout)
 		commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.StargzHeaderGet, digest, start) // time to get layer header
 		if err != nil {
 			rErr = fmt.Errorf("failed to get size (host %q, ref:%q, digest:%q): %v: %w", host.Host, fc.refspec, digest, err, rErr)
 			continue // Try another
 		}
 
+		// Check the consistency with the manifest before using this blob. Otherwise,
+		// the inconsistency would surface as confusing EOF errors on reading files.
+		if respDigest != "" && respDigest != digest {
+			err = fmt.Errorf("got %q: %w", respDigest, ErrBlobDigestMismatch)
+		} else {
+			err = checkBlobSize(desc, size)
+		}
+		if err != nil {
+			rErr = fmt.Errorf("inconsistent blob (host %q, ref:%q, digest:%q): %w: %v", host.Host, fc.refspec, digest, err, rErr)
+			continue // Try another
+		}
+
 		// Hit one destination
 		return &httpFetcher{
 			url:     url,
@@ -261,12 +387,40 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, int64
 			blobURL: blobURL,
 			digest:  digest,
 			timeout: timeout,
+
+			digestAddressed: isDigestAddressed(fc.digestAddressedHosts, host.Host, blobURL, url),
 		}, size, nil
 	}
 
 	return nil, 0, fmt.Errorf("cannot resolve layer: %w", rErr)
 }
 
+// isDigestAddressed reports whether the blob served by the host is addressed by its digest
+// also in HTTP caches (i.e. the digest is the ETag). The blob redirected to another host
+// (e.g. a storage backend) isn't because the backend can use its own ETag and a mismatching
+// If-Range makes the backend respond with the whole blob.
+func isDigestAddressed(hosts []string, host, blobURL, redirectedURL string) bool {
+	listed := false
+	for _, h := range hosts {
+		if h == host {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		return false
+	}
+	bu, err := url.Parse(blobURL)
+	if err != nil {
+		return false
+	}
+	ru, err := url.Parse(redirectedURL)
+	if err != nil {
+		return false
+	}
+	return bu.Host == ru.Host
+}
+
 type transport struct {
 	inner http.RoundTripper
 	auth  docker.Authorizer
@@ -345,7 +499,18 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 	return
 }
 
-func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (int64, error) {
+// checkBlobSize checks the size of the blob against the one recorded in the descriptor.
+// Descriptors without the size are always accepted.
+func checkBlobSize(desc ocispec.Descriptor, size int64) error {
+	if desc.Size > 0 && desc.Size != size {
+		return fmt.Errorf("manifest records %d bytes but got %d bytes: %w", desc.Size, size, ErrBlobSizeMismatch)
+	}
+	return nil
+}
+
+// getSize returns the size of the blob. This also returns the digest of the blob if
+// the registry reports it with "Docker-Content-Digest" header.
+func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (int64, digest.Digest, error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -353,16 +518,17 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	req.Close = false
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer res.Body.Close()
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, contentDigest(res), err
 	}
 	headStatusCode := res.StatusCode
 
@@ -371,13 +537,13 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	// HEAD request (2020).
 	req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to make request to the registry: %w", err)
+		return 0, "", fmt.Errorf("failed to make request to the registry: %w", err)
 	}
 	req.Close = false
 	req.Header.Set("Range", "bytes=0-1")
 	res, err = tr.RoundTrip(req)
 	if err != nil {
-		return 0, fmt.Errorf("failed to request: %w", err)
+		return 0, "", fmt.Errorf("failed to request: %w", err)
 	}
 	defer func() {
 		io.Copy(io.Discard, res.Body)
@@ -385,16 +551,27 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}()
 
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, contentDigest(res), err
 	} else if res.StatusCode == http.StatusPartialContent {
 		_, size, err := parseRange(res.Header.Get("Content-Range"))
-		return size, err
+		return size, contentDigest(res), err
 	}
 
-	return 0, fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
+	return 0, "", fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
 		headStatusCode, res.StatusCode)
 }
 
+// contentDigest returns the digest reported by the registry. Malformed values are
+// ignored because some storage backends behind redirection set arbitrary values.
+func contentDigest(res *http.Response) digest.Digest {
+	d, err := digest.Parse(res.Header.Get("Docker-Content-Digest"))
+	if err != nil {
+		return ""
+	}
+	return d
+}
+
 type httpFetcher struct {
 	url           string
 	urlMu         sync.Mutex
@@ -404,6 +581,9 @@ type httpFetcher struct {
 	singleRange   bool
 	singleRangeMu sync.Mutex
 	timeout       time.Duration
+
+	// digestAddressed is true if the blob is served with the digest as the ETag.
+	digestAddressed bool
 }
 
 type multipartReadCloser interface {
@@ -449,6 +629,12 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 	}
 	req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
 	req.Header.Add("Accept-Encoding", "identity")
+	if f.digestAddressed {
+		// The contents of the blob never change for the digest so any cached range is
+		// fresh. Caches not knowing the "immutable" directive ignore it.
+		req.Header.Add("If-Range", strconv.Quote(f.digest.String()))
+		req.Header.Add("Cache-Control", "max-stale, immutable")
+	}
 	req.Close = false
 
 	// Recording the roundtrip latency for remote registry GET operation.
@@ -543,6 +729,35 @@ func (f *httpFetcher) check() error {
 	return fmt.Errorf("unexpected status code %v", res.StatusCode)
 }
 
+func (f *httpFetcher) supportsRange(ctx context.Context) (bool, error) {
+	if f.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.timeout)
+		defer cancel()
+	}
+	f.urlMu.Lock()
+	url := f.url
+	f.urlMu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to make request: %w", err)
+	}
+	req.Close = false
+	req.Header.Set("Range", "bytes=0-1")
+	res, err := f.tr.RoundTrip(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to request to registry: %w", err)
+	}
+	defer res.Body.Close() // don't read the body; it can be the entire blob
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		return true, nil
+	case http.StatusOK:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code %v", res.StatusCode)
+}
+
 func (f *httpFetcher) refreshURL(ctx context.Context) error {
 	newURL, err := redirect(ctx, f.blobURL, f.tr, f.timeout)
 	if err != nil {
@@ -645,6 +860,7 @@ type Option func(*options)
 type options struct {
 	ctx       context.Context
 	cacheOpts []cache.Option
+	fetched   *int64
 }
 
 func WithContext(ctx context.Context) Option {
@@ -659,6 +875,14 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// WithFetchedBytes makes ReadAt add the number of bytes fetched from the registry
+// (i.e. not served from the cache) to n.
+func WithFetchedBytes(n *int64) Option {
+	return func(opts *options) {
+		opts.fetched = n
+	}
+}
+
 type remoteFetcher struct {
 	r Fetcher
 }
@@ -25,6 +25,7 @@ package remote
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -236,6 +237,146 @@ func (tr *sampleRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 	}, nil
 }
 
+func TestBlobConsistency(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	blobDigest := digest.FromString("dummy")
+	tests := []struct {
+		name       string
+		descSize   int64
+		respDigest string
+		wantErr    error
+	}{
+		{name: "consistent", descSize: 1, respDigest: blobDigest.String()},
+		{name: "no-size-in-desc", descSize: 0, respDigest: blobDigest.String()},
+		{name: "no-digest-in-resp", descSize: 1},
+		{name: "malformed-digest-in-resp", descSize: 1, respDigest: "dummy"},
+		{name: "size-mismatch", descSize: 2, respDigest: blobDigest.String(), wantErr: ErrBlobSizeMismatch},
+		{name: "digest-mismatch", descSize: 1, respDigest: digest.FromString("foo").String(), wantErr: ErrBlobDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &digestRoundTripper{digest: tt.respDigest}
+			hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       &http.Client{Transport: tr},
+					Host:         refspec.Hostname(),
+					Scheme:       "https",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull,
+				}}, nil
+			}
+			_, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+				hosts:   hosts,
+				refspec: refspec,
+				desc:    ocispec.Descriptor{Digest: blobDigest, Size: tt.descSize},
+			})
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("failed to resolve consistent blob: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// digestRoundTripper serves a 1 byte blob with the specified "Docker-Content-Digest" header.
+type digestRoundTripper struct {
+	digest string
+}
+
+func (tr *digestRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header := make(http.Header)
+	header.Add("Content-Length", "1")
+	if tr.digest != "" {
+		header.Add("Docker-Content-Digest", tr.digest)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader([]byte{0})),
+		Request:    req,
+	}, nil
+}
+
+func TestDigestAddressedHosts(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	blobDigest := digest.FromString("dummy")
+	tests := []struct {
+		name        string
+		hosts       []string
+		redirectURL map[string]string
+		want        bool
+	}{
+		{name: "not-listed", hosts: []string{"other.example.com"}},
+		{name: "listed", hosts: []string{"dummyexample.com"}, want: true},
+		{
+			name:        "redirected",
+			hosts:       []string{"dummyexample.com"},
+			redirectURL: map[string]string{"dummyexample.com": "https://storage.example.com/blob"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &headerRoundTripper{inner: &sampleRoundTripper{
+				redirectURL: tt.redirectURL,
+				okURLs:      []string{"dummyexample.com", "storage.example.com"},
+			}}
+			hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       &http.Client{Transport: tr},
+					Host:         refspec.Hostname(),
+					Scheme:       "https",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull,
+				}}, nil
+			}
+			f, _, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+				hosts:                hosts,
+				refspec:              refspec,
+				desc:                 ocispec.Descriptor{Digest: blobDigest},
+				digestAddressedHosts: tt.hosts,
+			})
+			if err != nil {
+				t.Fatalf("failed to resolve blob: %v", err)
+			}
+			if _, err := f.fetch(context.Background(), []region{{b: 0, e: 0}}, false); err != nil {
+				t.Fatalf("failed to fetch: %v", err)
+			}
+			wantIfRange, wantCacheControl := "", ""
+			if tt.want {
+				wantIfRange, wantCacheControl = `"`+blobDigest.String()+`"`, "max-stale, immutable"
+			}
+			if got := tr.header.Get("If-Range"); got != wantIfRange {
+				t.Errorf("If-Range = %q; want %q", got, wantIfRange)
+			}
+			if got := tr.header.Get("Cache-Control"); got != wantCacheControl {
+				t.Errorf("Cache-Control = %q; want %q", got, wantCacheControl)
+			}
+		})
+	}
+}
+
+// headerRoundTripper records the header of the last request.
+type headerRoundTripper struct {
+	inner  http.RoundTripper
+	header http.Header
+}
+
+func (tr *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.header = req.Header.Clone()
+	return tr.inner.RoundTrip(req)
+}
+
 func TestCheck(t *testing.T) {
 	tr := &breakRoundTripper{}
 	f := &httpFetcher{
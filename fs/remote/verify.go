@@ -0,0 +1,106 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxChunkMismatchRetries is the number of times a fetch is retried after the fetched
+// contents are found corrupted.
+const maxChunkMismatchRetries = 2
+
+// ErrChunkDigestMismatch is returned when contents of a span fetched from the remote
+// don't match to the TOC.
+var ErrChunkDigestMismatch = errors.New("chunk digest mismatch")
+
+// ChunkVerifier verifies spans of the blob while they are downloaded, before they are
+// stored in the cache.
+type ChunkVerifier interface {
+	// Spans returns non-overlapping spans contained in the range of the blob, sorted
+	// by their offsets. Each span is a range whose contents can be verified independently
+	// (e.g. a compressed chunk of a file).
+	Spans(offset int64, size int64) []Region
+
+	// Verify checks that p is the valid contents of the span. A mismatch must be
+	// reported as ErrChunkDigestMismatch.
+	Verify(s Region, p []byte) error
+}
+
+// spanVerifier is a writer that receives contiguous contents of a fetched region and
+// verifies the spans contained in the region as soon as each span is fully written.
+type spanVerifier struct {
+	v     ChunkVerifier
+	spans []Region // spans not verified yet
+	off   int64    // offset in the blob of the next written byte
+	buf   []byte   // contents of the current span
+}
+
+func newSpanVerifier(v ChunkVerifier, reg region) *spanVerifier {
+	if v == nil {
+		return nil
+	}
+	spans := v.Spans(reg.b, reg.size())
+	if len(spans) == 0 {
+		return nil
+	}
+	return &spanVerifier{v: v, spans: spans, off: reg.b}
+}
+
+func (sv *spanVerifier) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && len(sv.spans) > 0 {
+		s := sv.spans[0]
+		if sv.off < s.Offset {
+			skip := s.Offset - sv.off
+			if skip > int64(len(p)) {
+				skip = int64(len(p))
+			}
+			p = p[skip:]
+			sv.off += skip
+			continue
+		}
+		take := s.Offset + s.Size - sv.off
+		if take > int64(len(p)) {
+			take = int64(len(p))
+		}
+		sv.buf = append(sv.buf, p[:take]...)
+		p = p[take:]
+		sv.off += take
+		if sv.off < s.Offset+s.Size {
+			continue
+		}
+		if err := sv.v.Verify(s, sv.buf); err != nil {
+			return 0, fmt.Errorf("bytes %d-%d of the blob: %w", s.Offset, s.Offset+s.Size-1, err)
+		}
+		sv.buf = sv.buf[:0]
+		sv.spans = sv.spans[1:]
+	}
+	sv.off += int64(len(p))
+	return n, nil
+}
+
+// pendingOffset returns the offset of the blob where contents that aren't verified
+// yet start. Contents before this offset can be stored in the cache.
+func (sv *spanVerifier) pendingOffset() int64 {
+	if sv == nil || len(sv.spans) == 0 {
+		return math.MaxInt64
+	}
+	return sv.spans[0].Offset
+}
@@ -0,0 +1,385 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package sbom reads SBOMs (SPDX or CycloneDX) attached to images as referrers and
+// returns files of packages listed in them. The filesystem prefetches these files for
+// images that don't indicate prioritized files, which are usually the files actually used
+// by the containers.
+package sbom
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeSPDX is the media type of SPDX JSON.
+	MediaTypeSPDX = "application/spdx+json"
+
+	// MediaTypeCycloneDX is the media type of CycloneDX JSON.
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+
+	// maxManifestSize limits the size of the referrers index and manifests.
+	maxManifestSize = 4 << 20
+
+	// maxSBOMSize limits the size of an SBOM.
+	maxSBOMSize = 64 << 20
+)
+
+// descriptor is a descriptor in the referrers index including the artifact type.
+type descriptor struct {
+	MediaType    string        `json:"mediaType,omitempty"`
+	ArtifactType string        `json:"artifactType,omitempty"`
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+}
+
+type index struct {
+	Manifests []descriptor `json:"manifests"`
+}
+
+type manifest struct {
+	ArtifactType string       `json:"artifactType,omitempty"`
+	Config       descriptor   `json:"config"`
+	Layers       []descriptor `json:"layers"`
+}
+
+// Files returns files listed in SBOMs attached to the manifest as referrers. Referrers
+// are looked up with the referrers API and the referrers tag schema ("sha256-<digest>")
+// as the fallback. This returns no files without an error if no SBOM is attached.
+func Files(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, manifestDigest digest.Digest) ([]string, error) {
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		return nil, err
+	}
+	pullScope, err := docker.RepositoryScope(refspec, false)
+	if err != nil {
+		return nil, err
+	}
+	rErr := fmt.Errorf("failed to get SBOM")
+	for _, host := range reghosts {
+		if host.Host == "" || strings.Contains(host.Host, "/") {
+			rErr = fmt.Errorf("invalid destination (host %q, ref:%q): %w", host.Host, refspec, rErr)
+			continue // Try another
+		}
+		f := &fetcher{
+			host:  host,
+			repo:  strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
+			scope: pullScope,
+		}
+		files, err := f.files(ctx, manifestDigest)
+		if err != nil {
+			rErr = fmt.Errorf("failed to get SBOM (host %q, ref:%q): %v: %w", host.Host, refspec, err, rErr)
+			continue // Try another
+		}
+		return files, nil
+	}
+	return nil, rErr
+}
+
+type fetcher struct {
+	host  docker.RegistryHost
+	repo  string
+	scope string
+}
+
+func (f *fetcher) files(ctx context.Context, manifestDigest digest.Digest) ([]string, error) {
+	referrers, err := f.referrers(ctx, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, desc := range referrers {
+		if desc.ArtifactType != "" && !isSBOMType(desc.ArtifactType) {
+			continue
+		}
+		b, err := f.get(ctx, "manifests/"+desc.Digest.String(), desc.Digest, maxManifestSize, ocispec.MediaTypeImageManifest)
+		if err != nil {
+			return nil, err
+		}
+		var m manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %v: %w", desc.Digest, err)
+		}
+		artifactType := m.ArtifactType
+		if artifactType == "" {
+			artifactType = m.Config.MediaType
+		}
+		for _, l := range m.Layers {
+			mediaType := l.MediaType
+			if !isSBOMType(mediaType) {
+				if !isSBOMType(artifactType) {
+					continue
+				}
+				mediaType = artifactType
+			}
+			b, err := f.get(ctx, "blobs/"+l.Digest.String(), l.Digest, maxSBOMSize, "")
+			if err != nil {
+				return nil, err
+			}
+			sbomFiles, err := Parse(mediaType, bytes.NewReader(b))
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to parse SBOM %v", l.Digest)
+				continue
+			}
+			files = append(files, sbomFiles...)
+		}
+	}
+	return dedup(files), nil
+}
+
+// referrers returns descriptors of the manifests referring to the manifest.
+func (f *fetcher) referrers(ctx context.Context, manifestDigest digest.Digest) ([]descriptor, error) {
+	b, err := f.get(ctx, "referrers/"+manifestDigest.String(), "", maxManifestSize, ocispec.MediaTypeImageIndex)
+	if errdefs.IsNotFound(err) {
+		// The registry doesn't support the referrers API. Try the referrers tag schema.
+		tag := strings.Replace(manifestDigest.String(), ":", "-", 1)
+		b, err = f.get(ctx, "manifests/"+tag, "", maxManifestSize, ocispec.MediaTypeImageIndex)
+		if errdefs.IsNotFound(err) {
+			return nil, nil // no referrer
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse referrers of %v: %w", manifestDigest, err)
+	}
+	return idx.Manifests, nil
+}
+
+// get reads the resource of the repository. The contents are verified if dgst is
+// specified.
+func (f *fetcher) get(ctx context.Context, p string, dgst digest.Digest, limit int64, accept string) ([]byte, error) {
+	u := fmt.Sprintf("%s://%s/%s/%s", f.host.Scheme, path.Join(f.host.Host, f.host.Path), f.repo, p)
+	ctx = docker.WithScope(ctx, f.scope)
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if f.host.Authorizer != nil {
+			if err := f.host.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		client := f.host.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		return client.Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && f.host.Authorizer != nil {
+		err := f.host.Authorizer.AddResponses(ctx, []*http.Response{resp})
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = do(); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%q: %w", u, errdefs.ErrNotFound)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %v from %q", resp.Status, u)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%q exceeds the size limit %d", u, limit)
+	}
+	if dgst != "" && digest.FromBytes(b) != dgst {
+		return nil, fmt.Errorf("digest of %q mismatches; want %v", u, dgst)
+	}
+	return b, nil
+}
+
+func isSBOMType(mediaType string) bool {
+	return mediaType == MediaTypeSPDX || mediaType == MediaTypeCycloneDX
+}
+
+// Parse returns files listed in the SBOM of the media type. Paths are relative to the
+// root of the image. The format is detected from the contents if the media type is
+// neither SPDX nor CycloneDX.
+func Parse(mediaType string, r io.Reader) ([]string, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !isSBOMType(mediaType) {
+		var probe struct {
+			SPDXVersion string `json:"spdxVersion"`
+			BOMFormat   string `json:"bomFormat"`
+		}
+		if err := json.Unmarshal(b, &probe); err != nil {
+			return nil, fmt.Errorf("failed to parse SBOM: %w", err)
+		}
+		if probe.SPDXVersion != "" {
+			mediaType = MediaTypeSPDX
+		} else if probe.BOMFormat == "CycloneDX" {
+			mediaType = MediaTypeCycloneDX
+		}
+	}
+	switch mediaType {
+	case MediaTypeSPDX:
+		return parseSPDX(b)
+	case MediaTypeCycloneDX:
+		return parseCycloneDX(b)
+	}
+	return nil, fmt.Errorf("unsupported SBOM format %q", mediaType)
+}
+
+type spdxDocument struct {
+	Packages []struct {
+		SPDXID   string   `json:"SPDXID"`
+		HasFiles []string `json:"hasFiles"`
+	} `json:"packages"`
+	Files []struct {
+		SPDXID   string `json:"SPDXID"`
+		FileName string `json:"fileName"`
+	} `json:"files"`
+	Relationships []struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	} `json:"relationships"`
+}
+
+// parseSPDX returns files contained in packages. If no file is related to packages, all
+// files in the document are returned.
+func parseSPDX(b []byte) ([]string, error) {
+	var doc spdxDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse SPDX: %w", err)
+	}
+	packages := make(map[string]struct{})
+	inPackage := make(map[string]struct{})
+	for _, p := range doc.Packages {
+		packages[p.SPDXID] = struct{}{}
+		for _, f := range p.HasFiles {
+			inPackage[f] = struct{}{}
+		}
+	}
+	for _, r := range doc.Relationships {
+		switch r.RelationshipType {
+		case "CONTAINS":
+			if _, ok := packages[r.SPDXElementID]; ok {
+				inPackage[r.RelatedSPDXElement] = struct{}{}
+			}
+		case "CONTAINED_BY":
+			if _, ok := packages[r.RelatedSPDXElement]; ok {
+				inPackage[r.SPDXElementID] = struct{}{}
+			}
+		}
+	}
+	var files []string
+	for _, f := range doc.Files {
+		if _, ok := inPackage[f.SPDXID]; ok || len(inPackage) == 0 {
+			files = append(files, f.FileName)
+		}
+	}
+	return dedup(files), nil
+}
+
+type cycloneDXComponent struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Properties []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"properties"`
+	Evidence struct {
+		Occurrences []struct {
+			Location string `json:"location"`
+		} `json:"occurrences"`
+	} `json:"evidence"`
+	Components []cycloneDXComponent `json:"components"`
+}
+
+// parseCycloneDX returns locations of components. Locations are read from the evidence
+// of components and the properties recorded by syft ("syft:location:<N>:path").
+func parseCycloneDX(b []byte) ([]string, error) {
+	var doc struct {
+		Components []cycloneDXComponent `json:"components"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse CycloneDX: %w", err)
+	}
+	var files []string
+	var walk func(cs []cycloneDXComponent)
+	walk = func(cs []cycloneDXComponent) {
+		for _, c := range cs {
+			if c.Type == "file" {
+				files = append(files, c.Name)
+			}
+			for _, o := range c.Evidence.Occurrences {
+				files = append(files, o.Location)
+			}
+			for _, p := range c.Properties {
+				if strings.HasPrefix(p.Name, "syft:location:") && strings.HasSuffix(p.Name, ":path") {
+					files = append(files, p.Value)
+				}
+			}
+			walk(c.Components)
+		}
+	}
+	walk(doc.Components)
+	return dedup(files), nil
+}
+
+// dedup cleans paths to be relative to the root and removes duplicated ones, keeping
+// the order.
+func dedup(files []string) (res []string) {
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		f = strings.TrimPrefix(path.Clean("/"+f), "/")
+		if f == "" {
+			continue
+		}
+		if _, ok := seen[f]; ok {
+			continue
+		}
+		seen[f] = struct{}{}
+		res = append(res, f)
+	}
+	return res
+}
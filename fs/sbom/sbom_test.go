@@ -0,0 +1,232 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sbom
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testSPDX = `{
+  "spdxVersion": "SPDX-2.3",
+  "packages": [
+    {"SPDXID": "SPDXRef-Package-python", "hasFiles": ["SPDXRef-File-python"]},
+    {"SPDXID": "SPDXRef-Package-libc"}
+  ],
+  "files": [
+    {"SPDXID": "SPDXRef-File-python", "fileName": "/usr/bin/python3"},
+    {"SPDXID": "SPDXRef-File-libc", "fileName": "/lib/x86_64-linux-gnu/libc.so.6"},
+    {"SPDXID": "SPDXRef-File-unrelated", "fileName": "/etc/motd"}
+  ],
+  "relationships": [
+    {"spdxElementId": "SPDXRef-Package-libc", "relationshipType": "CONTAINS", "relatedSpdxElement": "SPDXRef-File-libc"},
+    {"spdxElementId": "SPDXRef-File-python", "relationshipType": "CONTAINED_BY", "relatedSpdxElement": "SPDXRef-Package-python"}
+  ]
+}`
+	testCycloneDX = `{
+  "bomFormat": "CycloneDX",
+  "components": [
+    {
+      "type": "library",
+      "name": "requests",
+      "properties": [
+        {"name": "syft:package:foundBy", "value": "python-package-cataloger"},
+        {"name": "syft:location:0:path", "value": "/usr/lib/python3/dist-packages/requests/__init__.py"}
+      ],
+      "components": [
+        {"type": "file", "name": "./usr/lib/python3/dist-packages/requests/api.py"}
+      ]
+    },
+    {
+      "type": "library",
+      "name": "openssl",
+      "evidence": {"occurrences": [{"location": "/usr/lib/libssl.so.3"}]}
+    }
+  ]
+}`
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType string
+		in        string
+		want      []string
+	}{
+		{
+			name:      "spdx",
+			mediaType: MediaTypeSPDX,
+			in:        testSPDX,
+			want:      []string{"usr/bin/python3", "lib/x86_64-linux-gnu/libc.so.6"},
+		},
+		{
+			name:      "spdx_detected",
+			mediaType: "application/json",
+			in:        testSPDX,
+			want:      []string{"usr/bin/python3", "lib/x86_64-linux-gnu/libc.so.6"},
+		},
+		{
+			name:      "spdx_without_packages",
+			mediaType: MediaTypeSPDX,
+			in:        `{"spdxVersion": "SPDX-2.3", "files": [{"SPDXID": "a", "fileName": "/a"}, {"SPDXID": "b", "fileName": "b"}, {"SPDXID": "c", "fileName": "/a"}]}`,
+			want:      []string{"a", "b"},
+		},
+		{
+			name:      "cyclonedx",
+			mediaType: MediaTypeCycloneDX,
+			in:        testCycloneDX,
+			want: []string{
+				"usr/lib/python3/dist-packages/requests/__init__.py",
+				"usr/lib/python3/dist-packages/requests/api.py",
+				"usr/lib/libssl.so.3",
+			},
+		},
+		{
+			name: "cyclonedx_detected",
+			in:   testCycloneDX,
+			want: []string{
+				"usr/lib/python3/dist-packages/requests/__init__.py",
+				"usr/lib/python3/dist-packages/requests/api.py",
+				"usr/lib/libssl.so.3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.mediaType, strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := Parse("", strings.NewReader(`{"foo": "bar"}`)); err == nil {
+		t.Errorf("unknown format must be rejected")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	manifestDigest := digest.FromString("image manifest")
+	sbomBlob := []byte(testCycloneDX)
+	sbomManifest, err := json.Marshal(manifest{
+		ArtifactType: MediaTypeCycloneDX,
+		Config:       descriptor{MediaType: "application/vnd.oci.empty.v1+json", Digest: digest.FromString("{}"), Size: 2},
+		Layers:       []descriptor{{MediaType: MediaTypeCycloneDX, Digest: digest.FromBytes(sbomBlob), Size: int64(len(sbomBlob))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherManifest := []byte(`{"artifactType": "application/vnd.example.signature", "layers": [{"digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000"}]}`)
+	referrers, err := json.Marshal(index{Manifests: []descriptor{
+		{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: "application/vnd.example.signature", Digest: digest.FromBytes(otherManifest), Size: int64(len(otherManifest))},
+		{MediaType: ocispec.MediaTypeImageManifest, ArtifactType: MediaTypeCycloneDX, Digest: digest.FromBytes(sbomManifest), Size: int64(len(sbomManifest))},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		referrersAPI bool
+		tagSchema    bool
+		want         []string
+	}{
+		{
+			name:         "referrers_api",
+			referrersAPI: true,
+			want: []string{
+				"usr/lib/python3/dist-packages/requests/__init__.py",
+				"usr/lib/python3/dist-packages/requests/api.py",
+				"usr/lib/libssl.so.3",
+			},
+		},
+		{
+			name:      "tag_schema",
+			tagSchema: true,
+			want: []string{
+				"usr/lib/python3/dist-packages/requests/__init__.py",
+				"usr/lib/python3/dist-packages/requests/api.py",
+				"usr/lib/libssl.so.3",
+			},
+		},
+		{
+			name: "no_sbom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents := map[string][]byte{
+				"/v2/test/manifests/" + digest.FromBytes(sbomManifest).String():  sbomManifest,
+				"/v2/test/manifests/" + digest.FromBytes(otherManifest).String(): otherManifest,
+				"/v2/test/blobs/" + digest.FromBytes(sbomBlob).String():          sbomBlob,
+			}
+			if tt.referrersAPI {
+				contents["/v2/test/referrers/"+manifestDigest.String()] = referrers
+			}
+			if tt.tagSchema {
+				contents["/v2/test/manifests/"+strings.Replace(manifestDigest.String(), ":", "-", 1)] = referrers
+			}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, ok := contents[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Write(b)
+			}))
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refspec, err := reference.Parse(u.Host + "/test:latest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+				return []docker.RegistryHost{{
+					Client:       srv.Client(),
+					Host:         u.Host,
+					Scheme:       "http",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+				}}, nil
+			}
+			got, err := Files(context.Background(), hosts, refspec, manifestDigest)
+			if err != nil {
+				t.Fatalf("failed to get files: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -19,6 +19,7 @@ package source
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd/images"
@@ -58,6 +59,10 @@ type Source struct {
 	// the manifest.
 	// Currently, only layer digests (Manifest.Layers.Digest) will be used.
 	Manifest ocispec.Manifest
+
+	// ManifestDigest is the digest of the manifest which contains the blob. This is
+	// empty if unknown.
+	ManifestDigest digest.Digest
 }
 
 const (
@@ -67,10 +72,17 @@ const (
 	// targetDigestLabel is a label which contains layer digest.
 	targetDigestLabel = "containerd.io/snapshot/remote/stargz.digest"
 
+	// targetSizeLabel is a label which contains layer size recorded in the manifest.
+	targetSizeLabel = "containerd.io/snapshot/remote/stargz.size"
+
 	// targetImageLayersLabel is a label which contains layer digests contained in
 	// the target image.
 	targetImageLayersLabel = "containerd.io/snapshot/remote/stargz.layers"
 
+	// targetManifestDigestLabel is a label which contains the digest of the manifest
+	// that contains the layer.
+	targetManifestDigestLabel = "containerd.io/snapshot/remote/stargz.manifest-digest"
+
 	// targetImageURLsLabelPrefix is a label prefix which constructs a map from the layer index to
 	// urls of the layer descriptor.
 	targetImageURLsLabelPrefix = "containerd.io/snapshot/remote/urls."
@@ -124,16 +136,29 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 			Digest:      target,
 			Annotations: labels,
 		}
+		if sizeStr, ok := labels[targetSizeLabel]; ok {
+			if targetDesc.Size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid size label %q: %w", sizeStr, err)
+			}
+		}
 		if targetURLs, ok := labels[targetURLsLabel]; ok {
 			targetDesc.URLs = append(targetDesc.URLs, strings.Split(targetURLs, ",")...)
 		}
 
+		var manifestDigest digest.Digest
+		if s, ok := labels[targetManifestDigestLabel]; ok {
+			if manifestDigest, err = digest.Parse(s); err != nil {
+				return nil, fmt.Errorf("invalid manifest digest label %q: %w", s, err)
+			}
+		}
+
 		return []Source{
 			{
-				Hosts:    hosts,
-				Name:     refspec,
-				Target:   targetDesc,
-				Manifest: ocispec.Manifest{Layers: append([]ocispec.Descriptor{targetDesc}, neighboringLayers...)},
+				Hosts:          hosts,
+				Name:           refspec,
+				Target:         targetDesc,
+				Manifest:       ocispec.Manifest{Layers: append([]ocispec.Descriptor{targetDesc}, neighboringLayers...)},
+				ManifestDigest: manifestDigest,
 			},
 		}, nil
 	}
@@ -158,29 +183,9 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 						if c.Annotations == nil {
 							c.Annotations = make(map[string]string)
 						}
-						c.Annotations[targetRefLabel] = ref
-						c.Annotations[targetDigestLabel] = c.Digest.String()
-						var layers string
-						for i, l := range children[i:] {
-							if images.IsLayerType(l.MediaType) {
-								ls := fmt.Sprintf("%s,", l.Digest.String())
-								// This avoids the label hits the size limitation.
-								// Skipping layers is allowed here and only affects performance.
-								if err := labels.Validate(targetImageLayersLabel, layers+ls); err != nil {
-									break
-								}
-								layers += ls
-
-								// Store URLs of the neighbouring layer as well.
-								urlsKey := targetImageURLsLabelPrefix + fmt.Sprintf("%d", i)
-								c.Annotations[urlsKey] = appendWithValidation(urlsKey, l.URLs)
-							}
+						for k, v := range defaultLabels(ref, desc.Digest, children[i:], prefetchSize) {
+							c.Annotations[k] = v
 						}
-						c.Annotations[targetImageLayersLabel] = strings.TrimSuffix(layers, ",")
-						c.Annotations[config.TargetPrefetchSizeLabel] = fmt.Sprintf("%d", prefetchSize)
-
-						// store URL in annotation to let containerd to pass it to the snapshotter
-						c.Annotations[targetURLsLabel] = appendWithValidation(targetURLsLabel, c.URLs)
 					}
 				}
 			}
@@ -189,6 +194,57 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 	}
 }
 
+// LayerLabels returns the default labels of each layer in the passed manifest, keyed by
+// the layer digest. Clients that pull images without ctr-remote can pass these labels to
+// Prepare of the snapshotter to get the layers mounted as remote snapshots.
+func LayerLabels(ref string, manifestDesc ocispec.Descriptor, manifest ocispec.Manifest, prefetchSize int64) map[digest.Digest]map[string]string {
+	res := make(map[digest.Digest]map[string]string)
+	for i, l := range manifest.Layers {
+		if images.IsLayerType(l.MediaType) {
+			res[l.Digest] = defaultLabels(ref, manifestDesc.Digest, manifest.Layers[i:], prefetchSize)
+		}
+	}
+	return res
+}
+
+// defaultLabels returns labels of the layer layers[0]. Following layers are
+// recorded as its neighbours.
+func defaultLabels(ref string, manifestDigest digest.Digest, layers []ocispec.Descriptor, prefetchSize int64) map[string]string {
+	target := layers[0]
+	res := map[string]string{
+		targetRefLabel:    ref,
+		targetDigestLabel: target.Digest.String(),
+	}
+	if manifestDigest != "" {
+		res[targetManifestDigestLabel] = manifestDigest.String()
+	}
+	if target.Size > 0 {
+		res[targetSizeLabel] = fmt.Sprintf("%d", target.Size)
+	}
+	var layersStr string
+	for i, l := range layers {
+		if images.IsLayerType(l.MediaType) {
+			ls := fmt.Sprintf("%s,", l.Digest.String())
+			// This avoids the label hits the size limitation.
+			// Skipping layers is allowed here and only affects performance.
+			if err := labels.Validate(targetImageLayersLabel, layersStr+ls); err != nil {
+				break
+			}
+			layersStr += ls
+
+			// Store URLs of the neighbouring layer as well.
+			urlsKey := targetImageURLsLabelPrefix + fmt.Sprintf("%d", i)
+			res[urlsKey] = appendWithValidation(urlsKey, l.URLs)
+		}
+	}
+	res[targetImageLayersLabel] = strings.TrimSuffix(layersStr, ",")
+	res[config.TargetPrefetchSizeLabel] = fmt.Sprintf("%d", prefetchSize)
+
+	// store URL in annotation to let containerd to pass it to the snapshotter
+	res[targetURLsLabel] = appendWithValidation(targetURLsLabel, target.URLs)
+	return res
+}
+
 func appendWithValidation(key string, values []string) string {
 	var v string
 	for _, u := range values {
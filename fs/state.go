@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+// layerStates tracks the states of mounted layers (see snapshot.LayerStateLabel) and
+// notifies their changes to the handlers.
+type layerStates struct {
+	mu       sync.Mutex
+	layers   map[string]*layerState // keyed by the mountpoint
+	handlers []func(mountpoint, state string)
+}
+
+type layerState struct {
+	prefetched bool
+	degraded   bool
+	state      string // the last notified state
+}
+
+func (s *layerStates) onChange(f func(mountpoint, state string)) {
+	s.mu.Lock()
+	s.handlers = append(s.handlers, f)
+	s.mu.Unlock()
+}
+
+// mounted starts tracking the layer mounted at the mountpoint.
+func (s *layerStates) mounted(mountpoint string) {
+	s.update(mountpoint, true, func(*layerState) {})
+}
+
+// prefetched records that the prefetch of the layer completed.
+func (s *layerStates) prefetched(mountpoint string) {
+	s.update(mountpoint, false, func(ls *layerState) { ls.prefetched = true })
+}
+
+// setDegraded records whether the layer can't fetch contents from the registry.
+func (s *layerStates) setDegraded(mountpoint string, degraded bool) {
+	s.update(mountpoint, false, func(ls *layerState) { ls.degraded = degraded })
+}
+
+// remove stops tracking the layer.
+func (s *layerStates) remove(mountpoint string) {
+	s.mu.Lock()
+	delete(s.layers, mountpoint)
+	s.mu.Unlock()
+}
+
+// update applies f to the state of the layer and notifies the handlers if the state
+// changed. Handlers are called with the lock held so that they observe changes in order.
+func (s *layerStates) update(mountpoint string, create bool, f func(*layerState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ls, ok := s.layers[mountpoint]
+	if !ok {
+		if !create {
+			return
+		}
+		if s.layers == nil {
+			s.layers = make(map[string]*layerState)
+		}
+		ls = &layerState{}
+		s.layers[mountpoint] = ls
+	}
+	f(ls)
+	state := snapshot.LayerStateMounted
+	if ls.degraded {
+		state = snapshot.LayerStateDegraded
+	} else if ls.prefetched {
+		state = snapshot.LayerStatePrefetchComplete
+	}
+	if state == ls.state {
+		return
+	}
+	ls.state = state
+	for _, h := range s.handlers {
+		h(mountpoint, state)
+	}
+}
+
+// OnLayerStateChange registers the function called with the mountpoint and the new state
+// whenever the state of a mounted layer changes. f must not block.
+func (fs *filesystem) OnLayerStateChange(f func(mountpoint, state string)) {
+	fs.layerStates.onChange(f)
+}
@@ -0,0 +1,49 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+func TestLayerStates(t *testing.T) {
+	var s layerStates
+	var got []string
+	s.onChange(func(mountpoint, state string) { got = append(got, mountpoint+"="+state) })
+
+	s.prefetched("/a") // not mounted yet
+	s.mounted("/a")
+	s.setDegraded("/a", false) // no change
+	s.prefetched("/a")
+	s.setDegraded("/a", true)
+	s.setDegraded("/a", false)
+	s.remove("/a")
+	s.setDegraded("/a", true) // already unmounted
+
+	want := []string{
+		"/a=" + snapshot.LayerStateMounted,
+		"/a=" + snapshot.LayerStatePrefetchComplete,
+		"/a=" + snapshot.LayerStateDegraded,
+		"/a=" + snapshot.LayerStatePrefetchComplete,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("notified states = %v; want %v", got, want)
+	}
+}
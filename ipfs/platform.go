@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxIndexDepth is the maximum depth of nested indexes traversed by SelectManifest.
+const maxIndexDepth = 8
+
+// SelectManifest returns the descriptor of the manifest in desc that matches the platform.
+// desc can be a manifest or an index that can contain nested indexes. When several manifests
+// match, the one preferred by platformMC is returned (e.g. the one with the same variant or
+// os.version as the host for platforms.Default()). The returned descriptor has the platform
+// of the manifest even if it's inherited from the index.
+func SelectManifest(ctx context.Context, f remotes.Fetcher, desc ocispec.Descriptor, platformMC platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var candidates []ocispec.Descriptor
+	if err := collectManifests(ctx, f, desc, platformMC, 0, &candidates); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if len(candidates) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest matches the platform in %v", desc.Digest)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Platform == nil {
+			return false
+		} else if candidates[j].Platform == nil {
+			return true
+		}
+		return platformMC.Less(*candidates[i].Platform, *candidates[j].Platform)
+	})
+	return candidates[0], nil
+}
+
+func collectManifests(ctx context.Context, f remotes.Fetcher, desc ocispec.Descriptor, platformMC platforms.MatchComparer, depth int, candidates *[]ocispec.Descriptor) error {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		if desc.Platform == nil || platformMC.Match(platforms.Normalize(*desc.Platform)) {
+			*candidates = append(*candidates, desc)
+		}
+		return nil
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return nil // unknown blob (e.g. attestations) is ignored
+	}
+	if depth >= maxIndexDepth {
+		return fmt.Errorf("index %v is nested too deeply", desc.Digest)
+	}
+	if desc.Platform != nil && !platformMC.Match(platforms.Normalize(*desc.Platform)) {
+		return nil
+	}
+	rc, err := f.Fetch(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch index %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	var idx ocispec.Index
+	if err := json.NewDecoder(io.LimitReader(rc, desc.Size)).Decode(&idx); err != nil {
+		return fmt.Errorf("failed to decode index %v: %w", desc.Digest, err)
+	}
+	for _, m := range idx.Manifests {
+		if m.Platform == nil && desc.Platform != nil {
+			p := *desc.Platform
+			m.Platform = &p // inherit the platform of the nested index
+		}
+		if err := collectManifests(ctx, f, m, platformMC, depth+1, candidates); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"path"
 
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes"
 	"github.com/ipfs/go-cid"
 	files "github.com/ipfs/go-ipfs-files"
@@ -32,13 +33,18 @@ import (
 )
 
 type resolver struct {
-	api    iface.CoreAPI
-	scheme string
+	api        iface.CoreAPI
+	scheme     string
+	platformMC platforms.MatchComparer
 }
 
 type ResolverOptions struct {
 	// Scheme is the scheme to fetch the specified IPFS content. "ipfs" or "ipns".
 	Scheme string
+
+	// Platforms makes Resolve return the manifest that matches the platform when the
+	// specified content is an index. The index is returned as is if this is nil.
+	Platforms platforms.MatchComparer
 }
 
 func NewResolver(client iface.CoreAPI, options ResolverOptions) (remotes.Resolver, error) {
@@ -46,7 +52,7 @@ func NewResolver(client iface.CoreAPI, options ResolverOptions) (remotes.Resolve
 	if s != "ipfs" && s != "ipns" {
 		return nil, fmt.Errorf("unsupported scheme %q", s)
 	}
-	return &resolver{client, s}, nil
+	return &resolver{client, s, options.Platforms}, nil
 }
 
 // Resolve resolves the provided ref for IPFS. ref must be a CID.
@@ -73,6 +79,12 @@ func (r *resolver) Resolve(ctx context.Context, ref string) (name string, desc o
 	if _, err := GetPath(desc); err != nil {
 		return "", ocispec.Descriptor{}, err
 	}
+	if r.platformMC != nil {
+		desc, err = SelectManifest(ctx, &fetcher{r}, desc, r.platformMC)
+		if err != nil {
+			return "", ocispec.Descriptor{}, err
+		}
+	}
 	return ref, desc, nil
 }
 
@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// MemoryReporter is implemented by readers that can estimate the memory they keep (e.g.
+// the parsed TOC). Readers not implementing this are assumed to keep little memory.
+type MemoryReporter interface {
+	// MemoryUsage returns the estimated number of bytes kept by the reader.
+	MemoryUsage() int64
+}
+
+// Budget creates readers with the primary store until the estimated memory kept by the
+// live readers exceeds the limit, and with the fallback store (e.g. a DB-backed store
+// keeping metadata on the disk) after that. This prevents nodes mounting hundreds of
+// images from running out of memory. Memory is released when readers are closed.
+type Budget struct {
+	primary  Store
+	fallback Store
+	limit    int64
+
+	mu       sync.Mutex
+	used     int64
+	fellBack uint64
+	readers  map[*budgetedReader]struct{}
+}
+
+// NewBudget returns a budget limiting the memory kept by readers created by primary.
+// limit <= 0 or nil fallback doesn't limit the memory but the usage is still reported.
+func NewBudget(primary, fallback Store, limit int64) *Budget {
+	return &Budget{
+		primary:  primary,
+		fallback: fallback,
+		limit:    limit,
+		readers:  make(map[*budgetedReader]struct{}),
+	}
+}
+
+// ReaderUsage is the estimated memory kept by a reader.
+type ReaderUsage struct {
+	TOCDigest digest.Digest `json:"tocDigest"`
+	Bytes     int64         `json:"bytes"`
+
+	// Fallback is true if the reader is created by the fallback store.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Usage is the memory usage of readers under a budget.
+type Usage struct {
+	// Limit is the limit of the memory. 0 means unlimited.
+	Limit int64 `json:"limit"`
+
+	// Used is the total memory kept by the live readers.
+	Used int64 `json:"used"`
+
+	// FellBack is the number of readers created by the fallback store because the
+	// budget was exceeded.
+	FellBack uint64 `json:"fellBack"`
+
+	// Readers are the live readers sorted by the memory in descending order.
+	Readers []ReaderUsage `json:"readers"`
+}
+
+// Store implements Store.
+func (b *Budget) Store(sr *io.SectionReader, opts ...Option) (Reader, error) {
+	b.mu.Lock()
+	fallback := b.fallback != nil && b.limit > 0 && b.used >= b.limit
+	if fallback {
+		b.fellBack++
+	}
+	b.mu.Unlock()
+	store := b.primary
+	if fallback {
+		store = b.fallback
+	}
+	r, err := store(sr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	br := &budgetedReader{Reader: r, b: b, fallback: fallback}
+	if mr, ok := r.(MemoryReporter); ok {
+		br.bytes = mr.MemoryUsage()
+	}
+	b.mu.Lock()
+	b.used += br.bytes
+	b.readers[br] = struct{}{}
+	b.mu.Unlock()
+	return br, nil
+}
+
+// Usage returns the current memory usage.
+func (b *Budget) Usage() Usage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := Usage{Used: b.used, FellBack: b.fellBack, Readers: []ReaderUsage{}}
+	if b.fallback != nil && b.limit > 0 {
+		u.Limit = b.limit
+	}
+	for r := range b.readers {
+		u.Readers = append(u.Readers, ReaderUsage{TOCDigest: r.TOCDigest(), Bytes: r.bytes, Fallback: r.fallback})
+	}
+	sort.Slice(u.Readers, func(i, j int) bool {
+		return u.Readers[i].Bytes > u.Readers[j].Bytes
+	})
+	return u
+}
+
+func (b *Budget) release(r *budgetedReader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.readers[r]; ok {
+		delete(b.readers, r)
+		b.used -= r.bytes
+	}
+}
+
+// budgetedReader is a reader accounted in a budget until it's closed. Clones aren't
+// accounted because they share the memory of the reader.
+type budgetedReader struct {
+	Reader
+	b        *Budget
+	bytes    int64
+	fallback bool
+}
+
+func (r *budgetedReader) MemoryUsage() int64 {
+	return r.bytes
+}
+
+func (r *budgetedReader) Close() error {
+	r.b.release(r)
+	return r.Reader.Close()
+}
@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package metadata
+
+import (
+	"io"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type testReader struct {
+	Reader
+	dgst   digest.Digest
+	bytes  int64
+	closed bool
+}
+
+func (r *testReader) TOCDigest() digest.Digest { return r.dgst }
+func (r *testReader) MemoryUsage() int64       { return r.bytes }
+func (r *testReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestBudget(t *testing.T) {
+	var created []*testReader
+	store := func(bytes int64) Store {
+		return func(sr *io.SectionReader, opts ...Option) (Reader, error) {
+			r := &testReader{dgst: digest.FromString(string(rune('a' + len(created)))), bytes: bytes}
+			created = append(created, r)
+			return r, nil
+		}
+	}
+	b := NewBudget(store(100), store(0), 150)
+
+	r1, err := b.Store(nil)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	r2, _ := b.Store(nil) // exceeds the budget
+	r3, _ := b.Store(nil) // falls back
+	u := b.Usage()
+	if u.Limit != 150 || u.Used != 200 || u.FellBack != 1 || len(u.Readers) != 3 {
+		t.Fatalf("unexpected usage %+v", u)
+	}
+	if u.Readers[0].Bytes != 100 || u.Readers[2].Bytes != 0 || !u.Readers[2].Fallback {
+		t.Errorf("readers must be sorted by the memory; got %+v", u.Readers)
+	}
+
+	// Closing readers releases the memory and new readers use the primary store again.
+	r1.Close()
+	r3.Close()
+	if !created[0].closed || !created[2].closed {
+		t.Errorf("underlying readers must be closed")
+	}
+	if u := b.Usage(); u.Used != 100 || len(u.Readers) != 1 || u.Readers[0].TOCDigest != created[1].dgst {
+		t.Errorf("unexpected usage after close %+v", u)
+	}
+	r4, _ := b.Store(nil)
+	if r4.(MemoryReporter).MemoryUsage() != 100 {
+		t.Errorf("reader must be created by the primary store under the budget")
+	}
+	r2.Close()
+	r4.Close()
+	if u := b.Usage(); u.Used != 0 || len(u.Readers) != 0 {
+		t.Errorf("all memory must be released; got %+v", u)
+	}
+}
@@ -17,10 +17,13 @@
 package memory
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"path"
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -70,8 +73,14 @@ func NewReader(sr *io.SectionReader, opts ...metadata.Option) (metadata.Reader,
 		estargz.WithTOCOffset(rOpts.TOCOffset),
 		estargz.WithTelemetry(telemetry),
 		estargz.WithDecompressors(decompressors...),
+		estargz.WithOpenPathPolicy(rOpts.PathPolicy),
 	}
-	er, err := estargz.Open(sr, erOpts...)
+	ctx := rOpts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// The context is used only while opening so it isn't kept in erOpts.
+	er, err := estargz.Open(sr, append(erOpts, estargz.WithOpenContext(ctx))...)
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +153,14 @@ func (r *reader) TOCDigest() digest.Digest {
 	return r.r.TOCDigest()
 }
 
+func (r *reader) PrefetchBoundary() (offset int64, ok bool) {
+	return r.r.PrefetchBoundary()
+}
+
+func (r *reader) Summary() (s estargz.TOCSummary, ok bool) {
+	return r.r.Summary()
+}
+
 func (r *reader) GetOffset(id uint32) (offset int64, err error) {
 	e, ok := r.idMap[id]
 	if !ok {
@@ -201,12 +218,89 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 	return err
 }
 
+func (r *reader) PathOf(id uint32) (string, error) {
+	e, ok := r.idMap[id]
+	if !ok {
+		return "", fmt.Errorf("entry %d not found", id)
+	}
+	return path.Join("/", e.Name), nil
+}
+
+func (r *reader) Walk(f func(path string, id uint32, mode os.FileMode) bool) error {
+	root, ok := r.idMap[r.rootID]
+	if !ok {
+		return fmt.Errorf("root entry %d not found", r.rootID)
+	}
+	var err error
+	var walk func(p string, id uint32, e *estargz.TOCEntry) bool
+	walk = func(p string, id uint32, e *estargz.TOCEntry) bool {
+		if !f(p, id, e.Stat().Mode()) {
+			return false
+		}
+		cont := true
+		e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+			cid, ok := r.idOfEntry[ent]
+			if !ok {
+				err = fmt.Errorf("id of child entry %q not found", baseName)
+				return false
+			}
+			cont = walk(path.Join(p, baseName), cid, ent)
+			return cont
+		})
+		return cont && err == nil
+	}
+	walk("/", r.rootID, root)
+	return err
+}
+
+func (r *reader) ForeachChunk(f func(c metadata.Chunk) bool) error {
+	seen := make(map[*estargz.TOCEntry]struct{})
+	for _, e := range r.idMap {
+		if e.Type != "reg" || e.Size == 0 {
+			continue
+		}
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		for off := int64(0); off < e.Size; {
+			ce, ok := r.r.ChunkEntryForOffset(e.Name, off)
+			if !ok || ce.ChunkSize <= 0 {
+				break
+			}
+			dgst := ce.Digest
+			if ce.ChunkDigest != "" {
+				dgst = ce.ChunkDigest
+			}
+			if !f(metadata.Chunk{
+				Offset:    ce.Offset,
+				Size:      ce.NextOffset() - ce.Offset,
+				ChunkSize: ce.ChunkSize,
+				Digest:    dgst,
+			}) {
+				return nil
+			}
+			off = ce.ChunkOffset + ce.ChunkSize
+		}
+	}
+	return nil
+}
+
+func (r *reader) DecompressChunk(p []byte) (io.ReadCloser, error) {
+	return r.r.Decompressor().Reader(bytes.NewReader(p))
+}
+
+// Decompressor returns the decompressor of the blob.
+func (r *reader) Decompressor() estargz.Decompressor {
+	return r.r.Decompressor()
+}
+
 func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 	e, ok := r.idMap[id]
 	if !ok {
 		return nil, fmt.Errorf("entry %d not found", id)
 	}
-	sr, err := r.r.OpenFile(e.Name)
+	sr, err := r.r.OpenRawFile(e.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -214,12 +308,7 @@ func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 }
 
 func (r *reader) Clone(sr *io.SectionReader) (metadata.Reader, error) {
-	er, err := estargz.Open(sr, r.estargzOpts...)
-	if err != nil {
-		return nil, err
-	}
-
-	return newReader(er, r.rootID, r.idMap, r.idOfEntry, r.estargzOpts), nil
+	return newReader(r.r.Clone(sr), r.rootID, r.idMap, r.idOfEntry, r.estargzOpts), nil
 }
 
 func (r *reader) Close() error {
@@ -254,6 +343,15 @@ func (r *reader) NumOfNodes() (i int, _ error) {
 	return len(r.idMap), nil
 }
 
+// nodeMemoryUsage is the estimated memory kept for a node, including its TOC entry and
+// the maps of IDs.
+const nodeMemoryUsage = 512
+
+// MemoryUsage implements metadata.MemoryReporter.
+func (r *reader) MemoryUsage() int64 {
+	return int64(len(r.idMap)) * nodeMemoryUsage
+}
+
 // TODO: share it with db pkg
 func attrFromTOCEntry(src *estargz.TOCEntry, dst *metadata.Attr) *metadata.Attr {
 	dst.Size = src.Size
@@ -266,5 +364,6 @@ func attrFromTOCEntry(src *estargz.TOCEntry, dst *metadata.Attr) *metadata.Attr
 	dst.DevMinor = src.DevMinor
 	dst.Xattrs = src.Xattrs
 	dst.NumLink = src.NumLink
+	dst.Encryption = src.Encryption
 	return dst
 }
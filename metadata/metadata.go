@@ -17,6 +17,7 @@
 package metadata
 
 import (
+	"context"
 	"io"
 	"os"
 	"time"
@@ -56,6 +57,11 @@ type Attr struct {
 
 	// NumLink is the number of names pointing to this node.
 	NumLink int
+
+	// Encryption, for regular files, is non-nil if the contents are encrypted.
+	// Files opened by Reader.OpenFile return the contents as stored in the blob
+	// so the caller needs to decrypt them.
+	Encryption *estargz.Encryption
 }
 
 // Store reads the provided eStargz blob and creates a metadata reader.
@@ -66,16 +72,52 @@ type Reader interface {
 	RootID() uint32
 	TOCDigest() digest.Digest
 
+	// PrefetchBoundary returns the offset where prioritized files end if it's recorded
+	// in the TOC instead of landmark files.
+	PrefetchBoundary() (offset int64, ok bool)
+
+	// Summary returns the statistics of the layer if it's recorded in the TOC.
+	Summary() (s estargz.TOCSummary, ok bool)
+
 	GetOffset(id uint32) (offset int64, err error)
 	GetAttr(id uint32) (attr Attr, err error)
 	GetChild(pid uint32, base string) (id uint32, attr Attr, err error)
 	ForeachChild(id uint32, f func(name string, id uint32, mode os.FileMode) bool) error
 	OpenFile(id uint32) (File, error)
 
+	// PathOf returns the absolute path of the node. If the node has multiple names
+	// (i.e. hardlinks), one of them is returned.
+	PathOf(id uint32) (string, error)
+
+	// Walk calls f for each node with its absolute path, visiting parents before their
+	// children. Nodes with multiple names are visited once per name. The iteration stops
+	// when f returns false.
+	Walk(f func(path string, id uint32, mode os.FileMode) bool) error
+
+	// ForeachChunk calls f for each chunk of regular files stored in the blob. Chunks
+	// shared by multiple names are visited once. The iteration stops when f returns false.
+	ForeachChunk(f func(c Chunk) bool) error
+
+	// DecompressChunk returns the reader of the chunk decompressed from p, which is the
+	// contents of the blob in the range of the chunk (Chunk.Offset and Chunk.Size).
+	DecompressChunk(p []byte) (io.ReadCloser, error)
+
 	Clone(sr *io.SectionReader) (Reader, error)
 	Close() error
 }
 
+// Chunk is a chunk of a regular file stored in the blob.
+type Chunk struct {
+	// Offset and Size are the range of the blob where the chunk is stored. The chunk
+	// can be decompressed from this range independently of other chunks.
+	Offset int64
+	Size   int64
+
+	// ChunkSize is the size of the decompressed chunk and Digest is its digest.
+	ChunkSize int64
+	Digest    string
+}
+
 type File interface {
 	ChunkEntryForOffset(offset int64) (off int64, size int64, dgst string, ok bool)
 	ReadAt(p []byte, off int64) (n int, err error)
@@ -84,7 +126,8 @@ type File interface {
 type Decompressor interface {
 	estargz.Decompressor
 
-	// DecompressTOC decompresses the passed blob and returns a reader of TOC JSON.
+	// DecompressTOC decompresses the passed blob and returns a reader of TOC JSON (or the
+	// binary TOC, which starts with the CBOR self-described tag).
 	DecompressTOC(io.Reader) (tocJSON io.ReadCloser, err error)
 }
 
@@ -92,6 +135,8 @@ type Options struct {
 	TOCOffset     int64
 	Telemetry     *Telemetry
 	Decompressors []Decompressor
+	PathPolicy    estargz.PathPolicy
+	Context       context.Context
 }
 
 // Option is an option to configure the behaviour of reader.
@@ -122,6 +167,24 @@ func WithDecompressors(decompressors ...Decompressor) Option {
 	}
 }
 
+// WithPathPolicy option specifies how to deal with entry names in the TOC that aren't
+// valid UTF-8 or contain NUL or control characters. Default is estargz.PathPolicyAllow.
+func WithPathPolicy(policy estargz.PathPolicy) Option {
+	return func(o *Options) error {
+		o.PathPolicy = policy
+		return nil
+	}
+}
+
+// WithContext option specifies a context that can be used for canceling the construction
+// of the reader. The returned reader doesn't depend on this context.
+func WithContext(ctx context.Context) Option {
+	return func(o *Options) error {
+		o.Context = ctx
+		return nil
+	}
+}
+
 // A func which takes start time and records the diff
 type MeasureLatencyHook func(time.Time)
 
@@ -0,0 +1,209 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+const (
+	giantFileSize  = 400 << 30 // 400GiB; offsets don't fit in int32/uint32
+	giantChunkSize = 64 << 20
+	giantDataStart = 1 << 20
+)
+
+// testGiantLayer tests a reader with a synthetic TOC of a layer larger than 4GiB. Only
+// the TOC and the footer are materialized and the payload is a hole of zeros.
+func testGiantLayer(t *testing.T, factory ReaderFactory) {
+	toc := &estargz.JTOC{Version: 1}
+	toc.Entries = append(toc.Entries, &estargz.TOCEntry{
+		Name:      "model.bin",
+		Type:      "reg",
+		Size:      giantFileSize,
+		Offset:    giantDataStart,
+		ChunkSize: giantChunkSize,
+		Mode:      0644,
+	})
+	for off := int64(giantChunkSize); off < giantFileSize; off += giantChunkSize {
+		ent := &estargz.TOCEntry{
+			Name:        "model.bin",
+			Type:        "chunk",
+			Offset:      giantDataStart + off,
+			ChunkOffset: off,
+			ChunkSize:   giantChunkSize,
+		}
+		if off+giantChunkSize >= giantFileSize {
+			ent.ChunkSize = 0 // the last chunk spans until the end of the file
+		}
+		toc.Entries = append(toc.Entries, ent)
+	}
+	sr, err := sparseBlob(giantDataStart+giantFileSize, toc)
+	if err != nil {
+		t.Fatalf("failed to build giant blob: %v", err)
+	}
+	r, err := factory(sr)
+	if err != nil {
+		t.Fatalf("failed to create reader of giant layer: %v", err)
+	}
+	defer r.Close()
+
+	id, err := lookup(r, "model.bin")
+	if err != nil {
+		t.Fatalf("failed to lookup giant file: %v", err)
+	}
+	attr, err := r.GetAttr(id)
+	if err != nil {
+		t.Fatalf("failed to get attr: %v", err)
+	}
+	if attr.Size != giantFileSize {
+		t.Errorf("size = %d; want %d", attr.Size, int64(giantFileSize))
+	}
+	if off, err := r.GetOffset(id); err != nil || off != giantDataStart {
+		t.Errorf("offset = %d (err: %v); want %d", off, err, giantDataStart)
+	}
+	fr, err := r.OpenFile(id)
+	if err != nil {
+		t.Fatalf("failed to open giant file: %v", err)
+	}
+	for _, off := range []int64{0, giantChunkSize - 1, 1 << 31, 1<<32 + 1, giantFileSize - 1} {
+		gotOff, gotSize, _, ok := fr.ChunkEntryForOffset(off)
+		wantOff := off / giantChunkSize * giantChunkSize
+		if !ok || gotOff != wantOff || gotSize != giantChunkSize {
+			t.Errorf("chunk for offset %d = (%d, %d, %v); want (%d, %d, true)",
+				off, gotOff, gotSize, ok, wantOff, int64(giantChunkSize))
+		}
+	}
+	if _, _, _, ok := fr.ChunkEntryForOffset(giantFileSize); ok {
+		t.Errorf("chunk must not be found at the end of the giant file")
+	}
+}
+
+// testOutOfBounds tests that a reader rejects TOCs whose offsets or sizes point outside
+// of the blob or overflow int64, either on creation or on the first access.
+func testOutOfBounds(t *testing.T, factory ReaderFactory) {
+	const blobSize = 1 << 20
+	reg := func(size, offset int64) *estargz.TOCEntry {
+		return &estargz.TOCEntry{Name: "a", Type: "reg", Size: size, Offset: offset, Mode: 0644}
+	}
+	tests := []struct {
+		name    string
+		entries []*estargz.TOCEntry
+	}{
+		{
+			name:    "negative-size",
+			entries: []*estargz.TOCEntry{reg(-1, 0)},
+		},
+		{
+			name:    "negative-offset",
+			entries: []*estargz.TOCEntry{reg(10, -1)},
+		},
+		{
+			name:    "offset-beyond-blob",
+			entries: []*estargz.TOCEntry{reg(10, blobSize+1)},
+		},
+		{
+			name: "chunk-overflow",
+			entries: []*estargz.TOCEntry{
+				func() *estargz.TOCEntry { e := reg(math.MaxInt64, 0); e.ChunkSize = 10; return e }(),
+				{Name: "a", Type: "chunk", Offset: 10, ChunkOffset: math.MaxInt64 - 5, ChunkSize: 10},
+			},
+		},
+		{
+			name: "chunk-beyond-file",
+			entries: []*estargz.TOCEntry{
+				func() *estargz.TOCEntry { e := reg(20, 0); e.ChunkSize = 10; return e }(),
+				{Name: "a", Type: "chunk", Offset: 10, ChunkOffset: 10, ChunkSize: 20},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			sr, err := sparseBlob(blobSize, &estargz.JTOC{Version: 1, Entries: tt.entries})
+			if err != nil {
+				t.Fatalf("failed to build blob: %v", err)
+			}
+			r, err := factory(sr)
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			// Readers initializing metadata in background report the error on the first
+			// access.
+			if err := r.ForeachChild(r.RootID(), func(string, uint32, os.FileMode) bool { return true }); err == nil {
+				t.Fatalf("reader must reject the TOC")
+			}
+		})
+	}
+
+	t.Run("toc-offset-beyond-blob", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := new(estargz.GzipCompressor).WriteTOCAndFooter(&buf, blobSize*2, &estargz.JTOC{Version: 1}, nil); err != nil {
+			t.Fatalf("failed to write TOC: %v", err)
+		}
+		if r, err := factory(io.NewSectionReader(bytes.NewReader(buf.Bytes()), 0, int64(buf.Len()))); err == nil {
+			r.Close()
+			t.Fatalf("reader must reject the TOC offset")
+		}
+	})
+}
+
+// sparseBlob returns a gzip eStargz blob of size bytes that contains the TOC and the footer
+// at the tail. The preceding bytes are zeros that are never stored.
+func sparseBlob(size int64, toc *estargz.JTOC) (*io.SectionReader, error) {
+	// The length of the tail doesn't depend on the TOC offset recorded in the footer.
+	var buf bytes.Buffer
+	if _, err := new(estargz.GzipCompressor).WriteTOCAndFooter(&buf, 0, toc, nil); err != nil {
+		return nil, err
+	}
+	tocOff := size - int64(buf.Len())
+	buf.Reset()
+	if _, err := new(estargz.GzipCompressor).WriteTOCAndFooter(&buf, tocOff, toc, nil); err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(&sparseReaderAt{tail: buf.Bytes(), tailOff: tocOff}, 0, size), nil
+}
+
+type sparseReaderAt struct {
+	tail    []byte
+	tailOff int64
+}
+
+func (s *sparseReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < s.tailOff {
+		p[n] = 0
+		n++
+	}
+	if n < len(p) {
+		i := off + int64(n) - s.tailOff
+		if i >= int64(len(s.tail)) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], s.tail[i:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,267 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/metadata"
+	tutil "github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// fuzzMaxBlobSize limits the size of inputs so that each run finishes quickly.
+	fuzzMaxBlobSize = 1 << 20
+
+	// fuzzMaxRead limits the bytes read from each file.
+	fuzzMaxRead = 1 << 16
+
+	// fuzzMaxNodes limits the nodes walked in each run.
+	fuzzMaxNodes = 10000
+)
+
+// FuzzReader fuzzes the reader with whole blobs, covering the footer, the TOC and the
+// contents of files. The reader must not panic or hang on any input.
+func FuzzReader(f *testing.F, factory ReaderFactory) {
+	corpus, err := FuzzCorpus()
+	if err != nil {
+		f.Fatalf("failed to generate corpus: %v", err)
+	}
+	for _, b := range corpus {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) > fuzzMaxBlobSize {
+			return
+		}
+		exerciseReader(t, factory, io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))))
+	})
+}
+
+// FuzzTOC fuzzes the reader with TOC JSON stored in a valid gzip blob containing a few
+// files. This reaches the TOC parser and the reconciliation of the TOC and the tar stream
+// more efficiently than FuzzReader because the fuzzer doesn't need to build the envelope.
+func FuzzTOC(f *testing.F, factory ReaderFactory) {
+	payload, tocs, err := fuzzTOCCorpus()
+	if err != nil {
+		f.Fatalf("failed to generate corpus: %v", err)
+	}
+	for _, toc := range tocs {
+		f.Add(toc)
+	}
+	f.Fuzz(func(t *testing.T, toc []byte) {
+		if len(toc) > fuzzMaxBlobSize {
+			return
+		}
+		blob, err := blobWithTOC(payload, toc)
+		if err != nil {
+			t.Fatalf("failed to build blob: %v", err)
+		}
+		exerciseReader(t, factory, io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	})
+}
+
+// FuzzCorpus returns blobs (gzip eStargz and zstd:chunked) covering various types of
+// entries, which seed fuzzing of parsers of layers.
+func FuzzCorpus() (corpus [][]byte, _ error) {
+	entries := fuzzEntries()
+	for _, c := range []compression{
+		gzipCompressionWithLevel(gzip.BestSpeed),
+		zstdCompressionWithLevel(zstd.SpeedFastest),
+	} {
+		for _, ents := range entries {
+			// Entries without "foo" are built with the prioritized landmark only.
+			var missed []string
+			for _, opts := range [][]estargz.Option{
+				{estargz.WithCompression(c)},
+				{estargz.WithCompression(c), estargz.WithChunkSize(4), estargz.WithPrioritizedFiles([]string{"foo"}), estargz.WithAllowPrioritizeNotFound(&missed)},
+				{estargz.WithCompression(c), estargz.WithoutLandmarks(), estargz.WithSummary()},
+			} {
+				sr, _, err := tutil.BuildEStargz(ents, tutil.WithEStargzOptions(opts...))
+				if err != nil {
+					return nil, err
+				}
+				b, err := io.ReadAll(io.NewSectionReader(sr, 0, sr.Size()))
+				if err != nil {
+					return nil, err
+				}
+				corpus = append(corpus, b)
+			}
+		}
+	}
+	return corpus, nil
+}
+
+// WriteFuzzCorpus writes the corpus of FuzzReader to the directory in the format of Go's
+// native fuzzing (e.g. "testdata/fuzz/FuzzReader"), for sharing it with other fuzzers or
+// persisting interesting inputs.
+func WriteFuzzCorpus(dir string) error {
+	corpus, err := FuzzCorpus()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, b := range corpus {
+		data := fmt.Sprintf("go test fuzz v1\n[]byte(%s)\n", strconv.Quote(string(b)))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("seed-%03d", i)), []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fuzzEntries() [][]tutil.TarEntry {
+	return [][]tutil.TarEntry{
+		{},
+		{
+			tutil.File("foo", "foofoofoo"),
+			tutil.Dir("bar/", tutil.WithDirXattrs(map[string]string{"user.foo": "bar"})),
+			tutil.File("bar/baz", "bazbazbazbazbaz", tutil.WithFileOwner(1000, 1000)),
+			tutil.Symlink("bar/sym", "../foo"),
+			tutil.Link("bar/link", "foo"),
+			tutil.Chardev("dev", 1, 3),
+			tutil.Fifo("fifo"),
+		},
+		{
+			tutil.Dir("a/"),
+			tutil.Dir("a/b/"),
+			tutil.File("a/b/c", "c"),
+			tutil.File("a/b/.wh.d", ""),
+			tutil.File("a/.wh..wh..opq", ""),
+		},
+	}
+}
+
+// fuzzTOCCorpus returns the payload of a blob (the part before the TOC) and TOC JSONs
+// consistent with the payload.
+func fuzzTOCCorpus() (payload []byte, tocs [][]byte, _ error) {
+	sr, _, err := tutil.BuildEStargz(fuzzEntries()[1],
+		tutil.WithEStargzOptions(estargz.WithChunkSize(4), estargz.WithCompression(gzipCompressionWithLevel(gzip.BestSpeed))))
+	if err != nil {
+		return nil, nil, err
+	}
+	tocOff, _, err := estargz.OpenFooter(sr)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload = make([]byte, tocOff)
+	if _, err := sr.ReadAt(payload, 0); err != nil {
+		return nil, nil, err
+	}
+	zr, err := gzip.NewReader(io.NewSectionReader(sr, tocOff, sr.Size()-tocOff-estargz.FooterSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(zr)
+	if _, err := tr.Next(); err != nil {
+		return nil, nil, err
+	}
+	toc, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return payload, [][]byte{toc, []byte(`{"version":1,"entries":[]}`), []byte(`{}`)}, nil
+}
+
+// blobWithTOC returns a gzip blob consisting of the payload and the raw TOC JSON.
+func blobWithTOC(payload, toc []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(append([]byte{}, payload...))
+	zw, _ := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(toc))}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(toc); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	// The footer depends only on the TOC offset so take it from a blob with an empty TOC.
+	var footer bytes.Buffer
+	if _, err := new(estargz.GzipCompressor).WriteTOCAndFooter(&footer, int64(len(payload)), &estargz.JTOC{}, nil); err != nil {
+		return nil, err
+	}
+	buf.Write(footer.Bytes()[footer.Len()-estargz.FooterSize:])
+	return buf.Bytes(), nil
+}
+
+// exerciseReader opens the blob and accesses all nodes and contents of files. Errors are
+// expected on broken inputs and ignored.
+func exerciseReader(t *testing.T, factory ReaderFactory, sr *io.SectionReader) {
+	r, err := factory(sr, metadata.WithDecompressors(new(estargz.GzipDecompressor), new(zstdchunked.Decompressor)))
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	r.PrefetchBoundary()
+	r.Summary()
+	nodes := 0
+	r.Walk(func(p string, id uint32, mode os.FileMode) bool {
+		if nodes++; nodes > fuzzMaxNodes {
+			return false
+		}
+		r.PathOf(id)
+		r.GetOffset(id)
+		attr, err := r.GetAttr(id)
+		if err != nil || !mode.IsRegular() {
+			return true
+		}
+		f, err := r.OpenFile(id)
+		if err != nil {
+			return true
+		}
+		size := attr.Size
+		if size < 0 || size > fuzzMaxRead {
+			size = fuzzMaxRead
+		}
+		for off := int64(0); off < size; {
+			cOff, cSize, _, ok := f.ChunkEntryForOffset(off)
+			if !ok || cSize <= 0 || cOff+cSize <= off {
+				break
+			}
+			if cSize > fuzzMaxRead {
+				cSize = fuzzMaxRead
+			}
+			f.ReadAt(make([]byte, cSize), cOff)
+			off = cOff + cSize
+		}
+		return true
+	})
+	if cr, err := r.Clone(sr); err == nil {
+		cr.Close()
+	}
+}
@@ -34,6 +34,7 @@ import (
 	tutil "github.com/containerd/stargz-snapshotter/util/testutil"
 	"github.com/hashicorp/go-multierror"
 	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
 )
 
 var allowedPrefix = [4]string{"", "./", "/", "../"}
@@ -52,6 +53,7 @@ var srcCompressions = map[string]compression{
 	"gzip-bestcompression":    gzipCompressionWithLevel(gzip.BestCompression),
 	"gzip-defaultcompression": gzipCompressionWithLevel(gzip.DefaultCompression),
 	"gzip-huffmanonly":        gzipCompressionWithLevel(gzip.HuffmanOnly),
+	"gzip-binarytoc":          gzipCompression{estargz.NewGzipCompressorWithBinaryTOC(gzip.BestCompression), &estargz.GzipDecompressor{}},
 }
 
 type zstdCompression struct {
@@ -143,6 +145,9 @@ func TestReader(t *testing.T, factory ReaderFactory) {
 				hasFile("foo/bar/xxxx", "x", 1),
 				hasFile("foo/bar/yyy", "yyy", 3),
 				hasFile("foo/a/1/2", "1111111111", 10),
+				hasPath("foo/a/1/2", "/foo/a/1/2"),
+				hasPath("", "/"),
+				walks("", "foo", "foo/bar", "foo/bar/baz.txt", "foo/bar/xxxx", "foo/bar/yyy", "foo/a", "foo/a/1", "foo/a/1/2"),
 			},
 		},
 		{
@@ -175,6 +180,8 @@ func TestReader(t *testing.T, factory ReaderFactory) {
 				hasNumLink("foo", 3),     // parent dir + 2 links
 				hasNumLink("barlink", 2), // parent dir + 1 link
 				hasNumLink("bar", 3),     // parent + "." + child's ".."
+				hasPath("bar/foolink2", "/foo", "/bar/foolink", "/bar/foolink2"),
+				walks("foo", "bar/foolink", "bar/foolink2", "bar/1/baz.txt", "barlink", "foosym"),
 			},
 		},
 		{
@@ -258,6 +265,7 @@ func TestReader(t *testing.T, factory ReaderFactory) {
 					if err := checkCalled(); err != nil {
 						t.Errorf("telemetry failure: %v", err)
 					}
+					checkChunks(t, r, esgz)
 
 					// Test the cloned reader works correctly as well
 					esgz2, _, err := tutil.BuildEStargz(tt.in, opts...)
@@ -339,6 +347,73 @@ func TestReader(t *testing.T, factory ReaderFactory) {
 			t.Fatal("file -> ID mappings did not match between original and cloned reader")
 		}
 	})
+
+	t.Run("summary", func(t *testing.T) {
+		in := []tutil.TarEntry{
+			tutil.File("foo", "foofoo"),
+			tutil.Dir("bar/"),
+			tutil.File("bar/baz.txt", "bazbazbaz"),
+		}
+		for _, withSummary := range []bool{false, true} {
+			var opts []tutil.BuildEStargzOption
+			if withSummary {
+				opts = append(opts, tutil.WithEStargzOptions(estargz.WithSummary()))
+			}
+			esgz, _, err := tutil.BuildEStargz(in, opts...)
+			if err != nil {
+				t.Fatalf("failed to build sample eStargz: %v", err)
+			}
+			r, err := factory(esgz)
+			if err != nil {
+				t.Fatalf("failed to create new reader: %v", err)
+			}
+			s, ok := r.Summary()
+			r.Close()
+			if ok != withSummary {
+				t.Fatalf("summary is recorded = %v; want %v", ok, withSummary)
+			}
+			if !ok {
+				continue
+			}
+			// foo, bar/, bar/baz.txt and the landmark file
+			want := estargz.TOCSummary{Entries: 4, RegularFiles: 3, TotalSize: 16}
+			if s.Entries != want.Entries || s.RegularFiles != want.RegularFiles || s.TotalSize != want.TotalSize {
+				t.Errorf("summary = %+v; want %+v", s, want)
+			}
+		}
+	})
+	t.Run("giant-layer", func(t *testing.T) { testGiantLayer(t, factory) })
+	t.Run("out-of-bounds", func(t *testing.T) { testOutOfBounds(t, factory) })
+}
+
+// checkChunks checks that all chunks reported by the reader can be decompressed from
+// their ranges of the blob and match to their digests.
+func checkChunks(t *testing.T, r TestableReader, sr *io.SectionReader) {
+	if err := r.ForeachChunk(func(c metadata.Chunk) bool {
+		p := make([]byte, c.Size)
+		if _, err := sr.ReadAt(p, c.Offset); err != nil {
+			t.Errorf("failed to read chunk at %d: %v", c.Offset, err)
+			return false
+		}
+		dr, err := r.DecompressChunk(p)
+		if err != nil {
+			t.Errorf("failed to decompress chunk at %d: %v", c.Offset, err)
+			return false
+		}
+		defer dr.Close()
+		dgstr := digest.Canonical.Digester()
+		if _, err := io.CopyN(dgstr.Hash(), dr, c.ChunkSize); err != nil {
+			t.Errorf("failed to read decompressed chunk at %d: %v", c.Offset, err)
+			return false
+		}
+		if got := dgstr.Digest().String(); got != c.Digest {
+			t.Errorf("digest of chunk at %d = %v; want %v", c.Offset, got, c.Digest)
+			return false
+		}
+		return true
+	}); err != nil {
+		t.Errorf("failed to read chunks: %v", err)
+	}
 }
 
 func newCalledTelemetry() (telemetry *metadata.Telemetry, check func() error) {
@@ -436,6 +511,57 @@ func sameNodes(n string, nodes ...string) check {
 	}
 }
 
+func hasPath(name string, paths ...string) check {
+	return func(t *testing.T, r TestableReader) {
+		id, err := lookup(r, name)
+		if err != nil {
+			t.Errorf("failed to lookup %q: %v", name, err)
+			return
+		}
+		p, err := r.PathOf(id)
+		if err != nil {
+			t.Errorf("failed to get path of %q: %v", name, err)
+			return
+		}
+		for _, want := range paths {
+			if p == want {
+				return
+			}
+		}
+		t.Errorf("path of %q = %q; want one of %v", name, p, paths)
+	}
+}
+
+func walks(names ...string) check {
+	return func(t *testing.T, r TestableReader) {
+		visited := make(map[string]uint32)
+		if err := r.Walk(func(p string, id uint32, mode os.FileMode) bool {
+			if pid, ok := visited[path.Dir(p)]; !ok && p != "/" {
+				t.Errorf("%q is visited before its parent", p)
+			} else if ok {
+				if _, _, err := r.GetChild(pid, path.Base(p)); err != nil {
+					t.Errorf("%q isn't a child of %d: %v", p, pid, err)
+				}
+			}
+			visited[p] = id
+			return true
+		}); err != nil {
+			t.Errorf("failed to walk: %v", err)
+			return
+		}
+		for _, n := range names {
+			id, err := lookup(r, n)
+			if err != nil {
+				t.Errorf("failed to lookup %q: %v", n, err)
+				return
+			}
+			if vid, ok := visited[path.Clean("/"+n)]; !ok || vid != id {
+				t.Errorf("%q (id %d) isn't visited by walk: %v", n, id, visited)
+			}
+		}
+	}
+}
+
 func linkName(name string, linkName string) check {
 	return func(t *testing.T, r TestableReader) {
 		id, err := lookup(r, name)
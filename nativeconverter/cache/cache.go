@@ -0,0 +1,290 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package cache provides a cache of layer conversion. A layer converted once is reused
+// when the same source layer is converted with the same options again, instead of
+// decompressing and recompressing it.
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// entry is the result of a conversion recorded in the cache.
+type entry struct {
+	// Descriptor is the descriptor of the converted layer.
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+
+	// Labels are the labels of the converted blob in the content store
+	// (e.g. "containerd.io/uncompressed").
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Option is an option of the cache.
+type Option func(*Cache)
+
+// WithFetcher makes the cache fetch converted blobs that aren't in the content store from
+// a registry (e.g. the repository where the result of the previous conversion is pushed).
+// Without this, such layers are converted again.
+func WithFetcher(f remotes.Fetcher) Option {
+	return func(c *Cache) {
+		c.fetcher = f
+	}
+}
+
+// WithTarget makes the cache push converted blobs to the repository of ref (the target of
+// the conversion) as soon as they are converted, and reuse converted blobs already pushed
+// there (e.g. by an interrupted conversion) without fetching them. Blobs are checked by
+// HEAD requests by digest. Blobs reused in this way aren't in the content store so images
+// referring to them must be converted and pushed through ContentStore.
+func WithTarget(resolver remotes.Resolver, ref string) Option {
+	return func(c *Cache) {
+		c.target, c.targetRef = resolver, ref
+	}
+}
+
+// Cache records results of conversion in a directory. Each result is keyed by the digest
+// of the source layer and the options of the conversion.
+type Cache struct {
+	dir     string
+	fetcher remotes.Fetcher
+
+	target    remotes.Resolver
+	targetRef string
+
+	// pushed are converted blobs found in the target repository but not in the content
+	// store.
+	pushed   map[digest.Digest]content.Info
+	pushedMu sync.Mutex
+}
+
+// NewCache returns a cache stored in the directory.
+func NewCache(dir string, opts ...Option) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir}
+	for _, o := range opts {
+		o(c)
+	}
+	return c, nil
+}
+
+// LayerConvertFunc wraps the layer converter with the cache. optsKey must identify the
+// options of the converter; layers converted with different optsKey never share results.
+func (c *Cache) LayerConvertFunc(optsKey string, f converter.ConvertFunc) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		key := digest.FromString(desc.Digest.String() + "\n" + optsKey)
+		if e, ok := c.get(ctx, key); ok {
+			err := c.ensureBlob(ctx, cs, e)
+			if err == nil {
+				log.G(ctx).WithField("digest", desc.Digest).Debugf("reusing converted layer %v", e.Descriptor.Digest)
+				newDesc := e.Descriptor
+				return &newDesc, nil
+			}
+			log.G(ctx).WithError(err).WithField("digest", desc.Digest).Debugf("cannot reuse converted layer; converting")
+		}
+		newDesc, err := f(ctx, cs, desc)
+		if err != nil || newDesc == nil {
+			return newDesc, err
+		}
+		info, err := cs.Info(ctx, newDesc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if c.target != nil {
+			// Push the blob before recording it so that the recorded blob can be found in
+			// the target repository if the conversion is interrupted.
+			if err := c.push(ctx, cs, *newDesc); err != nil {
+				return nil, fmt.Errorf("failed to push converted blob %v: %w", newDesc.Digest, err)
+			}
+		}
+		if err := c.put(key, entry{Descriptor: *newDesc, Labels: info.Labels}); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to record converted layer %v", newDesc.Digest)
+		}
+		return newDesc, nil
+	}
+}
+
+func (c *Cache) path(key digest.Digest) string {
+	return filepath.Join(c.dir, key.Encoded()+".json")
+}
+
+func (c *Cache) get(ctx context.Context, key digest.Digest) (e entry, ok bool) {
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.G(ctx).WithError(err).Warnf("failed to read conversion cache")
+		}
+		return entry{}, false
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		log.G(ctx).WithError(err).Warnf("broken conversion cache %q", c.path(key))
+		return entry{}, false
+	}
+	return e, true
+}
+
+func (c *Cache) put(key digest.Digest, e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it to avoid exposing a partially written entry.
+	tmp, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// ensureBlob makes sure that the converted blob is in the content store.
+func (c *Cache) ensureBlob(ctx context.Context, cs content.Store, e entry) error {
+	if _, err := cs.Info(ctx, e.Descriptor.Digest); err == nil {
+		return nil
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	if c.target != nil && c.existsInTarget(ctx, e.Descriptor) {
+		c.pushedMu.Lock()
+		if c.pushed == nil {
+			c.pushed = make(map[digest.Digest]content.Info)
+		}
+		c.pushed[e.Descriptor.Digest] = content.Info{
+			Digest: e.Descriptor.Digest,
+			Size:   e.Descriptor.Size,
+			Labels: e.Labels,
+		}
+		c.pushedMu.Unlock()
+		return nil
+	}
+	if c.fetcher == nil {
+		return fmt.Errorf("converted blob %v isn't in the content store", e.Descriptor.Digest)
+	}
+	rc, err := c.fetcher.Fetch(ctx, e.Descriptor)
+	if err != nil {
+		return fmt.Errorf("failed to fetch converted blob %v: %w", e.Descriptor.Digest, err)
+	}
+	defer rc.Close()
+	ref := fmt.Sprintf("convert-cache-%s", e.Descriptor.Digest)
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref), content.WithDescriptor(e.Descriptor))
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+	if err := content.Copy(ctx, w, rc, e.Descriptor.Size, e.Descriptor.Digest, content.WithLabels(e.Labels)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// existsInTarget checks whether the blob exists in the target repository.
+func (c *Cache) existsInTarget(ctx context.Context, desc ocispec.Descriptor) bool {
+	// The resolver sends HEAD requests for references by digest.
+	_, found, err := c.target.Resolve(ctx, repository(c.targetRef)+"@"+desc.Digest.String())
+	if err != nil {
+		if !errdefs.IsNotFound(err) {
+			log.G(ctx).WithError(err).Debugf("failed to check converted blob %v in the target", desc.Digest)
+		}
+		return false
+	}
+	return found.Digest == desc.Digest && found.Size == desc.Size
+}
+
+// push pushes the blob in the content store to the target repository.
+func (c *Cache) push(ctx context.Context, cs content.Store, desc ocispec.Descriptor) error {
+	pusher, err := c.target.Pusher(ctx, c.targetRef)
+	if err != nil {
+		return err
+	}
+	w, err := pusher.Push(ctx, desc)
+	if errdefs.IsAlreadyExists(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer w.Close()
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer ra.Close()
+	if err := content.Copy(ctx, w, content.NewReader(ra), desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// ContentStore returns the content store where converted blobs found in the target
+// repository (see WithTarget) exist without their contents, so that images referring to
+// them can be converted and pushed. Reading such blobs fails with errdefs.ErrNotFound.
+func (c *Cache) ContentStore(cs content.Store) content.Store {
+	return &targetStore{cs, c}
+}
+
+type targetStore struct {
+	content.Store
+	c *Cache
+}
+
+func (s *targetStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := s.Store.Info(ctx, dgst)
+	if errdefs.IsNotFound(err) {
+		s.c.pushedMu.Lock()
+		pushed, ok := s.c.pushed[dgst]
+		s.c.pushedMu.Unlock()
+		if ok {
+			return pushed, nil
+		}
+	}
+	return info, err
+}
+
+// repository returns the ref without the tag and the digest.
+func repository(ref string) string {
+	if i := strings.IndexByte(ref, '@'); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndexByte(ref, ':'); i > strings.LastIndexByte(ref, '/') {
+		ref = ref[:i]
+	}
+	return ref
+}
@@ -0,0 +1,301 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestLayerConvertFunc tests that layers converted once are reused.
+func TestLayerConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	cs, err := local.NewLabeledStore(filepath.Join(tmp, "content"), newMemoryLabelStore())
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+	c, err := NewCache(filepath.Join(tmp, "cache"))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	var converted int
+	convert := func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		converted++
+		b := []byte(fmt.Sprintf("converted-%s", desc.Digest))
+		newDesc := ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageLayerGzip,
+			Digest:      digest.FromBytes(b),
+			Size:        int64(len(b)),
+			Annotations: map[string]string{"test": "converted"},
+		}
+		if err := content.WriteBlob(ctx, cs, newDesc.Digest.String(), bytes.NewReader(b), newDesc,
+			content.WithLabels(map[string]string{labels.LabelUncompressed: "sha256:dummy"})); err != nil {
+			return nil, err
+		}
+		return &newDesc, nil
+	}
+	src := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("source"),
+		Size:      6,
+	}
+	check := func(name string, f func(context.Context, content.Store, ocispec.Descriptor) (*ocispec.Descriptor, error), wantConverted int) *ocispec.Descriptor {
+		newDesc, err := f(ctx, cs, src)
+		if err != nil {
+			t.Fatalf("%s: failed to convert: %v", name, err)
+		}
+		if newDesc.Annotations["test"] != "converted" {
+			t.Errorf("%s: annotations must be kept; got %v", name, newDesc.Annotations)
+		}
+		if converted != wantConverted {
+			t.Errorf("%s: converted %d times; want %d", name, converted, wantConverted)
+		}
+		return newDesc
+	}
+
+	first := check("first", c.LayerConvertFunc("opts1", convert), 1)
+	check("cached", c.LayerConvertFunc("opts1", convert), 1)
+	check("other options", c.LayerConvertFunc("opts2", convert), 2)
+
+	// Converted blob is removed from the content store. It must be converted again.
+	if err := cs.Delete(ctx, first.Digest); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	check("removed", c.LayerConvertFunc("opts1", convert), 3)
+
+	// Converted blob is available in the registry. It must be fetched instead.
+	if err := cs.Delete(ctx, first.Digest); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	c2, err := NewCache(filepath.Join(tmp, "cache"), WithFetcher(testFetcher{
+		first.Digest: []byte(fmt.Sprintf("converted-%s", src.Digest)),
+	}))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	check("fetched", c2.LayerConvertFunc("opts1", convert), 3)
+	info, err := cs.Info(ctx, first.Digest)
+	if err != nil {
+		t.Fatalf("fetched blob must be in the content store: %v", err)
+	}
+	if info.Labels[labels.LabelUncompressed] != "sha256:dummy" {
+		t.Errorf("labels of the fetched blob must be restored; got %v", info.Labels)
+	}
+}
+
+// memoryLabelStore keeps labels of contents in memory. Content stores without a label store
+// drop labels.
+type memoryLabelStore struct {
+	labels map[digest.Digest]map[string]string
+	mu     sync.Mutex
+}
+
+func newMemoryLabelStore() local.LabelStore {
+	return &memoryLabelStore{labels: make(map[digest.Digest]map[string]string)}
+}
+
+func (s *memoryLabelStore) Get(d digest.Digest) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.labels[d], nil
+}
+
+func (s *memoryLabelStore) Set(d digest.Digest, labels map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels[d] = labels
+	return nil
+}
+
+func (s *memoryLabelStore) Update(d digest.Digest, update map[string]string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	labels, ok := s.labels[d]
+	if !ok {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s.labels[d] = labels
+	return labels, nil
+}
+
+type testFetcher map[digest.Digest][]byte
+
+func (f testFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	b, ok := f[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%v not found", desc.Digest)
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// TestLayerConvertFuncWithTarget tests that converted layers are pushed to the target and
+// reused from there after the conversion is interrupted.
+func TestLayerConvertFuncWithTarget(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	cs, err := local.NewLabeledStore(filepath.Join(tmp, "content"), newMemoryLabelStore())
+	if err != nil {
+		t.Fatalf("failed to create content store: %v", err)
+	}
+	target := &testTarget{blobs: make(map[digest.Digest][]byte)}
+	c, err := NewCache(filepath.Join(tmp, "cache"), WithTarget(target, "example.com/foo:esgz"))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	var converted int
+	convert := func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		converted++
+		b := []byte(fmt.Sprintf("converted-%s", desc.Digest))
+		newDesc := ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(b),
+			Size:      int64(len(b)),
+		}
+		if err := content.WriteBlob(ctx, cs, newDesc.Digest.String(), bytes.NewReader(b), newDesc,
+			content.WithLabels(map[string]string{labels.LabelUncompressed: "sha256:dummy"})); err != nil {
+			return nil, err
+		}
+		return &newDesc, nil
+	}
+	src := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("source"),
+		Size:      6,
+	}
+
+	first, err := c.LayerConvertFunc("opts", convert)(ctx, c.ContentStore(cs), src)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if b, ok := target.blobs[first.Digest]; !ok || digest.FromBytes(b) != first.Digest {
+		t.Fatalf("converted blob must be pushed to the target")
+	}
+
+	// The conversion is interrupted and the converted blob is removed from the content
+	// store. It must be reused from the target without being converted.
+	if err := cs.Delete(ctx, first.Digest); err != nil {
+		t.Fatalf("failed to delete blob: %v", err)
+	}
+	c2, err := NewCache(filepath.Join(tmp, "cache"), WithTarget(target, "example.com/foo:esgz"))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	pushCS := c2.ContentStore(cs)
+	newDesc, err := c2.LayerConvertFunc("opts", convert)(ctx, pushCS, src)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if newDesc.Digest != first.Digest || converted != 1 {
+		t.Errorf("layer must be reused from the target; converted %d times", converted)
+	}
+	if _, err := cs.Info(ctx, first.Digest); !errdefs.IsNotFound(err) {
+		t.Errorf("reused blob must not be fetched; got %v", err)
+	}
+	info, err := pushCS.Info(ctx, first.Digest)
+	if err != nil {
+		t.Fatalf("reused blob must be visible through the content store: %v", err)
+	}
+	if info.Labels[labels.LabelUncompressed] != "sha256:dummy" {
+		t.Errorf("labels of the reused blob must be restored; got %v", info.Labels)
+	}
+}
+
+// testTarget is a registry storing blobs in memory.
+type testTarget struct {
+	blobs map[digest.Digest][]byte
+	mu    sync.Mutex
+}
+
+func (r *testTarget) Resolve(ctx context.Context, ref string) (string, ocispec.Descriptor, error) {
+	dgst, err := digest.Parse(ref[len(repository(ref))+1:])
+	if err != nil {
+		return "", ocispec.Descriptor{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.blobs[dgst]
+	if !ok {
+		return "", ocispec.Descriptor{}, fmt.Errorf("%v: %w", dgst, errdefs.ErrNotFound)
+	}
+	return ref, ocispec.Descriptor{Digest: dgst, Size: int64(len(b))}, nil
+}
+
+func (r *testTarget) Fetcher(ctx context.Context, ref string) (remotes.Fetcher, error) {
+	return nil, fmt.Errorf("fetcher: %w", errdefs.ErrNotImplemented)
+}
+
+func (r *testTarget) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {
+	return r, nil
+}
+
+func (r *testTarget) Push(ctx context.Context, desc ocispec.Descriptor) (content.Writer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.blobs[desc.Digest]; ok {
+		return nil, errdefs.ErrAlreadyExists
+	}
+	return &testWriter{r: r, digester: digest.Canonical.Digester()}, nil
+}
+
+type testWriter struct {
+	r        *testTarget
+	buf      bytes.Buffer
+	digester digest.Digester
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.digester.Hash().Write(p)
+	return w.buf.Write(p)
+}
+func (w *testWriter) Close() error          { return nil }
+func (w *testWriter) Digest() digest.Digest { return w.digester.Digest() }
+func (w *testWriter) Truncate(int64) error  { return errdefs.ErrNotImplemented }
+func (w *testWriter) Status() (content.Status, error) {
+	return content.Status{Offset: int64(w.buf.Len())}, nil
+}
+func (w *testWriter) Commit(ctx context.Context, size int64, expected digest.Digest, opts ...content.Opt) error {
+	if dgst := w.Digest(); dgst != expected {
+		return fmt.Errorf("unexpected digest %v; want %v", dgst, expected)
+	}
+	w.r.mu.Lock()
+	w.r.blobs[expected] = w.buf.Bytes()
+	w.r.mu.Unlock()
+	return nil
+}
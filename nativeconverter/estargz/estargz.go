@@ -17,6 +17,7 @@
 package estargz
 
 import (
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -30,6 +31,7 @@ import (
 	"github.com/containerd/containerd/labels"
 	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/util/ioutils"
+	"github.com/containerd/stargz-snapshotter/util/tracing"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -77,11 +79,15 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		}
 		defer ra.Close()
 		sr := io.NewSectionReader(ra, 0, desc.Size)
+		_, buildSpan := tracing.Start(ctx, "compress")
 		blob, err := estargz.Build(sr, append(opts, estargz.WithContext(ctx))...)
+		buildSpan.End(err)
 		if err != nil {
 			return nil, err
 		}
 		defer blob.Close()
+		_, writeSpan := tracing.Start(ctx, "write")
+		defer writeSpan.End(nil)
 		ref := fmt.Sprintf("convert-estargz-from-%s", desc.Digest)
 		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
 		if err != nil {
@@ -149,6 +155,110 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		}
 		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = blob.TOCDigest().String()
 		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", c.Size())
+		newDesc.Annotations[estargz.DiffIDAnnotation] = blob.DiffID().String()
+		return &newDesc, nil
+	}
+}
+
+// TOCConvertFunc converts the encoding of the TOC of gzip-based eStargz layers to the
+// binary format (binaryTOC=true) or to JSON. Only the TOC and the footer are rewritten and
+// file contents are kept as-is. Layers that aren't eStargz (i.e. without the TOC digest
+// annotation) are left unchanged.
+func TOCConvertFunc(binaryTOC bool) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) || uncompress.IsUncompressedType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		if _, ok := desc.Annotations[estargz.TOCJSONDigestAnnotation]; !ok {
+			return nil, nil
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		labelz := info.Labels
+		if labelz == nil {
+			labelz = make(map[string]string)
+		}
+
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		gc := estargz.NewGzipCompressor()
+		if binaryTOC {
+			gc = estargz.NewGzipCompressorWithBinaryTOC(gzip.BestCompression)
+		}
+		blob, tocDgst, err := estargz.ConvertTOC(io.NewSectionReader(ra, 0, desc.Size), gc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert TOC of %v: %w", desc.Digest, err)
+		}
+		ref := fmt.Sprintf("convert-estargz-toc-from-%s", desc.Digest)
+		w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		// Reset the writing position
+		// Old writer possibly remains without aborted
+		// (e.g. conversion interrupted by a signal)
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+
+		// Copy and count the contents. DiffID changes because the TOC is a tar entry.
+		pr, pw := io.Pipe()
+		c := new(ioutils.CountWriter)
+		diffID := digest.Canonical.Digester()
+		doneCount := make(chan error, 1)
+		go func() {
+			defer pr.Close()
+			zr, err := gzip.NewReader(pr)
+			if err != nil {
+				pr.CloseWithError(err)
+				doneCount <- err
+				return
+			}
+			defer zr.Close()
+			if _, err := io.Copy(io.MultiWriter(c, diffID.Hash()), zr); err != nil {
+				pr.CloseWithError(err)
+				doneCount <- err
+				return
+			}
+			doneCount <- nil
+		}()
+		n, err := io.Copy(w, io.TeeReader(blob, pw))
+		if err != nil {
+			return nil, err
+		}
+		if err := pw.Close(); err != nil {
+			return nil, err
+		}
+		if err := <-doneCount; err != nil {
+			return nil, fmt.Errorf("failed to decompress converted layer: %w", err)
+		}
+
+		// update diffID label
+		labelz[labels.LabelUncompressed] = diffID.Digest().String()
+		if err = w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		newDesc := desc
+		newDesc.Digest = w.Digest()
+		newDesc.Size = n
+		newDesc.Annotations = make(map[string]string, len(desc.Annotations))
+		for k, v := range desc.Annotations {
+			newDesc.Annotations[k] = v
+		}
+		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = tocDgst.String()
+		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", c.Size())
+		newDesc.Annotations[estargz.DiffIDAnnotation] = diffID.Digest().String()
 		return &newDesc, nil
 	}
 }
@@ -0,0 +1,178 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	distribution "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/nativeconverter/cache"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	zstdchunkedconvert "github.com/containerd/stargz-snapshotter/nativeconverter/zstdchunked"
+	"github.com/containerd/stargz-snapshotter/version"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// registryConverter converts images fetched from registries and pushes the results.
+type registryConverter struct {
+	resolver remotes.Resolver
+	root     string
+}
+
+// NewRegistryConverter returns a converter accessing registries with the resolver. Contents
+// of images are stored under root only during each conversion. Converted layers are
+// recorded under root and reused from the target repository when the same source layer is
+// converted again (e.g. the base layers of a new version of the source image).
+func NewRegistryConverter(resolver remotes.Resolver, root string) (Converter, error) {
+	if err := os.MkdirAll(filepath.Join(root, "cache"), 0700); err != nil {
+		return nil, err
+	}
+	return &registryConverter{resolver: resolver, root: root}, nil
+}
+
+func (c *registryConverter) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	ref, err := normalizeRef(ref)
+	if err != nil {
+		return "", err
+	}
+	_, desc, err := c.resolver.Resolve(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+func (c *registryConverter) Convert(ctx context.Context, src, target string, opts ConvertOptions) (digest.Digest, error) {
+	src, err := normalizeRef(src)
+	if err != nil {
+		return "", err
+	}
+	target, err = normalizeRef(target)
+	if err != nil {
+		return "", err
+	}
+	var layerConvertFunc converter.ConvertFunc
+	switch opts.Format {
+	case FormatEStargz:
+		layerConvertFunc = estargzconvert.LayerConvertFunc()
+	case FormatZstdChunked:
+		layerConvertFunc = zstdchunkedconvert.LayerConvertFunc()
+	default:
+		return "", fmt.Errorf("unknown format %q", opts.Format)
+	}
+	platformMC := platforms.All
+	if len(opts.Platforms) > 0 {
+		var all []ocispec.Platform
+		for _, ps := range opts.Platforms {
+			p, err := platforms.Parse(ps)
+			if err != nil {
+				return "", fmt.Errorf("invalid platform %q: %w", ps, err)
+			}
+			all = append(all, p)
+		}
+		platformMC = platforms.Ordered(all...)
+	}
+
+	tmpDir, err := os.MkdirTemp(c.root, "convert-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+	cs, err := local.NewStore(tmpDir)
+	if err != nil {
+		return "", err
+	}
+
+	name, desc, err := c.resolver.Resolve(ctx, src)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %q: %w", src, err)
+	}
+	fetcher, err := c.resolver.Fetcher(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	fetch := remotes.FetchHandler(cs, fetcher)
+	if err := images.Dispatch(ctx, images.Handlers(
+		images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			if images.IsLayerType(desc.MediaType) {
+				return nil, nil // fetched on conversion unless the converted layer is reused
+			}
+			return fetch(ctx, desc)
+		}),
+		images.FilterPlatforms(images.ChildrenHandler(cs), platformMC),
+	), nil, desc); err != nil {
+		return "", fmt.Errorf("failed to fetch %q: %w", src, err)
+	}
+
+	// Converted layers are pushed as soon as they are converted so that an interrupted
+	// conversion (e.g. by restarting the controller) is resumed.
+	lc, err := cache.NewCache(filepath.Join(c.root, "cache"), cache.WithTarget(c.resolver, target))
+	if err != nil {
+		return "", err
+	}
+	pushCS := lc.ContentStore(cs)
+	optsKey := strings.Join([]string{version.Version, version.Revision, opts.Format}, "\n")
+	layerConvertFunc = lc.LayerConvertFunc(optsKey, fetchLayerFunc(fetch, layerConvertFunc))
+	newDesc, err := converter.DefaultIndexConvertFunc(layerConvertFunc, true, platformMC)(ctx, pushCS, desc)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert %q: %w", src, err)
+	}
+	if newDesc == nil {
+		newDesc = &desc
+	}
+	pusher, err := c.resolver.Pusher(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	if err := remotes.PushContent(ctx, pusher, *newDesc, pushCS, nil, platformMC, nil); err != nil {
+		return "", fmt.Errorf("failed to push %q: %w", target, err)
+	}
+	return newDesc.Digest, nil
+}
+
+// fetchLayerFunc fetches the layer to the content store before converting it.
+func fetchLayerFunc(fetch images.HandlerFunc, f converter.ConvertFunc) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if images.IsLayerType(desc.MediaType) {
+			if _, err := fetch(ctx, desc); err != nil {
+				return nil, fmt.Errorf("failed to fetch layer %v: %w", desc.Digest, err)
+			}
+		}
+		return f(ctx, cs, desc)
+	}
+}
+
+// normalizeRef returns the fully qualified reference (e.g. "docker.io/library/ubuntu:latest"
+// for "ubuntu").
+func normalizeRef(ref string) (string, error) {
+	named, err := distribution.ParseDockerRef(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %q: %w", ref, err)
+	}
+	return named.String(), nil
+}
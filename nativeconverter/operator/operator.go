@@ -0,0 +1,374 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package operator provides a Kubernetes controller keeping eStargz (or zstd:chunked)
+// variants of images. Images are listed in ImageConversion custom resources. The
+// controller converts each source image when it changes, pushes the result to the target
+// reference and records the digests in the status of the resource.
+package operator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	digest "github.com/opencontainers/go-digest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// Group is the API group of ImageConversion.
+	Group = "stargz.containerd.io"
+
+	// Version is the API version of ImageConversion.
+	Version = "v1alpha1"
+
+	// Kind is the kind of the custom resource listing images to keep converted.
+	Kind = "ImageConversion"
+)
+
+// Resource is the resource of ImageConversion.
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "imageconversions"}
+
+// Formats of converted layers.
+const (
+	FormatEStargz     = "estargz"
+	FormatZstdChunked = "zstdchunked"
+)
+
+// Spec is the spec of ImageConversion.
+type Spec struct {
+	// Images are the images to keep converted.
+	Images []ImageSpec `json:"images"`
+
+	// Format is the format of converted layers, FormatEStargz (default) or
+	// FormatZstdChunked.
+	Format string `json:"format,omitempty"`
+
+	// Platforms are the platforms (e.g. "linux/amd64") included in the converted images.
+	// Empty includes all platforms.
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// ImageSpec is an image to keep converted.
+type ImageSpec struct {
+	// Source is the reference of the image to convert.
+	Source string `json:"source"`
+
+	// Target is the reference where the converted image is pushed.
+	Target string `json:"target"`
+}
+
+// Status is the status of ImageConversion.
+type Status struct {
+	// ObservedGeneration is the generation of the spec reflected to the status.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Images are the status of the images in the spec.
+	Images []ImageStatus `json:"images,omitempty"`
+}
+
+// ImageStatus is the status of an image in the spec.
+type ImageStatus struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+
+	// SourceDigest is the digest of the source image converted last.
+	SourceDigest digest.Digest `json:"sourceDigest,omitempty"`
+
+	// TargetDigest is the digest of the converted image pushed to the target.
+	TargetDigest digest.Digest `json:"targetDigest,omitempty"`
+
+	// Format and Platforms are the options of the last conversion.
+	Format    string   `json:"format,omitempty"`
+	Platforms []string `json:"platforms,omitempty"`
+
+	// LastConversionTime is the time of the last conversion in RFC 3339.
+	LastConversionTime string `json:"lastConversionTime,omitempty"`
+
+	// Error is the error of the last attempt. Empty if the target is up to date.
+	Error string `json:"error,omitempty"`
+}
+
+// ConvertOptions are the options of a conversion.
+type ConvertOptions struct {
+	Format    string
+	Platforms []string
+}
+
+// Converter converts images in registries.
+type Converter interface {
+	// Resolve returns the digest of the image referred by ref.
+	Resolve(ctx context.Context, ref string) (digest.Digest, error)
+
+	// Convert converts the image src, pushes it to target and returns the digest of the
+	// pushed image.
+	Convert(ctx context.Context, src, target string, opts ConvertOptions) (digest.Digest, error)
+}
+
+// Option is an option of the controller.
+type Option func(*Controller)
+
+// WithNamespace makes the controller watch ImageConversion only in the namespace. By
+// default, all namespaces are watched.
+func WithNamespace(ns string) Option {
+	return func(c *Controller) {
+		c.namespace = ns
+	}
+}
+
+// WithResyncPeriod makes the controller check all images at the interval to convert
+// source images updated in the registries (e.g. a tag pointing to a new image).
+func WithResyncPeriod(d time.Duration) Option {
+	return func(c *Controller) {
+		c.resync = d
+	}
+}
+
+// Controller converts images listed in ImageConversion.
+type Controller struct {
+	client    dynamic.Interface
+	converter Converter
+	namespace string
+	resync    time.Duration
+	now       func() time.Time
+
+	informer cache.SharedIndexInformer
+	queue    workqueue.RateLimitingInterface
+}
+
+// NewController returns a controller converting images with the converter.
+func NewController(client dynamic.Interface, converter Converter, opts ...Option) *Controller {
+	c := &Controller{
+		client:    client,
+		converter: converter,
+		namespace: metav1.NamespaceAll,
+		now:       time.Now,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	return c
+}
+
+// Run runs the controller with the number of workers until ctx is canceled. Failed
+// conversions are retried with exponential backoff.
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	// don't let panics crash the process
+	defer utilruntime.HandleCrash()
+
+	c.informer = cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return c.client.Resource(Resource).Namespace(c.namespace).List(ctx, options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return c.client.Resource(Resource).Namespace(c.namespace).Watch(ctx, options)
+			},
+		},
+		&unstructured.Unstructured{},
+		c.resync,
+		cache.Indexers{},
+	)
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.queue.ShutDown()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			o, n := old.(*unstructured.Unstructured), new.(*unstructured.Unstructured)
+			if o.GetResourceVersion() != n.GetResourceVersion() && o.GetGeneration() == n.GetGeneration() {
+				return // only the status is updated; resyncs keep the version
+			}
+			c.enqueue(new)
+		},
+	})
+	go c.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
+		return fmt.Errorf("timed out for syncing cache")
+	}
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for c.processNextItem(ctx) {
+				// continue looping
+			}
+		}, time.Second, ctx.Done())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err == nil {
+		c.queue.Add(key)
+	}
+}
+
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key.(string))
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to get object; don't sync %q: %v", key, err))
+		return true
+	}
+	if !exists {
+		// Converted images are left in the registries.
+		c.queue.Forget(key)
+		return true
+	}
+	if err := c.reconcile(ctx, obj.(*unstructured.Unstructured).DeepCopy()); err != nil {
+		log.G(ctx).WithError(err).WithField("key", key).Warn("failed to reconcile; retrying")
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile converts the images of the ImageConversion that aren't up to date and updates
+// its status.
+func (c *Controller) reconcile(ctx context.Context, obj *unstructured.Unstructured) error {
+	var spec Spec
+	if err := fromUnstructured(obj, "spec", &spec); err != nil {
+		return fmt.Errorf("invalid spec: %w", err)
+	}
+	var status Status
+	if err := fromUnstructured(obj, "status", &status); err != nil {
+		log.G(ctx).WithError(err).Warnf("ignoring broken status of %s/%s", obj.GetNamespace(), obj.GetName())
+		status = Status{}
+	}
+	opts := ConvertOptions{Format: spec.Format, Platforms: spec.Platforms}
+	if opts.Format == "" {
+		opts.Format = FormatEStargz
+	}
+
+	prev := make(map[ImageSpec]ImageStatus)
+	for _, s := range status.Images {
+		prev[ImageSpec{Source: s.Source, Target: s.Target}] = s
+	}
+	newStatus := Status{ObservedGeneration: obj.GetGeneration()}
+	var failed []string
+	for _, img := range spec.Images {
+		st, err := c.reconcileImage(ctx, img, prev[img], opts)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("source", img.Source).WithField("target", img.Target).Warn("failed to convert image")
+			failed = append(failed, img.Source)
+		}
+		newStatus.Images = append(newStatus.Images, st)
+	}
+
+	if !reflect.DeepEqual(status, newStatus) {
+		u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&newStatus)
+		if err != nil {
+			return err
+		}
+		obj.Object["status"] = u
+		if _, err := c.client.Resource(Resource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update status: %w", err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to convert %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// reconcileImage converts the image if the target isn't converted from the current source
+// image with the options.
+func (c *Controller) reconcileImage(ctx context.Context, img ImageSpec, prev ImageStatus, opts ConvertOptions) (ImageStatus, error) {
+	st := prev
+	st.Source, st.Target = img.Source, img.Target
+	srcDgst, err := c.converter.Resolve(ctx, img.Source)
+	if err != nil {
+		st.Error = fmt.Sprintf("failed to resolve source: %v", err)
+		return st, err
+	}
+	if c.upToDate(ctx, st, srcDgst, opts) {
+		st.Error = ""
+		return st, nil
+	}
+	// Pin the source so that the recorded digest is the converted one even if the tag is
+	// updated during the conversion.
+	dgst, err := c.converter.Convert(ctx, pinDigest(img.Source, srcDgst), img.Target, opts)
+	if err != nil {
+		st.Error = err.Error()
+		return st, err
+	}
+	return ImageStatus{
+		Source:             img.Source,
+		Target:             img.Target,
+		SourceDigest:       srcDgst,
+		TargetDigest:       dgst,
+		Format:             opts.Format,
+		Platforms:          opts.Platforms,
+		LastConversionTime: c.now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// upToDate reports whether the target is converted from the source image of srcDgst with
+// the options and isn't overwritten since then.
+func (c *Controller) upToDate(ctx context.Context, st ImageStatus, srcDgst digest.Digest, opts ConvertOptions) bool {
+	if st.SourceDigest != srcDgst || st.TargetDigest == "" || st.Format != opts.Format || !equalStrings(st.Platforms, opts.Platforms) {
+		return false
+	}
+	dgst, err := c.converter.Resolve(ctx, st.Target)
+	return err == nil && dgst == st.TargetDigest
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pinDigest adds the digest to the reference unless it already refers to a digest.
+func pinDigest(ref string, dgst digest.Digest) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	return ref + "@" + dgst.String()
+}
+
+func fromUnstructured(obj *unstructured.Unstructured, field string, v interface{}) error {
+	m, ok, err := unstructured.NestedMap(obj.Object, field)
+	if err != nil || !ok {
+		return err
+	}
+	return runtime.DefaultUnstructuredConverter.FromUnstructured(m, v)
+}
@@ -0,0 +1,151 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func TestReconcile(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		srcA   = "registry.example.com/a:latest"
+		srcB   = "registry.example.com/b:latest"
+		dstA   = "registry.example.com/a:esgz"
+		dstB   = "registry.example.com/b:esgz"
+		conv   = &testConverter{digests: map[string]digest.Digest{srcA: digest.FromString("a1"), srcB: digest.FromString("b1")}}
+		obj    = newImageConversion(srcA, dstA, srcB, dstB)
+		client = fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{Resource: Kind + "List"}, obj)
+		c = NewController(client, conv)
+	)
+	c.now = func() time.Time { return time.Unix(0, 0) }
+
+	reconcile := func(name string, wantConverted []string, wantErr bool) Status {
+		conv.converted = nil
+		cur, err := client.Resource(Resource).Namespace("default").Get(ctx, "test", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: failed to get object: %v", name, err)
+		}
+		if err := c.reconcile(ctx, cur); (err != nil) != wantErr {
+			t.Fatalf("%s: reconcile error = %v; want error %v", name, err, wantErr)
+		}
+		if fmt.Sprint(conv.converted) != fmt.Sprint(wantConverted) {
+			t.Errorf("%s: converted %v; want %v", name, conv.converted, wantConverted)
+		}
+		cur, err = client.Resource(Resource).Namespace("default").Get(ctx, "test", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: failed to get object: %v", name, err)
+		}
+		var status Status
+		if err := fromUnstructured(cur, "status", &status); err != nil {
+			t.Fatalf("%s: failed to get status: %v", name, err)
+		}
+		if len(status.Images) != 2 {
+			t.Fatalf("%s: status of %d images; want 2", name, len(status.Images))
+		}
+		return status
+	}
+
+	status := reconcile("initial", []string{pinDigest(srcA, conv.digests[srcA]), pinDigest(srcB, conv.digests[srcB])}, false)
+	for _, st := range status.Images {
+		if st.SourceDigest != conv.digests[st.Source] || st.TargetDigest != conv.digests[st.Target] ||
+			st.Format != FormatEStargz || st.LastConversionTime != "1970-01-01T00:00:00Z" || st.Error != "" {
+			t.Errorf("initial: unexpected status %+v", st)
+		}
+	}
+
+	reconcile("up-to-date", nil, false)
+
+	conv.digests[srcA] = digest.FromString("a2")
+	status = reconcile("source-updated", []string{pinDigest(srcA, conv.digests[srcA])}, false)
+	if st := status.Images[0]; st.SourceDigest != conv.digests[srcA] {
+		t.Errorf("source-updated: source digest %v; want %v", st.SourceDigest, conv.digests[srcA])
+	}
+
+	conv.digests[dstB] = digest.FromString("overwritten")
+	reconcile("target-overwritten", []string{pinDigest(srcB, conv.digests[srcB])}, false)
+
+	conv.digests[srcA] = digest.FromString("a3")
+	conv.fail = map[string]bool{dstA: true}
+	status = reconcile("failure", []string{pinDigest(srcA, conv.digests[srcA])}, true)
+	if st := status.Images[0]; st.Error == "" || st.SourceDigest != digest.FromString("a2") {
+		t.Errorf("failure: unexpected status %+v", st)
+	}
+	if st := status.Images[1]; st.Error != "" {
+		t.Errorf("failure: unexpected error of other image %+v", st)
+	}
+
+	conv.fail = nil
+	status = reconcile("recovered", []string{pinDigest(srcA, conv.digests[srcA])}, false)
+	if st := status.Images[0]; st.Error != "" {
+		t.Errorf("recovered: unexpected error %+v", st)
+	}
+}
+
+func newImageConversion(refs ...string) *unstructured.Unstructured {
+	var images []interface{}
+	for i := 0; i+1 < len(refs); i += 2 {
+		images = append(images, map[string]interface{}{"source": refs[i], "target": refs[i+1]})
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Group + "/" + Version,
+		"kind":       Kind,
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      "test",
+		},
+		"spec": map[string]interface{}{
+			"images": images,
+		},
+	}}
+}
+
+// testConverter "converts" images by recording the digest of the target.
+type testConverter struct {
+	digests   map[string]digest.Digest
+	fail      map[string]bool
+	converted []string
+}
+
+func (c *testConverter) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	dgst, ok := c.digests[ref]
+	if !ok {
+		return "", fmt.Errorf("%q not found", ref)
+	}
+	return dgst, nil
+}
+
+func (c *testConverter) Convert(ctx context.Context, src, target string, opts ConvertOptions) (digest.Digest, error) {
+	c.converted = append(c.converted, src)
+	if c.fail[target] {
+		return "", fmt.Errorf("failed to push %q", target)
+	}
+	dgst := digest.FromString(src + "\n" + opts.Format)
+	c.digests[target] = dgst
+	return dgst, nil
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ChunkList is the lists of chunk digests of layers of an image. This is exported for
+// tools outside of the snapshotter (e.g. cache preloaders, syncers and CDN warmers) to
+// find chunks shared among layers of versions of images.
+type ChunkList struct {
+	Layers []LayerChunks `json:"layers"`
+}
+
+// LayerChunks is the list of chunks of a layer.
+type LayerChunks struct {
+	Digest digest.Digest `json:"digest"`
+
+	// Chunks is the chunks of regular files in the order of their offsets in the blob.
+	// This is empty if the layer isn't eStargz.
+	Chunks []estargz.Chunk `json:"chunks,omitempty"`
+}
+
+// ComputeChunkList returns the lists of chunks of layers of the image. If target is an
+// index, the manifest matching the platform is used.
+func ComputeChunkList(ctx context.Context, cs content.Store, target ocispec.Descriptor, platform platforms.MatchComparer) (*ChunkList, error) {
+	mfstDesc, err := manifestDesc(ctx, cs, target, platform)
+	if err != nil {
+		return nil, err
+	}
+	b, err := content.ReadBlob(ctx, cs, mfstDesc)
+	if err != nil {
+		return nil, err
+	}
+	var mfst ocispec.Manifest
+	if err := json.Unmarshal(b, &mfst); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %v: %w", mfstDesc.Digest, err)
+	}
+	var l ChunkList
+	for _, desc := range mfst.Layers {
+		lc := LayerChunks{Digest: desc.Digest}
+		r, done, err := openLayer(ctx, cs, desc)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("layer %v isn't eStargz", desc.Digest)
+		} else {
+			lc.Chunks = r.Chunks()
+			if err := done(); err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to close layer %v", desc.Digest)
+			}
+		}
+		l.Layers = append(l.Layers, lc)
+	}
+	return &l, nil
+}
@@ -0,0 +1,406 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package stats computes statistics of eStargz layers of images (e.g. chunk sizes, prefetch
+// coverage and deduplication potential) and publishes them to registries as an artifact
+// referring to the image, so that registry UIs can show how images are ready for lazy pulling.
+package stats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// ArtifactType is the artifact type of the manifest of the stats.
+	ArtifactType = "application/vnd.stargz.stats.v1+json"
+
+	// mediaTypeEmpty is the media type of the empty config of artifacts.
+	mediaTypeEmpty = "application/vnd.oci.empty.v1+json"
+
+	// maxSize limits the size of manifests and the stats fetched from registries.
+	maxSize = 4 << 20
+)
+
+// Image is statistics of layers of an image.
+type Image struct {
+	Layers []Layer `json:"layers"`
+}
+
+// Layer is statistics of a layer.
+type Layer struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType"`
+
+	// Stats is nil if the layer isn't eStargz.
+	Stats *estargz.LayerStats `json:"stats,omitempty"`
+}
+
+// descriptor is a descriptor including the artifact type.
+type descriptor struct {
+	MediaType    string        `json:"mediaType"`
+	ArtifactType string        `json:"artifactType,omitempty"`
+	Digest       digest.Digest `json:"digest"`
+	Size         int64         `json:"size"`
+}
+
+// manifest is an artifact manifest referring to the subject.
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	ArtifactType  string       `json:"artifactType"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers"`
+	Subject       *descriptor  `json:"subject,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+// Compute computes the statistics of layers of the image. If target is an index, the
+// manifest matching the platform is used. This also returns the descriptor of the manifest.
+func Compute(ctx context.Context, cs content.Store, target ocispec.Descriptor, platform platforms.MatchComparer) (*Image, ocispec.Descriptor, error) {
+	mfstDesc, err := manifestDesc(ctx, cs, target, platform)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	b, err := content.ReadBlob(ctx, cs, mfstDesc)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	var mfst ocispec.Manifest
+	if err := json.Unmarshal(b, &mfst); err != nil {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("failed to parse manifest %v: %w", mfstDesc.Digest, err)
+	}
+	var img Image
+	for _, desc := range mfst.Layers {
+		l := Layer{Digest: desc.Digest, MediaType: desc.MediaType}
+		s, err := layerStats(ctx, cs, desc)
+		if err != nil {
+			log.G(ctx).WithError(err).Debugf("layer %v isn't eStargz", desc.Digest)
+		} else {
+			l.Stats = s
+		}
+		img.Layers = append(img.Layers, l)
+	}
+	return &img, mfstDesc, nil
+}
+
+func layerStats(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*estargz.LayerStats, error) {
+	r, done, err := openLayer(ctx, cs, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	s := r.Stats()
+	return &s, nil
+}
+
+// openLayer opens the eStargz layer in the content store. The returned function must be
+// called after using the reader.
+func openLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*estargz.Reader, func() error, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, desc.Size),
+		estargz.WithDecompressors(new(zstdchunked.Decompressor), new(uncompressed.Decompressor)))
+	if err != nil {
+		ra.Close()
+		return nil, nil, err
+	}
+	return r, ra.Close, nil
+}
+
+func manifestDesc(ctx context.Context, cs content.Store, target ocispec.Descriptor, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	switch target.MediaType {
+	case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+		return target, nil
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("unsupported media type %q: %w", target.MediaType, errdefs.ErrNotImplemented)
+	}
+	b, err := content.ReadBlob(ctx, cs, target)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	found, err := selectManifest(b, target.Digest, platform)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return manifestDesc(ctx, cs, found, platform)
+}
+
+// Push pushes the statistics to the repository of ref as an artifact referring to the
+// manifest specified by subject. The artifact is also listed in the index tagged with the
+// referrers tag schema ("sha256-<digest>") for registries that don't support the
+// referrers API. This returns the descriptor of the artifact manifest.
+func Push(ctx context.Context, resolver remotes.Resolver, ref string, subject ocispec.Descriptor, img *Image) (ocispec.Descriptor, error) {
+	repo := repository(ref)
+	statsJSON, err := json.Marshal(img)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	config := []byte("{}")
+	mfst := manifest{
+		SchemaVersion: 2,
+		MediaType:     ocispec.MediaTypeImageManifest,
+		ArtifactType:  ArtifactType,
+		Config:        descriptor{MediaType: mediaTypeEmpty, Digest: digest.FromBytes(config), Size: int64(len(config))},
+		Layers:        []descriptor{{MediaType: ArtifactType, Digest: digest.FromBytes(statsJSON), Size: int64(len(statsJSON))}},
+		Subject:       &descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+	}
+	mfstJSON, err := json.Marshal(mfst)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	mfstDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(mfstJSON), Size: int64(len(mfstJSON))}
+
+	pusher, err := resolver.Pusher(ctx, repo+"@"+mfstDesc.Digest.String())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for _, blob := range []struct {
+		desc descriptor
+		b    []byte
+	}{
+		{mfst.Config, config},
+		{mfst.Layers[0], statsJSON},
+	} {
+		desc := ocispec.Descriptor{MediaType: blob.desc.MediaType, Digest: blob.desc.Digest, Size: blob.desc.Size}
+		if err := push(ctx, pusher, desc, blob.b); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to push blob %v: %w", desc.Digest, err)
+		}
+	}
+	if err := push(ctx, pusher, mfstDesc, mfstJSON); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to push manifest %v: %w", mfstDesc.Digest, err)
+	}
+
+	// Update the index of the referrers tag schema.
+	tagRef := repo + ":" + referrersTag(subject.Digest)
+	idx := index{SchemaVersion: 2, MediaType: ocispec.MediaTypeImageIndex}
+	if b, _, err := fetch(ctx, resolver, tagRef); err == nil {
+		if err := json.Unmarshal(b, &idx); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to parse referrers index of %v: %w", subject.Digest, err)
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return ocispec.Descriptor{}, err
+	}
+	var manifests []descriptor
+	for _, m := range idx.Manifests {
+		if m.ArtifactType != ArtifactType {
+			manifests = append(manifests, m) // replace the stats pushed before
+		}
+	}
+	idx.Manifests = append(manifests, descriptor{MediaType: mfstDesc.MediaType, ArtifactType: ArtifactType, Digest: mfstDesc.Digest, Size: mfstDesc.Size})
+	idxJSON, err := json.Marshal(idx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	tagPusher, err := resolver.Pusher(ctx, tagRef)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	idxDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: digest.FromBytes(idxJSON), Size: int64(len(idxJSON))}
+	if err := push(ctx, tagPusher, idxDesc, idxJSON); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to push referrers index of %v: %w", subject.Digest, err)
+	}
+	return mfstDesc, nil
+}
+
+// Fetch fetches the statistics referring to the manifest specified by subject from the
+// repository of ref. errdefs.ErrNotFound is returned if no statistics is published.
+func Fetch(ctx context.Context, resolver remotes.Resolver, ref string, subject digest.Digest) (*Image, error) {
+	repo := repository(ref)
+	b, _, err := fetch(ctx, resolver, repo+":"+referrersTag(subject))
+	if err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse referrers index of %v: %w", subject, err)
+	}
+	for i := len(idx.Manifests) - 1; i >= 0; i-- {
+		m := idx.Manifests[i]
+		if m.ArtifactType != ArtifactType {
+			continue
+		}
+		b, _, err := fetch(ctx, resolver, repo+"@"+m.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		var mfst manifest
+		if err := json.Unmarshal(b, &mfst); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %v: %w", m.Digest, err)
+		}
+		for _, l := range mfst.Layers {
+			if l.MediaType != ArtifactType {
+				continue
+			}
+			b, err := fetchBlob(ctx, resolver, repo, l)
+			if err != nil {
+				return nil, err
+			}
+			var img Image
+			if err := json.Unmarshal(b, &img); err != nil {
+				return nil, fmt.Errorf("failed to parse stats %v: %w", l.Digest, err)
+			}
+			return &img, nil
+		}
+	}
+	return nil, fmt.Errorf("no stats refers to %v: %w", subject, errdefs.ErrNotFound)
+}
+
+// Resolve resolves ref in the registry to the manifest matching the platform.
+func Resolve(ctx context.Context, resolver remotes.Resolver, ref string, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	b, desc, err := fetch(ctx, resolver, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	for {
+		switch desc.MediaType {
+		case images.MediaTypeDockerSchema2Manifest, ocispec.MediaTypeImageManifest:
+			return desc, nil
+		case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+		default:
+			return ocispec.Descriptor{}, fmt.Errorf("unsupported media type %q: %w", desc.MediaType, errdefs.ErrNotImplemented)
+		}
+		found, err := selectManifest(b, desc.Digest, platform)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if b, _, err = fetch(ctx, resolver, repository(ref)+"@"+found.Digest.String()); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		desc = found
+	}
+}
+
+// selectManifest returns the manifest in the index that matches the platform best.
+func selectManifest(b []byte, dgst digest.Digest, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var idx ocispec.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse index %v: %w", dgst, err)
+	}
+	var found *ocispec.Descriptor
+	for i, m := range idx.Manifests {
+		if m.Platform == nil || !platform.Match(*m.Platform) {
+			continue
+		}
+		if found == nil || platform.Less(*m.Platform, *found.Platform) {
+			found = &idx.Manifests[i]
+		}
+	}
+	if found == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("no manifest matches the platform in %v: %w", dgst, errdefs.ErrNotFound)
+	}
+	return *found, nil
+}
+
+func push(ctx context.Context, pusher remotes.Pusher, desc ocispec.Descriptor, b []byte) error {
+	w, err := pusher.Push(ctx, desc)
+	if errdefs.IsAlreadyExists(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if err := w.Commit(ctx, desc.Size, desc.Digest); err != nil && !errdefs.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+func fetch(ctx context.Context, resolver remotes.Resolver, ref string) ([]byte, ocispec.Descriptor, error) {
+	name, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	if desc.Size > maxSize {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("manifest %v is too large (%d bytes)", desc.Digest, desc.Size)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	b, err := readAll(ctx, fetcher, desc)
+	return b, desc, err
+}
+
+func fetchBlob(ctx context.Context, resolver remotes.Resolver, repo string, d descriptor) ([]byte, error) {
+	if d.Size > maxSize {
+		return nil, fmt.Errorf("stats %v is too large (%d bytes)", d.Digest, d.Size)
+	}
+	fetcher, err := resolver.Fetcher(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return readAll(ctx, fetcher, ocispec.Descriptor{MediaType: d.MediaType, Digest: d.Digest, Size: d.Size})
+}
+
+func readAll(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(rc, desc.Size)); err != nil {
+		return nil, err
+	}
+	if dgst := digest.FromBytes(buf.Bytes()); dgst != desc.Digest {
+		return nil, fmt.Errorf("unexpected digest %v; want %v", dgst, desc.Digest)
+	}
+	return buf.Bytes(), nil
+}
+
+// repository returns the ref without the tag and the digest.
+func repository(ref string) string {
+	if i := strings.IndexByte(ref, '@'); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndexByte(ref, ':'); i > strings.LastIndexByte(ref, '/') {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// referrersTag returns the tag of the referrers tag schema.
+func referrersTag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1)
+}
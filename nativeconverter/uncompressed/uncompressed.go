@@ -0,0 +1,175 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package uncompressed
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type options struct {
+	chunkSize int
+	cdc       bool
+}
+
+// Option is an option of the conversion.
+type Option func(o *options) error
+
+// WithChunkSize option specifies the chunk size of eStargz layer to build.
+func WithChunkSize(chunkSize int) Option {
+	return func(o *options) error {
+		o.chunkSize = chunkSize
+		return nil
+	}
+}
+
+// WithContentDefinedChunking option decides boundaries of chunks by their contents.
+// The chunk size specified by WithChunkSize is used as the average chunk size.
+func WithContentDefinedChunking() Option {
+	return func(o *options) error {
+		o.cdc = true
+		return nil
+	}
+}
+
+// LayerConvertFunc converts tar(.gz) layers into uncompressed eStargz layers. The tar
+// archive is kept as-is and the TOC and the footer are appended after the end of the
+// archive so the layer can be lazily pulled without decompression. The result has the
+// uncompressed layer media type and its DiffID is the digest of the blob.
+//
+// This changes Docker MediaType to OCI MediaType so this should be used in
+// conjunction with WithDockerToOCI().
+//
+// Otherwise "containerd.io/snapshot/stargz/toc.digest" annotation will be lost,
+// because the Docker media type does not support layer annotations.
+func LayerConvertFunc(opts ...Option) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) {
+			// No conversion. No need to return an error here.
+			return nil, nil
+		}
+		var cOpts options
+		for _, o := range opts {
+			if err := o(&cOpts); err != nil {
+				return nil, err
+			}
+		}
+		info, err := cs.Info(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		labelz := info.Labels
+		if labelz == nil {
+			labelz = make(map[string]string)
+		}
+
+		ra, err := cs.ReaderAt(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		defer ra.Close()
+		tarR, err := compression.DecompressStream(content.NewReader(ra))
+		if err != nil {
+			return nil, err
+		}
+		defer tarR.Close()
+
+		ref := fmt.Sprintf("convert-uncompressed-estargz-from-%s", desc.Digest)
+		w, err := cs.Writer(ctx, content.WithRef(ref))
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+
+		// Reset the writing position
+		// Old writer possibly remains without aborted
+		// (e.g. conversion interrupted by a signal)
+		if err := w.Truncate(0); err != nil {
+			return nil, err
+		}
+
+		sw := estargz.NewWriterWithCompressor(w, new(uncompressed.Compressor))
+		sw.ChunkSize = cOpts.chunkSize
+		if cOpts.cdc {
+			avgSize := cOpts.chunkSize
+			if avgSize <= 0 {
+				avgSize = 4 << 20
+			}
+			if sw.Chunker, err = estargz.NewFastCDC(avgSize); err != nil {
+				return nil, err
+			}
+		}
+		if err := sw.AppendTarLossLess(tarR); err != nil {
+			return nil, err
+		}
+		tocDgst, err := sw.Close()
+		if err != nil {
+			return nil, err
+		}
+		st, err := w.Status()
+		if err != nil {
+			return nil, err
+		}
+		n := st.Offset
+
+		// The blob is uncompressed so DiffID is the digest of the blob itself.
+		labelz[labels.LabelUncompressed] = sw.DiffID()
+		if err = w.Commit(ctx, n, "", content.WithLabels(labelz)); err != nil && !errdefs.IsAlreadyExists(err) {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		newDesc := desc
+		newDesc.MediaType, err = convertMediaTypeToUncompressed(newDesc.MediaType)
+		if err != nil {
+			return nil, err
+		}
+		newDesc.Digest = w.Digest()
+		newDesc.Size = n
+		if newDesc.Annotations == nil {
+			newDesc.Annotations = make(map[string]string, 1)
+		}
+		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = tocDgst.String()
+		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", n)
+		newDesc.Annotations[estargz.DiffIDAnnotation] = sw.DiffID()
+		return &newDesc, nil
+	}
+}
+
+// NOTE: this converts docker mediatype to OCI mediatype
+func convertMediaTypeToUncompressed(mt string) (string, error) {
+	ociMediaType := converter.ConvertDockerMediaTypeToOCI(mt)
+	switch ociMediaType {
+	case ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerZstd:
+		return ocispec.MediaTypeImageLayer, nil
+	case ocispec.MediaTypeImageLayerNonDistributable, ocispec.MediaTypeImageLayerNonDistributableGzip, ocispec.MediaTypeImageLayerNonDistributableZstd:
+		return ocispec.MediaTypeImageLayerNonDistributable, nil
+	default:
+		return "", fmt.Errorf("unknown mediatype %q", mt)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package uncompressed
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/uncompressed"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestLayerConvertFunc tests conversion into uncompressed eStargz.
+// TestLayerConvertFunc is a pure unit test that does not need the daemon to be running.
+func TestLayerConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	desc, cs, err := testutil.EnsureHello(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lcf := LayerConvertFunc(WithChunkSize(64))
+	docker2oci := true
+	platformMC := platforms.DefaultStrict()
+	cf := converter.DefaultIndexConvertFunc(lcf, docker2oci, platformMC)
+
+	newDesc, err := cf(ctx, cs, *desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var layers []ocispec.Descriptor
+	handler := func(hCtx context.Context, hDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if images.IsLayerType(hDesc.MediaType) {
+			layers = append(layers, hDesc)
+		}
+		return nil, nil
+	}
+	handlers := images.Handlers(
+		images.ChildrenHandler(cs),
+		images.HandlerFunc(handler),
+	)
+	if err := images.Walk(ctx, handlers, *newDesc); err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) == 0 {
+		t.Fatalf("no layer is converted")
+	}
+	for _, l := range layers {
+		if l.MediaType != ocispec.MediaTypeImageLayer {
+			t.Errorf("mediatype %q is not %q", l.MediaType, ocispec.MediaTypeImageLayer)
+		}
+		tocDgst, ok := l.Annotations[estargz.TOCJSONDigestAnnotation]
+		if !ok {
+			t.Fatalf("%q is not set", estargz.TOCJSONDigestAnnotation)
+		}
+		info, err := cs.Info(ctx, l.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Labels[labels.LabelUncompressed] != l.Digest.String() {
+			t.Errorf("diffID %q must be the digest of the blob %q", info.Labels[labels.LabelUncompressed], l.Digest)
+		}
+		ra, err := cs.ReaderAt(ctx, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := estargz.Open(io.NewSectionReader(ra, 0, ra.Size()), estargz.WithDecompressors(new(uncompressed.Decompressor)))
+		if err != nil {
+			ra.Close()
+			t.Fatalf("failed to open converted layer: %v", err)
+		}
+		if _, err := r.VerifyTOC(digest.Digest(tocDgst)); err != nil {
+			t.Errorf("failed to verify TOC: %v", err)
+		}
+		ra.Close()
+	}
+}
@@ -179,6 +179,7 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		tocDgst := blob.TOCDigest().String()
 		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = tocDgst
 		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", c.Size())
+		newDesc.Annotations[estargz.DiffIDAnnotation] = blob.DiffID().String()
 		if p, ok := metadata[zstdchunked.ManifestChecksumAnnotation]; ok {
 			newDesc.Annotations[zstdchunked.ManifestChecksumAnnotation] = p
 		}
@@ -23,10 +23,19 @@ import (
 	"sync"
 )
 
+// Phases of the workload in which files are accessed. Empty phase means PhaseStartup.
+const (
+	PhaseStartup  = "startup"
+	PhaseShutdown = "shutdown"
+)
+
 type Entry struct {
 	Path           string `json:"path"`
 	ManifestDigest string `json:"manifestDigest,omitempty"`
 	LayerIndex     *int   `json:"layerIndex,omitempty"`
+
+	// Phase is the phase of the workload in which the file is accessed first.
+	Phase string `json:"phase,omitempty"`
 }
 
 func New(w io.Writer) *Recorder {
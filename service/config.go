@@ -18,6 +18,8 @@ package service
 
 import (
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/service/dataplane"
+	"github.com/containerd/stargz-snapshotter/service/provision"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 )
 
@@ -35,6 +37,12 @@ type Config struct {
 
 	// SnapshotterConfig is snapshotter-related config.
 	SnapshotterConfig `toml:"snapshotter"`
+
+	// DataPlaneConfig is config for serving layers by child processes.
+	DataPlaneConfig `toml:"data_plane"`
+
+	// ProvisionConfig is config for the API preparing snapshots of images in advance.
+	ProvisionConfig `toml:"provision"`
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -59,6 +67,12 @@ type CRIKeychainConfig struct {
 // ResolverConfig is config for resolving registries.
 type ResolverConfig resolver.Config
 
+// DataPlaneConfig is config for serving layers by child processes.
+type DataPlaneConfig dataplane.Config
+
+// ProvisionConfig is config for the API preparing snapshots of images in advance.
+type ProvisionConfig provision.Config
+
 // SnapshotterConfig is snapshotter-related config.
 type SnapshotterConfig struct {
 	// AllowInvalidMountsOnRestart allows that there are snapshot mounts that cannot access to the
@@ -66,4 +80,22 @@ type SnapshotterConfig struct {
 	// NOTE: User needs to manually remove the snapshots from containerd's metadata store using
 	//       ctr (e.g. `ctr snapshot rm`).
 	AllowInvalidMountsOnRestart bool `toml:"allow_invalid_mounts_on_restart"`
+
+	// CleanupConcurrency is the number of snapshots unmounted and removed in parallel on
+	// cleanup (e.g. after removing images on node drain). (default 16)
+	CleanupConcurrency int `toml:"cleanup_concurrency"`
+
+	// UnmountTimeoutSec is the time (in sec) to wait for unmounting a snapshot on cleanup
+	// before lazily detaching it. (default 10s)
+	UnmountTimeoutSec int64 `toml:"unmount_timeout_sec"`
+
+	// Metacopy enables "metacopy" of overlayfs so that changing only metadata (e.g. chmod
+	// and chown) of lazily pulled files doesn't copy up their contents. Once enabled, this
+	// mustn't be disabled while snapshots created with it exist.
+	Metacopy bool `toml:"metacopy"`
+
+	// VerifiedChainTTLSec is the time (in sec) to skip checking the availability of the
+	// layers of an image after all of them are checked successfully. 0 checks the layers on
+	// every Prepare.
+	VerifiedChainTTLSec int64 `toml:"verified_chain_ttl_sec"`
 }
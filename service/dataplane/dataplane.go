@@ -0,0 +1,473 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package dataplane serves layers by child processes of the snapshotter (data planes)
+// instead of the snapshotter process itself (control plane). Layers of each image are
+// served by a separate data plane so that a crash of a data plane (e.g. caused by a broken
+// layer) doesn't affect other images and resources consumed for fetching layers of an
+// image can be limited by cgroups.
+package dataplane
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	socketName      = "dataplane.sock"
+	credsSocketName = "credentials.sock"
+
+	// readyTimeout is the time to wait for a data plane to start serving.
+	readyTimeout = 30 * time.Second
+
+	// stopTimeout is the time to wait for a data plane to exit after SIGTERM.
+	stopTimeout = 10 * time.Second
+
+	// restartDelay is the delay to restart a data plane that exited unexpectedly.
+	restartDelay = time.Second
+)
+
+// cgroupRoot is the mountpoint of cgroup v2.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// Config is config for data planes.
+type Config struct {
+	// Enable serves layers of each image by a child process.
+	Enable bool `toml:"enable"`
+
+	// CgroupParent is the path of the cgroup (v2) relative to the cgroup root, under which
+	// a cgroup is created for each data plane. Empty doesn't create cgroups.
+	CgroupParent string `toml:"cgroup_parent"`
+
+	// MemoryMax and CPUMax are written to "memory.max" and "cpu.max" of the cgroup of each
+	// data plane (e.g. "512M" and "100000 100000"). Empty doesn't limit the resource.
+	MemoryMax string `toml:"memory_max"`
+	CPUMax    string `toml:"cpu_max"`
+}
+
+// CommandFunc returns the command to start a data plane. The data plane must serve on the
+// unix socket using Serve with the root directory and get registry credentials from the
+// control plane via the credential socket using CredentialFromControlPlane.
+type CommandFunc func(root, socket, credsSocket string) *exec.Cmd
+
+// GroupFunc returns the name of the group of the layer. Layers of the same group are
+// served by the same data plane.
+type GroupFunc func(labels map[string]string) string
+
+// FileSystem is a snapshot.FileSystem serving layers by data planes.
+type FileSystem struct {
+	root        string
+	command     CommandFunc
+	group       GroupFunc
+	config      Config
+	credsServer *http.Server
+
+	mu     sync.Mutex
+	planes map[string]*plane // data plane of each group
+	mounts map[string]*plane // data plane serving each mountpoint
+}
+
+// NewFileSystem returns a FileSystem starting data planes with the command. Data planes
+// get credentials of registries from the passed credential functions.
+func NewFileSystem(root string, command CommandFunc, group GroupFunc, creds []resolver.Credential, config Config) (*FileSystem, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	credsSocket := filepath.Join(root, credsSocketName)
+	if err := os.RemoveAll(credsSocket); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", credsSocket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen %q: %w", credsSocket, err)
+	}
+	srv := &http.Server{Handler: credentialsHandler(creds)}
+	go srv.Serve(l)
+	return &FileSystem{
+		root:        root,
+		command:     command,
+		group:       group,
+		config:      config,
+		credsServer: srv,
+		planes:      make(map[string]*plane),
+		mounts:      make(map[string]*plane),
+	}, nil
+}
+
+// Mount mounts the layer using the data plane of the group of the layer. The data plane is
+// started if it isn't running.
+func (fs *FileSystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	group := fs.group(labels)
+	fs.mu.Lock()
+	if _, ok := fs.mounts[mountpoint]; ok {
+		fs.mu.Unlock()
+		return fmt.Errorf("%q is already mounted", mountpoint)
+	}
+	p, ok := fs.planes[group]
+	if !ok {
+		var err error
+		if p, err = fs.newPlane(group); err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+		fs.planes[group] = p
+		p.start()
+	}
+	fs.mounts[mountpoint] = p
+	p.addMount(mountpoint, labels)
+	fs.mu.Unlock()
+
+	if err := p.ready(ctx); err != nil {
+		fs.release(mountpoint)
+		return err
+	}
+	if err := p.call(ctx, "/mount", mountRequest{mountpoint, labels}); err != nil {
+		fs.release(mountpoint)
+		return err
+	}
+	return nil
+}
+
+// Check checks the layer using the data plane serving it.
+func (fs *FileSystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mu.Lock()
+	p, ok := fs.mounts[mountpoint]
+	fs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%q isn't mounted by any data plane", mountpoint)
+	}
+	if err := p.ready(ctx); err != nil {
+		return err
+	}
+	return p.call(ctx, "/check", mountRequest{mountpoint, labels})
+}
+
+// Unmount unmounts the layer using the data plane serving it. The data plane is stopped
+// when it doesn't serve any layer.
+func (fs *FileSystem) Unmount(ctx context.Context, mountpoint string) error {
+	fs.mu.Lock()
+	p, ok := fs.mounts[mountpoint]
+	fs.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%q isn't mounted by any data plane", mountpoint)
+	}
+	var err error
+	if err = p.ready(ctx); err == nil {
+		err = p.call(ctx, "/unmount", mountRequest{Mountpoint: mountpoint})
+	}
+	if err != nil {
+		// Data plane may be broken. Detach the mount so that the snapshot can be removed.
+		log.G(ctx).WithError(err).Warnf("failed to unmount %q via data plane; detaching", mountpoint)
+		if uErr := unix.Unmount(mountpoint, unix.MNT_DETACH); uErr != nil {
+			return fmt.Errorf("failed to detach %q: %v: %w", mountpoint, uErr, err)
+		}
+	}
+	fs.release(mountpoint)
+	return nil
+}
+
+// Close stops all data planes.
+func (fs *FileSystem) Close() error {
+	fs.mu.Lock()
+	planes := fs.planes
+	fs.planes = make(map[string]*plane)
+	fs.mounts = make(map[string]*plane)
+	fs.mu.Unlock()
+	for _, p := range planes {
+		p.stop()
+	}
+	return fs.credsServer.Close()
+}
+
+// release forgets the mountpoint and stops the data plane if it serves nothing.
+func (fs *FileSystem) release(mountpoint string) {
+	fs.mu.Lock()
+	p, ok := fs.mounts[mountpoint]
+	if !ok {
+		fs.mu.Unlock()
+		return
+	}
+	delete(fs.mounts, mountpoint)
+	empty := p.removeMount(mountpoint)
+	if empty {
+		delete(fs.planes, p.group)
+	}
+	fs.mu.Unlock()
+	if empty {
+		p.stop()
+	}
+}
+
+func (fs *FileSystem) newPlane(group string) (*plane, error) {
+	// The directory is unique even among data planes of the same group because a data
+	// plane can be started while the previous one for the group is stopping.
+	dir, err := os.MkdirTemp(fs.root, fmt.Sprintf("%x", sha256.Sum256([]byte(group)))[:12]+"-")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, socketName)
+	return &plane{
+		fs:     fs,
+		group:  group,
+		dir:    dir,
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		mounts: make(map[string]map[string]string),
+	}, nil
+}
+
+// plane is a data plane process serving layers of a group.
+type plane struct {
+	fs     *FileSystem
+	group  string
+	dir    string
+	socket string
+	client *http.Client
+
+	mu       sync.Mutex
+	mounts   map[string]map[string]string // labels of each mountpoint
+	readyCh  chan struct{}                // closed when the process is ready or failed to start
+	startErr error
+	cmd      *exec.Cmd
+	exitedCh chan struct{}
+	stopped  bool
+}
+
+func (p *plane) addMount(mountpoint string, labels map[string]string) {
+	p.mu.Lock()
+	p.mounts[mountpoint] = labels
+	p.mu.Unlock()
+}
+
+func (p *plane) removeMount(mountpoint string) (empty bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.mounts, mountpoint)
+	return len(p.mounts) == 0
+}
+
+// start starts the process in background. The result can be waited by ready. This is
+// no-op after the data plane is stopped.
+func (p *plane) start() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	readyCh := make(chan struct{})
+	p.readyCh = readyCh
+	p.mu.Unlock()
+	go func() {
+		cmd, exitedCh, err := p.startProcess()
+		p.mu.Lock()
+		p.cmd, p.exitedCh, p.startErr = cmd, exitedCh, err
+		p.mu.Unlock()
+		close(readyCh)
+		if err == nil {
+			go p.supervise(exitedCh)
+		}
+	}()
+}
+
+func (p *plane) startProcess() (*exec.Cmd, chan struct{}, error) {
+	if err := os.RemoveAll(p.socket); err != nil {
+		return nil, nil, err
+	}
+	cmd := p.fs.command(p.dir, p.socket, filepath.Join(p.fs.root, credsSocketName))
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start data plane for %q: %w", p.group, err)
+	}
+	exitedCh := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exitedCh)
+	}()
+	if err := p.setCgroup(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		<-exitedCh
+		return nil, nil, fmt.Errorf("failed to configure cgroup of data plane for %q: %w", p.group, err)
+	}
+	timeout := time.After(readyTimeout)
+	for {
+		if err := p.call(context.Background(), "/healthz", nil); err == nil {
+			return cmd, exitedCh, nil
+		}
+		select {
+		case <-exitedCh:
+			return nil, nil, fmt.Errorf("data plane for %q exited on startup: %v", p.group, cmd.ProcessState)
+		case <-timeout:
+			cmd.Process.Kill()
+			<-exitedCh
+			return nil, nil, fmt.Errorf("data plane for %q didn't get ready in %v", p.group, readyTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// supervise restarts the process when it exits unexpectedly and mounts the layers again.
+// Layers mounted by the exited process are detached because they can't be served anymore.
+func (p *plane) supervise(exitedCh chan struct{}) {
+	<-exitedCh
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	state := p.cmd.ProcessState
+	p.mu.Unlock()
+	log.L.WithField("group", p.group).Warnf("data plane exited unexpectedly (%v); restarting", state)
+
+	time.Sleep(restartDelay)
+	p.start()
+	ctx := context.Background()
+	if err := p.ready(ctx); err != nil {
+		log.L.WithField("group", p.group).WithError(err).Errorf("failed to restart data plane")
+		return
+	}
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	mounts := make(map[string]map[string]string, len(p.mounts))
+	for mp, labels := range p.mounts {
+		mounts[mp] = labels
+	}
+	p.mu.Unlock()
+	for mp, labels := range mounts {
+		unix.Unmount(mp, unix.MNT_DETACH) // the mount served by the exited process is broken
+		if err := p.call(ctx, "/mount", mountRequest{mp, labels}); err != nil {
+			log.L.WithField("group", p.group).WithError(err).Errorf("failed to mount %q again", mp)
+		}
+	}
+}
+
+// ready waits for the process to start serving.
+func (p *plane) ready(ctx context.Context) error {
+	p.mu.Lock()
+	readyCh := p.readyCh
+	p.mu.Unlock()
+	select {
+	case <-readyCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startErr
+}
+
+// stop stops the process and removes its resources.
+func (p *plane) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	readyCh := p.readyCh
+	p.mu.Unlock()
+	<-readyCh
+	p.mu.Lock()
+	cmd, exitedCh := p.cmd, p.exitedCh
+	p.mu.Unlock()
+	if cmd != nil {
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-exitedCh:
+		case <-time.After(stopTimeout):
+			log.L.WithField("group", p.group).Warnf("data plane didn't exit in %v; killing", stopTimeout)
+			cmd.Process.Kill()
+			<-exitedCh
+		}
+	}
+	if p.fs.config.CgroupParent != "" {
+		os.Remove(p.cgroupPath())
+	}
+	os.RemoveAll(p.dir)
+}
+
+func (p *plane) cgroupPath() string {
+	return filepath.Join(cgroupRoot, p.fs.config.CgroupParent, "stargz-dataplane-"+filepath.Base(p.dir))
+}
+
+// setCgroup moves the process to the cgroup of this data plane.
+func (p *plane) setCgroup(pid int) error {
+	if p.fs.config.CgroupParent == "" {
+		return nil
+	}
+	dir := p.cgroupPath()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for file, v := range map[string]string{
+		"memory.max": p.fs.config.MemoryMax,
+		"cpu.max":    p.fs.config.CPUMax,
+	} {
+		if v == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(v), 0644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+func (p *plane) call(ctx context.Context, path string, req interface{}) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://dataplane"+path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("failed to call data plane for %q: %w", p.group, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("data plane for %q: %s", p.group, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+)
+
+const (
+	testSocketEnv      = "TEST_DATAPLANE_SOCKET"
+	testCredsSocketEnv = "TEST_DATAPLANE_CREDENTIALS"
+)
+
+// TestMain runs the test binary as a data plane when it's started by the tests.
+func TestMain(m *testing.M) {
+	if socket := os.Getenv(testSocketEnv); socket != "" {
+		if err := serveTestDataPlane(socket, os.Getenv(testCredsSocketEnv)); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to serve data plane: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func serveTestDataPlane(socket, credsSocket string) error {
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer cancel()
+	return Serve(ctx, l, &testFileSystem{CredentialFromControlPlane(credsSocket)})
+}
+
+// testFileSystem records mounts to "log" file under the mountpoint. Mount fails if the
+// control plane doesn't provide the credentials specified by the "user" label.
+type testFileSystem struct {
+	creds resolver.Credential
+}
+
+func (fs *testFileSystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	refspec, err := reference.Parse("dummy.io/test:latest")
+	if err != nil {
+		return err
+	}
+	user, _, err := fs.creds("dummy.io", refspec)
+	if err != nil {
+		return err
+	}
+	if user != labels["user"] {
+		return fmt.Errorf("unexpected user %q; want %q", user, labels["user"])
+	}
+	return appendLog(mountpoint, fmt.Sprintf("mount %d", os.Getpid()))
+}
+
+func (fs *testFileSystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if _, err := os.Stat(filepath.Join(mountpoint, "log")); err != nil {
+		return fmt.Errorf("not mounted: %w", err)
+	}
+	return nil
+}
+
+func (fs *testFileSystem) Unmount(ctx context.Context, mountpoint string) error {
+	return appendLog(mountpoint, fmt.Sprintf("unmount %d", os.Getpid()))
+}
+
+func appendLog(mountpoint, s string) error {
+	f, err := os.OpenFile(filepath.Join(mountpoint, "log"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, s)
+	return err
+}
+
+func readLog(t *testing.T, mountpoint string) []string {
+	b, err := os.ReadFile(filepath.Join(mountpoint, "log"))
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestFileSystem(t *testing.T) {
+	root := t.TempDir()
+	creds := func(host string, refspec reference.Spec) (string, string, error) {
+		return "testuser", "testsecret", nil
+	}
+	fs, err := NewFileSystem(filepath.Join(root, "dataplane"), func(root, socket, credsSocket string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), testSocketEnv+"="+socket, testCredsSocketEnv+"="+credsSocket)
+		cmd.Stderr = os.Stderr
+		return cmd
+	}, func(labels map[string]string) string {
+		return labels["group"]
+	}, []resolver.Credential{creds}, Config{Enable: true})
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+
+	ctx := context.Background()
+	mount := func(name, group string) string {
+		mp := filepath.Join(root, name)
+		if err := os.Mkdir(mp, 0700); err != nil {
+			t.Fatalf("failed to create mountpoint: %v", err)
+		}
+		if err := fs.Mount(ctx, mp, map[string]string{"group": group, "user": "testuser"}); err != nil {
+			t.Fatalf("failed to mount %q: %v", name, err)
+		}
+		return mp
+	}
+	a1 := mount("a1", "a")
+	a2 := mount("a2", "a")
+	b1 := mount("b1", "b")
+	for _, mp := range []string{a1, a2, b1} {
+		if err := fs.Check(ctx, mp, nil); err != nil {
+			t.Errorf("failed to check %q: %v", mp, err)
+		}
+	}
+	if n := len(fs.planes); n != 2 {
+		t.Fatalf("got %d data planes; want 2", n)
+	}
+	if l1, l2, l3 := readLog(t, a1), readLog(t, a2), readLog(t, b1); l1[0] != l2[0] || l1[0] == l3[0] {
+		t.Errorf("layers must be served by a data plane per group; got %q, %q, %q", l1, l2, l3)
+	}
+	if err := fs.Mount(ctx, a1, map[string]string{"group": "a"}); err == nil {
+		t.Errorf("mounting on the same mountpoint must fail")
+	}
+	if err := fs.Mount(ctx, filepath.Join(root, "c"), map[string]string{"group": "c", "user": "wrong"}); err == nil {
+		t.Errorf("mount failing in data plane must fail")
+	}
+	if _, ok := fs.planes["c"]; ok {
+		t.Errorf("data plane serving nothing must be stopped")
+	}
+
+	// Crash the data plane of group "a". It must be restarted and mount the layers again
+	// without affecting the data plane of group "b".
+	pa := fs.planes["a"]
+	pa.mu.Lock()
+	pa.cmd.Process.Kill()
+	pa.mu.Unlock()
+	for _, mp := range []string{a1, a2} {
+		waitFor(t, func() bool { return len(readLog(t, mp)) == 2 })
+		if l := readLog(t, mp); l[0] == l[1] {
+			t.Errorf("%q must be mounted by the restarted data plane; got %q", mp, l)
+		}
+	}
+	if err := fs.Check(ctx, a1, nil); err != nil {
+		t.Errorf("failed to check after restart: %v", err)
+	}
+	if l := readLog(t, b1); len(l) != 1 {
+		t.Errorf("data plane of another group must not be affected; got %q", l)
+	}
+
+	// Unmount all layers of group "b". The data plane must be stopped.
+	if err := fs.Unmount(ctx, b1); err != nil {
+		t.Fatalf("failed to unmount: %v", err)
+	}
+	if l := readLog(t, b1); len(l) != 2 || !strings.HasPrefix(l[1], "unmount") {
+		t.Errorf("layer must be unmounted by the data plane; got %q", l)
+	}
+	if _, ok := fs.planes["b"]; ok {
+		t.Errorf("data plane serving nothing must be stopped")
+	}
+	if err := fs.Check(ctx, b1, nil); err == nil {
+		t.Errorf("checking unmounted layer must fail")
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("timed out")
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dataplane
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+type mountRequest struct {
+	Mountpoint string            `json:"mountpoint"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Secret   string `json:"secret"`
+}
+
+// Serve serves requests from the control plane on the listener with the filesystem until
+// the context is done. Layers mounted by the requests are unmounted on return.
+func Serve(ctx context.Context, l net.Listener, fs snbase.FileSystem) error {
+	var mu sync.Mutex
+	mounted := make(map[string]struct{})
+	handle := func(f func(r *http.Request, req mountRequest) error) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req mountRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := f(r, req); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	m := http.NewServeMux()
+	m.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	m.Handle("/mount", handle(func(r *http.Request, req mountRequest) error {
+		if err := fs.Mount(r.Context(), req.Mountpoint, req.Labels); err != nil {
+			return err
+		}
+		mu.Lock()
+		mounted[req.Mountpoint] = struct{}{}
+		mu.Unlock()
+		return nil
+	}))
+	m.Handle("/check", handle(func(r *http.Request, req mountRequest) error {
+		return fs.Check(r.Context(), req.Mountpoint, req.Labels)
+	}))
+	m.Handle("/unmount", handle(func(r *http.Request, req mountRequest) error {
+		if err := fs.Unmount(r.Context(), req.Mountpoint); err != nil {
+			return err
+		}
+		mu.Lock()
+		delete(mounted, req.Mountpoint)
+		mu.Unlock()
+		return nil
+	}))
+
+	srv := &http.Server{Handler: m}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(l)
+	}()
+	var err error
+	select {
+	case <-ctx.Done():
+		srv.Close()
+	case err = <-errCh:
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for mp := range mounted {
+		if uErr := fs.Unmount(context.Background(), mp); uErr != nil {
+			log.G(ctx).WithError(uErr).Warnf("failed to unmount %q", mp)
+		}
+	}
+	return err
+}
+
+// credentialsHandler serves credentials of registries to data planes.
+func credentialsHandler(creds []resolver.Credential) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		refspec, err := reference.Parse(r.FormValue("ref"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var c credentials
+		for _, f := range creds {
+			if c.Username, c.Secret, err = f(r.FormValue("host"), refspec); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if c.Username != "" || c.Secret != "" {
+				break
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	})
+}
+
+// CredentialFromControlPlane returns a credential function getting credentials of
+// registries from the control plane via the credential socket.
+func CredentialFromControlPlane(credsSocket string) resolver.Credential {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", credsSocket)
+			},
+		},
+	}
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		q := url.Values{"host": {host}, "ref": {refspec.String()}}
+		resp, err := client.Get("http://controlplane/credentials?" + q.Encode())
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get credentials from control plane: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", "", fmt.Errorf("failed to get credentials from control plane: %s", resp.Status)
+		}
+		var c credentials
+		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			return "", "", err
+		}
+		return c.Username, c.Secret, nil
+	}
+}
@@ -26,14 +26,17 @@ import (
 
 	"github.com/containerd/containerd/defaults"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/metadata"
 	"github.com/containerd/containerd/pkg/dialer"
 	"github.com/containerd/containerd/platforms"
 	ctdplugin "github.com/containerd/containerd/plugin"
+	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/stargz-snapshotter/service"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
 	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
 	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 	grpc "google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials/insecure"
@@ -55,6 +58,28 @@ type Config struct {
 }
 
 func init() {
+	ctdplugin.Register(&ctdplugin.Registration{
+		Type: ctdplugin.DiffPlugin,
+		ID:   "stargz",
+		Requires: []ctdplugin.Type{
+			ctdplugin.MetadataPlugin,
+			ctdplugin.SnapshotPlugin,
+		},
+		InitFn: func(ic *ctdplugin.InitContext) (interface{}, error) {
+			md, err := ic.Get(ctdplugin.MetadataPlugin)
+			if err != nil {
+				return nil, err
+			}
+			sn, err := ic.GetByID(ctdplugin.SnapshotPlugin, "stargz")
+			if err != nil {
+				return nil, err
+			}
+			// The applier falls back to the next differ (e.g. "walking") for layers
+			// that can't be applied lazily. Enable this by adding "stargz" in front of
+			// the default differs of containerd's diff service.
+			return snbase.NewApplier(sn.(snapshots.Snapshotter), md.(*metadata.DB).ContentStore())
+		},
+	})
 	ctdplugin.Register(&ctdplugin.Registration{
 		Type:   ctdplugin.SnapshotPlugin,
 		ID:     "stargz",
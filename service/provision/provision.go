@@ -0,0 +1,315 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package provision provides a gRPC API to prepare the snapshots of images before they are
+// used by containers, so that node provisioning tools can pre-create the snapshot chains
+// of known workloads before any pod is scheduled.
+//
+// The API is served on the gRPC socket of the snapshotter. Messages are encoded in JSON
+// (content-subtype "json") so that no generated code is needed.
+package provision
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// ServiceName is the name of the gRPC service.
+	ServiceName = "containerd.stargz.v1.Provision"
+
+	prepareImageMethod = "/" + ServiceName + "/PrepareImage"
+
+	// codecName is the content-subtype of the messages.
+	codecName = "json"
+
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+	defaultSnapshotter       = "stargz"
+	defaultNamespace         = "k8s.io"
+
+	// defaultPrefetchSize is the size of the prefetched range of layers without landmarks,
+	// the same as ctr-remote rpull.
+	defaultPrefetchSize = 10 * 1024 * 1024
+)
+
+// Status of a layer prepared by PrepareImage.
+const (
+	// StatusRemote means that the snapshot of the layer is a remote snapshot (i.e. the
+	// layer is mounted lazily).
+	StatusRemote = "remote"
+
+	// StatusLocal means that the layer is unpacked to the snapshot (e.g. it isn't eStargz).
+	StatusLocal = "local"
+
+	// StatusMissing means that the snapshot of the layer doesn't exist.
+	StatusMissing = "missing"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return codecName }
+
+// Config is config for the provisioning API.
+type Config struct {
+	// Enable serves the provisioning API on the gRPC socket of the snapshotter.
+	Enable bool `toml:"enable"`
+
+	// ContainerdAddress is the address of containerd where snapshots are prepared.
+	// (default: /run/containerd/containerd.sock)
+	ContainerdAddress string `toml:"containerd_address"`
+
+	// Snapshotter is the name of this snapshotter in containerd. (default: stargz)
+	Snapshotter string `toml:"snapshotter"`
+}
+
+// PrepareImageRequest is the request of PrepareImage.
+type PrepareImageRequest struct {
+	// Ref is the reference of the image.
+	Ref string `json:"ref"`
+
+	// Namespace is the containerd namespace of the image. (default: k8s.io)
+	Namespace string `json:"namespace,omitempty"`
+
+	// Platform is the platform of the image. (default: the platform of the node)
+	Platform string `json:"platform,omitempty"`
+
+	// Labels are passed to the snapshotter as labels of the snapshots (e.g.
+	// "containerd.io/snapshot/remote/stargz.pinned").
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PrepareImageResponse is the response of PrepareImage.
+type PrepareImageResponse struct {
+	// Layers are the status of the layers of the image, from the bottom.
+	Layers []LayerStatus `json:"layers"`
+}
+
+// LayerStatus is the status of the snapshot of a layer.
+type LayerStatus struct {
+	Digest  digest.Digest `json:"digest"`
+	ChainID digest.Digest `json:"chainID"`
+	Status  string        `json:"status"`
+}
+
+// Service is the provisioning API.
+type Service interface {
+	// PrepareImage pulls the image and prepares the snapshots of all layers, without
+	// creating containers. Layers that can be lazily pulled become remote snapshots.
+	PrepareImage(context.Context, *PrepareImageRequest) (*PrepareImageResponse, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Service)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PrepareImage",
+			Handler:    prepareImageHandler,
+		},
+	},
+	Metadata: "provision",
+}
+
+func prepareImageHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrepareImageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(Service).PrepareImage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: prepareImageMethod}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(Service).PrepareImage(ctx, req.(*PrepareImageRequest))
+	})
+}
+
+// Register registers the service to the gRPC server.
+func Register(rpc *grpc.Server, s Service) {
+	rpc.RegisterService(&serviceDesc, s)
+}
+
+// Client is the client of the provisioning API.
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// NewClient returns a client of the API served on the connection.
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn}
+}
+
+// PrepareImage calls PrepareImage of the API.
+func (c *Client) PrepareImage(ctx context.Context, req *PrepareImageRequest) (*PrepareImageResponse, error) {
+	resp := new(PrepareImageResponse)
+	if err := c.conn.Invoke(ctx, prepareImageMethod, req, resp, grpc.CallContentSubtype(codecName)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Server prepares snapshots in containerd.
+type Server struct {
+	config Config
+	hosts  source.RegistryHosts
+
+	// mounted returns true if the layer is mounted by the snapshotter.
+	mounted func(digest.Digest) bool
+
+	clientMu sync.Mutex
+	client   *containerd.Client
+}
+
+// NewServer returns a server preparing snapshots in containerd using the registry hosts.
+// mounted reports whether the layer is mounted by the snapshotter.
+func NewServer(config Config, hosts source.RegistryHosts, mounted func(digest.Digest) bool) *Server {
+	if config.ContainerdAddress == "" {
+		config.ContainerdAddress = defaultContainerdAddress
+	}
+	if config.Snapshotter == "" {
+		config.Snapshotter = defaultSnapshotter
+	}
+	return &Server{config: config, hosts: hosts, mounted: mounted}
+}
+
+// Close closes the connection to containerd.
+func (s *Server) Close() error {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// containerdClient connects to containerd on the first call because containerd can
+// start after the snapshotter.
+func (s *Server) containerdClient() (*containerd.Client, error) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	if s.client == nil {
+		client, err := containerd.New(s.config.ContainerdAddress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to containerd: %w", err)
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// PrepareImage implements Service.
+func (s *Server) PrepareImage(ctx context.Context, req *PrepareImageRequest) (*PrepareImageResponse, error) {
+	resp, err := s.prepareImage(ctx, req)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("ref", req.Ref).Warn("failed to prepare image")
+	}
+	return resp, errdefs.ToGRPC(err)
+}
+
+func (s *Server) prepareImage(ctx context.Context, req *PrepareImageRequest) (*PrepareImageResponse, error) {
+	refspec, err := reference.Parse(req.Ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reference %q: %v: %w", req.Ref, err, errdefs.ErrInvalidArgument)
+	}
+	client, err := s.containerdClient()
+	if err != nil {
+		return nil, err
+	}
+	ns := req.Namespace
+	if ns == "" {
+		ns = defaultNamespace
+	}
+	ctx = namespaces.WithNamespace(ctx, ns)
+	platform := platforms.Default()
+	if req.Platform != "" {
+		p, err := platforms.Parse(req.Platform)
+		if err != nil {
+			return nil, fmt.Errorf("invalid platform %q: %v: %w", req.Platform, err, errdefs.ErrInvalidArgument)
+		}
+		platform = platforms.Only(p)
+	}
+
+	resolver := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) { return s.hosts(refspec) },
+	})
+	var snOpts []snapshots.Opt
+	if len(req.Labels) > 0 {
+		snOpts = append(snOpts, snapshots.WithLabels(req.Labels))
+	}
+	img, err := client.Pull(ctx, req.Ref,
+		containerd.WithResolver(resolver),
+		containerd.WithPlatformMatcher(platform),
+		containerd.WithSchema1Conversion,
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(s.config.Snapshotter, snOpts...),
+		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(req.Ref, defaultPrefetchSize)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull %q: %w", req.Ref, err)
+	}
+
+	manifest, err := images.Manifest(ctx, client.ContentStore(), img.Target(), platform)
+	if err != nil {
+		return nil, err
+	}
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(diffIDs) != len(manifest.Layers) {
+		return nil, fmt.Errorf("mismatched number of layers (%d) and diffIDs (%d)", len(manifest.Layers), len(diffIDs))
+	}
+	sn := client.SnapshotService(s.config.Snapshotter)
+	resp := &PrepareImageResponse{}
+	for i, chainID := range identity.ChainIDs(diffIDs) {
+		ls := LayerStatus{Digest: manifest.Layers[i].Digest, ChainID: chainID}
+		if _, err := sn.Stat(ctx, chainID.String()); err != nil {
+			if !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+			ls.Status = StatusMissing
+		} else if s.mounted != nil && s.mounted(ls.Digest) {
+			ls.Status = StatusRemote
+		} else {
+			ls.Status = StatusLocal
+		}
+		resp.Layers = append(resp.Layers, ls)
+	}
+	return resp, nil
+}
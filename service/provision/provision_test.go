@@ -0,0 +1,86 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package provision
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testService struct {
+	got *PrepareImageRequest
+}
+
+func (s *testService) PrepareImage(ctx context.Context, req *PrepareImageRequest) (*PrepareImageResponse, error) {
+	if req.Ref == "" {
+		return nil, errdefs.ToGRPC(errdefs.ErrInvalidArgument)
+	}
+	s.got = req
+	return &PrepareImageResponse{
+		Layers: []LayerStatus{
+			{Digest: digest.FromString("a"), ChainID: digest.FromString("b"), Status: StatusRemote},
+			{Digest: digest.FromString("c"), ChainID: digest.FromString("d"), Status: StatusLocal},
+		},
+	}, nil
+}
+
+func TestPrepareImage(t *testing.T) {
+	l := bufconn.Listen(1024 * 1024)
+	rpc := grpc.NewServer()
+	s := &testService{}
+	Register(rpc, s)
+	go rpc.Serve(l)
+	defer rpc.Stop()
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	c := NewClient(conn)
+
+	req := &PrepareImageRequest{
+		Ref:       "ghcr.io/stargz-containers/python:3.9-esgz",
+		Namespace: "test",
+		Labels:    map[string]string{"containerd.io/snapshot/remote/stargz.pinned": "true"},
+	}
+	resp, err := c.PrepareImage(context.Background(), req)
+	if err != nil {
+		t.Fatalf("failed to prepare image: %v", err)
+	}
+	if !reflect.DeepEqual(s.got, req) {
+		t.Errorf("server got %+v; want %+v", s.got, req)
+	}
+	if len(resp.Layers) != 2 || resp.Layers[0].Status != StatusRemote || resp.Layers[1].Status != StatusLocal ||
+		resp.Layers[0].Digest != digest.FromString("a") || resp.Layers[1].ChainID != digest.FromString("d") {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	if _, err := c.PrepareImage(context.Background(), &PrepareImageRequest{}); !errdefs.IsInvalidArgument(errdefs.FromGRPC(err)) {
+		t.Errorf("error = %v; want invalid argument", err)
+	}
+}
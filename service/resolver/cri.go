@@ -121,6 +121,7 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 			return dconfig.ConfigureHosts(ctx, hostOptions)(ref.Hostname())
 		}
 	}
+	sessionCache := newTLSSessionCache(0)
 	return func(ref reference.Spec) ([]docker.RegistryHost, error) {
 		host := ref.Hostname()
 		var registries []docker.RegistryHost
@@ -152,6 +153,9 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 					return nil, errors.New("TLS config cannot be applied; Client.Transport is not *http.Transport")
 				}
 			}
+			if err := applyTLSSessionCache(rclient, sessionCache); err != nil {
+				return nil, err
+			}
 
 			client := rclient.StandardClient()
 			authorizer := docker.NewDockerAuthorizer(
@@ -0,0 +1,206 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address families to connect to registries with.
+const (
+	// AddressFamilyIPv4 only uses IPv4 addresses.
+	AddressFamilyIPv4 = "ipv4"
+
+	// AddressFamilyIPv6 only uses IPv6 addresses.
+	AddressFamilyIPv6 = "ipv6"
+
+	// AddressFamilyPreferIPv4 tries IPv4 addresses first and falls back to IPv6.
+	AddressFamilyPreferIPv4 = "prefer-ipv4"
+
+	// AddressFamilyPreferIPv6 tries IPv6 addresses first and falls back to IPv4.
+	AddressFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+const (
+	defaultDialTimeout   = 30 * time.Second
+	defaultKeepAlive     = 30 * time.Second
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+// happyEyeballsDialer connects to hosts with racing the address families as described in
+// RFC 6555 (Happy Eyeballs). The preferred family is dialed first and the other one is
+// started after fallbackDelay or when the preferred one fails, so that a host with broken
+// routing of one family doesn't cause long dial timeouts.
+type happyEyeballsDialer struct {
+	family        string
+	fallbackDelay time.Duration
+
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newHappyEyeballsDialer(family string, fallbackDelay time.Duration) (*happyEyeballsDialer, error) {
+	switch family {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6, AddressFamilyPreferIPv4, AddressFamilyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family %q", family)
+	}
+	if fallbackDelay <= 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+	d := &net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAlive}
+	return &happyEyeballsDialer{
+		family:        family,
+		fallbackDelay: fallbackDelay,
+		dial:          d.DialContext,
+		lookup:        net.DefaultResolver.LookupIPAddr,
+	}, nil
+}
+
+func (d *happyEyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch d.family {
+	case AddressFamilyIPv4:
+		return d.dial(ctx, "tcp4", address)
+	case AddressFamilyIPv6:
+		return d.dial(ctx, "tcp6", address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dial(ctx, network, address)
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %q", host)
+	}
+	primaries, fallbacks := partitionAddrs(addrs, d.family)
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, primaries, port)
+	}
+	return d.dialParallel(ctx, primaries, fallbacks, port)
+}
+
+// partitionAddrs divides the addresses into the preferred family and the other. Without
+// preference, the family of the first address is preferred.
+func partitionAddrs(addrs []net.IPAddr, family string) (primaries, fallbacks []net.IPAddr) {
+	var preferIPv4 bool
+	switch family {
+	case AddressFamilyPreferIPv4:
+		preferIPv4 = true
+	case AddressFamilyPreferIPv6:
+		preferIPv4 = false
+	default:
+		preferIPv4 = addrs[0].IP.To4() != nil
+	}
+	for _, a := range addrs {
+		if (a.IP.To4() != nil) == preferIPv4 {
+			primaries = append(primaries, a)
+		} else {
+			fallbacks = append(fallbacks, a)
+		}
+	}
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+	return primaries, fallbacks
+}
+
+// dialSerial tries the addresses in order and returns the first successful connection.
+func (d *happyEyeballsDialer) dialSerial(ctx context.Context, addrs []net.IPAddr, port string) (net.Conn, error) {
+	var firstErr error
+	for _, a := range addrs {
+		c, err := d.dial(ctx, "tcp", net.JoinHostPort(a.String(), port))
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races the primaries and the fallbacks. The fallbacks are started after
+// fallbackDelay or as soon as all primaries fail.
+func (d *happyEyeballsDialer) dialParallel(ctx context.Context, primaries, fallbacks []net.IPAddr, port string) (net.Conn, error) {
+	type dialResult struct {
+		net.Conn
+		error
+		primary bool
+	}
+	returned := make(chan struct{})
+	defer close(returned)
+	results := make(chan dialResult)
+	startRacer := func(ctx context.Context, addrs []net.IPAddr, primary bool) {
+		c, err := d.dialSerial(ctx, addrs, port)
+		select {
+		case results <- dialResult{Conn: c, error: err, primary: primary}:
+		case <-returned:
+			if c != nil {
+				c.Close()
+			}
+		}
+	}
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go startRacer(primaryCtx, primaries, true)
+
+	fallbackTimer := time.NewTimer(d.fallbackDelay)
+	defer fallbackTimer.Stop()
+	fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+	defer fallbackCancel()
+
+	var primaryErr error
+	var primaryDone, fallbackDone bool
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go startRacer(fallbackCtx, fallbacks, false)
+		case res := <-results:
+			if res.error == nil {
+				return res.Conn, nil
+			}
+			if res.primary {
+				primaryDone, primaryErr = true, res.error
+			} else {
+				fallbackDone = true
+				if primaryErr == nil {
+					primaryErr = res.error
+				}
+			}
+			if primaryDone && fallbackDone {
+				return nil, primaryErr
+			}
+			if res.primary && fallbackTimer.Stop() {
+				// Don't wait for the delay because the primaries don't work.
+				go startRacer(fallbackCtx, fallbacks, false)
+			}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	net.Conn
+	addr string
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	const (
+		v4 = "192.0.2.1"
+		v6 = "2001:db8::1"
+	)
+	addrs := []net.IPAddr{{IP: net.ParseIP(v6)}, {IP: net.ParseIP(v4)}}
+	errRefused := errors.New("refused")
+	tests := []struct {
+		name     string
+		family   string
+		hang     string // address that never responds
+		fail     string // address that fails immediately
+		want     string
+		wantNet  string
+		maxDelay time.Duration
+	}{
+		{name: "auto", want: v6},
+		{name: "prefer-ipv4", family: AddressFamilyPreferIPv4, want: v4},
+		{name: "broken-ipv6", hang: v6, want: v4, maxDelay: time.Second},
+		{name: "refused-ipv6", fail: v6, want: v4, maxDelay: 200 * time.Millisecond},
+		{name: "ipv4-only", family: AddressFamilyIPv4, wantNet: "tcp4"},
+		{name: "ipv6-only", family: AddressFamilyIPv6, wantNet: "tcp6"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newHappyEyeballsDialer(tt.family, 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var mu sync.Mutex
+			var networks []string
+			d.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) { return addrs, nil }
+			d.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+				mu.Lock()
+				networks = append(networks, network)
+				mu.Unlock()
+				host, _, _ := net.SplitHostPort(address)
+				switch host {
+				case tt.hang:
+					<-ctx.Done()
+					return nil, ctx.Err()
+				case tt.fail:
+					return nil, errRefused
+				}
+				return &fakeConn{addr: host}, nil
+			}
+			start := time.Now()
+			c, err := d.DialContext(context.Background(), "tcp", "registry.test:443")
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			if tt.maxDelay > 0 && time.Since(start) > tt.maxDelay {
+				t.Errorf("dial took %v; want < %v", time.Since(start), tt.maxDelay)
+			}
+			if tt.wantNet != "" {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(networks) != 1 || networks[0] != tt.wantNet {
+					t.Errorf("dialed with %v; want %q", networks, tt.wantNet)
+				}
+				return
+			}
+			if got := c.(*fakeConn).addr; got != tt.want {
+				t.Errorf("connected to %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newHappyEyeballsDialer("ipv5", 0); err == nil {
+		t.Errorf("unknown address family must be rejected")
+	}
+}
@@ -0,0 +1,194 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// Types of DNS records that mirrors are discovered from.
+const (
+	// MirrorDiscoveryTypeSRV discovers mirrors from SRV records (e.g. "_registry._tcp.example.com").
+	// Mirrors are ordered by the priorities and weights of the records.
+	MirrorDiscoveryTypeSRV = "srv"
+
+	// MirrorDiscoveryTypeTXT discovers mirrors from TXT records. Each record lists
+	// "host[:port]" separated by spaces or commas, in the order of preference.
+	MirrorDiscoveryTypeTXT = "txt"
+)
+
+const (
+	defaultDiscoveryRefreshInterval = 60 * time.Second
+	discoveryLookupTimeout          = 5 * time.Second
+)
+
+// MirrorDiscoveryConfig is config for discovering mirrors of a host from DNS records.
+type MirrorDiscoveryConfig struct {
+	// Type is the type of the records: "srv" or "txt".
+	Type string `toml:"type"`
+
+	// Name is the DNS name to look up.
+	Name string `toml:"name"`
+
+	// RefreshIntervalSec is the time (in sec) for which the discovered mirrors are used
+	// before looking up the records again. The resolver of the standard library doesn't
+	// expose TTLs of records so this should be aligned to the TTL. 0 means the default (60s).
+	RefreshIntervalSec int `toml:"refresh_interval_sec"`
+
+	// Insecure and RequestTimeoutSec are applied to the discovered mirrors. See MirrorConfig.
+	Insecure          bool `toml:"insecure"`
+	RequestTimeoutSec int  `toml:"request_timeout_sec"`
+}
+
+// MirrorDiscoverer discovers mirrors from the records specified by the config.
+type MirrorDiscoverer interface {
+	Discover(ctx context.Context, cfg MirrorDiscoveryConfig) ([]MirrorConfig, error)
+}
+
+var (
+	mirrorDiscoverers   = map[string]MirrorDiscoverer{}
+	mirrorDiscoverersMu sync.Mutex
+)
+
+func init() {
+	d := &dnsDiscoverer{
+		lookupSRV: net.DefaultResolver.LookupSRV,
+		lookupTXT: net.DefaultResolver.LookupTXT,
+	}
+	RegisterMirrorDiscoverer(MirrorDiscoveryTypeSRV, d)
+	RegisterMirrorDiscoverer(MirrorDiscoveryTypeTXT, d)
+}
+
+// RegisterMirrorDiscoverer registers the discoverer used for MirrorDiscoveryConfig of the
+// type. A discoverer already registered for the type is replaced.
+func RegisterMirrorDiscoverer(typ string, d MirrorDiscoverer) {
+	mirrorDiscoverersMu.Lock()
+	mirrorDiscoverers[typ] = d
+	mirrorDiscoverersMu.Unlock()
+}
+
+func getMirrorDiscoverer(typ string) (MirrorDiscoverer, bool) {
+	mirrorDiscoverersMu.Lock()
+	defer mirrorDiscoverersMu.Unlock()
+	d, ok := mirrorDiscoverers[typ]
+	return d, ok
+}
+
+// dnsDiscoverer discovers mirrors from SRV or TXT records.
+type dnsDiscoverer struct {
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+func (d *dnsDiscoverer) Discover(ctx context.Context, cfg MirrorDiscoveryConfig) (mirrors []MirrorConfig, _ error) {
+	var hosts []string
+	switch cfg.Type {
+	case MirrorDiscoveryTypeSRV:
+		// The name is queried as-is (e.g. "_registry._tcp.example.com").
+		_, srvs, err := d.lookupSRV(ctx, "", "", cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			if target == "" {
+				continue // "." means the service isn't available at this domain
+			}
+			if srv.Port != 0 {
+				target = net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+			}
+			hosts = append(hosts, target)
+		}
+	case MirrorDiscoveryTypeTXT:
+		txts, err := d.lookupTXT(ctx, cfg.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, txt := range txts {
+			hosts = append(hosts, strings.FieldsFunc(txt, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		}
+	default:
+		return nil, fmt.Errorf("unknown type of mirror discovery %q", cfg.Type)
+	}
+	for _, h := range hosts {
+		mirrors = append(mirrors, MirrorConfig{
+			Host:              h,
+			Insecure:          cfg.Insecure,
+			RequestTimeoutSec: cfg.RequestTimeoutSec,
+		})
+	}
+	return mirrors, nil
+}
+
+// mirrorDiscoveryCache keeps discovered mirrors until their refresh intervals expire.
+// When a refresh fails, the previously discovered mirrors are kept being used.
+type mirrorDiscoveryCache struct {
+	m   map[string]*discoveredMirrors
+	mu  sync.Mutex
+	now func() time.Time
+}
+
+type discoveredMirrors struct {
+	mirrors []MirrorConfig
+	expires time.Time
+}
+
+func newMirrorDiscoveryCache() *mirrorDiscoveryCache {
+	return &mirrorDiscoveryCache{m: make(map[string]*discoveredMirrors), now: time.Now}
+}
+
+func (c *mirrorDiscoveryCache) get(ctx context.Context, cfg MirrorDiscoveryConfig) []MirrorConfig {
+	key := cfg.Type + "/" + cfg.Name
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if ok && c.now().Before(e.expires) {
+		return e.mirrors
+	}
+	interval := defaultDiscoveryRefreshInterval
+	if cfg.RefreshIntervalSec > 0 {
+		interval = time.Duration(cfg.RefreshIntervalSec) * time.Second
+	}
+	d, dOK := getMirrorDiscoverer(cfg.Type)
+	if !dOK {
+		log.G(ctx).Warnf("no mirror discoverer for type %q", cfg.Type)
+		return nil
+	}
+	lctx, cancel := context.WithTimeout(ctx, discoveryLookupTimeout)
+	defer cancel()
+	mirrors, err := d.Discover(lctx, cfg)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to discover mirrors from %q", cfg.Name)
+		if !ok {
+			return nil
+		}
+		// Keep using the stale mirrors and retry after the interval.
+		mirrors = e.mirrors
+	}
+	c.m[key] = &discoveredMirrors{mirrors: mirrors, expires: c.now().Add(interval)}
+	return mirrors
+}
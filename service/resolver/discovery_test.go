@@ -0,0 +1,155 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDNSDiscoverer(t *testing.T) {
+	d := &dnsDiscoverer{
+		lookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			if name != "_registry._tcp.example.com" {
+				return "", nil, errors.New("not found")
+			}
+			return name, []*net.SRV{
+				{Target: "tokyo.example.com.", Port: 5000, Priority: 1},
+				{Target: ".", Port: 0, Priority: 2},
+				{Target: "global.example.com.", Port: 443, Priority: 3},
+			}, nil
+		},
+		lookupTXT: func(ctx context.Context, name string) ([]string, error) {
+			if name != "mirrors.example.com" {
+				return nil, errors.New("not found")
+			}
+			return []string{"a.example.com, b.example.com:5000", "c.example.com"}, nil
+		},
+	}
+	tests := []struct {
+		name    string
+		cfg     MirrorDiscoveryConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "srv",
+			cfg:  MirrorDiscoveryConfig{Type: MirrorDiscoveryTypeSRV, Name: "_registry._tcp.example.com"},
+			want: []string{"tokyo.example.com:5000", "global.example.com:443"},
+		},
+		{
+			name: "txt",
+			cfg:  MirrorDiscoveryConfig{Type: MirrorDiscoveryTypeTXT, Name: "mirrors.example.com"},
+			want: []string{"a.example.com", "b.example.com:5000", "c.example.com"},
+		},
+		{
+			name:    "not-found",
+			cfg:     MirrorDiscoveryConfig{Type: MirrorDiscoveryTypeTXT, Name: "unknown.example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown-type",
+			cfg:     MirrorDiscoveryConfig{Type: "a", Name: "mirrors.example.com"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Insecure = true
+			mirrors, err := d.Discover(context.Background(), tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("discovery must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to discover: %v", err)
+			}
+			var got []string
+			for _, m := range mirrors {
+				if !m.Insecure {
+					t.Errorf("config isn't applied to %q", m.Host)
+				}
+				got = append(got, m.Host)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeDiscoverer struct {
+	hosts []string
+	err   error
+	calls int
+}
+
+func (d *fakeDiscoverer) Discover(ctx context.Context, cfg MirrorDiscoveryConfig) (mirrors []MirrorConfig, _ error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, h := range d.hosts {
+		mirrors = append(mirrors, MirrorConfig{Host: h})
+	}
+	return mirrors, nil
+}
+
+func TestMirrorDiscoveryCache(t *testing.T) {
+	d := &fakeDiscoverer{hosts: []string{"a.example.com"}}
+	RegisterMirrorDiscoverer("fake", d)
+	defer func() {
+		mirrorDiscoverersMu.Lock()
+		delete(mirrorDiscoverers, "fake")
+		mirrorDiscoverersMu.Unlock()
+	}()
+
+	now := time.Now()
+	c := newMirrorDiscoveryCache()
+	c.now = func() time.Time { return now }
+	cfg := MirrorDiscoveryConfig{Type: "fake", Name: "test", RefreshIntervalSec: 10}
+	check := func(name string, wantCalls int, wantHosts ...string) {
+		var got []string
+		for _, m := range c.get(context.Background(), cfg) {
+			got = append(got, m.Host)
+		}
+		if !reflect.DeepEqual(got, wantHosts) {
+			t.Errorf("%s: got %v; want %v", name, got, wantHosts)
+		}
+		if d.calls != wantCalls {
+			t.Errorf("%s: discovered %d times; want %d", name, d.calls, wantCalls)
+		}
+	}
+
+	check("first", 1, "a.example.com")
+	d.hosts = []string{"b.example.com"}
+	check("cached", 1, "a.example.com")
+
+	now = now.Add(11 * time.Second)
+	check("refreshed", 2, "b.example.com")
+
+	d.err = errors.New("lookup failure")
+	now = now.Add(11 * time.Second)
+	check("stale", 3, "b.example.com")
+	check("stale-cached", 3, "b.example.com")
+}
@@ -17,6 +17,10 @@
 package resolver
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/containerd/containerd/reference"
@@ -30,10 +34,21 @@ const defaultRequestTimeoutSec = 30
 // Config is config for resolving registries.
 type Config struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// TLSSessionCacheSize is the number of TLS sessions cached for resuming them on new
+	// connections to registries. The cache is shared among all hosts and fetchers.
+	// TLSSessionCacheSize == 0 indicates the default size (defaultTLSSessionCacheSize).
+	// TLSSessionCacheSize < 0 disables session resumption.
+	TLSSessionCacheSize int `toml:"tls_session_cache_size"`
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// MirrorDiscovery discovers mirrors from DNS records. Discovered mirrors are tried
+	// before the ones in Mirrors, in the order of MirrorDiscovery, so traffic can be
+	// steered to regional caches by updating the records.
+	MirrorDiscovery []MirrorDiscoveryConfig `toml:"mirror_discovery"`
 }
 
 type MirrorConfig struct {
@@ -48,19 +63,50 @@ type MirrorConfig struct {
 	// RequestTimeoutSec == 0 indicates the default timeout (defaultRequestTimeoutSec).
 	// RequestTimeoutSec < 0 indicates no timeout.
 	RequestTimeoutSec int `toml:"request_timeout_sec"`
+
+	// AddressFamily is the address family used for connecting to the host: "ipv4" or
+	// "ipv6" uses only that family and "prefer-ipv4" or "prefer-ipv6" tries that family
+	// first with falling back to the other one (Happy Eyeballs). Empty prefers the family
+	// of the first address resolved.
+	AddressFamily string `toml:"address_family"`
+
+	// FallbackDelayMSec is the time (in msec) to wait for the preferred address family
+	// before starting to connect with the other one. 0 means the default (300ms).
+	FallbackDelayMSec int `toml:"fallback_delay_msec"`
 }
 
 type Credential func(string, reference.Spec) (string, string, error)
 
 // RegistryHostsFromConfig creates RegistryHosts (a set of registry configuration) from Config.
 func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.RegistryHosts {
+	discoveryCache := newMirrorDiscoveryCache()
+	sessionCache := newTLSSessionCache(cfg.TLSSessionCacheSize)
 	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
 		host := ref.Hostname()
-		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
+		var mirrors []MirrorConfig
+		for _, d := range cfg.Host[host].MirrorDiscovery {
+			mirrors = append(mirrors, discoveryCache.get(context.Background(), d)...)
+		}
+		mirrors = append(mirrors, cfg.Host[host].Mirrors...)
+		for _, h := range append(mirrors, MirrorConfig{
 			Host: host,
 		}) {
 			client := rhttp.NewClient()
 			client.Logger = nil // disable logging every request
+			if h.AddressFamily != "" || h.FallbackDelayMSec != 0 {
+				d, err := newHappyEyeballsDialer(h.AddressFamily, time.Duration(h.FallbackDelayMSec)*time.Millisecond)
+				if err != nil {
+					return nil, fmt.Errorf("invalid config of host %q: %w", h.Host, err)
+				}
+				tr, ok := client.HTTPClient.Transport.(*http.Transport)
+				if !ok {
+					return nil, errors.New("dialer cannot be applied; Client.Transport is not *http.Transport")
+				}
+				tr.DialContext = d.DialContext
+			}
+			if err := applyTLSSessionCache(client, sessionCache); err != nil {
+				return nil, err
+			}
 			tr := client.StandardClient()
 			if h.RequestTimeoutSec >= 0 {
 				if h.RequestTimeoutSec == 0 {
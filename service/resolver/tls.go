@@ -0,0 +1,78 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"net/http"
+
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+const defaultTLSSessionCacheSize = 256
+
+// Counters of TLS handshakes with registries exposed via expvar for debugging.
+var (
+	tlsHandshakeCount        = expvar.NewInt("stargz_resolver_tls_handshake_count")
+	tlsResumedHandshakeCount = expvar.NewInt("stargz_resolver_tls_resumed_handshake_count")
+)
+
+// newTLSSessionCache returns a cache of TLS sessions shared among all clients
+// created from a config. Each client (e.g. one per layer fetcher) has its own
+// transport so sharing the cache lets new connections resume sessions (with session
+// tickets) established by other clients instead of doing full handshakes.
+// size == 0 indicates the default size and size < 0 disables the cache.
+func newTLSSessionCache(size int) tls.ClientSessionCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultTLSSessionCacheSize
+	}
+	return tls.NewLRUClientSessionCache(size)
+}
+
+// applyTLSSessionCache configures the transport of the client to use the cache.
+// If the transport already has a TLS config, that is cloned and kept.
+func applyTLSSessionCache(client *rhttp.Client, cache tls.ClientSessionCache) error {
+	tr, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("TLS session cache cannot be applied; Client.Transport is not *http.Transport")
+	}
+	var cfg *tls.Config
+	if tr.TLSClientConfig != nil {
+		cfg = tr.TLSClientConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	cfg.ClientSessionCache = cache
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		tlsHandshakeCount.Add(1)
+		if cs.DidResume {
+			tlsResumedHandshakeCount.Add(1)
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+	tr.TLSClientConfig = cfg
+	return nil
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+func TestTLSSessionCache(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	srvTLSConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	sessionCache := newTLSSessionCache(0)
+	get := func() {
+		client := rhttp.NewClient()
+		client.Logger = nil
+		client.HTTPClient.Transport.(*http.Transport).TLSClientConfig = srvTLSConfig
+		if err := applyTLSSessionCache(client, sessionCache); err != nil {
+			t.Fatalf("failed to apply cache: %v", err)
+		}
+		resp, err := client.StandardClient().Get(srv.URL)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		resp.Body.Close()
+		client.HTTPClient.CloseIdleConnections()
+	}
+	handshakes, resumed := tlsHandshakeCount.Value(), tlsResumedHandshakeCount.Value()
+	for i := 0; i < 3; i++ {
+		get() // each call uses a new client like fetchers of different layers
+	}
+	if got := tlsHandshakeCount.Value() - handshakes; got != 3 {
+		t.Errorf("handshakes = %d; want 3", got)
+	}
+	if got := tlsResumedHandshakeCount.Value() - resumed; got != 2 {
+		t.Errorf("resumed handshakes = %d; want 2", got)
+	}
+}
+
+func TestTLSSessionCacheDisabled(t *testing.T) {
+	if c := newTLSSessionCache(-1); c != nil {
+		t.Errorf("cache must be disabled with negative size")
+	}
+}
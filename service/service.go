@@ -18,7 +18,10 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
@@ -26,6 +29,7 @@ import (
 	stargzfs "github.com/containerd/stargz-snapshotter/fs"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/dataplane"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/hashicorp/go-multierror"
@@ -34,9 +38,10 @@ import (
 type Option func(*options)
 
 type options struct {
-	credsFuncs    []resolver.Credential
-	registryHosts source.RegistryHosts
-	fsOpts        []stargzfs.Option
+	credsFuncs       []resolver.Credential
+	registryHosts    source.RegistryHosts
+	fsOpts           []stargzfs.Option
+	dataPlaneCommand dataplane.CommandFunc
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
@@ -60,6 +65,14 @@ func WithFilesystemOptions(opts ...stargzfs.Option) Option {
 	}
 }
 
+// WithDataPlaneCommand specifies the command to start data planes serving layers on behalf
+// of the snapshotter. This is required for enabling DataPlaneConfig.
+func WithDataPlaneCommand(command dataplane.CommandFunc) Option {
+	return func(o *options) {
+		o.dataPlaneCommand = command
+	}
+}
+
 // NewStargzSnapshotterService returns stargz snapshotter.
 func NewStargzSnapshotterService(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
 	var sOpts options
@@ -67,13 +80,73 @@ func NewStargzSnapshotterService(ctx context.Context, root string, config *Confi
 		o(&sOpts)
 	}
 
-	hosts := sOpts.registryHosts
-	if hosts == nil {
-		// Use RegistryHosts based on ResolverConfig and keychain
-		hosts = resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+	// Configure filesystem and snapshotter
+	var fs snbase.FileSystem
+	if config.DataPlaneConfig.Enable {
+		if sOpts.dataPlaneCommand == nil {
+			return nil, fmt.Errorf("command to start data planes must be specified")
+		}
+		getSources := sourcesFromLabels(registryHosts(config, sOpts))
+		dfs, err := dataplane.NewFileSystem(dataPlaneRoot(root), sOpts.dataPlaneCommand, func(labels map[string]string) string {
+			// Layers of an image are served by the same data plane.
+			if src, err := getSources(labels); err == nil && len(src) > 0 {
+				return src[0].Name.String()
+			}
+			return ""
+		}, sOpts.credsFuncs, dataplane.Config(config.DataPlaneConfig))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure data planes: %w", err)
+		}
+		fs = dfs
+	} else {
+		fs = newFileSystem(ctx, fsRoot(root), snapshotterRoot(root), config, sOpts)
+	}
+
+	snOpts := []snbase.Opt{snbase.AsynchronousRemove}
+	if config.SnapshotterConfig.AllowInvalidMountsOnRestart {
+		snOpts = append(snOpts, snbase.AllowInvalidMountsOnRestart)
+	}
+	if n := config.SnapshotterConfig.CleanupConcurrency; n > 0 {
+		snOpts = append(snOpts, snbase.CleanupConcurrency(n))
+	}
+	if config.SnapshotterConfig.Metacopy {
+		snOpts = append(snOpts, snbase.Metacopy)
+	}
+	if sec := config.SnapshotterConfig.UnmountTimeoutSec; sec > 0 {
+		snOpts = append(snOpts, snbase.UnmountTimeout(time.Duration(sec)*time.Second))
+	}
+	if sec := config.SnapshotterConfig.VerifiedChainTTLSec; sec > 0 {
+		snOpts = append(snOpts, snbase.VerifiedChainTTL(time.Duration(sec)*time.Second))
+	}
+	if config.Config.VerifyDiffID {
+		snOpts = append(snOpts, snbase.VerifyDiffID)
+	}
+
+	snapshotter, err := snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
+	}
+
+	return snapshotter, err
+}
+
+// NewFileSystem returns the filesystem serving layers in the same way as the snapshotter.
+// This is used by data planes.
+func NewFileSystem(ctx context.Context, root string, config *Config, opts ...Option) (snbase.FileSystem, error) {
+	var sOpts options
+	for _, o := range opts {
+		o(&sOpts)
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
 	}
+	return newFileSystem(ctx, fsRoot(root), root, config, sOpts), nil
+}
 
-	userxattr, err := overlayutils.NeedsUserXAttr(snapshotterRoot(root))
+// newFileSystem configures the filesystem on fsRoot. xattrDir is used for detecting
+// whether overlayfs on the directory needs "userxattr" option.
+func newFileSystem(ctx context.Context, fsRoot, xattrDir string, config *Config, sOpts options) snbase.FileSystem {
+	userxattr, err := overlayutils.NeedsUserXAttr(xattrDir)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
 	}
@@ -81,29 +154,29 @@ func NewStargzSnapshotterService(ctx context.Context, root string, config *Confi
 	if userxattr {
 		opq = layer.OverlayOpaqueUser
 	}
-	// Configure filesystem and snapshotter
-	fsOpts := append(sOpts.fsOpts, stargzfs.WithGetSources(sources(
-		sourceFromCRILabels(hosts),      // provides source info based on CRI labels
-		source.FromDefaultLabels(hosts), // provides source info based on default labels
-	)), stargzfs.WithOverlayOpaqueType(opq))
-	fs, err := stargzfs.NewFilesystem(fsRoot(root), config.Config, fsOpts...)
+	fsOpts := append(sOpts.fsOpts,
+		stargzfs.WithGetSources(sourcesFromLabels(registryHosts(config, sOpts))),
+		stargzfs.WithOverlayOpaqueType(opq))
+	fs, err := stargzfs.NewFilesystem(fsRoot, config.Config, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
+	return fs
+}
 
-	var snapshotter snapshots.Snapshotter
-
-	snOpts := []snbase.Opt{snbase.AsynchronousRemove}
-	if config.SnapshotterConfig.AllowInvalidMountsOnRestart {
-		snOpts = append(snOpts, snbase.AllowInvalidMountsOnRestart)
-	}
-
-	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
-	if err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
+func registryHosts(config *Config, sOpts options) source.RegistryHosts {
+	if sOpts.registryHosts != nil {
+		return sOpts.registryHosts
 	}
+	// Use RegistryHosts based on ResolverConfig and keychain
+	return resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+}
 
-	return snapshotter, err
+func sourcesFromLabels(hosts source.RegistryHosts) source.GetSources {
+	return sources(
+		sourceFromCRILabels(hosts),      // provides source info based on CRI labels
+		source.FromDefaultLabels(hosts), // provides source info based on default labels
+	)
 }
 
 func snapshotterRoot(root string) string {
@@ -114,6 +187,10 @@ func fsRoot(root string) string {
 	return filepath.Join(root, "stargz")
 }
 
+func dataPlaneRoot(root string) string {
+	return filepath.Join(root, "dataplane")
+}
+
 func sources(ps ...source.GetSources) source.GetSources {
 	return func(labels map[string]string) (source []source.Source, allErr error) {
 		for _, p := range ps {
@@ -0,0 +1,199 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewApplier returns a diff.Applier that applies a layer lazily by mounting it as a
+// remote snapshot on the upper directory of the active snapshot, instead of extracting
+// the layer contents. This allows to decide whether each layer is lazily pulled when
+// containerd applies it.
+//
+// The applier returns errdefs.ErrNotImplemented when the layer can't be applied lazily
+// so that containerd falls back to the next applier (e.g. "walking"). This happens when
+// the mounts aren't provided by the passed snapshotter, when the active snapshot doesn't
+// have labels for resolving the layer (e.g. the ones added by
+// source.AppendDefaultLabelsHandlerWrapper), when the active snapshot was prepared before
+// the snapshotter restarted or when the DiffID of the layer is unknown.
+// The DiffID is looked up from the "containerd.io/uncompressed" annotation of the descriptor
+// and from the content label of the layer in cs (if cs is not nil).
+func NewApplier(sn snapshots.Snapshotter, cs InfoProvider) (diff.Applier, error) {
+	o, ok := sn.(*snapshotter)
+	if !ok {
+		return nil, fmt.Errorf("lazy applier must be used with stargz snapshotter but got %T", sn)
+	}
+	return &applier{o, cs}, nil
+}
+
+// InfoProvider provides information of contents (e.g. content.Store).
+type InfoProvider interface {
+	Info(ctx context.Context, dgst digest.Digest) (content.Info, error)
+}
+
+type applier struct {
+	sn *snapshotter
+	cs InfoProvider
+}
+
+func (a *applier) Apply(ctx context.Context, desc ocispec.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispec.Descriptor, error) {
+	diffID, err := a.diffIDOf(ctx, desc)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("cannot apply layer %v lazily", desc.Digest)
+		return ocispec.Descriptor{}, errdefs.ErrNotImplemented
+	}
+	key, err := a.sn.activeKeyOf(mounts)
+	if err != nil {
+		log.G(ctx).WithError(err).Debugf("cannot apply layer %v lazily", desc.Digest)
+		return ocispec.Descriptor{}, errdefs.ErrNotImplemented
+	}
+	lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("layer", desc.Digest))
+	if err := a.sn.applyRemote(lCtx, key); errdefs.IsNotImplemented(err) {
+		log.G(lCtx).WithError(err).Info("failed to apply layer lazily; falling back")
+		return ocispec.Descriptor{}, errdefs.ErrNotImplemented
+	} else if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	log.G(lCtx).Debug("applied layer lazily")
+
+	applied := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    diffID,
+	}
+	if s, err := strconv.ParseInt(desc.Annotations[estargz.StoreUncompressedSizeAnnotation], 10, 64); err == nil {
+		applied.Size = s
+	}
+	return applied, nil
+}
+
+// Compare isn't supported by this applier. This is implemented for allowing to register
+// the applier as a differ of containerd, which falls back to the next differ.
+func (a *applier) Compare(ctx context.Context, lower, upper []mount.Mount, opts ...diff.Opt) (ocispec.Descriptor, error) {
+	return ocispec.Descriptor{}, errdefs.ErrNotImplemented
+}
+
+// diffIDOf returns the DiffID of the layer, which is required to be returned by Apply.
+func (a *applier) diffIDOf(ctx context.Context, desc ocispec.Descriptor) (digest.Digest, error) {
+	v, ok := desc.Annotations[labels.LabelUncompressed]
+	if !ok && a.cs != nil {
+		if info, err := a.cs.Info(ctx, desc.Digest); err == nil {
+			v, ok = info.Labels[labels.LabelUncompressed]
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("DiffID of %v is unknown", desc.Digest)
+	}
+	return digest.Parse(v)
+}
+
+// activeKeyOf returns the key of the active snapshot of this snapshotter whose upper
+// directory is the target of the mounts. Only snapshots prepared by this process are
+// found.
+func (o *snapshotter) activeKeyOf(mounts []mount.Mount) (string, error) {
+	if len(mounts) != 1 {
+		return "", fmt.Errorf("unexpected number of mounts: %d", len(mounts))
+	}
+	var upper string
+	switch m := mounts[0]; m.Type {
+	case "bind":
+		upper = m.Source
+	case "overlay":
+		for _, opt := range m.Options {
+			if strings.HasPrefix(opt, "upperdir=") {
+				upper = strings.TrimPrefix(opt, "upperdir=")
+			}
+		}
+	}
+	rel, err := filepath.Rel(filepath.Join(o.root, "snapshots"), upper)
+	if err != nil || upper == "" {
+		return "", fmt.Errorf("mounts aren't provided by this snapshotter")
+	}
+	id, base := filepath.Split(rel)
+	id = filepath.Clean(id)
+	if base != "fs" || id == "." || strings.Contains(id, string(filepath.Separator)) || strings.HasPrefix(id, "..") {
+		return "", fmt.Errorf("mounts aren't provided by this snapshotter")
+	}
+
+	o.activeKeysMu.Lock()
+	key, ok := o.activeKeys[id]
+	o.activeKeysMu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("active snapshot of id %q not found: %w", id, errdefs.ErrNotFound)
+	}
+	return key, nil
+}
+
+// applyRemote mounts the layer as a remote snapshot on the active snapshot. The active
+// snapshot is marked as remote so that the following Commit preserves it as a remote snapshot.
+// If the layer can't be mounted lazily, the error wraps errdefs.ErrNotImplemented.
+func (o *snapshotter) applyRemote(ctx context.Context, key string) error {
+	info, err := o.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	mountpoint, err := o.prepareRemoteSnapshot(ctx, key, info.Labels)
+	if err != nil {
+		return fmt.Errorf("%v: %w", err, errdefs.ErrNotImplemented)
+	}
+	if info.Labels == nil {
+		info.Labels = make(map[string]string)
+	}
+	info.Labels[remoteLabel] = remoteLabelVal
+	fieldpaths := []string{"labels." + remoteLabel}
+	if o.layerStates != nil {
+		info.Labels[LayerStateLabel] = LayerStateMounted
+		fieldpaths = append(fieldpaths, "labels."+LayerStateLabel)
+	}
+	if _, err := o.Update(ctx, info, fieldpaths...); err != nil {
+		if uErr := o.unmountRemote(ctx, key); uErr != nil {
+			log.G(ctx).WithError(uErr).Warn("failed to unmount layer")
+		}
+		return err
+	}
+	o.layerStates.track(mountpoint, key)
+	return nil
+}
+
+func (o *snapshotter) unmountRemote(ctx context.Context, key string) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	return o.fs.Unmount(ctx, o.upperPath(id))
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/stargz-snapshotter/fs/bundle"
+)
+
+// Freezer is a snapshotter that can write the on-node state of snapshots to a bundle.
+type Freezer interface {
+	// Freeze writes the snapshot specified by the key and all of its parents to the
+	// bundle at dir. Remote snapshots are written with their contents fetched so far.
+	Freeze(ctx context.Context, key string, dir string) error
+}
+
+// Freeze implements Freezer. This is supported only if the backing filesystem
+// implements Freeze as well.
+func (o *snapshotter) Freeze(ctx context.Context, key string, dir string) error {
+	type freezer interface {
+		Freeze(ctx context.Context, mountpoint string, dir string) (*bundle.Layer, error)
+	}
+	f, ok := o.fs.(freezer)
+	if !ok {
+		return fmt.Errorf("filesystem doesn't support freezing snapshots: %w", errdefs.ErrNotImplemented)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	var m bundle.Manifest
+	for cKey := key; cKey != ""; {
+		id, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			return fmt.Errorf("failed to get info of %q: %w", cKey, err)
+		}
+		s := bundle.Snapshot{Key: info.Name, Labels: info.Labels}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			if s.Layer, err = f.Freeze(ctx, o.upperPath(id), dir); err != nil {
+				return err
+			}
+		} else {
+			log.G(ctx).WithField("key", cKey).Debug("contents of non-remote snapshot aren't included in the bundle")
+		}
+		m.Snapshots = append(m.Snapshots, s)
+		cKey = info.Parent
+	}
+	return bundle.WriteManifest(dir, &m)
+}
@@ -18,11 +18,16 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
@@ -31,7 +36,10 @@ import (
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/continuity/fs"
+	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/moby/sys/mountinfo"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
@@ -62,18 +70,39 @@ const (
 // Check() is called to check the connectibity of the existing layer snapshot
 // every time the layer is used by containerd.
 // Unmount() is called to unmount a remote snapshot from the specified mount point
-// directory.
+// directory. If the FileSystem implements io.Closer, it's closed when the snapshotter
+// is closed.
 type FileSystem interface {
 	Mount(ctx context.Context, mountpoint string, labels map[string]string) error
 	Check(ctx context.Context, mountpoint string, labels map[string]string) error
 	Unmount(ctx context.Context, mountpoint string) error
 }
 
+// ErrNoFallback can be wrapped by errors returned by FileSystem.Mount to make Prepare fail
+// instead of falling back to a normal snapshot.
+var ErrNoFallback = errors.New("remote snapshot must not fall back")
+
+// errTargetCommitted is returned by createSnapshot when the target snapshot is committed.
+var errTargetCommitted = errors.New("target snapshot is already committed")
+
+const (
+	defaultCleanupConcurrency = 16
+	defaultUnmountTimeout     = 10 * time.Second
+
+	// cleanupProgressInterval is the interval to report the progress of Cleanup.
+	cleanupProgressInterval = 5 * time.Second
+)
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove                 bool
 	noRestore                   bool
 	allowInvalidMountsOnRestart bool
+	cleanupConcurrency          int
+	unmountTimeout              time.Duration
+	metacopy                    bool
+	verifiedChainTTL            time.Duration
+	verifyDiffID                bool
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -98,6 +127,60 @@ func AllowInvalidMountsOnRestart(config *SnapshotterConfig) error {
 	return nil
 }
 
+// Metacopy enables "metacopy" of overlayfs on the writable snapshots. Changes of only
+// metadata (e.g. chmod, chown and xattrs) of files in lower layers are recorded in the
+// upper directory without copying up the file contents, so files in remote snapshots
+// aren't fetched entirely by such changes. This is ignored if the kernel doesn't support
+// it or "userxattr" is needed.
+//
+// Upper directories containing metacopy entries can't be mounted without this option so
+// this mustn't be disabled for existing snapshots.
+func Metacopy(config *SnapshotterConfig) error {
+	config.metacopy = true
+	return nil
+}
+
+// CleanupConcurrency sets the number of snapshot directories unmounted and removed in
+// parallel by Cleanup. (default 16)
+func CleanupConcurrency(n int) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.cleanupConcurrency = n
+		return nil
+	}
+}
+
+// UnmountTimeout sets the time to wait for FileSystem.Unmount during cleanup. When it
+// doesn't complete in time or fails, the mountpoint is lazily detached instead so that
+// the snapshot directory can be removed. (default 10s)
+func UnmountTimeout(timeout time.Duration) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.unmountTimeout = timeout
+		return nil
+	}
+}
+
+// VerifiedChainTTL makes the snapshotter skip checking the availability of a snapshot and
+// its parents for the duration after all of them are checked successfully. This cuts the
+// latency of Prepare when many containers are created from the same image. Snapshots that
+// become unavailable during the duration are detected on the next check after it expires.
+func VerifiedChainTTL(ttl time.Duration) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.verifiedChainTTL = ttl
+		return nil
+	}
+}
+
+// VerifyDiffID makes Prepare check that the DiffID of the layer annotated with
+// estargz.DiffIDAnnotation matches the chain ID of the target snapshot, before mounting it
+// as a remote snapshot. Remote snapshots are prepared only for layers passing the check so
+// layers whose contents don't match the image config fall back to normal snapshots, where
+// containerd verifies the DiffID. This assumes that the names of committed snapshots are
+// their chain IDs as containerd's unpacker does; the check is skipped otherwise.
+func VerifyDiffID(config *SnapshotterConfig) error {
+	config.verifyDiffID = true
+	return nil
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
@@ -108,6 +191,25 @@ type snapshotter struct {
 	userxattr                   bool // whether to enable "userxattr" mount option
 	noRestore                   bool
 	allowInvalidMountsOnRestart bool
+	cleanupConcurrency          int
+	unmountTimeout              time.Duration
+	metacopy                    bool
+	verifyDiffID                bool
+
+	// verifiedChains records the expiration of the result of checkAvailability for each
+	// key that passed the check.
+	verifiedChainTTL time.Duration
+	verifiedChains   map[string]time.Time
+	verifiedChainsMu sync.Mutex
+
+	// activeKeys maps IDs of active snapshots prepared by this process to their keys so
+	// that the applier can find the snapshot of the mounts.
+	activeKeys   map[string]string
+	activeKeysMu sync.Mutex
+
+	// layerStates records states of mounted layers to the labels of the snapshots. This
+	// is nil if the filesystem doesn't report states.
+	layerStates *layerStates
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -125,6 +227,12 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 			return nil, err
 		}
 	}
+	if config.cleanupConcurrency <= 0 {
+		config.cleanupConcurrency = defaultCleanupConcurrency
+	}
+	if config.unmountTimeout <= 0 {
+		config.unmountTimeout = defaultUnmountTimeout
+	}
 
 	if err := os.MkdirAll(root, 0700); err != nil {
 		return nil, err
@@ -150,6 +258,17 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		logrus.WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
 	}
 
+	metacopy := config.metacopy
+	if metacopy {
+		if userxattr {
+			logrus.Warn("metacopy is disabled because it can't be used with \"userxattr\"")
+			metacopy = false
+		} else if !supportsMetacopy() {
+			logrus.Warn("metacopy is disabled because the kernel doesn't support it")
+			metacopy = false
+		}
+	}
+
 	o := &snapshotter{
 		root:                        root,
 		ms:                          ms,
@@ -158,7 +277,15 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		userxattr:                   userxattr,
 		noRestore:                   config.noRestore,
 		allowInvalidMountsOnRestart: config.allowInvalidMountsOnRestart,
+		cleanupConcurrency:          config.cleanupConcurrency,
+		unmountTimeout:              config.unmountTimeout,
+		metacopy:                    metacopy,
+		verifiedChainTTL:            config.verifiedChainTTL,
+		verifyDiffID:                config.verifyDiffID,
+		verifiedChains:              make(map[string]time.Time),
+		activeKeys:                  make(map[string]string),
 	}
+	o.watchLayerStates()
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
 		return nil, fmt.Errorf("failed to restore remote snapshot: %w", err)
@@ -241,31 +368,59 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 }
 
 func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
-	if err != nil {
-		return nil, err
-	}
-
-	// Try to prepare the remote snapshot. If succeeded, we commit the snapshot now
-	// and return ErrAlreadyExists.
 	var base snapshots.Info
 	for _, opt := range opts {
 		if err := opt(&base); err != nil {
 			return nil, err
 		}
 	}
-	if target, ok := base.Labels[targetSnapshotLabel]; ok {
+
+	target, hasTarget := base.Labels[targetSnapshotLabel]
+	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, target, opts)
+	if errors.Is(err, errTargetCommitted) {
+		// The target is named after the chain ID of the layer, so a committed target means
+		// the same layer on the same parents is already prepared (e.g. by another image
+		// sharing the lower layers). Share it instead of mounting the layer again.
+		log.G(ctx).WithField("key", key).WithField("parent", parent).WithField(remoteSnapshotLogKey, prepareSucceeded).
+			Debugf("target snapshot %q already exists", target)
+		return nil, fmt.Errorf("target snapshot %q: %w", target, errdefs.ErrAlreadyExists)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Try to prepare the remote snapshot. If succeeded, we commit the snapshot now
+	// and return ErrAlreadyExists.
+	if hasTarget {
 		// NOTE: If passed labels include a target of the remote snapshot, `Prepare`
 		//       must log whether this method succeeded to prepare that remote snapshot
 		//       or not, using the key `remoteSnapshotLogKey` defined in the above. This
 		//       log is used by tests in this project.
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("parent", parent))
-		if err := o.prepareRemoteSnapshot(lCtx, key, base.Labels); err != nil {
+		if err := o.checkDiffID(target, parent, base.Labels); err != nil {
+			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
+				WithError(err).Error("layer doesn't match the DiffID; falling back to normal snapshot")
+		} else if mp, err := o.prepareRemoteSnapshot(lCtx, key, base.Labels); err != nil {
 			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
 				WithError(err).Warn("failed to prepare remote snapshot")
+			if errors.Is(err, ErrNoFallback) {
+				return nil, err
+			}
 		} else {
 			base.Labels[remoteLabel] = remoteLabelVal // Mark this snapshot as remote
+			if o.layerStates != nil {
+				base.Labels[LayerStateLabel] = LayerStateMounted
+			}
 			err := o.commit(ctx, true, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
+			if errdefs.IsAlreadyExists(err) {
+				// The target has been committed by a concurrent Prepare. Unmount and
+				// remove this snapshot so that the layer isn't kept mounted in parallel.
+				if err := o.unmount(ctx, mp); err != nil {
+					log.G(lCtx).WithError(err).Warn("failed to unmount snapshot duplicating the target")
+				}
+				if err := o.Remove(ctx, key); err != nil {
+					log.G(lCtx).WithError(err).Warn("failed to remove snapshot duplicating the target")
+				}
+			}
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				// count also AlreadyExists as "success"
 				log.G(lCtx).WithField(remoteSnapshotLogKey, prepareSucceeded).Debug("prepared remote snapshot")
@@ -282,7 +437,7 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 }
 
 func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
-	s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+	s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, "", opts)
 	if err != nil {
 		return nil, err
 	}
@@ -325,11 +480,28 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 	}()
 
 	// grab the existing id
-	id, _, usage, err := storage.GetInfo(ctx, key)
+	id, info, usage, err := storage.GetInfo(ctx, key)
 	if err != nil {
 		return err
 	}
 
+	if _, ok := info.Labels[remoteLabel]; ok && !isRemote {
+		// The layer was lazily applied to this snapshot by the applier. Keep the labels
+		// so that this snapshot can be restored as a remote snapshot.
+		isRemote = true
+		opts = append(opts, func(i *snapshots.Info) error {
+			if i.Labels == nil {
+				i.Labels = make(map[string]string)
+			}
+			for k, v := range info.Labels {
+				if _, ok := i.Labels[k]; !ok {
+					i.Labels[k] = v
+				}
+			}
+			return nil
+		})
+	}
+
 	if !isRemote { // skip diskusage for remote snapshots for allowing lazy preparation of nodes
 		du, err := fs.DiskUsage(ctx, o.upperPath(id))
 		if err != nil {
@@ -342,7 +514,14 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 		return fmt.Errorf("failed to commit snapshot: %w", err)
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err != nil {
+		return err
+	}
+	o.setActiveKey(id, "")
+	if isRemote {
+		o.layerStates.track(o.upperPath(id), name)
+	}
+	return nil
 }
 
 // Remove abandons the snapshot identified by key. The snapshot will
@@ -361,10 +540,11 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 		}
 	}()
 
-	_, _, err = storage.Remove(ctx, key)
+	id, _, err := storage.Remove(ctx, key)
 	if err != nil {
 		return fmt.Errorf("failed to remove: %w", err)
 	}
+	o.forgetVerifiedChain(key)
 
 	if !o.asyncRemove {
 		var removals []string
@@ -389,7 +569,11 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err == nil {
+		o.setActiveKey(id, "")
+		o.layerStates.untrack(o.upperPath(id))
+	}
+	return err
 }
 
 // Walk the snapshots.
@@ -415,15 +599,57 @@ func (o *snapshotter) cleanup(ctx context.Context, cleanupCommitted bool) error
 	}
 
 	log.G(ctx).Debugf("cleanup: dirs=%v", cleanup)
-	for _, dir := range cleanup {
-		if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
-		}
-	}
+	o.cleanupSnapshotDirectories(ctx, cleanup)
 
 	return nil
 }
 
+// cleanupSnapshotDirectories removes the directories in parallel. On node drains, there
+// can be hundreds of remote snapshots so unmounting them one by one takes too long.
+func (o *snapshotter) cleanupSnapshotDirectories(ctx context.Context, dirs []string) {
+	if len(dirs) == 0 {
+		return
+	}
+	start := time.Now()
+	var done, failed int64
+	stopProgress := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(cleanupProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				log.G(ctx).Infof("cleanup: %d/%d directories processed (%d failed)",
+					atomic.LoadInt64(&done), len(dirs), atomic.LoadInt64(&failed))
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+	dirCh := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < o.cleanupConcurrency && i < len(dirs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range dirCh {
+				if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
+					atomic.AddInt64(&failed, 1)
+					log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+				}
+				atomic.AddInt64(&done, 1)
+			}
+		}()
+	}
+	for _, dir := range dirs {
+		dirCh <- dir
+	}
+	close(dirCh)
+	wg.Wait()
+	close(stopProgress)
+	log.G(ctx).Debugf("cleanup: processed %d directories in %v (%d failed)", len(dirs), time.Since(start), failed)
+}
+
 func (o *snapshotter) cleanupDirectories(ctx context.Context, cleanupCommitted bool) ([]string, error) {
 	// Get a write transaction to ensure no other write transaction can be entered
 	// while the cleanup is scanning.
@@ -474,7 +700,7 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	// We use Filesystem's Unmount API so that it can do necessary finalization
 	// before/after the unmount.
 	mp := filepath.Join(dir, "fs")
-	if err := o.fs.Unmount(ctx, mp); err != nil {
+	if err := o.unmount(ctx, mp); err != nil {
 		log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
 	}
 	if err := os.RemoveAll(dir); err != nil {
@@ -483,11 +709,48 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	return nil
 }
 
-func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent string, opts []snapshots.Opt) (_ storage.Snapshot, err error) {
+// unmount unmounts the mountpoint using FileSystem. If that hangs (e.g. FUSE server
+// isn't responding) or fails with leaving the mountpoint mounted, this escalates to
+// MNT_DETACH. The kernel completes the detached unmount once the mount isn't busy.
+func (o *snapshotter) unmount(ctx context.Context, mp string) error {
+	errCh := make(chan error, 1)
+	go func() { errCh <- o.fs.Unmount(ctx, mp) }()
+	var err error
+	select {
+	case err = <-errCh:
+		if err == nil {
+			return nil
+		}
+	case <-time.After(o.unmountTimeout):
+		err = fmt.Errorf("unmount didn't complete in %v", o.unmountTimeout)
+	}
+	// Don't stat the mountpoint here because it can hang on unresponsive FUSE mounts.
+	mounts, mErr := mountinfo.GetMounts(mountinfo.SingleEntryFilter(mp))
+	if mErr != nil || len(mounts) == 0 {
+		return err
+	}
+	log.G(ctx).WithError(err).WithField("dir", mp).Info("lazily detaching the mountpoint")
+	if dErr := syscall.Unmount(mp, syscall.MNT_DETACH); dErr != nil {
+		return fmt.Errorf("failed to detach: %v: %w", dErr, err)
+	}
+	return nil
+}
+
+// createSnapshot creates the snapshot. If target isn't empty and already committed, this
+// fails with errTargetCommitted without creating the snapshot.
+func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, key, parent, target string, opts []snapshots.Opt) (_ storage.Snapshot, err error) {
 	ctx, t, err := o.ms.TransactionContext(ctx, true)
 	if err != nil {
 		return storage.Snapshot{}, err
 	}
+	if target != "" {
+		if _, info, _, err := storage.GetInfo(ctx, target); err == nil && info.Kind == snapshots.KindCommitted {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+			return storage.Snapshot{}, errTargetCommitted
+		}
+	}
 
 	var td, path string
 	defer func() {
@@ -554,6 +817,9 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	if err = t.Commit(); err != nil {
 		return storage.Snapshot{}, fmt.Errorf("commit failed: %w", err)
 	}
+	if kind == snapshots.KindActive {
+		o.setActiveKey(s.ID, key)
+	}
 
 	return s, nil
 }
@@ -579,8 +845,11 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 
 func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey string) ([]mount.Mount, error) {
 	// Make sure that all layers lower than the target layer are available
-	if checkKey != "" && !o.checkAvailability(ctx, checkKey) {
-		return nil, fmt.Errorf("layer %q unavailable: %w", s.ID, errdefs.ErrUnavailable)
+	if checkKey != "" && !o.chainVerified(checkKey) {
+		if !o.checkAvailability(ctx, checkKey) {
+			return nil, fmt.Errorf("layer %q unavailable: %w", s.ID, errdefs.ErrUnavailable)
+		}
+		o.markChainVerified(checkKey)
 	}
 
 	if len(s.ParentIDs) == 0 {
@@ -631,6 +900,9 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	if o.userxattr {
 		options = append(options, "userxattr")
 	}
+	if o.metacopy && s.Kind == snapshots.KindActive {
+		options = append(options, "metacopy=on")
+	}
 	return []mount.Mount{
 		{
 			Type:    "overlay",
@@ -641,6 +913,12 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 
 }
 
+// supportsMetacopy returns true if overlayfs of the kernel supports "metacopy" (since 4.19).
+func supportsMetacopy() bool {
+	_, err := os.Stat("/sys/module/overlay/parameters/metacopy")
+	return err == nil
+}
+
 func (o *snapshotter) upperPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "fs")
 }
@@ -654,29 +932,74 @@ func (o *snapshotter) Close() error {
 	// unmount all mounts including Committed
 	const cleanupCommitted = true
 	ctx := context.Background()
+	o.layerStates.close()
 	if err := o.cleanup(ctx, cleanupCommitted); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to cleanup")
 	}
+	if c, ok := o.fs.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to close filesystem")
+		}
+	}
 	return o.ms.Close()
 }
 
 // prepareRemoteSnapshot tries to prepare the snapshot as a remote snapshot
-// using filesystems registered in this snapshotter.
-func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) error {
+// using filesystems registered in this snapshotter. This returns the mountpoint.
+func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) (string, error) {
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer t.Rollback()
 	id, _, _, err := storage.GetInfo(ctx, key)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	mountpoint := o.upperPath(id)
 	log.G(ctx).Infof("preparing filesystem mount at mountpoint=%v", mountpoint)
 
-	return o.fs.Mount(ctx, mountpoint, labels)
+	return mountpoint, o.fs.Mount(ctx, mountpoint, labels)
+}
+
+// checkDiffID checks that the DiffID of the layer passed through the label matches the
+// chain ID of the target snapshot. Nop if VerifyDiffID isn't enabled or the DiffID isn't
+// derivable (i.e. no DiffID is passed or names of the snapshots aren't chain IDs).
+func (o *snapshotter) checkDiffID(target, parent string, labels map[string]string) error {
+	if !o.verifyDiffID {
+		return nil
+	}
+	v, ok := labels[estargz.DiffIDAnnotation]
+	if !ok {
+		return nil
+	}
+	diffID, err := digest.Parse(v)
+	if err != nil {
+		return fmt.Errorf("invalid DiffID %q: %w", v, err)
+	}
+	return verifyChainID(target, parent, diffID)
+}
+
+// verifyChainID checks that target is the chain ID of the layer with the DiffID on top of
+// the parent chain ID. Nop if target or parent isn't a digest.
+func verifyChainID(target, parent string, diffID digest.Digest) error {
+	targetChainID, err := digest.Parse(target)
+	if err != nil {
+		return nil
+	}
+	chain := []digest.Digest{diffID}
+	if parent != "" {
+		parentChainID, err := digest.Parse(parent)
+		if err != nil {
+			return nil
+		}
+		chain = []digest.Digest{parentChainID, diffID}
+	}
+	if got := identity.ChainID(chain); got != targetChainID {
+		return fmt.Errorf("chain ID %v of DiffID %v on %q doesn't match the target %v", got, diffID, parent, targetChainID)
+	}
+	return nil
 }
 
 // checkAvailability checks avaiability of the specified layer and all lower
@@ -721,6 +1044,50 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 	return true
 }
 
+// chainVerified returns true if the specified layer and all lower layers passed
+// checkAvailability within verifiedChainTTL.
+func (o *snapshotter) chainVerified(key string) bool {
+	if o.verifiedChainTTL <= 0 {
+		return false
+	}
+	o.verifiedChainsMu.Lock()
+	defer o.verifiedChainsMu.Unlock()
+	expire, ok := o.verifiedChains[key]
+	return ok && time.Now().Before(expire)
+}
+
+func (o *snapshotter) markChainVerified(key string) {
+	if o.verifiedChainTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	o.verifiedChainsMu.Lock()
+	defer o.verifiedChainsMu.Unlock()
+	for k, expire := range o.verifiedChains {
+		if !now.Before(expire) {
+			delete(o.verifiedChains, k)
+		}
+	}
+	o.verifiedChains[key] = now.Add(o.verifiedChainTTL)
+}
+
+func (o *snapshotter) forgetVerifiedChain(key string) {
+	o.verifiedChainsMu.Lock()
+	delete(o.verifiedChains, key)
+	o.verifiedChainsMu.Unlock()
+}
+
+// setActiveKey records the key of the active snapshot of the ID. Empty key forgets it.
+func (o *snapshotter) setActiveKey(id, key string) {
+	o.activeKeysMu.Lock()
+	defer o.activeKeysMu.Unlock()
+	if key == "" {
+		delete(o.activeKeys, id)
+		return
+	}
+	o.activeKeys[id] = key
+}
+
 func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 	mounts, err := mountinfo.GetMounts(nil)
 	if err != nil {
@@ -748,7 +1115,8 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 		return err
 	}
 	for _, info := range task {
-		if err := o.prepareRemoteSnapshot(ctx, info.Name, info.Labels); err != nil {
+		mountpoint, err := o.prepareRemoteSnapshot(ctx, info.Name, info.Labels)
+		if err != nil {
 			if o.allowInvalidMountsOnRestart {
 				logrus.WithError(err).Warnf("failed to restore remote snapshot %s; remove this snapshot manually", info.Name)
 				// This snapshot mount is invalid but allow this.
@@ -759,6 +1127,7 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 			}
 			return fmt.Errorf("failed to prepare remote snapshot: %s: %w", info.Name, err)
 		}
+		o.layerStates.track(mountpoint, info.Name)
 	}
 
 	return nil
@@ -22,15 +22,20 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/labels"
 	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/pkg/testutil"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
@@ -102,6 +107,167 @@ func TestRemotePrepare(t *testing.T) {
 	}
 }
 
+func TestRemotePrepareSharedTarget(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	bfs := bindFileSystem(t)
+	sn, err := NewSnapshotter(context.TODO(), root, bfs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Another image sharing the chain of the layer prepares the same target.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget1", "", nil)
+	defer sn.Remove(ctx, target)
+	prepareWithTarget(t, sn, target, "/tmp/prepareTarget2", "", nil)
+	if n := bfs.(*bindFs).mounts; n != 1 {
+		t.Errorf("layer is mounted %d times; want 1", n)
+	}
+	for _, key := range []string{"/tmp/prepareTarget1", "/tmp/prepareTarget2"} {
+		if _, err := sn.Stat(ctx, key); !errdefs.IsNotFound(err) {
+			t.Errorf("active snapshot %q is kept: %v", key, err)
+		}
+	}
+}
+
+func TestRemotePrepareConcurrentTarget(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	cfs := &concurrentFs{bindFs: bindFileSystem(t).(*bindFs)}
+	cfs.mounting.Add(2)
+	// Removed directories aren't unmounted until Cleanup so the duplicated layer must
+	// be unmounted by Prepare.
+	sn, err := NewSnapshotter(context.TODO(), root, cfs, AsynchronousRemove)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Both Prepares mount the layer before either of them commits the target.
+	keys := []string{"/tmp/prepareTarget1", "/tmp/prepareTarget2"}
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		key := key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			labels := map[string]string{targetSnapshotLabel: "testTarget"}
+			if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+				t.Errorf("failed to prepare remote snapshot %q: %v", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+	defer sn.Remove(ctx, "testTarget")
+
+	if _, err := sn.Stat(ctx, "testTarget"); err != nil {
+		t.Fatalf("failed to stat target: %v", err)
+	}
+	if cfs.unmounts != 1 {
+		t.Errorf("duplicated layer is unmounted %d times; want 1", cfs.unmounts)
+	}
+	for _, key := range keys {
+		if _, err := sn.Stat(ctx, key); !errdefs.IsNotFound(err) {
+			t.Errorf("active snapshot %q is kept: %v", key, err)
+		}
+	}
+}
+
+// concurrentFs blocks Mount until two layers are mounted and counts Unmount calls.
+type concurrentFs struct {
+	*bindFs
+	mu       sync.Mutex
+	mounting sync.WaitGroup
+	unmounts int
+}
+
+func (fs *concurrentFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mu.Lock()
+	err := fs.bindFs.Mount(ctx, mountpoint, labels)
+	fs.mu.Unlock()
+	fs.mounting.Done()
+	fs.mounting.Wait()
+	return err
+}
+
+func (fs *concurrentFs) Unmount(ctx context.Context, mountpoint string) error {
+	fs.mu.Lock()
+	fs.unmounts++
+	fs.mu.Unlock()
+	return fs.bindFs.Unmount(ctx, mountpoint)
+}
+
+func TestRemoteLayerState(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sfs := &stateFs{bindFs: bindFileSystem(t).(*bindFs)}
+	sn, err := NewSnapshotter(context.TODO(), root, sfs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	checkState := func(want string) {
+		var got string
+		for i := 0; i < 100; i++ {
+			info, err := sn.Stat(ctx, target)
+			if err != nil {
+				t.Fatalf("failed to stat remote snapshot: %v", err)
+			}
+			if got = info.Labels[LayerStateLabel]; got == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("state of the layer = %q; want %q", got, want)
+	}
+	checkState(LayerStateMounted)
+	sfs.set(LayerStatePrefetchComplete)
+	checkState(LayerStatePrefetchComplete)
+	sfs.set(LayerStateDegraded)
+	checkState(LayerStateDegraded)
+}
+
+// stateFs reports the state of the last mounted layer on set.
+type stateFs struct {
+	*bindFs
+	mountpoint string
+	handler    func(mountpoint, state string)
+}
+
+func (fs *stateFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if err := fs.bindFs.Mount(ctx, mountpoint, labels); err != nil {
+		return err
+	}
+	fs.mountpoint = mountpoint
+	fs.set(LayerStateMounted)
+	return nil
+}
+
+func (fs *stateFs) OnLayerStateChange(f func(mountpoint, state string)) {
+	fs.handler = f
+}
+
+func (fs *stateFs) set(state string) {
+	fs.handler(fs.mountpoint, state)
+}
+
 func TestRemoteOverlay(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -231,6 +397,59 @@ func TestRemoteCommit(t *testing.T) {
 	}
 }
 
+func TestLazyApply(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	a, err := NewApplier(sn, nil)
+	if err != nil {
+		t.Fatalf("failed to make applier: %v", err)
+	}
+
+	// Snapshot isn't prepared as remote because the target label isn't specified.
+	key := "/tmp/lazyApply"
+	mounts, err := sn.Prepare(ctx, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID := digest.FromString("dummy")
+	desc := ocispec.Descriptor{
+		Digest:      digest.FromString("dummy blob"),
+		Annotations: map[string]string{labels.LabelUncompressed: diffID.String()},
+	}
+	applied, err := a.Apply(ctx, desc, mounts)
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+	if applied.Digest != diffID {
+		t.Errorf("applied digest = %v; want %v", applied.Digest, diffID)
+	}
+	if _, err := a.Apply(ctx, ocispec.Descriptor{Digest: desc.Digest}, mounts); !errdefs.IsNotImplemented(err) {
+		t.Errorf("layer without DiffID must not be applied: %v", err)
+	}
+
+	name := "/tmp/lazyApplied"
+	if err := sn.Commit(ctx, name, key); err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Remove(ctx, name)
+	info, err := sn.Stat(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok {
+		t.Errorf("lazily applied snapshot must be remote: %v", info.Labels)
+	}
+}
+
 func TestFailureDetection(t *testing.T) {
 	testutil.RequiresRoot(t)
 	tests := []struct {
@@ -373,6 +592,47 @@ func TestFailureDetection(t *testing.T) {
 	}
 }
 
+func TestVerifiedChain(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fi := bindFileSystem(t)
+	sn, err := NewSnapshotter(ctx, root, fi, VerifiedChainTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to make new Snapshotter: %q", err)
+	}
+	fs := fi.(*bindFs)
+	target := prepareWithTarget(t, sn, "/tmp/testTarget", "/tmp/testKey", "", map[string]string{brokenLabel: "true"})
+	defer sn.Remove(ctx, target)
+
+	// The first Prepare checks the chain.
+	key := "/tmp/test1"
+	if _, err := sn.Prepare(ctx, key, target); err != nil {
+		t.Fatalf("failed to prepare: %v", err)
+	}
+	defer sn.Remove(ctx, key)
+
+	// The chain is trusted within TTL even if it's broken.
+	fs.checkFailure = true
+	key2 := "/tmp/test2"
+	if _, err := sn.Prepare(ctx, key2, target); err != nil {
+		t.Fatalf("verified chain must not be checked: %v", err)
+	}
+	defer sn.Remove(ctx, key2)
+
+	// The chain is checked again once the result is forgotten.
+	sn.(*snapshotter).forgetVerifiedChain(target)
+	key3 := "/tmp/test3"
+	defer sn.Remove(ctx, key3)
+	if _, err := sn.Prepare(ctx, key3, target); !errdefs.IsUnavailable(err) {
+		t.Fatalf("got %v; want unavailable", err)
+	}
+}
+
 func bindFileSystem(t *testing.T) FileSystem {
 	root, err := os.MkdirTemp("", "remote")
 	if err != nil {
@@ -393,6 +653,7 @@ type bindFs struct {
 	root         string
 	checkFailure bool
 	broken       map[string]bool
+	mounts       int
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -402,6 +663,7 @@ func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[strin
 	if err := syscall.Mount(fs.root, mountpoint, "none", syscall.MS_BIND, ""); err != nil {
 		fs.t.Fatalf("failed to bind mount %q to %q: %v", fs.root, mountpoint, err)
 	}
+	fs.mounts++
 	return nil
 }
 
@@ -434,6 +696,104 @@ func (fs *dummyFs) Unmount(ctx context.Context, mountpoint string) error {
 	return fmt.Errorf("dummy")
 }
 
+// slowUnmountFs takes unmountDelay for each Unmount and records the max number of
+// concurrent calls.
+type slowUnmountFs struct {
+	dummyFs
+	unmountDelay time.Duration
+	mu           sync.Mutex
+	current      int
+	max          int
+}
+
+func (fs *slowUnmountFs) Unmount(ctx context.Context, mountpoint string) error {
+	fs.mu.Lock()
+	fs.current++
+	if fs.current > fs.max {
+		fs.max = fs.current
+	}
+	fs.mu.Unlock()
+	time.Sleep(fs.unmountDelay)
+	fs.mu.Lock()
+	fs.current--
+	fs.mu.Unlock()
+	return fmt.Errorf("not mounted")
+}
+
+func TestVerifyChainID(t *testing.T) {
+	diffID := digest.FromString("layer")
+	parent := digest.FromString("parent")
+	tests := []struct {
+		name    string
+		target  string
+		parent  string
+		wantErr bool
+	}{
+		{name: "bottom", target: diffID.String()},
+		{name: "bottom mismatch", target: digest.FromString("other").String(), wantErr: true},
+		{name: "on parent", target: digest.FromString(parent.String() + " " + diffID.String()).String(), parent: parent.String()},
+		{name: "on parent mismatch", target: diffID.String(), parent: parent.String(), wantErr: true},
+		{name: "target isn't chain ID", target: "testTarget", parent: parent.String()},
+		{name: "parent isn't chain ID", target: diffID.String(), parent: "testParent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChainID(tt.target, tt.parent, diffID)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyChainID() = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCleanupParallel(t *testing.T) {
+	const (
+		numSnapshots = 20
+		concurrency  = 5
+	)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "cleanup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &slowUnmountFs{unmountDelay: 300 * time.Millisecond}
+	sn, err := NewSnapshotter(ctx, root, fs, AsynchronousRemove, CleanupConcurrency(concurrency))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+	for i := 0; i < numSnapshots; i++ {
+		key := fmt.Sprintf("snapshot-%d", i)
+		if _, err := sn.Prepare(ctx, key, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := sn.Remove(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	if err := sn.(snapshots.Cleaner).Cleanup(ctx); err != nil {
+		t.Fatalf("failed to cleanup: %v", err)
+	}
+	if elapsed, serial := time.Since(start), numSnapshots*fs.unmountDelay; elapsed > serial/2 {
+		t.Errorf("cleanup took %v; serial cleanup takes %v", elapsed, serial)
+	}
+	dirs, err := os.ReadDir(filepath.Join(root, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 0 {
+		t.Errorf("%d directories remain after cleanup", len(dirs))
+	}
+	fs.mu.Lock()
+	maxConcurrent := fs.max
+	fs.mu.Unlock()
+	if maxConcurrent < 2 || maxConcurrent > concurrency {
+		t.Errorf("max concurrent unmounts = %d; want 2..%d", maxConcurrent, concurrency)
+	}
+}
+
 // =============================================================================
 // Tests backword-comaptibility of overlayfs snapshotter.
 
@@ -559,6 +919,57 @@ func TestOverlayOverlayMount(t *testing.T) {
 	}
 }
 
+func TestOverlayMetacopyMount(t *testing.T) {
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	o, err := NewSnapshotter(ctx, root, dummyFileSystem(), Metacopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if !o.(*snapshotter).metacopy {
+		t.Skip("metacopy isn't available on this host")
+	}
+	if _, err = o.Prepare(ctx, "/tmp/test", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(ctx, "base", "/tmp/test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Prepare(ctx, "/tmp/base2", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(ctx, "base2", "/tmp/base2"); err != nil {
+		t.Fatal(err)
+	}
+	hasMetacopy := func(mounts []mount.Mount) bool {
+		for _, opt := range mounts[0].Options {
+			if opt == "metacopy=on" {
+				return true
+			}
+		}
+		return false
+	}
+	mounts, err := o.Prepare(ctx, "/tmp/active", "base2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMetacopy(mounts) {
+		t.Errorf("active snapshot must be mounted with metacopy: %v", mounts[0].Options)
+	}
+	mounts, err = o.View(ctx, "/tmp/view", "base2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasMetacopy(mounts) {
+		t.Errorf("view must not be mounted with metacopy: %v", mounts[0].Options)
+	}
+}
+
 func getBasePath(ctx context.Context, sn snapshots.Snapshotter, root, key string) string {
 	o := sn.(*snapshotter)
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// LayerStateLabel is the label of remote snapshots recording the state of the mounted
+// layer, if the FileSystem reports states of layers. Clients can observe the state through
+// the snapshot service of containerd (e.g. Stat) without talking to the snapshotter.
+const LayerStateLabel = "containerd.io/snapshot/remote.state"
+
+// States of mounted layers recorded in LayerStateLabel.
+const (
+	// LayerStateMounted means the layer is mounted and contents are fetched on demand.
+	LayerStateMounted = "mounted"
+
+	// LayerStatePrefetchComplete means the prefetch of the layer completed.
+	LayerStatePrefetchComplete = "prefetch-complete"
+
+	// LayerStateDegraded means the layer failed to fetch contents from the registry on
+	// the last check. Reads of contents not cached yet can fail.
+	LayerStateDegraded = "degraded"
+)
+
+// layerStateNotifier is implemented by FileSystems reporting the states of mounted layers.
+type layerStateNotifier interface {
+	// OnLayerStateChange registers the function called with the mountpoint and the new
+	// state whenever the state of a mounted layer changes. f must not block.
+	OnLayerStateChange(f func(mountpoint, state string))
+}
+
+// layerStates records states of mounted layers to the labels of the snapshots. Labels are
+// updated in order in background so that FileSystems can report states while transactions
+// of the metadata store are open.
+type layerStates struct {
+	mu      sync.Mutex
+	names   map[string]string // mountpoint -> name of the snapshot
+	states  map[string]string // mountpoint -> last reported state
+	pending map[string]string // mountpoint -> state to record
+	notify  chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// watchLayerStates starts recording states reported by the FileSystem until Close. This
+// is nop if the FileSystem doesn't report states.
+func (o *snapshotter) watchLayerStates() {
+	n, ok := o.fs.(layerStateNotifier)
+	if !ok {
+		return
+	}
+	s := &layerStates{
+		names:   make(map[string]string),
+		states:  make(map[string]string),
+		pending: make(map[string]string),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	n.OnLayerStateChange(s.set)
+	go func() {
+		for {
+			select {
+			case <-s.notify:
+			case <-s.done:
+				return
+			}
+			for name, state := range s.take() {
+				if err := o.setLayerStateLabel(name, state); err != nil {
+					log.L.WithError(err).Debugf("failed to record state %q of snapshot %q", state, name)
+				}
+			}
+		}
+	}()
+	o.layerStates = s
+}
+
+// setLayerStateLabel records the state to the label of the snapshot.
+func (o *snapshotter) setLayerStateLabel(name, state string) error {
+	ctx, t, err := o.ms.TransactionContext(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	info := snapshots.Info{Name: name, Labels: map[string]string{LayerStateLabel: state}}
+	if _, err := storage.UpdateInfo(ctx, info, "labels."+LayerStateLabel); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.Commit()
+}
+
+// track starts recording states of the layer mounted at the mountpoint to the snapshot of
+// the name. If the snapshot is renamed by Commit, track is called again with the new name.
+func (s *layerStates) track(mountpoint, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names[mountpoint] = name
+	if state, ok := s.states[mountpoint]; ok {
+		s.pendLocked(mountpoint, state)
+	}
+}
+
+// untrack stops recording states of the layer mounted at the mountpoint.
+func (s *layerStates) untrack(mountpoint string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.names, mountpoint)
+	delete(s.states, mountpoint)
+	delete(s.pending, mountpoint)
+	s.mu.Unlock()
+}
+
+func (s *layerStates) close() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { close(s.done) })
+}
+
+func (s *layerStates) set(mountpoint, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[mountpoint] = state
+	if _, ok := s.names[mountpoint]; ok {
+		s.pendLocked(mountpoint, state)
+	}
+}
+
+func (s *layerStates) pendLocked(mountpoint, state string) {
+	s.pending[mountpoint] = state
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the states to record keyed by the name of the snapshot.
+func (s *layerStates) take() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]string, len(s.pending))
+	for mp, state := range s.pending {
+		res[s.names[mp]] = state
+	}
+	s.pending = make(map[string]string)
+	return res
+}
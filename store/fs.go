@@ -74,7 +74,9 @@ func Mount(ctx context.Context, mountpoint string, layerManager *LayerManager, d
 		FsName:     "stargzstore",
 		Debug:      debug,
 	}
-	if _, err := exec.LookPath(fusermountBin); err == nil {
+	if layerManager.directMount {
+		mountOpts.DirectMount = true
+	} else if _, err := exec.LookPath(fusermountBin); err == nil {
 		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
 	} else {
 		log.G(ctx).WithError(err).Debugf("%s not installed; trying direct mount", fusermountBin)
@@ -405,7 +407,7 @@ func (n *layernode) Lookup(ctx context.Context, name string, out *fuse.EntryOut)
 		var cn *fusefs.Inode
 		var errno syscall.Errno
 		err = n.fs.layerMap.add(func(id uint32) (releasable, error) {
-			root, err := l.RootNode(id)
+			root, err := l.RootNode(id, "")
 			if err != nil {
 				return nil, err
 			}
@@ -84,6 +84,7 @@ func NewLayerManager(ctx context.Context, root string, hosts source.RegistryHost
 		resolveLock:           new(namedmutex.NamedMutex),
 		layer:                 make(map[string]map[string]layer.Layer),
 		refcounter:            make(map[string]map[string]int),
+		directMount:           cfg.FuseConfig.DirectMount,
 	}, nil
 }
 
@@ -101,6 +102,7 @@ type LayerManager struct {
 	disableVerification   bool
 	metricsController     *layermetrics.Controller
 	resolveLock           *namedmutex.NamedMutex
+	directMount           bool
 
 	layer      map[string]map[string]layer.Layer
 	refcounter map[string]map[string]int
@@ -229,15 +231,22 @@ func (r *LayerManager) getLayer(ctx context.Context, refspec reference.Spec, dgs
 func (r *LayerManager) resolveLayer(ctx context.Context, refspec reference.Spec, target ocispec.Descriptor) (layer.Layer, error) {
 	key := refspec.String() + "/" + target.Digest.String()
 
-	// Wait if resolving this layer is already running.
-	r.resolveLock.Lock(key)
-	defer r.resolveLock.Unlock(key)
-
+	// Wait if resolving this layer is already running. Lookups of resolved layers
+	// don't block each other.
+	r.resolveLock.RLock(key)
 	gotL := r.getCachedLayer(refspec, target.Digest)
+	r.resolveLock.RUnlock(key)
 	if gotL != nil {
 		// layer already resolved
 		return gotL, nil
 	}
+	r.resolveLock.Lock(key)
+	defer r.resolveLock.Unlock(key)
+
+	if gotL := r.getCachedLayer(refspec, target.Digest); gotL != nil {
+		// layer resolved while waiting for the lock
+		return gotL, nil
+	}
 
 	// Resolve this layer.
 	var esgzOpts []metadata.Option
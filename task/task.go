@@ -66,6 +66,36 @@ type BackgroundTaskManager struct {
 	prioritizedTaskStartNotify   chan struct{}
 	prioritizedTaskStartNotifyMu sync.Mutex
 	prioritizedTaskDoneCond      *sync.Cond
+	paused                       bool
+	pausedMu                     sync.Mutex
+}
+
+// Pause stops background tasks until Resume is called. Running background tasks are
+// cancelled and retried after Resume, same as when a prioritized task starts.
+func (ts *BackgroundTaskManager) Pause() {
+	ts.pausedMu.Lock()
+	defer ts.pausedMu.Unlock()
+	if !ts.paused {
+		ts.paused = true
+		ts.DoPrioritizedTask()
+	}
+}
+
+// Resume restarts background tasks stopped by Pause.
+func (ts *BackgroundTaskManager) Resume() {
+	ts.pausedMu.Lock()
+	defer ts.pausedMu.Unlock()
+	if ts.paused {
+		ts.paused = false
+		ts.DonePrioritizedTask()
+	}
+}
+
+// Paused returns true if background tasks are paused.
+func (ts *BackgroundTaskManager) Paused() bool {
+	ts.pausedMu.Lock()
+	defer ts.pausedMu.Unlock()
+	return ts.paused
 }
 
 // DoPrioritizedTask tells the manager that we are running a prioritized task
@@ -132,6 +132,31 @@ func TestBackgroundTasks(t *testing.T) {
 					task2.assert(true, false, false))
 			},
 		},
+		{
+			name:          "pause",
+			concurrency:   2,
+			checkInterval: 100 * time.Millisecond,
+			context: func(t *testing.T, pm *BackgroundTaskManager, task1, task2, task3, task4 *sampleTask) {
+				doGo(func() { pm.InvokeBackgroundTask(task1.do, 24*time.Hour) })
+				wait(t, "task1 started", task1.checkStarted())
+				pm.Pause()
+				pm.Pause() // pausing twice needs only one resume
+				wait(t, "task1 canceled", task1.checkCanceled())
+				task1.reset()
+				doGo(func() { pm.InvokeBackgroundTask(task2.do, 24*time.Hour) })
+				time.Sleep(300 * time.Millisecond) // wait for long time...
+				if task1.assert(true, false, false) || task2.assert(true, false, false) {
+					t.Fatalf("tasks must not run while paused")
+				}
+				pm.Resume()
+				wait(t, "task1 resumed", task1.checkStarted())
+				wait(t, "task2 started", task2.checkStarted())
+			},
+			assert: func(task1, task2, task3, task4 *sampleTask) bool {
+				return (task1.assert(true, false, false) &&
+					task2.assert(true, false, false))
+			},
+		},
 		{
 			name:          "finish_partial",
 			concurrency:   1,
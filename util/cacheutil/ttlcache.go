@@ -78,6 +78,9 @@ func (c *TTLCache) Add(key string, value interface{}) (cachedValue interface{},
 	rc.t = time.AfterFunc(c.ttl, func() {
 		c.mu.Lock()
 		defer c.mu.Unlock()
+		if rc.pinned {
+			return
+		}
 		c.evictLocked(key)
 	})
 	c.m[key] = rc
@@ -92,6 +95,48 @@ func (c *TTLCache) Remove(key string) {
 	c.evictLocked(key)
 }
 
+// Pin exempts the specified content from ttl-based eviction and from Purge. The content stays
+// in the cache until it is explicitly removed by Remove or unpinned. This returns false if the
+// content doesn't exist in the cache.
+func (c *TTLCache) Pin(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rc, ok := c.m[key]
+	if !ok {
+		return false
+	}
+	rc.pinned = true
+	rc.t.Stop()
+	return true
+}
+
+// Unpin makes the specified pinned content evictable again. The ttl of the content restarts
+// from the time of unpinning.
+func (c *TTLCache) Unpin(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rc, ok := c.m[key]; ok && rc.pinned {
+		rc.pinned = false
+		rc.t.Reset(c.ttl)
+	}
+}
+
+// Purge removes all unpinned contents from the cache and returns the number of removed contents.
+// Same as Remove, OnEvicted callback is called when nobody refers to each content.
+func (c *TTLCache) Purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for key, rc := range c.m {
+		if rc.pinned {
+			continue
+		}
+		c.evictLocked(key)
+		n++
+	}
+	return n
+}
+
 func (c *TTLCache) evictLocked(key string) {
 	if rc, ok := c.m[key]; ok {
 		delete(c.m, key)
@@ -111,5 +156,6 @@ func (c *TTLCache) decreaseOnceFunc(rc *refCounterWithTimer) func() {
 
 type refCounterWithTimer struct {
 	*refCounter
-	t *time.Timer
+	t      *time.Timer
+	pinned bool
 }
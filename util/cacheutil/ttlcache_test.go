@@ -92,6 +92,32 @@ func TestTTLRemove(t *testing.T) {
 	}
 }
 
+// TestTTLPurge tests Purge API
+func TestTTLPurge(t *testing.T) {
+	var evicted []string
+	c := NewTTLCache(time.Hour)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	_, done2, _ := c.Add("key2", "abcd2")
+	done2()
+
+	if n := c.Purge(); n != 2 {
+		t.Fatalf("purged %d contents; want 2", n)
+	}
+	if len(evicted) != 1 || evicted[0] != "key2" {
+		t.Fatalf("only unreferenced content must be evicted on purge: %v", evicted)
+	}
+	if _, _, ok := c.Get("key1"); ok {
+		t.Fatalf("purged content must not be returned")
+	}
+	done1()
+	if len(evicted) != 2 {
+		t.Fatalf("content must be evicted after all references are discarded")
+	}
+}
+
 // TestTTLRemoveOverwritten tests old gc doesn't affect overwritten content
 func TestTTLRemoveOverwritten(t *testing.T) {
 	var evicted []string
@@ -176,3 +202,42 @@ func TestTTLEviction(t *testing.T) {
 	}
 	evictedMu.Unlock()
 }
+
+// TestTTLPin tests pinned contents are exempted from ttl-based eviction and purge.
+func TestTTLPin(t *testing.T) {
+	var (
+		evicted   []string
+		evictedMu sync.Mutex
+	)
+	c := NewTTLCache(time.Second)
+	c.OnEvicted = func(key string, value interface{}) {
+		evictedMu.Lock()
+		evicted = append(evicted, key)
+		evictedMu.Unlock()
+	}
+	if c.Pin("key1") {
+		t.Fatalf("non-existing content must not be pinned")
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	done1()
+	if !c.Pin("key1") {
+		t.Fatalf("failed to pin content")
+	}
+	time.Sleep(2 * time.Second) // wait until elements reach ttl
+	if n := c.Purge(); n != 0 {
+		t.Fatalf("pinned content must not be purged but purged %d", n)
+	}
+	if _, done, ok := c.Get("key1"); !ok {
+		t.Fatalf("pinned content must not be evicted")
+	} else {
+		done()
+	}
+
+	c.Unpin("key1")
+	time.Sleep(2 * time.Second) // wait until elements reach ttl
+	evictedMu.Lock()
+	defer evictedMu.Unlock()
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Fatalf("unpinned content must be evicted after ttl: %v", evicted)
+	}
+}
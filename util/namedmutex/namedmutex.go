@@ -14,49 +14,195 @@
    limitations under the License.
 */
 
-// Package namedmutex provides NamedMutex that wraps sync.Mutex
+// Package namedmutex provides NamedMutex that wraps sync.RWMutex
 // and provides namespaced mutex.
 package namedmutex
 
 import (
+	"hash/fnv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// NamedMutex wraps sync.Mutex and provides namespaced mutex.
+// numShards is the number of shards of the table of names. Names in different shards
+// don't contend on the table.
+const numShards = 32
+
+// NamedMutex wraps sync.RWMutex and provides namespaced mutex.
+// The zero value is ready to use.
 type NamedMutex struct {
-	muMap  map[string]*sync.Mutex
-	refMap map[string]int
+	// Counters are placed first to be 64-bit aligned for atomic operations.
+	acquisitions uint64
+	contentions  uint64
+	waitNanos    uint64
+	longHolds    uint64
+
+	shards [numShards]shard
 
-	mu sync.Mutex
+	holdThreshold time.Duration
+	onLongHold    func(name string, held time.Duration)
 }
 
-// Lock locks the mutex of the given name
-func (nl *NamedMutex) Lock(name string) {
-	nl.mu.Lock()
-	if nl.muMap == nil {
-		nl.muMap = make(map[string]*sync.Mutex)
+type shard struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+}
+
+type entry struct {
+	mu sync.RWMutex
+
+	// Fields below are guarded by the mutex of the shard.
+	ref     int           // number of holders and waiters
+	writers int           // number of writers holding or waiting
+	timers  []*time.Timer // timers detecting long holds
+}
+
+// Option is an option to configure NamedMutex.
+type Option func(*NamedMutex)
+
+// WithHoldThreshold makes the mutex call f when a name is kept locked (by one or more
+// holders) longer than d, which likely indicates a leaked lock.
+func WithHoldThreshold(d time.Duration, f func(name string, held time.Duration)) Option {
+	return func(nl *NamedMutex) {
+		nl.holdThreshold = d
+		nl.onLongHold = f
 	}
-	if nl.refMap == nil {
-		nl.refMap = make(map[string]int)
+}
+
+// New returns a new NamedMutex configured with the options.
+func New(opts ...Option) *NamedMutex {
+	nl := new(NamedMutex)
+	for _, o := range opts {
+		o(nl)
 	}
-	if _, ok := nl.muMap[name]; !ok {
-		nl.muMap[name] = &sync.Mutex{}
+	return nl
+}
+
+// Stats is the statistics of a NamedMutex.
+type Stats struct {
+	// Acquisitions is the number of locks acquired.
+	Acquisitions uint64
+
+	// Contentions is the number of locks that waited for other holders.
+	Contentions uint64
+
+	// WaitTime is the total time spent by contended locks for waiting.
+	WaitTime time.Duration
+
+	// LongHolds is the number of locks held longer than the threshold.
+	LongHolds uint64
+}
+
+// Stats returns the statistics of the mutex.
+func (nl *NamedMutex) Stats() Stats {
+	return Stats{
+		Acquisitions: atomic.LoadUint64(&nl.acquisitions),
+		Contentions:  atomic.LoadUint64(&nl.contentions),
+		WaitTime:     time.Duration(atomic.LoadUint64(&nl.waitNanos)),
+		LongHolds:    atomic.LoadUint64(&nl.longHolds),
 	}
-	mu := nl.muMap[name]
-	nl.refMap[name]++
-	nl.mu.Unlock()
-	mu.Lock()
+}
+
+// Lock locks the mutex of the given name
+func (nl *NamedMutex) Lock(name string) {
+	e, contended := nl.acquire(name, true)
+	nl.wait(contended, e.mu.Lock)
+	nl.held(name, e)
 }
 
 // Unlock unlocks the mutex of the given name
 func (nl *NamedMutex) Unlock(name string) {
-	nl.mu.Lock()
-	mu := nl.muMap[name]
-	nl.refMap[name]--
-	if nl.refMap[name] <= 0 {
-		delete(nl.muMap, name)
-		delete(nl.refMap, name)
-	}
-	nl.mu.Unlock()
-	mu.Unlock()
+	nl.release(name, true).mu.Unlock()
+}
+
+// RLock locks the mutex of the given name for reading. Readers of the same name
+// don't block each other.
+func (nl *NamedMutex) RLock(name string) {
+	e, contended := nl.acquire(name, false)
+	nl.wait(contended, e.mu.RLock)
+	nl.held(name, e)
+}
+
+// RUnlock unlocks the mutex of the given name locked for reading.
+func (nl *NamedMutex) RUnlock(name string) {
+	nl.release(name, false).mu.RUnlock()
+}
+
+func (nl *NamedMutex) shard(name string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return &nl.shards[h.Sum32()%numShards]
+}
+
+// acquire gets the entry of the name, reporting whether the caller needs to wait for
+// others to get the lock.
+func (nl *NamedMutex) acquire(name string, write bool) (e *entry, contended bool) {
+	s := nl.shard(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks == nil {
+		s.locks = make(map[string]*entry)
+	}
+	e, ok := s.locks[name]
+	if !ok {
+		e = &entry{}
+		s.locks[name] = e
+	}
+	if write {
+		contended = e.ref > 0
+		e.writers++
+	} else {
+		contended = e.writers > 0
+	}
+	e.ref++
+	return e, contended
+}
+
+func (nl *NamedMutex) wait(contended bool, lock func()) {
+	atomic.AddUint64(&nl.acquisitions, 1)
+	if !contended {
+		lock()
+		return
+	}
+	start := time.Now()
+	lock()
+	atomic.AddUint64(&nl.contentions, 1)
+	atomic.AddUint64(&nl.waitNanos, uint64(time.Since(start)))
+}
+
+func (nl *NamedMutex) held(name string, e *entry) {
+	if nl.holdThreshold <= 0 {
+		return
+	}
+	d := nl.holdThreshold
+	t := time.AfterFunc(d, func() {
+		atomic.AddUint64(&nl.longHolds, 1)
+		if nl.onLongHold != nil {
+			nl.onLongHold(name, d)
+		}
+	})
+	s := nl.shard(name)
+	s.mu.Lock()
+	e.timers = append(e.timers, t)
+	s.mu.Unlock()
+}
+
+func (nl *NamedMutex) release(name string, write bool) *entry {
+	s := nl.shard(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.locks[name]
+	if n := len(e.timers); n > 0 {
+		e.timers[n-1].Stop()
+		e.timers = e.timers[:n-1]
+	}
+	if write {
+		e.writers--
+	}
+	e.ref--
+	if e.ref <= 0 {
+		delete(s.locks, name)
+	}
+	return e
 }
@@ -0,0 +1,103 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package namedmutex
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNamedMutex(t *testing.T) {
+	var nl NamedMutex
+
+	// Readers of the same name don't block each other.
+	nl.RLock("a")
+	done := make(chan struct{})
+	go func() {
+		nl.RLock("a")
+		nl.RUnlock("a")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("reader is blocked by another reader")
+	}
+
+	// Writers wait for readers.
+	locked := make(chan struct{})
+	go func() {
+		nl.Lock("a")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatalf("writer isn't blocked by reader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Other names aren't blocked.
+	nl.Lock("b")
+	nl.Unlock("b")
+
+	nl.RUnlock("a")
+	<-locked
+	nl.Unlock("a")
+
+	s := nl.Stats()
+	if s.Acquisitions != 4 {
+		t.Errorf("acquisitions = %d; want 4", s.Acquisitions)
+	}
+	if s.Contentions != 1 {
+		t.Errorf("contentions = %d; want 1", s.Contentions)
+	}
+	if s.WaitTime < 100*time.Millisecond {
+		t.Errorf("wait time %v is too short", s.WaitTime)
+	}
+	for i := range nl.shards {
+		if n := len(nl.shards[i].locks); n != 0 {
+			t.Errorf("shard %d has %d remaining names", i, n)
+		}
+	}
+}
+
+func TestNamedMutexHoldThreshold(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	nl := New(WithHoldThreshold(100*time.Millisecond, func(name string, held time.Duration) {
+		mu.Lock()
+		names = append(names, name)
+		mu.Unlock()
+	}))
+	nl.Lock("short")
+	nl.Unlock("short")
+	nl.Lock("long")
+	time.Sleep(500 * time.Millisecond)
+	nl.Unlock("long")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(names) != 1 || names[0] != "long" {
+		t.Errorf("reported names = %v; want [long]", names)
+	}
+	if n := nl.Stats().LongHolds; n != 1 {
+		t.Errorf("long holds = %d; want 1", n)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package registryreplay records registry traffic of a pull into a fixture and replays it
+// from a local server. This allows to test performance of fetch strategies deterministically
+// with realistic traffic patterns.
+package registryreplay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+const maxRedirects = 10
+
+// Entry is a recorded registry request and its response.
+type Entry struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Range  string      `json:"range,omitempty"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+
+	// Latency is the duration until the response header is received.
+	Latency time.Duration `json:"latency"`
+
+	// Duration is the duration until the entire response body is received.
+	Duration time.Duration `json:"duration"`
+}
+
+// ReadEntries reads entries from a fixture written by Recorder.
+func ReadEntries(r io.Reader) (entries []Entry, _ error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to decode entry: %w", err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// Recorder is a proxy to a registry which records all requests and responses to the
+// fixture. Redirects are followed by the recorder so that the contents served by other
+// hosts (e.g. CDN) are recorded as well. Responses of 401 are passed to the client but
+// not recorded so that the fixture doesn't contain credentials.
+type Recorder struct {
+	upstream  *url.URL
+	transport http.RoundTripper
+
+	w   io.Writer
+	wMu sync.Mutex
+}
+
+// NewRecorder returns a new recorder proxying requests to upstream (e.g. "https://registry-1.docker.io")
+// and writing entries to w as JSON lines.
+func NewRecorder(upstream *url.URL, w io.Writer, transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{upstream: upstream, transport: transport, w: w}
+}
+
+func (r *Recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	res, err := r.roundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	latency := time.Since(start)
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	duration := time.Since(start)
+
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	w.Write(body)
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return
+	}
+	e := Entry{
+		Method:   req.Method,
+		Path:     req.URL.RequestURI(),
+		Range:    req.Header.Get("Range"),
+		Status:   res.StatusCode,
+		Header:   res.Header,
+		Body:     body,
+		Latency:  latency,
+		Duration: duration,
+	}
+	r.wMu.Lock()
+	defer r.wMu.Unlock()
+	if err := json.NewEncoder(r.w).Encode(&e); err != nil {
+		log.G(req.Context()).WithError(err).Warnf("failed to record response of %q", e.Path)
+	}
+}
+
+func (r *Recorder) roundTrip(req *http.Request) (*http.Response, error) {
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	outReq.URL.Scheme = r.upstream.Scheme
+	outReq.URL.Host = r.upstream.Host
+	outReq.Host = r.upstream.Host
+	for i := 0; i < maxRedirects; i++ {
+		res, err := r.transport.RoundTrip(outReq)
+		if err != nil {
+			return nil, err
+		}
+		loc := res.Header.Get("Location")
+		if res.StatusCode < 300 || res.StatusCode >= 400 || loc == "" {
+			return res, nil
+		}
+		res.Body.Close()
+		u, err := outReq.URL.Parse(loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect location %q: %w", loc, err)
+		}
+		redirected, err := http.NewRequestWithContext(req.Context(), req.Method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if rng := req.Header.Get("Range"); rng != "" {
+			redirected.Header.Set("Range", rng)
+		}
+		outReq = redirected
+	}
+	return nil, fmt.Errorf("too many redirects")
+}
+
+// ReplayOption is an option for Replayer.
+type ReplayOption func(*Replayer)
+
+// WithoutDelay disables reproducing the recorded latency of responses.
+func WithoutDelay() ReplayOption {
+	return func(r *Replayer) {
+		r.noDelay = true
+	}
+}
+
+// Replayer is a registry serving the recorded responses. A request that exactly matches
+// a recorded one gets the recorded response. Range requests of blobs that don't match any
+// recorded request are served as long as the requested bytes are contained in the recorded
+// responses of that blob, so that the fixture can be used for different fetch strategies.
+type Replayer struct {
+	entries map[string]Entry
+	blobs   map[string]*blobContents
+	noDelay bool
+}
+
+// NewReplayer returns a new replayer of the passed entries.
+func NewReplayer(entries []Entry, opts ...ReplayOption) (*Replayer, error) {
+	r := &Replayer{
+		entries: make(map[string]Entry),
+		blobs:   make(map[string]*blobContents),
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	for _, e := range entries {
+		r.entries[entryKey(e.Method, e.Path, e.Range)] = e
+		if e.Method != http.MethodGet || !strings.Contains(e.Path, "/blobs/") {
+			continue
+		}
+		b, ok := r.blobs[e.Path]
+		if !ok {
+			b = &blobContents{size: -1, header: make(http.Header)}
+			r.blobs[e.Path] = b
+		}
+		if err := b.add(e); err != nil {
+			return nil, fmt.Errorf("failed to load response of %q: %w", e.Path, err)
+		}
+	}
+	return r, nil
+}
+
+func entryKey(method, path, rng string) string {
+	return method + " " + path + " " + rng
+}
+
+func (r *Replayer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if e, ok := r.entries[entryKey(req.Method, req.URL.RequestURI(), req.Header.Get("Range"))]; ok {
+		r.delay(e.Latency)
+		for k, v := range e.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(e.Status)
+		r.delay(e.Duration - e.Latency)
+		w.Write(e.Body)
+		return
+	}
+	b, ok := r.blobs[req.URL.RequestURI()]
+	if !ok || b.size < 0 || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		http.Error(w, "not recorded", http.StatusNotFound)
+		return
+	}
+	ranges, err := parseRanges(req.Header.Get("Range"), b.size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	for _, rg := range ranges {
+		if !b.covers(rg[0], rg[1]) {
+			http.Error(w, fmt.Sprintf("range %d-%d not recorded", rg[0], rg[1]-1), http.StatusNotFound)
+			return
+		}
+	}
+	r.delay(b.latency)
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	http.ServeContent(w, req, "", time.Time{}, io.NewSectionReader(b, 0, b.size))
+}
+
+func (r *Replayer) delay(d time.Duration) {
+	if !r.noDelay && d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// blobContents is the recorded contents of a blob. Only parts of the blob can be recorded.
+type blobContents struct {
+	size    int64
+	regions []region
+	header  http.Header
+	latency time.Duration // the maximum latency among responses of this blob
+}
+
+type region struct {
+	off  int64
+	data []byte
+}
+
+func (b *blobContents) add(e Entry) error {
+	if e.Latency > b.latency {
+		b.latency = e.Latency
+	}
+	if v := e.Header.Get("Docker-Content-Digest"); v != "" {
+		b.header.Set("Docker-Content-Digest", v)
+	}
+	switch e.Status {
+	case http.StatusOK:
+		b.header.Set("Content-Type", e.Header.Get("Content-Type"))
+		b.size = int64(len(e.Body))
+		b.regions = append(b.regions, region{0, e.Body})
+	case http.StatusPartialContent:
+		mediaType, params, _ := mime.ParseMediaType(e.Header.Get("Content-Type"))
+		if mediaType != "multipart/byteranges" {
+			b.header.Set("Content-Type", e.Header.Get("Content-Type"))
+			if err := b.addPart(e.Header.Get("Content-Range"), e.Body); err != nil {
+				return err
+			}
+			break
+		}
+		mr := multipart.NewReader(bytes.NewReader(e.Body), params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(p)
+			if err != nil {
+				return err
+			}
+			if err := b.addPart(p.Header.Get("Content-Range"), data); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Slice(b.regions, func(i, j int) bool { return b.regions[i].off < b.regions[j].off })
+	return nil
+}
+
+func (b *blobContents) addPart(contentRange string, data []byte) error {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return fmt.Errorf("unexpected Content-Range %q: %w", contentRange, err)
+	}
+	if end-start+1 != int64(len(data)) {
+		return fmt.Errorf("Content-Range %q doesn't match the size %d", contentRange, len(data))
+	}
+	b.size = size
+	b.regions = append(b.regions, region{start, data})
+	return nil
+}
+
+// covers reports whether the bytes in [start, end) are recorded.
+func (b *blobContents) covers(start, end int64) bool {
+	for _, rg := range b.regions {
+		if rg.off > start {
+			break
+		}
+		if rgEnd := rg.off + int64(len(rg.data)); rgEnd > start {
+			start = rgEnd
+		}
+	}
+	return start >= end
+}
+
+func (b *blobContents) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= b.size {
+			return n, io.EOF
+		}
+		found := false
+		for _, rg := range b.regions {
+			if rg.off <= cur && cur < rg.off+int64(len(rg.data)) {
+				n += copy(p[n:], rg.data[cur-rg.off:])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return n, fmt.Errorf("offset %d not recorded", cur)
+		}
+	}
+	return n, nil
+}
+
+// parseRanges parses the value of the Range header into [start, end) pairs.
+// Empty value means the entire blob.
+func parseRanges(s string, size int64) (ranges [][2]int64, _ error) {
+	if s == "" {
+		return [][2]int64{{0, size}}, nil
+	}
+	if !strings.HasPrefix(s, "bytes=") {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+	for _, spec := range strings.Split(strings.TrimPrefix(s, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		startS, endS := spec[:i], spec[i+1:]
+		var start, end int64
+		if startS == "" { // suffix range
+			n, err := strconv.ParseInt(endS, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q: %w", s, err)
+			}
+			if n > size {
+				n = size
+			}
+			start, end = size-n, size
+		} else {
+			var err error
+			if start, err = strconv.ParseInt(startS, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid range %q: %w", s, err)
+			}
+			end = size
+			if endS != "" {
+				e, err := strconv.ParseInt(endS, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid range %q: %w", s, err)
+				}
+				if e+1 < end {
+					end = e + 1
+				}
+			}
+		}
+		if start >= size || start >= end {
+			return nil, fmt.Errorf("unsatisfiable range %q", s)
+		}
+		ranges = append(ranges, [2]int64{start, end})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package registryreplay
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const sampleBlobPath = "/v2/test/blobs/sha256:0000"
+
+func TestRecordAndReplay(t *testing.T) {
+	blob := make([]byte, 1000)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect" + sampleBlobPath:
+			http.Redirect(w, r, sampleBlobPath, http.StatusTemporaryRedirect)
+		case sampleBlobPath:
+			w.Header().Set("Docker-Content-Digest", "sha256:0000")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fixture bytes.Buffer
+	recorder := httptest.NewServer(NewRecorder(u, &fixture, nil))
+	for _, rng := range []string{"bytes=0-99", "bytes=100-199,300-399", "bytes=200-299"} {
+		res := get(t, recorder.URL+sampleBlobPath, rng)
+		if res.StatusCode != http.StatusPartialContent {
+			t.Fatalf("unexpected status %d for %q", res.StatusCode, rng)
+		}
+	}
+	if res := get(t, recorder.URL+"/redirect"+sampleBlobPath, "bytes=900-999"); res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("redirect must be followed by recorder: %d", res.StatusCode)
+	}
+	if res := get(t, recorder.URL+"/v2/", ""); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	recorder.Close()
+
+	entries, err := ReadEntries(&fixture)
+	if err != nil {
+		t.Fatalf("failed to read entries: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("4 entries must be recorded but got %d", len(entries))
+	}
+	replayer, err := NewReplayer(entries, WithoutDelay())
+	if err != nil {
+		t.Fatalf("failed to create replayer: %v", err)
+	}
+	srv := httptest.NewServer(replayer)
+	defer srv.Close()
+
+	redirectedPath := "/redirect" + sampleBlobPath
+	tests := []struct {
+		path   string
+		rng    string
+		status int
+		want   []byte
+	}{
+		{path: sampleBlobPath, rng: "bytes=0-99", status: http.StatusPartialContent, want: blob[0:100]},
+		{path: sampleBlobPath, rng: "bytes=50-349", status: http.StatusPartialContent, want: blob[50:350]},
+		{path: redirectedPath, rng: "bytes=-50", status: http.StatusPartialContent, want: blob[950:]},
+		{path: sampleBlobPath, rng: "bytes=350-450", status: http.StatusNotFound},
+		{path: sampleBlobPath, rng: "", status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		res := get(t, srv.URL+tt.path, tt.rng)
+		if res.StatusCode != tt.status {
+			t.Errorf("%q: status = %d; want %d", tt.rng, res.StatusCode, tt.status)
+			continue
+		}
+		if tt.want == nil {
+			continue
+		}
+		got, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%q: unexpected contents", tt.rng)
+		}
+		if d := res.Header.Get("Docker-Content-Digest"); d != "sha256:0000" {
+			t.Errorf("%q: unexpected digest header %q", tt.rng, d)
+		}
+	}
+}
+
+func get(t *testing.T, u, rng string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
@@ -0,0 +1,244 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package sandbox restricts system calls available to the snapshotter process to reduce
+// the impact of bugs in parsing untrusted image contents (e.g. TOCs and tar headers).
+//
+// Landlock isn't used because processes restricted by Landlock can't mount filesystems,
+// which the snapshotter needs to do for serving layers.
+package sandbox
+
+import "errors"
+
+// ErrUnsupported is returned when the sandbox isn't supported on this platform.
+var ErrUnsupported = errors.New("sandbox is not supported on this platform")
+
+// AllowedSyscalls is the list of system calls allowed by ApplySeccomp. This covers the
+// system calls used by the snapshotter (i.e. the Go runtime, FUSE, mounting and networking)
+// and by its child processes (e.g. fusermount). Legacy system calls of amd64 (e.g. open and
+// stat) are allowed as well on the architecture.
+var AllowedSyscalls = []string{
+	"accept",
+	"accept4",
+	"bind",
+	"brk",
+	"capget",
+	"capset",
+	"chdir",
+	"chroot",
+	"clock_getres",
+	"clock_gettime",
+	"clock_nanosleep",
+	"clone",
+	"clone3",
+	"close",
+	"close_range",
+	"connect",
+	"copy_file_range",
+	"dup",
+	"dup3",
+	"epoll_create1",
+	"epoll_ctl",
+	"epoll_pwait",
+	"epoll_pwait2",
+	"eventfd2",
+	"execve",
+	"execveat",
+	"exit",
+	"exit_group",
+	"faccessat",
+	"faccessat2",
+	"fadvise64",
+	"fallocate",
+	"fchdir",
+	"fchmod",
+	"fchmodat",
+	"fchown",
+	"fchownat",
+	"fcntl",
+	"fdatasync",
+	"fgetxattr",
+	"flistxattr",
+	"flock",
+	"fremovexattr",
+	"fsetxattr",
+	"fstat",
+	"fstatfs",
+	"fsync",
+	"ftruncate",
+	"futex",
+	"getcpu",
+	"getcwd",
+	"getdents64",
+	"getegid",
+	"geteuid",
+	"getgid",
+	"getgroups",
+	"getitimer",
+	"getpeername",
+	"getpgid",
+	"getpid",
+	"getppid",
+	"getpriority",
+	"getrandom",
+	"getresgid",
+	"getresuid",
+	"getrlimit",
+	"getrusage",
+	"getsid",
+	"getsockname",
+	"getsockopt",
+	"gettid",
+	"gettimeofday",
+	"getuid",
+	"getxattr",
+	"inotify_add_watch",
+	"inotify_init1",
+	"inotify_rm_watch",
+	"ioctl",
+	"kill",
+	"lgetxattr",
+	"linkat",
+	"listen",
+	"listxattr",
+	"llistxattr",
+	"lremovexattr",
+	"lseek",
+	"lsetxattr",
+	"madvise",
+	"membarrier",
+	"memfd_create",
+	"mincore",
+	"mkdirat",
+	"mknodat",
+	"mlock",
+	"mmap",
+	"mount",
+	"mprotect",
+	"mremap",
+	"msync",
+	"munlock",
+	"munmap",
+	"nanosleep",
+	"newfstatat",
+	"openat",
+	"openat2",
+	"pidfd_open",
+	"pidfd_send_signal",
+	"pipe2",
+	"ppoll",
+	"prctl",
+	"pread64",
+	"preadv",
+	"preadv2",
+	"prlimit64",
+	"pselect6",
+	"pwrite64",
+	"pwritev",
+	"pwritev2",
+	"read",
+	"readahead",
+	"readlinkat",
+	"readv",
+	"recvfrom",
+	"recvmmsg",
+	"recvmsg",
+	"removexattr",
+	"renameat",
+	"renameat2",
+	"restart_syscall",
+	"rseq",
+	"rt_sigaction",
+	"rt_sigpending",
+	"rt_sigprocmask",
+	"rt_sigqueueinfo",
+	"rt_sigreturn",
+	"rt_sigsuspend",
+	"rt_sigtimedwait",
+	"sched_getaffinity",
+	"sched_getattr",
+	"sched_getparam",
+	"sched_getscheduler",
+	"sched_setaffinity",
+	"sched_yield",
+	"sendfile",
+	"sendmmsg",
+	"sendmsg",
+	"sendto",
+	"set_robust_list",
+	"set_tid_address",
+	"setfsgid",
+	"setfsuid",
+	"setgid",
+	"setgroups",
+	"setitimer",
+	"setpgid",
+	"setpriority",
+	"setregid",
+	"setresgid",
+	"setresuid",
+	"setreuid",
+	"setrlimit",
+	"setsid",
+	"setsockopt",
+	"setuid",
+	"setxattr",
+	"shutdown",
+	"sigaltstack",
+	"signalfd4",
+	"socket",
+	"socketpair",
+	"splice",
+	"statfs",
+	"statx",
+	"symlinkat",
+	"sync",
+	"sync_file_range",
+	"syncfs",
+	"sysinfo",
+	"tee",
+	"tgkill",
+	"timer_create",
+	"timer_delete",
+	"timer_getoverrun",
+	"timer_gettime",
+	"timer_settime",
+	"timerfd_create",
+	"timerfd_gettime",
+	"timerfd_settime",
+	"times",
+	"tkill",
+	"truncate",
+	"umask",
+	"umount2",
+	"uname",
+	"unlinkat",
+	"unshare",
+	"utimensat",
+	"vmsplice",
+	"wait4",
+	"waitid",
+	"write",
+	"writev",
+}
+
+// ApplySeccomp installs a seccomp filter to all threads of the current process that
+// fails system calls not listed in AllowedSyscalls with EPERM. System calls of foreign
+// architectures (e.g. 32bit compatible ones) are denied as well. The filter can't be
+// removed and is inherited by child processes.
+func ApplySeccomp() error {
+	return applySeccomp(AllowedSyscalls)
+}
@@ -0,0 +1,305 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants of seccomp(2) defined here not to depend on the version of x/sys.
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	// offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+var syscallNumbers = map[string]uint32{
+	"accept":             unix.SYS_ACCEPT,
+	"accept4":            unix.SYS_ACCEPT4,
+	"bind":               unix.SYS_BIND,
+	"brk":                unix.SYS_BRK,
+	"capget":             unix.SYS_CAPGET,
+	"capset":             unix.SYS_CAPSET,
+	"chdir":              unix.SYS_CHDIR,
+	"chroot":             unix.SYS_CHROOT,
+	"clock_getres":       unix.SYS_CLOCK_GETRES,
+	"clock_gettime":      unix.SYS_CLOCK_GETTIME,
+	"clock_nanosleep":    unix.SYS_CLOCK_NANOSLEEP,
+	"clone":              unix.SYS_CLONE,
+	"clone3":             unix.SYS_CLONE3,
+	"close":              unix.SYS_CLOSE,
+	"close_range":        unix.SYS_CLOSE_RANGE,
+	"connect":            unix.SYS_CONNECT,
+	"copy_file_range":    unix.SYS_COPY_FILE_RANGE,
+	"dup":                unix.SYS_DUP,
+	"dup3":               unix.SYS_DUP3,
+	"epoll_create1":      unix.SYS_EPOLL_CREATE1,
+	"epoll_ctl":          unix.SYS_EPOLL_CTL,
+	"epoll_pwait":        unix.SYS_EPOLL_PWAIT,
+	"epoll_pwait2":       unix.SYS_EPOLL_PWAIT2,
+	"eventfd2":           unix.SYS_EVENTFD2,
+	"execve":             unix.SYS_EXECVE,
+	"execveat":           unix.SYS_EXECVEAT,
+	"exit":               unix.SYS_EXIT,
+	"exit_group":         unix.SYS_EXIT_GROUP,
+	"faccessat":          unix.SYS_FACCESSAT,
+	"faccessat2":         unix.SYS_FACCESSAT2,
+	"fadvise64":          unix.SYS_FADVISE64,
+	"fallocate":          unix.SYS_FALLOCATE,
+	"fchdir":             unix.SYS_FCHDIR,
+	"fchmod":             unix.SYS_FCHMOD,
+	"fchmodat":           unix.SYS_FCHMODAT,
+	"fchown":             unix.SYS_FCHOWN,
+	"fchownat":           unix.SYS_FCHOWNAT,
+	"fcntl":              unix.SYS_FCNTL,
+	"fdatasync":          unix.SYS_FDATASYNC,
+	"fgetxattr":          unix.SYS_FGETXATTR,
+	"flistxattr":         unix.SYS_FLISTXATTR,
+	"flock":              unix.SYS_FLOCK,
+	"fremovexattr":       unix.SYS_FREMOVEXATTR,
+	"fsetxattr":          unix.SYS_FSETXATTR,
+	"fstat":              unix.SYS_FSTAT,
+	"fstatfs":            unix.SYS_FSTATFS,
+	"fsync":              unix.SYS_FSYNC,
+	"ftruncate":          unix.SYS_FTRUNCATE,
+	"futex":              unix.SYS_FUTEX,
+	"getcpu":             unix.SYS_GETCPU,
+	"getcwd":             unix.SYS_GETCWD,
+	"getdents64":         unix.SYS_GETDENTS64,
+	"getegid":            unix.SYS_GETEGID,
+	"geteuid":            unix.SYS_GETEUID,
+	"getgid":             unix.SYS_GETGID,
+	"getgroups":          unix.SYS_GETGROUPS,
+	"getitimer":          unix.SYS_GETITIMER,
+	"getpeername":        unix.SYS_GETPEERNAME,
+	"getpgid":            unix.SYS_GETPGID,
+	"getpid":             unix.SYS_GETPID,
+	"getppid":            unix.SYS_GETPPID,
+	"getpriority":        unix.SYS_GETPRIORITY,
+	"getrandom":          unix.SYS_GETRANDOM,
+	"getresgid":          unix.SYS_GETRESGID,
+	"getresuid":          unix.SYS_GETRESUID,
+	"getrlimit":          unix.SYS_GETRLIMIT,
+	"getrusage":          unix.SYS_GETRUSAGE,
+	"getsid":             unix.SYS_GETSID,
+	"getsockname":        unix.SYS_GETSOCKNAME,
+	"getsockopt":         unix.SYS_GETSOCKOPT,
+	"gettid":             unix.SYS_GETTID,
+	"gettimeofday":       unix.SYS_GETTIMEOFDAY,
+	"getuid":             unix.SYS_GETUID,
+	"getxattr":           unix.SYS_GETXATTR,
+	"inotify_add_watch":  unix.SYS_INOTIFY_ADD_WATCH,
+	"inotify_init1":      unix.SYS_INOTIFY_INIT1,
+	"inotify_rm_watch":   unix.SYS_INOTIFY_RM_WATCH,
+	"ioctl":              unix.SYS_IOCTL,
+	"kill":               unix.SYS_KILL,
+	"lgetxattr":          unix.SYS_LGETXATTR,
+	"linkat":             unix.SYS_LINKAT,
+	"listen":             unix.SYS_LISTEN,
+	"listxattr":          unix.SYS_LISTXATTR,
+	"llistxattr":         unix.SYS_LLISTXATTR,
+	"lremovexattr":       unix.SYS_LREMOVEXATTR,
+	"lseek":              unix.SYS_LSEEK,
+	"lsetxattr":          unix.SYS_LSETXATTR,
+	"madvise":            unix.SYS_MADVISE,
+	"membarrier":         unix.SYS_MEMBARRIER,
+	"memfd_create":       unix.SYS_MEMFD_CREATE,
+	"mincore":            unix.SYS_MINCORE,
+	"mkdirat":            unix.SYS_MKDIRAT,
+	"mknodat":            unix.SYS_MKNODAT,
+	"mlock":              unix.SYS_MLOCK,
+	"mmap":               unix.SYS_MMAP,
+	"mount":              unix.SYS_MOUNT,
+	"mprotect":           unix.SYS_MPROTECT,
+	"mremap":             unix.SYS_MREMAP,
+	"msync":              unix.SYS_MSYNC,
+	"munlock":            unix.SYS_MUNLOCK,
+	"munmap":             unix.SYS_MUNMAP,
+	"nanosleep":          unix.SYS_NANOSLEEP,
+	"openat":             unix.SYS_OPENAT,
+	"openat2":            unix.SYS_OPENAT2,
+	"pidfd_open":         unix.SYS_PIDFD_OPEN,
+	"pidfd_send_signal":  unix.SYS_PIDFD_SEND_SIGNAL,
+	"pipe2":              unix.SYS_PIPE2,
+	"ppoll":              unix.SYS_PPOLL,
+	"prctl":              unix.SYS_PRCTL,
+	"pread64":            unix.SYS_PREAD64,
+	"preadv":             unix.SYS_PREADV,
+	"preadv2":            unix.SYS_PREADV2,
+	"prlimit64":          unix.SYS_PRLIMIT64,
+	"pselect6":           unix.SYS_PSELECT6,
+	"pwrite64":           unix.SYS_PWRITE64,
+	"pwritev":            unix.SYS_PWRITEV,
+	"pwritev2":           unix.SYS_PWRITEV2,
+	"read":               unix.SYS_READ,
+	"readahead":          unix.SYS_READAHEAD,
+	"readlinkat":         unix.SYS_READLINKAT,
+	"readv":              unix.SYS_READV,
+	"recvfrom":           unix.SYS_RECVFROM,
+	"recvmmsg":           unix.SYS_RECVMMSG,
+	"recvmsg":            unix.SYS_RECVMSG,
+	"removexattr":        unix.SYS_REMOVEXATTR,
+	"renameat":           unix.SYS_RENAMEAT,
+	"renameat2":          unix.SYS_RENAMEAT2,
+	"restart_syscall":    unix.SYS_RESTART_SYSCALL,
+	"rseq":               unix.SYS_RSEQ,
+	"rt_sigaction":       unix.SYS_RT_SIGACTION,
+	"rt_sigpending":      unix.SYS_RT_SIGPENDING,
+	"rt_sigprocmask":     unix.SYS_RT_SIGPROCMASK,
+	"rt_sigqueueinfo":    unix.SYS_RT_SIGQUEUEINFO,
+	"rt_sigreturn":       unix.SYS_RT_SIGRETURN,
+	"rt_sigsuspend":      unix.SYS_RT_SIGSUSPEND,
+	"rt_sigtimedwait":    unix.SYS_RT_SIGTIMEDWAIT,
+	"sched_getaffinity":  unix.SYS_SCHED_GETAFFINITY,
+	"sched_getattr":      unix.SYS_SCHED_GETATTR,
+	"sched_getparam":     unix.SYS_SCHED_GETPARAM,
+	"sched_getscheduler": unix.SYS_SCHED_GETSCHEDULER,
+	"sched_setaffinity":  unix.SYS_SCHED_SETAFFINITY,
+	"sched_yield":        unix.SYS_SCHED_YIELD,
+	"sendfile":           unix.SYS_SENDFILE,
+	"sendmmsg":           unix.SYS_SENDMMSG,
+	"sendmsg":            unix.SYS_SENDMSG,
+	"sendto":             unix.SYS_SENDTO,
+	"set_robust_list":    unix.SYS_SET_ROBUST_LIST,
+	"set_tid_address":    unix.SYS_SET_TID_ADDRESS,
+	"setfsgid":           unix.SYS_SETFSGID,
+	"setfsuid":           unix.SYS_SETFSUID,
+	"setgid":             unix.SYS_SETGID,
+	"setgroups":          unix.SYS_SETGROUPS,
+	"setitimer":          unix.SYS_SETITIMER,
+	"setpgid":            unix.SYS_SETPGID,
+	"setpriority":        unix.SYS_SETPRIORITY,
+	"setregid":           unix.SYS_SETREGID,
+	"setresgid":          unix.SYS_SETRESGID,
+	"setresuid":          unix.SYS_SETRESUID,
+	"setreuid":           unix.SYS_SETREUID,
+	"setrlimit":          unix.SYS_SETRLIMIT,
+	"setsid":             unix.SYS_SETSID,
+	"setsockopt":         unix.SYS_SETSOCKOPT,
+	"setuid":             unix.SYS_SETUID,
+	"setxattr":           unix.SYS_SETXATTR,
+	"shutdown":           unix.SYS_SHUTDOWN,
+	"sigaltstack":        unix.SYS_SIGALTSTACK,
+	"signalfd4":          unix.SYS_SIGNALFD4,
+	"socket":             unix.SYS_SOCKET,
+	"socketpair":         unix.SYS_SOCKETPAIR,
+	"splice":             unix.SYS_SPLICE,
+	"statfs":             unix.SYS_STATFS,
+	"statx":              unix.SYS_STATX,
+	"symlinkat":          unix.SYS_SYMLINKAT,
+	"sync":               unix.SYS_SYNC,
+	"sync_file_range":    unix.SYS_SYNC_FILE_RANGE,
+	"syncfs":             unix.SYS_SYNCFS,
+	"sysinfo":            unix.SYS_SYSINFO,
+	"tee":                unix.SYS_TEE,
+	"tgkill":             unix.SYS_TGKILL,
+	"timer_create":       unix.SYS_TIMER_CREATE,
+	"timer_delete":       unix.SYS_TIMER_DELETE,
+	"timer_getoverrun":   unix.SYS_TIMER_GETOVERRUN,
+	"timer_gettime":      unix.SYS_TIMER_GETTIME,
+	"timer_settime":      unix.SYS_TIMER_SETTIME,
+	"timerfd_create":     unix.SYS_TIMERFD_CREATE,
+	"timerfd_gettime":    unix.SYS_TIMERFD_GETTIME,
+	"timerfd_settime":    unix.SYS_TIMERFD_SETTIME,
+	"times":              unix.SYS_TIMES,
+	"tkill":              unix.SYS_TKILL,
+	"truncate":           unix.SYS_TRUNCATE,
+	"umask":              unix.SYS_UMASK,
+	"umount2":            unix.SYS_UMOUNT2,
+	"uname":              unix.SYS_UNAME,
+	"unlinkat":           unix.SYS_UNLINKAT,
+	"unshare":            unix.SYS_UNSHARE,
+	"utimensat":          unix.SYS_UTIMENSAT,
+	"vmsplice":           unix.SYS_VMSPLICE,
+	"wait4":              unix.SYS_WAIT4,
+	"waitid":             unix.SYS_WAITID,
+	"write":              unix.SYS_WRITE,
+	"writev":             unix.SYS_WRITEV,
+}
+
+func applySeccomp(allowed []string) error {
+	prog, err := seccompProgram(append(allowed, archSyscalls...))
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		// unprivileged processes can install filters only with no_new_privs
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	}
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %w", errno)
+	} else if r != 0 {
+		return fmt.Errorf("failed to synchronize seccomp filter with thread %d", r)
+	}
+	return nil
+}
+
+// seccompProgram returns a BPF program failing the syscalls not allowed with EPERM.
+func seccompProgram(allowed []string) ([]unix.SockFilter, error) {
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetErrno | uint32(unix.EPERM)}
+	allow := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow}
+	jeq := func(k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: jt, Jf: jf, K: k}
+	}
+	load := func(off uint32) unix.SockFilter {
+		return unix.SockFilter{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: off}
+	}
+
+	prog := []unix.SockFilter{
+		load(seccompDataArch),
+		jeq(auditArch, 1, 0),
+		deny,
+		load(seccompDataNr),
+	}
+	if x32SyscallBit != 0 {
+		prog = append(prog,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jt: 0, Jf: 1, K: x32SyscallBit},
+			deny,
+		)
+	}
+	for _, name := range allowed {
+		nr, ok := syscallNumbers[name]
+		if !ok {
+			nr, ok = archSyscallNumbers[name]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown syscall %q", name)
+		}
+		prog = append(prog, jeq(nr, 0, 1), allow)
+	}
+	return append(prog, deny), nil
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const (
+	auditArch = unix.AUDIT_ARCH_X86_64
+
+	// x32SyscallBit is set to the numbers of syscalls of x32 ABI, which share the
+	// architecture with x86_64.
+	x32SyscallBit = 0x40000000
+)
+
+// archSyscalls are the legacy system calls allowed only on amd64, which are still used by
+// the Go runtime and child processes.
+var archSyscalls = []string{
+	"access",
+	"alarm",
+	"arch_prctl",
+	"chmod",
+	"chown",
+	"creat",
+	"dup2",
+	"epoll_create",
+	"epoll_wait",
+	"eventfd",
+	"fork",
+	"futimesat",
+	"getdents",
+	"getpgrp",
+	"inotify_init",
+	"lchown",
+	"link",
+	"lstat",
+	"mkdir",
+	"mknod",
+	"open",
+	"pause",
+	"pipe",
+	"poll",
+	"readlink",
+	"rename",
+	"rmdir",
+	"select",
+	"signalfd",
+	"stat",
+	"symlink",
+	"time",
+	"unlink",
+	"utime",
+	"utimes",
+	"vfork",
+}
+
+// archSyscallNumbers are the numbers of system calls only available on amd64.
+var archSyscallNumbers = map[string]uint32{
+	"access":       unix.SYS_ACCESS,
+	"alarm":        unix.SYS_ALARM,
+	"arch_prctl":   unix.SYS_ARCH_PRCTL,
+	"chmod":        unix.SYS_CHMOD,
+	"chown":        unix.SYS_CHOWN,
+	"creat":        unix.SYS_CREAT,
+	"dup2":         unix.SYS_DUP2,
+	"epoll_create": unix.SYS_EPOLL_CREATE,
+	"epoll_wait":   unix.SYS_EPOLL_WAIT,
+	"eventfd":      unix.SYS_EVENTFD,
+	"fork":         unix.SYS_FORK,
+	"futimesat":    unix.SYS_FUTIMESAT,
+	"getdents":     unix.SYS_GETDENTS,
+	"getpgrp":      unix.SYS_GETPGRP,
+	"inotify_init": unix.SYS_INOTIFY_INIT,
+	"lchown":       unix.SYS_LCHOWN,
+	"link":         unix.SYS_LINK,
+	"lstat":        unix.SYS_LSTAT,
+	"mkdir":        unix.SYS_MKDIR,
+	"mknod":        unix.SYS_MKNOD,
+	"newfstatat":   unix.SYS_NEWFSTATAT,
+	"open":         unix.SYS_OPEN,
+	"pause":        unix.SYS_PAUSE,
+	"pipe":         unix.SYS_PIPE,
+	"poll":         unix.SYS_POLL,
+	"readlink":     unix.SYS_READLINK,
+	"rename":       unix.SYS_RENAME,
+	"rmdir":        unix.SYS_RMDIR,
+	"select":       unix.SYS_SELECT,
+	"signalfd":     unix.SYS_SIGNALFD,
+	"stat":         unix.SYS_STAT,
+	"symlink":      unix.SYS_SYMLINK,
+	"time":         unix.SYS_TIME,
+	"unlink":       unix.SYS_UNLINK,
+	"utime":        unix.SYS_UTIME,
+	"utimes":       unix.SYS_UTIMES,
+	"vfork":        unix.SYS_VFORK,
+}
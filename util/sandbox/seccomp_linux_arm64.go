@@ -0,0 +1,32 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const (
+	auditArch     = unix.AUDIT_ARCH_AARCH64
+	x32SyscallBit = 0
+)
+
+// archSyscalls are the system calls allowed only on arm64.
+var archSyscalls []string
+
+// archSyscallNumbers are the numbers of system calls named differently on arm64.
+var archSyscallNumbers = map[string]uint32{
+	"newfstatat": unix.SYS_FSTATAT,
+}
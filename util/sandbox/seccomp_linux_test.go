@@ -0,0 +1,76 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package sandbox
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+const seccompTestEnv = "STARGZ_SANDBOX_TEST_CHILD"
+
+func TestApplySeccomp(t *testing.T) {
+	if os.Getenv(seccompTestEnv) != "" {
+		// child process where the filter is applied
+		if err := ApplySeccomp(); err != nil {
+			t.Fatalf("failed to apply seccomp: %v", err)
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_KEYCTL, 0, 0, 0); errno != unix.EPERM {
+			t.Fatalf("keyctl must fail with EPERM; got %v", errno)
+		}
+		if err := unix.PtraceAttach(os.Getppid()); !errors.Is(err, unix.EPERM) {
+			t.Fatalf("ptrace must fail with EPERM; got %v", err)
+		}
+		if err := unix.Acct(""); !errors.Is(err, unix.EPERM) {
+			t.Fatalf("acct must fail with EPERM; got %v", err)
+		}
+		if _, err := os.Getwd(); err != nil {
+			t.Fatalf("allowed syscall failed: %v", err)
+		}
+		// child processes (e.g. fusermount) must work under the filter
+		if out, err := exec.Command("sh", "-c", "ls / > /dev/null && echo ok").CombinedOutput(); err != nil || string(out) != "ok\n" {
+			t.Fatalf("failed to run child process under the filter: %v: %s", err, out)
+		}
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApplySeccomp$")
+	cmd.Env = append(os.Environ(), seccompTestEnv+"=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("child process failed: %v: %s", err, out)
+	}
+}
+
+func TestSeccompProgramAllowedSyscalls(t *testing.T) {
+	if _, err := seccompProgram(append(AllowedSyscalls, archSyscalls...)); err != nil {
+		t.Errorf("allowed syscalls must be known: %v", err)
+	}
+}
+
+func TestSeccompProgramUnknownSyscall(t *testing.T) {
+	if _, err := seccompProgram([]string{"no_such_syscall"}); err == nil {
+		t.Errorf("unknown syscall must be rejected")
+	}
+}
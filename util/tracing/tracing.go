@@ -0,0 +1,263 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package tracing records spans of stages of long-running pipelines (e.g. conversion
+// and optimization of images) so that users can tell which stage dominates the time.
+// Spans can be summarized as a tree of durations and exported in OTLP/JSON, which can
+// be sent to tracing backends by OpenTelemetry Collector.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// Tracer records spans of a trace.
+type Tracer struct {
+	traceID string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewTracer returns a tracer of a new trace.
+func NewTracer() *Tracer {
+	return &Tracer{traceID: newID(16)}
+}
+
+// WithTracer returns a context that records spans started with it to the tracer.
+func WithTracer(ctx context.Context, t *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// Span is a timed stage of a trace.
+type Span struct {
+	tracer   *Tracer
+	id       string
+	parentID string
+	name     string
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+// Start starts a span of the stage as a child of the span in the context. This returns
+// a nil span, whose methods are nop, if the context doesn't have a tracer.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	t, ok := ctx.Value(tracerKey{}).(*Tracer)
+	if !ok || t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, id: newID(8), name: name, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		s.parentID = parent.id
+	}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]string)
+	}
+	s.attributes[key] = value
+}
+
+// End ends the span. err is recorded as the status of the span if not nil.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+		if err != nil {
+			s.err = err.Error()
+		}
+	}
+}
+
+func (s *Span) snapshot() (end time.Time, attrs map[string]string, err string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end = s.end
+	if end.IsZero() {
+		end = time.Now() // not ended yet
+	}
+	attrs = make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		attrs[k] = v
+	}
+	return end, attrs, s.err
+}
+
+func (t *Tracer) list() []*Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Span{}, t.spans...)
+}
+
+// WriteSummary writes the tree of the spans with their durations to w.
+func (t *Tracer) WriteSummary(w io.Writer) error {
+	spans := t.list()
+	children := make(map[string][]*Span)
+	for _, s := range spans {
+		children[s.parentID] = append(children[s.parentID], s)
+	}
+	var b strings.Builder
+	var walk func(parentID string, depth int)
+	walk = func(parentID string, depth int) {
+		cs := children[parentID]
+		sort.SliceStable(cs, func(i, j int) bool { return cs[i].start.Before(cs[j].start) })
+		for _, s := range cs {
+			end, attrs, err := s.snapshot()
+			line := fmt.Sprintf("%s%-*s %10s", strings.Repeat("  ", depth), 40-2*depth, s.name, end.Sub(s.start).Round(time.Millisecond))
+			for _, k := range sortedKeys(attrs) {
+				line += " " + k + "=" + attrs[k]
+			}
+			if err != "" {
+				line += " (error: " + err + ")"
+			}
+			b.WriteString(line + "\n")
+			walk(s.id, depth+1)
+		}
+	}
+	walk("", 0)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteOTLP writes the spans to w in OTLP/JSON (ExportTraceServiceRequest) as spans of the
+// service.
+func (t *Tracer) WriteOTLP(w io.Writer, service string) error {
+	var spans []otlpSpan
+	for _, s := range t.list() {
+		end, attrs, err := s.snapshot()
+		o := otlpSpan{
+			TraceID:           t.traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		}
+		for _, k := range sortedKeys(attrs) {
+			o.Attributes = append(o.Attributes, otlpAttribute{k, otlpValue{attrs[k]}})
+		}
+		if err != "" {
+			o.Status = &otlpStatus{Code: 2, Message: err} // STATUS_CODE_ERROR
+		}
+		spans = append(spans, o)
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{{"service.name", otlpValue{service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/containerd/stargz-snapshotter/util/tracing"},
+			Spans: spans,
+		}},
+	}}}
+	return json.NewEncoder(w).Encode(req)
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	if _, s := Start(context.Background(), "nop"); s != nil {
+		t.Fatalf("span must be nil without tracer")
+	}
+
+	tr := NewTracer()
+	ctx := WithTracer(context.Background(), tr)
+	ctx, root := Start(ctx, "optimize")
+	_, child := Start(ctx, "convert")
+	child.SetAttribute("digest", "sha256:aaa")
+	child.End(errors.New("failed"))
+	root.End(nil)
+
+	var sum bytes.Buffer
+	if err := tr.WriteSummary(&sum); err != nil {
+		t.Fatalf("failed to write summary: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(sum.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "optimize") || !strings.HasPrefix(lines[1], "  convert") {
+		t.Fatalf("unexpected summary:\n%s", sum.String())
+	}
+	if !strings.Contains(lines[1], "digest=sha256:aaa") || !strings.Contains(lines[1], "(error: failed)") {
+		t.Errorf("attributes and error must be summarized: %q", lines[1])
+	}
+
+	var buf bytes.Buffer
+	if err := tr.WriteOTLP(&buf, "test"); err != nil {
+		t.Fatalf("failed to write OTLP: %v", err)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatalf("failed to parse OTLP: %v", err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans; want 2", len(spans))
+	}
+	if spans[0].TraceID != spans[1].TraceID || len(spans[0].TraceID) != 32 {
+		t.Errorf("invalid trace IDs %q, %q", spans[0].TraceID, spans[1].TraceID)
+	}
+	if spans[1].ParentSpanID != spans[0].SpanID || spans[0].ParentSpanID != "" {
+		t.Errorf("invalid parent of spans")
+	}
+	if spans[1].Status == nil || spans[1].Status.Code != 2 {
+		t.Errorf("error must be recorded as status: %+v", spans[1].Status)
+	}
+}